@@ -0,0 +1,673 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// projectArchiveManifestName is the name of the manifest in a project archive.
+// It's always the first entry of the archive.
+const projectArchiveManifestName = "manifest.json"
+
+// projectArchiveManifest describes the contents of an archive
+// written by [Backend.ExportProject].
+type projectArchiveManifest struct {
+	// StoreVersion is the version of the state store the archive was exported from.
+	StoreVersion int `json:"storeVersion"`
+
+	// Project is the name of the exported project.
+	// It's empty for stores with the legacy layout.
+	Project string `json:"project,omitempty"`
+
+	// Stacks lists the exported stacks.
+	Stacks []projectArchiveStack `json:"stacks"`
+}
+
+// projectArchiveStack lists the entries of a project archive
+// that hold the files of a stack.
+//
+// Entries are named after the stack rather than after the keys they were read from
+// so that archives can be imported into stores with a different layout.
+type projectArchiveStack struct {
+	Name string `json:"name"`
+
+	// Checkpoint is the entry holding the checkpoint of the stack.
+	// Its extension matches that of the checkpoint file, e.g. ".json.gz".
+	Checkpoint string `json:"checkpoint"`
+
+	// Tags is the entry holding the tags of the stack, if it has any.
+	Tags string `json:"tags,omitempty"`
+
+	// Meta is the entry holding the metadata of the stack, if it has any.
+	Meta string `json:"meta,omitempty"`
+
+	// History lists the entries holding the files in the history directory of the stack.
+	// Their names match those of the files.
+	History []string `json:"history,omitempty"`
+}
+
+// projectArchiveFile is a file of the state store written to a project archive.
+type projectArchiveFile struct {
+	key  string // key of the file in the bucket
+	name string // name of its entry in the archive
+	size int64
+}
+
+func (b *localBackend) ExportProject(ctx context.Context, project tokens.Name, w io.Writer) (err error) {
+	ctx = withOperationID(ctx)
+	defer func() { err = operationError(ctx, err) }()
+
+	refs, err := b.projectReferences(ctx, project)
+	if err != nil {
+		return err
+	}
+
+	// The manifest has to be written first,
+	// so all files are listed before any of them are read.
+	manifest := projectArchiveManifest{Project: string(project), Stacks: []projectArchiveStack{}}
+	if b.meta != nil {
+		manifest.StoreVersion = b.meta.Version
+	}
+	var files []projectArchiveFile
+	for _, ref := range refs {
+		stk, stackFiles, err := b.listProjectArchiveFiles(ctx, ref)
+		if err != nil {
+			return fmt.Errorf("export stack %v: %w", ref, err)
+		}
+		manifest.Stacks = append(manifest.Stacks, stk)
+		files = append(files, stackFiles...)
+	}
+
+	tw := tar.NewWriter(w)
+	byts, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeArchiveHeader(tw, projectArchiveManifestName, int64(len(byts))); err != nil {
+		return err
+	}
+	if _, err := tw.Write(byts); err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+
+	for _, f := range files {
+		if err := b.writeProjectArchiveFile(ctx, tw, f); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// projectReferences returns the references of all stacks in the given project.
+// Stores with the legacy layout only have the unnamed project.
+func (b *localBackend) projectReferences(
+	ctx context.Context, project tokens.Name,
+) ([]*localBackendReference, error) {
+	_, legacy := b.store.(*legacyReferenceStore)
+	switch {
+	case legacy && project != "":
+		return nil, fmt.Errorf("project %v not found: stores with the legacy layout don't have projects", project)
+	case !legacy && project == "":
+		return nil, errors.New("project name must not be empty")
+	}
+
+	all, err := b.getLocalStacks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var refs []*localBackendReference
+	for _, ref := range all {
+		if ref.project == project {
+			refs = append(refs, ref)
+		}
+	}
+	return refs, nil
+}
+
+// listProjectArchiveFiles lists the files of the given stack that are exported,
+// with the checkpoint last.
+func (b *localBackend) listProjectArchiveFiles(
+	ctx context.Context, ref *localBackendReference,
+) (projectArchiveStack, []projectArchiveFile, error) {
+	stk := projectArchiveStack{Name: string(ref.name)}
+	dir := path.Join("stacks", string(ref.name))
+	var files []projectArchiveFile
+
+	tagsPath := stackTagsPath(ref)
+	if attrs, err := b.bucket.Attributes(ctx, tagsPath); err == nil {
+		stk.Tags = path.Join(dir, "tags.json")
+		files = append(files, projectArchiveFile{key: tagsPath, name: stk.Tags, size: attrs.Size})
+	} else if gcerrors.Code(err) != gcerrors.NotFound {
+		return stk, nil, fmt.Errorf("read tags: %w", err)
+	}
+
+	metaPath := stackMetaPath(ref)
+	if attrs, err := b.bucket.Attributes(ctx, metaPath); err == nil {
+		stk.Meta = path.Join(dir, "meta.json")
+		files = append(files, projectArchiveFile{key: metaPath, name: stk.Meta, size: attrs.Size})
+	} else if gcerrors.Code(err) != gcerrors.NotFound {
+		return stk, nil, fmt.Errorf("read stack metadata: %w", err)
+	}
+
+	history, err := ref.listHistory(ctx)
+	if err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+		return stk, nil, fmt.Errorf("list history: %w", err)
+	}
+	// Archives hold the history without its shards.
+	for _, file := range uniqueHistoryFiles(history) {
+		if file.IsDir {
+			continue
+		}
+		name := path.Join(dir, "history", path.Base(file.Key))
+		stk.History = append(stk.History, name)
+		files = append(files, projectArchiveFile{key: file.Key, name: name, size: file.Size})
+	}
+
+	// The checkpoint is written last so that a stack only exists
+	// once all of its files are imported.
+	chkpath := b.stackPath(ctx, ref)
+	attrs, err := b.bucket.Attributes(ctx, chkpath)
+	if err != nil {
+		return stk, nil, fmt.Errorf("read checkpoint: %w", err)
+	}
+	ext := strings.TrimPrefix(chkpath, filepath.ToSlash(ref.StackBasePath()))
+	stk.Checkpoint = path.Join(dir, "checkpoint"+ext)
+	files = append(files, projectArchiveFile{key: chkpath, name: stk.Checkpoint, size: attrs.Size})
+	return stk, files, nil
+}
+
+// writeProjectArchiveFile copies a file of the state store to the archive,
+// streaming it if the bucket supports it.
+func (b *localBackend) writeProjectArchiveFile(ctx context.Context, tw *tar.Writer, f projectArchiveFile) error {
+	r, err := newBucketReader(ctx, b.bucket, f.key)
+	if errors.Is(err, errStreamingUnsupported) {
+		var byts []byte
+		byts, err = b.bucket.ReadAll(ctx, f.key)
+		if err == nil {
+			// The size is exact if the file was read in full.
+			f.size = int64(len(byts))
+			r = io.NopCloser(bytes.NewReader(byts))
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("read %v: %w", f.key, err)
+	}
+	defer contract.IgnoreClose(r)
+
+	if err := writeArchiveHeader(tw, f.name, f.size); err != nil {
+		return err
+	}
+	// The header can't be rewritten,
+	// so files that changed size since they were listed can't be exported.
+	_, err = io.CopyN(tw, r, f.size)
+	if errors.Is(err, io.EOF) {
+		return fmt.Errorf("export %v: file changed while it was exported", f.key)
+	}
+	if err != nil {
+		return fmt.Errorf("export %v: %w", f.key, err)
+	}
+	if n, _ := r.Read(make([]byte, 1)); n > 0 {
+		return fmt.Errorf("export %v: file changed while it was exported", f.key)
+	}
+	return nil
+}
+
+func writeArchiveHeader(tw *tar.Writer, name string, size int64) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0o644,
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("write %v: %w", name, err)
+	}
+	return nil
+}
+
+// ProjectImportConflict decides what [Backend.ImportProject] does
+// with stacks in the archive that already exist.
+type ProjectImportConflict string
+
+const (
+	// ProjectImportFail fails the import before anything is restored
+	// if any of the stacks already exists.
+	// This is the default.
+	ProjectImportFail ProjectImportConflict = "fail"
+
+	// ProjectImportSkip leaves stacks that already exist as they are.
+	ProjectImportSkip ProjectImportConflict = "skip"
+
+	// ProjectImportOverwrite replaces stacks that already exist.
+	// Their checkpoints are backed up first,
+	// and their history files that aren't in the archive are removed.
+	ProjectImportOverwrite ProjectImportConflict = "overwrite"
+)
+
+// ImportProjectOptions customizes the behavior of [Backend.ImportProject].
+type ImportProjectOptions struct {
+	// Project is the project the stacks are restored into.
+	// Defaults to the project they were exported from.
+	Project tokens.Name
+
+	// OnConflict decides what happens to stacks that already exist.
+	// Defaults to ProjectImportFail.
+	OnConflict ProjectImportConflict
+}
+
+// ImportProjectReport is the result of [Backend.ImportProject].
+type ImportProjectReport struct {
+	// Imported lists the fully qualified names of the stacks that were restored.
+	Imported []string `json:"imported,omitempty"`
+
+	// Skipped lists the stacks that were left as they were
+	// because they already exist.
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// projectImportStack is a stack being restored from a project archive.
+type projectImportStack struct {
+	ref    *localBackendReference
+	exists bool
+	skip   bool
+
+	// files maps the names of the entries of the stack
+	// to the keys they're restored to.
+	files map[string]string
+
+	// checkpoint is the name of the entry holding the checkpoint.
+	checkpoint string
+
+	// checksum is the checksum of the checkpoint once it's staged.
+	checksum string
+}
+
+// projectImportStagingDir is the directory that project archives are staged in
+// before the stacks in them are restored.
+func projectImportStagingDir() string {
+	return path.Join(workspace.BookkeepingDir, "imports")
+}
+
+func (b *localBackend) ImportProject(
+	ctx context.Context, r io.Reader, opts *ImportProjectOptions,
+) (_ *ImportProjectReport, err error) {
+	ctx = withOperationID(ctx)
+	defer func() { err = operationError(ctx, err) }()
+
+	if opts == nil {
+		opts = &ImportProjectOptions{}
+	}
+	onConflict := opts.OnConflict
+	switch onConflict {
+	case "":
+		onConflict = ProjectImportFail
+	case ProjectImportFail, ProjectImportSkip, ProjectImportOverwrite:
+	default:
+		return nil, fmt.Errorf("unknown conflict policy %q", onConflict)
+	}
+	if err := b.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+	if hdr.Name != projectArchiveManifestName {
+		return nil, fmt.Errorf("not a project archive: expected %v, got %v", projectArchiveManifestName, hdr.Name)
+	}
+	var manifest projectArchiveManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+	if err := b.checkProjectArchiveVersion(&manifest); err != nil {
+		return nil, err
+	}
+
+	project := opts.Project
+	if project == "" {
+		project = tokens.Name(manifest.Project)
+	}
+	stacks, err := b.planProjectImport(ctx, project, &manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ImportProjectReport{}
+	for _, stk := range stacks {
+		if !stk.exists {
+			continue
+		}
+		switch onConflict {
+		case ProjectImportFail:
+			return nil, fmt.Errorf("stack %v already exists", stk.ref)
+		case ProjectImportSkip:
+			stk.skip = true
+			report.Skipped = append(report.Skipped, string(stk.ref.FullyQualifiedName()))
+		}
+	}
+
+	// Stage the whole archive before restoring any stack
+	// so that a truncated or malformed archive doesn't restore only some of them.
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	staging := path.Join(projectImportStagingDir(), id.String())
+	staged := make(map[string]string)
+	defer func() {
+		keys := make([]string, 0, len(staged))
+		for _, key := range staged {
+			keys = append(keys, key)
+		}
+		if err := deleteAll(ctx, b.bucket, keys, b.deleteConcurrency); err != nil {
+			logging.V(5).Infof("error deleting staged import %v: %v", staging, err)
+		}
+	}()
+
+	owners := make(map[string]*projectImportStack)
+	for _, stk := range stacks {
+		for name := range stk.files {
+			owners[name] = stk
+		}
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read archive: %w", err)
+		}
+		stk, ok := owners[hdr.Name]
+		if !ok {
+			return nil, fmt.Errorf("archive entry %v is not listed in the manifest", hdr.Name)
+		}
+		if stk.skip {
+			continue
+		}
+		if _, ok := staged[hdr.Name]; ok {
+			return nil, fmt.Errorf("archive entry %v is listed more than once", hdr.Name)
+		}
+
+		// Entries are staged under their position in the archive
+		// since their names can't be trusted to be valid keys.
+		key := path.Join(staging, strconv.Itoa(len(staged)))
+		staged[hdr.Name] = key
+		hash := newChecksumHash()
+		if err := writeStream(ctx, b.bucket, key, io.TeeReader(tr, hash)); err != nil {
+			return nil, fmt.Errorf("stage %v: %w", hdr.Name, err)
+		}
+		if hdr.Name == stk.checkpoint {
+			stk.checksum = formatChecksum(hash)
+		}
+	}
+	for name, stk := range owners {
+		if _, ok := staged[name]; !ok && !stk.skip {
+			return nil, fmt.Errorf("import stack %v: archive entry %v is missing", stk.ref, name)
+		}
+	}
+
+	for _, stk := range stacks {
+		if stk.skip {
+			continue
+		}
+		if err := b.commitProjectImport(ctx, stk, staged); err != nil {
+			return report, fmt.Errorf("import stack %v: %w", stk.ref, err)
+		}
+		report.Imported = append(report.Imported, string(stk.ref.FullyQualifiedName()))
+	}
+	return report, nil
+}
+
+// checkProjectArchiveVersion checks that the stacks in an archive
+// can be restored into this state store.
+func (b *localBackend) checkProjectArchiveVersion(manifest *projectArchiveManifest) error {
+	if manifest.StoreVersion > maxSupportedVersion {
+		return fmt.Errorf("archive was exported from a version %d state store, "+
+			"but this version of the CLI only supports up to version %d",
+			manifest.StoreVersion, maxSupportedVersion)
+	}
+	if _, legacy := b.store.(*legacyReferenceStore); legacy && manifest.Project != "" {
+		return fmt.Errorf("archive of project %v can't be imported into a state store with the legacy layout; "+
+			"upgrade it with 'pulumi state upgrade' first", manifest.Project)
+	}
+	return nil
+}
+
+// planProjectImport returns the stacks in the manifest
+// with the keys their files are restored to.
+func (b *localBackend) planProjectImport(
+	ctx context.Context, project tokens.Name, manifest *projectArchiveManifest,
+) ([]*projectImportStack, error) {
+	if _, err := b.projectReferences(ctx, project); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var stacks []*projectImportStack
+	for _, entry := range manifest.Stacks {
+		qualified := entry.Name
+		if project != "" {
+			qualified = "organization/" + string(project) + "/" + entry.Name
+		}
+		ref, err := b.parseStackReference(qualified)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stack in manifest: %w", err)
+		}
+
+		exists, err := b.bucket.Exists(ctx, b.stackPath(ctx, ref))
+		if err != nil {
+			return nil, fmt.Errorf("check whether stack %v exists: %w", ref, err)
+		}
+		stk := &projectImportStack{
+			ref:        ref,
+			exists:     exists,
+			files:      make(map[string]string),
+			checkpoint: entry.Checkpoint,
+		}
+		add := func(name, key string) error {
+			if seen[name] {
+				return fmt.Errorf("archive entry %v is listed more than once", name)
+			}
+			seen[name] = true
+			stk.files[name] = key
+			return nil
+		}
+
+		ext := path.Ext(entry.Checkpoint)
+		if ext == ".gz" {
+			ext = path.Ext(strings.TrimSuffix(entry.Checkpoint, ext)) + ext
+		}
+		if ext != ".json" && ext != ".json.gz" {
+			return nil, fmt.Errorf("stack %v: unsupported checkpoint %v", ref, entry.Checkpoint)
+		}
+		if err := add(entry.Checkpoint, filepath.ToSlash(ref.StackBasePath())+ext); err != nil {
+			return nil, err
+		}
+		if entry.Tags != "" {
+			if err := add(entry.Tags, stackTagsPath(ref)); err != nil {
+				return nil, err
+			}
+		}
+		if entry.Meta != "" {
+			if err := add(entry.Meta, stackMetaPath(ref)); err != nil {
+				return nil, err
+			}
+		}
+		for _, name := range entry.History {
+			base := path.Base(name)
+			if err := validateNamePath("history file", tokens.Name(base)); err != nil {
+				return nil, fmt.Errorf("stack %v: %w", ref, err)
+			}
+			if err := add(name, ref.HistoryFile(base)); err != nil {
+				return nil, err
+			}
+		}
+		stacks = append(stacks, stk)
+	}
+	return stacks, nil
+}
+
+// commitProjectImport restores a stack from its staged files.
+//
+// The checkpoint is restored last: the stack only appears, or changes,
+// once all of its other files are in place.
+// If restoring any file fails, the files that were added are removed again.
+func (b *localBackend) commitProjectImport(
+	ctx context.Context, stk *projectImportStack, staged map[string]string,
+) error {
+	if err := b.Lock(ctx, stk.ref); err != nil {
+		return err
+	}
+	defer b.Unlock(ctx, stk.ref)
+
+	if b.checkpointValidator != nil {
+		byts, err := b.bucket.ReadAll(ctx, staged[stk.checkpoint])
+		if err != nil {
+			return fmt.Errorf("read staged checkpoint: %w", err)
+		}
+		if err := b.validateCheckpointFile(ctx, stk.ref, stk.checkpoint, byts); err != nil {
+			return err
+		}
+	}
+
+	// Files that already exist are replaced,
+	// and those that aren't in the archive are removed once the stack is restored.
+	previous := make(map[string]bool)
+	if stk.exists {
+		history, err := stk.ref.listHistory(ctx)
+		if err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+			return fmt.Errorf("list history: %w", err)
+		}
+		for _, file := range history {
+			if !file.IsDir {
+				previous[file.Key] = true
+			}
+		}
+		previous[stackTagsPath(stk.ref)] = true
+		previous[stackMetaPath(stk.ref)] = true
+	}
+
+	var added []string
+	rollback := func(err error) error {
+		if derr := deleteAll(ctx, b.bucket, added, b.deleteConcurrency); derr != nil {
+			return fmt.Errorf("%w; files of the stack may have to be removed manually: %v", err, derr)
+		}
+		return err
+	}
+	for name, key := range stk.files {
+		if name == stk.checkpoint {
+			continue
+		}
+		if err := b.bucket.Copy(ctx, key, staged[name], nil); err != nil {
+			return rollback(fmt.Errorf("restore %v: %w", key, err))
+		}
+		if !previous[key] {
+			added = append(added, key)
+		}
+		delete(previous, key)
+	}
+
+	chkpath := stk.files[stk.checkpoint]
+	backupTarget(ctx, b.bucket, chkpath, true /* keepOriginal */)
+	if err := b.bucket.Copy(ctx, chkpath, staged[stk.checkpoint], nil); err != nil {
+		return rollback(fmt.Errorf("restore checkpoint: %w", err))
+	}
+	b.versions.forget(chkpath)
+
+	// The stack is restored at this point:
+	// failures to clean up after it don't undo that.
+	if b.checksums {
+		if err := writeChecksum(ctx, b.bucket, chkpath, stk.checksum); err != nil {
+			return err
+		}
+	} else if err := b.bucket.Delete(ctx, checksumPath(chkpath)); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+		return fmt.Errorf("delete stale checksum: %w", err)
+	}
+
+	// Only the checkpoint of the kind just restored may exist.
+	other := strings.TrimSuffix(chkpath, ".gz")
+	if other == chkpath {
+		other += ".gz"
+	}
+	if stk.exists {
+		backupTarget(ctx, b.bucket, other, false /* keepOriginal */)
+		previous[checksumPath(other)] = true
+	}
+
+	stale := make([]string, 0, len(previous))
+	for key := range previous {
+		stale = append(stale, key)
+	}
+	if err := deleteAll(ctx, b.bucket, stale, b.deleteConcurrency); err != nil {
+		return fmt.Errorf("remove files not in the archive: %w", err)
+	}
+	return nil
+}
+
+// writeStream writes the contents of r to the given key,
+// streaming them if the bucket supports it.
+// Nothing is written if reading r fails.
+func writeStream(ctx context.Context, bucket Bucket, key string, r io.Reader) error {
+	var opts *blob.WriterOptions
+	if strings.HasSuffix(key, ".gz") {
+		opts = gzipWriterOptions()
+	}
+
+	// Cancelling the context aborts the write.
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w, err := newBucketWriter(wctx, bucket, key, opts)
+	if errors.Is(err, errStreamingUnsupported) {
+		byts, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return bucket.WriteAll(ctx, key, byts, opts)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		cancel()
+		contract.IgnoreClose(w)
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,245 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+func TestExportImportProject(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	src, foo := newSnapshotBackend(t, nil)
+	_, _, err := src.saveCheckpoint(ctx, foo, newTestCheckpoint(t, 2))
+	require.NoError(t, err)
+	require.NoError(t, src.addToHistory(ctx, foo, backend.UpdateInfo{Kind: "update", Message: "first"}))
+	require.NoError(t, src.SetStackTags(ctx, foo, map[apitype.StackTagName]string{"team": "infra"}))
+
+	bar, err := src.parseStackReference("bar")
+	require.NoError(t, err)
+	_, err = src.CreateStack(ctx, bar, "", nil)
+	require.NoError(t, err)
+
+	// Stacks of other projects aren't exported.
+	other, err := src.parseStackReference("organization/other/baz")
+	require.NoError(t, err)
+	_, err = src.CreateStack(ctx, other, "", nil)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, src.ExportProject(ctx, "proj", &buf))
+
+	// The manifest comes first.
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	hdr, err := tr.Next()
+	require.NoError(t, err)
+	assert.Equal(t, projectArchiveManifestName, hdr.Name)
+	var manifest projectArchiveManifest
+	require.NoError(t, json.NewDecoder(tr).Decode(&manifest))
+	assert.Equal(t, 1, manifest.StoreVersion)
+	require.Len(t, manifest.Stacks, 2)
+
+	dst, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"}, nil)
+	require.NoError(t, err)
+	report, err := dst.ImportProject(ctx, bytes.NewReader(buf.Bytes()), nil)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"organization/proj/foo", "organization/proj/bar"}, report.Imported)
+
+	chk, err := dst.getCheckpoint(ctx, foo)
+	require.NoError(t, err)
+	assert.Len(t, chk.Latest.Resources, 2)
+	tags, err := dst.GetStackTags(ctx, foo)
+	require.NoError(t, err)
+	assert.Equal(t, "infra", tags["team"])
+	updates, err := dst.ListUpdates(ctx, foo, nil)
+	require.NoError(t, err)
+	require.Len(t, updates, 1)
+	assert.Equal(t, "first", updates[0].Message)
+	chk, err = dst.GetCheckpointAt(ctx, foo, updates[0].ID)
+	require.NoError(t, err)
+	assert.Len(t, chk.Latest.Resources, 2)
+
+	stk, err := dst.GetStack(ctx, bar)
+	require.NoError(t, err)
+	assert.NotNil(t, stk)
+	stk, err = dst.GetStack(ctx, other)
+	require.NoError(t, err)
+	assert.Nil(t, stk)
+
+	// Existing stacks aren't overwritten by default.
+	_, err = dst.ImportProject(ctx, bytes.NewReader(buf.Bytes()), nil)
+	assert.ErrorContains(t, err, "already exists")
+
+	// Nothing is left behind in the staging directory.
+	assert.Empty(t, listKeys(t, dst.bucket, projectImportStagingDir()))
+}
+
+func TestImportProject_conflict(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	src, ref := newSnapshotBackend(t, nil)
+	_, _, err := src.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 2))
+	require.NoError(t, err)
+	require.NoError(t, src.addToHistory(ctx, ref, backend.UpdateInfo{Kind: "update", Message: "exported"}))
+	var buf bytes.Buffer
+	require.NoError(t, src.ExportProject(ctx, "proj", &buf))
+
+	// The stack exists in the destination with other state.
+	dst, _ := newSnapshotBackend(t, nil)
+	_, _, err = dst.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 3))
+	require.NoError(t, err)
+	require.NoError(t, dst.addToHistory(ctx, ref, backend.UpdateInfo{Kind: "update", Message: "local"}))
+
+	report, err := dst.ImportProject(ctx, bytes.NewReader(buf.Bytes()),
+		&ImportProjectOptions{OnConflict: ProjectImportSkip})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"organization/proj/foo"}, report.Skipped)
+	assert.Empty(t, report.Imported)
+	chk, err := dst.getCheckpoint(ctx, ref)
+	require.NoError(t, err)
+	assert.Len(t, chk.Latest.Resources, 3)
+
+	report, err = dst.ImportProject(ctx, bytes.NewReader(buf.Bytes()),
+		&ImportProjectOptions{OnConflict: ProjectImportOverwrite})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"organization/proj/foo"}, report.Imported)
+	chk, err = dst.getCheckpoint(ctx, ref)
+	require.NoError(t, err)
+	assert.Len(t, chk.Latest.Resources, 2)
+
+	// The history is that of the archive.
+	updates, err := dst.ListUpdates(ctx, ref, nil)
+	require.NoError(t, err)
+	require.Len(t, updates, 1)
+	assert.Equal(t, "exported", updates[0].Message)
+
+	_, err = dst.ImportProject(ctx, bytes.NewReader(buf.Bytes()),
+		&ImportProjectOptions{OnConflict: "merge"})
+	assert.ErrorContains(t, err, `unknown conflict policy "merge"`)
+}
+
+func TestExportImportProject_legacy(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	env := map[string]string{"PULUMI_SELF_MANAGED_STATE_LEGACY_LAYOUT": "1"}
+	src, ref := newSnapshotBackend(t, env)
+
+	var buf bytes.Buffer
+	assert.ErrorContains(t, src.ExportProject(ctx, "proj", &buf), "legacy layout")
+	require.NoError(t, src.ExportProject(ctx, "", &buf))
+
+	// Archives can be imported into a store with another layout.
+	dst, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"}, nil)
+	require.NoError(t, err)
+	_, err = dst.ImportProject(ctx, &buf, &ImportProjectOptions{Project: "proj"})
+	require.NoError(t, err)
+
+	dstRef, err := dst.parseStackReference(string(ref.name))
+	require.NoError(t, err)
+	stk, err := dst.GetStack(ctx, dstRef)
+	require.NoError(t, err)
+	assert.NotNil(t, stk)
+}
+
+func TestImportProject_invalid(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"}, nil)
+	require.NoError(t, err)
+
+	archive := func(manifest projectArchiveManifest, entries ...string) *bytes.Buffer {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		byts, err := json.Marshal(manifest)
+		require.NoError(t, err)
+		require.NoError(t, writeArchiveHeader(tw, projectArchiveManifestName, int64(len(byts))))
+		_, err = tw.Write(byts)
+		require.NoError(t, err)
+		for _, name := range entries {
+			require.NoError(t, writeArchiveHeader(tw, name, 2))
+			_, err = tw.Write([]byte("{}"))
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+		return &buf
+	}
+
+	tests := []struct {
+		desc    string
+		give    *bytes.Buffer
+		wantErr string
+	}{
+		{
+			desc:    "newer store",
+			give:    archive(projectArchiveManifest{StoreVersion: maxSupportedVersion + 1, Project: "proj"}),
+			wantErr: "this version of the CLI only supports up to version",
+		},
+		{
+			desc:    "unlisted entry",
+			give:    archive(projectArchiveManifest{Project: "proj"}, "stacks/foo/checkpoint.json"),
+			wantErr: "archive entry stacks/foo/checkpoint.json is not listed in the manifest",
+		},
+		{
+			desc: "missing entry",
+			give: archive(projectArchiveManifest{Project: "proj", Stacks: []projectArchiveStack{
+				{Name: "foo", Checkpoint: "stacks/foo/checkpoint.json"},
+			}}),
+			wantErr: "archive entry stacks/foo/checkpoint.json is missing",
+		},
+		{
+			desc: "bad stack name",
+			give: archive(projectArchiveManifest{Project: "proj", Stacks: []projectArchiveStack{
+				{Name: "..", Checkpoint: "stacks/foo/checkpoint.json"},
+			}}),
+			wantErr: "invalid stack in manifest",
+		},
+		{
+			desc: "bad history file",
+			give: archive(projectArchiveManifest{Project: "proj", Stacks: []projectArchiveStack{
+				{Name: "foo", Checkpoint: "stacks/foo/checkpoint.json", History: []string{"stacks/foo/history/.."}},
+			}}),
+			wantErr: "history file name",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := b.ImportProject(ctx, tt.give, nil)
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
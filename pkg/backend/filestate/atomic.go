@@ -0,0 +1,164 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/gofrs/uuid"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
+)
+
+// tempFileInfix separates the key that a temporary file is destined for
+// from the unique suffix of the temporary file.
+// For example, "a.json" is written as "a.json.tmp-<uuid>" first.
+const tempFileInfix = ".tmp-"
+
+// writeAtomic writes the given contents to the given key
+// such that readers never observe a partially written file.
+//
+// The contents are first written to a temporary key next to the destination,
+// and then copied over the destination.
+// gocloud has no notion of renaming objects,
+// so the temporary file is deleted after the copy.
+func writeAtomic(ctx context.Context, bucket Bucket, key string, p []byte, opts *blob.WriterOptions) error {
+	return writeTemp(ctx, bucket, key, "", func(tmp string) (int64, error) {
+		return int64(len(p)), bucket.WriteAll(ctx, tmp, p, opts)
+	})
+}
+
+// writeAtomicStream is like writeAtomic,
+// but writes the contents produced by write to the bucket as they're produced
+// so that they're never held in memory in full.
+//
+// If the bucket can't write objects incrementally,
+// the contents are buffered and written with WriteAll instead.
+// Streamed writes that fail with transient errors are replayed by calling write again,
+// as allowed by the given retry policy;
+// the other requests are retried by the bucket itself.
+//
+// If ifVersion is set, the destination is only replaced if it's still at that version,
+// as returned by objectVersion.
+// The write fails with ErrConcurrentModification otherwise.
+func writeAtomicStream(
+	ctx context.Context, bucket Bucket, key, ifVersion string, policy retryPolicy,
+	write func(io.Writer) error, opts *blob.WriterOptions,
+) error {
+	return writeTemp(ctx, bucket, key, ifVersion, func(tmp string) (int64, error) {
+		var n int64
+		err := policy.run(ctx, "write", tmp, sleepContext, func(int) (err error) {
+			n, err = streamTemp(ctx, bucket, tmp, write, opts)
+			return err
+		})
+		if errors.Is(err, errStreamingUnsupported) {
+			var buf bytes.Buffer
+			if err := write(&buf); err != nil {
+				return 0, err
+			}
+			return int64(buf.Len()), bucket.WriteAll(ctx, tmp, buf.Bytes(), opts)
+		}
+		return n, err
+	})
+}
+
+// streamTemp streams the contents produced by write to the temporary file tmp,
+// and returns the number of bytes written.
+// It returns errStreamingUnsupported if the bucket can't write objects incrementally.
+func streamTemp(
+	ctx context.Context, bucket Bucket, tmp string, write func(io.Writer) error, opts *blob.WriterOptions,
+) (int64, error) {
+	// Cancelling the context aborts the write
+	// so that a failed write doesn't commit partial contents.
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w, err := newBucketWriter(wctx, bucket, tmp, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	cw := &countingWriter{w: w}
+	if err := write(cw); err != nil {
+		cancel()
+		contract.IgnoreClose(w)
+		return 0, err
+	}
+	return cw.n, w.Close()
+}
+
+// writeTemp writes a temporary file next to the given key with write,
+// and copies it over the key, conditionally if ifVersion is set.
+// write returns the number of bytes it wrote.
+func writeTemp(
+	ctx context.Context, bucket Bucket, key, ifVersion string, write func(tmp string) (int64, error),
+) error {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return err
+	}
+	tmp := key + tempFileInfix + id.String()
+
+	// Even a failed write may leave an object behind,
+	// so always try to clean up the temporary file.
+	defer func() {
+		if err := bucket.Delete(ctx, tmp); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+			logging.V(5).Infof("error deleting temporary file %v: %v (skipping)", tmp, err)
+		}
+	}()
+
+	size, err := write(tmp)
+	if err != nil {
+		return err
+	}
+	if ifVersion != "" {
+		err = copyIfVersion(ctx, bucket, key, tmp, ifVersion)
+	} else {
+		err = bucket.Copy(ctx, key, tmp, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("copy %q to %q: %w", tmp, key, err)
+	}
+
+	// Not all providers guarantee that a copy is complete when it returns.
+	// Verify that the entire file made it to the destination.
+	attrs, err := bucket.Attributes(ctx, key)
+	if err != nil {
+		return fmt.Errorf("verify %q: %w", key, err)
+	}
+	if attrs.Size != size {
+		return fmt.Errorf("verify %q: expected %d bytes, got %d", key, size, attrs.Size)
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written to the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
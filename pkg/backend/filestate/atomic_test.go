@@ -0,0 +1,186 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/memblob"
+	"google.golang.org/api/googleapi"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// listKeys returns the keys of all files in the bucket under the given directory.
+func listKeys(t *testing.T, b Bucket, dir string) []string {
+	t.Helper()
+
+	var keys []string
+	iter := b.List(&blob.ListOptions{Prefix: dir + "/"})
+	for {
+		obj, err := iter.Next(context.Background())
+		if err == io.EOF {
+			return keys
+		}
+		require.NoError(t, err)
+		keys = append(keys, obj.Key)
+	}
+}
+
+func TestWriteAtomic(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b := &wrappedBucket{bucket: memblob.OpenBucket(nil)}
+
+	require.NoError(t, writeAtomic(ctx, b, ".pulumi/stacks/a.json", []byte("foo"), nil))
+	require.NoError(t, writeAtomic(ctx, b, ".pulumi/stacks/a.json", []byte("barbaz"), nil))
+
+	got, err := b.ReadAll(ctx, ".pulumi/stacks/a.json")
+	require.NoError(t, err)
+	assert.Equal(t, "barbaz", string(got))
+
+	// No temporary files should be left behind.
+	assert.Equal(t, []string{".pulumi/stacks/a.json"}, listKeys(t, b, ".pulumi/stacks"))
+}
+
+// copyFailBucket is a Bucket that fails all copies.
+type copyFailBucket struct {
+	Bucket
+}
+
+func (b *copyFailBucket) Copy(ctx context.Context, dstKey, srcKey string, opts *blob.CopyOptions) error {
+	return errors.New("great sadness")
+}
+
+func TestWriteAtomic_copyFailure(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b := &copyFailBucket{Bucket: &wrappedBucket{bucket: memblob.OpenBucket(nil)}}
+
+	err := writeAtomic(ctx, b, ".pulumi/stacks/a.json", []byte("foo"), nil)
+	assert.ErrorContains(t, err, "great sadness")
+
+	// Neither the destination nor the temporary file should exist.
+	assert.Empty(t, listKeys(t, b, ".pulumi/stacks"))
+}
+
+func TestWriteAtomicStream(t *testing.T) {
+	t.Parallel()
+
+	for _, streaming := range []bool{true, false} {
+		streaming := streaming
+		name := "buffered"
+		if streaming {
+			name = "streaming"
+		}
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			b := &wrappedBucket{bucket: memblob.OpenBucket(nil), streaming: streaming}
+
+			err := writeAtomicStream(ctx, b, ".pulumi/stacks/a.json", "", retryPolicy{MaxAttempts: 1}, func(w io.Writer) error {
+				_, err := io.WriteString(w, "foo")
+				return err
+			}, nil)
+			require.NoError(t, err)
+
+			got, err := b.ReadAll(ctx, ".pulumi/stacks/a.json")
+			require.NoError(t, err)
+			assert.Equal(t, "foo", string(got))
+			assert.Equal(t, []string{".pulumi/stacks/a.json"}, listKeys(t, b, ".pulumi/stacks"))
+		})
+	}
+}
+
+func TestWriteAtomicStream_writeFailure(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b := &wrappedBucket{bucket: memblob.OpenBucket(nil), streaming: true}
+	require.NoError(t, b.WriteAll(ctx, ".pulumi/stacks/a.json", []byte("old"), nil))
+
+	err := writeAtomicStream(ctx, b, ".pulumi/stacks/a.json", "", retryPolicy{MaxAttempts: 1}, func(w io.Writer) error {
+		if _, err := io.WriteString(w, "partial"); err != nil {
+			return err
+		}
+		return errors.New("great sadness")
+	}, nil)
+	assert.ErrorContains(t, err, "great sadness")
+
+	// The partial contents are never committed.
+	got, err := b.ReadAll(ctx, ".pulumi/stacks/a.json")
+	require.NoError(t, err)
+	assert.Equal(t, "old", string(got))
+	assert.Equal(t, []string{".pulumi/stacks/a.json"}, listKeys(t, b, ".pulumi/stacks"))
+}
+
+func TestWriteAtomicStream_retry(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b := &wrappedBucket{bucket: memblob.OpenBucket(nil), streaming: true}
+
+	// Streamed writes that fail with transient errors start over.
+	var calls int
+	err := writeAtomicStream(ctx, b, ".pulumi/stacks/a.json", "", retryPolicy{MaxAttempts: 2}, func(w io.Writer) error {
+		calls++
+		if calls == 1 {
+			if _, err := io.WriteString(w, "partial"); err != nil {
+				return err
+			}
+			return &googleapi.Error{Code: http.StatusServiceUnavailable}
+		}
+		_, err := io.WriteString(w, "foo")
+		return err
+	}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2, calls)
+
+	got, err := b.ReadAll(ctx, ".pulumi/stacks/a.json")
+	require.NoError(t, err)
+	assert.Equal(t, "foo", string(got))
+	assert.Equal(t, []string{".pulumi/stacks/a.json"}, listKeys(t, b, ".pulumi/stacks"))
+}
+
+func TestSaveCheckpoint_noTempFiles(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"}, nil)
+	require.NoError(t, err)
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	for _, key := range listKeys(t, b.bucket, StacksDir) {
+		assert.False(t, strings.Contains(key, tempFileInfix), "temporary file %q was left behind", key)
+	}
+}
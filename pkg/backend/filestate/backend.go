@@ -15,28 +15,32 @@
 package filestate
 
 import (
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
-	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/gofrs/uuid"
+	"github.com/hashicorp/go-multierror"
+	"golang.org/x/sync/errgroup"
 
 	user "github.com/tweekmonster/luser"
 	"gocloud.dev/blob"
-	_ "gocloud.dev/blob/azureblob" // driver for azblob://
-	_ "gocloud.dev/blob/fileblob"  // driver for file://
-	"gocloud.dev/blob/gcsblob"     // driver for gs://
-	_ "gocloud.dev/blob/s3blob"    // driver for s3://
+	"gocloud.dev/blob/azureblob" // driver for azblob://
+	"gocloud.dev/blob/fileblob"  // driver for file://
+	"gocloud.dev/blob/gcsblob"   // driver for gs://
+	"gocloud.dev/blob/s3blob"    // driver for s3://
 	"gocloud.dev/gcerrors"
 
 	"github.com/pulumi/pulumi/pkg/v3/authhelpers"
@@ -67,6 +71,11 @@ import (
 // to enable gzip compression when using the filestate backend.
 const PulumiFilestateGzipEnvVar = "PULUMI_SELF_MANAGED_STATE_GZIP"
 
+// PulumiFilestateGzipLevelEnvVar is an env var that specifies
+// the compression level to use when gzip compression is enabled.
+// It must be an integer accepted by gzip.NewWriterLevel.
+var PulumiFilestateGzipLevelEnvVar = env.SelfManagedStateGzipLevel.Var().Name()
+
 // TODO[pulumi/pulumi#12539]:
 // This section contains names of environment variables
 // that affect the behavior of the backend.
@@ -88,15 +97,462 @@ var (
 	//
 	// This opt-out is intended to be removed in a future release.
 	PulumiFilestateLegacyLayoutEnvVar = env.SelfManagedStateLegacyLayout.Var().Name()
+
+	// PulumiFilestateAllowNewerEnvVar is the name of an environment variable
+	// that can be set to allow read-only access to state stores
+	// with a version newer than this CLI supports.
+	PulumiFilestateAllowNewerEnvVar = env.SelfManagedStateAllowNewer.Var().Name()
+
+	// PulumiFilestateLockTTLEnvVar is the name of an environment variable
+	// that specifies how long a stack lock may be held
+	// before it's considered stale and may be reclaimed by another process.
+	// The value must be a duration parseable by time.ParseDuration, e.g. "1h".
+	//
+	// Locks never go stale if this is unset.
+	PulumiFilestateLockTTLEnvVar = env.SelfManagedStateLockTTL.Var().Name()
+
+	// PulumiFilestateChecksumsEnvVar is the name of an environment variable
+	// that must be truthy to record checksums of checkpoint files
+	// and verify them when the checkpoints are read.
+	//
+	// Checksums are always enabled for stores
+	// that were initialized with this set.
+	PulumiFilestateChecksumsEnvVar = env.SelfManagedStateChecksums.Var().Name()
+
+	// PulumiFilestateSnapshotRetentionDaysEnvVar is the name of an environment variable
+	// that specifies the number of days after which stack snapshots are pruned.
+	PulumiFilestateSnapshotRetentionDaysEnvVar = env.SelfManagedStateSnapshotRetentionDays.Var().Name()
+
+	// PulumiFilestateSnapshotRetentionCountEnvVar is the name of an environment variable
+	// that specifies the maximum number of snapshots kept for each stack.
+	PulumiFilestateSnapshotRetentionCountEnvVar = env.SelfManagedStateSnapshotRetentionCount.Var().Name()
+
+	// PulumiFilestateHistoryRetentionCountEnvVar is the name of an environment variable
+	// that caps the number of updates kept in the history of each stack.
+	// The oldest updates are removed after every successful update.
+	// The update that was just recorded is always kept, so 0 is the same as 1.
+	PulumiFilestateHistoryRetentionCountEnvVar = env.SelfManagedStateHistoryRetentionCount.Var().Name()
+
+	// PulumiFilestateVerifyWritesEnvVar is the name of an environment variable
+	// that must be truthy to read checkpoint files back after they're written.
+	PulumiFilestateVerifyWritesEnvVar = env.SelfManagedStateVerifyWrites.Var().Name()
+
+	// PulumiFilestateConsistencyTimeoutEnvVar is the name of an environment variable
+	// that holds how long to wait for checkpoint files to be readable after they're written.
+	PulumiFilestateConsistencyTimeoutEnvVar = env.SelfManagedStateConsistencyTimeout.Var().Name()
+
+	// PulumiFilestateMetaIndentEnvVar is the name of an environment variable
+	// that holds the number of spaces that the metadata file is indented with.
+	PulumiFilestateMetaIndentEnvVar = env.SelfManagedStateMetaIndent.Var().Name()
+
+	// PulumiFilestateKeyTemplateEnvVar is the name of an environment variable
+	// that holds the key template recorded in the metadata file of new state stores.
+	PulumiFilestateKeyTemplateEnvVar = env.SelfManagedStateKeyTemplate.Var().Name()
+
+	// PulumiFilestateDescriptionEnvVar is the name of an environment variable
+	// that holds the description recorded in the metadata file of new state stores.
+	PulumiFilestateDescriptionEnvVar = env.SelfManagedStateDescription.Var().Name()
+
+	// PulumiFilestateEnvironmentEnvVar is the name of an environment variable
+	// that holds the environment label recorded in the metadata file of new state stores.
+	PulumiFilestateEnvironmentEnvVar = env.SelfManagedStateEnvironment.Var().Name()
+
+	// PulumiFilestateSoftDeleteEnvVar is the name of an environment variable
+	// that moves removed stacks to the trash instead of deleting them.
+	PulumiFilestateSoftDeleteEnvVar = env.SelfManagedStateSoftDelete.Var().Name()
+
+	// PulumiFilestateTrashRetentionDaysEnvVar is the name of an environment variable
+	// that holds the number of days after which removed stacks are purged from the trash.
+	PulumiFilestateTrashRetentionDaysEnvVar = env.SelfManagedStateTrashRetentionDays.Var().Name()
+
+	// PulumiFilestateDedupSnapshotsEnvVar is the name of an environment variable
+	// that stores the checkpoints of snapshots by their checksum.
+	PulumiFilestateDedupSnapshotsEnvVar = env.SelfManagedStateDedupSnapshots.Var().Name()
+
+	// PulumiFilestateDeleteConcurrencyEnvVar is the name of an environment variable
+	// that sets how many files are deleted concurrently when a stack is removed.
+	PulumiFilestateDeleteConcurrencyEnvVar = env.SelfManagedStateDeleteConcurrency.Var().Name()
+
+	// PulumiFilestateSSEAlgorithmEnvVar is the name of an environment variable
+	// that sets the S3 server-side encryption algorithm of every object written.
+	PulumiFilestateSSEAlgorithmEnvVar = env.SelfManagedStateSSEAlgorithm.Var().Name()
+
+	// PulumiFilestateSSEKMSKeyIDEnvVar is the name of an environment variable
+	// that sets the KMS key that every object written is encrypted with by the storage provider.
+	PulumiFilestateSSEKMSKeyIDEnvVar = env.SelfManagedStateSSEKMSKeyID.Var().Name()
+
+	// PulumiFilestateFsyncEnvVar is the name of an environment variable
+	// that flushes files written to file:// state stores to stable storage.
+	PulumiFilestateFsyncEnvVar = env.SelfManagedStateFsync.Var().Name()
+
+	// PulumiFilestateListConcurrencyEnvVar is the name of an environment variable
+	// that specifies how many stacks are read concurrently when listing stacks,
+	// and how many history entries are read concurrently by GetHistoryRange.
+	PulumiFilestateListConcurrencyEnvVar = env.SelfManagedStateListConcurrency.Var().Name()
+
+	// PulumiFilestateRetryAttemptsEnvVar is the name of an environment variable
+	// that specifies how many times a bucket operation is attempted
+	// if it fails with a transient error.
+	PulumiFilestateRetryAttemptsEnvVar = env.SelfManagedStateRetryAttempts.Var().Name()
+
+	// PulumiFilestateRetryDelayEnvVar is the name of an environment variable
+	// that specifies the delay before the first retry of a failed bucket operation.
+	PulumiFilestateRetryDelayEnvVar = env.SelfManagedStateRetryDelay.Var().Name()
+
+	// PulumiFilestateOperationTimeoutEnvVar is the name of an environment variable
+	// that specifies how long a single request to the state store may take.
+	PulumiFilestateOperationTimeoutEnvVar = env.SelfManagedStateOperationTimeout.Var().Name()
+
+	// PulumiFilestateNativeVersioningEnvVar is the name of an environment variable
+	// that makes the backend use object versioning of the storage provider
+	// for prior checkpoints if it's enabled on the bucket.
+	PulumiFilestateNativeVersioningEnvVar = env.SelfManagedStateNativeVersioning.Var().Name()
+
+	// PulumiFilestateRecoverFromHistoryEnvVar is the name of an environment variable
+	// that makes the backend fall back to the checkpoint of the most recent update
+	// if the current checkpoint of a stack is missing or corrupt.
+	PulumiFilestateRecoverFromHistoryEnvVar = env.SelfManagedStateRecoverFromHistory.Var().Name()
+
+	// PulumiFilestateThinHistoryEnvVar is the name of an environment variable
+	// that makes the backend save deltas from the prior checkpoint
+	// in the history of a stack instead of full copies.
+	PulumiFilestateThinHistoryEnvVar = env.SelfManagedStateThinHistory.Var().Name()
+
+	// PulumiFilestateDedupHistoryEnvVar is the name of an environment variable
+	// that makes the backend skip copies of unchanged checkpoints in the history of a stack.
+	PulumiFilestateDedupHistoryEnvVar = env.SelfManagedStateDedupHistory.Var().Name()
+
+	// PulumiFilestateGzipHistoryEnvVar is the name of an environment variable
+	// that makes the backend compress new entries in the history of a stack
+	// even if checkpoints aren't compressed.
+	PulumiFilestateGzipHistoryEnvVar = env.SelfManagedStateGzipHistory.Var().Name()
+
+	// PulumiFilestateSecretsProviderEnvVar is the name of an environment variable
+	// that holds the secrets provider recorded in the metadata file of new state stores.
+	PulumiFilestateSecretsProviderEnvVar = env.SelfManagedStateSecretsProvider.Var().Name()
+
+	// PulumiFilestateStrictSecretsProviderEnvVar is the name of an environment variable
+	// that must be truthy to reject secrets providers
+	// that differ from the one recorded for the state store.
+	PulumiFilestateStrictSecretsProviderEnvVar = env.SelfManagedStateStrictSecretsProvider.Var().Name()
+
+	// PulumiFilestateCheckpointFormatEnvVar is the name of an environment variable
+	// that selects the CheckpointFormat that checkpoint files are written in.
+	PulumiFilestateCheckpointFormatEnvVar = env.SelfManagedStateCheckpointFormat.Var().Name()
+
+	// PulumiFilestateNoInitEnvVar is the name of an environment variable
+	// that must be truthy to open state stores without a metadata file
+	// without writing one.
+	PulumiFilestateNoInitEnvVar = env.SelfManagedStateNoInit.Var().Name()
+
+	// PulumiFilestateStrictLayoutEnvVar is the name of an environment variable
+	// that must be truthy to reject state stores that mix both layouts of stacks.
+	PulumiFilestateStrictLayoutEnvVar = env.SelfManagedStateStrictLayout.Var().Name()
+
+	// PulumiFilestateCheckpointMetadataEnvVar is the name of an environment variable
+	// that holds comma-separated key=value pairs of metadata to attach to checkpoint files.
+	PulumiFilestateCheckpointMetadataEnvVar = env.SelfManagedStateCheckpointMetadata.Var().Name()
+
+	// PulumiFilestateEncryptionPassphraseEnvVar is the name of an environment variable
+	// that holds the passphrase checkpoints are encrypted with.
+	//
+	// If set when a new store is initialized, the store is encrypted.
+	PulumiFilestateEncryptionPassphraseEnvVar = env.SelfManagedStateEncryptionPassphrase.Var().Name()
+
+	// PulumiFilestateEncryptionKeyEnvVar is the name of an environment variable
+	// that holds the URL of a key management service key,
+	// e.g. "awskms://alias/my-key".
+	//
+	// If set when a new store is initialized, the store is encrypted
+	// with a data key that is itself encrypted with this key.
+	PulumiFilestateEncryptionKeyEnvVar = env.SelfManagedStateEncryptionKey.Var().Name()
+
+	// PulumiFilestateMirrorURLEnvVar is the name of an environment variable
+	// that holds the URL of a mirror bucket
+	// that all writes to the state store are replicated to.
+	PulumiFilestateMirrorURLEnvVar = env.SelfManagedStateMirrorURL.Var().Name()
+
+	// PulumiFilestateMirrorFallbackEnvVar is the name of an environment variable
+	// that must be truthy to read from the mirror bucket
+	// if a read from the state store fails.
+	PulumiFilestateMirrorFallbackEnvVar = env.SelfManagedStateMirrorFallback.Var().Name()
+
+	// PulumiFilestateMetaFormatEnvVar is the name of an environment variable
+	// that selects the format of the metadata file of new state stores.
+	PulumiFilestateMetaFormatEnvVar = env.SelfManagedStateMetaFormat.Var().Name()
+
+	// PulumiFilestateConditionalWritesEnvVar is the name of an environment variable
+	// that must be truthy to write checkpoints only if they haven't changed
+	// since this process last read or wrote them.
+	// Writes of checkpoints that were modified concurrently fail with [ErrConcurrentModification].
+	//
+	// This is supported for Google Cloud Storage and Azure Blob Storage.
+	// Checkpoints are written unconditionally with a warning for other providers.
+	PulumiFilestateConditionalWritesEnvVar = env.SelfManagedStateConditionalWrites.Var().Name()
 )
 
 // Backend extends the base backend interface with specific information about local backends.
+//
+// A Backend is safe for concurrent use by multiple goroutines,
+// except for Upgrade and RefreshMeta, which must not run concurrently with other operations.
+// Operations on different stacks run in parallel and share the connections to the storage provider,
+// so open one Backend per state store and share it between stacks
+// instead of opening one per stack.
+// Operations that lock a stack, like updates,
+// fail if the stack is already locked by another goroutine sharing the Backend.
 type Backend interface {
 	backend.Backend
 	local() // at the moment, no local specific info, so just use a marker function.
 
 	// Upgrade to the latest state store version.
+	//
+	// Legacy stacks are moved to the project-scoped layout by the same migration as [Migrate],
+	// except that stacks that can't be moved, e.g. because their project can't be determined,
+	// are skipped with a warning.
+	//
+	// The store is locked while it's upgraded, so stacks can't be locked in the meantime,
+	// and the upgrade fails if any stack is already locked.
 	Upgrade(ctx context.Context) error
+
+	// BreakLock forcibly removes all locks held on the given stack
+	// and records that they were broken in the stack's history.
+	BreakLock(ctx context.Context, stackRef backend.StackReference) error
+
+	// ListLocks returns the locks currently held on all stacks,
+	// ordered by stack and then by age.
+	// Lock files that can't be read are skipped with a warning.
+	ListLocks(ctx context.Context) ([]LockInfo, error)
+
+	// Verify scans the state store for problems
+	// without modifying it or taking any locks.
+	//
+	// If events is non-nil, it receives an event for every checkpoint checked
+	// and is closed when Verify returns.
+	Verify(ctx context.Context, events chan<- ProgressEvent) (*VerifyReport, error)
+
+	// Snapshot saves a copy of the current checkpoint of the given stack
+	// that it may be restored to later with Restore.
+	//
+	// If events is non-nil, it receives an event for every old snapshot
+	// pruned by the retention policy and is closed when Snapshot returns.
+	Snapshot(ctx context.Context, stackRef backend.StackReference, events chan<- ProgressEvent) (SnapshotID, error)
+
+	// Restore replaces the checkpoint of the given stack
+	// with a snapshot previously taken with Snapshot.
+	// The current checkpoint is snapshotted first.
+	Restore(ctx context.Context, stackRef backend.StackReference, id SnapshotID) error
+
+	// ListTrash returns the stacks that were moved to the trash
+	// because they were removed with Options.SoftDelete set,
+	// oldest first.
+	ListTrash(ctx context.Context) ([]TrashedStack, error)
+
+	// RestoreStack brings back a stack that was moved to the trash,
+	// with its tags, history, and backups.
+	// If the stack was removed more than once, id selects which removal to restore;
+	// an empty id restores the most recently removed one.
+	// It fails if the stack exists.
+	RestoreStack(ctx context.Context, stackRef backend.StackReference, id TrashID) error
+
+	// EmptyTrash permanently deletes all stacks in the trash.
+	EmptyTrash(ctx context.Context) error
+
+	// ImportFrom replaces the checkpoint of the given stack
+	// with a deployment read from r, as written by 'pulumi stack export'.
+	// With ImportMerge, the resources of the deployment are merged into the checkpoint instead,
+	// and the report lists the resources that were added or replaced.
+	//
+	// The deployment is validated before anything is written.
+	// The current checkpoint is snapshotted first,
+	// and the ID of that snapshot is reported.
+	ImportFrom(
+		ctx context.Context, stackRef backend.StackReference, r io.Reader, opts *ImportOptions,
+	) (*ImportReport, error)
+
+	// ExportTo writes the deployment of the given stack to w
+	// in the format of 'pulumi stack export'.
+	//
+	// With ExportOptions.Redact, secret values are replaced with placeholders
+	// and the deployment is marked as redacted, so that it can't be imported.
+	ExportTo(ctx context.Context, stackRef backend.StackReference, w io.Writer, opts *ExportOptions) error
+
+	// GetStackOutputs returns the outputs of the root stack resource of the given stack
+	// as they're printed by 'pulumi stack output --json',
+	// without loading the rest of its state.
+	// Secret outputs are replaced with "[secret]" unless showSecrets is set,
+	// in which case they're decrypted with the secrets provider of the stack;
+	// the secrets provider isn't used otherwise.
+	GetStackOutputs(ctx context.Context, stackRef backend.StackReference, showSecrets bool) (map[string]interface{}, error)
+
+	// BeginTransaction locks the given stacks, which must exist,
+	// and returns a Transaction that replaces their checkpoints together when committed.
+	// The locks are held until the transaction is committed or rolled back.
+	BeginTransaction(ctx context.Context, stackRefs ...backend.StackReference) (*Transaction, error)
+
+	// RecoverTransactions rolls back the transactions whose commit didn't finish,
+	// e.g. because the process committing them died,
+	// putting back the checkpoints they had already replaced.
+	// It returns the IDs of the transactions rolled back.
+	//
+	// Transactions that are still being committed hold the locks of their stacks,
+	// so recovering them fails.
+	RecoverTransactions(ctx context.Context) ([]string, error)
+
+	// ListCheckpointVersions returns the prior versions of the checkpoint of the given stack,
+	// most recent first.
+	//
+	// With native versioning, these are the versions of the checkpoint object
+	// kept by the storage provider.
+	// Otherwise, these are the checkpoints saved with the updates in the history of the stack.
+	ListCheckpointVersions(ctx context.Context, stackRef backend.StackReference) ([]CheckpointVersion, error)
+
+	// GetCheckpointVersion returns the given version of the checkpoint of a stack
+	// as returned by ListCheckpointVersions.
+	GetCheckpointVersion(ctx context.Context, stackRef backend.StackReference, id string) (*apitype.CheckpointV3, error)
+
+	// ListUpdates returns the updates recorded in the history of the given stack,
+	// most recent first.
+	ListUpdates(ctx context.Context, stackRef backend.StackReference, opts *ListUpdatesOptions) ([]UpdateInfo, error)
+
+	// GetHistoryRange returns the updates in the history of the given stack
+	// from index from up to but not including index to, most recent first,
+	// where index 0 is the most recent update.
+	// The range is truncated to the updates that exist.
+	//
+	// The history entries are read concurrently,
+	// which is much faster than reading them one at a time on remote storage.
+	// All entries that could not be read are reported in the returned error.
+	GetHistoryRange(ctx context.Context, stackRef backend.StackReference, from, to int) ([]UpdateInfo, error)
+
+	// WatchHistory sends the updates recorded in the history of the given stack
+	// after the watch starts, oldest first, as they're appended,
+	// until ctx is done, when the channel is closed.
+	//
+	// The history is listed every Options.HistoryWatchInterval,
+	// and every update is sent once, even if it's listed again.
+	// Failures to list or read the history are retried at the next listing.
+	WatchHistory(ctx context.Context, stackRef backend.StackReference) (<-chan UpdateInfo, error)
+
+	// GetCheckpointAt returns the checkpoint of the given stack
+	// as it was saved after the update with the given ID.
+	GetCheckpointAt(ctx context.Context, stackRef backend.StackReference, updateID string) (*apitype.CheckpointV3, error)
+
+	// CompactHistory removes all but the most recent keep updates
+	// from the history of the given stack.
+	// The removed updates are deleted, or archived if requested.
+	CompactHistory(ctx context.Context, stackRef backend.StackReference, keep int, opts *CompactHistoryOptions) error
+
+	// ListStacksPage returns the summaries of up to pageSize stacks that match the filter,
+	// starting after the position in the continuation token,
+	// and a token to list the next page with, which is nil after the last page.
+	// Pass a nil token to start from the beginning.
+	//
+	// Stacks are listed a page at a time with the native pagination of the storage provider,
+	// so that stores with many stacks can be listed without reading all of them.
+	// A page may hold fewer stacks than requested even if more remain,
+	// e.g. because some stacks don't match the tag filter.
+	ListStacksPage(ctx context.Context, filter backend.ListStacksFilter, pageSize int,
+		token backend.ContinuationToken) ([]backend.StackSummary, backend.ContinuationToken, error)
+
+	// ListStacksMatching returns the summaries of the stacks whose names match
+	// the given glob pattern and the filter, in order of their fully qualified names.
+	// Patterns have the syntax of [path.Match].
+	// Patterns that contain a "/" are matched against "project/stack",
+	// e.g. "web-*/dev-*", and others against the stack name alone.
+	//
+	// Stacks are matched against the keys of their checkpoints in the store listing,
+	// so the files of stacks that don't match are never read.
+	ListStacksMatching(ctx context.Context, pattern string,
+		filter backend.ListStacksFilter) ([]backend.StackSummary, error)
+
+	// ListProjects returns the names of all projects in the state store.
+	//
+	// Stores with the legacy layout don't group stacks by project,
+	// so a single empty project name is returned for them.
+	ListProjects(ctx context.Context) ([]tokens.Name, error)
+
+	// ExportProject writes a tar archive of all stacks in the given project to w.
+	// It holds the checkpoint, tags, and history files of every stack as they're stored,
+	// preceded by a manifest listing them.
+	// Files are streamed to w rather than held in memory.
+	//
+	// Use an empty project name for stores with the legacy layout.
+	ExportProject(ctx context.Context, project tokens.Name, w io.Writer) error
+
+	// ImportProject restores the stacks in an archive written by ExportProject.
+	// The archive must have been exported from a state store version this CLI supports.
+	// Stacks that already exist are handled according to ImportProjectOptions.OnConflict.
+	//
+	// The archive is staged in the state store before any stack is restored,
+	// and each stack is restored in full or not at all.
+	// A failure may leave some stacks restored while others are not;
+	// the report lists the stacks restored before the failure.
+	//
+	// Checkpoints are restored as they were stored,
+	// so those of encrypted stores can only be read with the same key.
+	ImportProject(ctx context.Context, r io.Reader, opts *ImportProjectOptions) (*ImportProjectReport, error)
+
+	// GC removes the histories, backups, and locks left behind by stacks
+	// that no longer have a checkpoint, e.g. because they were deleted out-of-band,
+	// and the objects that no snapshot refers to (see Options.DedupSnapshots).
+	//
+	// Stacks that are currently locked are skipped,
+	// and stacks can't be locked until GC finishes.
+	// With GCOptions.DryRun, the files are only reported.
+	GC(ctx context.Context, opts GCOptions) (*GCReport, error)
+
+	// PruneEmptyStacks moves the stacks whose checkpoints have no resources
+	// and no pending operations to the trash, e.g. those that were destroyed but never removed.
+	// Stacks that have never been updated are empty too.
+	// They're moved to the trash regardless of Options.SoftDelete, so they can be restored with RestoreStack.
+	//
+	// Stacks that are locked are skipped rather than waited for.
+	// With dryRun, the stacks are only reported.
+	PruneEmptyStacks(ctx context.Context, dryRun bool) (*PruneReport, error)
+
+	// GetStackTags returns the tags of the given stack,
+	// as stored next to its checkpoint.
+	GetStackTags(ctx context.Context, stackRef backend.StackReference) (map[apitype.StackTagName]string, error)
+
+	// SetStackTags replaces all tags of the given stack.
+	// Setting no tags removes the file that holds them.
+	SetStackTags(ctx context.Context, stackRef backend.StackReference, tags map[apitype.StackTagName]string) error
+
+	// StoreInfo describes the layout of the state store
+	// as resolved when the backend was created or its metadata last refreshed.
+	StoreInfo() StoreInfo
+
+	// BucketInfo describes the bucket that holds the state store
+	// as resolved from the backend URL when the backend was created,
+	// including the region and endpoint where the storage provider exposes them.
+	BucketInfo() BucketInfo
+
+	// WriteIndex writes an index of all files in the state store
+	// to .pulumi/index.json.
+	// Stores served over HTTP with a "filestate+https://" URL are listed with it,
+	// so write it before publishing the files of the store, and after every change.
+	WriteIndex(ctx context.Context) error
+
+	// Ping checks that the state store can be reached with the credentials in use.
+	// It writes, reads back, and deletes a probe object under .pulumi/.healthcheck,
+	// or only lists the store if the backend is read-only.
+	//
+	// The error wraps ErrAccessDenied if the credentials were rejected,
+	// and ErrUnreachable if the storage provider could not be reached.
+	Ping(ctx context.Context) error
+
+	// RefreshMeta re-reads the state store's metadata file.
+	//
+	// The metadata file is read once when the backend is created.
+	// Use this if it may have been changed by another process since then.
+	RefreshMeta(ctx context.Context) error
+
+	// InitStore writes the metadata file of the state store if it doesn't have one,
+	// as opening the backend does unless Options.NoInit is set.
+	// Empty state stores are initialized with the latest layout
+	// or Options.InitialVersion.
+	// Stores that already have a metadata file are left unchanged.
+	InitStore(ctx context.Context) error
 }
 
 type localBackend struct {
@@ -108,13 +564,110 @@ type localBackend struct {
 	originalURL string
 	url         string
 
+	// keyPrefix is the prefix of all keys of the state store
+	// in the underlying storage. See wrappedBucket.keyPrefix.
+	keyPrefix string
+
+	// bucketInfo describes the bucket of the state store as it was opened.
+	bucketInfo BucketInfo
+
 	bucket Bucket
-	mutex  sync.Mutex
 
-	lockID string
+	// retry is the policy that the bucket retries requests with.
+	// Streamed writes, which it can't retry by itself, are retried with it too.
+	retry retryPolicy
+
+	// locker acquires and releases stack locks.
+	// Defaults to a blobLocker for the state store.
+	locker Locker
+
+	// onLockConflict decides what to do about locks held by others if set.
+	// See Options.OnLockConflict.
+	onLockConflict func(LockInfo) LockConflictAction
+
+	// clock tells the time of lock timestamps, lock staleness, history entries,
+	// and the deadline of consistency checks.
+	clock clock
+
+	// storeLockID is the ID of the store lock held by this backend, if any.
+	// Operations on the whole store, like Upgrade, lock stacks while they hold it.
+	storeLockID atomic.Pointer[string]
 
 	gzip bool
 
+	// gzipLevel is the compression level used when gzip is true.
+	gzipLevel int
+
+	// checkpointFormat is the JSON format that checkpoint files are written in.
+	checkpointFormat CheckpointFormat
+
+	// checkpointValidator inspects checkpoints before they're written if set.
+	checkpointValidator CheckpointValidator
+
+	// checkpointMetadata is the custom metadata attached to checkpoint files.
+	checkpointMetadata map[string]string
+
+	// checksums reports whether checksums of checkpoint files
+	// are written and verified.
+	checksums bool
+
+	// verifyWrites reports whether checkpoint files are read back after they're written.
+	verifyWrites bool
+
+	// consistencyTimeout is how long checkpoint files are read back for after they're written
+	// until they have the new contents, if positive.
+	consistencyTimeout time.Duration
+
+	// atSnapshot pins reads of checkpoints to the snapshots
+	// taken at or before the given snapshot if set.
+	atSnapshot SnapshotID
+
+	// conditionalWrites reports whether checkpoint files are only replaced
+	// if they're still at the version recorded in versions.
+	conditionalWrites bool
+
+	// versions holds the versions of checkpoint files
+	// that this backend last read or wrote,
+	// if conditionalWrites is set.
+	versions objectVersions
+
+	// warnConditionalOnce reports that conditional writes aren't supported
+	// by the state store at most once.
+	warnConditionalOnce sync.Once
+
+	// crypter encrypts and decrypts checkpoint files.
+	// It is nil if the store is not encrypted.
+	crypter config.Crypter
+
+	// snapshotRetention controls which snapshots are pruned
+	// when a new snapshot is taken.
+	snapshotRetention snapshotRetention
+
+	// historyRetention is the number of updates kept in the history of a stack
+	// after a successful update.
+	// All updates are kept if it's zero.
+	historyRetention int
+
+	// trashRetention is how long removed stacks are kept in the trash.
+	// They're kept until the trash is emptied if it's zero.
+	trashRetention time.Duration
+
+	// historyWatchInterval is how often WatchHistory lists the history of a stack.
+	historyWatchInterval time.Duration
+
+	// listConcurrency is the maximum number of stacks
+	// read concurrently by ListStacks and ListStacksPage,
+	// and of history entries read concurrently by GetHistoryRange.
+	listConcurrency int
+
+	// deleteConcurrency is the maximum number of files deleted concurrently
+	// by operations that remove stacks or clean up after them,
+	// if the bucket can't delete files in bulk.
+	deleteConcurrency int
+
+	// progress receives the files deleted when a stack is removed if set.
+	progress func(ProgressEvent)
+
 	Getenv func(string) string // == os.Getenv
 
 	// The current project, if any.
@@ -125,6 +678,53 @@ type localBackend struct {
 	// specified in the metadata file.
 	// If the metadata file is missing, we use the legacy layout.
 	store referenceStore
+
+	// meta is the contents of the metadata file,
+	// cached when the backend was created or last refreshed.
+	meta *pulumiMeta
+
+	// metaExists is set if meta was read from or written to the metadata file.
+	metaExists bool
+
+	// initVersion is the version requested for new state stores, if any.
+	initVersion *int
+
+	// nativeVersioning is set if prior checkpoints are kept
+	// by the object versioning of the storage provider,
+	// rather than copied to the history directory.
+	nativeVersioning bool
+
+	// recoverFromHistory is set if checkpoints that fail to load
+	// are recovered from the history of their stack.
+	recoverFromHistory bool
+
+	// thinHistory is set if checkpoints are saved in the history
+	// as deltas from the checkpoint of the prior update.
+	thinHistory bool
+
+	// dedupHistory is set if checkpoints with the same resources as that of the prior update
+	// are saved in the history as markers rather than copies.
+	dedupHistory bool
+
+	// gzipHistory is set if new files in the history are compressed
+	// even if gzip isn't set.
+	gzipHistory bool
+
+	// strictSecretsProvider is set if secrets providers that differ from the one
+	// recorded for the store are rejected rather than warned about.
+	strictSecretsProvider bool
+
+	// secretsProviderWarned holds the names of the stacks
+	// whose secrets provider mismatch was already warned about.
+	secretsProviderWarned sync.Map
+
+	// softDelete is set if removed stacks are moved to the trash
+	// rather than deleted.
+	softDelete bool
+
+	// dedupSnapshots is set if snapshots refer to content-addressed objects
+	// rather than hold a copy of the checkpoint.
+	dedupSnapshots bool
 }
 
 type localBackendReference struct {
@@ -184,6 +784,14 @@ func (r *localBackendReference) StackBasePath() string { return r.store.StackBas
 func (r *localBackendReference) HistoryDir() string    { return r.store.HistoryDir(r) }
 func (r *localBackendReference) BackupDir() string     { return r.store.BackupDir(r) }
 
+func (r *localBackendReference) HistoryFile(name string) string {
+	return r.store.HistoryFile(r, name)
+}
+
+func (r *localBackendReference) listHistory(ctx context.Context) ([]*blob.ListObject, error) {
+	return r.store.listHistory(ctx, r)
+}
+
 func IsFileStateBackendURL(urlstr string) bool {
 	u, err := url.Parse(urlstr)
 	if err != nil {
@@ -199,8 +807,409 @@ const FilePathPrefix = "file://"
 // using the given URL as the root for storage.
 // The URL must use one of the schemes supported by the go-cloud blob package.
 // Thes inclue: file, s3, gs, azblob.
+// Stores served over HTTP are read with "filestate+http" and "filestate+https" URLs;
+// see [Backend.WriteIndex].
+// Stores accessed through signed URLs are opened with "filestate+signed" URLs
+// by [NewWithOptions] with Options.SignedURLResolver.
 func New(ctx context.Context, d diag.Sink, originalURL string, project *workspace.Project) (Backend, error) {
-	return newLocalBackend(ctx, d, originalURL, project, nil)
+	return NewWithOptions(ctx, d, originalURL, project, nil)
+}
+
+// ErrReadOnly is returned by operations that would modify the state store
+// of a backend opened in read-only mode.
+var ErrReadOnly = errors.New("backend is read-only")
+
+// Options configures a backend created with [NewWithOptions].
+type Options struct {
+	// ReadOnly opens the backend in read-only mode.
+	//
+	// All operations that would modify the state store
+	// fail immediately with [ErrReadOnly].
+	// This includes initializing the metadata of an empty store.
+	ReadOnly bool
+
+	// RetryMaxAttempts is the number of times a request to the state store
+	// is attempted if it fails with a transient error, including the first attempt.
+	// Set to 1 to disable retries.
+	//
+	// Defaults to the value of PULUMI_SELF_MANAGED_STATE_RETRY_ATTEMPTS, or 5.
+	RetryMaxAttempts int
+
+	// RetryBaseDelay is the delay before the first retry of a failed request.
+	// It doubles with every following retry, with some random jitter.
+	//
+	// Defaults to the value of PULUMI_SELF_MANAGED_STATE_RETRY_DELAY, or 100ms.
+	RetryBaseDelay time.Duration
+
+	// RetryBudget is the total number of retries allowed across all requests
+	// made by a single operation of the backend, such as an update,
+	// or an operation on the whole store such as Upgrade or GC.
+	// Once it's spent, requests that fail are no longer retried,
+	// and fail with an error that wraps [ErrRetryBudgetExhausted],
+	// so that an operation against a struggling store fails fast
+	// instead of retrying every one of its requests RetryMaxAttempts times.
+	// Other requests, such as those made to open the store,
+	// are only limited by RetryMaxAttempts.
+	//
+	// Defaults to no limit.
+	RetryBudget int
+
+	// OperationTimeout is how long a single request to the state store may take
+	// before it's abandoned. Requests that time out are retried.
+	// Set to a negative value to wait indefinitely.
+	//
+	// Defaults to the value of PULUMI_SELF_MANAGED_STATE_OPERATION_TIMEOUT, or 5m.
+	OperationTimeout time.Duration
+
+	// SweepOrphans scans the state store, when the backend is opened,
+	// for temporary checkpoint files and locks
+	// left behind by processes that crashed,
+	// and reports each one through the diagnostic sink.
+	SweepOrphans bool
+
+	// RemoveOrphans deletes the files found by SweepOrphans
+	// if the stack they belong to doesn't exist.
+	// Files of existing stacks may belong to an update in progress,
+	// so they're only reported.
+	//
+	// This has no effect in read-only mode.
+	RemoveOrphans bool
+
+	// OrphanMinAge is the age after which SweepOrphans considers
+	// temporary files and locks to be abandoned.
+	//
+	// Defaults to one hour.
+	OrphanMinAge time.Duration
+
+	// HistoryWatchInterval is how often [Backend.WatchHistory]
+	// lists the history of the stack it watches.
+	//
+	// Defaults to five seconds.
+	HistoryWatchInterval time.Duration
+
+	// MirrorURL is the URL of a second bucket that all writes
+	// to the state store are replicated to, e.g. for disaster recovery.
+	// Failures to write to the mirror are reported as warnings,
+	// but are otherwise ignored.
+	// Files that the mirror missed are written again when they're next copied,
+	// e.g. when a checkpoint is backed up.
+	//
+	// Defaults to the value of PULUMI_SELF_MANAGED_STATE_MIRROR_URL.
+	MirrorURL string
+
+	// MirrorFallback reads from the mirror bucket
+	// if a read from the state store fails,
+	// unless the file doesn't exist.
+	//
+	// Defaults to the value of PULUMI_SELF_MANAGED_STATE_MIRROR_FALLBACK.
+	MirrorFallback bool
+
+	// Metrics, if set, is notified of every request made to the state store
+	// and to the mirror bucket.
+	// No measurements are taken if it's nil.
+	Metrics Metrics
+
+	// NativeVersioning relies on the object versioning of the storage provider
+	// for prior versions of checkpoints.
+	// Updates then record which version of the checkpoint they saved
+	// instead of copying it to the history directory of the stack.
+	//
+	// This is supported for S3 and GCS buckets with object versioning enabled.
+	// Checkpoints are copied as usual for all other buckets.
+	//
+	// Defaults to the value of PULUMI_SELF_MANAGED_STATE_NATIVE_VERSIONING.
+	NativeVersioning bool
+
+	// InitialVersion, if set, is the version of the metadata file
+	// written when the backend is opened on an empty state store.
+	// Version 0 uses the legacy layout and writes no metadata file.
+	// Version 2 shards the history of stacks, like stores upgraded with [ShardHistory].
+	// This takes precedence over PULUMI_SELF_MANAGED_STATE_LEGACY_LAYOUT,
+	// which only applies if InitialVersion is nil.
+	//
+	// Opening a state store that was already initialized
+	// with a different version fails.
+	// This includes state stores that aren't empty, but have no metadata file,
+	// which are at version 0.
+	InitialVersion *int
+
+	// NoInit opens state stores that have no metadata file without writing one,
+	// so that credentials that can only read are enough to open them.
+	// They're treated as legacy stores at version 0
+	// until they're initialized with [Backend.InitStore],
+	// so stacks created before then use the legacy layout.
+	// For empty stores, InitialVersion applies to InitStore instead.
+	//
+	// Defaults to the value of PULUMI_SELF_MANAGED_STATE_NO_INIT.
+	NoInit bool
+
+	// StrictLayout fails to open state stores with project-scoped stacks
+	// that also have stack files in the legacy layout,
+	// which are otherwise ignored with a warning.
+	// Such stores are usually the result of an old CLI or another tool
+	// writing to a store that was upgraded.
+	//
+	// Defaults to the value of PULUMI_SELF_MANAGED_STATE_STRICT_LAYOUT.
+	StrictLayout bool
+
+	// StrictSecretsProvider fails to open state stores, and to save stacks,
+	// whose secrets provider differs from the one recorded in the metadata file of the store,
+	// which is otherwise warned about.
+	// Stores record the secrets provider set in PULUMI_SELF_MANAGED_STATE_SECRETS_PROVIDER
+	// when they're initialized; those that don't record one are never checked.
+	//
+	// Defaults to the value of PULUMI_SELF_MANAGED_STATE_STRICT_SECRETS_PROVIDER.
+	StrictSecretsProvider bool
+
+	// RecoverFromHistory loads the checkpoint saved with the most recent update
+	// of a stack if its current checkpoint is missing or corrupt,
+	// warning every time it does so.
+	// Checkpoints in the history that can't be decoded are skipped.
+	//
+	// Defaults to the value of PULUMI_SELF_MANAGED_STATE_RECOVER_FROM_HISTORY.
+	RecoverFromHistory bool
+
+	// Locker, if set, keeps the locks that prevent concurrent operations on stacks
+	// instead of the state store.
+	// Use this with a strongly consistent service like DynamoDB or Redis
+	// if the state store doesn't reliably detect concurrent locks.
+	//
+	// The stale lock TTL (PULUMI_SELF_MANAGED_STATE_LOCK_TTL),
+	// garbage collection, and the orphan sweep
+	// only apply to locks kept in the state store.
+	Locker Locker
+
+	// OnLockConflict, if set, is called with each lock held by others
+	// on a stack that an operation needs to lock,
+	// and decides whether to wait for it to be released, break it, or abort the operation.
+	// Locks are only broken if it decides to break all of them,
+	// and waited for unless it decides to abort on any of them.
+	// It's called again with the locks that are still held after waiting or breaking,
+	// until the stack is locked or the operation is aborted.
+	// Broken locks are recorded in the history of the stack like with [Backend.BreakLock].
+	//
+	// If it's not set, operations on stacks locked by others fail with a [LockConflictError].
+	// Custom Lockers must return a LockConflictError for conflicts to be resolved this way.
+	OnLockConflict func(LockInfo) LockConflictAction
+
+	// ThinHistory saves the checkpoint of each update in the history of a stack
+	// as the changes to its resources since the prior update,
+	// instead of a full copy.
+	// Checkpoints are reconstructed when read,
+	// and a full copy is saved every few updates to bound the cost of doing so.
+	// Full copies saved before this was enabled stay readable.
+	// Native versioning takes precedence if it's in use.
+	//
+	// Defaults to the value of PULUMI_SELF_MANAGED_STATE_THIN_HISTORY.
+	ThinHistory bool
+
+	// DedupHistory skips the copy of the checkpoint of an update in the history of a stack
+	// if its resources are identical to those of the prior update,
+	// as they are after an update that made no changes.
+	// A marker that holds the rest of the checkpoint, including the time of the update,
+	// is saved instead, and the checkpoint is reconstructed from the prior one when read.
+	// The update itself is still recorded in the history.
+	//
+	// This costs reading both checkpoints after every update.
+	// With ThinHistory, unchanged checkpoints are always saved as markers.
+	// Native versioning takes precedence if it's in use.
+	//
+	// Defaults to the value of PULUMI_SELF_MANAGED_STATE_DEDUP_HISTORY.
+	DedupHistory bool
+
+	// GzipHistory compresses the files saved in the history of a stack with gzip,
+	// even if checkpoints aren't compressed.
+	// History files are read whether or not they're compressed,
+	// so entries saved before this was enabled stay readable.
+	// It has no further effect if PULUMI_SELF_MANAGED_STATE_GZIP is set.
+	//
+	// Defaults to the value of PULUMI_SELF_MANAGED_STATE_GZIP_HISTORY.
+	GzipHistory bool
+
+	// CheckpointFormat is the JSON format that checkpoint files are written in.
+	// Checkpoint files in either format are read regardless.
+	//
+	// Defaults to the value of PULUMI_SELF_MANAGED_STATE_CHECKPOINT_FORMAT,
+	// or CheckpointFormatPretty if that's not set.
+	CheckpointFormat CheckpointFormat
+
+	// CheckpointValidator, if set, is called with every checkpoint before it's written,
+	// including those restored by ImportFrom, Restore, and ImportProject.
+	// If it returns an error, the write fails and the prior state of the stack is kept.
+	CheckpointValidator CheckpointValidator
+
+	// CheckpointMetadata is custom metadata attached to checkpoint files
+	// in addition to the pulumi-stack, pulumi-project, and pulumi-store-version keys,
+	// which are always set.
+	// Checkpoint files are also written with the application/json content type,
+	// or application/octet-stream if the state store is encrypted.
+	// Keys must not start with "pulumi-".
+	//
+	// How metadata is stored depends on the storage provider,
+	// e.g. as user-defined metadata of S3 objects.
+	//
+	// Defaults to the value of PULUMI_SELF_MANAGED_STATE_CHECKPOINT_METADATA.
+	CheckpointMetadata map[string]string
+
+	// VerifyWrites reads every checkpoint file back after it's written
+	// and fails the write with [ErrChecksumMismatch]
+	// if the contents differ from what was written.
+	// This guards against storage providers that acknowledge writes
+	// before they serve the new contents,
+	// at the cost of an extra request for every checkpoint.
+	//
+	// Defaults to the value of PULUMI_SELF_MANAGED_STATE_VERIFY_WRITES.
+	VerifyWrites bool
+
+	// ConsistencyTimeout is how long to wait for a checkpoint file to be served with its new contents
+	// after it's written, for storage providers that are eventually consistent.
+	// The file is read back until it is, with an increasing delay between reads,
+	// and the write fails with [ErrChecksumMismatch] if it isn't once the timeout expires.
+	// This implies VerifyWrites.
+	//
+	// Strongly consistent storage providers serve the new contents right away,
+	// so the file is only read once.
+	// Use this for S3-compatible stores known to be eventually consistent.
+	//
+	// Defaults to the value of PULUMI_SELF_MANAGED_STATE_CONSISTENCY_TIMEOUT, or 0 to disable waiting.
+	ConsistencyTimeout time.Duration
+
+	// SoftDelete moves the checkpoint, tags, history, and backups of removed stacks
+	// to .pulumi/trash instead of deleting them,
+	// so that they can be brought back with [Backend.RestoreStack].
+	// Stacks in the trash are only deleted by [Backend.EmptyTrash]
+	// and the TrashRetention policy.
+	//
+	// Defaults to the value of PULUMI_SELF_MANAGED_STATE_SOFT_DELETE.
+	SoftDelete bool
+
+	// TrashRetention is how long removed stacks are kept in the trash.
+	// Older stacks are permanently deleted whenever another stack is removed.
+	//
+	// Defaults to the value of PULUMI_SELF_MANAGED_STATE_TRASH_RETENTION_DAYS,
+	// or 0 to keep removed stacks until the trash is emptied.
+	TrashRetention time.Duration
+
+	// DedupSnapshots stores the checkpoints saved by [Backend.Snapshot]
+	// in .pulumi/objects, named after their SHA-256 checksum,
+	// and has snapshots refer to them rather than hold a copy.
+	// Identical checkpoints, e.g. those of a stack that didn't change between snapshots,
+	// are then stored once for all snapshots of all stacks.
+	// Objects are read back transparently, and checked against their checksum.
+	//
+	// Objects are deleted by [Backend.GC] once no snapshot refers to them;
+	// pruning and removing snapshots only deletes the references.
+	// Snapshots taken this way aren't listed by older versions of the CLI.
+	// Snapshots taken before this was enabled stay readable.
+	//
+	// Defaults to the value of PULUMI_SELF_MANAGED_STATE_DEDUP_SNAPSHOTS.
+	DedupSnapshots bool
+
+	// DeleteConcurrency is the maximum number of files deleted concurrently
+	// when a stack is removed, with its history and backups,
+	// from a state store that can't delete files in bulk.
+	// Stores in S3 delete them in bulk instead.
+	//
+	// Defaults to the value of PULUMI_SELF_MANAGED_STATE_DELETE_CONCURRENCY, or 16.
+	DeleteConcurrency int
+
+	// ServerSideEncryption is applied by the storage provider to every object written to the state store,
+	// including checkpoints, history, and metadata, instead of the default encryption of the bucket.
+	// It's checked when the backend is created,
+	// which fails if it can't be applied to the state store.
+	// It isn't applied to the mirror bucket.
+	//
+	// Defaults to the values of PULUMI_SELF_MANAGED_STATE_SSE_ALGORITHM
+	// and PULUMI_SELF_MANAGED_STATE_SSE_KMS_KEY_ID.
+	ServerSideEncryption *ServerSideEncryption
+
+	// Fsync flushes every file written to a file:// state store or mirror,
+	// along with the directories it's in, to stable storage
+	// before the write is reported as successful,
+	// so that it survives a crash or power loss of the machine or file server.
+	// This makes writes slower.
+	// It has no effect on other state stores,
+	// whose writes are durable once the storage provider acknowledges them.
+	//
+	// Defaults to the value of PULUMI_SELF_MANAGED_STATE_FSYNC.
+	Fsync bool
+
+	// Progress receives a ProgressEvent for every file deleted when a stack is removed,
+	// since RemoveStack has no channel to report progress to.
+	// It's called with one event at a time but may be called from any goroutine.
+	Progress func(ProgressEvent)
+
+	// AtSnapshot opens the backend at the point in time of a snapshot
+	// taken with [Backend.Snapshot].
+	//
+	// The checkpoint of every stack is read from its latest snapshot
+	// taken at or before the given one,
+	// so stacks other than the one the snapshot was taken of
+	// show their state as of the same moment.
+	// Stacks without such a snapshot are left out of listings and can't be read.
+	//
+	// The backend is read-only:
+	// operations that would modify the state store fail with [ErrReadOnly].
+	AtSnapshot SnapshotID
+
+	// SignedURLResolver issues the URLs through which the files of the state store are accessed,
+	// rather than credentials for the whole bucket.
+	// It's required by state stores opened with a "filestate+signed" URL,
+	// and can't be used with any other.
+	SignedURLResolver SignedURLResolver
+}
+
+// NewWithOptions constructs a new filestate backend like [New],
+// configured with the given options.
+func NewWithOptions(
+	ctx context.Context, d diag.Sink, originalURL string, project *workspace.Project, opts *Options,
+) (Backend, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	return newLocalBackend(ctx, d, originalURL, project, &localBackendOptions{
+		ReadOnly:         opts.ReadOnly,
+		RetryMaxAttempts: opts.RetryMaxAttempts,
+		RetryBaseDelay:   opts.RetryBaseDelay,
+		RetryBudget:      opts.RetryBudget,
+		OperationTimeout: opts.OperationTimeout,
+		SweepOrphans:     opts.SweepOrphans,
+		RemoveOrphans:    opts.RemoveOrphans,
+		OrphanMinAge:     opts.OrphanMinAge,
+		MirrorURL:        opts.MirrorURL,
+		MirrorFallback:   opts.MirrorFallback,
+		Metrics:          opts.Metrics,
+		NativeVersioning: opts.NativeVersioning,
+		InitialVersion:   opts.InitialVersion,
+		NoInit:           opts.NoInit,
+		StrictLayout:     opts.StrictLayout,
+		Locker:           opts.Locker,
+		OnLockConflict:   opts.OnLockConflict,
+
+		StrictSecretsProvider: opts.StrictSecretsProvider,
+
+		RecoverFromHistory: opts.RecoverFromHistory,
+		ThinHistory:        opts.ThinHistory,
+		DedupHistory:       opts.DedupHistory,
+		GzipHistory:        opts.GzipHistory,
+		CheckpointFormat:   opts.CheckpointFormat,
+
+		CheckpointValidator: opts.CheckpointValidator,
+		CheckpointMetadata:  opts.CheckpointMetadata,
+		VerifyWrites:        opts.VerifyWrites,
+		ConsistencyTimeout:  opts.ConsistencyTimeout,
+		AtSnapshot:          opts.AtSnapshot,
+		SoftDelete:          opts.SoftDelete,
+		TrashRetention:      opts.TrashRetention,
+		DedupSnapshots:      opts.DedupSnapshots,
+		DeleteConcurrency:   opts.DeleteConcurrency,
+		Progress:            opts.Progress,
+
+		ServerSideEncryption: opts.ServerSideEncryption,
+		Fsync:                opts.Fsync,
+		SignedURLResolver:    opts.SignedURLResolver,
+		HistoryWatchInterval: opts.HistoryWatchInterval,
+	})
 }
 
 type localBackendOptions struct {
@@ -208,6 +1217,124 @@ type localBackendOptions struct {
 	//
 	// Defaults to os.Getenv.
 	Getenv func(string) string
+
+	// Clock tells the time of lock timestamps, lock staleness, and history entries.
+	//
+	// Defaults to the system clock.
+	Clock clock
+
+	// ReadOnly rejects all modifications to the state store.
+	ReadOnly bool
+
+	// RetryMaxAttempts and RetryBaseDelay override
+	// the retry policy for bucket operations if set.
+	RetryMaxAttempts int
+	RetryBaseDelay   time.Duration
+
+	// RetryBudget limits the retries of each operation if positive.
+	RetryBudget int
+
+	// OperationTimeout overrides the timeout of bucket operations if non-zero.
+	// Negative values disable the timeout.
+	OperationTimeout time.Duration
+
+	// SweepOrphans, RemoveOrphans, and OrphanMinAge
+	// configure the sweep for files left behind by crashed processes.
+	// See the corresponding fields of Options.
+	SweepOrphans  bool
+	RemoveOrphans bool
+	OrphanMinAge  time.Duration
+
+	// HistoryWatchInterval overrides how often WatchHistory polls if positive.
+	HistoryWatchInterval time.Duration
+
+	// MirrorURL and MirrorFallback override the mirror configuration if set.
+	MirrorURL      string
+	MirrorFallback bool
+
+	// Metrics receives measurements of requests to the state store if set.
+	Metrics Metrics
+
+	// NativeVersioning uses the object versioning of the storage provider
+	// for prior checkpoints if it's available.
+	NativeVersioning bool
+
+	// InitialVersion pins the version of new state stores if set.
+	// See Options.InitialVersion.
+	InitialVersion *int
+
+	// NoInit leaves state stores without a metadata file uninitialized.
+	NoInit bool
+
+	// StrictLayout rejects state stores that mix both layouts of stacks.
+	StrictLayout bool
+
+	// StrictSecretsProvider rejects secrets providers
+	// that differ from the one recorded for the state store.
+	StrictSecretsProvider bool
+
+	// Locker keeps stack locks instead of the state store if set.
+	Locker Locker
+
+	// OnLockConflict decides what to do about locks held by others if set.
+	OnLockConflict func(LockInfo) LockConflictAction
+
+	// RecoverFromHistory falls back to the checkpoints of prior updates
+	// if the current checkpoint of a stack can't be loaded.
+	RecoverFromHistory bool
+
+	// ThinHistory saves deltas in the history instead of checkpoint copies.
+	ThinHistory bool
+
+	// DedupHistory saves markers in the history instead of copies of unchanged checkpoints.
+	DedupHistory bool
+
+	// GzipHistory compresses new files in the history even if checkpoints aren't compressed.
+	GzipHistory bool
+
+	// CheckpointFormat overrides PULUMI_SELF_MANAGED_STATE_CHECKPOINT_FORMAT if set.
+	CheckpointFormat CheckpointFormat
+
+	// CheckpointValidator inspects checkpoints before they're written.
+	CheckpointValidator CheckpointValidator
+
+	// CheckpointMetadata overrides PULUMI_SELF_MANAGED_STATE_CHECKPOINT_METADATA if set.
+	CheckpointMetadata map[string]string
+
+	// VerifyWrites reads checkpoint files back after they're written.
+	VerifyWrites bool
+
+	// ConsistencyTimeout overrides PULUMI_SELF_MANAGED_STATE_CONSISTENCY_TIMEOUT if non-zero.
+	ConsistencyTimeout time.Duration
+
+	// AtSnapshot opens a read-only backend at the given snapshot if set.
+	// See Options.AtSnapshot.
+	AtSnapshot SnapshotID
+
+	// SoftDelete moves removed stacks to the trash instead of deleting them.
+	SoftDelete bool
+
+	// TrashRetention overrides PULUMI_SELF_MANAGED_STATE_TRASH_RETENTION_DAYS if non-zero.
+	TrashRetention time.Duration
+
+	// DedupSnapshots stores the checkpoints of snapshots as shared, content-addressed objects.
+	DedupSnapshots bool
+
+	// DeleteConcurrency overrides PULUMI_SELF_MANAGED_STATE_DELETE_CONCURRENCY if positive.
+	DeleteConcurrency int
+
+	// Progress receives the files deleted when stacks are removed if set.
+	Progress func(ProgressEvent)
+
+	// ServerSideEncryption overrides PULUMI_SELF_MANAGED_STATE_SSE_ALGORITHM
+	// and PULUMI_SELF_MANAGED_STATE_SSE_KMS_KEY_ID if set.
+	ServerSideEncryption *ServerSideEncryption
+
+	// Fsync flushes files written to file:// stores to stable storage.
+	Fsync bool
+
+	// SignedURLResolver opens "filestate+signed" stores.
+	SignedURLResolver SignedURLResolver
 }
 
 // newLocalBackend builds a filestate backend implementation
@@ -219,23 +1346,482 @@ func newLocalBackend(
 	if opts == nil {
 		opts = &localBackendOptions{}
 	}
-	if opts.Getenv == nil {
-		opts.Getenv = os.Getenv
+	if opts.Getenv == nil {
+		opts.Getenv = os.Getenv
+	}
+	if opts.Clock == nil {
+		opts.Clock = systemClock{}
+	}
+
+	if !IsFileStateBackendURL(originalURL) {
+		return nil, fmt.Errorf("local URL %s has an illegal prefix; expected one of: %s",
+			originalURL, strings.Join(blob.DefaultURLMux().BucketSchemes(), ", "))
+	}
+
+	if v := opts.InitialVersion; v != nil && (*v < 0 || *v > maxSupportedVersion) {
+		return nil, fmt.Errorf("unsupported initial state store version %d; expected 0 to %d",
+			*v, maxSupportedVersion)
+	}
+
+	if id := opts.AtSnapshot; id != "" {
+		if _, err := time.Parse(snapshotTimeFormat, string(id)); err != nil {
+			return nil, fmt.Errorf("invalid snapshot ID %q", id)
+		}
+	}
+
+	var (
+		bucket *wrappedBucket
+		u      string
+		err    error
+	)
+	if opts.SignedURLResolver != nil {
+		bucket, u, err = openSignedURLBucket(originalURL, opts.SignedURLResolver, opts.Clock)
+	} else {
+		bucket, u, err = openBucket(ctx, originalURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Stores served over HTTP can't be written to.
+	readOnly := opts.ReadOnly || httpBucketSchemes[bucket.info.Scheme] || opts.AtSnapshot != ""
+
+	sse := opts.ServerSideEncryption
+	if sse == nil {
+		sse = &ServerSideEncryption{
+			Algorithm: opts.Getenv(PulumiFilestateSSEAlgorithmEnvVar),
+			KMSKeyID:  opts.Getenv(PulumiFilestateSSEKMSKeyIDEnvVar),
+		}
+	}
+	bucket.sse, err = resolveServerSideEncryption(bucket.info.Scheme, sse)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server-side encryption: %w", err)
+	}
+	fsync := opts.Fsync || cmdutil.IsTruthy(opts.Getenv(PulumiFilestateFsyncEnvVar))
+	bucket.fsync = fsync
+
+	// Allocate a unique lock ID for this backend instance.
+	lockID, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+
+	gzipCompression := cmdutil.IsTruthy(opts.Getenv(PulumiFilestateGzipEnvVar))
+	gzipLevel := gzip.DefaultCompression
+	if v := opts.Getenv(PulumiFilestateGzipLevelEnvVar); v != "" {
+		gzipLevel, err = strconv.Atoi(v)
+		if err != nil || gzipLevel < gzip.HuffmanOnly || gzipLevel > gzip.BestCompression {
+			return nil, fmt.Errorf("invalid %v: %q is not a valid gzip compression level",
+				PulumiFilestateGzipLevelEnvVar, v)
+		}
+	}
+
+	checkpointFormat := opts.CheckpointFormat
+	if checkpointFormat == "" {
+		checkpointFormat = CheckpointFormat(opts.Getenv(PulumiFilestateCheckpointFormatEnvVar))
+	}
+	switch checkpointFormat {
+	case "":
+		checkpointFormat = CheckpointFormatPretty
+	case CheckpointFormatPretty, CheckpointFormatCompact:
+	default:
+		return nil, fmt.Errorf("invalid checkpoint format %q; expected %q or %q",
+			checkpointFormat, CheckpointFormatPretty, CheckpointFormatCompact)
+	}
+
+	checkpointMetadata := opts.CheckpointMetadata
+	if checkpointMetadata == nil {
+		checkpointMetadata, err = parseCheckpointMetadata(opts.Getenv(PulumiFilestateCheckpointMetadataEnvVar))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := validateCheckpointMetadata(checkpointMetadata); err != nil {
+		return nil, err
+	}
+
+	var lockTTL time.Duration
+	if v := opts.Getenv(PulumiFilestateLockTTLEnvVar); v != "" {
+		lockTTL, err = time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v: %w", PulumiFilestateLockTTLEnvVar, err)
+		}
+	}
+
+	var retention snapshotRetention
+	if v := opts.Getenv(PulumiFilestateSnapshotRetentionDaysEnvVar); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 1 {
+			return nil, fmt.Errorf("invalid %v: %q is not a positive number of days",
+				PulumiFilestateSnapshotRetentionDaysEnvVar, v)
+		}
+		retention.MaxAge = time.Duration(days) * 24 * time.Hour
+	}
+	if v := opts.Getenv(PulumiFilestateSnapshotRetentionCountEnvVar); v != "" {
+		retention.MaxCount, err = strconv.Atoi(v)
+		if err != nil || retention.MaxCount < 1 {
+			return nil, fmt.Errorf("invalid %v: %q is not a positive number of snapshots",
+				PulumiFilestateSnapshotRetentionCountEnvVar, v)
+		}
+	}
+
+	trashRetention := opts.TrashRetention
+	if v := opts.Getenv(PulumiFilestateTrashRetentionDaysEnvVar); v != "" && trashRetention == 0 {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 1 {
+			return nil, fmt.Errorf("invalid %v: %q is not a positive number of days",
+				PulumiFilestateTrashRetentionDaysEnvVar, v)
+		}
+		trashRetention = time.Duration(days) * 24 * time.Hour
+	}
+
+	var historyRetention int
+	if v := opts.Getenv(PulumiFilestateHistoryRetentionCountEnvVar); v != "" {
+		historyRetention, err = strconv.Atoi(v)
+		if err != nil || historyRetention < 0 {
+			return nil, fmt.Errorf("invalid %v: %q is not a non-negative number of updates",
+				PulumiFilestateHistoryRetentionCountEnvVar, v)
+		}
+		// The update that was just recorded must never be removed.
+		if historyRetention == 0 {
+			historyRetention = 1
+		}
+	}
+
+	listConcurrency := defaultListConcurrency
+	if v := opts.Getenv(PulumiFilestateListConcurrencyEnvVar); v != "" {
+		listConcurrency, err = strconv.Atoi(v)
+		if err != nil || listConcurrency < 1 {
+			return nil, fmt.Errorf("invalid %v: %q is not a positive number",
+				PulumiFilestateListConcurrencyEnvVar, v)
+		}
+	}
+
+	deleteConcurrency := defaultDeleteConcurrency
+	if v := opts.Getenv(PulumiFilestateDeleteConcurrencyEnvVar); v != "" {
+		deleteConcurrency, err = strconv.Atoi(v)
+		if err != nil || deleteConcurrency < 1 {
+			return nil, fmt.Errorf("invalid %v: %q is not a positive number",
+				PulumiFilestateDeleteConcurrencyEnvVar, v)
+		}
+	}
+	if opts.DeleteConcurrency > 0 {
+		deleteConcurrency = opts.DeleteConcurrency
+	}
+
+	historyWatchInterval := defaultHistoryWatchInterval
+	if opts.HistoryWatchInterval > 0 {
+		historyWatchInterval = opts.HistoryWatchInterval
+	}
+
+	retry := retryPolicy{
+		MaxAttempts: defaultRetryMaxAttempts,
+		BaseDelay:   defaultRetryBaseDelay,
+	}
+	if v := opts.Getenv(PulumiFilestateRetryAttemptsEnvVar); v != "" {
+		retry.MaxAttempts, err = strconv.Atoi(v)
+		if err != nil || retry.MaxAttempts < 1 {
+			return nil, fmt.Errorf("invalid %v: %q is not a positive number",
+				PulumiFilestateRetryAttemptsEnvVar, v)
+		}
+	}
+	if v := opts.Getenv(PulumiFilestateRetryDelayEnvVar); v != "" {
+		retry.BaseDelay, err = time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v: %w", PulumiFilestateRetryDelayEnvVar, err)
+		}
+	}
+	if opts.RetryMaxAttempts > 0 {
+		retry.MaxAttempts = opts.RetryMaxAttempts
+	}
+	if opts.RetryBaseDelay > 0 {
+		retry.BaseDelay = opts.RetryBaseDelay
+	}
+	if opts.RetryBudget > 0 {
+		retry.Budget = opts.RetryBudget
+	}
+
+	timeout := defaultOperationTimeout
+	if v := opts.Getenv(PulumiFilestateOperationTimeoutEnvVar); v != "" {
+		timeout, err = time.ParseDuration(v)
+		if err != nil || timeout < 0 {
+			return nil, fmt.Errorf("invalid %v: %q is not a non-negative duration",
+				PulumiFilestateOperationTimeoutEnvVar, v)
+		}
+	}
+	if opts.OperationTimeout != 0 {
+		timeout = opts.OperationTimeout
+	}
+
+	consistencyTimeout := opts.ConsistencyTimeout
+	if v := opts.Getenv(PulumiFilestateConsistencyTimeoutEnvVar); v != "" && consistencyTimeout == 0 {
+		consistencyTimeout, err = time.ParseDuration(v)
+		if err != nil || consistencyTimeout < 0 {
+			return nil, fmt.Errorf("invalid %v: %q is not a non-negative duration",
+				PulumiFilestateConsistencyTimeoutEnvVar, v)
+		}
+	}
+
+	// All other wrappers must be layered on top of the retries
+	// so that their own errors are never retried.
+	// Timeouts are layered below them so that every attempt has its own deadline,
+	// and metrics below those so that every attempt is measured.
+	// Buckets whose credentials expired are reopened below everything else.
+	var rbucket Bucket = newRetryBucket(
+		newTimeoutBucket(newMetricsBucket(withCredentialRefresh(bucket, originalURL), opts.Metrics), timeout), retry)
+	keyPrefix, bucketInfo := bucket.keyPrefix, bucket.info
+	bucket = nil // prevent accidental use of unwrapped bucket
+
+	mirrorURL := opts.Getenv(PulumiFilestateMirrorURLEnvVar)
+	if opts.MirrorURL != "" {
+		mirrorURL = opts.MirrorURL
+	}
+	if mirrorURL != "" {
+		if !IsFileStateBackendURL(mirrorURL) {
+			return nil, fmt.Errorf("mirror URL %s has an illegal prefix; expected one of: %s",
+				mirrorURL, strings.Join(blob.DefaultURLMux().BucketSchemes(), ", "))
+		}
+		mirror, mu, err := openBucket(ctx, mirrorURL)
+		if err != nil {
+			return nil, fmt.Errorf("open mirror: %w", err)
+		}
+		if mu == u {
+			return nil, fmt.Errorf("mirror URL %s is the same as the state store URL", mirrorURL)
+		}
+		if httpBucketSchemes[mirror.info.Scheme] {
+			return nil, fmt.Errorf("mirror URL %s is read-only", mirrorURL)
+		}
+		mirror.fsync = fsync
+		mirrorInfo := mirror.info
+		bucketInfo.Mirror = &mirrorInfo
+		mbucket := newRetryBucket(
+			newTimeoutBucket(newMetricsBucket(withCredentialRefresh(mirror, mirrorURL), opts.Metrics), timeout), retry)
+		rbucket = &mirrorBucket{
+			Bucket:   rbucket,
+			mirror:   mbucket,
+			d:        d,
+			fallback: opts.MirrorFallback || cmdutil.IsTruthy(opts.Getenv(PulumiFilestateMirrorFallbackEnvVar)),
+		}
+	}
+
+	// Objects matched by the ignore file are hidden from all listings,
+	// so it must be read before anything is listed.
+	rbucket, err = applyIgnoreList(ctx, rbucket)
+	if err != nil {
+		return nil, err
+	}
+
+	var backendBucket Bucket = rbucket
+	switch {
+	case opts.AtSnapshot != "":
+		backendBucket = &readOnlyBucket{
+			Bucket: rbucket,
+			err:    fmt.Errorf("%w: opened at snapshot %v", ErrReadOnly, opts.AtSnapshot),
+		}
+	case readOnly:
+		backendBucket = &readOnlyBucket{Bucket: rbucket, err: ErrReadOnly}
+	}
+
+	backend := &localBackend{
+		d:           d,
+		originalURL: originalURL,
+		url:         u,
+		keyPrefix:   keyPrefix,
+		bucketInfo:  bucketInfo,
+		bucket:      backendBucket,
+		retry:       retry,
+		locker:      opts.Locker,
+		gzip:        gzipCompression,
+		gzipLevel:   gzipLevel,
+		Getenv:      opts.Getenv,
+
+		checkpointFormat:    checkpointFormat,
+		checkpointValidator: opts.CheckpointValidator,
+		checkpointMetadata:  checkpointMetadata,
+		verifyWrites:        opts.VerifyWrites || cmdutil.IsTruthy(opts.Getenv(PulumiFilestateVerifyWritesEnvVar)),
+		consistencyTimeout:  consistencyTimeout,
+		clock:               opts.Clock,
+		atSnapshot:          opts.AtSnapshot,
+
+		conditionalWrites: cmdutil.IsTruthy(opts.Getenv(PulumiFilestateConditionalWritesEnvVar)),
+
+		snapshotRetention: retention,
+		historyRetention:  historyRetention,
+		trashRetention:    trashRetention,
+		listConcurrency:   listConcurrency,
+		deleteConcurrency: deleteConcurrency,
+		progress:          opts.Progress,
+		initVersion:       opts.InitialVersion,
+		onLockConflict:    opts.OnLockConflict,
+
+		historyWatchInterval: historyWatchInterval,
+
+		recoverFromHistory: opts.RecoverFromHistory ||
+			cmdutil.IsTruthy(opts.Getenv(PulumiFilestateRecoverFromHistoryEnvVar)),
+		thinHistory: opts.ThinHistory ||
+			cmdutil.IsTruthy(opts.Getenv(PulumiFilestateThinHistoryEnvVar)),
+		dedupHistory: opts.DedupHistory ||
+			cmdutil.IsTruthy(opts.Getenv(PulumiFilestateDedupHistoryEnvVar)),
+		gzipHistory: opts.GzipHistory ||
+			cmdutil.IsTruthy(opts.Getenv(PulumiFilestateGzipHistoryEnvVar)),
+		strictSecretsProvider: opts.StrictSecretsProvider ||
+			cmdutil.IsTruthy(opts.Getenv(PulumiFilestateStrictSecretsProviderEnvVar)),
+		softDelete: opts.SoftDelete ||
+			cmdutil.IsTruthy(opts.Getenv(PulumiFilestateSoftDeleteEnvVar)),
+		dedupSnapshots: opts.DedupSnapshots ||
+			cmdutil.IsTruthy(opts.Getenv(PulumiFilestateDedupSnapshotsEnvVar)),
+	}
+	if backend.locker == nil {
+		backend.locker = &blobLocker{
+			bucket: backendBucket,
+			url:    u,
+			id:     lockID.String(),
+			ttl:    lockTTL,
+			clock:  opts.Clock,
+			d:      d,
+		}
+	}
+	backend.currentProject.Store(project)
+
+	// Read the Pulumi state metadata
+	// and ensure that it is compatible with this version of the CLI.
+	// The version in the metadata file informs which store we use.
+	meta, err := readPulumiMeta(ctx, rbucket)
+	metaExists := meta != nil
+	var uninitialized bool // set if the empty store is left as is
+	if err == nil && meta == nil {
+		switch {
+		case readOnly:
+			// Don't initialize the store in read-only mode.
+			// Use the metadata that would have been written instead.
+			meta, err = newPulumiMeta(ctx, rbucket, opts.Getenv, opts.InitialVersion)
+		case opts.NoInit || cmdutil.IsTruthy(opts.Getenv(PulumiFilestateNoInitEnvVar)):
+			meta, err = newPulumiMeta(ctx, rbucket, opts.Getenv, opts.InitialVersion)
+			if err == nil && meta.Version > 0 {
+				// The store is empty.
+				// Stacks created before it's initialized must remain visible after it is,
+				// so use the layout that InitStore picks for stores that aren't empty.
+				meta = &pulumiMeta{Version: 0}
+				uninitialized = true
+			}
+		default:
+			meta, err = ensurePulumiMeta(ctx, rbucket, opts.Getenv, opts.InitialVersion)
+			// The metadata file isn't written for legacy stores.
+			metaExists = err == nil && meta.Version > 0
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if v := opts.InitialVersion; v != nil && meta.Version != *v && !uninitialized {
+		return nil, fmt.Errorf("state store at %v has version %d, but version %d was requested",
+			originalURL, meta.Version, *v)
+	}
+
+	if err := backend.applyMeta(ctx, meta); err != nil {
+		return nil, err
+	}
+	backend.metaExists = metaExists
+	projectMode := meta.Version > 0
+
+	// Stacks may be missing from either layout until an interrupted migration is finished.
+	if exists, err := rbucket.Exists(ctx, migrationJournalPath); err == nil && exists {
+		d.Warningf(diag.Message("", "A migration of the state store at %v didn't finish. "+
+			"Some stacks may be missing until it's resumed or rolled back."), originalURL)
+	}
+
+	if opts.NativeVersioning || cmdutil.IsTruthy(opts.Getenv(PulumiFilestateNativeVersioningEnvVar)) {
+		backend.nativeVersioning = backend.checkNativeVersioning(ctx)
+	}
+
+	// Clean up after any processes that crashed, if requested.
+	if opts.SweepOrphans {
+		minAge := defaultOrphanMinAge
+		if opts.OrphanMinAge > 0 {
+			minAge = opts.OrphanMinAge
+		}
+		remove := opts.RemoveOrphans && backend.checkWritable() == nil
+		backend.sweepOrphans(ctx, remove, minAge, opts.Clock.Now())
+	}
+
+	// If we're not in project mode, or we've disabled the warning, we're done.
+	// Strict mode can't be disabled that way.
+	strictLayout := opts.StrictLayout || cmdutil.IsTruthy(opts.Getenv(PulumiFilestateStrictLayoutEnvVar))
+	if !projectMode || (!strictLayout && cmdutil.IsTruthy(opts.Getenv(PulumiFilestateNoLegacyWarningEnvVar))) {
+		return backend, nil
+	}
+	// Otherwise, warn about any old stack files.
+	// This is possible if a user creates a new stack with a new CLI,
+	// or migrates it to project mode with `pulumi state upgrade`,
+	// but someone else interacts with the same state with an old CLI.
+
+	files, err := newLegacyReferenceStore(rbucket).listStackFiles(ctx)
+	if err != nil {
+		if strictLayout {
+			return nil, fmt.Errorf("check layout of state store at %v: %w", originalURL, err)
+		}
+		// If there's an error listing don't fail, just don't print the warnings
+		return backend, nil
+	}
+	if len(files) == 0 {
+		return backend, nil
+	}
+
+	var list strings.Builder
+	for _, file := range files {
+		fmt.Fprintf(&list, "  - %s (%s)\n", file.Name, file.Key)
+	}
+	if strictLayout {
+		return nil, fmt.Errorf("state store at %v has project-scoped stacks, but also legacy stack files:\n%s"+
+			"Run 'pulumi state upgrade' to migrate them to the new format", originalURL, list.String())
 	}
 
-	if !IsFileStateBackendURL(originalURL) {
-		return nil, fmt.Errorf("local URL %s has an illegal prefix; expected one of: %s",
-			originalURL, strings.Join(blob.DefaultURLMux().BucketSchemes(), ", "))
+	var msg strings.Builder
+	msg.WriteString("Found legacy stack files in state store:\n")
+	msg.WriteString(list.String())
+	msg.WriteString("Please run 'pulumi state upgrade' to migrate them to the new format.\n")
+	msg.WriteString("Set PULUMI_SELF_MANAGED_STATE_NO_LEGACY_WARNING=1 to disable this warning.")
+	d.Warningf(diag.Message("", msg.String()))
+	return backend, nil
+}
+
+// openBucket opens the bucket at the given filestate backend URL.
+// It returns the bucket and the canonicalized URL.
+func openBucket(ctx context.Context, originalURL string) (*wrappedBucket, string, error) {
+	baseURL, prefix, err := splitBucketPrefix(originalURL)
+	if err != nil {
+		return nil, "", err
 	}
 
-	u, err := massageBlobPath(originalURL)
+	u, err := massageBlobPath(baseURL)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	p, err := url.Parse(u)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+
+	// Stores served over HTTP are rooted at the path of their URL,
+	// so the prefix is part of it rather than of their keys.
+	httpStore := httpBucketSchemes[p.Scheme]
+	var keyPrefix string
+	if httpStore && prefix != "" {
+		p.Path = path.Join("/", p.Path, prefix)
+		u = p.String()
+		keyPrefix = prefix + "/"
+		prefix = ""
+	}
+
+	// localDir is the directory of a file:// store,
+	// resolved the way fileblob does.
+	var localDir string
+	if p.Scheme == fileblob.Scheme {
+		localDir = p.Path
+		if p.Host == "." || os.PathSeparator != '/' {
+			localDir = strings.TrimPrefix(localDir, "/")
+		}
+		localDir = filepath.Join(filepath.FromSlash(localDir), filepath.FromSlash(prefix))
 	}
 
 	blobmux := blob.DefaultURLMux()
@@ -245,16 +1831,18 @@ func newLocalBackend(
 	if p.Scheme == gcsblob.Scheme {
 		blobmux, err = authhelpers.GoogleCredentialsMux(ctx)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 	}
 
 	bucket, err := blobmux.OpenBucket(ctx, u)
 	if err != nil {
-		return nil, fmt.Errorf("unable to open bucket %s: %w", u, err)
+		return nil, "", fmt.Errorf("unable to open bucket %s: %w", u, err)
 	}
 
-	if !strings.HasPrefix(u, FilePathPrefix) {
+	// keyPrefix is the prefix of all keys in the underlying bucket.
+	// Stores served over SFTP are rooted at the path of their URL, like those served over HTTP.
+	if !strings.HasPrefix(u, FilePathPrefix) && !httpStore && p.Scheme != sftpBucketScheme {
 		bucketSubDir := strings.TrimLeft(p.Path, "/")
 		if bucketSubDir != "" {
 			if !strings.HasSuffix(bucketSubDir, "/") {
@@ -262,41 +1850,160 @@ func newLocalBackend(
 			}
 
 			bucket = blob.PrefixedBucket(bucket, bucketSubDir)
+			keyPrefix = bucketSubDir
 		}
 	}
 
-	// Allocate a unique lock ID for this backend instance.
-	lockID, err := uuid.NewV4()
+	// Apply the prefix to the bucket rather than the path of the URL
+	// because fileblob can't open directories that don't exist yet.
+	// The canonical URL includes it as part of the path.
+	if prefix != "" {
+		bucket = blob.PrefixedBucket(bucket, prefix+"/")
+		keyPrefix += prefix + "/"
+		p.Path = path.Join("/", p.Path, prefix)
+		u = p.String()
+	}
+
+	wbucket := &wrappedBucket{
+		bucket:    bucket,
+		streaming: streamingSchemes[p.Scheme],
+		keyPrefix: keyPrefix,
+		info:      newBucketInfo(bucket, p),
+		localDir:  localDir,
+	}
+	switch p.Scheme {
+	case s3blob.Scheme:
+		wbucket.batch = newS3BatchDeleter(bucket, p.Host, keyPrefix)
+		wbucket.revisioner = newS3Revisioner(bucket, p.Host, keyPrefix)
+	case gcsblob.Scheme:
+		wbucket.versioner = gcsVersioner{}
+		wbucket.revisioner = newGCSRevisioner(bucket, p.Host, keyPrefix)
+	case azureblob.Scheme:
+		wbucket.versioner = azureVersioner{}
+	}
+	return wbucket, u, nil
+}
+
+// streamingSchemes are the schemes of the built-in drivers
+// which upload objects incrementally without needing their size up front.
+// Objects in buckets of other drivers are written with WriteAll.
+var streamingSchemes = map[string]bool{
+	azureblob.Scheme: true,
+	fileblob.Scheme:  true,
+	gcsblob.Scheme:   true,
+	s3blob.Scheme:    true,
+	sftpBucketScheme: true,
+}
+
+// bucketPrefixParam is the query parameter of a backend URL
+// that specifies a prefix for all keys in the bucket.
+const bucketPrefixParam = "prefix"
+
+// splitBucketPrefix removes the "prefix" query parameter from the given backend URL.
+// It returns the remaining URL and the normalized prefix,
+// which is empty if the parameter isn't set.
+//
+// The prefix is the directory that holds the bookkeeping directory,
+// e.g. "team-a" for "team-a/.pulumi/meta.yaml".
+// It may also name the bookkeeping directory itself, e.g. "team-a/.pulumi".
+func splitBucketPrefix(rawURL string) (string, string, error) {
+	base, rawQuery, ok := strings.Cut(rawURL, "?")
+	if !ok {
+		return rawURL, "", nil
+	}
+	q, err := url.ParseQuery(rawQuery)
 	if err != nil {
-		return nil, err
+		return "", "", fmt.Errorf("invalid query in URL %s: %w", rawURL, err)
+	}
+	if !q.Has(bucketPrefixParam) {
+		return rawURL, "", nil
+	}
+	prefix := q.Get(bucketPrefixParam)
+	q.Del(bucketPrefixParam)
+	if len(q) > 0 {
+		base += "?" + q.Encode()
 	}
 
-	gzipCompression := cmdutil.IsTruthy(opts.Getenv(PulumiFilestateGzipEnvVar))
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return "", "", errors.New("invalid prefix: must not be empty")
+	}
+	for _, part := range strings.Split(prefix, "/") {
+		if part == "" || part == "." || part == ".." || strings.Contains(part, `\`) {
+			return "", "", fmt.Errorf("invalid prefix %q: "+
+				"must be a relative path without empty, '.', or '..' components", prefix)
+		}
+	}
 
-	wbucket := &wrappedBucket{bucket: bucket}
-	bucket = nil // prevent accidental use of unwrapped bucket
+	if prefix == workspace.BookkeepingDir {
+		return base, "", nil
+	}
+	return base, strings.TrimSuffix(prefix, "/"+workspace.BookkeepingDir), nil
+}
 
-	backend := &localBackend{
-		d:           d,
-		originalURL: originalURL,
-		url:         u,
-		bucket:      wbucket,
-		lockID:      lockID.String(),
-		gzip:        gzipCompression,
-		Getenv:      opts.Getenv,
+// applyMeta configures the backend for the store described by the given metadata
+// and caches the metadata.
+func (b *localBackend) applyMeta(ctx context.Context, meta *pulumiMeta) error {
+	// Stores initialized with checksums enabled always use them.
+	// Others may opt in with an environment variable.
+	var checksums bool
+	switch meta.Checksum {
+	case "":
+		checksums = cmdutil.IsTruthy(b.Getenv(PulumiFilestateChecksumsEnvVar))
+	case sha256Checksum:
+		checksums = true
+	default:
+		return fmt.Errorf("unsupported checksum algorithm %q in %q", meta.Checksum, meta.path())
 	}
-	backend.currentProject.Store(project)
 
-	// Read the Pulumi state metadata
-	// and ensure that it is compatible with this version of the CLI.
-	// The version in the metadata file informs which store we use.
-	meta, err := ensurePulumiMeta(ctx, wbucket, opts.Getenv)
+	// Encryption can only be enabled when the store is initialized.
+	// Refuse to silently ignore a key for an unencrypted store.
+	var crypter config.Crypter
+	switch {
+	case meta.Encryption == nil:
+		for _, name := range []string{PulumiFilestateEncryptionPassphraseEnvVar, PulumiFilestateEncryptionKeyEnvVar} {
+			if b.Getenv(name) != "" {
+				return fmt.Errorf("%v is set, but the state store is not encrypted; "+
+					"encryption can only be enabled for new state stores", name)
+			}
+		}
+	case b.meta != nil && b.meta.Encryption != nil && *b.meta.Encryption == *meta.Encryption:
+		// Deriving the key is slow, so reuse it if it hasn't changed.
+		crypter = b.crypter
+	default:
+		var err error
+		crypter, err = openEncryption(ctx, meta.Encryption, meta.path(), b.Getenv)
+		if err != nil {
+			return err
+		}
+	}
+
+	configured, err := parseSecretsProvider(b.Getenv(PulumiFilestateSecretsProviderEnvVar))
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if err := b.checkSecretsProvider(meta, "", configured); err != nil {
+		return err
 	}
 
-	// projectMode tracks whether the current state supports project-scoped stacks.
-	// Historically, the filestate backend did not support this.
+	// Files can't be found if the key template changes, so it can't be.
+	keys, err := parseKeyTemplate(meta.KeyTemplate)
+	if err != nil {
+		return fmt.Errorf("invalid key template in %q: %w", meta.path(), err)
+	}
+	if v := b.Getenv(PulumiFilestateKeyTemplateEnvVar); v != "" {
+		switch want, err := parseKeyTemplate(v); {
+		case err != nil:
+			return fmt.Errorf("invalid %v: %w", PulumiFilestateKeyTemplateEnvVar, err)
+		case meta.Version == 0:
+			return fmt.Errorf("%v is set: %w", PulumiFilestateKeyTemplateEnvVar, errKeyTemplateLegacy)
+		case want.String() != keys.String():
+			return fmt.Errorf("%v is %q, but the state store uses the key template %q; "+
+				"the key template can only be set for new state stores", PulumiFilestateKeyTemplateEnvVar, want, keys)
+		}
+	}
+
+	// Historically, the filestate backend did not support project-scoped stacks.
 	// To avoid breaking old stacks, we use legacy mode for existing states.
 	// We use project mode only if one of the following is true:
 	//
@@ -306,162 +2013,172 @@ func newLocalBackend(
 	//    so there's no risk of breaking old stacks.
 	//
 	// All actual logic of project mode vs legacy mode is handled by the referenceStore.
-	// This boolean just helps us warn users about unmigrated stacks.
-	var projectMode bool
-	switch meta.Version {
-	case 0:
-		backend.store = newLegacyReferenceStore(wbucket)
-	case 1:
-		backend.store = newProjectReferenceStore(wbucket, backend.currentProject.Load)
-		projectMode = true
+	switch {
+	case meta.Version == 0:
+		b.store = newLegacyReferenceStore(b.bucket)
+		keys = nil
+	case meta.Version > 0 && meta.Version <= maxSupportedVersion:
+		store := newProjectReferenceStore(b.bucket, b.currentProject.Load, keys)
+		store.shardHistory = meta.shardsHistory()
+		b.store = store
+	case meta.Version > maxSupportedVersion && cmdutil.IsTruthy(b.Getenv(PulumiFilestateAllowNewerEnvVar)):
+		// The user has opted into reading a store from a newer CLI.
+		// Assume that it's laid out like the newest store we know about,
+		// and refuse all writes so that we don't corrupt it.
+		b.d.Warningf(diag.Message("", "State store version (%d) is newer than this version of the Pulumi CLI supports. "+
+			"The store will be opened in read-only mode."), meta.Version)
+		if b.checkWritable() == nil {
+			b.bucket = &readOnlyBucket{Bucket: b.bucket, err: newStoreTooNewError(meta)}
+		}
+		store := newProjectReferenceStore(b.bucket, b.currentProject.Load, keys)
+		store.shardHistory = true
+		b.store = store
 	default:
-		return nil, fmt.Errorf(
-			"state store unsupported: 'meta.yaml' version (%d) is not supported "+
-				"by this version of the Pulumi CLI", meta.Version)
+		return newStoreTooNewError(meta)
 	}
 
-	// If we're not in project mode, or we've disabled the warning, we're done.
-	if !projectMode || cmdutil.IsTruthy(opts.Getenv(PulumiFilestateNoLegacyWarningEnvVar)) {
-		return backend, nil
+	if l, ok := b.locker.(*blobLocker); ok {
+		l.keys.Store(keys)
 	}
-	// Otherwise, warn about any old stack files.
-	// This is possible if a user creates a new stack with a new CLI,
-	// or migrates it to project mode with `pulumi state upgrade`,
-	// but someone else interacts with the same state with an old CLI.
+	b.checksums = checksums
+	b.crypter = crypter
+	b.meta = meta
+	return nil
+}
 
-	refs, err := newLegacyReferenceStore(wbucket).ListReferences(ctx)
-	if err != nil {
-		// If there's an error listing don't fail, just don't print the warnings
-		return backend, nil
-	}
-	if len(refs) == 0 {
-		return backend, nil
-	}
+// StoreInfo describes the layout of a state store
+// as reported by [Backend.StoreInfo].
+type StoreInfo struct {
+	// Version is the version of the state store.
+	//
+	// This is 0 for stores with the legacy layout.
+	Version int
 
-	var msg strings.Builder
-	msg.WriteString("Found legacy stack files in state store:\n")
-	for _, ref := range refs {
-		fmt.Fprintf(&msg, "  - %s\n", ref.Name())
+	// Legacy reports whether stacks are stored in the legacy layout
+	// without project-scoped stacks.
+	//
+	// This is set for version 0 stores, including new stores created with
+	// PULUMI_SELF_MANAGED_STATE_LEGACY_LAYOUT set.
+	Legacy bool
+
+	// MetaExists reports whether the store has a metadata file.
+	//
+	// This is false for legacy stores,
+	// and for new stores opened in read-only mode.
+	MetaExists bool
+
+	// Prefix is the directory in the underlying storage
+	// that holds the bookkeeping directory of the store,
+	// e.g. "team" for "s3://bucket/team".
+	// It's empty if the store is at the root of the storage.
+	//
+	// For file:// URLs, the path of the URL is the root of the storage,
+	// so this is only set by the "prefix" query parameter.
+	Prefix string
+
+	// Description and Environment are the free-text description and the environment label,
+	// e.g. "production", recorded in the metadata file, if any.
+	// They only tell stores apart and have no effect on how the store is used.
+	Description string
+	Environment string
+}
+
+func (b *localBackend) StoreInfo() StoreInfo {
+	info := StoreInfo{
+		MetaExists: b.metaExists,
+		Prefix:     strings.TrimSuffix(b.keyPrefix, "/"),
 	}
-	msg.WriteString("Please run 'pulumi state upgrade' to migrate them to the new format.\n")
-	msg.WriteString("Set PULUMI_SELF_MANAGED_STATE_NO_LEGACY_WARNING=1 to disable this warning.")
-	d.Warningf(diag.Message("", msg.String()))
-	return backend, nil
+	if b.meta != nil {
+		info.Version = b.meta.Version
+		info.Description = b.meta.Description
+		info.Environment = b.meta.Environment
+	}
+	_, info.Legacy = b.store.(*legacyReferenceStore)
+	return info
 }
 
-func (b *localBackend) Upgrade(ctx context.Context) error {
-	// We don't use the existing b.store because
-	// this may already be a projectReferenceStore
-	// with new legacy files introduced to it accidentally.
-	olds, err := newLegacyReferenceStore(b.bucket).ListReferences(ctx)
+func (b *localBackend) RefreshMeta(ctx context.Context) error {
+	meta, err := readPulumiMeta(ctx, b.bucket)
+	exists := meta != nil
+	if err == nil && meta == nil {
+		// The file was never written, e.g. for a legacy store.
+		// Refreshing must not initialize the store.
+		meta, err = newPulumiMeta(ctx, b.bucket, b.Getenv, b.initVersion)
+	}
 	if err != nil {
-		return fmt.Errorf("read old references: %w", err)
+		return err
 	}
-
-	// It's important that we attempt to write the new metadata file
-	// before we attempt the upgrade.
-	// This ensures that if permissions are borked for any reason,
-	// (e.g., we can write to .pulumi/*/*" but not ".pulumi/*.")
-	// we don't leave the bucket in a completely inaccessible state.
-	meta := pulumiMeta{Version: 1}
-	if err := meta.WriteTo(ctx, b.bucket); err != nil {
-		var s strings.Builder
-		fmt.Fprintf(&s, "Could not write new state metadata file: %v\n", err)
-		fmt.Fprintf(&s, "Please verify that the storage is writable, and try again.")
-		b.d.Errorf(diag.RawMessage("", s.String()))
-		return errors.New("state upgrade failed")
+	if err := b.applyMeta(ctx, meta); err != nil {
+		return err
 	}
+	b.metaExists = exists
+	return nil
+}
 
-	newStore := newProjectReferenceStore(b.bucket, b.currentProject.Load)
-
-	// There's no limit to the number of stacks we need to upgrade.
-	// We don't want to overload the system with too many concurrent upgrades.
-	// We'll run a fixed pool of goroutines to upgrade stacks.
-	// They'll work their way through the list of old stacks
-	// using nextIdx to track which stack to upgrade next.
-	var (
-		// Index into olds for goroutines to track
-		// which stack they're upgrading.
-		nextIdx atomic.Int64
-
-		// Number of stacks successfully upgraded.
-		upgraded atomic.Int64
-
-		wg sync.WaitGroup
-	)
-
-	// GOMAXPROCS defaults to the number of cores on the system,
-	// so this should be a reasonable default.
-	numWorkers := runtime.GOMAXPROCS(0)
-	if count := len(olds); count < numWorkers {
-		// Don't need more workers than work.
-		numWorkers = count
+func (b *localBackend) InitStore(ctx context.Context) error {
+	if err := b.checkWritable(); err != nil {
+		return err
 	}
 
-	for i := 0; i < numWorkers; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-
-			for {
-				// Add returns the new value of the atomic,
-				// so we need to subtract 1 from the result.
-				idx := nextIdx.Add(1) - 1
-
-				// List of old stacks has been exhausted.
-				// We're done.
-				if idx >= int64(len(olds)) {
-					return
-				}
-
-				old := olds[idx]
-				if err := b.upgradeStack(ctx, newStore, old); err != nil {
-					b.d.Warningf(diag.Message("", "Skipping stack %q: %v"), old, err)
-				} else {
-					upgraded.Add(1)
-				}
-			}
-		}()
+	meta, err := ensurePulumiMeta(ctx, b.bucket, b.Getenv, b.initVersion)
+	if err != nil {
+		return fmt.Errorf("initialize state store %v: %w", b.url, err)
+	}
+	if err := b.applyMeta(ctx, meta); err != nil {
+		return err
 	}
-	wg.Wait()
-	b.store = newStore
-	b.d.Infoerrf(diag.Message("", "Upgraded %d stack(s) to project mode"), upgraded.Load())
+	// The metadata file isn't written for legacy stores.
+	b.metaExists = b.metaExists || meta.Version > 0
 	return nil
 }
 
-// upgradeStack upgrades a single stack to use the provided projectReferenceStore.
-func (b *localBackend) upgradeStack(
-	ctx context.Context,
-	newStore *projectReferenceStore,
-	old *localBackendReference,
-) error {
-	contract.Requiref(old.project == "", "old.project", "must be empty")
+func (b *localBackend) Upgrade(ctx context.Context) (err error) {
+	ctx = withOperationID(ctx)
+	defer func() { err = operationError(ctx, err) }()
 
-	chk, err := b.getCheckpoint(ctx, old)
-	if err != nil {
+	if err := b.checkWritable(); err != nil {
 		return err
 	}
 
-	// Try and find the project name from _any_ resource URN
-	var project tokens.Name
-	if chk.Latest != nil {
-		for _, res := range chk.Latest.Resources {
-			project = tokens.Name(res.URN.Project())
-			break
+	// The new metadata file is only written once every stack was copied into the new layout
+	// and read back from it, and an interrupted upgrade is picked up by the next one.
+	plan, err := migrate(ctx, b.bucket, b.clock, b.ListLocks, &MigrateOptions{
+		OnSkip: func(stack string, err error) {
+			b.sink(ctx).Warningf(diag.Message("", "Skipping stack %q: %v"), stack, err)
+		},
+	})
+	if err != nil {
+		var merr *migratedMetaError
+		if !errors.As(err, &merr) || errors.Is(err, ErrStoreTooNew) {
+			return err
 		}
-	}
-	if project == "" {
-		return errors.New("no project found")
-	}
 
-	new := newStore.newReference(project, old.Name())
-	if err := b.renameStack(ctx, old, new); err != nil {
-		return fmt.Errorf("rename to %v: %w", new, err)
+		var s strings.Builder
+		fmt.Fprintf(&s, "Could not write new state metadata file: %v\n", merr.err)
+		fmt.Fprintf(&s, "Please verify that the storage is writable, and try again.")
+		b.sink(ctx).Errorf(diag.RawMessage("", s.String()))
+		return errors.New("state upgrade failed")
 	}
+	b.sink(ctx).Infoerrf(diag.Message("", "Upgraded %d stack(s) to project mode"), len(plan.Report.Stacks))
 
+	// Pick up the new version so that later writes use the new layout.
+	if err := b.RefreshMeta(ctx); err != nil {
+		return fmt.Errorf("reload state metadata: %w", err)
+	}
 	return nil
 }
 
+// guessProject returns the name of the project that the stack in the given checkpoint belongs to,
+// or an empty string if it can't be determined.
+//
+// Checkpoints don't record their project, so we take it from the URN of any resource in the stack.
+func guessProject(chk *apitype.CheckpointV3) tokens.Name {
+	if chk.Latest == nil || len(chk.Latest.Resources) == 0 {
+		return ""
+	}
+	return tokens.Name(chk.Latest.Resources[0].URN.Project())
+}
+
 // massageBlobPath takes the path the user provided and converts it to an appropriate form go-cloud
 // can support.  Importantly, s3/azblob/gs paths should not be be touched. This will only affect
 // file:// paths which have a few oddities around them that we want to ensure work properly.
@@ -515,6 +2232,40 @@ func Login(ctx context.Context, d diag.Sink, url string, project *workspace.Proj
 	return be, workspace.StoreAccount(be.URL(), workspace.Account{}, true)
 }
 
+// ErrLegacyLayout is returned when attempting to write a stack
+// in the legacy layout into a store that uses project-scoped stacks.
+var ErrLegacyLayout = errors.New("legacy stack layout not allowed")
+
+// checkLayout returns an error if saving the checkpoint of the given stack
+// would write it into the legacy flat layout of a store with version 1 or newer.
+// Stacks there are invisible to clients that expect project-scoped stacks,
+// which leaves the store with both layouts mixed.
+func (b *localBackend) checkLayout(ref *localBackendReference) error {
+	if b.meta == nil || b.meta.Version < 1 || ref.project != "" {
+		return nil
+	}
+	return fmt.Errorf("%w: cannot write stack %q without a project into a state store with version %d; "+
+		"this version of the Pulumi CLI is too old for this store, please upgrade it",
+		ErrLegacyLayout, ref.name, b.meta.Version)
+}
+
+// defaultListConcurrency is the default maximum number of stacks
+// read concurrently when listing stacks.
+const defaultListConcurrency = 8
+
+// checkWritable returns an error if the backend must not modify the state store,
+// e.g. because it was opened in read-only mode.
+//
+// Operations that modify the store should check this up front
+// rather than relying on the bucket to reject the writes,
+// so that they fail before doing any work.
+func (b *localBackend) checkWritable() error {
+	if rb, ok := b.bucket.(*readOnlyBucket); ok {
+		return rb.err
+	}
+	return nil
+}
+
 func (b *localBackend) getReference(ref backend.StackReference) (*localBackendReference, error) {
 	stackRef, ok := ref.(*localBackendReference)
 	if !ok {
@@ -561,7 +2312,7 @@ func (b *localBackend) ListPolicyPacks(ctx context.Context, orgName string, _ ba
 }
 
 func (b *localBackend) SupportsTags() bool {
-	return false
+	return true
 }
 
 func (b *localBackend) SupportsOrganizations() bool {
@@ -622,7 +2373,10 @@ func currentProjectContradictsWorkspace(stack *localBackendReference) bool {
 
 func (b *localBackend) CreateStack(ctx context.Context, stackRef backend.StackReference,
 	root string, opts *backend.CreateStackOptions,
-) (backend.Stack, error) {
+) (_ backend.Stack, err error) {
+	ctx = withOperationID(ctx)
+	defer func() { err = operationError(ctx, err) }()
+
 	if opts != nil && len(opts.Teams) > 0 {
 		return nil, backend.ErrTeamsNotSupported
 	}
@@ -661,9 +2415,12 @@ func (b *localBackend) CreateStack(ctx context.Context, stackRef backend.StackRe
 	if err != nil {
 		return nil, err
 	}
+	if err := b.writeStackMeta(ctx, localStackRef, &stackMeta{Created: b.clock.Now().UTC()}); err != nil {
+		return nil, err
+	}
 
-	stack := newStack(localStackRef, file, nil, b)
-	b.d.Infof(diag.Message("", "Created stack '%s'"), stack.Ref())
+	stack := newStack(localStackRef, file, nil, nil, b)
+	b.sink(ctx).Infof(diag.Message("", "Created stack '%s'"), stack.Ref())
 
 	return stack, nil
 }
@@ -681,9 +2438,13 @@ func (b *localBackend) GetStack(ctx context.Context, stackRef backend.StackRefer
 		return nil, nil
 	case err != nil:
 		return nil, err
-	default:
-		return newStack(localStackRef, path, snapshot, b), nil
 	}
+
+	tags, err := b.readStackTags(ctx, localStackRef)
+	if err != nil {
+		return nil, err
+	}
+	return newStack(localStackRef, path, snapshot, tags, b), nil
 }
 
 func (b *localBackend) ListStacks(
@@ -695,27 +2456,114 @@ func (b *localBackend) ListStacks(
 		return nil, nil, err
 	}
 
-	// Note that the provided stack filter is only partially honored, since fields like organizations and tags
+	// Note that the provided stack filter is only partially honored, since organizations
 	// aren't persisted in the local backend.
-	results := make([]backend.StackSummary, 0, len(stacks))
+	filtered := stacks[:0]
 	for _, stackRef := range stacks {
 		// We can check for project name filter here, but be careful about legacy stores where project is always blank.
 		stackProject, hasProject := stackRef.Project()
 		if filter.Project != nil && hasProject && string(stackProject) != *filter.Project {
 			continue
 		}
+		filtered = append(filtered, stackRef)
+	}
+
+	summaries, err := b.readStackSummaries(ctx, filter, filtered)
+	if err != nil {
+		return nil, nil, err
+	}
+	return summaries, nil, nil
+}
+
+// readStackSummaries returns the summaries of the given stacks
+// that match the tag filter, in the same order.
+func (b *localBackend) readStackSummaries(
+	ctx context.Context, filter backend.ListStacksFilter, filtered []*localBackendReference,
+) ([]backend.StackSummary, error) {
+	// Reading each checkpoint is a separate round trip to the bucket,
+	// so read them concurrently.
+	// Each worker writes only to its own index of the results
+	// so that they're in the same order as the references.
+	results := make([]backend.StackSummary, len(filtered))
+	errs := make([]error, len(filtered))
+	var wg errgroup.Group
+	wg.SetLimit(b.listConcurrency)
+	for i, stackRef := range filtered {
+		i, stackRef := i, stackRef
+		wg.Go(func() error {
+			if ctx.Err() != nil {
+				// Don't start reading more stacks once the listing is canceled.
+				return nil
+			}
+			tags, err := b.readStackTags(ctx, stackRef)
+			if err != nil {
+				errs[i] = fmt.Errorf("read stack %v: %w", stackRef, err)
+				return nil
+			}
+			if !matchesTagFilter(filter, tags) {
+				return nil
+			}
+			chk, err := b.getCheckpoint(ctx, stackRef)
+			if errors.Is(err, errNoSnapshot) {
+				// The stack has no state at the snapshot the backend was opened at.
+				return nil
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("read stack %v: %w", stackRef, err)
+				return nil
+			}
+			summary := newLocalStackSummary(stackRef, chk, tags)
+			meta, err := b.readStackMeta(ctx, stackRef)
+			if err != nil {
+				errs[i] = fmt.Errorf("read stack %v: %w", stackRef, err)
+				return nil
+			}
+			if meta != nil {
+				summary.created = &meta.Created
+			}
+			if summary.LastUpdate() == nil {
+				// The stack has no deployment, e.g. because it was just created or imported,
+				// so fall back to its history.
+				if summary.lastUpdate, err = b.lastUpdateFromHistory(ctx, stackRef); err != nil {
+					errs[i] = fmt.Errorf("read stack %v: %w", stackRef, err)
+					return nil
+				}
+			}
+			results[i] = summary
+			return nil
+		})
+	}
+	contract.IgnoreError(wg.Wait()) // workers never fail
+	if err := ctx.Err(); err != nil {
+		// Each stack that wasn't read would fail with the same error.
+		return nil, err
+	}
 
-		chk, err := b.getCheckpoint(ctx, stackRef)
+	// Report all stacks that couldn't be read, not just the first one.
+	var merr *multierror.Error
+	for _, err := range errs {
 		if err != nil {
-			return nil, nil, err
+			merr = multierror.Append(merr, err)
 		}
-		results = append(results, newLocalStackSummary(stackRef, chk))
+	}
+	if err := merr.ErrorOrNil(); err != nil {
+		return nil, err
 	}
 
-	return results, nil, nil
+	// Drop the stacks that didn't match the tag filter.
+	summaries := results[:0]
+	for _, summary := range results {
+		if summary != nil {
+			summaries = append(summaries, summary)
+		}
+	}
+	return summaries, nil
 }
 
-func (b *localBackend) RemoveStack(ctx context.Context, stack backend.Stack, force bool) (bool, error) {
+func (b *localBackend) RemoveStack(ctx context.Context, stack backend.Stack, force bool) (_ bool, err error) {
+	ctx = withOperationID(ctx)
+	defer func() { err = operationError(ctx, err) }()
+
 	localStackRef, err := b.getReference(stack.Ref())
 	if err != nil {
 		return false, err
@@ -742,7 +2590,10 @@ func (b *localBackend) RemoveStack(ctx context.Context, stack backend.Stack, for
 
 func (b *localBackend) RenameStack(ctx context.Context, stack backend.Stack,
 	newName tokens.QName,
-) (backend.StackReference, error) {
+) (_ backend.StackReference, err error) {
+	ctx = withOperationID(ctx)
+	defer func() { err = operationError(ctx, err) }()
+
 	localStackRef, err := b.getReference(stack.Ref())
 	if err != nil {
 		return nil, err
@@ -801,12 +2652,43 @@ func (b *localBackend) renameStack(ctx context.Context, oldRef *localBackendRefe
 	// To remove the old stack, just make a backup of the file and don't write out anything new.
 	file := b.stackPath(ctx, oldRef)
 	backupTarget(ctx, b.bucket, file, false)
+	b.versions.forget(file)
 
 	// And rename the history folder as well.
 	if err = b.renameHistory(ctx, oldRef, newRef); err != nil {
 		return err
 	}
-	return err
+	if err = b.renameBackups(ctx, oldRef, newRef); err != nil {
+		return err
+	}
+	if err = b.renameStackTags(ctx, oldRef, newRef); err != nil {
+		return err
+	}
+	if err = b.renameStackMeta(ctx, oldRef, newRef); err != nil {
+		return err
+	}
+
+	// Carry over the configuration of the latest update
+	// so that the rename doesn't hide it from GetLatestConfiguration.
+	now := b.clock.Now().Unix()
+	update := backend.UpdateInfo{
+		Kind:      apitype.RenameUpdate,
+		StartTime: now,
+		EndTime:   now,
+		Message:   fmt.Sprintf("renamed from %v", oldRef),
+		Result:    backend.SucceededResult,
+	}
+	hist, err := b.getHistory(ctx, newRef, 1 /*pageSize*/, 1 /*page*/)
+	if err != nil {
+		return err
+	}
+	if len(hist) > 0 {
+		update.Config = hist[0].Config
+	}
+	if err := b.addToHistory(ctx, newRef, update); err != nil {
+		return fmt.Errorf("record rename in history: %w", err)
+	}
+	return nil
 }
 
 func (b *localBackend) GetLatestConfiguration(ctx context.Context,
@@ -845,9 +2727,10 @@ func (b *localBackend) Preview(ctx context.Context, stack backend.Stack,
 func (b *localBackend) Update(ctx context.Context, stack backend.Stack,
 	op backend.UpdateOperation,
 ) (sdkDisplay.ResourceChanges, result.Result) {
+	ctx = withOperationID(ctx)
 	err := b.Lock(ctx, stack.Ref())
 	if err != nil {
-		return nil, result.FromError(err)
+		return nil, result.FromError(operationError(ctx, err))
 	}
 	defer b.Unlock(ctx, stack.Ref())
 
@@ -857,9 +2740,10 @@ func (b *localBackend) Update(ctx context.Context, stack backend.Stack,
 func (b *localBackend) Import(ctx context.Context, stack backend.Stack,
 	op backend.UpdateOperation, imports []deploy.Import,
 ) (sdkDisplay.ResourceChanges, result.Result) {
+	ctx = withOperationID(ctx)
 	err := b.Lock(ctx, stack.Ref())
 	if err != nil {
-		return nil, result.FromError(err)
+		return nil, result.FromError(operationError(ctx, err))
 	}
 	defer b.Unlock(ctx, stack.Ref())
 
@@ -870,9 +2754,10 @@ func (b *localBackend) Import(ctx context.Context, stack backend.Stack,
 func (b *localBackend) Refresh(ctx context.Context, stack backend.Stack,
 	op backend.UpdateOperation,
 ) (sdkDisplay.ResourceChanges, result.Result) {
+	ctx = withOperationID(ctx)
 	err := b.Lock(ctx, stack.Ref())
 	if err != nil {
-		return nil, result.FromError(err)
+		return nil, result.FromError(operationError(ctx, err))
 	}
 	defer b.Unlock(ctx, stack.Ref())
 
@@ -882,9 +2767,10 @@ func (b *localBackend) Refresh(ctx context.Context, stack backend.Stack,
 func (b *localBackend) Destroy(ctx context.Context, stack backend.Stack,
 	op backend.UpdateOperation,
 ) (sdkDisplay.ResourceChanges, result.Result) {
+	ctx = withOperationID(ctx)
 	err := b.Lock(ctx, stack.Ref())
 	if err != nil {
-		return nil, result.FromError(err)
+		return nil, result.FromError(operationError(ctx, err))
 	}
 	defer b.Unlock(ctx, stack.Ref())
 
@@ -902,10 +2788,22 @@ func (b *localBackend) Watch(ctx context.Context, stk backend.Stack,
 }
 
 // apply actually performs the provided type of update on a locally hosted stack.
+//
+// It's part of the operation that ctx belongs to, if any, or else an operation of its own.
 func (b *localBackend) apply(
 	ctx context.Context, kind apitype.UpdateKind, stack backend.Stack,
 	op backend.UpdateOperation, opts backend.ApplierOptions,
 	events chan<- engine.Event,
+) (*deploy.Plan, sdkDisplay.ResourceChanges, result.Result) {
+	ctx = withOperationID(ctx)
+	plan, changes, res := b.applyOperation(ctx, kind, stack, op, opts, events)
+	return plan, changes, operationResult(ctx, res)
+}
+
+func (b *localBackend) applyOperation(
+	ctx context.Context, kind apitype.UpdateKind, stack backend.Stack,
+	op backend.UpdateOperation, opts backend.ApplierOptions,
+	events chan<- engine.Event,
 ) (*deploy.Plan, sdkDisplay.ResourceChanges, result.Result) {
 	stackRef := stack.Ref()
 	localStackRef, err := b.getReference(stackRef)
@@ -969,7 +2867,7 @@ func (b *localBackend) apply(
 	}
 
 	// Perform the update
-	start := time.Now().Unix()
+	start := b.clock.Now().Unix()
 	var plan *deploy.Plan
 	var changes sdkDisplay.ResourceChanges
 	var updateRes result.Result
@@ -987,7 +2885,7 @@ func (b *localBackend) apply(
 	default:
 		contract.Failf("Unrecognized update kind: %s", kind)
 	}
-	end := time.Now().Unix()
+	end := b.clock.Now().Unix()
 
 	// Wait for the display to finish showing all the events.
 	<-displayDone
@@ -1024,6 +2922,10 @@ func (b *localBackend) apply(
 		saveErr = b.addToHistory(ctx, localStackRef, info)
 		backupErr = b.backupStack(ctx, localStackRef)
 	}
+	if saveErr == nil && updateRes == nil && !opts.DryRun {
+		// The update has been recorded, so removing older ones can't lose it.
+		b.pruneHistory(ctx, localStackRef)
+	}
 
 	if updateRes != nil {
 		// We swallow saveErr and backupErr as they are less important than the updateErr.
@@ -1082,6 +2984,17 @@ func (b *localBackend) query(ctx context.Context, op backend.QueryOperation,
 	return backend.RunQuery(ctx, b, op, callerEventsOpt, b.newQuery)
 }
 
+func (b *localBackend) ListProjects(ctx context.Context) ([]tokens.Name, error) {
+	projStore, ok := b.store.(*projectReferenceStore)
+	if !ok {
+		// Legacy stores don't have projects,
+		// so all stacks belong to the same unnamed project.
+		return []tokens.Name{""}, nil
+	}
+
+	return projStore.ListProjects(ctx)
+}
+
 func (b *localBackend) GetHistory(
 	ctx context.Context,
 	stackRef backend.StackReference,
@@ -1146,8 +3059,14 @@ func (b *localBackend) ExportDeployment(ctx context.Context,
 	if err != nil {
 		return nil, err
 	}
+	return b.exportDeployment(ctx, localStackRef)
+}
 
-	chk, err := b.getCheckpoint(ctx, localStackRef)
+// exportDeployment returns the current deployment of the given stack.
+func (b *localBackend) exportDeployment(
+	ctx context.Context, ref *localBackendReference,
+) (*apitype.UntypedDeployment, error) {
+	chk, err := b.getCheckpoint(ctx, ref)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load checkpoint: %w", err)
 	}
@@ -1156,20 +3075,45 @@ func (b *localBackend) ExportDeployment(ctx context.Context,
 	if err != nil {
 		return nil, err
 	}
+	// Exports of the same state are byte-identical
+	// so that backups can be compared by their checksums.
+	data, err = canonicalJSON(data)
+	if err != nil {
+		return nil, err
+	}
 
 	return &apitype.UntypedDeployment{
 		Version:    3,
 		Deployment: json.RawMessage(data),
+		StateStore: b.stateStore(),
 	}, nil
 }
 
+// stateStore describes the version and layout of the state store.
+func (b *localBackend) stateStore() *apitype.StateStoreV1 {
+	info := &apitype.StateStoreV1{Layout: apitype.StateStoreLayoutProject}
+	if b.meta != nil {
+		info.Version = b.meta.Version
+	}
+	if _, ok := b.store.(*legacyReferenceStore); ok {
+		info.Layout = apitype.StateStoreLayoutLegacy
+	}
+	return info
+}
+
 func (b *localBackend) ImportDeployment(ctx context.Context, stk backend.Stack,
 	deployment *apitype.UntypedDeployment,
-) error {
+) (err error) {
+	ctx = withOperationID(ctx)
+	defer func() { err = operationError(ctx, err) }()
+
 	localStackRef, err := b.getReference(stk.Ref())
 	if err != nil {
 		return err
 	}
+	if err := checkDeploymentVersion(deployment); err != nil {
+		return err
+	}
 
 	err = b.Lock(ctx, localStackRef)
 	if err != nil {
@@ -1177,6 +3121,11 @@ func (b *localBackend) ImportDeployment(ctx context.Context, stk backend.Stack,
 	}
 	defer b.Unlock(ctx, localStackRef)
 
+	if err := checkNotRedacted(deployment); err != nil {
+		return err
+	}
+	b.checkImportedStateStore(ctx, deployment.StateStore)
+
 	stackName := localStackRef.FullyQualifiedName()
 	chk, err := stack.MarshalUntypedDeploymentToVersionedCheckpoint(stackName, deployment)
 	if err != nil {
@@ -1187,6 +3136,19 @@ func (b *localBackend) ImportDeployment(ctx context.Context, stk backend.Stack,
 	return err
 }
 
+// checkImportedStateStore warns if a deployment being imported
+// was exported from a state store with another version or layout.
+//
+// Deployments don't depend on the layout of the store they're saved in,
+// but a mismatch may mean the deployment was meant for another store.
+func (b *localBackend) checkImportedStateStore(ctx context.Context, src *apitype.StateStoreV1) {
+	if dst := b.stateStore(); src != nil && *src != *dst {
+		b.sink(ctx).Warningf(diag.Message("", "Importing a deployment exported from a state store "+
+			"with version %d (%v layout) into a state store with version %d (%v layout)"),
+			src.Version, src.Layout, dst.Version, dst.Layout)
+	}
+}
+
 func (b *localBackend) Logout() error {
 	return workspace.DeleteAccount(b.originalURL)
 }
@@ -1207,39 +3169,10 @@ func (b *localBackend) getLocalStacks(ctx context.Context) ([]*localBackendRefer
 	return b.store.ListReferences(ctx)
 }
 
-// UpdateStackTags updates the stacks's tags, replacing all existing tags.
-func (b *localBackend) UpdateStackTags(ctx context.Context,
-	stack backend.Stack, tags map[apitype.StackTagName]string,
-) error {
-	// The local backend does not currently persist tags.
-	return errors.New("stack tags not supported in --local mode")
-}
-
 func (b *localBackend) CancelCurrentUpdate(ctx context.Context, stackRef backend.StackReference) error {
-	// Try to delete ALL the lock files
-	allFiles, err := listBucket(ctx, b.bucket, stackLockDir(stackRef.FullyQualifiedName()))
-	if err != nil {
-		// Don't error if it just wasn't found
-		if gcerrors.Code(err) == gcerrors.NotFound {
-			return nil
-		}
+	if err := b.checkWritable(); err != nil {
 		return err
 	}
 
-	for _, file := range allFiles {
-		if file.IsDir {
-			continue
-		}
-
-		err := b.bucket.Delete(ctx, file.Key)
-		if err != nil {
-			// Race condition, don't error if the file was delete between us calling list and now
-			if gcerrors.Code(err) == gcerrors.NotFound {
-				return nil
-			}
-			return err
-		}
-	}
-
-	return nil
+	return b.locker.BreakLocks(ctx, stackRef.FullyQualifiedName())
 }
@@ -135,14 +135,14 @@ func TestCancel_legacy(t *testing.T) {
 	err = lb.Lock(ctx, aStackRef)
 	assert.NoError(t, err)
 	// check the lock file exists
-	lockExists, err := lb.bucket.Exists(ctx, lb.lockPath(aStackRef))
+	lockExists, err := lb.bucket.Exists(ctx, lb.locker.(*blobLocker).lockPath(aStackRef.FullyQualifiedName()))
 	assert.NoError(t, err)
 	assert.True(t, lockExists)
 	// Call CancelCurrentUpdate
 	err = lb.CancelCurrentUpdate(ctx, aStackRef)
 	assert.NoError(t, err)
 	// Now check the lock file no longer exists
-	lockExists, err = lb.bucket.Exists(ctx, lb.lockPath(aStackRef))
+	lockExists, err = lb.bucket.Exists(ctx, lb.locker.(*blobLocker).lockPath(aStackRef.FullyQualifiedName()))
 	assert.NoError(t, err)
 	assert.False(t, lockExists)
 
@@ -156,12 +156,12 @@ func TestCancel_legacy(t *testing.T) {
 	// Lock the stack with this new backend, then check that checkForLocks on the first backend now errors
 	err = otherBackend.Lock(ctx, aStackRef)
 	assert.NoError(t, err)
-	err = lb.checkForLock(ctx, aStackRef)
+	err = lb.locker.(*blobLocker).checkForLock(ctx, aStackRef.FullyQualifiedName())
 	assert.Error(t, err)
 	// Now call CancelCurrentUpdate and check that checkForLocks no longer errors
 	err = lb.CancelCurrentUpdate(ctx, aStackRef)
 	assert.NoError(t, err)
-	err = lb.checkForLock(ctx, aStackRef)
+	err = lb.locker.(*blobLocker).checkForLock(ctx, aStackRef.FullyQualifiedName())
 	assert.NoError(t, err)
 }
 
@@ -271,11 +271,16 @@ func TestRenameWorks_legacy(t *testing.T) {
 	assert.NoError(t, err)
 	assert.False(t, stackFileExists)
 
-	// Check we can still get the history
+	// Check we can still get the history,
+	// which records both renames, newest first.
 	history, err := b.GetHistory(ctx, cStackRef, 10, 0)
 	assert.NoError(t, err)
-	assert.Len(t, history, 1)
-	assert.Equal(t, apitype.DestroyUpdate, history[0].Kind)
+	require.Len(t, history, 3)
+	assert.Equal(t, apitype.RenameUpdate, history[0].Kind)
+	assert.Equal(t, "renamed from b", history[0].Message)
+	assert.Equal(t, apitype.RenameUpdate, history[1].Kind)
+	assert.Equal(t, "renamed from a", history[1].Message)
+	assert.Equal(t, apitype.DestroyUpdate, history[2].Kind)
 }
 
 // Regression test for https://github.com/pulumi/pulumi/issues/10439
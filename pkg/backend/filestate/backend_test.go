@@ -102,6 +102,84 @@ func TestMassageBlobPath(t *testing.T) {
 	})
 }
 
+func TestSplitBucketPrefix(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		give       string
+		wantURL    string
+		wantPrefix string
+		wantErr    string
+	}{
+		{give: "s3://bucket", wantURL: "s3://bucket"},
+		{give: "s3://bucket?region=us-west-2", wantURL: "s3://bucket?region=us-west-2"},
+		{give: "s3://bucket?prefix=team-a", wantURL: "s3://bucket", wantPrefix: "team-a"},
+		{give: "s3://bucket?prefix=team-a/.pulumi", wantURL: "s3://bucket", wantPrefix: "team-a"},
+		{give: "s3://bucket?prefix=/org/team-a/", wantURL: "s3://bucket", wantPrefix: "org/team-a"},
+		{give: "s3://bucket?prefix=.pulumi", wantURL: "s3://bucket"},
+		{
+			give:       "s3://bucket?region=us-west-2&prefix=team-a",
+			wantURL:    "s3://bucket?region=us-west-2",
+			wantPrefix: "team-a",
+		},
+		{give: "file:///tmp/state?prefix=team-a", wantURL: "file:///tmp/state", wantPrefix: "team-a"},
+		{give: "s3://bucket?prefix=", wantErr: "must not be empty"},
+		{give: "s3://bucket?prefix=a//b", wantErr: `invalid prefix "a//b"`},
+		{give: "s3://bucket?prefix=../b", wantErr: `invalid prefix "../b"`},
+		{give: "s3://bucket?prefix=a/./b", wantErr: `invalid prefix "a/./b"`},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.give, func(t *testing.T) {
+			t.Parallel()
+
+			gotURL, gotPrefix, err := splitBucketPrefix(tt.give)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantURL, gotURL)
+			assert.Equal(t, tt.wantPrefix, gotPrefix)
+		})
+	}
+}
+
+// Multiple independent state stores may share a bucket
+// if they use different prefixes.
+func TestNew_prefix(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	stateDir := t.TempDir()
+	for _, team := range []string{"team-a", "team-b"} {
+		b, err := newLocalBackend(ctx, diagtest.LogSink(t),
+			"file://"+filepath.ToSlash(stateDir)+"?prefix="+team+"/.pulumi",
+			&workspace.Project{Name: "proj"}, nil)
+		require.NoError(t, err)
+		assert.Equal(t, team, path.Base(b.url))
+
+		ref, err := b.parseStackReference(team)
+		require.NoError(t, err)
+		_, err = b.CreateStack(ctx, ref, "", nil)
+		require.NoError(t, err)
+		require.NoError(t, b.Lock(ctx, ref))
+		assert.FileExists(t, filepath.Join(stateDir, team, ".pulumi", "locks", "organization", "proj", team,
+			b.locker.(*blobLocker).id+".json"))
+		b.Unlock(ctx, ref)
+
+		stacks, _, err := b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+		require.NoError(t, err)
+		require.Len(t, stacks, 1)
+		assert.Equal(t, team, stacks[0].Name().Name().String())
+
+		assert.FileExists(t, filepath.Join(stateDir, team, ".pulumi", "meta.yaml"))
+		assert.FileExists(t, filepath.Join(stateDir, team, ".pulumi", "stacks", "proj", team+".json"))
+	}
+	assert.NoDirExists(t, filepath.Join(stateDir, ".pulumi"))
+}
+
 func TestGetLogsForTargetWithNoSnapshot(t *testing.T) {
 	t.Parallel()
 
@@ -269,14 +347,14 @@ func TestCancel(t *testing.T) {
 	err = lb.Lock(ctx, aStackRef)
 	assert.NoError(t, err)
 	// check the lock file exists
-	lockExists, err := lb.bucket.Exists(ctx, lb.lockPath(aStackRef))
+	lockExists, err := lb.bucket.Exists(ctx, lb.locker.(*blobLocker).lockPath(aStackRef.FullyQualifiedName()))
 	assert.NoError(t, err)
 	assert.True(t, lockExists)
 	// Call CancelCurrentUpdate
 	err = lb.CancelCurrentUpdate(ctx, aStackRef)
 	assert.NoError(t, err)
 	// Now check the lock file no longer exists
-	lockExists, err = lb.bucket.Exists(ctx, lb.lockPath(aStackRef))
+	lockExists, err = lb.bucket.Exists(ctx, lb.locker.(*blobLocker).lockPath(aStackRef.FullyQualifiedName()))
 	assert.NoError(t, err)
 	assert.False(t, lockExists)
 
@@ -290,12 +368,12 @@ func TestCancel(t *testing.T) {
 	// Lock the stack with this new backend, then check that checkForLocks on the first backend now errors
 	err = otherBackend.Lock(ctx, aStackRef)
 	assert.NoError(t, err)
-	err = lb.checkForLock(ctx, aStackRef)
+	err = lb.locker.(*blobLocker).checkForLock(ctx, aStackRef.FullyQualifiedName())
 	assert.Error(t, err)
 	// Now call CancelCurrentUpdate and check that checkForLocks no longer errors
 	err = lb.CancelCurrentUpdate(ctx, aStackRef)
 	assert.NoError(t, err)
-	err = lb.checkForLock(ctx, aStackRef)
+	err = lb.locker.(*blobLocker).checkForLock(ctx, aStackRef.FullyQualifiedName())
 	assert.NoError(t, err)
 }
 
@@ -342,6 +420,113 @@ func TestRemoveMakesBackups(t *testing.T) {
 	assert.True(t, backupFileExists)
 }
 
+func TestRemoveStack_historyAndBackups(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, nil)
+	addTestHistory(t, b, ref, 20)
+	require.NoError(t, b.backupStack(ctx, ref))
+
+	foo, err := b.GetStack(ctx, ref)
+	require.NoError(t, err)
+	_, err = b.RemoveStack(ctx, foo, false /* force */)
+	require.NoError(t, err)
+
+	for _, dir := range []string{ref.HistoryDir(), ref.BackupDir(), stackLockDir(ref.FullyQualifiedName())} {
+		files, err := listBucket(ctx, b.bucket, dir)
+		require.NoError(t, err)
+		assert.Empty(t, files, "files in %v", dir)
+	}
+	exists, err := b.bucket.Exists(ctx, b.stackPath(ctx, ref))
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestRemoveStack_progress(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	var events []ProgressEvent
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"},
+		&localBackendOptions{
+			Getenv:            mapGetenv(nil),
+			DeleteConcurrency: 2,
+			Progress:          func(e ProgressEvent) { events = append(events, e) },
+		})
+	require.NoError(t, err)
+	assert.Equal(t, 2, b.deleteConcurrency)
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	foo, err := b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+	addTestHistory(t, b, ref, 10)
+	history, err := listBucket(ctx, b.bucket, ref.HistoryDir())
+	require.NoError(t, err)
+
+	_, err = b.RemoveStack(ctx, foo, false /* force */)
+	require.NoError(t, err)
+
+	// Every file of the stack is reported once.
+	require.Greater(t, len(events), len(history))
+	keys := make(map[string]bool)
+	for i, e := range events {
+		assert.Equal(t, ProgressRemove, e.Operation)
+		assert.Equal(t, "organization/proj/foo", e.Stack)
+		assert.Equal(t, i+1, e.Files)
+		keys[e.Key] = true
+	}
+	assert.Len(t, keys, len(events))
+	assert.True(t, keys[b.stackPath(ctx, ref)], "checkpoint not reported")
+	for _, f := range history {
+		assert.True(t, keys[f.Key], "%v not reported", f.Key)
+	}
+}
+
+func TestNew_deleteConcurrency(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()), nil,
+		&localBackendOptions{Getenv: mapGetenv(nil)})
+	require.NoError(t, err)
+	assert.Equal(t, defaultDeleteConcurrency, b.deleteConcurrency)
+
+	b, err = newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()), nil,
+		&localBackendOptions{Getenv: mapGetenv(map[string]string{
+			"PULUMI_SELF_MANAGED_STATE_DELETE_CONCURRENCY": "64",
+		})})
+	require.NoError(t, err)
+	assert.Equal(t, 64, b.deleteConcurrency)
+
+	_, err = newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()), nil,
+		&localBackendOptions{Getenv: mapGetenv(map[string]string{
+			"PULUMI_SELF_MANAGED_STATE_DELETE_CONCURRENCY": "0",
+		})})
+	assert.ErrorContains(t, err, "is not a positive number")
+}
+
+func TestRemoveStack_locked(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, nil)
+	addTestHistory(t, b, ref, 2)
+	writeLock(t, b, "foo", "other", LockInfo{Pid: 42, Timestamp: time.Now()})
+
+	foo, err := b.GetStack(ctx, ref)
+	require.NoError(t, err)
+	_, err = b.RemoveStack(ctx, foo, true /* force */)
+	assert.ErrorContains(t, err, "the stack is currently locked")
+
+	// Nothing was removed.
+	history, err := b.GetHistory(ctx, ref, 0 /* pageSize */, 0 /* page */)
+	require.NoError(t, err)
+	assert.Len(t, history, 2)
+}
+
 func TestRenameWorks(t *testing.T) {
 	t.Parallel()
 
@@ -405,11 +590,76 @@ func TestRenameWorks(t *testing.T) {
 	assert.NoError(t, err)
 	assert.False(t, stackFileExists)
 
-	// Check we can still get the history
+	// Check we can still get the history,
+	// which records both renames, newest first.
 	history, err := b.GetHistory(ctx, cStackRef, 10, 0)
 	assert.NoError(t, err)
-	assert.Len(t, history, 1)
-	assert.Equal(t, apitype.DestroyUpdate, history[0].Kind)
+	require.Len(t, history, 3)
+	assert.Equal(t, apitype.RenameUpdate, history[0].Kind)
+	assert.Equal(t, "renamed from organization/project/b", history[0].Message)
+	assert.Equal(t, apitype.RenameUpdate, history[1].Kind)
+	assert.Equal(t, "renamed from organization/project/a", history[1].Message)
+	assert.Equal(t, apitype.DestroyUpdate, history[2].Kind)
+}
+
+// Renaming a stack should move its backups and snapshots with it.
+func TestRenameStack_backups(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	stateDir := t.TempDir()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+		&workspace.Project{Name: "proj"}, nil)
+	require.NoError(t, err)
+
+	fooRef, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	foo, err := b.CreateStack(ctx, fooRef, "", nil)
+	require.NoError(t, err)
+
+	snapID, err := b.Snapshot(ctx, fooRef, nil /* events */)
+	require.NoError(t, err)
+	require.NoError(t, b.backupStack(ctx, fooRef))
+
+	// A history entry with configuration.
+	require.NoError(t, b.addToHistory(ctx, fooRef, backend.UpdateInfo{
+		Kind:   apitype.UpdateUpdate,
+		Config: config.Map{config.MustMakeKey("proj", "greeting"): config.NewValue("hello")},
+	}))
+
+	// Renaming to an invalid name or an existing stack fails
+	// without touching the original.
+	_, err = b.RenameStack(ctx, foo, "organization/proj/not a valid name")
+	assert.Error(t, err)
+	barRef, err := b.parseStackReference("bar")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, barRef, "", nil)
+	require.NoError(t, err)
+	_, err = b.RenameStack(ctx, foo, "organization/proj/bar")
+	assert.ErrorContains(t, err, "a stack named bar already exists")
+
+	bazRefI, err := b.RenameStack(ctx, foo, "organization/proj/baz")
+	require.NoError(t, err)
+	bazRef := bazRefI.(*localBackendReference)
+
+	backupsDir := filepath.Join(stateDir, ".pulumi", "backups", "proj")
+	leftover, err := filepath.Glob(filepath.Join(backupsDir, "foo", "*"))
+	require.NoError(t, err)
+	assert.Empty(t, leftover)
+	backups, err := filepath.Glob(filepath.Join(backupsDir, "baz", "baz.*.json"))
+	require.NoError(t, err)
+	assert.Len(t, backups, 1)
+
+	snapshots, err := b.listSnapshots(ctx, bazRef)
+	require.NoError(t, err)
+	require.Len(t, snapshots, 1)
+	assert.Equal(t, snapID, snapshots[0].id)
+
+	baz, err := b.GetStack(ctx, bazRef)
+	require.NoError(t, err)
+	cfg, err := b.GetLatestConfiguration(ctx, baz)
+	require.NoError(t, err)
+	assert.Equal(t, config.NewValue("hello"), cfg[config.MustMakeKey("proj", "greeting")])
 }
 
 func TestLoginToNonExistingFolderFails(t *testing.T) {
@@ -517,6 +767,47 @@ func TestLocalBackendRejectsStackInitOptions(t *testing.T) {
 	assert.ErrorIs(t, err, backend.ErrTeamsNotSupported)
 }
 
+func TestListProjects(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	t.Run("project", func(t *testing.T) {
+		t.Parallel()
+
+		b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()), nil, nil)
+		require.NoError(t, err)
+		for _, name := range []string{"organization/a/dev", "organization/a/prod", "organization/b/dev"} {
+			ref, err := b.parseStackReference(name)
+			require.NoError(t, err)
+			_, err = b.CreateStack(ctx, ref, "", nil)
+			require.NoError(t, err)
+		}
+
+		projects, err := b.ListProjects(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, []tokens.Name{"a", "b"}, projects)
+	})
+
+	t.Run("legacy", func(t *testing.T) {
+		t.Parallel()
+
+		b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+			nil, &localBackendOptions{Getenv: mapGetenv(map[string]string{
+				"PULUMI_SELF_MANAGED_STATE_LEGACY_LAYOUT": "true",
+			})})
+		require.NoError(t, err)
+		ref, err := b.parseStackReference("dev")
+		require.NoError(t, err)
+		_, err = b.CreateStack(ctx, ref, "", nil)
+		require.NoError(t, err)
+
+		projects, err := b.ListProjects(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, []tokens.Name{""}, projects)
+	})
+}
+
 func TestLegacyFolderStructure(t *testing.T) {
 	t.Parallel()
 
@@ -801,6 +1092,7 @@ func TestNew_legacyFileWarning(t *testing.T) {
 		files   map[string]string
 		env     map[string]string
 		wantOut string
+		wantErr string
 	}{
 		{
 			desc: "no legacy stacks",
@@ -817,8 +1109,8 @@ func TestNew_legacyFileWarning(t *testing.T) {
 				".pulumi/stacks/c.json.bak": "{}", // should ignore backup files
 			},
 			wantOut: "warning: Found legacy stack files in state store:\n" +
-				"  - a\n" +
-				"  - b\n" +
+				"  - a (.pulumi/stacks/a.json)\n" +
+				"  - b (.pulumi/stacks/b.json)\n" +
 				"Please run 'pulumi state upgrade' to migrate them to the new format.\n" +
 				"Set PULUMI_SELF_MANAGED_STATE_NO_LEGACY_WARNING=1 to disable this warning.\n",
 		},
@@ -832,6 +1124,26 @@ func TestNew_legacyFileWarning(t *testing.T) {
 				"PULUMI_SELF_MANAGED_STATE_NO_LEGACY_WARNING": "true",
 			},
 		},
+		{
+			desc: "strict",
+			files: map[string]string{
+				".pulumi/stacks/a.json.gz": "{}",
+				".pulumi/stacks/b.bak":     "{}",
+			},
+			env: map[string]string{
+				"PULUMI_SELF_MANAGED_STATE_STRICT_LAYOUT":     "true",
+				"PULUMI_SELF_MANAGED_STATE_NO_LEGACY_WARNING": "true",
+			},
+			wantErr: "has project-scoped stacks, but also legacy stack files:\n" +
+				"  - a (.pulumi/stacks/a.json.gz)\n" +
+				"Run 'pulumi state upgrade' to migrate them to the new format",
+		},
+		{
+			desc: "strict without legacy stacks",
+			env: map[string]string{
+				"PULUMI_SELF_MANAGED_STATE_STRICT_LAYOUT": "true",
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -860,7 +1172,11 @@ func TestNew_legacyFileWarning(t *testing.T) {
 				&localBackendOptions{
 					Getenv: mapGetenv(tt.env),
 				})
-			require.NoError(t, err)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
 
 			assert.Equal(t, tt.wantOut, buff.String())
 		})
@@ -936,6 +1252,109 @@ func TestLegacyUpgrade(t *testing.T) {
 	assert.True(t, stackFileExists)
 }
 
+// Upgrades run the same migration as Migrate.
+func TestLegacyUpgrade_migrate(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	stateDir := t.TempDir()
+	bucket, err := fileblob.OpenBucket(stateDir, nil)
+	require.NoError(t, err)
+	writeFiles(t, bucket, map[string]string{
+		".pulumi/stacks/a.json":              legacyCheckpoint,
+		".pulumi/history/a/a-1.history.json": "{}",
+	})
+
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), nil, nil)
+	require.NoError(t, err)
+	legacyRef, err := b.parseStackReference("a")
+	require.NoError(t, err)
+	require.NoError(t, b.SetStackTags(ctx, legacyRef, map[apitype.StackTagName]string{"team": "infra"}))
+
+	// It doesn't run while another migration does.
+	unlock, err := lockMigration(ctx, b.bucket, systemClock{})
+	require.NoError(t, err)
+	assert.ErrorIs(t, b.Upgrade(ctx), ErrMigrationInProgress)
+	assertExists(t, bucket, ".pulumi/stacks/a.json")
+	unlock()
+
+	require.NoError(t, b.Upgrade(ctx))
+	assertExists(t, bucket, ".pulumi/stacks/a.json.bak")
+	assertExists(t, bucket, ".pulumi/history/proj/a/a-1.history.json")
+	assertNotExists(t, bucket, migrationJournalPath)
+
+	ref, err := b.parseStackReference("organization/proj/a")
+	require.NoError(t, err)
+	tags, err := b.GetStackTags(ctx, ref)
+	require.NoError(t, err)
+	assert.Equal(t, "infra", tags["team"])
+
+	// Upgrading again has nothing to do.
+	require.NoError(t, b.Upgrade(ctx))
+	assertExists(t, bucket, ".pulumi/stacks/proj/a.json")
+}
+
+// Upgrading a store should not lose the checksum setting
+// and should update the cached metadata.
+func TestLegacyUpgrade_checksums(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	bucket, err := fileblob.OpenBucket(stateDir, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t,
+		bucket.WriteAll(ctx, ".pulumi/meta.yaml", []byte("version: 0\nchecksum: sha256\n"), nil))
+
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, &pulumiMeta{Version: 0, Checksum: "sha256"}, b.meta)
+
+	require.NoError(t, b.Upgrade(ctx))
+	assert.Equal(t, &pulumiMeta{Version: 1, Checksum: "sha256"}, b.meta)
+	assert.True(t, b.checksums)
+
+	got, err := ReadMeta(ctx, bucket)
+	require.NoError(t, err)
+	assert.Equal(t, &Meta{Version: 1, Exists: true, Checksum: "sha256"}, got)
+}
+
+// The cached metadata is only re-read on RefreshMeta.
+func TestRefreshMeta(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	bucket, err := fileblob.OpenBucket(stateDir, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t,
+		bucket.WriteAll(ctx, ".pulumi/stacks/foo.json", []byte(`{}`), nil))
+
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), nil, nil)
+	require.NoError(t, err)
+	assert.IsType(t, &legacyReferenceStore{}, b.store)
+	assert.Equal(t, StoreInfo{Version: 0, Legacy: true}, b.StoreInfo())
+
+	// Another process upgrades the store.
+	require.NoError(t,
+		bucket.WriteAll(ctx, ".pulumi/meta.yaml", []byte("version: 1\n"), nil))
+	assert.IsType(t, &legacyReferenceStore{}, b.store)
+
+	require.NoError(t, b.RefreshMeta(ctx))
+	assert.IsType(t, &projectReferenceStore{}, b.store)
+	assert.Equal(t, &pulumiMeta{Version: 1}, b.meta)
+	assert.Equal(t, StoreInfo{Version: 1, MetaExists: true}, b.StoreInfo())
+
+	// A store that became too new is rejected.
+	require.NoError(t,
+		bucket.WriteAll(ctx, ".pulumi/meta.yaml", []byte("version: 42\n"), nil))
+	err = b.RefreshMeta(ctx)
+	assert.ErrorIs(t, err, ErrStoreTooNew)
+	assert.Equal(t, &pulumiMeta{Version: 1}, b.meta)
+}
+
 func TestLegacyUpgrade_partial(t *testing.T) {
 	t.Parallel()
 
@@ -979,6 +1398,41 @@ func TestLegacyUpgrade_partial(t *testing.T) {
 	assert.Equal(t, tokens.QName("organization/project/foo"), ref.FullyQualifiedName())
 }
 
+// Stores with project-scoped stacks must never get legacy stack files.
+func TestSaveCheckpoint_refusesLegacyLayout(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	stateDir := t.TempDir()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+		&workspace.Project{Name: "proj"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, b.meta.Version)
+
+	legacyRef := newLegacyReferenceStore(b.bucket).newReference("foo")
+	_, _, err = b.saveCheckpoint(ctx, legacyRef, &apitype.VersionedCheckpoint{
+		Version:    apitype.DeploymentSchemaVersionCurrent,
+		Checkpoint: json.RawMessage(`{}`),
+	})
+	assert.ErrorIs(t, err, ErrLegacyLayout)
+	assert.ErrorContains(t, err, "too old")
+	assert.NoFileExists(t, filepath.Join(stateDir, ".pulumi", "stacks", "foo.json"))
+
+	// Legacy stores are unaffected.
+	legacy, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"},
+		&localBackendOptions{Getenv: mapGetenv(map[string]string{
+			"PULUMI_SELF_MANAGED_STATE_LEGACY_LAYOUT": "true",
+		})})
+	require.NoError(t, err)
+	_, _, err = legacy.saveCheckpoint(ctx, newLegacyReferenceStore(legacy.bucket).newReference("foo"),
+		&apitype.VersionedCheckpoint{
+			Version:    apitype.DeploymentSchemaVersionCurrent,
+			Checkpoint: json.RawMessage(`{}`),
+		})
+	assert.NoError(t, err)
+}
+
 // If an upgrade failed because we couldn't write the meta.yaml,
 // the stacks should be left in legacy mode.
 func TestLegacyUpgrade_writeMetaError(t *testing.T) {
@@ -1013,7 +1467,7 @@ func TestLegacyUpgrade_writeMetaError(t *testing.T) {
 	require.Error(t, b.Upgrade(ctx))
 
 	stderr := buff.String()
-	assert.Contains(t, stderr, "error: Could not write new state metadata file")
+	assert.Regexp(t, `error: \[operation [^]]+\] Could not write new state metadata file`, stderr)
 	assert.Contains(t, stderr, "Please verify that the storage is writable")
 
 	assert.FileExists(t, filepath.Join(stateDir, ".pulumi", "stacks", "foo.json"),
@@ -1038,6 +1492,65 @@ func TestNew_unsupportedStoreVersion(t *testing.T) {
 	_, err = New(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), nil)
 	assert.ErrorContains(t, err, "state store unsupported")
 	assert.ErrorContains(t, err, "'meta.yaml' version (999999999) is not supported")
+	assert.ErrorIs(t, err, ErrStoreTooNew)
+}
+
+func TestNew_unsupportedStoreVersionJSON(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	bucket, err := fileblob.OpenBucket(stateDir, nil)
+	require.NoError(t, err)
+
+	// The error names the metadata file that the version was read from.
+	ctx := context.Background()
+	require.NoError(t,
+		bucket.WriteAll(ctx, ".pulumi/meta.json", []byte(`{"version": 999999999}`), nil))
+
+	_, err = New(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), nil)
+	assert.ErrorContains(t, err, "'meta.json' version (999999999) is not supported")
+	assert.ErrorIs(t, err, ErrStoreTooNew)
+}
+
+func TestNew_allowNewerStoreVersion(t *testing.T) {
+	t.Parallel()
+
+	// Verifies that stores from newer CLIs can be read when opted into,
+	// but that all writes are rejected.
+
+	stateDir := t.TempDir()
+	bucket, err := fileblob.OpenBucket(stateDir, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t,
+		bucket.WriteAll(ctx, ".pulumi/meta.yaml", []byte("version: 3"), nil))
+	require.NoError(t,
+		bucket.WriteAll(ctx, ".pulumi/stacks/proj/foo.json", []byte(`{"latest": {}}`), nil))
+
+	var buff bytes.Buffer
+	sink := diag.DefaultSink(io.Discard, &buff, diag.FormatOptions{Color: colors.Never})
+	b, err := newLocalBackend(ctx, sink, "file://"+filepath.ToSlash(stateDir), nil,
+		&localBackendOptions{
+			Getenv: mapGetenv(map[string]string{
+				"PULUMI_SELF_MANAGED_STATE_ALLOW_NEWER": "true",
+			}),
+		})
+	require.NoError(t, err)
+	assert.Contains(t, buff.String(), "will be opened in read-only mode")
+
+	stacks, _, err := b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+	require.NoError(t, err)
+	require.Len(t, stacks, 1)
+	assert.Equal(t, "organization/proj/foo", stacks[0].Name().String())
+
+	barRef, err := b.ParseStackReference("organization/proj/bar")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, barRef, "", nil)
+	assert.ErrorIs(t, err, ErrStoreTooNew)
+	assert.NoFileExists(t, filepath.Join(stateDir, ".pulumi", "stacks", "proj", "bar.json"))
+
+	assert.ErrorIs(t, b.Upgrade(ctx), ErrStoreTooNew)
 }
 
 // TestSerializeTimestampRFC3339 captures our expectations that Created and Modified will be serialized to
@@ -1118,7 +1631,7 @@ func TestCreateStack_gzip(t *testing.T) {
 	assert.FileExists(t, filepath.Join(stateDir, ".pulumi", "stacks", "testproj", "foo.json.gz"))
 }
 
-func TestCreateStack_retainCheckpoints(t *testing.T) {
+func TestCreateStack_gzipLevel(t *testing.T) {
 	t.Parallel()
 
 	stateDir := t.TempDir()
@@ -1129,7 +1642,8 @@ func TestCreateStack_retainCheckpoints(t *testing.T) {
 		&workspace.Project{Name: "testproj"},
 		&localBackendOptions{
 			Getenv: mapGetenv(map[string]string{
-				"PULUMI_RETAIN_CHECKPOINTS": "true",
+				"PULUMI_SELF_MANAGED_STATE_GZIP":       "true",
+				"PULUMI_SELF_MANAGED_STATE_GZIP_LEVEL": "9",
 			}),
 		},
 	)
@@ -1137,16 +1651,274 @@ func TestCreateStack_retainCheckpoints(t *testing.T) {
 
 	fooRef, err := b.ParseStackReference("foo")
 	require.NoError(t, err)
-
 	_, err = b.CreateStack(ctx, fooRef, "", nil)
 	require.NoError(t, err)
 
-	// With PULUMI_RETAIN_CHECKPOINTS enabled,
-	// we'll make copies of files under $orig.$timestamp.
-	// Since we can't predict the timestamp,
-	// we'll just check that there's at least one file
-	// with a timestamp extension.
-	got, err := filepath.Glob(
+	bucket, err := fileblob.OpenBucket(stateDir, nil)
+	require.NoError(t, err)
+	key := ".pulumi/stacks/testproj/foo.json.gz"
+	body, err := bucket.ReadAll(ctx, key)
+	require.NoError(t, err)
+	assert.True(t, encoding.IsCompressed(body), "checkpoint is not compressed")
+
+	// The object should carry a hint that it's compressed.
+	attrs, err := bucket.Attributes(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, "gzip", attrs.ContentEncoding)
+
+	// Stacks can be read back.
+	stack, err := b.GetStack(ctx, fooRef)
+	require.NoError(t, err)
+	assert.NotNil(t, stack)
+}
+
+func TestNew_invalidGzipLevel(t *testing.T) {
+	t.Parallel()
+
+	_, err := newLocalBackend(context.Background(), diagtest.LogSink(t),
+		"file://"+filepath.ToSlash(t.TempDir()), nil,
+		&localBackendOptions{
+			Getenv: mapGetenv(map[string]string{
+				"PULUMI_SELF_MANAGED_STATE_GZIP_LEVEL": "42",
+			}),
+		})
+	assert.ErrorContains(t, err, `invalid PULUMI_SELF_MANAGED_STATE_GZIP_LEVEL: "42"`)
+}
+
+func TestSaveCheckpoint_format(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, map[string]string{PulumiFilestateCheckpointFormatEnvVar: "compact"})
+	_, _, err := b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 2))
+	require.NoError(t, err)
+	compact, err := b.bucket.ReadAll(ctx, b.stackPath(ctx, ref))
+	require.NoError(t, err)
+	assert.Equal(t, 1, bytes.Count(compact, []byte("\n")), "compact checkpoint should be a single line")
+
+	// Pretty files are written the same way every time.
+	b.checkpointFormat = CheckpointFormatPretty
+	var pretty [][]byte
+	for i := 0; i < 2; i++ {
+		_, _, err = b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 2))
+		require.NoError(t, err)
+		byts, err := b.bucket.ReadAll(ctx, b.stackPath(ctx, ref))
+		require.NoError(t, err)
+		pretty = append(pretty, byts)
+	}
+	assert.Greater(t, bytes.Count(pretty[0], []byte("\n")), 1)
+	assert.Equal(t, pretty[0], pretty[1])
+	assert.JSONEq(t, string(compact), string(pretty[0]))
+
+	// Either format is read back.
+	for _, byts := range [][]byte{compact, pretty[0]} {
+		require.NoError(t, b.bucket.WriteAll(ctx, b.stackPath(ctx, ref), byts, nil))
+		chk, err := b.getCheckpoint(ctx, ref)
+		require.NoError(t, err)
+		assert.Len(t, chk.Latest.Resources, 2)
+	}
+}
+
+func TestNew_invalidCheckpointFormat(t *testing.T) {
+	t.Parallel()
+
+	_, err := newLocalBackend(context.Background(), diagtest.LogSink(t),
+		"file://"+filepath.ToSlash(t.TempDir()), nil,
+		&localBackendOptions{CheckpointFormat: "yaml"})
+	assert.ErrorContains(t, err, `invalid checkpoint format "yaml"`)
+}
+
+// A store with both plain and compressed checkpoints should be readable.
+func TestListStacks_mixedGzip(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	ctx := context.Background()
+	plain, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+		&workspace.Project{Name: "testproj"}, nil)
+	require.NoError(t, err)
+	compressed, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+		&workspace.Project{Name: "testproj"},
+		&localBackendOptions{
+			Getenv: mapGetenv(map[string]string{
+				"PULUMI_SELF_MANAGED_STATE_GZIP": "true",
+			}),
+		})
+	require.NoError(t, err)
+
+	aRef, err := plain.ParseStackReference("a")
+	require.NoError(t, err)
+	_, err = plain.CreateStack(ctx, aRef, "", nil)
+	require.NoError(t, err)
+
+	bRef, err := compressed.ParseStackReference("b")
+	require.NoError(t, err)
+	_, err = compressed.CreateStack(ctx, bRef, "", nil)
+	require.NoError(t, err)
+
+	for _, be := range []*localBackend{plain, compressed} {
+		stacks, _, err := be.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+		require.NoError(t, err)
+		assert.Len(t, stacks, 2)
+	}
+}
+
+// Stacks read concurrently should still be listed in a deterministic order.
+func TestListStacks_concurrent(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+		&workspace.Project{Name: "testproj"},
+		&localBackendOptions{
+			Getenv: mapGetenv(map[string]string{
+				"PULUMI_SELF_MANAGED_STATE_LIST_CONCURRENCY": "3",
+			}),
+		})
+	require.NoError(t, err)
+	assert.Equal(t, 3, b.listConcurrency)
+
+	var want []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("stack%02d", i)
+		ref, err := b.ParseStackReference(name)
+		require.NoError(t, err)
+		_, err = b.CreateStack(ctx, ref, "", nil)
+		require.NoError(t, err)
+		want = append(want, name)
+	}
+
+	for i := 0; i < 5; i++ {
+		stacks, _, err := b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+		require.NoError(t, err)
+
+		got := make([]string, len(stacks))
+		for i, s := range stacks {
+			got[i] = s.Name().String()
+		}
+		assert.Equal(t, want, got)
+	}
+}
+
+// All stacks that can't be read should be reported, not just the first.
+func TestListStacks_aggregateErrors(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+		&workspace.Project{Name: "testproj"}, nil)
+	require.NoError(t, err)
+
+	for _, name := range []string{"a", "b", "c", "d"} {
+		ref, err := b.ParseStackReference(name)
+		require.NoError(t, err)
+		_, err = b.CreateStack(ctx, ref, "", nil)
+		require.NoError(t, err)
+	}
+
+	stacksDir := filepath.Join(stateDir, ".pulumi", "stacks", "testproj")
+	for _, name := range []string{"b", "d"} {
+		require.NoError(t, os.WriteFile(filepath.Join(stacksDir, name+".json"), []byte("{"), 0o600))
+	}
+
+	_, _, err = b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "2 errors occurred")
+	assert.ErrorContains(t, err, "read stack b:")
+	assert.ErrorContains(t, err, "read stack d:")
+	assert.NotContains(t, err.Error(), "read stack a:")
+	assert.NotContains(t, err.Error(), "read stack c:")
+}
+
+// cancelingBucket is a Bucket that cancels a context when it's first read from.
+type cancelingBucket struct {
+	Bucket
+
+	cancel context.CancelFunc
+}
+
+func (b *cancelingBucket) ReadAll(ctx context.Context, key string) ([]byte, error) {
+	b.cancel()
+	return b.Bucket.ReadAll(ctx, key)
+}
+
+func TestListStacks_canceled(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "testproj"}, nil)
+	require.NoError(t, err)
+	for _, name := range []string{"a", "b", "c"} {
+		ref, err := b.ParseStackReference(name)
+		require.NoError(t, err)
+		_, err = b.CreateStack(ctx, ref, "", nil)
+		require.NoError(t, err)
+	}
+
+	// Cancel the listing once the first stack is read.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	b.bucket = &cancelingBucket{Bucket: b.bucket, cancel: cancel}
+
+	stacks, _, err := b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+	assert.Equal(t, context.Canceled, err)
+	assert.Nil(t, stacks)
+}
+
+func TestNew_invalidListConcurrency(t *testing.T) {
+	t.Parallel()
+
+	for _, give := range []string{"0", "-1", "foo"} {
+		give := give
+		t.Run(give, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := newLocalBackend(context.Background(), diagtest.LogSink(t),
+				"file://"+filepath.ToSlash(t.TempDir()),
+				&workspace.Project{Name: "testproj"},
+				&localBackendOptions{
+					Getenv: mapGetenv(map[string]string{
+						"PULUMI_SELF_MANAGED_STATE_LIST_CONCURRENCY": give,
+					}),
+				})
+			assert.ErrorContains(t, err,
+				fmt.Sprintf("invalid PULUMI_SELF_MANAGED_STATE_LIST_CONCURRENCY: %q", give))
+		})
+	}
+}
+
+func TestCreateStack_retainCheckpoints(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	ctx := context.Background()
+	b, err := newLocalBackend(
+		ctx,
+		diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+		&workspace.Project{Name: "testproj"},
+		&localBackendOptions{
+			Getenv: mapGetenv(map[string]string{
+				"PULUMI_RETAIN_CHECKPOINTS": "true",
+			}),
+		},
+	)
+	require.NoError(t, err)
+
+	fooRef, err := b.ParseStackReference("foo")
+	require.NoError(t, err)
+
+	_, err = b.CreateStack(ctx, fooRef, "", nil)
+	require.NoError(t, err)
+
+	// With PULUMI_RETAIN_CHECKPOINTS enabled,
+	// we'll make copies of files under $orig.$timestamp.
+	// Since we can't predict the timestamp,
+	// we'll just check that there's at least one file
+	// with a timestamp extension.
+	got, err := filepath.Glob(
 		filepath.Join(stateDir, ".pulumi", "stacks", "testproj", "foo.json.*"))
 	require.NoError(t, err)
 
@@ -1162,6 +1934,24 @@ func TestCreateStack_retainCheckpoints(t *testing.T) {
 		"file with a timestamp extension not found in %v", got)
 }
 
+// newTestBackend creates a backend for project "proj" in the given directory
+// with the given options.
+// The environment is empty unless opts sets Getenv.
+func newTestBackend(t *testing.T, dir string, opts *localBackendOptions) *localBackend {
+	t.Helper()
+
+	if opts == nil {
+		opts = &localBackendOptions{}
+	}
+	if opts.Getenv == nil {
+		opts.Getenv = mapGetenv(nil)
+	}
+	b, err := newLocalBackend(context.Background(), diagtest.LogSink(t), "file://"+filepath.ToSlash(dir),
+		&workspace.Project{Name: "proj"}, opts)
+	require.NoError(t, err)
+	return b
+}
+
 // mapGetenv builds an os.Getenv-like function
 // that returns values from the given map.
 func mapGetenv(m map[string]string) func(string) string {
@@ -1169,3 +1959,336 @@ func mapGetenv(m map[string]string) func(string) string {
 		return m[key]
 	}
 }
+
+// readDirFiles returns the contents of all files under the given directory
+// keyed by their paths relative to it.
+func readDirFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+
+	files := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		body, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = string(body)
+		return nil
+	})
+	require.NoError(t, err)
+	return files
+}
+
+func TestNewWithOptions_readOnlyEmpty(t *testing.T) {
+	t.Parallel()
+
+	// An empty bucket must not be initialized in read-only mode.
+
+	stateDir := t.TempDir()
+	ctx := context.Background()
+	b, err := NewWithOptions(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+		&workspace.Project{Name: "proj"}, &Options{ReadOnly: true})
+	require.NoError(t, err)
+
+	ref, err := b.ParseStackReference("foo")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	assert.ErrorIs(t, err, ErrReadOnly)
+
+	assert.Empty(t, readDirFiles(t, stateDir))
+}
+
+func TestNewWithOptions_initialVersion(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	stateDir := t.TempDir()
+	url := "file://" + filepath.ToSlash(stateDir)
+	project := &workspace.Project{Name: "proj"}
+
+	// The pinned version wins over the environment variable.
+	legacy, err := newLocalBackend(ctx, diagtest.LogSink(t), url, project, &localBackendOptions{
+		Getenv:         mapGetenv(map[string]string{PulumiFilestateLegacyLayoutEnvVar: "true"}),
+		InitialVersion: intPtr(1),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, StoreInfo{Version: 1, MetaExists: true}, legacy.StoreInfo())
+
+	// Reopening with the same version is fine.
+	_, err = NewWithOptions(ctx, diagtest.LogSink(t), url, project, &Options{InitialVersion: intPtr(1)})
+	require.NoError(t, err)
+
+	// A conflicting version is rejected.
+	_, err = NewWithOptions(ctx, diagtest.LogSink(t), url, project, &Options{InitialVersion: intPtr(0)})
+	assert.ErrorContains(t, err, "has version 1, but version 0 was requested")
+}
+
+func TestNewWithOptions_noInit(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	project := &workspace.Project{Name: "proj"}
+
+	t.Run("empty", func(t *testing.T) {
+		t.Parallel()
+
+		stateDir := t.TempDir()
+		url := "file://" + filepath.ToSlash(stateDir)
+		b, err := NewWithOptions(ctx, diagtest.LogSink(t), url, project,
+			&Options{NoInit: true, InitialVersion: intPtr(1)})
+		require.NoError(t, err)
+		assert.Equal(t, StoreInfo{Version: 0, Legacy: true}, b.StoreInfo())
+		assert.Empty(t, readDirFiles(t, stateDir))
+
+		require.NoError(t, b.InitStore(ctx))
+		assert.Equal(t, StoreInfo{Version: 1, MetaExists: true}, b.StoreInfo())
+
+		// Initializing again does nothing.
+		require.NoError(t, b.InitStore(ctx))
+		b, err = New(ctx, diagtest.LogSink(t), url, project)
+		require.NoError(t, err)
+		assert.Equal(t, StoreInfo{Version: 1, MetaExists: true}, b.StoreInfo())
+	})
+
+	t.Run("stacks before init", func(t *testing.T) {
+		t.Parallel()
+
+		url := "file://" + filepath.ToSlash(t.TempDir())
+		b, err := newLocalBackend(ctx, diagtest.LogSink(t), url, project, &localBackendOptions{
+			Getenv: mapGetenv(map[string]string{PulumiFilestateNoInitEnvVar: "true"}),
+		})
+		require.NoError(t, err)
+		ref, err := b.ParseStackReference("foo")
+		require.NoError(t, err)
+		_, err = b.CreateStack(ctx, ref, "", nil)
+		require.NoError(t, err)
+
+		// Stacks created with the legacy layout stay visible.
+		require.NoError(t, b.InitStore(ctx))
+		assert.Equal(t, StoreInfo{Version: 0, Legacy: true}, b.StoreInfo())
+		stacks, _, err := b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+		require.NoError(t, err)
+		assert.Len(t, stacks, 1)
+	})
+
+	t.Run("read-only", func(t *testing.T) {
+		t.Parallel()
+
+		url := "file://" + filepath.ToSlash(t.TempDir())
+		b, err := NewWithOptions(ctx, diagtest.LogSink(t), url, project, &Options{ReadOnly: true})
+		require.NoError(t, err)
+		assert.ErrorIs(t, b.InitStore(ctx), ErrReadOnly)
+	})
+}
+
+func TestNewWithOptions_initialVersionUnsupported(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	for _, v := range []int{-1, maxSupportedVersion + 1} {
+		_, err := NewWithOptions(context.Background(), diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+			&workspace.Project{Name: "proj"}, &Options{InitialVersion: intPtr(v)})
+		assert.ErrorContains(t, err, "unsupported initial state store version")
+	}
+	assert.Empty(t, readDirFiles(t, stateDir))
+}
+
+func TestNewWithOptions_readOnly(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	ctx := context.Background()
+	project := &workspace.Project{Name: "proj"}
+
+	// Populate the store, including an orphaned temporary file
+	// that would normally be removed when the backend is opened.
+	rw, err := New(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), project)
+	require.NoError(t, err)
+	fooRef, err := rw.ParseStackReference("foo")
+	require.NoError(t, err)
+	_, err = rw.CreateStack(ctx, fooRef, "", nil)
+	require.NoError(t, err)
+	tmpFile := filepath.Join(stateDir, ".pulumi", "stacks", "proj", "bar.json.tmp-1234")
+	require.NoError(t, os.WriteFile(tmpFile, []byte("{}"), 0o600))
+	old := time.Now().Add(-2 * defaultOrphanMinAge)
+	require.NoError(t, os.Chtimes(tmpFile, old, old))
+
+	before := readDirFiles(t, stateDir)
+
+	b, err := NewWithOptions(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+		project, &Options{ReadOnly: true, SweepOrphans: true, RemoveOrphans: true})
+	require.NoError(t, err)
+
+	// Reads work as usual.
+	foo, err := b.GetStack(ctx, fooRef)
+	require.NoError(t, err)
+	require.NotNil(t, foo)
+	stacks, _, err := b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+	require.NoError(t, err)
+	assert.Len(t, stacks, 1)
+	_, err = b.ExportDeployment(ctx, foo)
+	require.NoError(t, err)
+
+	// All writes are rejected.
+	barRef, err := b.ParseStackReference("bar")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, barRef, "", nil)
+	assert.ErrorIs(t, err, ErrReadOnly)
+	_, err = b.RemoveStack(ctx, foo, true /* force */)
+	assert.ErrorIs(t, err, ErrReadOnly)
+	_, err = b.RenameStack(ctx, foo, "organization/proj/baz")
+	assert.ErrorIs(t, err, ErrReadOnly)
+	assert.ErrorIs(t, b.ImportDeployment(ctx, foo, &apitype.UntypedDeployment{Version: 3}), ErrReadOnly)
+	assert.ErrorIs(t, b.(*localBackend).Lock(ctx, fooRef), ErrReadOnly)
+	assert.ErrorIs(t, b.BreakLock(ctx, fooRef), ErrReadOnly)
+	assert.ErrorIs(t, b.CancelCurrentUpdate(ctx, fooRef), ErrReadOnly)
+	assert.ErrorIs(t, b.Upgrade(ctx), ErrReadOnly)
+	_, err = b.Snapshot(ctx, fooRef, nil /* events */)
+	assert.ErrorIs(t, err, ErrReadOnly)
+
+	assert.Equal(t, before, readDirFiles(t, stateDir))
+}
+
+func TestExportDeployment_stateStore(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	newBackend := func(t *testing.T, env map[string]string) (*localBackend, *bytes.Buffer, backend.Stack) {
+		var buff bytes.Buffer
+		sink := diag.DefaultSink(io.Discard, &buff, diag.FormatOptions{Color: colors.Never})
+		b, err := newLocalBackend(ctx, sink, "file://"+filepath.ToSlash(t.TempDir()),
+			&workspace.Project{Name: "proj"}, &localBackendOptions{Getenv: mapGetenv(env)})
+		require.NoError(t, err)
+		ref, err := b.parseStackReference("foo")
+		require.NoError(t, err)
+		s, err := b.CreateStack(ctx, ref, "", nil)
+		require.NoError(t, err)
+		return b, &buff, s
+	}
+
+	legacy, _, legacyStack := newBackend(t, map[string]string{
+		"PULUMI_SELF_MANAGED_STATE_LEGACY_LAYOUT": "true",
+	})
+	legacyDep, err := legacy.ExportDeployment(ctx, legacyStack)
+	require.NoError(t, err)
+	assert.Equal(t, &apitype.StateStoreV1{Version: 0, Layout: apitype.StateStoreLayoutLegacy}, legacyDep.StateStore)
+
+	project, buff, projectStack := newBackend(t, nil)
+	projectDep, err := project.ExportDeployment(ctx, projectStack)
+	require.NoError(t, err)
+	assert.Equal(t, &apitype.StateStoreV1{Version: 1, Layout: apitype.StateStoreLayoutProject}, projectDep.StateStore)
+
+	// Deployments from the same kind of store are imported silently.
+	require.NoError(t, project.ImportDeployment(ctx, projectStack, projectDep))
+	assert.Empty(t, buff.String())
+
+	require.NoError(t, project.ImportDeployment(ctx, projectStack, legacyDep))
+	assert.Contains(t, buff.String(), "Importing a deployment exported from a state store "+
+		"with version 0 (legacy layout) into a state store with version 1 (project layout)")
+}
+
+func TestStoreInfo(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc     string
+		files    map[string]string
+		query    string
+		env      map[string]string
+		readOnly bool
+		want     StoreInfo
+	}{
+		{
+			desc: "new",
+			want: StoreInfo{Version: 1, MetaExists: true},
+		},
+		{
+			desc: "new/legacy",
+			env:  map[string]string{PulumiFilestateLegacyLayoutEnvVar: "1"},
+			want: StoreInfo{Version: 0, Legacy: true},
+		},
+		{
+			desc:     "new/read-only",
+			readOnly: true,
+			want:     StoreInfo{Version: 1},
+		},
+		{
+			desc:  "legacy stacks",
+			files: map[string]string{".pulumi/stacks/foo.json": "{}"},
+			want:  StoreInfo{Version: 0, Legacy: true},
+		},
+		{
+			desc:  "version 0 file",
+			files: map[string]string{".pulumi/meta.yaml": "version: 0\n"},
+			want:  StoreInfo{Version: 0, Legacy: true, MetaExists: true},
+		},
+		{
+			desc:  "prefix",
+			query: "?prefix=team-a",
+			want:  StoreInfo{Version: 1, MetaExists: true, Prefix: "team-a"},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			stateDir := t.TempDir()
+			bucket, err := fileblob.OpenBucket(stateDir, nil)
+			require.NoError(t, err)
+			writeFiles(t, bucket, tt.files)
+
+			b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir)+tt.query, nil,
+				&localBackendOptions{Getenv: mapGetenv(tt.env), ReadOnly: tt.readOnly})
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, b.StoreInfo())
+		})
+	}
+}
+
+func TestBucketInfo(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	stateDir := filepath.ToSlash(t.TempDir())
+	mirrorDir := filepath.ToSlash(t.TempDir())
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+stateDir+"?prefix=team-a", nil,
+		&localBackendOptions{MirrorURL: "file://" + mirrorDir})
+	require.NoError(t, err)
+
+	info := b.BucketInfo()
+	assert.Equal(t, b.url, info.URL)
+	assert.Equal(t, "team-a", path.Base(info.URL))
+	assert.Equal(t, "file", info.Scheme)
+	assert.Empty(t, info.Bucket)
+	assert.Empty(t, info.Region)
+	require.NotNil(t, info.Mirror)
+	assert.Equal(t, "file://"+mirrorDir, info.Mirror.URL)
+	assert.Nil(t, info.Mirror.Mirror)
+}
+
+func TestBucketInfo_s3(t *testing.T) {
+	t.Parallel()
+
+	// Opening an S3 bucket doesn't send any requests.
+	ctx := context.Background()
+	bucket, _, err := openBucket(ctx, "s3://my-bucket?region=eu-west-1&endpoint=http://localhost:9000&prefix=team-a")
+	require.NoError(t, err)
+	defer bucket.bucket.Close()
+
+	info := bucket.info
+	assert.Equal(t, "s3", info.Scheme)
+	assert.Equal(t, "my-bucket", info.Bucket)
+	assert.Equal(t, "eu-west-1", info.Region)
+	assert.Equal(t, "http://localhost:9000", info.Endpoint)
+	assert.Contains(t, info.URL, "region=eu-west-1")
+	assert.Contains(t, info.URL, "/team-a")
+}
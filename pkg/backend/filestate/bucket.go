@@ -2,14 +2,19 @@ package filestate
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
-	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
 	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+	"golang.org/x/sync/errgroup"
 )
 
 // Bucket is a wrapper around an underlying gocloud blob.Bucket.  It ensures that we pass all paths
@@ -22,6 +27,7 @@ type Bucket interface {
 	ReadAll(ctx context.Context, key string) (_ []byte, err error)
 	WriteAll(ctx context.Context, key string, p []byte, opts *blob.WriterOptions) (err error)
 	Exists(ctx context.Context, key string) (bool, error)
+	Attributes(ctx context.Context, key string) (*blob.Attributes, error)
 }
 
 // wrappedBucket encapsulates a true gocloud blob.Bucket, but ensures that all paths we send to it
@@ -30,22 +36,145 @@ type Bucket interface {
 // backslashes to the hex string __0x5c__, breaking things on windows completely.
 type wrappedBucket struct {
 	bucket *blob.Bucket
+
+	// batch deletes objects in bulk if the underlying storage supports it.
+	// It's nil otherwise.
+	batch batchDeleter
+
+	// streaming is set if objects can be written without knowing their size up front.
+	streaming bool
+
+	// versioner replaces objects conditionally if the underlying storage supports it.
+	// It's nil otherwise.
+	versioner versioner
+
+	// revisioner reads prior versions of objects if the underlying storage supports it.
+	// It's nil otherwise.
+	revisioner revisioner
+
+	// keyPrefix is the prefix of all keys in the underlying storage
+	// that is applied by bucket, e.g. "team/" for "s3://bucket/team".
+	// It's empty if the store is at the root of the storage.
+	keyPrefix string
+
+	// info describes the bucket as reported by Backend.BucketInfo.
+	info BucketInfo
+
+	// sse is applied to every object written to the bucket if set.
+	sse *ServerSideEncryption
+
+	// localDir is the directory that the keys of a file:// store are relative to,
+	// including its prefix. It's empty for other stores.
+	localDir string
+
+	// fsync flushes files written to a file:// store to stable storage if set.
+	fsync bool
 }
 
 func (b *wrappedBucket) Copy(ctx context.Context, dstKey, srcKey string, opts *blob.CopyOptions) (err error) {
-	return b.bucket.Copy(ctx, filepath.ToSlash(dstKey), filepath.ToSlash(srcKey), opts)
+	if err := b.bucket.Copy(ctx, filepath.ToSlash(dstKey), filepath.ToSlash(srcKey), b.copyOptions(opts)); err != nil {
+		return err
+	}
+	return b.syncKey(dstKey)
 }
 
 func (b *wrappedBucket) Delete(ctx context.Context, key string) (err error) {
 	return b.bucket.Delete(ctx, filepath.ToSlash(key))
 }
 
+func (b *wrappedBucket) DeleteBatch(ctx context.Context, keys []string) error {
+	if b.batch == nil {
+		return errBatchDeleteUnsupported
+	}
+	slashKeys := make([]string, len(keys))
+	for i, key := range keys {
+		slashKeys[i] = filepath.ToSlash(key)
+	}
+	return b.batch.DeleteBatch(ctx, slashKeys)
+}
+
+func (b *wrappedBucket) NewWriter(ctx context.Context, key string, opts *blob.WriterOptions) (io.WriteCloser, error) {
+	if !b.streaming {
+		return nil, errStreamingUnsupported
+	}
+	w, err := b.bucket.NewWriter(ctx, filepath.ToSlash(key), b.writerOptions(opts))
+	if err != nil || !b.fsync {
+		return w, err
+	}
+	return &syncWriter{WriteCloser: w, sync: func() error { return b.syncKey(key) }}, nil
+}
+
+func (b *wrappedBucket) NewReader(ctx context.Context, key string) (io.ReadCloser, error) {
+	if !b.streaming {
+		return nil, errStreamingUnsupported
+	}
+	return b.bucket.NewReader(ctx, filepath.ToSlash(key), nil)
+}
+
+func (b *wrappedBucket) ObjectVersion(ctx context.Context, key string) (string, error) {
+	if b.versioner == nil {
+		return "", errConditionalUnsupported
+	}
+	attrs, err := b.bucket.Attributes(ctx, filepath.ToSlash(key))
+	if err != nil {
+		return "", err
+	}
+	return b.versioner.version(attrs)
+}
+
+func (b *wrappedBucket) CopyIfVersion(ctx context.Context, dstKey, srcKey, version string) error {
+	if b.versioner == nil {
+		return errConditionalUnsupported
+	}
+	opts, err := b.versioner.copyOptions(version)
+	if err != nil {
+		return err
+	}
+	err = b.bucket.Copy(ctx, filepath.ToSlash(dstKey), filepath.ToSlash(srcKey), b.copyOptions(opts))
+	if err != nil && isPreconditionFailed(err) {
+		return fmt.Errorf("%w: %v", ErrConcurrentModification, err)
+	}
+	if err != nil {
+		return err
+	}
+	return b.syncKey(dstKey)
+}
+
+func (b *wrappedBucket) RevisionsEnabled(ctx context.Context) (bool, error) {
+	if b.revisioner == nil {
+		return false, errRevisionsUnsupported
+	}
+	return b.revisioner.enabled(ctx)
+}
+
+func (b *wrappedBucket) ListRevisions(ctx context.Context, key string) ([]objectRevision, error) {
+	if b.revisioner == nil {
+		return nil, errRevisionsUnsupported
+	}
+	return b.revisioner.list(ctx, filepath.ToSlash(key))
+}
+
+func (b *wrappedBucket) ReadRevision(ctx context.Context, key, id string) ([]byte, error) {
+	if b.revisioner == nil {
+		return nil, errRevisionsUnsupported
+	}
+	return b.revisioner.read(ctx, filepath.ToSlash(key), id)
+}
+
 func (b *wrappedBucket) List(opts *blob.ListOptions) *blob.ListIterator {
 	optsCopy := *opts
 	optsCopy.Prefix = filepath.ToSlash(opts.Prefix)
 	return b.bucket.List(&optsCopy)
 }
 
+func (b *wrappedBucket) ListPage(
+	ctx context.Context, pageToken []byte, pageSize int, opts *blob.ListOptions,
+) ([]*blob.ListObject, []byte, error) {
+	optsCopy := *opts
+	optsCopy.Prefix = filepath.ToSlash(opts.Prefix)
+	return b.bucket.ListPage(ctx, pageToken, pageSize, &optsCopy)
+}
+
 func (b *wrappedBucket) SignedURL(ctx context.Context, key string, opts *blob.SignedURLOptions) (string, error) {
 	return b.bucket.SignedURL(ctx, filepath.ToSlash(key), opts)
 }
@@ -55,13 +184,86 @@ func (b *wrappedBucket) ReadAll(ctx context.Context, key string) (_ []byte, err
 }
 
 func (b *wrappedBucket) WriteAll(ctx context.Context, key string, p []byte, opts *blob.WriterOptions) (err error) {
-	return b.bucket.WriteAll(ctx, filepath.ToSlash(key), p, opts)
+	if err := b.bucket.WriteAll(ctx, filepath.ToSlash(key), p, b.writerOptions(opts)); err != nil {
+		return err
+	}
+	return b.syncKey(key)
 }
 
 func (b *wrappedBucket) Exists(ctx context.Context, key string) (bool, error) {
 	return b.bucket.Exists(ctx, filepath.ToSlash(key))
 }
 
+func (b *wrappedBucket) Attributes(ctx context.Context, key string) (*blob.Attributes, error) {
+	return b.bucket.Attributes(ctx, filepath.ToSlash(key))
+}
+
+// readOnlyBucket wraps a Bucket, rejecting all operations that would modify it
+// with the provided error.
+type readOnlyBucket struct {
+	Bucket
+
+	err error
+}
+
+func (b *readOnlyBucket) operationTimeout() time.Duration {
+	return operationTimeout(b.Bucket)
+}
+
+func (b *readOnlyBucket) ignoredKey(key string) bool {
+	return ignoredKey(b.Bucket, key)
+}
+
+func (b *readOnlyBucket) Copy(ctx context.Context, dstKey, srcKey string, opts *blob.CopyOptions) error {
+	return fmt.Errorf("copy %q: %w", dstKey, b.err)
+}
+
+func (b *readOnlyBucket) Delete(ctx context.Context, key string) error {
+	return fmt.Errorf("delete %q: %w", key, b.err)
+}
+
+func (b *readOnlyBucket) DeleteBatch(ctx context.Context, keys []string) error {
+	return fmt.Errorf("delete %d objects: %w", len(keys), b.err)
+}
+
+func (b *readOnlyBucket) NewWriter(ctx context.Context, key string, opts *blob.WriterOptions) (io.WriteCloser, error) {
+	return nil, fmt.Errorf("write %q: %w", key, b.err)
+}
+
+func (b *readOnlyBucket) NewReader(ctx context.Context, key string) (io.ReadCloser, error) {
+	return newBucketReader(ctx, b.Bucket, key)
+}
+
+func (b *readOnlyBucket) CopyIfVersion(ctx context.Context, dstKey, srcKey, version string) error {
+	return fmt.Errorf("copy %q: %w", dstKey, b.err)
+}
+
+func (b *readOnlyBucket) ObjectVersion(ctx context.Context, key string) (string, error) {
+	return objectVersion(ctx, b.Bucket, key)
+}
+
+func (b *readOnlyBucket) RevisionsEnabled(ctx context.Context) (bool, error) {
+	return revisionsEnabled(ctx, b.Bucket)
+}
+
+func (b *readOnlyBucket) ListRevisions(ctx context.Context, key string) ([]objectRevision, error) {
+	return listRevisions(ctx, b.Bucket, key)
+}
+
+func (b *readOnlyBucket) ReadRevision(ctx context.Context, key, id string) ([]byte, error) {
+	return readRevision(ctx, b.Bucket, key, id)
+}
+
+func (b *readOnlyBucket) ListPage(
+	ctx context.Context, pageToken []byte, pageSize int, opts *blob.ListOptions,
+) ([]*blob.ListObject, []byte, error) {
+	return listPage(ctx, b.Bucket, pageToken, pageSize, opts)
+}
+
+func (b *readOnlyBucket) WriteAll(ctx context.Context, key string, p []byte, opts *blob.WriterOptions) error {
+	return fmt.Errorf("write %q: %w", key, b.err)
+}
+
 // listBucket returns a list of all files in the bucket within a given directory. go-cloud sorts the results by key
 func listBucket(ctx context.Context, bucket Bucket, dir string) ([]*blob.ListObject, error) {
 	bucketIter := bucket.List(&blob.ListOptions{
@@ -72,7 +274,7 @@ func listBucket(ctx context.Context, bucket Bucket, dir string) ([]*blob.ListObj
 	files := []*blob.ListObject{}
 
 	for {
-		file, err := bucketIter.Next(ctx)
+		file, err := nextObject(ctx, bucket, bucketIter)
 		if err == io.EOF {
 			break
 		}
@@ -93,19 +295,128 @@ func objectName(obj *blob.ListObject) string {
 	return filename
 }
 
-// removeAllByPrefix deletes all objects with a given prefix (i.e. filepath)
-func removeAllByPrefix(ctx context.Context, bucket Bucket, dir string) error {
-	files, err := listBucket(ctx, bucket, dir)
-	if err != nil {
-		return fmt.Errorf("unable to list bucket objects for removal: %w", err)
+// batchDeleter is implemented by Buckets that may be able to delete
+// many objects with a single request.
+type batchDeleter interface {
+	// DeleteBatch deletes the objects with the given keys.
+	// Keys that don't exist are ignored.
+	//
+	// It returns errBatchDeleteUnsupported without deleting anything
+	// if the underlying storage can't delete objects in bulk.
+	DeleteBatch(ctx context.Context, keys []string) error
+}
+
+// errBatchDeleteUnsupported is returned by batchDeleter.DeleteBatch
+// if the storage doesn't support deleting objects in bulk.
+var errBatchDeleteUnsupported = errors.New("batch deletion is not supported")
+
+// deleteBatch deletes the given objects in bulk,
+// or returns errBatchDeleteUnsupported if the bucket can't do that.
+func deleteBatch(ctx context.Context, bucket Bucket, keys []string) error {
+	if bd, ok := bucket.(batchDeleter); ok {
+		return bd.DeleteBatch(ctx, keys)
+	}
+	return errBatchDeleteUnsupported
+}
+
+// defaultDeleteConcurrency is the maximum number of objects
+// deleted concurrently if the bucket can't delete them in bulk.
+const defaultDeleteConcurrency = 16
+
+// deleteAll deletes all objects with the given keys.
+// Keys that don't exist are ignored.
+//
+// It uses bulk deletion if the bucket supports it,
+// and otherwise deletes up to concurrency objects at a time.
+// All objects that could not be deleted are reported in the returned error.
+func deleteAll(ctx context.Context, bucket Bucket, keys []string, concurrency int) error {
+	return deleteAllProgress(ctx, bucket, keys, concurrency, nil /* deleted */)
+}
+
+// deleteAllProgress is like deleteAll,
+// but calls deleted with the key of every object once it's deleted if deleted is non-nil.
+// Objects deleted in bulk are reported once the whole batch was deleted,
+// including those that didn't exist; otherwise, only objects that existed are reported.
+func deleteAllProgress(
+	ctx context.Context, bucket Bucket, keys []string, concurrency int, deleted func(key string),
+) error {
+	if len(keys) == 0 {
+		return nil
 	}
+	err := deleteBatch(ctx, bucket, keys)
+	if !errors.Is(err, errBatchDeleteUnsupported) {
+		if err == nil && deleted != nil {
+			for _, key := range keys {
+				deleted(key)
+			}
+		}
+		return err
+	}
+
+	// Each worker writes only to its own index of errs.
+	errs := make([]error, len(keys))
+	var wg errgroup.Group
+	wg.SetLimit(concurrency)
+	for i, key := range keys {
+		i, key := i, key
+		wg.Go(func() error {
+			err := bucket.Delete(ctx, key)
+			switch {
+			case err == nil:
+				if deleted != nil {
+					deleted(key)
+				}
+			case gcerrors.Code(err) != gcerrors.NotFound:
+				errs[i] = fmt.Errorf("delete %v: %w", key, err)
+			}
+			return nil
+		})
+	}
+	contract.IgnoreError(wg.Wait()) // workers never fail
 
-	for _, file := range files {
-		err = bucket.Delete(ctx, file.Key)
+	var merr *multierror.Error
+	for _, err := range errs {
 		if err != nil {
-			logging.V(5).Infof("error deleting object: %v (%v) skipping", file.Key, err)
+			merr = multierror.Append(merr, err)
 		}
 	}
+	return merr.ErrorOrNil()
+}
+
+// streamingBucket is implemented by Buckets that may be able to
+// write and read objects incrementally
+// rather than holding their entire contents in memory.
+type streamingBucket interface {
+	// NewWriter returns a writer for the object with the given key.
+	// The object is committed when the writer is closed.
+	//
+	// It returns errStreamingUnsupported if the object must be written with WriteAll.
+	NewWriter(ctx context.Context, key string, opts *blob.WriterOptions) (io.WriteCloser, error)
 
-	return nil
+	// NewReader returns a reader for the object with the given key.
+	//
+	// It returns errStreamingUnsupported if the object must be read with ReadAll.
+	NewReader(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// errStreamingUnsupported is returned if an object can't be
+// written or read incrementally.
+var errStreamingUnsupported = errors.New("streaming is not supported")
+
+// newBucketWriter returns a writer for the given object,
+// or errStreamingUnsupported if the bucket can't write objects incrementally.
+func newBucketWriter(ctx context.Context, bucket Bucket, key string, opts *blob.WriterOptions) (io.WriteCloser, error) {
+	if sb, ok := bucket.(streamingBucket); ok {
+		return sb.NewWriter(ctx, key, opts)
+	}
+	return nil, errStreamingUnsupported
+}
+
+// newBucketReader returns a reader for the given object,
+// or errStreamingUnsupported if the bucket can't read objects incrementally.
+func newBucketReader(ctx context.Context, bucket Bucket, key string) (io.ReadCloser, error) {
+	if sb, ok := bucket.(streamingBucket); ok {
+		return sb.NewReader(ctx, key)
+	}
+	return nil, errStreamingUnsupported
 }
@@ -3,12 +3,17 @@ package filestate
 import (
 	"context"
 	"fmt"
+	"io"
 	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"gocloud.dev/blob"
+	"gocloud.dev/blob/memblob"
+	"gocloud.dev/gcerrors"
 )
 
 func mustNotHaveError(t *testing.T, context string, err error) {
@@ -42,7 +47,11 @@ func TestWrappedBucket(t *testing.T) {
 		t.Fatalf("backend wasn't of type localBackend?")
 	}
 
-	wrappedBucket, ok := localBackend.bucket.(*wrappedBucket)
+	retryBucket, ok := localBackend.bucket.(*retryBucket)
+	if !ok {
+		t.Fatalf("localBackend.bucket wasn't of type retryBucket?")
+	}
+	wrappedBucket, ok := retryBucket.Bucket.(*wrappedBucket)
 	if !ok {
 		t.Fatalf("localBackend.bucket wasn't of type wrappedBucket?")
 	}
@@ -96,3 +105,117 @@ func TestWrappedBucket(t *testing.T) {
 		}
 	})
 }
+
+// recordingBatchDeleter records the keys it's asked to delete
+// and deletes them from the wrapped bucket.
+type recordingBatchDeleter struct {
+	bucket *blob.Bucket
+	keys   []string
+}
+
+func (d *recordingBatchDeleter) DeleteBatch(ctx context.Context, keys []string) error {
+	d.keys = append(d.keys, keys...)
+	for _, key := range keys {
+		if err := d.bucket.Delete(ctx, key); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestDeleteAll(t *testing.T) {
+	t.Parallel()
+
+	newBucket := func(t *testing.T) (*blob.Bucket, []string) {
+		bucket := memblob.OpenBucket(nil)
+		var keys []string
+		for i := 0; i < 50; i++ {
+			key := fmt.Sprintf("dir/file-%d", i)
+			require.NoError(t, bucket.WriteAll(context.Background(), key, []byte("{}"), nil))
+			keys = append(keys, key)
+		}
+		// Missing files are ignored.
+		return bucket, append(keys, "dir/missing")
+	}
+
+	assertEmpty := func(t *testing.T, bucket *blob.Bucket) {
+		_, err := bucket.List(nil).Next(context.Background())
+		assert.Equal(t, io.EOF, err, "bucket should be empty")
+	}
+
+	t.Run("concurrent", func(t *testing.T) {
+		t.Parallel()
+
+		bucket, keys := newBucket(t)
+		require.NoError(t, deleteAll(context.Background(), &wrappedBucket{bucket: bucket}, keys, 4))
+		assertEmpty(t, bucket)
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		t.Parallel()
+
+		bucket, keys := newBucket(t)
+		batch := &recordingBatchDeleter{bucket: bucket}
+		wbucket := newRetryBucket(&wrappedBucket{bucket: bucket, batch: batch}, retryPolicy{MaxAttempts: 1})
+		require.NoError(t, deleteAll(context.Background(), wbucket, keys, 4))
+		assert.Equal(t, keys, batch.keys)
+		assertEmpty(t, bucket)
+	})
+
+	t.Run("progress", func(t *testing.T) {
+		t.Parallel()
+
+		for _, batched := range []bool{false, true} {
+			bucket, keys := newBucket(t)
+			wbucket := &wrappedBucket{bucket: bucket}
+			if batched {
+				wbucket.batch = &recordingBatchDeleter{bucket: bucket}
+			}
+
+			var mu sync.Mutex
+			var deleted []string
+			require.NoError(t, deleteAllProgress(context.Background(), wbucket, keys, 4, func(key string) {
+				mu.Lock()
+				defer mu.Unlock()
+				deleted = append(deleted, key)
+			}))
+			want := keys
+			if !batched {
+				// Files that don't exist are only reported when they're deleted in bulk.
+				want = keys[:len(keys)-1]
+			}
+			assert.ElementsMatch(t, want, deleted, "batched: %v", batched)
+			assertEmpty(t, bucket)
+		}
+	})
+
+	t.Run("read only", func(t *testing.T) {
+		t.Parallel()
+
+		bucket, keys := newBucket(t)
+		batch := &recordingBatchDeleter{bucket: bucket}
+		wbucket := &readOnlyBucket{Bucket: &wrappedBucket{bucket: bucket, batch: batch}, err: ErrReadOnly}
+		err := deleteAll(context.Background(), wbucket, keys, 4)
+		assert.ErrorIs(t, err, ErrReadOnly)
+		assert.Empty(t, batch.keys)
+	})
+}
+
+// failingDeleteBucket is a Bucket that can't delete any objects.
+type failingDeleteBucket struct {
+	Bucket
+}
+
+func (b *failingDeleteBucket) Delete(ctx context.Context, key string) error {
+	return fmt.Errorf("permission denied")
+}
+
+func TestDeleteAll_errors(t *testing.T) {
+	t.Parallel()
+
+	bucket := &failingDeleteBucket{Bucket: &wrappedBucket{bucket: memblob.OpenBucket(nil)}}
+	err := deleteAll(context.Background(), bucket, []string{"foo", "bar"}, 2)
+	// All failures are reported.
+	assert.ErrorContains(t, err, "delete foo: permission denied")
+	assert.ErrorContains(t, err, "delete bar: permission denied")
+}
@@ -0,0 +1,79 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/s3blob"
+)
+
+// BucketInfo describes the bucket that holds a state store
+// as resolved from the backend URL, as reported by [Backend.BucketInfo].
+// It's informational: use it to tell which bucket and endpoint are in use.
+type BucketInfo struct {
+	// URL is the normalized URL of the bucket,
+	// including the query parameters it was opened with.
+	// The "prefix" parameter is part of its path.
+	URL string
+
+	// Scheme is the scheme of the URL, e.g. "s3" or "file".
+	Scheme string
+
+	// Bucket is the name of the bucket.
+	// It's empty for file:// URLs.
+	Bucket string
+
+	// Region is the region of the bucket as configured for the storage provider
+	// from the URL and its environment, e.g. "eu-west-1".
+	// It's empty if the provider doesn't expose it.
+	Region string
+
+	// Endpoint is the endpoint requests to the bucket are sent to.
+	// It's empty if the provider doesn't expose it,
+	// in which case its default endpoint is used.
+	Endpoint string
+
+	// Mirror describes the bucket that writes are mirrored to, if any.
+	Mirror *BucketInfo
+}
+
+// newBucketInfo describes the given bucket opened from the normalized URL u.
+func newBucketInfo(bucket *blob.Bucket, u *url.URL) BucketInfo {
+	info := BucketInfo{
+		URL:      u.String(),
+		Scheme:   u.Scheme,
+		Bucket:   u.Host,
+		Region:   u.Query().Get("region"),
+		Endpoint: u.Query().Get("endpoint"),
+	}
+
+	// The AWS SDK resolves the region and endpoint from the environment
+	// if the URL doesn't set them.
+	// Buckets opened with "awssdk=v2" only report what the URL sets.
+	var client *s3.S3
+	if u.Scheme == s3blob.Scheme && bucket.As(&client) {
+		info.Region = aws.StringValue(client.Config.Region)
+		info.Endpoint = client.Endpoint
+	}
+	return info
+}
+
+func (b *localBackend) BucketInfo() BucketInfo {
+	return b.bucketInfo
+}
@@ -0,0 +1,94 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
+)
+
+// canonicalJSON re-encodes the given JSON document in a canonical form
+// so that documents with the same content are byte-identical:
+// object keys are sorted,
+// numbers are formatted like encoding/json formats float64 values,
+// and the document is indented like encoding.JSON.
+//
+// The content is unchanged.
+// Integers are kept exactly, even if they don't fit a float64.
+// Other numbers are formatted as the float64 that the engine decodes them to,
+// unless they're too large for one.
+func canonicalJSON(raw []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	// encoding/json sorts the keys of maps.
+	return encoding.JSON.Marshal(canonicalValue(v))
+}
+
+// canonicalValue normalizes the numbers in a value decoded with json.Decoder.UseNumber.
+func canonicalValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = canonicalValue(e)
+		}
+		return v
+	case []interface{}:
+		for i, e := range v {
+			v[i] = canonicalValue(e)
+		}
+		return v
+	case json.Number:
+		return canonicalNumber(v)
+	default:
+		return v
+	}
+}
+
+// canonicalNumber formats n like encoding/json formats float64 values,
+// e.g. "1" for "1.0" and "100" for "1e2".
+// Integers are returned as is.
+func canonicalNumber(n json.Number) json.Number {
+	s := n.String()
+	if strings.Trim(s, "-0123456789") == "" {
+		// Integers are kept exactly; only negative zero has another form.
+		if s == "-0" {
+			return "0"
+		}
+		return n
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		// Out of range for a float64.
+		return n
+	}
+	if f == 0 {
+		// Includes negative zero.
+		return "0"
+	}
+	byts, err := json.Marshal(f)
+	if err != nil {
+		return n
+	}
+	return json.Number(byts)
+}
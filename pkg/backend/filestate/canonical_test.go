@@ -0,0 +1,95 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc string
+		give string
+		want string
+	}{
+		{desc: "sorted keys", give: `{"b": 1, "a": {"d": [], "c": {}}}`, want: `{"a":{"c":{},"d":[]},"b":1}`},
+		{desc: "float", give: `[1.0, 1e2, 0.50, -0.0, -0, 1.5E-7]`, want: `[1,100,0.5,0,0,1.5e-7]`},
+		{desc: "large integer", give: `[12345678901234567890123]`, want: `[12345678901234567890123]`},
+		{desc: "out of range", give: `[1e400]`, want: `[1e400]`},
+		{desc: "strings", give: `["<a>", "é", "1.0"]`, want: `["<a>","é","1.0"]`},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := canonicalJSON([]byte(tt.give))
+			require.NoError(t, err)
+			var compact bytes.Buffer
+			require.NoError(t, json.Compact(&compact, got))
+			assert.Equal(t, tt.want, compact.String())
+
+			// Canonical JSON is its own canonical form.
+			again, err := canonicalJSON(got)
+			require.NoError(t, err)
+			assert.Equal(t, string(got), string(again))
+		})
+	}
+
+	_, err := canonicalJSON([]byte(`{"a":`))
+	assert.Error(t, err)
+}
+
+func TestExportDeployment_deterministic(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, nil)
+	stk, err := b.GetStack(ctx, ref)
+	require.NoError(t, err)
+
+	// The same state serialized two ways exports the same.
+	export := func(state string) []byte {
+		raw, err := json.Marshal(apitype.CheckpointV3{
+			Stack: ref.FullyQualifiedName(),
+			Latest: &apitype.DeploymentV3{
+				SecretsProviders: &apitype.SecretsProvidersV1{Type: "test", State: json.RawMessage(state)},
+			},
+		})
+		require.NoError(t, err)
+		_, _, err = b.saveCheckpoint(ctx, ref, &apitype.VersionedCheckpoint{
+			Version:    apitype.DeploymentSchemaVersionCurrent,
+			Checkpoint: raw,
+		})
+		require.NoError(t, err)
+
+		dep, err := b.ExportDeployment(ctx, stk)
+		require.NoError(t, err)
+		return dep.Deployment
+	}
+	first := export(`{"b": 1.0, "a": {"y": 2, "x": 1e0}}`)
+	second := export(`{"a": {"x": 1, "y": 2}, "b": 1}`)
+	assert.Equal(t, string(first), string(second))
+}
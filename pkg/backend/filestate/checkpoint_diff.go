@@ -0,0 +1,226 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/pulumi/pulumi/pkg/v3/resource/stack"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	apimigrate "github.com/pulumi/pulumi/sdk/v3/go/common/apitype/migrate"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+)
+
+// CheckpointDiff describes how the resources of a stack differ
+// between two checkpoints, as reported by [DiffCheckpoints].
+//
+// Resources are matched by URN.
+// Resources pending deletion are matched separately
+// from live resources with the same URN.
+// All lists are ordered by URN.
+type CheckpointDiff struct {
+	// Added lists resources that are only in the new checkpoint.
+	Added []apitype.ResourceV3 `json:"added,omitempty"`
+
+	// Removed lists resources that are only in the old checkpoint.
+	Removed []apitype.ResourceV3 `json:"removed,omitempty"`
+
+	// Changed lists resources that are in both checkpoints, but differ.
+	Changed []ResourceChange `json:"changed,omitempty"`
+}
+
+// ResourceChange is a resource that differs between two checkpoints.
+type ResourceChange struct {
+	// URN is the URN of the resource.
+	URN resource.URN `json:"urn"`
+
+	// Old is the resource in the old checkpoint.
+	Old apitype.ResourceV3 `json:"old"`
+
+	// New is the resource in the new checkpoint.
+	New apitype.ResourceV3 `json:"new"`
+
+	// Fields lists the JSON names of the fields of the resource that differ,
+	// e.g. "inputs" or "outputs", in alphabetical order.
+	Fields []string `json:"fields"`
+}
+
+// DiffCheckpoints compares the resources in two checkpoints.
+//
+// Each checkpoint may be a deployment written by 'pulumi stack export'
+// or a checkpoint file of the filestate backend, optionally compressed with gzip,
+// in any schema version that this version of the CLI can read.
+// Encrypted checkpoint files must be decrypted first.
+func DiffCheckpoints(oldCheckpoint, newCheckpoint io.Reader) (*CheckpointDiff, error) {
+	oldDeployment, err := readExportedDeployment(oldCheckpoint)
+	if err != nil {
+		return nil, fmt.Errorf("read old checkpoint: %w", err)
+	}
+	newDeployment, err := readExportedDeployment(newCheckpoint)
+	if err != nil {
+		return nil, fmt.Errorf("read new checkpoint: %w", err)
+	}
+	return diffDeployments(oldDeployment, newDeployment)
+}
+
+// readExportedDeployment reads a deployment or a checkpoint file
+// and migrates it to the latest schema version.
+func readExportedDeployment(r io.Reader) (*apitype.DeploymentV3, error) {
+	byts, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	m := encoding.JSON
+	if encoding.IsCompressed(byts) {
+		m = encoding.Gzip(m)
+	}
+
+	// Exported deployments hold the deployment directly,
+	// whereas checkpoint files wrap it with the stack's configuration.
+	var envelope struct {
+		Version    int             `json:"version"`
+		Deployment json.RawMessage `json:"deployment"`
+	}
+	if err := m.Unmarshal(byts, &envelope); err != nil {
+		return nil, err
+	}
+	if envelope.Deployment == nil {
+		chk, err := stack.UnmarshalVersionedCheckpointToLatestCheckpoint(m, byts)
+		if err != nil {
+			return nil, err
+		}
+		if chk.Latest == nil {
+			return &apitype.DeploymentV3{}, nil
+		}
+		return chk.Latest, nil
+	}
+
+	switch envelope.Version {
+	case 1:
+		var v1 apitype.DeploymentV1
+		if err := json.Unmarshal(envelope.Deployment, &v1); err != nil {
+			return nil, err
+		}
+		v3 := apimigrate.UpToDeploymentV3(apimigrate.UpToDeploymentV2(v1))
+		return &v3, nil
+	case 2:
+		var v2 apitype.DeploymentV2
+		if err := json.Unmarshal(envelope.Deployment, &v2); err != nil {
+			return nil, err
+		}
+		v3 := apimigrate.UpToDeploymentV3(v2)
+		return &v3, nil
+	case 3:
+		var v3 apitype.DeploymentV3
+		if err := json.Unmarshal(envelope.Deployment, &v3); err != nil {
+			return nil, err
+		}
+		return &v3, nil
+	default:
+		return nil, fmt.Errorf("unsupported deployment version %d", envelope.Version)
+	}
+}
+
+// resourceKey identifies a resource within a deployment.
+type resourceKey struct {
+	urn    resource.URN
+	delete bool
+}
+
+func diffDeployments(before, after *apitype.DeploymentV3) (*CheckpointDiff, error) {
+	olds := make(map[resourceKey]apitype.ResourceV3, len(before.Resources))
+	for _, res := range before.Resources {
+		olds[resourceKey{res.URN, res.Delete}] = res
+	}
+
+	var diff CheckpointDiff
+	seen := make(map[resourceKey]bool, len(after.Resources))
+	for _, res := range after.Resources {
+		key := resourceKey{res.URN, res.Delete}
+		seen[key] = true
+		oldRes, ok := olds[key]
+		if !ok {
+			diff.Added = append(diff.Added, res)
+			continue
+		}
+		fields, err := changedFields(oldRes, res)
+		if err != nil {
+			return nil, fmt.Errorf("compare %v: %w", res.URN, err)
+		}
+		if len(fields) > 0 {
+			diff.Changed = append(diff.Changed, ResourceChange{URN: res.URN, Old: oldRes, New: res, Fields: fields})
+		}
+	}
+	for _, res := range before.Resources {
+		if !seen[resourceKey{res.URN, res.Delete}] {
+			diff.Removed = append(diff.Removed, res)
+		}
+	}
+
+	sortResources := func(rs []apitype.ResourceV3) {
+		sort.SliceStable(rs, func(i, j int) bool { return rs[i].URN < rs[j].URN })
+	}
+	sortResources(diff.Added)
+	sortResources(diff.Removed)
+	sort.SliceStable(diff.Changed, func(i, j int) bool { return diff.Changed[i].URN < diff.Changed[j].URN })
+	return &diff, nil
+}
+
+// changedFields returns the JSON names of the fields that differ
+// between two versions of a resource.
+func changedFields(before, after apitype.ResourceV3) ([]string, error) {
+	oldFields, err := resourceFields(before)
+	if err != nil {
+		return nil, err
+	}
+	newFields, err := resourceFields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields []string
+	for name, v := range newFields {
+		if !bytes.Equal(v, oldFields[name]) {
+			fields = append(fields, name)
+		}
+	}
+	for name := range oldFields {
+		if _, ok := newFields[name]; !ok {
+			fields = append(fields, name)
+		}
+	}
+	sort.Strings(fields)
+	return fields, nil
+}
+
+// resourceFields returns the JSON encoding of each field of the resource.
+// Maps are encoded with sorted keys, so equal fields have equal encodings.
+func resourceFields(res apitype.ResourceV3) (map[string]json.RawMessage, error) {
+	byts, err := json.Marshal(res)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(byts, &fields); err != nil {
+		return nil, errors.New("resource is not a JSON object")
+	}
+	return fields, nil
+}
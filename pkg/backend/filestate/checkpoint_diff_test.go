@@ -0,0 +1,169 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+)
+
+func testResource(name string, outputs map[string]interface{}) apitype.ResourceV3 {
+	return apitype.ResourceV3{
+		URN:     resource.URN("urn:pulumi:foo::proj::pkg:index:Res::" + name),
+		Custom:  true,
+		ID:      resource.ID(name + "-id"),
+		Type:    "pkg:index:Res",
+		Outputs: outputs,
+	}
+}
+
+// exportResources returns an exported deployment with the given resources.
+func exportResources(t *testing.T, resources ...apitype.ResourceV3) []byte {
+	t.Helper()
+
+	deployment, err := json.Marshal(apitype.DeploymentV3{Resources: resources})
+	require.NoError(t, err)
+	byts, err := json.Marshal(apitype.UntypedDeployment{
+		Version:    apitype.DeploymentSchemaVersionCurrent,
+		Deployment: deployment,
+	})
+	require.NoError(t, err)
+	return byts
+}
+
+func TestDiffCheckpoints(t *testing.T) {
+	t.Parallel()
+
+	kept := testResource("kept", map[string]interface{}{"a": 1.0})
+	removed := testResource("removed", nil)
+	changed := testResource("changed", map[string]interface{}{"a": 1.0})
+	added := testResource("added", nil)
+
+	changedNew := changed
+	changedNew.Outputs = map[string]interface{}{"a": 2.0}
+	changedNew.Protect = true
+
+	diff, err := DiffCheckpoints(
+		bytes.NewReader(exportResources(t, kept, removed, changed)),
+		bytes.NewReader(exportResources(t, changedNew, kept, added)),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, &CheckpointDiff{
+		Added:   []apitype.ResourceV3{added},
+		Removed: []apitype.ResourceV3{removed},
+		Changed: []ResourceChange{{
+			URN:    changed.URN,
+			Old:    changed,
+			New:    changedNew,
+			Fields: []string{"outputs", "protect"},
+		}},
+	}, diff)
+}
+
+func TestDiffCheckpoints_pendingDelete(t *testing.T) {
+	t.Parallel()
+
+	// A replaced resource that's pending deletion
+	// is a different resource than its replacement.
+	res := testResource("res", nil)
+	pending := res
+	pending.Delete = true
+
+	diff, err := DiffCheckpoints(
+		bytes.NewReader(exportResources(t, res)),
+		bytes.NewReader(exportResources(t, res, pending)),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, &CheckpointDiff{Added: []apitype.ResourceV3{pending}}, diff)
+}
+
+func TestDiffCheckpoints_formats(t *testing.T) {
+	t.Parallel()
+
+	res := testResource("res", map[string]interface{}{"a": "b"})
+	export := exportResources(t, res)
+
+	chkJSON, err := json.Marshal(apitype.CheckpointV3{
+		Stack:  "foo",
+		Latest: &apitype.DeploymentV3{Resources: []apitype.ResourceV3{res}},
+	})
+	require.NoError(t, err)
+	checkpoint, err := json.Marshal(apitype.VersionedCheckpoint{
+		Version:    apitype.DeploymentSchemaVersionCurrent,
+		Checkpoint: chkJSON,
+	})
+	require.NoError(t, err)
+	gzipped, err := encoding.Gzip(encoding.JSON).Marshal(json.RawMessage(checkpoint))
+	require.NoError(t, err)
+
+	tests := []struct {
+		desc string
+		give []byte
+	}{
+		{desc: "checkpoint", give: checkpoint},
+		{desc: "gzip", give: gzipped},
+		{
+			desc: "version 2",
+			give: []byte(`{"version": 2, "deployment": {"resources": [` +
+				`{"urn": "urn:pulumi:foo::proj::pkg:index:Res::res", "custom": true, ` +
+				`"id": "res-id", "type": "pkg:index:Res", "outputs": {"a": "b"}}]}}`),
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			diff, err := DiffCheckpoints(bytes.NewReader(export), bytes.NewReader(tt.give))
+			require.NoError(t, err)
+			assert.Equal(t, &CheckpointDiff{}, diff)
+		})
+	}
+}
+
+func TestDiffCheckpoints_empty(t *testing.T) {
+	t.Parallel()
+
+	// Checkpoints of stacks that were never deployed have no deployment.
+	res := testResource("res", nil)
+	diff, err := DiffCheckpoints(
+		strings.NewReader(`{"version": 3, "checkpoint": {"stack": "foo"}}`),
+		bytes.NewReader(exportResources(t, res)),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, &CheckpointDiff{Added: []apitype.ResourceV3{res}}, diff)
+}
+
+func TestDiffCheckpoints_invalid(t *testing.T) {
+	t.Parallel()
+
+	valid := exportResources(t)
+
+	_, err := DiffCheckpoints(strings.NewReader("not json"), bytes.NewReader(valid))
+	assert.ErrorContains(t, err, "read old checkpoint")
+
+	_, err = DiffCheckpoints(bytes.NewReader(valid), strings.NewReader(`{"version": 99, "deployment": {}}`))
+	assert.ErrorContains(t, err, "read new checkpoint: unsupported deployment version 99")
+}
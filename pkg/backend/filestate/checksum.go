@@ -0,0 +1,110 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+
+	"gocloud.dev/gcerrors"
+)
+
+// ErrChecksumMismatch is returned when a checkpoint does not match
+// the checksum recorded alongside it.
+// This usually indicates that the checkpoint was truncated or otherwise corrupted.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// sha256Checksum is the name of the SHA-256 checksum algorithm
+// as recorded in the store's metadata file.
+const sha256Checksum = "sha256"
+
+// checksumExt is the extension of the sidecar file
+// holding the checksum of a checkpoint file.
+const checksumExt = ".sha256"
+
+// checksumPath returns the path of the sidecar file
+// holding the checksum of the given file.
+func checksumPath(file string) string {
+	return file + checksumExt
+}
+
+// computeChecksum returns the hex-encoded SHA-256 digest of the given bytes.
+func computeChecksum(byts []byte) string {
+	sum := sha256.Sum256(byts)
+	return hex.EncodeToString(sum[:])
+}
+
+// newChecksumHash returns a hash that computes the same checksums as computeChecksum
+// for contents that are written to it incrementally.
+// Use formatChecksum to get the checksum.
+func newChecksumHash() hash.Hash {
+	return sha256.New()
+}
+
+// formatChecksum returns the checksum of the contents written to a hash from newChecksumHash.
+func formatChecksum(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeChecksum records the given checksum of the contents of file
+// in a sidecar file next to it.
+func writeChecksum(ctx context.Context, bucket Bucket, file, sum string) error {
+	sumFile := checksumPath(file)
+	if err := bucket.WriteAll(ctx, sumFile, []byte(sum+"\n"), nil); err != nil {
+		return fmt.Errorf("write checksum %q: %w", sumFile, err)
+	}
+	return nil
+}
+
+// verifyChecksum verifies that the given contents of file
+// match the checksum recorded in its sidecar file.
+//
+// Files without a sidecar file are not verified.
+// This allows checksums to be enabled on stores with existing checkpoints.
+func verifyChecksum(ctx context.Context, bucket Bucket, file string, byts []byte) error {
+	want, ok, err := readChecksum(ctx, bucket, file)
+	if err != nil || !ok {
+		return err
+	}
+	return matchChecksum(file, want, computeChecksum(byts))
+}
+
+// readChecksum returns the checksum recorded in the sidecar file of file.
+// ok is false if the file doesn't have a sidecar file.
+func readChecksum(ctx context.Context, bucket Bucket, file string) (sum string, ok bool, err error) {
+	sumFile := checksumPath(file)
+	want, err := bucket.ReadAll(ctx, sumFile)
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("read checksum %q: %w", sumFile, err)
+	}
+	return strings.TrimSpace(string(want)), true, nil
+}
+
+// matchChecksum returns ErrChecksumMismatch if the checksums of file don't match.
+func matchChecksum(file, expected, actual string) error {
+	if actual != expected {
+		return fmt.Errorf("%w: %q: expected %v %v, got %v",
+			ErrChecksumMismatch, file, sha256Checksum, expected, actual)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// checksumOptions are the options of a backend with checksums enabled.
+func checksumOptions() *localBackendOptions {
+	return &localBackendOptions{
+		Getenv: mapGetenv(map[string]string{PulumiFilestateChecksumsEnvVar: "true"}),
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b := newTestBackend(t, t.TempDir(), checksumOptions())
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	s, err := b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	chkpath := b.stackPath(ctx, ref)
+	want, err := b.bucket.ReadAll(ctx, chkpath)
+	require.NoError(t, err)
+	got, err := b.bucket.ReadAll(ctx, checksumPath(chkpath))
+	require.NoError(t, err)
+	assert.Equal(t, computeChecksum(want)+"\n", string(got))
+
+	_, err = b.GetStack(ctx, ref)
+	require.NoError(t, err)
+
+	// Removing the stack also removes its checksum.
+	_, err = b.RemoveStack(ctx, s, false)
+	require.NoError(t, err)
+	exists, err := b.bucket.Exists(ctx, checksumPath(chkpath))
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestChecksum_mismatch(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b := newTestBackend(t, t.TempDir(), checksumOptions())
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	// Simulate a truncated or otherwise modified checkpoint.
+	chkpath := b.stackPath(ctx, ref)
+	want, err := b.bucket.ReadAll(ctx, checksumPath(chkpath))
+	require.NoError(t, err)
+	corrupt := []byte(`{"version": 3, "checkpoint": {}}`)
+	require.NoError(t, b.bucket.WriteAll(ctx, chkpath, corrupt, nil))
+
+	_, err = b.GetStack(ctx, ref)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+	assert.ErrorContains(t, err, string(want[:len(want)-1]))
+	assert.ErrorContains(t, err, computeChecksum(corrupt))
+}
+
+func TestChecksum_missing(t *testing.T) {
+	t.Parallel()
+
+	// Checkpoints written before checksums were enabled
+	// don't have a checksum and are not verified.
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(dir),
+		&workspace.Project{Name: "proj"}, nil)
+	require.NoError(t, err)
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	exists, err := b.bucket.Exists(ctx, checksumPath(b.stackPath(ctx, ref)))
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	b = newTestBackend(t, dir, checksumOptions())
+	_, err = b.GetStack(ctx, ref)
+	assert.NoError(t, err)
+}
+
+func TestChecksum_fromMeta(t *testing.T) {
+	t.Parallel()
+
+	// Stores initialized with checksums enabled
+	// use them even if the environment variable is unset.
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	newTestBackend(t, dir, checksumOptions())
+
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(dir),
+		&workspace.Project{Name: "proj"}, nil)
+	require.NoError(t, err)
+	assert.True(t, b.checksums)
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	exists, err := b.bucket.Exists(ctx, checksumPath(b.stackPath(ctx, ref)))
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestNew_unsupportedChecksum(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(dir), nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, (&pulumiMeta{Version: 1, Checksum: "md5"}).WriteTo(ctx, b.bucket))
+
+	_, err = newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(dir), nil, nil)
+	assert.ErrorContains(t, err, `unsupported checksum algorithm "md5"`)
+}
@@ -0,0 +1,36 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import "time"
+
+// clock tells the time of lock timestamps, lock staleness, history entries,
+// and the deadline of consistency checks.
+//
+// It's replaced in tests to control the time,
+// like Getenv is replaced to control the environment.
+type clock interface {
+	// Now returns the current time.
+	Now() time.Time
+}
+
+// systemClock is the clock of the system, and the default.
+type systemClock struct{}
+
+var _ clock = systemClock{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,200 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob/memblob"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// fakeClock is a clock that only moves when it's told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+var _ clock = (*fakeClock)(nil)
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock by d, which may be negative.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestClock_lockTTL(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	clk := newFakeClock()
+	url := "file://" + filepath.ToSlash(t.TempDir())
+	open := func() *localBackend {
+		b, err := newLocalBackend(ctx, diagtest.LogSink(t), url, &workspace.Project{Name: "proj"},
+			&localBackendOptions{
+				Getenv: mapGetenv(map[string]string{PulumiFilestateLockTTLEnvVar: "1h"}),
+				Clock:  clk,
+			})
+		require.NoError(t, err)
+		return b
+	}
+	b, other := open(), open()
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	require.NoError(t, b.Lock(ctx, ref))
+	locks, err := other.ListLocks(ctx)
+	require.NoError(t, err)
+	require.Len(t, locks, 1)
+	assert.Equal(t, clk.Now(), locks[0].Timestamp.UTC())
+	assert.False(t, locks[0].Stale)
+	assert.Error(t, other.Lock(ctx, ref))
+
+	clk.Advance(2 * time.Hour)
+	locks, err = other.ListLocks(ctx)
+	require.NoError(t, err)
+	require.Len(t, locks, 1)
+	assert.True(t, locks[0].Stale)
+	assert.Equal(t, 2*time.Hour, locks[0].Age(clk.Now()))
+	// The stale lock is reclaimed.
+	require.NoError(t, other.Lock(ctx, ref))
+	other.Unlock(ctx, ref)
+}
+
+func TestClock_history(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	clk := newFakeClock()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"}, &localBackendOptions{Getenv: mapGetenv(nil), Clock: clk})
+	require.NoError(t, err)
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	// History entries are named and ordered by the time of the clock.
+	var want []string
+	for i, d := range []time.Duration{time.Second, -time.Minute, time.Hour} {
+		clk.Advance(d)
+		want = append(want, strconv.FormatInt(clk.Now().UnixNano(), 10))
+		require.NoError(t, b.addToHistory(ctx, ref, backend.UpdateInfo{
+			Kind:      apitype.UpdateUpdate,
+			StartTime: int64(i),
+		}))
+	}
+
+	updates, err := b.ListUpdates(ctx, ref, nil /* opts */)
+	require.NoError(t, err)
+	var got []string
+	var starts []int64
+	for _, u := range updates {
+		got = append(got, u.ID)
+		starts = append(starts, u.StartTime)
+	}
+	assert.Equal(t, []string{want[2], want[0], want[1]}, got)
+	assert.Equal(t, []int64{2, 0, 1}, starts)
+}
+
+func TestClock_migration(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	clk := newFakeClock()
+	b := &wrappedBucket{bucket: memblob.OpenBucket(nil)}
+	writeFiles(t, b.bucket, map[string]string{".pulumi/stacks/a.json": legacyCheckpoint})
+
+	// Migration locks are timestamped by the clock.
+	unlock, err := lockMigration(ctx, b, clk)
+	require.NoError(t, err)
+	byts, err := b.ReadAll(ctx, migrationLockPath)
+	require.NoError(t, err)
+	var lock LockInfo
+	require.NoError(t, json.Unmarshal(byts, &lock))
+	assert.Equal(t, clk.Now(), lock.Timestamp.UTC())
+	unlock()
+
+	// So are the journals and reports of migrations.
+	migrations, _, err := planMigration(ctx, b, newProjectReferenceStore(b, nil, nil), nil /* skip */)
+	require.NoError(t, err)
+	assert.Equal(t, clk.Now(), newMigrationJournal(nil, migrations, clk.Now()).Started)
+	plan, err := migrate(ctx, b, clk, nil /* stackLocks */, nil)
+	require.NoError(t, err)
+	assert.Equal(t, clk.Now(), plan.Report.Started)
+	assert.Zero(t, plan.Report.DurationMillis)
+}
+
+// advancingBucket is a Bucket that moves the clock on every read,
+// as if each read took that long.
+type advancingBucket struct {
+	Bucket
+
+	clk  *fakeClock
+	step time.Duration
+}
+
+func (b *advancingBucket) ReadAll(ctx context.Context, key string) ([]byte, error) {
+	b.clk.Advance(b.step)
+	return b.Bucket.ReadAll(ctx, key)
+}
+
+func TestClock_consistencyTimeout(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	clk := newFakeClock()
+	b := newTestBackend(t, t.TempDir(), &localBackendOptions{
+		Getenv: mapGetenv(map[string]string{PulumiFilestateConsistencyTimeoutEnvVar: "1h"}),
+		Clock:  clk,
+	})
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	// The deadline of the consistency check is kept by the clock,
+	// so the check gives up once the clock passes it.
+	stale := &staleReadBucket{Bucket: b.bucket}
+	b.bucket = &advancingBucket{Bucket: stale, clk: clk, step: 40 * time.Minute}
+	_, _, err = b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 1))
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+	assert.ErrorContains(t, err, "not visible after 1h0m0s")
+}
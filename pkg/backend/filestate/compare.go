@@ -0,0 +1,242 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"gocloud.dev/blob"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// StoreDiff describes how the stacks of two state stores differ.
+// It's reported by [CompareStores], and is safe to serialize to JSON.
+//
+// Stacks are identified by their fully qualified names.
+type StoreDiff struct {
+	// Compared is the number of stacks whose checkpoints were compared.
+	Compared int `json:"compared"`
+
+	// OnlyInA and OnlyInB list the stacks that only the first or second store has a checkpoint for.
+	OnlyInA []string `json:"onlyInA,omitempty"`
+	OnlyInB []string `json:"onlyInB,omitempty"`
+
+	// Differ lists the stacks whose checkpoints differ.
+	Differ []string `json:"differ,omitempty"`
+}
+
+// InSync reports whether the stores have the same checkpoints.
+func (d *StoreDiff) InSync() bool {
+	return len(d.OnlyInA) == 0 && len(d.OnlyInB) == 0 && len(d.Differ) == 0
+}
+
+// CompareStores reports the stacks whose checkpoints differ between two state stores,
+// e.g. a state store and its mirror (see PULUMI_SELF_MANAGED_STATE_MIRROR_URL).
+//
+// Checkpoints are compared byte for byte by their SHA-256 checksums,
+// using the checksum files recorded alongside them if both stores have them.
+// A checkpoint that's compressed in only one of the stores is reported as only in either store.
+// Only the latest checkpoint of each stack is compared, not its history or backups.
+//
+// Both stores are listed in step and checkpoints are read one at a time,
+// so stores of any size can be compared.
+// It fails if the stores have different layouts.
+//
+// This only reads from the buckets,
+// so checkpoints that are written while the stores are compared may be reported as different.
+func CompareStores(ctx context.Context, a, b *blob.Bucket) (*StoreDiff, error) {
+	storeA, err := openCompareStore(ctx, a)
+	if err != nil {
+		return nil, fmt.Errorf("open first store: %w", err)
+	}
+	storeB, err := openCompareStore(ctx, b)
+	if err != nil {
+		return nil, fmt.Errorf("open second store: %w", err)
+	}
+	return compareStores(ctx, storeA, storeB)
+}
+
+// compareStore is a state store being compared by CompareStores.
+type compareStore struct {
+	bucket Bucket
+	store  referenceStore
+
+	// layout describes the layout of the store for messages.
+	layout string
+}
+
+func openCompareStore(ctx context.Context, bucket *blob.Bucket) (*compareStore, error) {
+	b, err := applyIgnoreList(ctx, &wrappedBucket{bucket: bucket})
+	if err != nil {
+		return nil, err
+	}
+	meta, err := readPulumiMeta(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil || meta.Version == 0 {
+		return &compareStore{bucket: b, store: newLegacyReferenceStore(b), layout: "legacy"}, nil
+	}
+	if meta.Version > maxSupportedVersion {
+		return nil, newStoreTooNewError(meta)
+	}
+	keys, err := parseKeyTemplate(meta.KeyTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key template in %q: %w", meta.path(), err)
+	}
+	store := newProjectReferenceStore(b, func() *workspace.Project { return nil }, keys)
+	store.shardHistory = meta.shardsHistory()
+	return &compareStore{
+		bucket: b,
+		store:  store,
+		layout: fmt.Sprintf("project-scoped with key template %q", keys),
+	}, nil
+}
+
+func compareStores(ctx context.Context, a, b *compareStore) (*StoreDiff, error) {
+	if a.layout != b.layout {
+		return nil, fmt.Errorf("the stores have different layouts: %v and %v", a.layout, b.layout)
+	}
+
+	// Listings are in lexicographical order of keys,
+	// so the checkpoints of both stores can be merged as they're listed.
+	itA := a.checkpoints(ctx)
+	itB := b.checkpoints(ctx)
+	chkA, err := itA.next()
+	if err != nil {
+		return nil, err
+	}
+	chkB, err := itB.next()
+	if err != nil {
+		return nil, err
+	}
+
+	diff := StoreDiff{}
+	for chkA != nil || chkB != nil {
+		switch {
+		case chkB == nil || (chkA != nil && chkA.key < chkB.key):
+			diff.OnlyInA = append(diff.OnlyInA, chkA.stack)
+			if chkA, err = itA.next(); err != nil {
+				return nil, err
+			}
+		case chkA == nil || chkB.key < chkA.key:
+			diff.OnlyInB = append(diff.OnlyInB, chkB.stack)
+			if chkB, err = itB.next(); err != nil {
+				return nil, err
+			}
+		default:
+			same, err := sameCheckpoint(ctx, a.bucket, b.bucket, chkA.key)
+			if err != nil {
+				return nil, err
+			}
+			diff.Compared++
+			if !same {
+				diff.Differ = append(diff.Differ, chkA.stack)
+			}
+			if chkA, err = itA.next(); err != nil {
+				return nil, err
+			}
+			if chkB, err = itB.next(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &diff, nil
+}
+
+// listedCheckpoint is a checkpoint file listed by a checkpointIterator.
+type listedCheckpoint struct {
+	key   string
+	stack string
+}
+
+// checkpointIterator lists the checkpoint files of a store in the order of their keys.
+type checkpointIterator struct {
+	ctx   context.Context
+	store *compareStore
+	iter  *blob.ListIterator
+}
+
+func (s *compareStore) checkpoints(ctx context.Context) *checkpointIterator {
+	return &checkpointIterator{ctx: ctx, store: s, iter: s.bucket.List(s.store.stackListOptions(""))}
+}
+
+// next returns the next checkpoint, or nil once all were listed.
+func (it *checkpointIterator) next() (*listedCheckpoint, error) {
+	for {
+		obj, err := nextObject(it.ctx, it.store.bucket, it.iter)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("list stacks: %w", err)
+		}
+		if obj.IsDir {
+			continue
+		}
+		if ref, ok := it.store.store.referenceFromKey(obj.Key); ok {
+			return &listedCheckpoint{key: obj.Key, stack: ref.FullyQualifiedName().String()}, nil
+		}
+	}
+}
+
+// sameCheckpoint reports whether the checkpoint files at the given key in both buckets have the same contents.
+func sameCheckpoint(ctx context.Context, a, b Bucket, key string) (bool, error) {
+	sumA, okA, err := readChecksum(ctx, a, key)
+	if err != nil {
+		return false, err
+	}
+	sumB, okB, err := readChecksum(ctx, b, key)
+	if err != nil {
+		return false, err
+	}
+	if !okA || !okB {
+		if sumA, err = hashObject(ctx, a, key); err != nil {
+			return false, err
+		}
+		if sumB, err = hashObject(ctx, b, key); err != nil {
+			return false, err
+		}
+	}
+	return sumA == sumB, nil
+}
+
+// hashObject returns the checksum of the contents of the given object,
+// reading it incrementally if the bucket supports it.
+func hashObject(ctx context.Context, b Bucket, key string) (string, error) {
+	r, err := newBucketReader(ctx, b, key)
+	if errors.Is(err, errStreamingUnsupported) {
+		byts, err := b.ReadAll(ctx, key)
+		if err != nil {
+			return "", fmt.Errorf("read %q: %w", key, err)
+		}
+		return computeChecksum(byts), nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("read %q: %w", key, err)
+	}
+	defer contract.IgnoreClose(r)
+
+	hash := newChecksumHash()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", fmt.Errorf("read %q: %w", key, err)
+	}
+	return formatChecksum(hash), nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob/memblob"
+)
+
+func TestCompareStores(t *testing.T) {
+	t.Parallel()
+
+	a, b := memblob.OpenBucket(nil), memblob.OpenBucket(nil)
+	writeFiles(t, a, map[string]string{
+		".pulumi/meta.yaml":              "version: 1",
+		".pulumi/stacks/proj/dev.json":   `{"a": 1}`,
+		".pulumi/stacks/proj/prod.json":  `{"a": 2}`,
+		".pulumi/stacks/proj/stage.json": `{"a": 3}`,
+		".pulumi/stacks/web/dev.json":    `{"a": 4}`,
+		// Backups and history aren't compared.
+		".pulumi/stacks/proj/dev.json.bak": `{}`,
+		".pulumi/history/proj/dev/1.json":  `{}`,
+	})
+	writeFiles(t, b, map[string]string{
+		".pulumi/meta.yaml":              "version: 1",
+		".pulumi/stacks/proj/dev.json":   `{"a": 1}`,
+		".pulumi/stacks/proj/prod.json":  `{"a": 20}`,
+		".pulumi/stacks/proj/test.json":  `{"a": 5}`,
+		".pulumi/stacks/web/dev.json":    `{"a": 4}`,
+		".pulumi/stacks/web/dev.json.gz": `{"a": 4}`,
+	})
+
+	diff, err := CompareStores(context.Background(), a, b)
+	require.NoError(t, err)
+	assert.False(t, diff.InSync())
+	assert.Equal(t, &StoreDiff{
+		Compared: 3,
+		OnlyInA:  []string{"organization/proj/stage"},
+		OnlyInB:  []string{"organization/proj/test", "organization/web/dev"},
+		Differ:   []string{"organization/proj/prod"},
+	}, diff)
+
+	diff, err = CompareStores(context.Background(), a, a)
+	require.NoError(t, err)
+	assert.True(t, diff.InSync())
+	assert.Equal(t, 4, diff.Compared)
+}
+
+func TestCompareStores_checksums(t *testing.T) {
+	t.Parallel()
+
+	// Recorded checksums are compared instead of the checkpoints.
+	sum := computeChecksum([]byte("other"))
+	a, b := memblob.OpenBucket(nil), memblob.OpenBucket(nil)
+	writeFiles(t, a, map[string]string{
+		".pulumi/stacks/dev.json":        `{"a": 1}`,
+		".pulumi/stacks/dev.json.sha256": sum,
+	})
+	writeFiles(t, b, map[string]string{
+		".pulumi/stacks/dev.json":        `{"a": 2}`,
+		".pulumi/stacks/dev.json.sha256": sum,
+	})
+	diff, err := CompareStores(context.Background(), a, b)
+	require.NoError(t, err)
+	assert.True(t, diff.InSync())
+	assert.Equal(t, 1, diff.Compared)
+
+	// Without checksums on both sides, contents are hashed.
+	require.NoError(t, b.Delete(context.Background(), ".pulumi/stacks/dev.json.sha256"))
+	diff, err = CompareStores(context.Background(), a, b)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"dev"}, diff.Differ)
+}
+
+func TestCompareStores_layouts(t *testing.T) {
+	t.Parallel()
+
+	a, b := memblob.OpenBucket(nil), memblob.OpenBucket(nil)
+	writeFiles(t, a, map[string]string{".pulumi/meta.yaml": "version: 1"})
+	_, err := CompareStores(context.Background(), a, b)
+	assert.ErrorContains(t, err, "the stores have different layouts")
+
+	writeFiles(t, b, map[string]string{
+		".pulumi/meta.yaml": "version: 1\nkeytemplate: archive/{project}/{stack}",
+	})
+	_, err = CompareStores(context.Background(), a, b)
+	assert.ErrorContains(t, err, "the stores have different layouts")
+}
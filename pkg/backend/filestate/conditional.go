@@ -0,0 +1,174 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/gcsblob"
+	"gocloud.dev/gcerrors"
+)
+
+// ErrConcurrentModification is returned when a checkpoint can't be written
+// because another process modified it since this backend last read or wrote it.
+var ErrConcurrentModification = errors.New("checkpoint was modified concurrently")
+
+// errConditionalUnsupported is returned by objectVersion and copyIfVersion
+// if the bucket can't replace objects conditionally.
+var errConditionalUnsupported = errors.New("conditional writes are not supported")
+
+// conditionalBucket is implemented by Buckets that can replace an object
+// only if it hasn't changed since a known version of it.
+type conditionalBucket interface {
+	// ObjectVersion returns an opaque identifier
+	// of the current version of the object at key.
+	ObjectVersion(ctx context.Context, key string) (string, error)
+
+	// CopyIfVersion copies srcKey over dstKey
+	// if dstKey is still at the given version, as returned by ObjectVersion.
+	// It fails with ErrConcurrentModification otherwise.
+	CopyIfVersion(ctx context.Context, dstKey, srcKey, version string) error
+}
+
+// objectVersion returns the current version of the object at key
+// if the bucket supports conditional writes,
+// or errConditionalUnsupported otherwise.
+func objectVersion(ctx context.Context, bucket Bucket, key string) (string, error) {
+	if cb, ok := bucket.(conditionalBucket); ok {
+		return cb.ObjectVersion(ctx, key)
+	}
+	return "", errConditionalUnsupported
+}
+
+// copyIfVersion copies srcKey over dstKey if dstKey is at the given version
+// and the bucket supports conditional writes,
+// or returns errConditionalUnsupported otherwise.
+func copyIfVersion(ctx context.Context, bucket Bucket, dstKey, srcKey, version string) error {
+	if cb, ok := bucket.(conditionalBucket); ok {
+		return cb.CopyIfVersion(ctx, dstKey, srcKey, version)
+	}
+	return errConditionalUnsupported
+}
+
+// versioner implements conditional copies for a specific storage provider.
+//
+// gocloud doesn't expose preconditions,
+// so these use the provider-specific types that its drivers expose through As.
+type versioner interface {
+	// version returns the version of an object with the given attributes.
+	version(attrs *blob.Attributes) (string, error)
+
+	// copyOptions returns options for a copy
+	// that fails if the destination isn't at the given version.
+	copyOptions(version string) (*blob.CopyOptions, error)
+}
+
+// gcsVersioner uses object generations as versions.
+type gcsVersioner struct{}
+
+func (gcsVersioner) version(attrs *blob.Attributes) (string, error) {
+	var oattrs storage.ObjectAttrs
+	if !attrs.As(&oattrs) {
+		return "", errors.New("object attributes are not from GCS")
+	}
+	return strconv.FormatInt(oattrs.Generation, 10), nil
+}
+
+func (gcsVersioner) copyOptions(version string) (*blob.CopyOptions, error) {
+	generation, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid object generation %q: %w", version, err)
+	}
+	return &blob.CopyOptions{
+		BeforeCopy: func(as func(interface{}) bool) error {
+			var handles *gcsblob.CopyObjectHandles
+			if !as(&handles) {
+				return errors.New("copy is not to GCS")
+			}
+			handles.Dst = handles.Dst.If(storage.Conditions{GenerationMatch: generation})
+			return nil
+		},
+	}, nil
+}
+
+// azureVersioner uses ETags as versions.
+type azureVersioner struct{}
+
+func (azureVersioner) version(attrs *blob.Attributes) (string, error) {
+	if attrs.ETag == "" {
+		return "", errors.New("object has no ETag")
+	}
+	return attrs.ETag, nil
+}
+
+func (azureVersioner) copyOptions(version string) (*blob.CopyOptions, error) {
+	return &blob.CopyOptions{
+		BeforeCopy: func(as func(interface{}) bool) error {
+			var opts *azblob.BlobStartCopyOptions
+			if !as(&opts) {
+				return errors.New("copy is not to Azure Blob Storage")
+			}
+			etag := version
+			opts.ModifiedAccessConditions = &azblob.ModifiedAccessConditions{IfMatch: &etag}
+			return nil
+		},
+	}, nil
+}
+
+// isPreconditionFailed reports whether a bucket operation failed
+// because one of its preconditions didn't hold.
+func isPreconditionFailed(err error) bool {
+	return gcerrors.Code(err) == gcerrors.FailedPrecondition ||
+		httpStatusCode(err) == http.StatusPreconditionFailed
+}
+
+// objectVersions records the versions of checkpoint files
+// as last read or written by this backend.
+type objectVersions struct {
+	mu sync.Mutex
+	m  map[string]string
+}
+
+func (v *objectVersions) get(key string) (string, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	version, ok := v.m[key]
+	return version, ok
+}
+
+func (v *objectVersions) set(key, version string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.m == nil {
+		v.m = make(map[string]string)
+	}
+	v.m[key] = version
+}
+
+func (v *objectVersions) forget(keys ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, key := range keys {
+		delete(v.m, key)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob"
+	"google.golang.org/api/googleapi"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag/colors"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// md5ConditionalBucket is a conditionalBucket
+// that uses the MD5 hashes of objects as their versions.
+//
+// Unlike real storage providers,
+// it doesn't check the version and copy the object atomically.
+type md5ConditionalBucket struct {
+	Bucket
+}
+
+var _ conditionalBucket = (*md5ConditionalBucket)(nil)
+
+func (b *md5ConditionalBucket) ObjectVersion(ctx context.Context, key string) (string, error) {
+	attrs, err := b.Attributes(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(attrs.MD5), nil
+}
+
+func (b *md5ConditionalBucket) CopyIfVersion(ctx context.Context, dstKey, srcKey, version string) error {
+	got, err := b.ObjectVersion(ctx, dstKey)
+	if err != nil {
+		return err
+	}
+	if got != version {
+		return fmt.Errorf("%w: version is %v", ErrConcurrentModification, got)
+	}
+	return b.Copy(ctx, dstKey, srcKey, nil)
+}
+
+func TestSaveCheckpoint_conditional(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, map[string]string{PulumiFilestateConditionalWritesEnvVar: "true"})
+	b.bucket = &md5ConditionalBucket{Bucket: b.bucket}
+	file := b.stackPath(ctx, ref)
+
+	// The version of the file is unknown until it's read or written,
+	// so this write is unconditional.
+	_, _, err := b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 1))
+	require.NoError(t, err)
+	_, ok := b.versions.get(file)
+	assert.True(t, ok, "version should be recorded after a write")
+
+	// Writes following our own writes succeed.
+	_, _, err = b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 2))
+	require.NoError(t, err)
+
+	// Another process writes the checkpoint.
+	other, err := b.bucket.ReadAll(ctx, file)
+	require.NoError(t, err)
+	other = append(other, '\n')
+	require.NoError(t, b.bucket.WriteAll(ctx, file, other, nil))
+
+	_, _, err = b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 3))
+	assert.ErrorIs(t, err, ErrConcurrentModification)
+	got, err := b.bucket.ReadAll(ctx, file)
+	require.NoError(t, err)
+	assert.Equal(t, other, got, "concurrent modification must not be overwritten")
+
+	// After reading the checkpoint again, it may be written.
+	_, err = b.getCheckpoint(ctx, ref)
+	require.NoError(t, err)
+	_, _, err = b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 3))
+	require.NoError(t, err)
+	chk, err := b.getCheckpoint(ctx, ref)
+	require.NoError(t, err)
+	assert.Len(t, chk.Latest.Resources, 3)
+}
+
+func TestSaveCheckpoint_conditionalDisabled(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, nil)
+	b.bucket = &md5ConditionalBucket{Bucket: b.bucket}
+	file := b.stackPath(ctx, ref)
+
+	_, err := b.getCheckpoint(ctx, ref)
+	require.NoError(t, err)
+	require.NoError(t, b.bucket.WriteAll(ctx, file, []byte(`{"version": 3, "checkpoint": {}}`), nil))
+
+	_, _, err = b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 1))
+	assert.NoError(t, err)
+}
+
+func TestSaveCheckpoint_conditionalUnsupported(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	var buff bytes.Buffer
+	b, err := newLocalBackend(ctx,
+		diag.DefaultSink(io.Discard, &buff, diag.FormatOptions{Color: colors.Never}),
+		"file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"},
+		&localBackendOptions{Getenv: mapGetenv(map[string]string{
+			PulumiFilestateConditionalWritesEnvVar: "true",
+		})})
+	require.NoError(t, err)
+
+	// Writes fall back to being unconditional.
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = b.getCheckpoint(ctx, ref)
+		require.NoError(t, err)
+		_, _, err = b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, i))
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, 1, strings.Count(buff.String(), "does not support conditional writes"),
+		"expected a single warning, got:\n%v", buff.String())
+}
+
+func TestIsPreconditionFailed(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc string
+		give error
+		want bool
+	}{
+		{desc: "gcs", give: &googleapi.Error{Code: http.StatusPreconditionFailed}, want: true},
+		{desc: "azure", give: &azcore.ResponseError{StatusCode: http.StatusPreconditionFailed}, want: true},
+		{desc: "not found", give: &googleapi.Error{Code: http.StatusNotFound}},
+		{desc: "other", give: io.ErrUnexpectedEOF},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, tt.want, isPreconditionFailed(fmt.Errorf("copy: %w", tt.give)))
+		})
+	}
+}
+
+func TestVersioner_errors(t *testing.T) {
+	t.Parallel()
+
+	_, err := gcsVersioner{}.copyOptions("not a number")
+	assert.ErrorContains(t, err, `invalid object generation "not a number"`)
+
+	_, err = azureVersioner{}.version(&blob.Attributes{})
+	assert.ErrorContains(t, err, "object has no ETag")
+}
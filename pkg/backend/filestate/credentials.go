@@ -0,0 +1,283 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/azureblob"
+	"gocloud.dev/blob/gcsblob"
+	"gocloud.dev/blob/s3blob"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
+)
+
+// expiredCredentialsCodes are the error codes with which AWS rejects requests
+// signed with temporary credentials that have expired.
+var expiredCredentialsCodes = map[string]bool{
+	"ExpiredToken":          true,
+	"ExpiredTokenException": true,
+	"TokenRefreshRequired":  true,
+}
+
+// isExpiredCredentialsError reports whether a failed bucket operation was rejected
+// because the credentials it was made with are no longer valid,
+// so that it may succeed with credentials resolved anew.
+func isExpiredCredentialsError(err error) bool {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && expiredCredentialsCodes[aerr.Code()] {
+		return true
+	}
+	// Errors of version 2 of the AWS SDK report their code with ErrorCode.
+	var cerr interface{ ErrorCode() string }
+	if errors.As(err, &cerr) && expiredCredentialsCodes[cerr.ErrorCode()] {
+		return true
+	}
+	// Azure and Google Cloud Storage reject expired tokens as unauthenticated.
+	return httpStatusCode(err) == http.StatusUnauthorized
+}
+
+// refreshingSchemes are the schemes of the cloud storage drivers
+// whose buckets are reopened when their credentials expire.
+var refreshingSchemes = map[string]bool{
+	azureblob.Scheme: true,
+	gcsblob.Scheme:   true,
+	s3blob.Scheme:    true,
+}
+
+// credentialsBucket wraps the bucket of a state store,
+// reopening it when a request fails because its credentials have expired,
+// and then making the request again once.
+//
+// The SDKs already renew credentials that they obtain themselves,
+// such as those of assumed roles, instance profiles, and managed identities.
+// Reopening the bucket resolves the credentials again from the environment and configuration files,
+// so that operations that outlive temporary credentials pick up
+// the ones that replaced them, e.g. in a credentials file that is rewritten periodically.
+//
+// Bucket operations can't be replayed if they fail while objects are read or written incrementally,
+// and listings can't be wrapped, so such failures are reported as they are.
+// The request that follows them reopens the bucket instead.
+type credentialsBucket struct {
+	// reopen opens the bucket anew, resolving its credentials again.
+	reopen func(context.Context) (Bucket, error)
+
+	// mu guards bucket, and is held while the bucket is reopened
+	// so that it's reopened once for all requests that fail concurrently.
+	mu     sync.Mutex
+	bucket Bucket
+}
+
+var _ Bucket = (*credentialsBucket)(nil)
+
+// newCredentialsBucket returns a Bucket that calls reopen to replace b
+// when its credentials expire.
+func newCredentialsBucket(b Bucket, reopen func(context.Context) (Bucket, error)) *credentialsBucket {
+	return &credentialsBucket{bucket: b, reopen: reopen}
+}
+
+// current returns the bucket that requests are currently made to.
+func (b *credentialsBucket) current() Bucket {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.bucket
+}
+
+// refresh reopens the bucket unless it was already reopened since stale was current,
+// and returns the bucket that replaced stale.
+func (b *credentialsBucket) refresh(ctx context.Context, stale Bucket) (Bucket, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.bucket != stale {
+		return b.bucket, nil
+	}
+	fresh, err := b.reopen(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Requests already made to the stale bucket may still be in progress,
+	// so it's left open.
+	b.bucket = fresh
+	return fresh, nil
+}
+
+// do runs f with the current bucket,
+// and again with a reopened bucket if it fails because the credentials expired.
+func (b *credentialsBucket) do(ctx context.Context, op, key string, f func(Bucket) error) error {
+	bucket := b.current()
+	err := f(bucket)
+	if err == nil || ctx.Err() != nil || !isExpiredCredentialsError(err) {
+		return err
+	}
+
+	logging.V(5).Infof("%v %q failed because the credentials expired, reopening the bucket: %v", op, key, err)
+	fresh, rerr := b.refresh(ctx, bucket)
+	if rerr != nil {
+		return fmt.Errorf("%w (reopening the bucket with new credentials failed: %v)", err, rerr)
+	}
+	return f(fresh)
+}
+
+func (b *credentialsBucket) Copy(ctx context.Context, dstKey, srcKey string, opts *blob.CopyOptions) error {
+	return b.do(ctx, "copy", dstKey, func(bucket Bucket) error {
+		return bucket.Copy(ctx, dstKey, srcKey, opts)
+	})
+}
+
+func (b *credentialsBucket) Delete(ctx context.Context, key string) error {
+	return b.do(ctx, "delete", key, func(bucket Bucket) error {
+		return bucket.Delete(ctx, key)
+	})
+}
+
+func (b *credentialsBucket) DeleteBatch(ctx context.Context, keys []string) error {
+	return b.do(ctx, "delete batch", fmt.Sprintf("%d objects", len(keys)), func(bucket Bucket) error {
+		return deleteBatch(ctx, bucket, keys)
+	})
+}
+
+func (b *credentialsBucket) NewWriter(
+	ctx context.Context, key string, opts *blob.WriterOptions,
+) (w io.WriteCloser, err error) {
+	err = b.do(ctx, "write", key, func(bucket Bucket) error {
+		w, err = newBucketWriter(ctx, bucket, key, opts)
+		return err
+	})
+	return w, err
+}
+
+func (b *credentialsBucket) NewReader(ctx context.Context, key string) (r io.ReadCloser, err error) {
+	err = b.do(ctx, "open", key, func(bucket Bucket) error {
+		r, err = newBucketReader(ctx, bucket, key)
+		return err
+	})
+	return r, err
+}
+
+func (b *credentialsBucket) ObjectVersion(ctx context.Context, key string) (version string, err error) {
+	err = b.do(ctx, "stat", key, func(bucket Bucket) error {
+		version, err = objectVersion(ctx, bucket, key)
+		return err
+	})
+	return version, err
+}
+
+func (b *credentialsBucket) CopyIfVersion(ctx context.Context, dstKey, srcKey, version string) error {
+	return b.do(ctx, "copy", dstKey, func(bucket Bucket) error {
+		return copyIfVersion(ctx, bucket, dstKey, srcKey, version)
+	})
+}
+
+func (b *credentialsBucket) RevisionsEnabled(ctx context.Context) (enabled bool, err error) {
+	err = b.do(ctx, "stat", "", func(bucket Bucket) error {
+		enabled, err = revisionsEnabled(ctx, bucket)
+		return err
+	})
+	return enabled, err
+}
+
+func (b *credentialsBucket) ListRevisions(ctx context.Context, key string) (revisions []objectRevision, err error) {
+	err = b.do(ctx, "list", key, func(bucket Bucket) error {
+		revisions, err = listRevisions(ctx, bucket, key)
+		return err
+	})
+	return revisions, err
+}
+
+func (b *credentialsBucket) ReadRevision(ctx context.Context, key, id string) (byts []byte, err error) {
+	err = b.do(ctx, "read", key, func(bucket Bucket) error {
+		byts, err = readRevision(ctx, bucket, key, id)
+		return err
+	})
+	return byts, err
+}
+
+func (b *credentialsBucket) List(opts *blob.ListOptions) *blob.ListIterator {
+	return b.current().List(opts)
+}
+
+func (b *credentialsBucket) ListPage(
+	ctx context.Context, pageToken []byte, pageSize int, opts *blob.ListOptions,
+) (objs []*blob.ListObject, next []byte, err error) {
+	err = b.do(ctx, "list", opts.Prefix, func(bucket Bucket) error {
+		objs, next, err = listPage(ctx, bucket, pageToken, pageSize, opts)
+		return err
+	})
+	return objs, next, err
+}
+
+func (b *credentialsBucket) SignedURL(
+	ctx context.Context, key string, opts *blob.SignedURLOptions,
+) (url string, err error) {
+	err = b.do(ctx, "sign", key, func(bucket Bucket) error {
+		url, err = bucket.SignedURL(ctx, key, opts)
+		return err
+	})
+	return url, err
+}
+
+func (b *credentialsBucket) ReadAll(ctx context.Context, key string) (byts []byte, err error) {
+	err = b.do(ctx, "read", key, func(bucket Bucket) error {
+		byts, err = bucket.ReadAll(ctx, key)
+		return err
+	})
+	return byts, err
+}
+
+func (b *credentialsBucket) WriteAll(ctx context.Context, key string, p []byte, opts *blob.WriterOptions) error {
+	return b.do(ctx, "write", key, func(bucket Bucket) error {
+		return bucket.WriteAll(ctx, key, p, opts)
+	})
+}
+
+func (b *credentialsBucket) Exists(ctx context.Context, key string) (exists bool, err error) {
+	err = b.do(ctx, "stat", key, func(bucket Bucket) error {
+		exists, err = bucket.Exists(ctx, key)
+		return err
+	})
+	return exists, err
+}
+
+func (b *credentialsBucket) Attributes(ctx context.Context, key string) (attrs *blob.Attributes, err error) {
+	err = b.do(ctx, "stat", key, func(bucket Bucket) error {
+		attrs, err = bucket.Attributes(ctx, key)
+		return err
+	})
+	return attrs, err
+}
+
+// withCredentialRefresh returns b wrapped in a credentialsBucket
+// that reopens it from the given URL if it's in cloud storage,
+// or b as is otherwise.
+func withCredentialRefresh(b *wrappedBucket, originalURL string) Bucket {
+	if !refreshingSchemes[b.info.Scheme] {
+		return b
+	}
+	return newCredentialsBucket(b, func(ctx context.Context) (Bucket, error) {
+		fresh, _, err := openBucket(ctx, originalURL)
+		if err != nil {
+			return nil, err
+		}
+		fresh.sse = b.sse
+		return fresh, nil
+	})
+}
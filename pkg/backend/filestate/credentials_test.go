@@ -0,0 +1,161 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob/memblob"
+	"google.golang.org/api/googleapi"
+)
+
+// apiError is an error that reports its code like those of version 2 of the AWS SDK.
+type apiError struct{ code string }
+
+func (e *apiError) Error() string     { return e.code }
+func (e *apiError) ErrorCode() string { return e.code }
+
+func TestIsExpiredCredentialsError(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc string
+		give error
+		want bool
+	}{
+		{desc: "aws expired token", give: awserr.New("ExpiredToken", "The provided token has expired.", nil), want: true},
+		{
+			desc: "aws wrapped",
+			give: fmt.Errorf("read: %w", awserr.New("ExpiredTokenException", "expired", nil)),
+			want: true,
+		},
+		{desc: "aws v2", give: &apiError{code: "ExpiredToken"}, want: true},
+		{desc: "gcs unauthorized", give: &googleapi.Error{Code: http.StatusUnauthorized}, want: true},
+		{desc: "azure unauthorized", give: &azcore.ResponseError{StatusCode: http.StatusUnauthorized}, want: true},
+		{desc: "aws access denied", give: awserr.New("AccessDenied", "Access Denied", nil)},
+		{desc: "forbidden", give: &googleapi.Error{Code: http.StatusForbidden}},
+		{desc: "other", give: errors.New("great sadness")},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, tt.want, isExpiredCredentialsError(tt.give))
+		})
+	}
+}
+
+func TestCredentialsBucket(t *testing.T) {
+	t.Parallel()
+
+	expired := awserr.New("ExpiredToken", "The provided token has expired.", nil)
+
+	// newExpiredBucket returns a bucket whose credentials expired,
+	// and a function that reopens it with new credentials.
+	newExpiredBucket := func(t *testing.T) (*flakyBucket, func(context.Context) (Bucket, error), *int) {
+		mem := &wrappedBucket{bucket: memblob.OpenBucket(nil)}
+		require.NoError(t, mem.WriteAll(context.Background(), "foo", []byte("bar"), nil))
+		stale := &flakyBucket{Bucket: mem, err: expired, failures: 100}
+
+		var mu sync.Mutex
+		var reopens int
+		return stale, func(context.Context) (Bucket, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			reopens++
+			return mem, nil
+		}, &reopens
+	}
+
+	t.Run("reopens", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+		stale, reopen, reopens := newExpiredBucket(t)
+		b := newCredentialsBucket(stale, reopen)
+
+		got, err := b.ReadAll(ctx, "foo")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("bar"), got)
+		assert.Equal(t, 1, *reopens)
+		assert.Equal(t, 1, stale.calls)
+
+		// Later requests go to the reopened bucket.
+		require.NoError(t, b.WriteAll(ctx, "baz", []byte("qux"), nil))
+		assert.Equal(t, 1, *reopens)
+		assert.Equal(t, 1, stale.calls)
+	})
+
+	t.Run("reopens once", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+		stale, reopen, reopens := newExpiredBucket(t)
+		b := newCredentialsBucket(stale, reopen)
+
+		// Requests that fail concurrently share the reopened bucket.
+		fresh, err := b.refresh(ctx, stale)
+		require.NoError(t, err)
+		again, err := b.refresh(ctx, stale)
+		require.NoError(t, err)
+		assert.Same(t, fresh, again)
+		assert.Equal(t, 1, *reopens)
+	})
+
+	t.Run("reopen fails", func(t *testing.T) {
+		t.Parallel()
+
+		stale, _, _ := newExpiredBucket(t)
+		b := newCredentialsBucket(stale, func(context.Context) (Bucket, error) {
+			return nil, errors.New("no credentials")
+		})
+
+		_, err := b.ReadAll(context.Background(), "foo")
+		assert.ErrorIs(t, err, expired)
+		assert.ErrorContains(t, err, "no credentials")
+	})
+
+	t.Run("other errors", func(t *testing.T) {
+		t.Parallel()
+
+		forbidden := &googleapi.Error{Code: http.StatusForbidden}
+		stale, reopen, reopens := newExpiredBucket(t)
+		stale.err = forbidden
+		b := newCredentialsBucket(stale, reopen)
+
+		_, err := b.ReadAll(context.Background(), "foo")
+		assert.ErrorIs(t, err, forbidden)
+		assert.Zero(t, *reopens)
+	})
+
+	t.Run("local buckets", func(t *testing.T) {
+		t.Parallel()
+
+		mem, _, err := openBucket(context.Background(), "mem://")
+		require.NoError(t, err)
+		assert.Same(t, mem, withCredentialRefresh(mem, "mem://"))
+	})
+}
@@ -0,0 +1,469 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
+)
+
+// maxHistoryDeltaDepth is the most deltas that are applied
+// to reconstruct the checkpoint of an update with thin history.
+// A full copy of the checkpoint is saved instead of a delta
+// once a checkpoint would take more deltas to reconstruct,
+// which bounds the cost of reading a checkpoint.
+const maxHistoryDeltaDepth = 10
+
+// errHistoryDeltaTooDeep is returned by writeHistoryDelta
+// if the next delta would exceed maxHistoryDeltaDepth.
+var errHistoryDeltaTooDeep = errors.New("too many deltas since the last full checkpoint")
+
+// errHistoryChanged is returned by writeHistoryDelta
+// if only unchanged checkpoints are saved as deltas and the checkpoint changed.
+var errHistoryChanged = errors.New("resources changed since the prior update")
+
+// historyDeltaKey returns the key of the delta saved alongside the given history file
+// instead of a copy of the checkpoint with thin history.
+//
+// Deltas are named "$stack-$nanos.delta.json[.gz]" so that they're moved
+// along with the history files when a stack is renamed.
+func historyDeltaKey(historyFile string) string {
+	return strings.Replace(historyFile, ".history.", ".delta.", 1)
+}
+
+// historyDelta is the difference between the checkpoint saved with an update
+// and the checkpoint of the update before it, its base.
+type historyDelta struct {
+	// Base is the ID of the update whose checkpoint this applies to.
+	Base string `json:"base"`
+
+	// Depth is the number of deltas that are applied
+	// to a full checkpoint to reconstruct this one, including this one.
+	Depth int `json:"depth"`
+
+	// Checkpoint is the checkpoint without the resources of its latest deployment.
+	// It's small, so it's kept in full.
+	Checkpoint json.RawMessage `json:"checkpoint"`
+
+	// Resources lists the resources of the latest deployment in order.
+	// It's empty if Unchanged is set.
+	Resources []historyDeltaResource `json:"resources"`
+
+	// Unchanged is set if the resources are exactly those of the base checkpoint.
+	// Such deltas mark updates that made no changes.
+	Unchanged bool `json:"unchanged,omitempty"`
+}
+
+// historyDeltaResource is a resource of a checkpoint saved as a delta.
+// Exactly one of its fields is set.
+type historyDeltaResource struct {
+	// Base is the index of the identical resource in the base checkpoint.
+	Base *int `json:"base,omitempty"`
+
+	// Resource is the resource if it's not in the base checkpoint.
+	Resource json.RawMessage `json:"resource,omitempty"`
+}
+
+// splitCheckpoint separates the resources of the latest deployment
+// from the rest of the given checkpoint file.
+// Resources are compacted and HTML-escaped so that they can be compared:
+// that's how encoding/json writes them,
+// so resources of reconstructed checkpoints match those of the original.
+//
+// The checkpoint is handled as untyped JSON
+// so that fields unknown to this version of the CLI are preserved.
+func splitCheckpoint(byts []byte) (json.RawMessage, []json.RawMessage, error) {
+	var file map[string]json.RawMessage
+	if err := json.Unmarshal(byts, &file); err != nil {
+		return nil, nil, err
+	}
+	var chk map[string]json.RawMessage
+	if err := unmarshalObject(file["checkpoint"], &chk); err != nil {
+		return nil, nil, fmt.Errorf("checkpoint: %w", err)
+	}
+	var latest map[string]json.RawMessage
+	if err := unmarshalObject(chk["latest"], &latest); err != nil {
+		return nil, nil, fmt.Errorf("latest deployment: %w", err)
+	}
+	if latest == nil {
+		return byts, nil, nil
+	}
+
+	var resources []json.RawMessage
+	if raw, ok := latest["resources"]; ok {
+		if err := json.Unmarshal(raw, &resources); err != nil {
+			return nil, nil, fmt.Errorf("resources: %w", err)
+		}
+		delete(latest, "resources")
+	}
+	for i, res := range resources {
+		var compact, buf bytes.Buffer
+		if err := json.Compact(&compact, res); err != nil {
+			return nil, nil, fmt.Errorf("resource %d: %w", i, err)
+		}
+		json.HTMLEscape(&buf, compact.Bytes())
+		resources[i] = buf.Bytes()
+	}
+
+	var err error
+	if chk["latest"], err = json.Marshal(latest); err != nil {
+		return nil, nil, err
+	}
+	if file["checkpoint"], err = json.Marshal(chk); err != nil {
+		return nil, nil, err
+	}
+	skeleton, err := json.Marshal(file)
+	return skeleton, resources, err
+}
+
+// joinCheckpoint is the inverse of splitCheckpoint.
+func joinCheckpoint(skeleton json.RawMessage, resources []json.RawMessage) ([]byte, error) {
+	if resources == nil {
+		return skeleton, nil
+	}
+
+	var file map[string]json.RawMessage
+	if err := json.Unmarshal(skeleton, &file); err != nil {
+		return nil, err
+	}
+	var chk map[string]json.RawMessage
+	if err := unmarshalObject(file["checkpoint"], &chk); err != nil {
+		return nil, fmt.Errorf("checkpoint: %w", err)
+	}
+	var latest map[string]json.RawMessage
+	if err := unmarshalObject(chk["latest"], &latest); err != nil {
+		return nil, fmt.Errorf("latest deployment: %w", err)
+	}
+	if latest == nil {
+		latest = make(map[string]json.RawMessage)
+	}
+
+	var err error
+	if latest["resources"], err = json.Marshal(resources); err != nil {
+		return nil, err
+	}
+	if chk["latest"], err = json.Marshal(latest); err != nil {
+		return nil, err
+	}
+	if file["checkpoint"], err = json.Marshal(chk); err != nil {
+		return nil, err
+	}
+	return json.Marshal(file)
+}
+
+// unmarshalObject unmarshals a JSON object into m.
+// m is left nil if raw is empty or null.
+func unmarshalObject(raw json.RawMessage, m *map[string]json.RawMessage) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	return json.Unmarshal(raw, m)
+}
+
+// newHistoryDelta returns the delta from the checkpoint base to the checkpoint chk.
+// Both are plaintext, uncompressed checkpoint files.
+func newHistoryDelta(baseID string, baseDepth int, base, chk []byte) (*historyDelta, error) {
+	_, baseResources, err := splitCheckpoint(base)
+	if err != nil {
+		return nil, fmt.Errorf("base checkpoint: %w", err)
+	}
+	skeleton, resources, err := splitCheckpoint(chk)
+	if err != nil {
+		return nil, err
+	}
+
+	// Resources are compacted, so identical resources have identical encodings.
+	index := make(map[string]int, len(baseResources))
+	for i, res := range baseResources {
+		if _, ok := index[string(res)]; !ok {
+			index[string(res)] = i
+		}
+	}
+
+	delta := &historyDelta{
+		Base:       baseID,
+		Depth:      baseDepth + 1,
+		Checkpoint: skeleton,
+		Resources:  make([]historyDeltaResource, len(resources)),
+	}
+	if resources == nil {
+		delta.Resources = nil
+	}
+	unchanged := (resources == nil) == (baseResources == nil) && len(resources) == len(baseResources)
+	for i, res := range resources {
+		if j, ok := index[string(res)]; ok {
+			j := j
+			delta.Resources[i] = historyDeltaResource{Base: &j}
+			unchanged = unchanged && j == i
+		} else {
+			delta.Resources[i] = historyDeltaResource{Resource: res}
+			unchanged = false
+		}
+	}
+	if unchanged {
+		delta.Resources, delta.Unchanged = nil, true
+	}
+	return delta, nil
+}
+
+// apply reconstructs the checkpoint file from the base checkpoint it was made for.
+func (d *historyDelta) apply(base []byte) ([]byte, error) {
+	_, baseResources, err := splitCheckpoint(base)
+	if err != nil {
+		return nil, fmt.Errorf("base checkpoint: %w", err)
+	}
+	if d.Unchanged {
+		return joinCheckpoint(d.Checkpoint, baseResources)
+	}
+
+	var resources []json.RawMessage
+	if d.Resources != nil {
+		resources = make([]json.RawMessage, len(d.Resources))
+	}
+	for i, res := range d.Resources {
+		switch {
+		case res.Base != nil:
+			if *res.Base < 0 || *res.Base >= len(baseResources) {
+				return nil, fmt.Errorf("resource %d refers to resource %d of the base checkpoint, which has %d",
+					i, *res.Base, len(baseResources))
+			}
+			resources[i] = baseResources[*res.Base]
+		case res.Resource != nil:
+			resources[i] = res.Resource
+		default:
+			return nil, fmt.Errorf("resource %d is empty", i)
+		}
+	}
+	return joinCheckpoint(d.Checkpoint, resources)
+}
+
+// plainCheckpoint decrypts and decompresses the contents of the checkpoint file at key.
+func (b *localBackend) plainCheckpoint(ctx context.Context, key string, byts []byte) ([]byte, error) {
+	byts, err := unsealCheckpoint(ctx, b.crypter, key, byts)
+	if err != nil {
+		return nil, err
+	}
+	if !encoding.IsCompressed(byts) {
+		return byts, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(byts))
+	if err != nil {
+		return nil, fmt.Errorf("decompress %v: %w", key, err)
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// writeHistoryDelta saves the checkpoint at chkpath for the given history file
+// as a delta from the checkpoint of the update before it.
+//
+// It fails if there's no prior update with a checkpoint,
+// with errHistoryDeltaTooDeep if a full copy is due,
+// or with errHistoryChanged if unchangedOnly is set and the delta isn't a marker of an unchanged checkpoint.
+func (b *localBackend) writeHistoryDelta(
+	ctx context.Context, ref *localBackendReference, historyFile, chkpath string,
+	m encoding.Marshaler, writeOpts *blob.WriterOptions, unchangedOnly bool,
+) error {
+	files, err := b.listHistoryFiles(ctx, ref)
+	if err != nil {
+		return err
+	}
+	var baseID string
+	for i, file := range files {
+		if file.Key == historyFile && i+1 < len(files) {
+			baseID, _ = historyUpdateID(files[i+1].Key)
+			break
+		}
+	}
+	if baseID == "" {
+		return errors.New("no prior update to save a delta from")
+	}
+
+	base, depth, err := b.historyCheckpointPlaintext(ctx, ref, baseID, maxHistoryDeltaDepth)
+	if err != nil {
+		return fmt.Errorf("read checkpoint of update %v: %w", baseID, err)
+	}
+	if depth >= maxHistoryDeltaDepth {
+		return errHistoryDeltaTooDeep
+	}
+
+	chk, err := b.bucket.ReadAll(ctx, chkpath)
+	if err != nil {
+		return err
+	}
+	if chk, err = b.plainCheckpoint(ctx, chkpath, chk); err != nil {
+		return err
+	}
+	delta, err := newHistoryDelta(baseID, depth, base, chk)
+	if err != nil {
+		return err
+	}
+	if unchangedOnly && !delta.Unchanged {
+		return errHistoryChanged
+	}
+
+	byts, err := m.Marshal(delta)
+	if err != nil {
+		return err
+	}
+	if b.crypter != nil {
+		if byts, err = sealCheckpoint(ctx, b.crypter, byts); err != nil {
+			return fmt.Errorf("encrypt delta: %w", err)
+		}
+		writeOpts = nil
+	}
+	return b.bucket.WriteAll(ctx, historyDeltaKey(historyFile), byts, writeOpts)
+}
+
+// readHistoryDelta reconstructs the checkpoint saved as a delta at key,
+// applying at most budget deltas.
+// It returns the plaintext checkpoint and the number of deltas applied.
+func (b *localBackend) readHistoryDelta(
+	ctx context.Context, ref *localBackendReference, key string, byts []byte, budget int,
+) ([]byte, int, error) {
+	if budget <= 0 {
+		return nil, 0, fmt.Errorf("%v: more than %d deltas to apply", key, maxHistoryDeltaDepth)
+	}
+	byts, err := b.plainCheckpoint(ctx, key, byts)
+	if err != nil {
+		return nil, 0, err
+	}
+	var delta historyDelta
+	if err := json.Unmarshal(byts, &delta); err != nil {
+		return nil, 0, fmt.Errorf("unmarshal %v: %w", key, err)
+	}
+
+	base, depth, err := b.historyCheckpointPlaintext(ctx, ref, delta.Base, budget-1)
+	if err != nil {
+		// The code of err is dropped so that a missing base
+		// is not mistaken for a missing delta.
+		return nil, 0, fmt.Errorf("read base checkpoint of %v: %v", key, err)
+	}
+	chk, err := delta.apply(base)
+	if err != nil {
+		return nil, 0, fmt.Errorf("apply %v: %w", key, err)
+	}
+	return chk, depth + 1, nil
+}
+
+// readHistoryDeltaCheckpoint reconstructs the checkpoint saved as a delta with the given history file,
+// encrypting it if the store is encrypted so that it's returned as a checkpoint copy would be.
+// It returns a NotFound error if there's no delta.
+func (b *localBackend) readHistoryDeltaCheckpoint(
+	ctx context.Context, ref *localBackendReference, historyFile string,
+) (string, []byte, error) {
+	key := historyDeltaKey(historyFile)
+	byts, err := b.bucket.ReadAll(ctx, key)
+	if err != nil {
+		return "", nil, err
+	}
+	chk, _, err := b.readHistoryDelta(ctx, ref, key, byts, maxHistoryDeltaDepth)
+	if err != nil {
+		return "", nil, err
+	}
+	if b.crypter != nil {
+		if chk, err = sealCheckpoint(ctx, b.crypter, chk); err != nil {
+			return "", nil, err
+		}
+	}
+	return key, chk, nil
+}
+
+// historyCheckpointPlaintext returns the plaintext checkpoint saved with the given update,
+// and the number of deltas that were applied to reconstruct it.
+//
+// The files of the update are read directly rather than listed
+// since this is called for every delta applied.
+func (b *localBackend) historyCheckpointPlaintext(
+	ctx context.Context, ref *localBackendReference, updateID string, budget int,
+) ([]byte, int, error) {
+	// Files of updates that were recorded before the history was sharded
+	// are in the history directory itself until they're moved into their shard.
+	name := fmt.Sprintf("%s-%s", ref.name, updateID)
+	prefixes := []string{filepath.ToSlash(ref.HistoryFile(name))}
+	if unsharded := path.Join(filepath.ToSlash(ref.HistoryDir()), name); unsharded != prefixes[0] {
+		prefixes = append(prefixes, unsharded)
+	}
+	for _, prefix := range prefixes {
+		for _, ext := range []string{"json", "json.gz"} {
+			key := prefix + ".checkpoint." + ext
+			byts, err := b.bucket.ReadAll(ctx, key)
+			if err == nil {
+				chk, err := b.plainCheckpoint(ctx, key, byts)
+				return chk, 0, err
+			}
+			if gcerrors.Code(err) != gcerrors.NotFound {
+				return nil, 0, err
+			}
+
+			key = prefix + ".delta." + ext
+			byts, err = b.bucket.ReadAll(ctx, key)
+			if err == nil {
+				return b.readHistoryDelta(ctx, ref, key, byts, budget)
+			}
+			if gcerrors.Code(err) != gcerrors.NotFound {
+				return nil, 0, err
+			}
+		}
+	}
+
+	// The checkpoint may be kept by native versioning or archived.
+	key, byts, err := b.readHistoryCheckpoint(ctx, ref, updateID)
+	if err != nil {
+		return nil, 0, err
+	}
+	chk, err := b.plainCheckpoint(ctx, key, byts)
+	return chk, 0, err
+}
+
+// materializeHistoryDelta replaces the delta saved with the given history file, if any,
+// with a full copy of the checkpoint
+// so that it no longer depends on the checkpoints of prior updates.
+func (b *localBackend) materializeHistoryDelta(
+	ctx context.Context, ref *localBackendReference, historyFile string,
+) error {
+	key, chk, err := b.readHistoryDeltaCheckpoint(ctx, ref, historyFile)
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil
+		}
+		return err
+	}
+
+	var writeOpts *blob.WriterOptions
+	if b.crypter == nil && strings.HasSuffix(historyFile, ".gz") {
+		if chk, err = gzipBytes(chk, b.gzipLevel); err != nil {
+			return err
+		}
+		writeOpts = gzipWriterOptions()
+	}
+	if err := b.bucket.WriteAll(ctx, historyCheckpointKey(historyFile), chk, writeOpts); err != nil {
+		return err
+	}
+	return b.bucket.Delete(ctx, key)
+}
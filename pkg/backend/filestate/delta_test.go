@@ -0,0 +1,317 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/config"
+)
+
+// addThinHistory saves checkpoints with 1 through n resources to the history of ref.
+func addThinHistory(t *testing.T, b *localBackend, ref *localBackendReference, n int) {
+	t.Helper()
+
+	ctx := context.Background()
+	for i := 1; i <= n; i++ {
+		_, _, err := b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, i))
+		require.NoError(t, err)
+		require.NoError(t, b.addToHistory(ctx, ref, backend.UpdateInfo{
+			Kind:    "update",
+			Message: strconv.Itoa(i),
+		}))
+	}
+}
+
+// countHistoryFiles counts the deltas and checkpoint copies in the history of ref.
+func countHistoryFiles(t *testing.T, b *localBackend, ref *localBackendReference) (deltas, copies int) {
+	t.Helper()
+
+	for _, key := range listKeys(t, b.bucket, ref.HistoryDir()) {
+		switch {
+		case strings.Contains(key, ".delta."):
+			deltas++
+		case strings.Contains(key, ".checkpoint."):
+			copies++
+		}
+	}
+	return deltas, copies
+}
+
+func TestThinHistory(t *testing.T) {
+	t.Parallel()
+
+	for _, gzip := range []bool{false, true} {
+		gzip := gzip
+		t.Run("gzip="+strconv.FormatBool(gzip), func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			b, ref := newSnapshotBackend(t, map[string]string{
+				PulumiFilestateThinHistoryEnvVar: "true",
+				PulumiFilestateGzipEnvVar:        strconv.FormatBool(gzip),
+			})
+			require.True(t, b.thinHistory)
+			addThinHistory(t, b, ref, 3)
+
+			// Only the first update has a full copy.
+			deltas, copies := countHistoryFiles(t, b, ref)
+			assert.Equal(t, 2, deltas)
+			assert.Equal(t, 1, copies)
+
+			updates, err := b.ListUpdates(ctx, ref, nil)
+			require.NoError(t, err)
+			require.Len(t, updates, 3)
+			for i, u := range updates {
+				chk, err := b.GetCheckpointAt(ctx, ref, u.ID)
+				require.NoError(t, err)
+				assert.Len(t, chk.Latest.Resources, len(updates)-i)
+			}
+		})
+	}
+}
+
+func TestThinHistory_depth(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, map[string]string{PulumiFilestateThinHistoryEnvVar: "true"})
+	addThinHistory(t, b, ref, maxHistoryDeltaDepth+2)
+
+	// A full copy is saved once the maximum depth is reached.
+	deltas, copies := countHistoryFiles(t, b, ref)
+	assert.Equal(t, maxHistoryDeltaDepth, deltas)
+	assert.Equal(t, 2, copies)
+
+	updates, err := b.ListUpdates(ctx, ref, nil)
+	require.NoError(t, err)
+	chk, err := b.GetCheckpointAt(ctx, ref, updates[1].ID)
+	require.NoError(t, err)
+	assert.Len(t, chk.Latest.Resources, maxHistoryDeltaDepth+1)
+}
+
+func TestThinHistory_fullEntriesReadable(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, nil)
+	addThinHistory(t, b, ref, 1)
+
+	// Later updates are deltas from the full copy saved before.
+	b.thinHistory = true
+	_, _, err := b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 2))
+	require.NoError(t, err)
+	require.NoError(t, b.addToHistory(ctx, ref, backend.UpdateInfo{Kind: "update"}))
+	deltas, copies := countHistoryFiles(t, b, ref)
+	assert.Equal(t, 1, deltas)
+	assert.Equal(t, 1, copies)
+
+	updates, err := b.ListUpdates(ctx, ref, nil)
+	require.NoError(t, err)
+	require.Len(t, updates, 2)
+	for i, want := range []int{2, 1} {
+		chk, err := b.GetCheckpointAt(ctx, ref, updates[i].ID)
+		require.NoError(t, err)
+		assert.Len(t, chk.Latest.Resources, want)
+	}
+}
+
+func TestThinHistory_compact(t *testing.T) {
+	t.Parallel()
+
+	for _, archive := range []bool{false, true} {
+		archive := archive
+		t.Run("archive="+strconv.FormatBool(archive), func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			b, ref := newSnapshotBackend(t, map[string]string{PulumiFilestateThinHistoryEnvVar: "true"})
+			addThinHistory(t, b, ref, 4)
+
+			require.NoError(t, b.CompactHistory(ctx, ref, 2, &CompactHistoryOptions{Archive: archive}))
+
+			// The oldest update that's kept no longer depends on removed ones.
+			deltas, copies := countHistoryFiles(t, b, ref)
+			assert.Equal(t, 1, deltas)
+			assert.Equal(t, 1, copies)
+
+			updates, err := b.ListUpdates(ctx, ref, &ListUpdatesOptions{IncludeArchived: true})
+			require.NoError(t, err)
+			if archive {
+				require.Len(t, updates, 4)
+			} else {
+				require.Len(t, updates, 2)
+			}
+			for i, u := range updates {
+				chk, err := b.GetCheckpointAt(ctx, ref, u.ID)
+				require.NoError(t, err)
+				assert.Len(t, chk.Latest.Resources, 4-i)
+			}
+		})
+	}
+}
+
+func TestHistoryDelta(t *testing.T) {
+	t.Parallel()
+
+	base, err := json.Marshal(newTestCheckpoint(t, 3))
+	require.NoError(t, err)
+	chk, err := json.Marshal(newTestCheckpoint(t, 4))
+	require.NoError(t, err)
+
+	delta, err := newHistoryDelta("1", 0, base, chk)
+	require.NoError(t, err)
+	assert.Equal(t, 1, delta.Depth)
+	require.Len(t, delta.Resources, 4)
+	var shared int
+	for _, res := range delta.Resources {
+		if res.Base != nil {
+			shared++
+		}
+	}
+	assert.Equal(t, 3, shared)
+
+	got, err := delta.apply(base)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(chk), string(got))
+
+	// Deltas don't apply to checkpoints with fewer resources.
+	short, err := json.Marshal(newTestCheckpoint(t, 1))
+	require.NoError(t, err)
+	_, err = delta.apply(short)
+	assert.ErrorContains(t, err, "of the base checkpoint, which has 1")
+}
+
+func TestHistoryDelta_unchanged(t *testing.T) {
+	t.Parallel()
+
+	base, err := json.Marshal(newTestCheckpoint(t, 3))
+	require.NoError(t, err)
+
+	// Only the time of the deployment differs.
+	versioned := newTestCheckpoint(t, 3)
+	var chk apitype.CheckpointV3
+	require.NoError(t, json.Unmarshal(versioned.Checkpoint, &chk))
+	chk.Latest.Manifest.Time = time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	versioned.Checkpoint, err = json.Marshal(chk)
+	require.NoError(t, err)
+	next, err := json.Marshal(versioned)
+	require.NoError(t, err)
+
+	delta, err := newHistoryDelta("1", 0, base, next)
+	require.NoError(t, err)
+	assert.True(t, delta.Unchanged)
+	assert.Nil(t, delta.Resources)
+
+	got, err := delta.apply(base)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(next), string(got))
+
+	// Checkpoints without a deployment don't match those with an empty one.
+	empty, err := json.Marshal(apitype.VersionedCheckpoint{
+		Version:    apitype.DeploymentSchemaVersionCurrent,
+		Checkpoint: json.RawMessage(`{"stack":"foo","latest":{"resources":[]}}`),
+	})
+	require.NoError(t, err)
+	none, err := json.Marshal(apitype.VersionedCheckpoint{
+		Version:    apitype.DeploymentSchemaVersionCurrent,
+		Checkpoint: json.RawMessage(`{"stack":"foo"}`),
+	})
+	require.NoError(t, err)
+	delta, err = newHistoryDelta("1", 0, empty, none)
+	require.NoError(t, err)
+	assert.False(t, delta.Unchanged)
+}
+
+func TestDedupHistory(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, map[string]string{PulumiFilestateDedupHistoryEnvVar: "true"})
+	require.True(t, b.dedupHistory)
+	for _, n := range []int{2, 2, 2, 3} {
+		_, _, err := b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, n))
+		require.NoError(t, err)
+		require.NoError(t, b.addToHistory(ctx, ref, backend.UpdateInfo{Kind: "update", Message: strconv.Itoa(n)}))
+	}
+
+	// The repeated updates are markers, and the changed one is a full copy.
+	deltas, copies := countHistoryFiles(t, b, ref)
+	assert.Equal(t, 2, deltas)
+	assert.Equal(t, 2, copies)
+	for _, key := range listKeys(t, b.bucket, ref.HistoryDir()) {
+		if !strings.Contains(key, ".delta.") {
+			continue
+		}
+		byts, err := b.bucket.ReadAll(ctx, key)
+		require.NoError(t, err)
+		assert.NotContains(t, string(byts), "urn:pulumi")
+	}
+
+	updates, err := b.ListUpdates(ctx, ref, nil)
+	require.NoError(t, err)
+	require.Len(t, updates, 4)
+	for i, want := range []int{3, 2, 2, 2} {
+		chk, err := b.GetCheckpointAt(ctx, ref, updates[i].ID)
+		require.NoError(t, err)
+		assert.Len(t, chk.Latest.Resources, want)
+	}
+
+	// The markers of kept updates are replaced once the update they repeat is removed.
+	require.NoError(t, b.CompactHistory(ctx, ref, 2, nil))
+	deltas, copies = countHistoryFiles(t, b, ref)
+	assert.Equal(t, 0, deltas)
+	assert.Equal(t, 2, copies)
+	chk, err := b.GetCheckpointAt(ctx, ref, updates[1].ID)
+	require.NoError(t, err)
+	assert.Len(t, chk.Latest.Resources, 2)
+}
+
+func TestThinHistory_encrypted(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, map[string]string{PulumiFilestateThinHistoryEnvVar: "true"})
+	b.crypter = config.NewSymmetricCrypter(make([]byte, config.SymmetricCrypterKeyBytes))
+	addThinHistory(t, b, ref, 2)
+	deltas, _ := countHistoryFiles(t, b, ref)
+	require.Equal(t, 1, deltas)
+
+	// Deltas are encrypted like checkpoints.
+	for _, key := range listKeys(t, b.bucket, ref.HistoryDir()) {
+		if !strings.Contains(key, ".delta.") {
+			continue
+		}
+		byts, err := b.bucket.ReadAll(ctx, key)
+		require.NoError(t, err)
+		assert.NotContains(t, string(byts), "urn:pulumi")
+	}
+
+	updates, err := b.ListUpdates(ctx, ref, nil)
+	require.NoError(t, err)
+	chk, err := b.GetCheckpointAt(ctx, ref, updates[0].ID)
+	require.NoError(t, err)
+	assert.Len(t, chk.Latest.Resources, 2)
+}
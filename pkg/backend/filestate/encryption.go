@@ -0,0 +1,208 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/pulumi/pulumi/pkg/v3/secrets/cloud"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/config"
+)
+
+// ErrEncryptionMismatch is returned when a checkpoint is encrypted
+// in a store that does not use encryption, or vice versa.
+var ErrEncryptionMismatch = errors.New("encryption mismatch")
+
+// aes256GCM is the name of the algorithm used to encrypt checkpoints
+// as recorded in the store's metadata file.
+// This is the algorithm used by config.NewSymmetricCrypter.
+const aes256GCM = "aes-256-gcm"
+
+// encryptedCheckpointPrefix starts all encrypted checkpoint files.
+// It can't be mistaken for the start of a JSON or gzip file.
+var encryptedCheckpointPrefix = []byte("pulumi-encrypted:")
+
+// encryptionKeyCheck is encrypted with the key of a store
+// to detect wrong keys before any checkpoints are read.
+const encryptionKeyCheck = "pulumi"
+
+// encryptionMeta records how checkpoints in a store are encrypted
+// in the store's metadata file.
+//
+// The key is either derived from a passphrase with Salt,
+// or it's a data key encrypted with the key management service at KeyURL.
+type encryptionMeta struct {
+	// Algorithm is the encryption algorithm.
+	// Only "aes-256-gcm" is currently supported.
+	Algorithm string `json:"algorithm" yaml:"algorithm"`
+
+	// Salt is the base64-encoded salt used to derive the key from a passphrase.
+	Salt string `json:"salt,omitempty" yaml:"salt,omitempty"`
+
+	// KeyURL is the URL of the key management service key
+	// that encrypts the data key.
+	KeyURL string `json:"keyurl,omitempty" yaml:"keyurl,omitempty"`
+
+	// EncryptedKey is the base64-encoded data key,
+	// encrypted with the key at KeyURL.
+	EncryptedKey string `json:"encryptedkey,omitempty" yaml:"encryptedkey,omitempty"`
+
+	// KeyCheck is encryptionKeyCheck encrypted with the key.
+	KeyCheck string `json:"keycheck" yaml:"keycheck"`
+}
+
+// newEncryptionMeta sets up encryption for a new store
+// as requested by the environment.
+// It returns nil if encryption was not requested.
+func newEncryptionMeta(ctx context.Context, getenv func(string) string) (*encryptionMeta, error) {
+	passphrase := getenv(PulumiFilestateEncryptionPassphraseEnvVar)
+	keyURL := getenv(PulumiFilestateEncryptionKeyEnvVar)
+
+	var (
+		meta    encryptionMeta
+		crypter config.Crypter
+	)
+	switch {
+	case passphrase != "" && keyURL != "":
+		return nil, fmt.Errorf("only one of %v and %v may be set",
+			PulumiFilestateEncryptionPassphraseEnvVar, PulumiFilestateEncryptionKeyEnvVar)
+
+	case passphrase != "":
+		salt := make([]byte, 8)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, fmt.Errorf("generate salt: %w", err)
+		}
+		meta.Salt = base64.StdEncoding.EncodeToString(salt)
+		crypter = config.NewSymmetricCrypterFromPassphrase(passphrase, salt)
+
+	case keyURL != "":
+		dataKey, err := cloud.NewDataKey(keyURL)
+		if err != nil {
+			return nil, fmt.Errorf("generate data key with %v: %w", keyURL, err)
+		}
+		crypter, err = cloud.NewDataKeyCrypter(keyURL, dataKey)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt data key with %v: %w", keyURL, err)
+		}
+		meta.KeyURL = keyURL
+		meta.EncryptedKey = base64.StdEncoding.EncodeToString(dataKey)
+
+	default:
+		return nil, nil
+	}
+
+	meta.Algorithm = aes256GCM
+	check, err := crypter.EncryptValue(ctx, encryptionKeyCheck)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt key check: %w", err)
+	}
+	meta.KeyCheck = check
+	return &meta, nil
+}
+
+// openEncryption returns the crypter for checkpoints in a store
+// encrypted as described by the given metadata,
+// which was read from the file at metaPath.
+func openEncryption(
+	ctx context.Context, meta *encryptionMeta, metaPath string, getenv func(string) string,
+) (config.Crypter, error) {
+	if meta.Algorithm != aes256GCM {
+		return nil, fmt.Errorf("unsupported encryption algorithm %q in %q", meta.Algorithm, metaPath)
+	}
+
+	var crypter config.Crypter
+	switch {
+	case meta.Salt != "":
+		passphrase := getenv(PulumiFilestateEncryptionPassphraseEnvVar)
+		if passphrase == "" {
+			return nil, fmt.Errorf("state store is encrypted with a passphrase; set %v to open it",
+				PulumiFilestateEncryptionPassphraseEnvVar)
+		}
+		salt, err := base64.StdEncoding.DecodeString(meta.Salt)
+		if err != nil {
+			return nil, fmt.Errorf("corrupt store: decode salt in %q: %w", metaPath, err)
+		}
+		crypter = config.NewSymmetricCrypterFromPassphrase(passphrase, salt)
+
+	case meta.EncryptedKey != "":
+		dataKey, err := base64.StdEncoding.DecodeString(meta.EncryptedKey)
+		if err != nil {
+			return nil, fmt.Errorf("corrupt store: decode data key in %q: %w", metaPath, err)
+		}
+		crypter, err = cloud.NewDataKeyCrypter(meta.KeyURL, dataKey)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt data key with %v: %w", meta.KeyURL, err)
+		}
+
+	default:
+		return nil, fmt.Errorf("corrupt store: no encryption key in %q", metaPath)
+	}
+
+	if check, err := crypter.DecryptValue(ctx, meta.KeyCheck); err != nil || check != encryptionKeyCheck {
+		if meta.Salt != "" {
+			return nil, errors.New("incorrect passphrase for encrypted state store")
+		}
+		return nil, errors.New("incorrect key for encrypted state store")
+	}
+	return crypter, nil
+}
+
+// isEncryptedCheckpoint reports whether the given contents of a checkpoint file
+// are encrypted.
+func isEncryptedCheckpoint(byts []byte) bool {
+	return bytes.HasPrefix(byts, encryptedCheckpointPrefix)
+}
+
+// sealCheckpoint encrypts the contents of a checkpoint file.
+// A new nonce is generated for every call
+// and stored alongside the ciphertext.
+func sealCheckpoint(ctx context.Context, c config.Crypter, byts []byte) ([]byte, error) {
+	ciphertext, err := c.EncryptValue(ctx, string(byts))
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, encryptedCheckpointPrefix...), ciphertext...), nil
+}
+
+// unsealCheckpoint decrypts the contents of the given checkpoint file
+// if the store is encrypted, i.e. if c is non-nil.
+//
+// To prevent a store from being downgraded by accident,
+// plaintext checkpoints are rejected in encrypted stores
+// and encrypted checkpoints are rejected in all others.
+func unsealCheckpoint(ctx context.Context, c config.Crypter, file string, byts []byte) ([]byte, error) {
+	encrypted := isEncryptedCheckpoint(byts)
+	switch {
+	case c == nil && !encrypted:
+		return byts, nil
+	case c == nil:
+		return nil, fmt.Errorf("%w: %q is encrypted, but the state store does not use encryption",
+			ErrEncryptionMismatch, file)
+	case !encrypted:
+		return nil, fmt.Errorf("%w: %q is not encrypted, but the state store requires encryption",
+			ErrEncryptionMismatch, file)
+	}
+
+	plaintext, err := c.DecryptValue(ctx, string(byts[len(encryptedCheckpointPrefix):]))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt %q: %w", file, err)
+	}
+	return []byte(plaintext), nil
+}
@@ -0,0 +1,227 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob/fileblob"
+	_ "gocloud.dev/secrets/localsecrets" // driver for base64key://
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/config"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+func TestSealCheckpoint(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	crypter := config.NewSymmetricCrypter(make([]byte, config.SymmetricCrypterKeyBytes))
+	plaintext := []byte(`{"version": 3}`)
+
+	sealed1, err := sealCheckpoint(ctx, crypter, plaintext)
+	require.NoError(t, err)
+	assert.True(t, isEncryptedCheckpoint(sealed1))
+	assert.NotContains(t, string(sealed1), string(plaintext))
+
+	// Every write must use a new nonce.
+	sealed2, err := sealCheckpoint(ctx, crypter, plaintext)
+	require.NoError(t, err)
+	assert.NotEqual(t, sealed1, sealed2)
+
+	got, err := unsealCheckpoint(ctx, crypter, "foo.json", sealed1)
+	require.NoError(t, err)
+	assert.Equal(t, plaintext, got)
+
+	t.Run("plaintext in encrypted store", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := unsealCheckpoint(ctx, crypter, "foo.json", plaintext)
+		assert.ErrorIs(t, err, ErrEncryptionMismatch)
+		assert.ErrorContains(t, err, `"foo.json" is not encrypted`)
+	})
+
+	t.Run("encrypted in plaintext store", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := unsealCheckpoint(ctx, nil, "foo.json", sealed1)
+		assert.ErrorIs(t, err, ErrEncryptionMismatch)
+		assert.ErrorContains(t, err, `"foo.json" is encrypted`)
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		t.Parallel()
+
+		other := config.NewSymmetricCrypter([]byte("0123456789abcdef0123456789abcdef"))
+		_, err := unsealCheckpoint(ctx, other, "foo.json", sealed1)
+		assert.ErrorContains(t, err, `decrypt "foo.json"`)
+	})
+}
+
+// newEncryptedTestBackend opens a backend for the given directory
+// with the given environment.
+func newEncryptedTestBackend(t *testing.T, dir string, env map[string]string) (*localBackend, error) {
+	return newLocalBackend(context.Background(), diagtest.LogSink(t), "file://"+filepath.ToSlash(dir),
+		&workspace.Project{Name: "testproj"}, &localBackendOptions{Getenv: mapGetenv(env)})
+}
+
+func TestEncryption_passphrase(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	stateDir := t.TempDir()
+	env := map[string]string{"PULUMI_SELF_MANAGED_STATE_ENCRYPTION_PASSPHRASE": "hunter2"}
+
+	b, err := newEncryptedTestBackend(t, stateDir, env)
+	require.NoError(t, err)
+	require.NotNil(t, b.meta.Encryption)
+	assert.Equal(t, "aes-256-gcm", b.meta.Encryption.Algorithm)
+	assert.NotEmpty(t, b.meta.Encryption.Salt)
+
+	ref, err := b.ParseStackReference("dev")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	byts, err := os.ReadFile(filepath.Join(stateDir, ".pulumi", "stacks", "testproj", "dev.json"))
+	require.NoError(t, err)
+	assert.True(t, isEncryptedCheckpoint(byts), "checkpoint is not encrypted: %s", byts)
+
+	t.Run("reopen", func(t *testing.T) {
+		t.Parallel()
+
+		b, err := newEncryptedTestBackend(t, stateDir, env)
+		require.NoError(t, err)
+		stacks, _, err := b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+		require.NoError(t, err)
+		assert.Len(t, stacks, 1)
+	})
+
+	t.Run("missing passphrase", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := newEncryptedTestBackend(t, stateDir, nil)
+		assert.ErrorContains(t, err,
+			"state store is encrypted with a passphrase; set PULUMI_SELF_MANAGED_STATE_ENCRYPTION_PASSPHRASE")
+	})
+
+	t.Run("wrong passphrase", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := newEncryptedTestBackend(t, stateDir, map[string]string{
+			"PULUMI_SELF_MANAGED_STATE_ENCRYPTION_PASSPHRASE": "hunter3",
+		})
+		assert.ErrorContains(t, err, "incorrect passphrase for encrypted state store")
+	})
+}
+
+func TestEncryption_kms(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	stateDir := t.TempDir()
+	keyURL := "base64key://" + base64.URLEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+	// Compression and encryption may be combined.
+	b, err := newEncryptedTestBackend(t, stateDir, map[string]string{
+		"PULUMI_SELF_MANAGED_STATE_ENCRYPTION_KEY": keyURL,
+		"PULUMI_SELF_MANAGED_STATE_GZIP":           "true",
+	})
+	require.NoError(t, err)
+	require.NotNil(t, b.meta.Encryption)
+	assert.Equal(t, keyURL, b.meta.Encryption.KeyURL)
+	assert.NotEmpty(t, b.meta.Encryption.EncryptedKey)
+
+	ref, err := b.ParseStackReference("dev")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	byts, err := os.ReadFile(filepath.Join(stateDir, ".pulumi", "stacks", "testproj", "dev.json.gz"))
+	require.NoError(t, err)
+	assert.True(t, isEncryptedCheckpoint(byts))
+
+	// The key URL is recorded in the store
+	// so it doesn't need to be specified again.
+	b, err = newEncryptedTestBackend(t, stateDir, nil)
+	require.NoError(t, err)
+	stacks, _, err := b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+	require.NoError(t, err)
+	assert.Len(t, stacks, 1)
+
+	bucket, err := fileblob.OpenBucket(stateDir, nil)
+	require.NoError(t, err)
+	meta, err := ReadMeta(ctx, bucket)
+	require.NoError(t, err)
+	assert.True(t, meta.Encrypted)
+}
+
+// Plaintext checkpoints in an encrypted store must not be read.
+func TestEncryption_rejectsPlaintext(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	stateDir := t.TempDir()
+	env := map[string]string{"PULUMI_SELF_MANAGED_STATE_ENCRYPTION_PASSPHRASE": "hunter2"}
+
+	b, err := newEncryptedTestBackend(t, stateDir, env)
+	require.NoError(t, err)
+
+	stacksDir := filepath.Join(stateDir, ".pulumi", "stacks", "testproj")
+	require.NoError(t, os.MkdirAll(stacksDir, 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(stacksDir, "dev.json"), []byte(`{"version": 3}`), 0o600))
+
+	_, _, err = b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+	assert.ErrorIs(t, err, ErrEncryptionMismatch)
+
+	report, err := b.Verify(ctx, nil /* events */)
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 1)
+	assert.Equal(t, VerifyError, report.Problems[0].Severity)
+	assert.Contains(t, report.Problems[0].Message, "is not encrypted")
+}
+
+// Encryption can't be enabled for existing stores.
+func TestEncryption_existingStore(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	_, err := newEncryptedTestBackend(t, stateDir, nil)
+	require.NoError(t, err)
+
+	_, err = newEncryptedTestBackend(t, stateDir, map[string]string{
+		"PULUMI_SELF_MANAGED_STATE_ENCRYPTION_PASSPHRASE": "hunter2",
+	})
+	assert.ErrorContains(t, err, "PULUMI_SELF_MANAGED_STATE_ENCRYPTION_PASSPHRASE is set, "+
+		"but the state store is not encrypted")
+}
+
+func TestEncryption_passphraseAndKey(t *testing.T) {
+	t.Parallel()
+
+	_, err := newEncryptedTestBackend(t, t.TempDir(), map[string]string{
+		"PULUMI_SELF_MANAGED_STATE_ENCRYPTION_PASSPHRASE": "hunter2",
+		"PULUMI_SELF_MANAGED_STATE_ENCRYPTION_KEY":        "base64key://",
+	})
+	assert.ErrorContains(t, err, "only one of")
+}
@@ -0,0 +1,125 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+)
+
+// ExportOptions customizes the behavior of [Backend.ExportTo].
+type ExportOptions struct {
+	// Redact replaces the value of every secret in the deployment with a placeholder,
+	// and drops the state of its secrets provider, which may hold an encrypted key.
+	// The structure of the deployment is kept, so that it can be shared for troubleshooting.
+	//
+	// Unlike exporting with decrypted secrets, this reveals nothing about their values.
+	// Redacted deployments are marked as such and are refused by ImportFrom and ImportDeployment.
+	Redact bool
+}
+
+// redactedSecret is the placeholder that redacted secrets hold instead of their ciphertext.
+const redactedSecret = "[redacted]"
+
+func (b *localBackend) ExportTo(
+	ctx context.Context, stackRef backend.StackReference, w io.Writer, opts *ExportOptions,
+) error {
+	if opts == nil {
+		opts = &ExportOptions{}
+	}
+	ref, err := b.getReference(stackRef)
+	if err != nil {
+		return err
+	}
+	deployment, err := b.exportDeployment(ctx, ref)
+	if err != nil {
+		return err
+	}
+
+	if opts.Redact {
+		data, err := redactDeployment(deployment.Deployment)
+		if err != nil {
+			return fmt.Errorf("redact deployment: %w", err)
+		}
+		deployment.Deployment = data
+		deployment.Redacted = true
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	return enc.Encode(deployment)
+}
+
+// redactDeployment returns the given deployment with the value of each secret
+// replaced with redactedSecret and the state of its secrets provider removed.
+func redactDeployment(data json.RawMessage) (json.RawMessage, error) {
+	// Numbers are kept as they were written.
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var deployment map[string]interface{}
+	if err := dec.Decode(&deployment); err != nil {
+		return nil, err
+	}
+
+	if providers, ok := deployment["secrets_providers"].(map[string]interface{}); ok {
+		delete(providers, "state")
+	}
+	redacted, err := json.Marshal(redactSecrets(deployment))
+	if err != nil {
+		return nil, err
+	}
+	return canonicalJSON(redacted)
+}
+
+// redactSecrets replaces the values of the secrets found in v.
+func redactSecrets(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if v[resource.SigKey] == resource.SecretSig {
+			return map[string]interface{}{
+				resource.SigKey: resource.SecretSig,
+				"ciphertext":    redactedSecret,
+			}
+		}
+		for k, e := range v {
+			v[k] = redactSecrets(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = redactSecrets(e)
+		}
+	}
+	return v
+}
+
+// errRedactedDeployment is returned when importing a deployment exported with ExportOptions.Redact.
+var errRedactedDeployment = errors.New("the deployment was redacted when it was exported " +
+	"and its secrets were replaced with placeholders, so it can't be imported")
+
+// checkNotRedacted returns an error if the given deployment was redacted.
+func checkNotRedacted(deployment *apitype.UntypedDeployment) error {
+	if deployment.Redacted {
+		return errRedactedDeployment
+	}
+	return nil
+}
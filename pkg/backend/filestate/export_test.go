@@ -0,0 +1,96 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+)
+
+func TestExportTo_redact(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, nil)
+	secret := func(ciphertext string) map[string]interface{} {
+		return map[string]interface{}{resource.SigKey: resource.SecretSig, "ciphertext": ciphertext}
+	}
+	raw, err := encoding.JSON.Marshal(apitype.CheckpointV3{
+		Stack: "foo",
+		Latest: &apitype.DeploymentV3{
+			SecretsProviders: &apitype.SecretsProvidersV1{
+				Type:  "passphrase",
+				State: json.RawMessage(`{"salt":"v1:c2FsdA==:c2VjcmV0"}`),
+			},
+			Resources: []apitype.ResourceV3{{
+				URN:    "urn:pulumi:foo::proj::pkg:index:Res::a",
+				Custom: true,
+				Type:   "pkg:index:Res",
+				Outputs: map[string]interface{}{
+					"password": secret("v1:cGFzc3dvcmQ="),
+					"tokens":   []interface{}{"public", secret("v1:dG9rZW4=")},
+					"name":     "visible",
+					"count":    3,
+				},
+			}},
+		},
+	})
+	require.NoError(t, err)
+	_, _, err = b.saveCheckpoint(ctx, ref, &apitype.VersionedCheckpoint{
+		Version:    apitype.DeploymentSchemaVersionCurrent,
+		Checkpoint: raw,
+	})
+	require.NoError(t, err)
+
+	var plain bytes.Buffer
+	require.NoError(t, b.ExportTo(ctx, ref, &plain, nil /* opts */))
+	assert.Contains(t, plain.String(), "v1:cGFzc3dvcmQ=")
+	assert.NotContains(t, plain.String(), `"redacted"`)
+
+	var redacted bytes.Buffer
+	require.NoError(t, b.ExportTo(ctx, ref, &redacted, &ExportOptions{Redact: true}))
+	for _, leaked := range []string{"v1:cGFzc3dvcmQ=", "v1:dG9rZW4=", "c2VjcmV0"} {
+		assert.NotContains(t, redacted.String(), leaked)
+	}
+
+	var got apitype.UntypedDeployment
+	require.NoError(t, json.Unmarshal(redacted.Bytes(), &got))
+	assert.True(t, got.Redacted)
+	var deployment apitype.DeploymentV3
+	require.NoError(t, json.Unmarshal(got.Deployment, &deployment))
+	assert.Equal(t, &apitype.SecretsProvidersV1{Type: "passphrase"}, deployment.SecretsProviders)
+	require.Len(t, deployment.Resources, 1)
+	outputs := deployment.Resources[0].Outputs
+	assert.Equal(t, secret("[redacted]"), outputs["password"])
+	assert.Equal(t, []interface{}{"public", secret("[redacted]")}, outputs["tokens"])
+	assert.Equal(t, "visible", outputs["name"])
+	assert.Equal(t, 3.0, outputs["count"])
+
+	// Redacted deployments can't be imported.
+	_, err = b.ImportFrom(ctx, ref, bytes.NewReader(redacted.Bytes()), nil /* opts */)
+	assert.ErrorIs(t, err, errRedactedDeployment)
+	stk := newStack(ref, b.stackPath(ctx, ref), nil /* snapshot */, nil /* tags */, b)
+	assert.ErrorIs(t, b.ImportDeployment(ctx, stk, &got), errRedactedDeployment)
+	assert.Equal(t, 1, checkpointResources(t, b, ref))
+}
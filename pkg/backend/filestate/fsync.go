@@ -0,0 +1,109 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
+)
+
+// fileblobAttrsExt is the extension of the sidecar file
+// in which fileblob stores the attributes of a file.
+const fileblobAttrsExt = ".attrs"
+
+// syncKey flushes the file of the given key in a file:// store to stable storage,
+// along with its attributes and the directories from it up to the root of the store,
+// so that the rename that fileblob wrote it with is durable too.
+// It does nothing unless fsync is enabled for the store.
+//
+// Keys are mapped to files as fileblob does for keys that it doesn't need to escape,
+// which covers every key the backend writes.
+func (b *wrappedBucket) syncKey(key string) error {
+	if !b.fsync || b.localDir == "" {
+		return nil
+	}
+
+	path := filepath.Join(b.localDir, filepath.FromSlash(key))
+	if err := syncFile(path); err != nil {
+		return fmt.Errorf("sync %q: %w", key, err)
+	}
+	if err := syncFile(path + fileblobAttrsExt); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("sync attributes of %q: %w", key, err)
+	}
+
+	// Directories can't be opened for syncing on Windows,
+	// where renames are flushed with the file system's journal instead.
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	// Sync every directory that the write may have created,
+	// since a new directory is only durable once its parent is synced.
+	root := filepath.Clean(b.localDir)
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		if err := syncDir(dir); err != nil {
+			return fmt.Errorf("sync directory of %q: %w", key, err)
+		}
+		if dir == root || !strings.HasPrefix(dir, root) || dir == filepath.Dir(dir) {
+			return nil
+		}
+	}
+}
+
+// syncFile flushes the file at the given path to stable storage.
+func syncFile(path string) error {
+	// Windows only flushes files that are open for writing.
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		contract.IgnoreClose(f)
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir flushes the entries of the directory at the given path to stable storage.
+func syncDir(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer contract.IgnoreClose(f)
+	return f.Sync()
+}
+
+// syncWriter is a writer to a file:// store
+// that syncs the file it wrote once it's closed.
+type syncWriter struct {
+	io.WriteCloser
+
+	sync func() error
+}
+
+func (w *syncWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return w.sync()
+}
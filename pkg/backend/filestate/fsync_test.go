@@ -0,0 +1,85 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+func TestWrappedBucket_fsync(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	b, _, err := openBucket(ctx, "file://"+filepath.ToSlash(dir)+"?prefix=team/a")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "team", "a"), b.localDir)
+	b.fsync = true
+
+	// Files are synced where fileblob wrote them,
+	// so writes would fail if they were looked for anywhere else.
+	require.NoError(t, b.WriteAll(ctx, ".pulumi/stacks/proj/foo.json", []byte("{}"), nil))
+	require.NoError(t, b.Copy(ctx, ".pulumi/stacks/proj/foo.json.bak", ".pulumi/stacks/proj/foo.json", nil))
+	w, err := b.NewWriter(ctx, ".pulumi/history/proj/foo/1.json", nil)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("{}"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	got, err := b.ReadAll(ctx, ".pulumi/history/proj/foo/1.json")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("{}"), got)
+
+	err = b.syncKey(".pulumi/stacks/proj/missing.json")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// Other stores aren't synced.
+	mem, _, err := openBucket(ctx, "mem://")
+	require.NoError(t, err)
+	assert.Empty(t, mem.localDir)
+	mem.fsync = true
+	assert.NoError(t, mem.syncKey("missing"))
+}
+
+func TestNew_fsync(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"},
+		&localBackendOptions{Getenv: mapGetenv(map[string]string{
+			"PULUMI_SELF_MANAGED_STATE_FSYNC": "true",
+		})})
+	require.NoError(t, err)
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+	saveOutputsCheckpoint(t, b, ref, nil /* providers */, map[string]interface{}{"url": "https://example.com"})
+
+	outputs, err := b.GetStackOutputs(ctx, ref, false /* showSecrets */)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"url": "https://example.com"}, outputs)
+}
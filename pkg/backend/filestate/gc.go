@@ -0,0 +1,276 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gocloud.dev/gcerrors"
+)
+
+// GCOptions configures [Backend.GC].
+type GCOptions struct {
+	// DryRun reports the files that would be deleted
+	// without deleting them.
+	DryRun bool
+
+	// MinAge is the age below which files and locks are left alone
+	// because they may belong to an operation in progress.
+	// Defaults to one hour.
+	MinAge time.Duration
+}
+
+// GCFileKind is the kind of file removed by [Backend.GC].
+type GCFileKind string
+
+const (
+	// GCHistory is a history entry of a stack.
+	GCHistory GCFileKind = "history"
+
+	// GCBackup is a backup or snapshot of a stack's checkpoint.
+	GCBackup GCFileKind = "backup"
+
+	// GCLock is an abandoned lock on a stack.
+	GCLock GCFileKind = "lock"
+
+	// GCObject is a checkpoint in the objects directory that no snapshot refers to.
+	GCObject GCFileKind = "object"
+)
+
+// GCFile is a single file removed by [Backend.GC].
+type GCFile struct {
+	// Key is the key of the file in the bucket.
+	Key string `json:"key"`
+
+	// Kind is the kind of file.
+	Kind GCFileKind `json:"kind"`
+
+	// Size is the size of the file in bytes.
+	Size int64 `json:"size"`
+}
+
+// GCReport is the result of [Backend.GC].
+type GCReport struct {
+	// DryRun is set if the files were only reported, not deleted.
+	DryRun bool `json:"dryRun"`
+
+	// Files lists the files that were deleted,
+	// or would have been deleted for a dry run,
+	// ordered by key.
+	Files []GCFile `json:"files,omitempty"`
+
+	// Skipped lists the stacks without a checkpoint
+	// whose files were kept because the stack is currently locked.
+	Skipped []string `json:"skipped,omitempty"`
+
+	// ReclaimedBytes is the total size of Files.
+	ReclaimedBytes int64 `json:"reclaimedBytes"`
+}
+
+func (b *localBackend) GC(ctx context.Context, opts GCOptions) (_ *GCReport, err error) {
+	ctx = withOperationID(ctx)
+	defer func() { err = operationError(ctx, err) }()
+
+	if !opts.DryRun {
+		if err := b.checkWritable(); err != nil {
+			return nil, err
+		}
+		// Stacks that are locked when it starts are skipped,
+		// so it's only new locks that must wait.
+		_, unlock, err := lockStore(ctx, b.bucket, b.clock, "garbage collection", nil)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+	minAge := opts.MinAge
+	if minAge == 0 {
+		minAge = defaultOrphanMinAge
+	}
+	return b.collectGarbage(ctx, opts.DryRun, minAge, b.clock.Now())
+}
+
+// collectGarbage deletes the histories, backups, and locks of stacks
+// that have no checkpoint, unless dryRun is set.
+//
+// Files younger than minAge relative to now are kept
+// in case they're being written by a stack that is being created,
+// as are all files of stacks with a lock younger than minAge.
+func (b *localBackend) collectGarbage(
+	ctx context.Context, dryRun bool, minAge time.Duration, now time.Time,
+) (*GCReport, error) {
+	// Stacks in the legacy layout are usable in a store with project layout,
+	// so their files are kept regardless of the layout in use.
+	refs, err := b.store.ListReferences(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list stacks: %w", err)
+	}
+	legacyRefs, err := newLegacyReferenceStore(b.bucket).ListReferences(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list legacy stacks: %w", err)
+	}
+	live := make(map[string]struct{}, len(refs)+len(legacyRefs))
+	for _, ref := range append(refs, legacyRefs...) {
+		rel := strings.TrimPrefix(filepath.ToSlash(ref.HistoryDir()), filepath.ToSlash(HistoriesDir)+"/")
+		live[rel] = struct{}{}
+	}
+
+	// Files of stacks that aren't live, grouped by the path of the stack
+	// relative to the directory that holds the files.
+	candidates := make(map[string][]GCFile)
+	locked := make(map[string]struct{})
+	dirs := []struct {
+		kind GCFileKind
+		dir  string
+	}{
+		{GCHistory, filepath.ToSlash(HistoriesDir)},
+		{GCBackup, filepath.ToSlash(BackupsDir)},
+		{GCLock, lockDir()},
+	}
+	for _, d := range dirs {
+		files, err := listAll(ctx, b.bucket, d.dir+"/")
+		if err != nil {
+			return nil, fmt.Errorf("list %v: %w", d.dir, err)
+		}
+		for _, file := range files {
+			if file.Key == storeLockPath {
+				// Not the lock of any stack.
+				continue
+			}
+			dir := path.Dir(file.Key)
+			if d.kind == GCHistory {
+				// Files in shards belong to the stack whose history holds the shard.
+				dir = historyFileDir(file.Key)
+			}
+			id := strings.TrimPrefix(dir, d.dir+"/")
+			if d.kind == GCLock {
+				// Locks of project-scoped stacks are keyed by their fully qualified name.
+				id = strings.TrimPrefix(id, "organization/")
+			}
+			if _, ok := live[id]; ok {
+				continue
+			}
+
+			age := now.Sub(file.ModTime)
+			if d.kind == GCLock {
+				age = now.Sub(b.lockTakenAt(ctx, file))
+				if age < minAge {
+					locked[id] = struct{}{}
+				}
+			}
+			if age < minAge {
+				continue
+			}
+			candidates[id] = append(candidates[id], GCFile{Key: file.Key, Kind: d.kind, Size: file.Size})
+		}
+	}
+	// Locks that couldn't be read once ctx was canceled
+	// were aged by their modification time, so the candidates can't be trusted.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	report := GCReport{DryRun: dryRun}
+	for id := range locked {
+		report.Skipped = append(report.Skipped, id)
+	}
+	sort.Strings(report.Skipped)
+	for id, files := range candidates {
+		if _, ok := locked[id]; ok {
+			continue
+		}
+		report.Files = append(report.Files, files...)
+	}
+
+	// Snapshots whose files are about to be deleted no longer refer to their objects.
+	deleted := make(map[string]struct{}, len(report.Files))
+	for _, f := range report.Files {
+		deleted[f.Key] = struct{}{}
+	}
+	objects, err := b.unreferencedObjects(ctx, deleted, minAge, now)
+	if err != nil {
+		return nil, err
+	}
+	report.Files = append(report.Files, objects...)
+
+	sort.Slice(report.Files, func(i, j int) bool {
+		return report.Files[i].Key < report.Files[j].Key
+	})
+
+	keys := make([]string, len(report.Files))
+	for i, f := range report.Files {
+		keys[i] = f.Key
+		report.ReclaimedBytes += f.Size
+	}
+	if !dryRun {
+		if err := deleteAll(ctx, b.bucket, keys, b.deleteConcurrency); err != nil {
+			return nil, fmt.Errorf("delete unreferenced files: %w", err)
+		}
+	}
+	return &report, nil
+}
+
+// unreferencedObjects returns the objects older than minAge that no snapshot refers to,
+// ignoring the snapshots in deleted.
+// Snapshots of stacks in the trash still refer to their objects.
+func (b *localBackend) unreferencedObjects(
+	ctx context.Context, deleted map[string]struct{}, minAge time.Duration, now time.Time,
+) ([]GCFile, error) {
+	objects, err := listAll(ctx, b.bucket, objectsDir()+"/")
+	if err != nil {
+		return nil, fmt.Errorf("list %v: %w", objectsDir(), err)
+	}
+	if len(objects) == 0 {
+		return nil, nil
+	}
+
+	referenced := make(map[string]struct{})
+	for _, dir := range []string{filepath.ToSlash(BackupsDir), trashDir()} {
+		files, err := listAll(ctx, b.bucket, dir+"/")
+		if err != nil {
+			return nil, fmt.Errorf("list %v: %w", dir, err)
+		}
+		for _, file := range files {
+			if _, ok := deleted[file.Key]; ok || path.Ext(file.Key) != objectRefExt {
+				continue
+			}
+			sum, err := readObjectRef(ctx, b.bucket, file.Key)
+			if err != nil {
+				if gcerrors.Code(err) == gcerrors.NotFound {
+					// The snapshot was pruned since it was listed.
+					continue
+				}
+				return nil, fmt.Errorf("read snapshot %v: %w", file.Key, err)
+			}
+			referenced[sum] = struct{}{}
+		}
+	}
+
+	var files []GCFile
+	for _, obj := range objects {
+		sum := path.Base(obj.Key)
+		if _, ok := referenced[sum]; ok || !isObjectID(sum) || now.Sub(obj.ModTime) < minAge {
+			continue
+		}
+		files = append(files, GCFile{Key: obj.Key, Kind: GCObject, Size: obj.Size})
+	}
+	return files, nil
+}
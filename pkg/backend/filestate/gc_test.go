@@ -0,0 +1,147 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// newGarbageStore creates a state store with the stack "proj/foo",
+// a legacy stack "legacy", and files left behind by
+// the deleted stack "proj/gone" and the deleted but locked stack "proj/busy".
+//
+// It returns the time at which locks taken when the store was created are recent.
+func newGarbageStore(t *testing.T) (*localBackend, time.Time) {
+	t.Helper()
+
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"}, nil)
+	require.NoError(t, err)
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	// Files are written now, so they're old two hours later.
+	// Only the lock on "busy" is still recent then.
+	now := time.Now().Add(2 * time.Hour)
+	oldLock, err := json.Marshal(LockInfo{Timestamp: time.Now()})
+	require.NoError(t, err)
+	recentLock, err := json.Marshal(LockInfo{Timestamp: now.Add(-time.Minute)})
+	require.NoError(t, err)
+
+	files := map[string]string{
+		".pulumi/stacks/legacy.json":                       `{"version": 3, "checkpoint": {}}`,
+		".pulumi/history/legacy/legacy-1.history.json":     "{}",
+		".pulumi/history/proj/foo/foo-1.history.json":      "{}",
+		".pulumi/backups/proj/foo/foo.1.json":              "{}",
+		".pulumi/history/proj/gone/gone-1.history.json":    "{}",
+		".pulumi/history/proj/gone/gone-1.checkpoint.json": "12345",
+		".pulumi/backups/proj/gone/gone.1.json":            "{}",
+		".pulumi/locks/organization/proj/gone/1.json":      string(oldLock),
+		".pulumi/history/proj/busy/busy-1.history.json":    "{}",
+		".pulumi/locks/organization/proj/busy/1.json":      string(recentLock),
+	}
+	for key, body := range files {
+		require.NoError(t, b.bucket.WriteAll(ctx, key, []byte(body), nil))
+	}
+	return b, now
+}
+
+func TestGC(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, now := newGarbageStore(t)
+
+	report, err := b.collectGarbage(ctx, false /* dryRun */, time.Hour, now)
+	require.NoError(t, err)
+
+	var keys []string
+	for _, f := range report.Files {
+		keys = append(keys, f.Key)
+	}
+	assert.Equal(t, []string{
+		".pulumi/backups/proj/gone/gone.1.json",
+		".pulumi/history/proj/gone/gone-1.checkpoint.json",
+		".pulumi/history/proj/gone/gone-1.history.json",
+		".pulumi/locks/organization/proj/gone/1.json",
+	}, keys)
+	assert.Equal(t, []string{"proj/busy"}, report.Skipped)
+	assert.False(t, report.DryRun)
+	assert.Positive(t, report.ReclaimedBytes)
+
+	for _, key := range keys {
+		exists, err := b.bucket.Exists(ctx, key)
+		require.NoError(t, err)
+		assert.False(t, exists, "%q should be deleted", key)
+	}
+	for _, key := range []string{
+		".pulumi/history/legacy/legacy-1.history.json",
+		".pulumi/history/proj/foo/foo-1.history.json",
+		".pulumi/backups/proj/foo/foo.1.json",
+		".pulumi/history/proj/busy/busy-1.history.json",
+		".pulumi/locks/organization/proj/busy/1.json",
+	} {
+		exists, err := b.bucket.Exists(ctx, key)
+		require.NoError(t, err)
+		assert.True(t, exists, "%q should be kept", key)
+	}
+}
+
+func TestGC_dryRun(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, now := newGarbageStore(t)
+
+	report, err := b.collectGarbage(ctx, true /* dryRun */, time.Hour, now)
+	require.NoError(t, err)
+	assert.True(t, report.DryRun)
+	require.Len(t, report.Files, 4)
+
+	var size int64
+	for _, f := range report.Files {
+		size += f.Size
+		exists, err := b.bucket.Exists(ctx, f.Key)
+		require.NoError(t, err)
+		assert.True(t, exists, "%q should not be deleted in a dry run", f.Key)
+	}
+	assert.Equal(t, size, report.ReclaimedBytes)
+}
+
+func TestGC_recent(t *testing.T) {
+	t.Parallel()
+
+	// Files that were just written may belong to a stack being created.
+	ctx := context.Background()
+	b, _ := newGarbageStore(t)
+
+	report, err := b.GC(ctx, GCOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, report.Files)
+	assert.Zero(t, report.ReclaimedBytes)
+}
@@ -0,0 +1,556 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"gocloud.dev/gcerrors"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
+)
+
+// UpdateInfo is an update recorded in the history of a stack
+// by [Backend.ListUpdates].
+type UpdateInfo struct {
+	// ID identifies the update within the history of its stack.
+	// Pass it to [Backend.GetCheckpointAt]
+	// to read the checkpoint as it was after the update.
+	ID string `json:"id"`
+
+	backend.UpdateInfo
+}
+
+// historyUpdateID returns the ID of the update recorded in the given history file.
+//
+// History files are named "$stack-$nanos.history.json[.gz]".
+// The ID is the timestamp part, which is kept when a stack is renamed.
+func historyUpdateID(key string) (string, bool) {
+	name := path.Base(key)
+	idx := strings.Index(name, ".history.")
+	if idx == -1 {
+		return "", false
+	}
+	name = name[:idx]
+
+	dash := strings.LastIndex(name, "-")
+	if dash == -1 || dash == len(name)-1 {
+		return "", false
+	}
+	return name[dash+1:], true
+}
+
+func (b *localBackend) GetHistoryRange(
+	ctx context.Context, stackRef backend.StackReference, from, to int,
+) ([]UpdateInfo, error) {
+	if from < 0 || to < from {
+		return nil, fmt.Errorf("invalid history range [%d, %d)", from, to)
+	}
+	ref, err := b.getReference(stackRef)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := b.listHistoryFiles(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	if to > len(files) {
+		to = len(files)
+	}
+	if from >= to {
+		return nil, nil
+	}
+	files = files[from:to]
+
+	// Each worker writes only to its own index of the results
+	// so that they're in the same order as the history.
+	updates := make([]UpdateInfo, len(files))
+	errs := make([]error, len(files))
+	var wg errgroup.Group
+	wg.SetLimit(b.listConcurrency)
+	for i, file := range files {
+		i, file := i, file
+		wg.Go(func() error {
+			if ctx.Err() != nil {
+				// Don't start reading more entries once the fetch is canceled.
+				return nil
+			}
+			update, err := b.readHistoryFile(ctx, file.Key)
+			if err != nil {
+				errs[i] = err
+				return nil
+			}
+			id, _ := historyUpdateID(file.Key)
+			updates[i] = UpdateInfo{ID: id, UpdateInfo: update}
+			return nil
+		})
+	}
+	contract.IgnoreError(wg.Wait()) // workers never fail
+	if err := ctx.Err(); err != nil {
+		// Each entry that wasn't read would fail with the same error.
+		return nil, err
+	}
+
+	var merr *multierror.Error
+	for _, err := range errs {
+		if err != nil {
+			merr = multierror.Append(merr, err)
+		}
+	}
+	if err := merr.ErrorOrNil(); err != nil {
+		return nil, err
+	}
+	return updates, nil
+}
+
+// ListUpdatesOptions customizes the behavior of [Backend.ListUpdates].
+type ListUpdatesOptions struct {
+	// IncludeArchived also returns updates that were archived
+	// by [Backend.CompactHistory].
+	// These are older than all other updates, so they're returned last.
+	IncludeArchived bool
+}
+
+func (b *localBackend) ListUpdates(
+	ctx context.Context, stackRef backend.StackReference, opts *ListUpdatesOptions,
+) ([]UpdateInfo, error) {
+	if opts == nil {
+		opts = &ListUpdatesOptions{}
+	}
+	ref, err := b.getReference(stackRef)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := b.listHistoryFiles(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	updates := make([]UpdateInfo, 0, len(files))
+	for _, file := range files {
+		id, ok := historyUpdateID(file.Key)
+		if !ok {
+			continue
+		}
+		update, err := b.readHistoryFile(ctx, file.Key)
+		if err != nil {
+			return nil, err
+		}
+		updates = append(updates, UpdateInfo{ID: id, UpdateInfo: update})
+	}
+
+	if opts.IncludeArchived {
+		archived, err := b.readHistoryArchives(ctx, ref)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range archived {
+			updates = append(updates, UpdateInfo{ID: u.ID, UpdateInfo: u.Update})
+		}
+	}
+	return updates, nil
+}
+
+func (b *localBackend) GetCheckpointAt(
+	ctx context.Context, stackRef backend.StackReference, updateID string,
+) (*apitype.CheckpointV3, error) {
+	ref, err := b.getReference(stackRef)
+	if err != nil {
+		return nil, err
+	}
+
+	chkpath, byts, err := b.readHistoryCheckpoint(ctx, ref, updateID)
+	if err != nil {
+		return nil, err
+	}
+	return b.decodeHistoryCheckpoint(ctx, "update "+updateID, chkpath, byts)
+}
+
+// decodeHistoryCheckpoint decrypts and decodes a prior checkpoint
+// read from the given path.
+// what describes the checkpoint in error messages, e.g. "update 123".
+func (b *localBackend) decodeHistoryCheckpoint(
+	ctx context.Context, what, chkpath string, byts []byte,
+) (*apitype.CheckpointV3, error) {
+	byts, err := unsealCheckpoint(ctx, b.crypter, chkpath, byts)
+	if err != nil {
+		return nil, fmt.Errorf("read checkpoint for %v: %w", what, err)
+	}
+	chk, err := decodeCheckpoint(byts)
+	if err != nil {
+		return nil, fmt.Errorf("checkpoint for %v is corrupt: %w", what, err)
+	}
+	return chk, nil
+}
+
+// CheckpointVersion is a prior version of the checkpoint of a stack
+// as returned by [Backend.ListCheckpointVersions].
+type CheckpointVersion struct {
+	// ID identifies the version.
+	// Pass it to [Backend.GetCheckpointVersion] to read the checkpoint.
+	ID string `json:"id"`
+
+	// Time is when the version was saved.
+	Time time.Time `json:"time"`
+
+	// Native is set if the version is kept by the object versioning
+	// of the storage provider.
+	// Otherwise, the ID is that of the update that saved the checkpoint.
+	Native bool `json:"native,omitempty"`
+}
+
+func (b *localBackend) ListCheckpointVersions(
+	ctx context.Context, stackRef backend.StackReference,
+) ([]CheckpointVersion, error) {
+	ref, err := b.getReference(stackRef)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.nativeVersioning {
+		revs, err := listRevisions(ctx, b.bucket, b.stackPath(ctx, ref))
+		if err != nil {
+			return nil, fmt.Errorf("list versions of stack %v: %w", ref, err)
+		}
+		versions := make([]CheckpointVersion, len(revs))
+		for i, rev := range revs {
+			versions[i] = CheckpointVersion{ID: rev.ID, Time: rev.ModTime, Native: true}
+		}
+		return versions, nil
+	}
+
+	updates, err := b.ListUpdates(ctx, stackRef, &ListUpdatesOptions{IncludeArchived: true})
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]CheckpointVersion, len(updates))
+	for i, u := range updates {
+		versions[i] = CheckpointVersion{ID: u.ID, Time: time.Unix(u.EndTime, 0)}
+	}
+	return versions, nil
+}
+
+func (b *localBackend) GetCheckpointVersion(
+	ctx context.Context, stackRef backend.StackReference, id string,
+) (*apitype.CheckpointV3, error) {
+	if !b.nativeVersioning {
+		return b.GetCheckpointAt(ctx, stackRef, id)
+	}
+
+	ref, err := b.getReference(stackRef)
+	if err != nil {
+		return nil, err
+	}
+	chkpath, byts, err := b.readCheckpointRevision(ctx, checkpointRevision{Key: b.stackPath(ctx, ref), ID: id})
+	if err != nil {
+		return nil, err
+	}
+	return b.decodeHistoryCheckpoint(ctx, "version "+id, chkpath, byts)
+}
+
+// readHistoryCheckpoint returns the contents of the checkpoint
+// saved with the given update, and the key of the file it was read from.
+// Archived updates are searched if the update is not found otherwise.
+func (b *localBackend) readHistoryCheckpoint(
+	ctx context.Context, ref *localBackendReference, updateID string,
+) (string, []byte, error) {
+	files, err := b.listHistoryFiles(ctx, ref)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, file := range files {
+		if id, ok := historyUpdateID(file.Key); !ok || id != updateID {
+			continue
+		}
+
+		// The checkpoint is copied next to the history file
+		// with the same name and extension.
+		chkpath := historyCheckpointKey(file.Key)
+		byts, err := b.bucket.ReadAll(ctx, chkpath)
+		if err != nil {
+			if gcerrors.Code(err) != gcerrors.NotFound {
+				return "", nil, fmt.Errorf("read checkpoint for update %v: %w", updateID, err)
+			}
+
+			// With thin history, a delta from the prior checkpoint is saved instead.
+			key, byts, err := b.readHistoryDeltaCheckpoint(ctx, ref, file.Key)
+			if err == nil {
+				return key, byts, nil
+			}
+			if gcerrors.Code(err) != gcerrors.NotFound {
+				return "", nil, fmt.Errorf("read checkpoint for update %v: %w", updateID, err)
+			}
+
+			// With native versioning, the revision of the checkpoint
+			// is recorded instead of a copy.
+			rev, err := b.readHistoryRevision(ctx, file.Key)
+			if err != nil {
+				if gcerrors.Code(err) == gcerrors.NotFound {
+					return "", nil, fmt.Errorf("no checkpoint was saved for update %v of stack %v", updateID, ref)
+				}
+				return "", nil, fmt.Errorf("read checkpoint for update %v: %w", updateID, err)
+			}
+			return b.readCheckpointRevision(ctx, rev)
+		}
+		return chkpath, byts, nil
+	}
+
+	archived, err := b.readHistoryArchives(ctx, ref)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, u := range archived {
+		if u.ID != updateID {
+			continue
+		}
+		if u.Checkpoint == nil && u.Revision != nil {
+			return b.readCheckpointRevision(ctx, *u.Revision)
+		}
+		if u.Checkpoint == nil {
+			return "", nil, fmt.Errorf("no checkpoint was saved for update %v of stack %v", updateID, ref)
+		}
+		return u.archive, u.Checkpoint, nil
+	}
+
+	return "", nil, fmt.Errorf("update %v of stack %v not found", updateID, ref)
+}
+
+// historyCheckpointKey returns the key of the checkpoint copy
+// saved alongside the given history file.
+func historyCheckpointKey(historyFile string) string {
+	return strings.Replace(historyFile, ".history.", ".checkpoint.", 1)
+}
+
+// historyArchiveExt is the extension of history archives
+// written by CompactHistory.
+//
+// Archives are named "$stack-$nanos.archive.json.gz"
+// so that they're moved along with the history files when a stack is renamed,
+// but are not mistaken for history files.
+const historyArchiveExt = ".archive.json.gz"
+
+// historyArchive is the contents of a history archive.
+type historyArchive struct {
+	// Updates holds the archived updates, most recent first.
+	Updates []archivedUpdate `json:"updates"`
+}
+
+// archivedUpdate is a single update in a history archive.
+type archivedUpdate struct {
+	ID     string             `json:"id"`
+	Update backend.UpdateInfo `json:"update"`
+
+	// Checkpoint holds the verbatim contents of the checkpoint copy
+	// saved with the update, if any.
+	// This may be compressed or encrypted like the original file.
+	Checkpoint []byte `json:"checkpoint,omitempty"`
+
+	// Revision is the revision of the checkpoint recorded with the update
+	// instead of a copy, if any.
+	Revision *checkpointRevision `json:"revision,omitempty"`
+
+	// archive is the key of the archive the update was read from.
+	archive string
+}
+
+// readHistoryArchives returns the updates in all history archives
+// of the given stack, most recent first.
+func (b *localBackend) readHistoryArchives(
+	ctx context.Context, ref *localBackendReference,
+) ([]archivedUpdate, error) {
+	files, err := ref.listHistory(ctx)
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	files = uniqueHistoryFiles(files)
+
+	// Later archives hold more recent updates.
+	// Files are sorted by name, which includes the time of compaction.
+	var updates []archivedUpdate
+	for i := len(files) - 1; i >= 0; i-- {
+		key := files[i].Key
+		if !strings.HasSuffix(key, historyArchiveExt) {
+			continue
+		}
+
+		byts, err := b.bucket.ReadAll(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("read history archive %s: %w", key, err)
+		}
+		m := encoding.JSON
+		if encoding.IsCompressed(byts) {
+			m = encoding.Gzip(m)
+		}
+		var archive historyArchive
+		if err := m.Unmarshal(byts, &archive); err != nil {
+			return nil, fmt.Errorf("read history archive %s: %w", key, err)
+		}
+		for _, u := range archive.Updates {
+			u.archive = key
+			updates = append(updates, u)
+		}
+	}
+	return updates, nil
+}
+
+// CompactHistoryOptions customizes the behavior of [Backend.CompactHistory].
+type CompactHistoryOptions struct {
+	// Archive bundles the removed updates into a single compressed file
+	// in the history directory instead of deleting them.
+	// Archived updates are returned by [Backend.ListUpdates]
+	// with [ListUpdatesOptions.IncludeArchived].
+	Archive bool
+}
+
+func (b *localBackend) CompactHistory(
+	ctx context.Context, stackRef backend.StackReference, keep int, opts *CompactHistoryOptions,
+) (err error) {
+	ctx = withOperationID(ctx)
+	defer func() { err = operationError(ctx, err) }()
+
+	if keep < 0 {
+		return fmt.Errorf("invalid number of updates to keep: %d", keep)
+	}
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+	ref, err := b.getReference(stackRef)
+	if err != nil {
+		return err
+	}
+
+	if err := b.Lock(ctx, stackRef); err != nil {
+		return err
+	}
+	defer b.Unlock(ctx, stackRef)
+
+	return b.compactHistory(ctx, ref, keep, opts)
+}
+
+// pruneHistory removes the oldest updates from the history of a stack
+// beyond the number kept with PULUMI_SELF_MANAGED_STATE_HISTORY_RETENTION_COUNT, if set.
+// It's called after a successful update has been recorded, with the stack locked.
+// Failures are reported as warnings since the update succeeded regardless.
+func (b *localBackend) pruneHistory(ctx context.Context, ref *localBackendReference) {
+	if b.historyRetention == 0 {
+		return
+	}
+	if err := b.compactHistory(ctx, ref, b.historyRetention, nil); err != nil {
+		b.sink(ctx).Warningf(diag.Message("", "Could not remove old updates from the history of stack %v: %v"), ref, err)
+	}
+}
+
+// compactHistory removes all but the most recent keep updates from the history of a stack.
+// The stack must be locked.
+func (b *localBackend) compactHistory(
+	ctx context.Context, ref *localBackendReference, keep int, opts *CompactHistoryOptions,
+) error {
+	if opts == nil {
+		opts = &CompactHistoryOptions{}
+	}
+
+	// files is sorted most recent first.
+	files, err := b.listHistoryFiles(ctx, ref)
+	if err != nil {
+		return err
+	}
+	if len(files) <= keep {
+		return nil
+	}
+	old := files[keep:]
+
+	if opts.Archive {
+		var archive historyArchive
+		for _, file := range old {
+			id, ok := historyUpdateID(file.Key)
+			if !ok {
+				continue
+			}
+			update, err := b.readHistoryFile(ctx, file.Key)
+			if err != nil {
+				return err
+			}
+			chk, err := b.bucket.ReadAll(ctx, historyCheckpointKey(file.Key))
+			if err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+				return fmt.Errorf("read checkpoint for update %v: %w", id, err)
+			}
+			if chk == nil {
+				// With thin history, the checkpoint is archived whole
+				// since the updates it's a delta from go away.
+				_, chk, err = b.readHistoryDeltaCheckpoint(ctx, ref, file.Key)
+				if err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+					return fmt.Errorf("read checkpoint for update %v: %w", id, err)
+				}
+			}
+			var rev *checkpointRevision
+			if chk == nil {
+				r, err := b.readHistoryRevision(ctx, file.Key)
+				switch {
+				case err == nil:
+					rev = &r
+				case gcerrors.Code(err) != gcerrors.NotFound:
+					return fmt.Errorf("read checkpoint revision for update %v: %w", id, err)
+				}
+			}
+			archive.Updates = append(archive.Updates, archivedUpdate{
+				ID: id, Update: update, Checkpoint: chk, Revision: rev,
+			})
+		}
+
+		byts, err := encoding.GzipLevel(encoding.JSON, b.gzipLevel).Marshal(&archive)
+		if err != nil {
+			return fmt.Errorf("marshal history archive: %w", err)
+		}
+		key := ref.HistoryFile(fmt.Sprintf("%s-%d%s", ref.name, b.clock.Now().UnixNano(), historyArchiveExt))
+		if err := b.bucket.WriteAll(ctx, key, byts, gzipWriterOptions()); err != nil {
+			return fmt.Errorf("write history archive: %w", err)
+		}
+	}
+
+	// The oldest update that's kept may be a delta from one that's removed.
+	if keep > 0 {
+		if err := b.materializeHistoryDelta(ctx, ref, files[keep-1].Key); err != nil {
+			return fmt.Errorf("save checkpoint for update %v: %w", files[keep-1].Key, err)
+		}
+	}
+
+	// Only delete the old files once they've been archived
+	// so that a failure doesn't lose any history.
+	for _, file := range old {
+		for _, key := range []string{
+			file.Key, historyCheckpointKey(file.Key), historyDeltaKey(file.Key), historyRevisionKey(file.Key),
+		} {
+			if err := b.bucket.Delete(ctx, key); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+				return fmt.Errorf("delete history file %s: %w", key, err)
+			}
+		}
+	}
+	return nil
+}
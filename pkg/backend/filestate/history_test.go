@@ -0,0 +1,451 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+func TestHistoryUpdateID(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		give   string
+		want   string
+		wantOk bool
+	}{
+		{give: ".pulumi/history/foo/foo-1234.history.json", want: "1234", wantOk: true},
+		{give: ".pulumi/history/proj/my-stack/my-stack-1234.history.json.gz", want: "1234", wantOk: true},
+		{give: ".pulumi/history/foo/foo-1234.checkpoint.json"},
+		{give: ".pulumi/history/foo/foo.history.json"},
+		{give: ".pulumi/history/foo/foo-.history.json"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.give, func(t *testing.T) {
+			t.Parallel()
+
+			got, ok := historyUpdateID(tt.give)
+			assert.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestListUpdates(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc       string
+		env        map[string]string
+		historyDir string
+	}{
+		{
+			desc:       "project",
+			historyDir: ".pulumi/history/proj/foo",
+		},
+		{
+			desc:       "legacy",
+			env:        map[string]string{"PULUMI_SELF_MANAGED_STATE_LEGACY_LAYOUT": "true"},
+			historyDir: ".pulumi/history/foo",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			stateDir := t.TempDir()
+			b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+				&workspace.Project{Name: "proj"}, &localBackendOptions{Getenv: mapGetenv(tt.env)})
+			require.NoError(t, err)
+
+			ref, err := b.parseStackReference("foo")
+			require.NoError(t, err)
+			_, err = b.CreateStack(ctx, ref, "", nil)
+			require.NoError(t, err)
+
+			// The first update leaves the stack empty,
+			// the second adds a resource.
+			require.NoError(t, b.addToHistory(ctx, ref, backend.UpdateInfo{
+				Kind:      apitype.UpdateUpdate,
+				StartTime: 1,
+				Result:    backend.FailedResult,
+			}))
+			require.NoError(t, b.bucket.WriteAll(ctx, b.stackPath(ctx, ref), []byte(legacyCheckpoint), nil))
+			require.NoError(t, b.addToHistory(ctx, ref, backend.UpdateInfo{
+				Kind:      apitype.UpdateUpdate,
+				StartTime: 2,
+				Result:    backend.SucceededResult,
+			}))
+
+			files, err := filepath.Glob(filepath.Join(stateDir, filepath.FromSlash(tt.historyDir), "*.history.json"))
+			require.NoError(t, err)
+			assert.Len(t, files, 2)
+
+			updates, err := b.ListUpdates(ctx, ref, nil /* opts */)
+			require.NoError(t, err)
+			require.Len(t, updates, 2)
+			assert.Equal(t, int64(2), updates[0].StartTime)
+			assert.Equal(t, backend.SucceededResult, updates[0].Result)
+			assert.Equal(t, int64(1), updates[1].StartTime)
+			assert.Equal(t, backend.FailedResult, updates[1].Result)
+			assert.NotEqual(t, updates[0].ID, updates[1].ID)
+
+			chk, err := b.GetCheckpointAt(ctx, ref, updates[0].ID)
+			require.NoError(t, err)
+			require.NotNil(t, chk.Latest)
+			assert.Len(t, chk.Latest.Resources, 1)
+
+			chk, err = b.GetCheckpointAt(ctx, ref, updates[1].ID)
+			require.NoError(t, err)
+			if chk.Latest != nil {
+				assert.Empty(t, chk.Latest.Resources)
+			}
+
+			_, err = b.GetCheckpointAt(ctx, ref, "1234")
+			assert.ErrorContains(t, err, "update 1234 of stack foo not found")
+		})
+	}
+}
+
+func TestListUpdates_noHistory(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, nil)
+
+	updates, err := b.ListUpdates(ctx, ref, nil /* opts */)
+	require.NoError(t, err)
+	assert.Empty(t, updates)
+}
+
+func TestGetCheckpointAt_encrypted(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, map[string]string{
+		"PULUMI_SELF_MANAGED_STATE_ENCRYPTION_PASSPHRASE": "hunter2",
+	})
+	require.NoError(t, b.addToHistory(ctx, ref, backend.UpdateInfo{Kind: apitype.UpdateUpdate}))
+
+	updates, err := b.ListUpdates(ctx, ref, nil /* opts */)
+	require.NoError(t, err)
+	require.Len(t, updates, 1)
+
+	_, err = b.GetCheckpointAt(ctx, ref, updates[0].ID)
+	assert.NoError(t, err)
+}
+
+func TestGzipHistory(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, map[string]string{PulumiFilestateGzipHistoryEnvVar: "true"})
+	require.True(t, b.gzipHistory)
+
+	// Entries saved before compression was enabled stay readable.
+	b.gzipHistory = false
+	addThinHistory(t, b, ref, 1)
+	b.gzipHistory = true
+	_, _, err := b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 2))
+	require.NoError(t, err)
+	require.NoError(t, b.addToHistory(ctx, ref, backend.UpdateInfo{Kind: apitype.UpdateUpdate, Message: "2"}))
+
+	// The checkpoint itself isn't compressed.
+	chkpath := b.stackPath(ctx, ref)
+	assert.True(t, strings.HasSuffix(chkpath, ".json"), chkpath)
+	byts, err := b.bucket.ReadAll(ctx, chkpath)
+	require.NoError(t, err)
+	assert.False(t, encoding.IsCompressed(byts))
+
+	var compressed int
+	for _, key := range listKeys(t, b.bucket, ref.HistoryDir()) {
+		byts, err := b.bucket.ReadAll(ctx, key)
+		require.NoError(t, err)
+		assert.Equal(t, strings.HasSuffix(key, ".gz"), encoding.IsCompressed(byts), key)
+		if strings.HasSuffix(key, ".gz") {
+			compressed++
+		}
+	}
+	assert.Equal(t, 2, compressed)
+
+	updates, err := b.ListUpdates(ctx, ref, nil /* opts */)
+	require.NoError(t, err)
+	require.Len(t, updates, 2)
+	for i, want := range []int{2, 1} {
+		assert.Equal(t, strconv.Itoa(want), updates[i].Message)
+		chk, err := b.GetCheckpointAt(ctx, ref, updates[i].ID)
+		require.NoError(t, err)
+		assert.Len(t, chk.Latest.Resources, want)
+	}
+}
+
+func TestGzipHistory_thin(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, map[string]string{
+		PulumiFilestateGzipHistoryEnvVar: "true",
+		PulumiFilestateThinHistoryEnvVar: "true",
+	})
+	addThinHistory(t, b, ref, 2)
+
+	// Deltas are compressed too.
+	deltas, _ := countHistoryFiles(t, b, ref)
+	require.Equal(t, 1, deltas)
+	for _, key := range listKeys(t, b.bucket, ref.HistoryDir()) {
+		assert.True(t, strings.HasSuffix(key, ".gz"), key)
+	}
+
+	updates, err := b.ListUpdates(ctx, ref, nil /* opts */)
+	require.NoError(t, err)
+	chk, err := b.GetCheckpointAt(ctx, ref, updates[0].ID)
+	require.NoError(t, err)
+	assert.Len(t, chk.Latest.Resources, 2)
+}
+
+// addTestHistory records n updates in the history of the given stack
+// with start times 1 through n.
+func addTestHistory(t *testing.T, b *localBackend, ref *localBackendReference, n int) {
+	t.Helper()
+
+	for i := 1; i <= n; i++ {
+		require.NoError(t, b.addToHistory(context.Background(), ref, backend.UpdateInfo{
+			Kind:      apitype.UpdateUpdate,
+			StartTime: int64(i),
+		}))
+	}
+}
+
+func startTimes(updates []backend.UpdateInfo) []int64 {
+	times := make([]int64, len(updates))
+	for i, u := range updates {
+		times[i] = u.StartTime
+	}
+	return times
+}
+
+func TestCompactHistory_delete(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, nil)
+	addTestHistory(t, b, ref, 5)
+
+	require.NoError(t, b.CompactHistory(ctx, ref, 2, nil /* opts */))
+
+	history, err := b.GetHistory(ctx, ref, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{5, 4}, startTimes(history))
+
+	// The checkpoint copies of the removed updates are gone too.
+	files, err := listBucket(ctx, b.bucket, ref.HistoryDir())
+	require.NoError(t, err)
+	assert.Len(t, files, 4)
+
+	updates, err := b.ListUpdates(ctx, ref, &ListUpdatesOptions{IncludeArchived: true})
+	require.NoError(t, err)
+	assert.Len(t, updates, 2)
+}
+
+func TestCompactHistory_archive(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, nil)
+	addTestHistory(t, b, ref, 3)
+	require.NoError(t, b.CompactHistory(ctx, ref, 2, &CompactHistoryOptions{Archive: true}))
+	addTestHistory(t, b, ref, 2)
+	require.NoError(t, b.CompactHistory(ctx, ref, 1, &CompactHistoryOptions{Archive: true}))
+
+	history, err := b.GetHistory(ctx, ref, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{2}, startTimes(history))
+
+	updates, err := b.ListUpdates(ctx, ref, nil /* opts */)
+	require.NoError(t, err)
+	assert.Len(t, updates, 1)
+
+	// Archived updates are listed after the others, most recent first.
+	updates, err = b.ListUpdates(ctx, ref, &ListUpdatesOptions{IncludeArchived: true})
+	require.NoError(t, err)
+	var got []int64
+	for _, u := range updates {
+		got = append(got, u.StartTime)
+	}
+	assert.Equal(t, []int64{2, 1, 3, 2, 1}, got)
+
+	// Checkpoints of archived updates can still be read.
+	_, err = b.GetCheckpointAt(ctx, ref, updates[len(updates)-1].ID)
+	assert.NoError(t, err)
+}
+
+func TestCompactHistory_rename(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, nil)
+	addTestHistory(t, b, ref, 2)
+	require.NoError(t, b.CompactHistory(ctx, ref, 0, &CompactHistoryOptions{Archive: true}))
+
+	foo, err := b.GetStack(ctx, ref)
+	require.NoError(t, err)
+	barRef, err := b.RenameStack(ctx, foo, "bar")
+	require.NoError(t, err)
+
+	updates, err := b.ListUpdates(ctx, barRef, &ListUpdatesOptions{IncludeArchived: true})
+	require.NoError(t, err)
+	// The rename itself and the two archived updates.
+	assert.Len(t, updates, 3)
+}
+
+func TestPruneHistory(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc string
+		give string
+		want []int64
+	}{
+		{desc: "unset", want: []int64{4, 3, 2, 1}},
+		{desc: "count", give: "2", want: []int64{4, 3}},
+		{desc: "more than recorded", give: "10", want: []int64{4, 3, 2, 1}},
+		// The latest update is never removed.
+		{desc: "zero", give: "0", want: []int64{4}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			env := map[string]string{}
+			if tt.give != "" {
+				env[PulumiFilestateHistoryRetentionCountEnvVar] = tt.give
+			}
+			b, ref := newSnapshotBackend(t, env)
+			addTestHistory(t, b, ref, 4)
+
+			b.pruneHistory(ctx, ref)
+			history, err := b.GetHistory(ctx, ref, 0, 0)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, startTimes(history))
+		})
+	}
+}
+
+func TestNew_invalidHistoryRetention(t *testing.T) {
+	t.Parallel()
+
+	_, err := newLocalBackend(context.Background(), diagtest.LogSink(t),
+		"file://"+filepath.ToSlash(t.TempDir()), &workspace.Project{Name: "proj"},
+		&localBackendOptions{Getenv: mapGetenv(map[string]string{
+			PulumiFilestateHistoryRetentionCountEnvVar: "-1",
+		})})
+	assert.ErrorContains(t, err, `"-1" is not a non-negative number of updates`)
+}
+
+func TestCompactHistory_invalidKeep(t *testing.T) {
+	t.Parallel()
+
+	b, ref := newSnapshotBackend(t, nil)
+	err := b.CompactHistory(context.Background(), ref, -1, nil /* opts */)
+	assert.ErrorContains(t, err, "invalid number of updates to keep: -1")
+}
+
+func TestGetHistoryRange(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, nil)
+	b.listConcurrency = 2
+	for i := 1; i <= 5; i++ {
+		require.NoError(t, b.addToHistory(ctx, ref, backend.UpdateInfo{
+			Kind:      apitype.UpdateUpdate,
+			StartTime: int64(i),
+		}))
+	}
+	all, err := b.ListUpdates(ctx, ref, nil /* opts */)
+	require.NoError(t, err)
+	require.Len(t, all, 5)
+
+	tests := []struct {
+		desc     string
+		from, to int
+		want     []UpdateInfo
+	}{
+		{desc: "all", from: 0, to: 5, want: all},
+		{desc: "middle", from: 1, to: 4, want: all[1:4]},
+		{desc: "truncated", from: 3, to: 100, want: all[3:]},
+		{desc: "past end", from: 5, to: 10},
+		{desc: "empty", from: 2, to: 2},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := b.GetHistoryRange(ctx, ref, tt.from, tt.to)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err = b.GetHistoryRange(ctx, ref, 3, 1)
+	assert.ErrorContains(t, err, "invalid history range [3, 1)")
+}
+
+func TestGetHistoryRange_errors(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, nil)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, b.addToHistory(ctx, ref, backend.UpdateInfo{Kind: apitype.UpdateUpdate}))
+	}
+	files, err := b.listHistoryFiles(ctx, ref)
+	require.NoError(t, err)
+	require.Len(t, files, 3)
+	for _, file := range []string{files[0].Key, files[2].Key} {
+		require.NoError(t, b.bucket.WriteAll(ctx, file, []byte("not json"), nil))
+	}
+
+	// Every entry that could not be read is reported.
+	_, err = b.GetHistoryRange(ctx, ref, 0, 3)
+	assert.ErrorContains(t, err, "2 errors occurred")
+	assert.ErrorContains(t, err, files[0].Key)
+	assert.ErrorContains(t, err, files[2].Key)
+
+	updates, err := b.GetHistoryRange(ctx, ref, 1, 2)
+	require.NoError(t, err)
+	assert.Len(t, updates, 1)
+}
@@ -0,0 +1,471 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/driver"
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// State stores may be read over HTTP from a web server or CDN
+// that serves the files of the store, e.g. a copy of a bucket.
+// They're opened with the URL of the store prefixed by "filestate+",
+// e.g. "filestate+https://state.example.com/team",
+// which keeps them apart from the URLs of the Pulumi Cloud.
+//
+// Stores served over HTTP are read-only.
+// Files are fetched with GET requests.
+// Listings are answered from an index of the store
+// written by [Backend.WriteIndex] and served with the other files.
+const (
+	httpBucketScheme  = "filestate+http"
+	httpsBucketScheme = "filestate+https"
+)
+
+// httpBucketSchemes are the schemes of stores served over HTTP.
+var httpBucketSchemes = map[string]bool{
+	httpBucketScheme:  true,
+	httpsBucketScheme: true,
+}
+
+func init() {
+	blob.DefaultURLMux().RegisterBucket(httpBucketScheme, &httpBucketURLOpener{})
+	blob.DefaultURLMux().RegisterBucket(httpsBucketScheme, &httpBucketURLOpener{})
+}
+
+// storeIndexKey is the key of the index of a state store,
+// relative to the root of the store.
+var storeIndexKey = path.Join(workspace.BookkeepingDir, "index.json")
+
+// storeIndex lists the files of a state store.
+// It's written by Backend.WriteIndex.
+type storeIndex struct {
+	// Objects lists the files of the store sorted by key,
+	// excluding the index itself.
+	Objects []storeIndexObject `json:"objects"`
+}
+
+// storeIndexObject is a file listed in a storeIndex.
+type storeIndexObject struct {
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+func (b *localBackend) WriteIndex(ctx context.Context) error {
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+
+	files, err := listAll(ctx, b.bucket, "")
+	if err != nil {
+		return fmt.Errorf("list state store: %w", err)
+	}
+	index := storeIndex{Objects: make([]storeIndexObject, 0, len(files))}
+	for _, file := range files {
+		if file.Key == storeIndexKey {
+			continue
+		}
+		index.Objects = append(index.Objects, storeIndexObject{
+			Key:     file.Key,
+			Size:    file.Size,
+			ModTime: file.ModTime.UTC(),
+		})
+	}
+	sort.Slice(index.Objects, func(i, j int) bool {
+		return index.Objects[i].Key < index.Objects[j].Key
+	})
+
+	byts, err := json.Marshal(&index)
+	if err != nil {
+		return err
+	}
+	return b.bucket.WriteAll(ctx, storeIndexKey, byts, nil)
+}
+
+// errHTTPReadOnly is returned by stores served over HTTP for all writes.
+var errHTTPReadOnly = errors.New("state stores served over HTTP are read-only")
+
+// httpStatusError is returned by stores served over HTTP
+// for requests that fail with an unexpected status.
+type httpStatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("%v %v: %v %v", e.Method, e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// httpBucketURLOpener opens stores served over HTTP.
+type httpBucketURLOpener struct{}
+
+func (*httpBucketURLOpener) OpenBucketURL(ctx context.Context, u *url.URL) (*blob.Bucket, error) {
+	base := *u
+	base.Scheme = strings.TrimPrefix(u.Scheme, "filestate+")
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	base.RawPath = ""
+	return blob.NewBucket(&httpBucket{client: http.DefaultClient, base: &base}), nil
+}
+
+// httpBucket is a read-only driver.Bucket for stores served over HTTP.
+type httpBucket struct {
+	client *http.Client
+
+	// base is the URL of the root of the store.
+	// Its query, if any, is sent with every request.
+	base *url.URL
+
+	// urls issues the URLs of files in place of base, if set.
+	// See signedURLBucket.
+	urls *signedURLCache
+}
+
+var _ driver.Bucket = (*httpBucket)(nil)
+
+// url returns the URL of the file with the given key.
+func (b *httpBucket) url(key string) string {
+	u := *b.base
+	u.Path += "/" + key
+	return u.String()
+}
+
+// do sends a request for the file with the given key.
+// It fails with an httpStatusError if the response doesn't have one of the given statuses.
+//
+// Requests with a signed URL that are denied are sent again with a freshly signed one,
+// in case the URL expired sooner than it said.
+func (b *httpBucket) do(
+	ctx context.Context, method, key string, header http.Header, body []byte, statuses ...int,
+) (*http.Response, error) {
+	resp, err := b.send(ctx, method, key, header, body, false /* fresh */, statuses)
+	var herr *httpStatusError
+	if b.urls != nil && errors.As(err, &herr) &&
+		(herr.StatusCode == http.StatusUnauthorized || herr.StatusCode == http.StatusForbidden) {
+		return b.send(ctx, method, key, header, body, true /* fresh */, statuses)
+	}
+	return resp, err
+}
+
+func (b *httpBucket) send(
+	ctx context.Context, method, key string, header http.Header, body []byte, fresh bool, statuses []int,
+) (*http.Response, error) {
+	var signed *SignedURL
+	var rawURL string
+	if b.urls != nil {
+		var err error
+		if signed, err = b.urls.get(ctx, method, key, fresh); err != nil {
+			return nil, fmt.Errorf("sign %v %v: %w", method, key, err)
+		}
+		rawURL = signed.URL
+	} else {
+		rawURL = b.url(key)
+	}
+
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, r)
+	if err != nil {
+		return nil, err
+	}
+	if signed != nil {
+		for k, v := range signed.Header {
+			req.Header[k] = v
+		}
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	// Files must be read as they're stored, so that checksums match.
+	// This stops the transport from decompressing gzip-encoded responses.
+	req.Header.Set("Accept-Encoding", "identity")
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range statuses {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	resp.Body.Close()
+
+	errURL := *req.URL
+	if signed != nil {
+		// The query of signed URLs holds their signature.
+		errURL.RawQuery = ""
+	}
+	return nil, &httpStatusError{Method: method, URL: errURL.Redacted(), StatusCode: resp.StatusCode}
+}
+
+func (b *httpBucket) ErrorCode(err error) gcerrors.ErrorCode {
+	if errors.Is(err, errHTTPReadOnly) {
+		return gcerrors.PermissionDenied
+	}
+	var herr *httpStatusError
+	if !errors.As(err, &herr) {
+		return gcerrors.Unknown
+	}
+	switch code := herr.StatusCode; {
+	case code == http.StatusNotFound:
+		return gcerrors.NotFound
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return gcerrors.PermissionDenied
+	case code == http.StatusPreconditionFailed:
+		return gcerrors.FailedPrecondition
+	case code == http.StatusTooManyRequests:
+		return gcerrors.ResourceExhausted
+	case code >= http.StatusInternalServerError:
+		return gcerrors.Internal
+	default:
+		return gcerrors.Unknown
+	}
+}
+
+func (b *httpBucket) As(i interface{}) bool { return false }
+
+func (b *httpBucket) ErrorAs(err error, i interface{}) bool { return errors.As(err, i) }
+
+func (b *httpBucket) Attributes(ctx context.Context, key string) (*driver.Attributes, error) {
+	resp, err := b.do(ctx, http.MethodHead, key, nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	attrs := &driver.Attributes{
+		CacheControl:       resp.Header.Get("Cache-Control"),
+		ContentDisposition: resp.Header.Get("Content-Disposition"),
+		ContentEncoding:    resp.Header.Get("Content-Encoding"),
+		ContentLanguage:    resp.Header.Get("Content-Language"),
+		ContentType:        resp.Header.Get("Content-Type"),
+		ModTime:            lastModified(resp),
+		Size:               resp.ContentLength,
+		ETag:               resp.Header.Get("ETag"),
+		AsFunc:             func(interface{}) bool { return false },
+	}
+	return attrs, nil
+}
+
+// lastModified returns the Last-Modified time of resp, or the zero time.
+func lastModified(resp *http.Response) time.Time {
+	t, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// readIndex fetches the index of the store.
+func (b *httpBucket) readIndex(ctx context.Context) (*storeIndex, error) {
+	resp, err := b.do(ctx, http.MethodGet, storeIndexKey, nil, nil, http.StatusOK)
+	if err != nil {
+		var herr *httpStatusError
+		if errors.As(err, &herr) && herr.StatusCode == http.StatusNotFound {
+			// Listings can't be answered without the index.
+			// Missing files are reported as NotFound,
+			// which would make the store look empty.
+			return nil, fmt.Errorf("%v is missing; write it with WriteIndex to serve the store over HTTP",
+				storeIndexKey)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var index storeIndex
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		return nil, fmt.Errorf("decode %v: %w", storeIndexKey, err)
+	}
+	sort.Slice(index.Objects, func(i, j int) bool {
+		return index.Objects[i].Key < index.Objects[j].Key
+	})
+	return &index, nil
+}
+
+// ListPaged lists the files in the index of the store.
+// The index is fetched for every page so that listings are current.
+func (b *httpBucket) ListPaged(ctx context.Context, opts *driver.ListOptions) (*driver.ListPage, error) {
+	if opts.BeforeList != nil {
+		if err := opts.BeforeList(func(interface{}) bool { return false }); err != nil {
+			return nil, err
+		}
+	}
+	index, err := b.readIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return index.page(opts), nil
+}
+
+// page returns the page of the files in the index that the given options ask for.
+// The files must be sorted by key.
+func (index *storeIndex) page(opts *driver.ListOptions) *driver.ListPage {
+	// The page token is the last key of the previous page.
+	after := string(opts.PageToken)
+	var page driver.ListPage
+	for _, obj := range index.Objects {
+		if !strings.HasPrefix(obj.Key, opts.Prefix) {
+			continue
+		}
+
+		item := &driver.ListObject{Key: obj.Key, ModTime: obj.ModTime, Size: obj.Size}
+		if opts.Delimiter != "" {
+			rest := obj.Key[len(opts.Prefix):]
+			if i := strings.Index(rest, opts.Delimiter); i >= 0 {
+				item = &driver.ListObject{Key: opts.Prefix + rest[:i+len(opts.Delimiter)], IsDir: true}
+			}
+		}
+		// Objects are sorted, so directories follow each other
+		// and only their first object needs to be listed.
+		if item.Key <= after {
+			continue
+		}
+		if n := len(page.Objects); n > 0 && page.Objects[n-1].Key == item.Key {
+			continue
+		}
+
+		if opts.PageSize > 0 && len(page.Objects) == opts.PageSize {
+			page.NextPageToken = []byte(page.Objects[len(page.Objects)-1].Key)
+			break
+		}
+		page.Objects = append(page.Objects, item)
+	}
+	return &page
+}
+
+func (b *httpBucket) NewRangeReader(
+	ctx context.Context, key string, offset, length int64, opts *driver.ReaderOptions,
+) (driver.Reader, error) {
+	header := make(http.Header)
+	statuses := []int{http.StatusOK}
+	if offset > 0 || length >= 0 {
+		rng := "bytes=" + strconv.FormatInt(offset, 10) + "-"
+		if length > 0 {
+			rng += strconv.FormatInt(offset+length-1, 10)
+		}
+		header.Set("Range", rng)
+		statuses = append(statuses, http.StatusPartialContent)
+	}
+	method := http.MethodGet
+	if length == 0 {
+		method = http.MethodHead
+	}
+
+	resp, err := b.do(ctx, method, key, header, nil, statuses...)
+	if err != nil {
+		return nil, err
+	}
+	if opts.BeforeRead != nil {
+		if err := opts.BeforeRead(func(interface{}) bool { return false }); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+
+	r := &httpReader{
+		body: resp.Body,
+		attrs: driver.ReaderAttributes{
+			ContentType: resp.Header.Get("Content-Type"),
+			ModTime:     lastModified(resp),
+			Size:        resp.ContentLength,
+		},
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		// The size of the file is after the slash in "bytes 0-99/1234".
+		cr := resp.Header.Get("Content-Range")
+		if i := strings.LastIndex(cr, "/"); i >= 0 {
+			if size, err := strconv.ParseInt(cr[i+1:], 10, 64); err == nil {
+				r.attrs.Size = size
+			}
+		}
+	}
+	if length == 0 {
+		r.body = io.NopCloser(strings.NewReader(""))
+		resp.Body.Close()
+	} else if resp.StatusCode == http.StatusOK && offset > 0 {
+		// The server ignored the range.
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+	if length > 0 {
+		r.body = struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(r.body, length), r.body}
+	}
+	return r, nil
+}
+
+// httpReader reads the body of a response to a GET request.
+type httpReader struct {
+	body  io.ReadCloser
+	attrs driver.ReaderAttributes
+}
+
+func (r *httpReader) Read(p []byte) (int, error) { return r.body.Read(p) }
+
+func (r *httpReader) Close() error { return r.body.Close() }
+
+func (r *httpReader) Attributes() *driver.ReaderAttributes { return &r.attrs }
+
+func (r *httpReader) As(interface{}) bool { return false }
+
+func (b *httpBucket) NewTypedWriter(
+	ctx context.Context, key, contentType string, opts *driver.WriterOptions,
+) (driver.Writer, error) {
+	return nil, errHTTPReadOnly
+}
+
+func (b *httpBucket) Copy(ctx context.Context, dstKey, srcKey string, opts *driver.CopyOptions) error {
+	return errHTTPReadOnly
+}
+
+func (b *httpBucket) Delete(ctx context.Context, key string) error {
+	return errHTTPReadOnly
+}
+
+// SignedURL returns the URL of the file,
+// which is readable by anyone who can read the store.
+func (b *httpBucket) SignedURL(ctx context.Context, key string, opts *driver.SignedURLOptions) (string, error) {
+	if opts.Method != http.MethodGet {
+		return "", errHTTPReadOnly
+	}
+	return b.url(key), nil
+}
+
+func (b *httpBucket) Close() error { return nil }
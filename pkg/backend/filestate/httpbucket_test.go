@@ -0,0 +1,197 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob/driver"
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// serveStore creates a stack with two updates in a store at the given prefix of a directory,
+// and serves the directory over HTTP.
+// It returns the URL of the server.
+func serveStore(t *testing.T, query string) string {
+	t.Helper()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(dir)+query,
+		&workspace.Project{Name: "proj"}, nil)
+	require.NoError(t, err)
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+	for i := 1; i <= 2; i++ {
+		_, _, err = b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, i))
+		require.NoError(t, err)
+		require.NoError(t, b.addToHistory(ctx, ref, backend.UpdateInfo{Kind: "update"}))
+	}
+	require.NoError(t, b.WriteIndex(ctx))
+
+	srv := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestHTTPStore(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc  string
+		query string
+	}{
+		{desc: "root"},
+		{desc: "prefix", query: "?prefix=team-a"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			srvURL := serveStore(t, tt.query)
+			b, err := newLocalBackend(ctx, diagtest.LogSink(t), "filestate+"+srvURL+tt.query,
+				&workspace.Project{Name: "proj"}, nil)
+			require.NoError(t, err)
+			assert.Equal(t, 1, b.StoreInfo().Version)
+			assert.Equal(t, httpBucketScheme, b.BucketInfo().Scheme)
+
+			stacks, _, err := b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+			require.NoError(t, err)
+			require.Len(t, stacks, 1)
+			ref, err := b.parseStackReference("foo")
+			require.NoError(t, err)
+			chk, err := b.getCheckpoint(ctx, ref)
+			require.NoError(t, err)
+			assert.Len(t, chk.Latest.Resources, 2)
+
+			updates, err := b.ListUpdates(ctx, ref, nil)
+			require.NoError(t, err)
+			require.Len(t, updates, 2)
+			chk, err = b.GetCheckpointAt(ctx, ref, updates[1].ID)
+			require.NoError(t, err)
+			assert.Len(t, chk.Latest.Resources, 1)
+
+			// Writes are rejected.
+			_, _, err = b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 3))
+			assert.ErrorIs(t, err, ErrReadOnly)
+		})
+	}
+}
+
+func TestHTTPStore_missingIndex(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	_, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(dir), nil, nil)
+	require.NoError(t, err)
+	srv := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	t.Cleanup(srv.Close)
+
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "filestate+"+srv.URL, nil, nil)
+	require.NoError(t, err)
+	_, _, err = b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+	assert.ErrorContains(t, err, ".pulumi/index.json is missing")
+}
+
+func TestHTTPStore_mirror(t *testing.T) {
+	t.Parallel()
+
+	_, err := newLocalBackend(context.Background(), diagtest.LogSink(t),
+		"file://"+filepath.ToSlash(t.TempDir()), nil,
+		&localBackendOptions{MirrorURL: "filestate+https://example.com/state"})
+	assert.ErrorContains(t, err, "is read-only")
+}
+
+func TestHTTPBucket(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/root/.pulumi/index.json":
+			_, err := w.Write([]byte(`{"objects": [
+				{"key": "a/1", "size": 1},
+				{"key": "a/2", "size": 2},
+				{"key": "b", "size": 3},
+				{"key": "c/d/e", "size": 4}
+			]}`))
+			assert.NoError(t, err)
+		case "/root/b":
+			http.ServeContent(w, r, "b", time.Time{}, strings.NewReader("bbb"))
+		case "/root/secret":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL + "/root")
+	require.NoError(t, err)
+	b := &httpBucket{client: srv.Client(), base: u}
+
+	// Listings are paged through in order.
+	var keys []string
+	opts := &driver.ListOptions{Delimiter: "/", PageSize: 2}
+	for {
+		page, err := b.ListPaged(ctx, opts)
+		require.NoError(t, err)
+		for _, obj := range page.Objects {
+			keys = append(keys, obj.Key)
+		}
+		if page.NextPageToken == nil {
+			break
+		}
+		opts.PageToken = page.NextPageToken
+	}
+	assert.Equal(t, []string{"a/", "b", "c/"}, keys)
+
+	page, err := b.ListPaged(ctx, &driver.ListOptions{Prefix: "a/"})
+	require.NoError(t, err)
+	require.Len(t, page.Objects, 2)
+	assert.Equal(t, int64(2), page.Objects[1].Size)
+
+	r, err := b.NewRangeReader(ctx, "b", 1, -1, &driver.ReaderOptions{})
+	require.NoError(t, err)
+	byts, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, "bb", string(byts))
+	assert.Equal(t, int64(3), r.Attributes().Size)
+
+	_, err = b.NewRangeReader(ctx, "missing", 0, -1, &driver.ReaderOptions{})
+	assert.Equal(t, gcerrors.NotFound, b.ErrorCode(err))
+	_, err = b.Attributes(ctx, "secret")
+	assert.Equal(t, gcerrors.PermissionDenied, b.ErrorCode(err))
+	assert.Equal(t, gcerrors.PermissionDenied, b.ErrorCode(b.Delete(ctx, "b")))
+}
@@ -0,0 +1,232 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// ignoreFilePath returns the path of the file that lists patterns of objects
+// the backend skips when it lists the state store,
+// so that files of other tools in the bookkeeping directory aren't mistaken for its own.
+func ignoreFilePath() string {
+	return path.Join(workspace.BookkeepingDir, ".ignore")
+}
+
+// ignoreList is the set of patterns read from the ignore file.
+//
+// Each line of the file is a pattern, except for blank lines and lines starting with '#'.
+// Patterns are matched against keys relative to the bookkeeping directory,
+// e.g. "stacks/proj/dev.json", with the syntax of path.Match,
+// except that a "**" element matches any number of path elements, including none.
+// A pattern that matches a directory matches everything in it.
+// A pattern that ends in '/' only matches directories.
+type ignoreList struct {
+	// patterns holds the elements of each pattern.
+	patterns []ignorePattern
+}
+
+type ignorePattern struct {
+	elems []string
+	dir   bool
+}
+
+// parseIgnoreList parses the contents of the ignore file.
+func parseIgnoreList(byts []byte) (*ignoreList, error) {
+	var l ignoreList
+	scanner := bufio.NewScanner(bytes.NewReader(byts))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		p := ignorePattern{dir: strings.HasSuffix(text, "/")}
+		p.elems = strings.Split(strings.Trim(text, "/"), "/")
+		for _, elem := range p.elems {
+			if elem == "" {
+				return nil, fmt.Errorf("%v:%d: pattern %q has an empty path element", ignoreFilePath(), line, text)
+			}
+			if _, err := path.Match(elem, ""); err != nil {
+				return nil, fmt.Errorf("%v:%d: invalid pattern %q: %w", ignoreFilePath(), line, text, err)
+			}
+		}
+		l.patterns = append(l.patterns, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %v: %w", ignoreFilePath(), err)
+	}
+	return &l, nil
+}
+
+// match reports whether the object with the given key is ignored.
+// Keys of directories end in '/', as they do in listings made with a delimiter.
+// Keys outside the bookkeeping directory are never ignored.
+func (l *ignoreList) match(key string) bool {
+	prefix := workspace.BookkeepingDir + "/"
+	if !strings.HasPrefix(key, prefix) {
+		return false
+	}
+	rel := strings.TrimPrefix(key, prefix)
+	isDir := strings.HasSuffix(rel, "/")
+	elems := strings.Split(strings.TrimSuffix(rel, "/"), "/")
+	for _, p := range l.patterns {
+		// Match the object itself and each directory it's in.
+		for n := len(elems); n > 0; n-- {
+			if p.dir && n == len(elems) && !isDir {
+				continue
+			}
+			if matchElems(p.elems, elems[:n]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchElems reports whether the path elements match those of a pattern.
+func matchElems(pattern, elems []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// Try every number of elements for the "**", fewest first.
+			for i := 0; i <= len(elems); i++ {
+				if matchElems(pattern[1:], elems[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(elems) == 0 {
+			return false
+		}
+		// The pattern was validated when it was parsed.
+		if ok, _ := path.Match(pattern[0], elems[0]); !ok {
+			return false
+		}
+		pattern, elems = pattern[1:], elems[1:]
+	}
+	return len(elems) == 0
+}
+
+// applyIgnoreList reads the ignore file of the state store in b
+// and returns a Bucket that hides the objects it matches from listings.
+// b is returned as is if there's no ignore file.
+func applyIgnoreList(ctx context.Context, b Bucket) (Bucket, error) {
+	byts, err := b.ReadAll(ctx, ignoreFilePath())
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return b, nil
+		}
+		return nil, fmt.Errorf("read %v: %w", ignoreFilePath(), err)
+	}
+	l, err := parseIgnoreList(byts)
+	if err != nil {
+		return nil, err
+	}
+	return &ignoringBucket{Bucket: b, ignore: l}, nil
+}
+
+// ignoringBucket wraps a Bucket, hiding the objects matched by an ignoreList
+// from listings made with nextObject.
+// The objects can still be read and written directly.
+type ignoringBucket struct {
+	Bucket
+
+	ignore *ignoreList
+}
+
+var _ Bucket = (*ignoringBucket)(nil)
+
+func (b *ignoringBucket) operationTimeout() time.Duration {
+	return operationTimeout(b.Bucket)
+}
+
+func (b *ignoringBucket) ignoredKey(key string) bool {
+	return b.ignore.match(key)
+}
+
+func (b *ignoringBucket) DeleteBatch(ctx context.Context, keys []string) error {
+	return deleteBatch(ctx, b.Bucket, keys)
+}
+
+func (b *ignoringBucket) NewWriter(ctx context.Context, key string, opts *blob.WriterOptions) (io.WriteCloser, error) {
+	return newBucketWriter(ctx, b.Bucket, key, opts)
+}
+
+func (b *ignoringBucket) NewReader(ctx context.Context, key string) (io.ReadCloser, error) {
+	return newBucketReader(ctx, b.Bucket, key)
+}
+
+func (b *ignoringBucket) CopyIfVersion(ctx context.Context, dstKey, srcKey, version string) error {
+	return copyIfVersion(ctx, b.Bucket, dstKey, srcKey, version)
+}
+
+func (b *ignoringBucket) ObjectVersion(ctx context.Context, key string) (string, error) {
+	return objectVersion(ctx, b.Bucket, key)
+}
+
+func (b *ignoringBucket) RevisionsEnabled(ctx context.Context) (bool, error) {
+	return revisionsEnabled(ctx, b.Bucket)
+}
+
+func (b *ignoringBucket) ListRevisions(ctx context.Context, key string) ([]objectRevision, error) {
+	return listRevisions(ctx, b.Bucket, key)
+}
+
+func (b *ignoringBucket) ReadRevision(ctx context.Context, key, id string) ([]byte, error) {
+	return readRevision(ctx, b.Bucket, key, id)
+}
+
+// ListPage drops ignored objects from the page,
+// so pages may hold fewer objects than requested.
+func (b *ignoringBucket) ListPage(
+	ctx context.Context, pageToken []byte, pageSize int, opts *blob.ListOptions,
+) ([]*blob.ListObject, []byte, error) {
+	objs, next, err := listPage(ctx, b.Bucket, pageToken, pageSize, opts)
+	kept := objs[:0]
+	for _, obj := range objs {
+		if !b.ignore.match(obj.Key) {
+			kept = append(kept, obj)
+		}
+	}
+	return kept, next, err
+}
+
+// keyIgnorer is implemented by Buckets
+// that hide some of their objects from listings.
+type keyIgnorer interface {
+	ignoredKey(key string) bool
+}
+
+// ignoredKey reports whether the object with the given key
+// is hidden from listings of the given bucket.
+func ignoredKey(b Bucket, key string) bool {
+	if i, ok := b.(keyIgnorer); ok {
+		return i.ignoredKey(key)
+	}
+	return false
+}
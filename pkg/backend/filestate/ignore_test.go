@@ -0,0 +1,147 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+func TestIgnoreList_match(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc    string
+		give    string // pattern
+		key     string
+		matches bool
+	}{
+		{desc: "exact", give: "stacks/foo.json", key: ".pulumi/stacks/foo.json", matches: true},
+		{desc: "not relative to root", give: ".pulumi/stacks/foo.json", key: ".pulumi/stacks/foo.json"},
+		{desc: "leading slash", give: "/stacks/foo.json", key: ".pulumi/stacks/foo.json", matches: true},
+		{desc: "outside bookkeeping dir", give: "*", key: "stacks/foo.json"},
+		{desc: "star in element", give: "stacks/*.tmp", key: ".pulumi/stacks/foo.tmp", matches: true},
+		{desc: "star doesn't cross slash", give: "stacks/*.tmp", key: ".pulumi/stacks/proj/foo.tmp"},
+		{desc: "star matches dir", give: "stacks/*", key: ".pulumi/stacks/proj/foo.json", matches: true},
+		{desc: "question mark", give: "stacks/?.json", key: ".pulumi/stacks/a.json", matches: true},
+		{desc: "question mark one char", give: "stacks/?.json", key: ".pulumi/stacks/ab.json"},
+		{desc: "character class", give: "stacks/[a-c].json", key: ".pulumi/stacks/b.json", matches: true},
+		{desc: "negated class", give: "stacks/[^a-c].json", key: ".pulumi/stacks/b.json"},
+		{desc: "escaped star", give: `stacks/\*.json`, key: ".pulumi/stacks/*.json", matches: true},
+		{desc: "escaped star literal", give: `stacks/\*.json`, key: ".pulumi/stacks/a.json"},
+		{desc: "double star any depth", give: "**/*.tmp", key: ".pulumi/history/proj/a/b.tmp", matches: true},
+		{desc: "double star no depth", give: "**/x.tmp", key: ".pulumi/x.tmp", matches: true},
+		{desc: "double star middle", give: "stacks/**/x.json", key: ".pulumi/stacks/a/b/x.json", matches: true},
+		{desc: "double star middle none", give: "stacks/**/x.json", key: ".pulumi/stacks/x.json", matches: true},
+		{desc: "double star wrong dir", give: "stacks/**/x.json", key: ".pulumi/history/x.json"},
+		{desc: "trailing double star", give: "vendor/**", key: ".pulumi/vendor/a/b", matches: true},
+		{desc: "double star in element", give: "stacks/a**b", key: ".pulumi/stacks/axxb", matches: true},
+		{desc: "directory", give: "vendor", key: ".pulumi/vendor/a/b.json", matches: true},
+		{desc: "directory prefix only", give: "vendor", key: ".pulumi/vendored/a.json"},
+		{desc: "dir pattern dir", give: "vendor/", key: ".pulumi/vendor/a.json", matches: true},
+		{desc: "dir pattern listed dir", give: "vendor/", key: ".pulumi/vendor/", matches: true},
+		{desc: "dir pattern file", give: "vendor/", key: ".pulumi/vendor"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			l, err := parseIgnoreList([]byte(tt.give))
+			require.NoError(t, err)
+			assert.Equal(t, tt.matches, l.match(tt.key))
+		})
+	}
+}
+
+func TestParseIgnoreList(t *testing.T) {
+	t.Parallel()
+
+	l, err := parseIgnoreList([]byte("# comment\n\n  stacks/*.tmp  \r\nvendor/\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []ignorePattern{
+		{elems: []string{"stacks", "*.tmp"}},
+		{elems: []string{"vendor"}, dir: true},
+	}, l.patterns)
+
+	_, err = parseIgnoreList([]byte("ok\nstacks/[a-\n"))
+	assert.ErrorContains(t, err, `.pulumi/.ignore:2: invalid pattern "stacks/[a-"`)
+	_, err = parseIgnoreList([]byte("stacks//foo"))
+	assert.ErrorContains(t, err, `.pulumi/.ignore:1: pattern "stacks//foo" has an empty path element`)
+}
+
+func TestIgnoreFile(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	stateDir := t.TempDir()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+		&workspace.Project{Name: "proj"}, nil)
+	require.NoError(t, err)
+	ref, err := b.ParseStackReference("dev")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	// Another tool keeps files next to the stacks.
+	for key, body := range map[string]string{
+		".pulumi/stacks/proj/tool.json": "not a checkpoint",
+		".pulumi/history/tool/log.json": "{}",
+	} {
+		require.NoError(t, b.bucket.WriteAll(ctx, key, []byte(body), nil))
+	}
+
+	_, _, err = b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+	require.Error(t, err)
+	report, err := b.Verify(ctx, nil /* events */)
+	require.NoError(t, err)
+	require.True(t, report.HasErrors())
+
+	require.NoError(t, b.bucket.WriteAll(ctx, ignoreFilePath(), []byte("stacks/*/tool.json\nhistory/tool/\n"), nil))
+	b, err = newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+		&workspace.Project{Name: "proj"}, nil)
+	require.NoError(t, err)
+
+	stacks, _, err := b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+	require.NoError(t, err)
+	require.Len(t, stacks, 1)
+	assert.Equal(t, "dev", stacks[0].Name().String())
+
+	report, err = b.Verify(ctx, nil /* events */)
+	require.NoError(t, err)
+	assert.Empty(t, report.Problems)
+}
+
+func TestIgnoreFile_invalid(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(stateDir, ".pulumi"), 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(stateDir, ".pulumi", ".ignore"), []byte("[\n"), 0o600))
+
+	_, err := newLocalBackend(context.Background(), diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+		&workspace.Project{Name: "proj"}, nil)
+	assert.ErrorContains(t, err, `.pulumi/.ignore:1: invalid pattern "["`)
+}
@@ -0,0 +1,283 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/resource/stack"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+)
+
+// ImportMode decides how [Backend.ImportFrom] combines an imported deployment
+// with the current state of a stack.
+type ImportMode string
+
+const (
+	// ImportReplace replaces the checkpoint of the stack with the deployment.
+	// This is the default.
+	ImportReplace ImportMode = "replace"
+
+	// ImportMerge adds the resources of the deployment to the checkpoint of the stack,
+	// replacing those with the same URN and leaving the others as they are.
+	ImportMerge ImportMode = "merge"
+)
+
+// ImportOptions customizes the behavior of [Backend.ImportFrom].
+type ImportOptions struct {
+	// Mode decides how the deployment is combined with the current state of the stack.
+	// Defaults to ImportReplace.
+	Mode ImportMode
+}
+
+// ImportReport is the result of [Backend.ImportFrom].
+type ImportReport struct {
+	// Snapshot is the ID of the snapshot of the state of the stack before the import.
+	Snapshot SnapshotID `json:"snapshot"`
+
+	// Added lists the resources of a merged deployment that weren't in the stack.
+	Added []resource.URN `json:"added,omitempty"`
+
+	// Conflicts lists the resources of a merged deployment that were in the stack
+	// with other contents, and were replaced by the imported ones.
+	Conflicts []resource.URN `json:"conflicts,omitempty"`
+}
+
+func (b *localBackend) ImportFrom(
+	ctx context.Context, stackRef backend.StackReference, r io.Reader, opts *ImportOptions,
+) (_ *ImportReport, err error) {
+	ctx = withOperationID(ctx)
+	defer func() { err = operationError(ctx, err) }()
+
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+	mode := opts.Mode
+	switch mode {
+	case "":
+		mode = ImportReplace
+	case ImportReplace, ImportMerge:
+	default:
+		return nil, fmt.Errorf("unknown import mode %q", mode)
+	}
+
+	ref, err := b.getReference(stackRef)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	// Keep the deployment as it was read rather than re-serializing it
+	// so that fields unknown to this version of the CLI are preserved.
+	var deployment apitype.UntypedDeployment
+	if err := json.NewDecoder(r).Decode(&deployment); err != nil {
+		return nil, fmt.Errorf("read deployment: %w", err)
+	}
+	if err := checkDeploymentVersion(&deployment); err != nil {
+		return nil, err
+	}
+	if err := checkNotRedacted(&deployment); err != nil {
+		return nil, err
+	}
+	// Merged deployments may depend on resources of the stack,
+	// so they're only validated once they've been merged.
+	if mode == ImportReplace {
+		if err := validateImport(ctx, ref, &deployment); err != nil {
+			return nil, fmt.Errorf("invalid deployment: %w", err)
+		}
+	}
+	chk, err := stack.MarshalUntypedDeploymentToVersionedCheckpoint(ref.FullyQualifiedName(), &deployment)
+	if err != nil {
+		return nil, fmt.Errorf("invalid deployment: %w", err)
+	}
+
+	if err := b.Lock(ctx, stackRef); err != nil {
+		return nil, err
+	}
+	defer b.Unlock(ctx, stackRef)
+
+	var report ImportReport
+	if mode == ImportMerge {
+		// Merge with the state the lock protects,
+		// so that it's checked before anything is written.
+		if chk, err = b.mergeImport(ctx, ref, chk, &report); err != nil {
+			return nil, err
+		}
+	}
+
+	safety, err := b.snapshot(ctx, ref, nil /* progress */)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot current state: %w", err)
+	}
+	report.Snapshot = safety
+	b.sink(ctx).Infoerrf(diag.Message("", "Saved the current state of stack %v as snapshot %v"), ref, safety)
+
+	b.checkImportedStateStore(ctx, deployment.StateStore)
+
+	if _, _, err := b.saveCheckpoint(ctx, ref, chk); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// mergeImport merges the imported checkpoint chk into the current checkpoint of the given stack,
+// recording the resources it adds and replaces in report.
+//
+// Resources are matched by URN, and whether they're pending deletion,
+// since a resource pending deletion shares its URN with the one that replaced it.
+// Imported resources replace the ones they match in place,
+// and the others are added after the resources of the stack.
+// Pending operations are merged the same way.
+// The manifest of the stack is kept if it has been updated, and the merged deployment is validated again
+// because the imported resources may depend on, or be depended on by, resources of the stack.
+func (b *localBackend) mergeImport(
+	ctx context.Context, ref *localBackendReference, chk *apitype.VersionedCheckpoint, report *ImportReport,
+) (*apitype.VersionedCheckpoint, error) {
+	byts, err := json.Marshal(chk)
+	if err != nil {
+		return nil, err
+	}
+	imported, err := stack.UnmarshalVersionedCheckpointToLatestCheckpoint(encoding.JSON, byts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid deployment: %w", err)
+	}
+	current, err := b.getCheckpoint(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	merged, err := mergeDeployments(current.Latest, imported.Latest, report)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	deployment := apitype.UntypedDeployment{Version: apitype.DeploymentSchemaVersionCurrent, Deployment: raw}
+	if err := validateImport(ctx, ref, &deployment); err != nil {
+		return nil, fmt.Errorf("invalid merged deployment: %w", err)
+	}
+	return stack.MarshalUntypedDeploymentToVersionedCheckpoint(ref.FullyQualifiedName(), &deployment)
+}
+
+// mergeDeployments merges imported into current as described by mergeImport.
+// Either may be nil for stacks that have never been updated.
+func mergeDeployments(current, imported *apitype.DeploymentV3, report *ImportReport) (*apitype.DeploymentV3, error) {
+	if imported == nil {
+		imported = &apitype.DeploymentV3{}
+	}
+	if current == nil {
+		current = &apitype.DeploymentV3{Manifest: imported.Manifest}
+	}
+
+	// Secrets in the imported resources can only be decrypted with the provider they were encrypted with.
+	providers := current.SecretsProviders
+	switch {
+	case providers == nil:
+		providers = imported.SecretsProviders
+	case imported.SecretsProviders != nil &&
+		(providers.Type != imported.SecretsProviders.Type ||
+			!bytes.Equal(providers.State, imported.SecretsProviders.State)):
+		return nil, fmt.Errorf("cannot merge a deployment with secrets provider %q "+
+			"into a stack with another secrets provider configuration", imported.SecretsProviders.Type)
+	}
+
+	merged := &apitype.DeploymentV3{
+		Manifest:         current.Manifest,
+		SecretsProviders: providers,
+		Resources:        append([]apitype.ResourceV3(nil), current.Resources...),
+	}
+
+	index := make(map[resourceKey]int, len(merged.Resources))
+	for i, res := range merged.Resources {
+		key := resourceKey{res.URN, res.Delete}
+		if _, ok := index[key]; !ok {
+			index[key] = i
+		}
+	}
+	for _, res := range imported.Resources {
+		i, ok := index[resourceKey{res.URN, res.Delete}]
+		if !ok {
+			merged.Resources = append(merged.Resources, res)
+			report.Added = append(report.Added, res.URN)
+			continue
+		}
+		if !reflect.DeepEqual(merged.Resources[i], res) {
+			report.Conflicts = append(report.Conflicts, res.URN)
+		}
+		merged.Resources[i] = res
+	}
+
+	ops := make(map[resourceKey]struct{}, len(imported.PendingOperations))
+	for _, op := range imported.PendingOperations {
+		ops[resourceKey{op.Resource.URN, op.Resource.Delete}] = struct{}{}
+	}
+	for _, op := range current.PendingOperations {
+		if _, ok := ops[resourceKey{op.Resource.URN, op.Resource.Delete}]; !ok {
+			merged.PendingOperations = append(merged.PendingOperations, op)
+		}
+	}
+	merged.PendingOperations = append(merged.PendingOperations, imported.PendingOperations...)
+	return merged, nil
+}
+
+// checkDeploymentVersion returns an error if the schema version of the given deployment
+// isn't one this version of the CLI can manage,
+// so that it's refused before any of it is read or written,
+// rather than failing wherever its contents are first misunderstood.
+func checkDeploymentVersion(deployment *apitype.UntypedDeployment) error {
+	oldest, newest := stack.DeploymentSchemaVersionOldestSupported, apitype.DeploymentSchemaVersionCurrent
+	switch v := deployment.Version; {
+	case v > newest:
+		return fmt.Errorf("%w: the deployment has schema version %d, "+
+			"but this version of the Pulumi CLI supports versions %d to %d; "+
+			"upgrade the Pulumi CLI to import it", stack.ErrDeploymentSchemaVersionTooNew, v, oldest, newest)
+	case v < oldest:
+		return fmt.Errorf("%w: the deployment has schema version %d, "+
+			"but this version of the Pulumi CLI supports versions %d to %d",
+			stack.ErrDeploymentSchemaVersionTooOld, v, oldest, newest)
+	default:
+		return nil
+	}
+}
+
+// validateImport checks that the given deployment can be imported into the given stack:
+// it must be well-formed, internally consistent,
+// and contain only resources of that stack.
+func validateImport(ctx context.Context, ref *localBackendReference, deployment *apitype.UntypedDeployment) error {
+	snap, err := stack.DeserializeUntypedDeployment(ctx, deployment, stack.DefaultSecretsProvider)
+	if err != nil {
+		return err
+	}
+	for _, res := range snap.Resources {
+		if res.URN.Stack() != ref.name.Q() {
+			return fmt.Errorf("resource %v is from a different stack (%v != %v)",
+				res.URN, res.URN.Stack(), ref.name)
+		}
+	}
+	return snap.VerifyIntegrity()
+}
@@ -0,0 +1,327 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/pkg/v3/resource/stack"
+	"github.com/pulumi/pulumi/pkg/v3/secrets/b64"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+)
+
+// exportedDeployment returns a deployment with the given resources
+// as written by 'pulumi stack export'.
+func exportedDeployment(t *testing.T, urns ...string) []byte {
+	t.Helper()
+
+	resources := make([]apitype.ResourceV3, len(urns))
+	for i, urn := range urns {
+		resources[i] = apitype.ResourceV3{
+			URN:    resource.URN(urn),
+			Custom: true,
+			ID:     resource.ID(fmt.Sprintf("id-%d", i)),
+			Type:   "pkg:index:Res",
+		}
+	}
+	deployment, err := json.Marshal(apitype.DeploymentV3{Resources: resources})
+	require.NoError(t, err)
+	byts, err := json.Marshal(apitype.UntypedDeployment{
+		Version:    apitype.DeploymentSchemaVersionCurrent,
+		Deployment: deployment,
+	})
+	require.NoError(t, err)
+	return byts
+}
+
+func TestImportFrom(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, nil)
+	_, _, err := b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 1))
+	require.NoError(t, err)
+
+	report, err := b.ImportFrom(ctx, ref, bytes.NewReader(exportedDeployment(t,
+		"urn:pulumi:foo::proj::pkg:index:Res::a",
+		"urn:pulumi:foo::proj::pkg:index:Res::b",
+	)), nil /* opts */)
+	require.NoError(t, err)
+	id := report.Snapshot
+
+	chk, err := b.getCheckpoint(ctx, ref)
+	require.NoError(t, err)
+	assert.Len(t, chk.Latest.Resources, 2)
+
+	// The previous state was snapshotted.
+	assert.Equal(t, []SnapshotID{id}, snapshotIDs(t, b, ref))
+	require.NoError(t, b.Restore(ctx, ref, id))
+	chk, err = b.getCheckpoint(ctx, ref)
+	require.NoError(t, err)
+	assert.Len(t, chk.Latest.Resources, 1)
+}
+
+func TestImportFrom_invalid(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc    string
+		give    string
+		wantErr string
+	}{
+		{
+			desc:    "not json",
+			give:    "not json",
+			wantErr: "read deployment",
+		},
+		{
+			desc: "too new",
+			give: `{"version": 999, "deployment": {}}`,
+			wantErr: "deployment version is too new: the deployment has schema version 999, " +
+				"but this version of the Pulumi CLI supports versions 1 to 3",
+		},
+		{
+			desc:    "no version",
+			give:    `{"deployment": {}}`,
+			wantErr: "the deployment has schema version 0",
+		},
+		{
+			desc:    "other stack",
+			give:    string(exportedDeployment(t, "urn:pulumi:bar::proj::pkg:index:Res::a")),
+			wantErr: "is from a different stack",
+		},
+		{
+			desc: "duplicate resource",
+			give: string(exportedDeployment(t,
+				"urn:pulumi:foo::proj::pkg:index:Res::a",
+				"urn:pulumi:foo::proj::pkg:index:Res::a",
+			)),
+			wantErr: "invalid deployment",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			b, ref := newSnapshotBackend(t, nil)
+			before, err := b.bucket.ReadAll(ctx, b.stackPath(ctx, ref))
+			require.NoError(t, err)
+
+			_, err = b.ImportFrom(ctx, ref, strings.NewReader(tt.give), nil /* opts */)
+			assert.ErrorContains(t, err, tt.wantErr)
+
+			// Nothing was written.
+			after, err := b.bucket.ReadAll(ctx, b.stackPath(ctx, ref))
+			require.NoError(t, err)
+			assert.Equal(t, before, after)
+			assert.Empty(t, snapshotIDs(t, b, ref))
+		})
+	}
+}
+
+// Deployments with unsupported versions are refused before they're read,
+// however they're imported.
+func TestImport_unsupportedVersion(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, nil)
+	before, err := b.bucket.ReadAll(ctx, b.stackPath(ctx, ref))
+	require.NoError(t, err)
+
+	// The deployment of a future version may look nothing like today's.
+	give := `{"version": 4, "deployment": {"resources": "elsewhere"}}`
+	_, err = b.ImportFrom(ctx, ref, strings.NewReader(give), &ImportOptions{Mode: ImportMerge})
+	assert.ErrorIs(t, err, stack.ErrDeploymentSchemaVersionTooNew)
+	assert.ErrorContains(t, err, "schema version 4")
+
+	stk, err := b.GetStack(ctx, ref)
+	require.NoError(t, err)
+	err = b.ImportDeployment(ctx, stk, &apitype.UntypedDeployment{
+		Version:    4,
+		Deployment: json.RawMessage(`{"resources": "elsewhere"}`),
+	})
+	assert.ErrorIs(t, err, stack.ErrDeploymentSchemaVersionTooNew)
+	assert.ErrorContains(t, err, "upgrade the Pulumi CLI")
+
+	after, err := b.bucket.ReadAll(ctx, b.stackPath(ctx, ref))
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+	assert.Empty(t, snapshotIDs(t, b, ref))
+}
+
+func TestImportFrom_merge(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, nil)
+	_, _, err := b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 2))
+	require.NoError(t, err)
+	before, err := b.getCheckpoint(ctx, ref)
+	require.NoError(t, err)
+
+	// r1 is replaced, c is added, and r0 is left as it was.
+	report, err := b.ImportFrom(ctx, ref, bytes.NewReader(exportedDeployment(t,
+		"urn:pulumi:foo::proj::pkg:index:Res::r1",
+		"urn:pulumi:foo::proj::pkg:index:Res::c",
+	)), &ImportOptions{Mode: ImportMerge})
+	require.NoError(t, err)
+	assert.Equal(t, []resource.URN{"urn:pulumi:foo::proj::pkg:index:Res::c"}, report.Added)
+	assert.Equal(t, []resource.URN{"urn:pulumi:foo::proj::pkg:index:Res::r1"}, report.Conflicts)
+
+	chk, err := b.getCheckpoint(ctx, ref)
+	require.NoError(t, err)
+	require.Len(t, chk.Latest.Resources, 3)
+	assert.Equal(t, before.Latest.Resources[0], chk.Latest.Resources[0])
+	assert.Equal(t, resource.ID("id-0"), chk.Latest.Resources[1].ID)
+	assert.Equal(t, resource.URN("urn:pulumi:foo::proj::pkg:index:Res::c"), chk.Latest.Resources[2].URN)
+
+	// Importing the same resources again changes nothing.
+	report, err = b.ImportFrom(ctx, ref, bytes.NewReader(exportedDeployment(t,
+		"urn:pulumi:foo::proj::pkg:index:Res::r1",
+	)), &ImportOptions{Mode: ImportMerge})
+	require.NoError(t, err)
+	assert.Empty(t, report.Added)
+	assert.Empty(t, report.Conflicts)
+
+	// Merged resources may depend on those of the stack.
+	dependent, err := json.Marshal(apitype.DeploymentV3{Resources: []apitype.ResourceV3{{
+		URN:          "urn:pulumi:foo::proj::pkg:index:Res::d",
+		Custom:       true,
+		ID:           "id-d",
+		Type:         "pkg:index:Res",
+		Dependencies: []resource.URN{"urn:pulumi:foo::proj::pkg:index:Res::r0"},
+	}}})
+	require.NoError(t, err)
+	byts, err := json.Marshal(apitype.UntypedDeployment{
+		Version:    apitype.DeploymentSchemaVersionCurrent,
+		Deployment: dependent,
+	})
+	require.NoError(t, err)
+	report, err = b.ImportFrom(ctx, ref, bytes.NewReader(byts), &ImportOptions{Mode: ImportMerge})
+	require.NoError(t, err)
+	assert.Equal(t, []resource.URN{"urn:pulumi:foo::proj::pkg:index:Res::d"}, report.Added)
+
+	// Each import was snapshotted.
+	assert.Len(t, snapshotIDs(t, b, ref), 3)
+	require.NoError(t, b.Restore(ctx, ref, snapshotIDs(t, b, ref)[0]))
+	chk, err = b.getCheckpoint(ctx, ref)
+	require.NoError(t, err)
+	assert.Equal(t, before.Latest.Resources, chk.Latest.Resources)
+}
+
+func TestImportFrom_mergeInvalid(t *testing.T) {
+	t.Parallel()
+
+	withProviders := func(typ string) string {
+		deployment, err := json.Marshal(apitype.DeploymentV3{
+			SecretsProviders: &apitype.SecretsProvidersV1{Type: typ},
+		})
+		require.NoError(t, err)
+		byts, err := json.Marshal(apitype.UntypedDeployment{
+			Version:    apitype.DeploymentSchemaVersionCurrent,
+			Deployment: deployment,
+		})
+		require.NoError(t, err)
+		return string(byts)
+	}
+	dependent, err := json.Marshal(apitype.DeploymentV3{Resources: []apitype.ResourceV3{{
+		URN:          "urn:pulumi:foo::proj::pkg:index:Res::r0",
+		Custom:       true,
+		ID:           "id",
+		Type:         "pkg:index:Res",
+		Dependencies: []resource.URN{"urn:pulumi:foo::proj::pkg:index:Res::r1"},
+	}}})
+	require.NoError(t, err)
+	dependentDeployment, err := json.Marshal(apitype.UntypedDeployment{
+		Version:    apitype.DeploymentSchemaVersionCurrent,
+		Deployment: dependent,
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		desc    string
+		give    string
+		mode    ImportMode
+		wantErr string
+	}{
+		{
+			desc:    "unknown mode",
+			give:    string(exportedDeployment(t)),
+			mode:    "append",
+			wantErr: `unknown import mode "append"`,
+		},
+		{
+			desc:    "other secrets provider",
+			give:    withProviders("passphrase"),
+			mode:    ImportMerge,
+			wantErr: `cannot merge a deployment with secrets provider "passphrase"`,
+		},
+		{
+			desc:    "other stack",
+			give:    string(exportedDeployment(t, "urn:pulumi:bar::proj::pkg:index:Res::a")),
+			mode:    ImportMerge,
+			wantErr: "is from a different stack",
+		},
+		{
+			// r1 comes after r0 in the stack.
+			desc:    "dependency out of order",
+			give:    string(dependentDeployment),
+			mode:    ImportMerge,
+			wantErr: "invalid merged deployment",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			b, ref := newSnapshotBackend(t, nil)
+			chk := newTestCheckpoint(t, 2)
+			var withSecrets apitype.CheckpointV3
+			require.NoError(t, json.Unmarshal(chk.Checkpoint, &withSecrets))
+			withSecrets.Latest.SecretsProviders = &apitype.SecretsProvidersV1{Type: b64.Type}
+			chk.Checkpoint, err = json.Marshal(withSecrets)
+			require.NoError(t, err)
+			_, _, err := b.saveCheckpoint(ctx, ref, chk)
+			require.NoError(t, err)
+			before, err := b.bucket.ReadAll(ctx, b.stackPath(ctx, ref))
+			require.NoError(t, err)
+
+			_, err = b.ImportFrom(ctx, ref, strings.NewReader(tt.give), &ImportOptions{Mode: tt.mode})
+			assert.ErrorContains(t, err, tt.wantErr)
+
+			// Nothing was written.
+			after, err := b.bucket.ReadAll(ctx, b.stackPath(ctx, ref))
+			require.NoError(t, err)
+			assert.Equal(t, before, after)
+			assert.Empty(t, snapshotIDs(t, b, ref))
+		})
+	}
+}
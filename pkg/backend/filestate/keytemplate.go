@@ -0,0 +1,219 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
+)
+
+const (
+	// defaultKeyTemplate is the key template of project-scoped stores that don't record one.
+	defaultKeyTemplate = projectPlaceholder + "/" + stackPlaceholder
+
+	projectPlaceholder = "{project}"
+	stackPlaceholder   = "{stack}"
+)
+
+// defaultKeys is the parsed defaultKeyTemplate.
+var defaultKeys = func() *keyTemplate {
+	t, err := parseKeyTemplate(defaultKeyTemplate)
+	contract.AssertNoErrorf(err, "parse default key template")
+	return t
+}()
+
+// keyTemplate names the files of the stacks of a project-scoped store.
+//
+// A template is a relative path, e.g. "{project}/{stack}",
+// that a stack's files are kept at under the stacks, histories, backups, and locks directories:
+// the checkpoint of stack "dev" of project "app" is .pulumi/stacks/app/dev.json with the default template,
+// and its lock is in .pulumi/locks/organization/app/dev.
+//
+// To keep keys inside those directories and map them back to stacks unambiguously,
+// templates have one segment that contains "{project}" and a later one that contains "{stack}",
+// and are otherwise made of the characters allowed in stack names.
+type keyTemplate struct {
+	text     string
+	segments []string
+
+	// project and stack are the indexes of the segments with the placeholders.
+	project, stack int
+}
+
+// parseKeyTemplate parses and validates a key template.
+// An empty template is the default one.
+func parseKeyTemplate(text string) (*keyTemplate, error) {
+	if text == "" {
+		text = defaultKeyTemplate
+	}
+
+	t := keyTemplate{text: text, segments: strings.Split(text, "/"), project: -1, stack: -1}
+	for i, seg := range t.segments {
+		literal := seg
+		if strings.Contains(seg, projectPlaceholder) {
+			if t.project != -1 {
+				return nil, fmt.Errorf("key template %q must contain %v once", text, projectPlaceholder)
+			}
+			t.project = i
+			literal = strings.Replace(literal, projectPlaceholder, "", 1)
+		}
+		if strings.Contains(seg, stackPlaceholder) {
+			if t.stack != -1 {
+				return nil, fmt.Errorf("key template %q must contain %v once", text, stackPlaceholder)
+			}
+			t.stack = i
+			literal = strings.Replace(literal, stackPlaceholder, "", 1)
+		}
+
+		switch {
+		case seg == "" || seg == "." || seg == "..":
+			return nil, fmt.Errorf("key template %q must be a relative path without empty, %q, or %q segments",
+				text, ".", "..")
+		case strings.Contains(seg, projectPlaceholder) && strings.Contains(seg, stackPlaceholder):
+			return nil, fmt.Errorf("key template %q must have %v and %v in separate segments",
+				text, projectPlaceholder, stackPlaceholder)
+		case literal != "" && !tokens.IsName(literal):
+			return nil, fmt.Errorf("key template %q may only contain alphanumerics, hyphens, underscores, and periods "+
+				"besides %v, %v, and path separators", text, projectPlaceholder, stackPlaceholder)
+		}
+	}
+
+	switch {
+	case t.project == -1 || t.stack == -1:
+		return nil, fmt.Errorf("key template %q must contain %v and %v", text, projectPlaceholder, stackPlaceholder)
+	case t.stack < t.project:
+		return nil, fmt.Errorf("key template %q must have %v before %v", text, projectPlaceholder, stackPlaceholder)
+	}
+	return &t, nil
+}
+
+// String returns the text of the template.
+func (t *keyTemplate) String() string {
+	return t.text
+}
+
+// isDefault reports whether the template names files like stores without a key template.
+func (t *keyTemplate) isDefault() bool {
+	return t.text == defaultKeyTemplate
+}
+
+// path returns the path of the files of the given stack relative to the directories that hold them.
+func (t *keyTemplate) path(project, stack tokens.Name) string {
+	segs := make([]string, len(t.segments))
+	copy(segs, t.segments)
+	segs[t.project] = strings.Replace(segs[t.project], projectPlaceholder, namePath("project", project), 1)
+	segs[t.stack] = strings.Replace(segs[t.stack], stackPlaceholder, namePath("stack", stack), 1)
+	return strings.Join(segs, "/")
+}
+
+// parse returns the project and stack whose files are at the given path
+// relative to the directories that hold them,
+// or false if the path doesn't match the template.
+func (t *keyTemplate) parse(rel string) (project, stack tokens.Name, ok bool) {
+	segs := strings.Split(rel, "/")
+	if len(segs) != len(t.segments) {
+		return "", "", false
+	}
+	for i, seg := range segs {
+		switch i {
+		case t.project:
+			if project, ok = t.projectName(seg); !ok {
+				return "", "", false
+			}
+		case t.stack:
+			name, ok := matchPlaceholder(t.segments[i], stackPlaceholder, seg)
+			if !ok || !tokens.IsName(name) || validateNamePath("stack", tokens.Name(name)) != nil {
+				return "", "", false
+			}
+			stack = tokens.Name(name)
+		default:
+			if seg != t.segments[i] {
+				return "", "", false
+			}
+		}
+	}
+	return project, stack, true
+}
+
+// projectsDir returns the path of the directory whose entries are named after projects,
+// relative to the directories that hold the files of stacks.
+// It's "" if the entries are directly in those directories.
+func (t *keyTemplate) projectsDir() string {
+	return strings.Join(t.segments[:t.project], "/")
+}
+
+// projectDir returns the path of the directory that holds the files of the stacks of a project
+// relative to the directories that hold the files of stacks.
+func (t *keyTemplate) projectDir(project tokens.Name) string {
+	return path.Join(t.projectsDir(),
+		strings.Replace(t.segments[t.project], projectPlaceholder, namePath("project", project), 1))
+}
+
+// projectName returns the project whose stacks are in the entry of projectsDir with the given name,
+// or false if the entry doesn't belong to a project.
+func (t *keyTemplate) projectName(entry string) (tokens.Name, bool) {
+	name, ok := matchPlaceholder(t.segments[t.project], projectPlaceholder, entry)
+	if !ok || !tokens.IsName(name) || validateNamePath("project", tokens.Name(name)) != nil {
+		return "", false
+	}
+	return tokens.Name(name), true
+}
+
+// stackLockDir returns the directory that holds the locks of the given stack.
+//
+// Locks of project-scoped stacks are keyed by their fully qualified names,
+// so the template applies below the directory of the organization.
+func (t *keyTemplate) stackLockDir(stack tokens.QName) string {
+	parts := strings.Split(string(stack), "/")
+	if t == nil || t.isDefault() || len(parts) != 3 {
+		return stackLockDir(stack)
+	}
+	return path.Join(lockDir(), parts[0], t.path(tokens.Name(parts[1]), tokens.Name(parts[2])))
+}
+
+// lockedStack returns the stack whose locks are in the given directory relative to the locks directory.
+// It's the inverse of stackLockDir.
+func (t *keyTemplate) lockedStack(dir string) tokens.QName {
+	if t == nil || t.isDefault() {
+		return tokens.QName(dir)
+	}
+	org, rel, ok := strings.Cut(dir, "/")
+	if !ok {
+		return tokens.QName(dir)
+	}
+	project, stack, ok := t.parse(rel)
+	if !ok {
+		return tokens.QName(dir)
+	}
+	return tokens.QName(org + "/" + string(project) + "/" + string(stack))
+}
+
+// matchPlaceholder returns the value of the placeholder in the given template segment
+// that makes it seg, or false if there isn't one.
+func matchPlaceholder(segment, placeholder, seg string) (string, bool) {
+	prefix, suffix, _ := strings.Cut(segment, placeholder)
+	if len(seg) <= len(prefix)+len(suffix) || !strings.HasPrefix(seg, prefix) || !strings.HasSuffix(seg, suffix) {
+		return "", false
+	}
+	return seg[len(prefix) : len(seg)-len(suffix)], true
+}
+
+// errKeyTemplateLegacy is returned when a key template is configured for a store with the legacy layout.
+var errKeyTemplateLegacy = errors.New("key templates are only supported by state stores with project-scoped stacks")
@@ -0,0 +1,251 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob/fileblob"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+func TestParseKeyTemplate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		give    string
+		wantErr string
+	}{
+		{give: ""},
+		{give: "{project}/{stack}"},
+		{give: "compliance/{project}/env-{stack}"},
+		{give: "p-{project}.x/stacks/{stack}/state"},
+		{give: "{project}", wantErr: "must contain {project} and {stack}"},
+		{give: "{stack}/{project}", wantErr: "must have {project} before {stack}"},
+		{give: "{project}-{stack}", wantErr: "in separate segments"},
+		{give: "{project}/{stack}/{stack}", wantErr: "must contain {stack} once"},
+		{give: "/{project}/{stack}", wantErr: "must be a relative path"},
+		{give: "{project}//{stack}", wantErr: "must be a relative path"},
+		{give: "../{project}/{stack}", wantErr: "must be a relative path"},
+		{give: "{project}/$/{stack}", wantErr: "may only contain"},
+		{give: `{project}/a\b/{stack}`, wantErr: "may only contain"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.give, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := parseKeyTemplate(tt.give)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestKeyTemplate(t *testing.T) {
+	t.Parallel()
+
+	keys, err := parseKeyTemplate("compliance/p-{project}/env-{stack}.state")
+	require.NoError(t, err)
+	assert.Equal(t, "compliance/p-app/env-dev.state", keys.path("app", "dev"))
+	assert.Equal(t, "compliance", keys.projectsDir())
+	assert.Equal(t, "compliance/p-app", keys.projectDir("app"))
+
+	project, stack, ok := keys.parse("compliance/p-app/env-dev.state")
+	assert.True(t, ok)
+	assert.Equal(t, tokens.Name("app"), project)
+	assert.Equal(t, tokens.Name("dev"), stack)
+	for _, rel := range []string{
+		"compliance/p-app/dev.state",
+		"compliance/app/env-dev.state",
+		"other/p-app/env-dev.state",
+		"compliance/p-app/env-.state",
+		"compliance/p-app/env-dev.state/x",
+		"p-app/env-dev.state",
+	} {
+		_, _, ok := keys.parse(rel)
+		assert.False(t, ok, rel)
+	}
+
+	dir := keys.stackLockDir("organization/app/dev")
+	assert.Equal(t, ".pulumi/locks/organization/compliance/p-app/env-dev.state", dir)
+	assert.Equal(t, tokens.QName("organization/app/dev"),
+		keys.lockedStack("organization/compliance/p-app/env-dev.state"))
+
+	// The default template names files like stores always have.
+	assert.Equal(t, "app/dev", defaultKeys.path("app", "dev"))
+	assert.Equal(t, stackLockDir("organization/app/dev"), defaultKeys.stackLockDir("organization/app/dev"))
+	assert.Equal(t, stackLockDir("dev"), keys.stackLockDir("dev"))
+}
+
+func TestKeyTemplate_backend(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	url := "file://" + filepath.ToSlash(t.TempDir())
+	env := map[string]string{PulumiFilestateKeyTemplateEnvVar: "compliance/{project}/env-{stack}"}
+	open := func(env map[string]string) (*localBackend, error) {
+		return newLocalBackend(ctx, diagtest.LogSink(t), url,
+			&workspace.Project{Name: "proj"}, &localBackendOptions{Getenv: mapGetenv(env)})
+	}
+
+	b, err := open(env)
+	require.NoError(t, err)
+	assert.Equal(t, "compliance/{project}/env-{stack}", b.meta.KeyTemplate)
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+	_, _, err = b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 1))
+	require.NoError(t, err)
+	require.NoError(t, b.backupStack(ctx, ref))
+	assert.Equal(t, []string{
+		".pulumi/stacks/compliance/proj/env-foo.json",
+		".pulumi/stacks/compliance/proj/env-foo.json.bak",
+		".pulumi/stacks/compliance/proj/env-foo.meta",
+	}, listKeys(t, b.bucket, ".pulumi/stacks"))
+	assert.Len(t, listKeys(t, b.bucket, ".pulumi/backups/compliance/proj/env-foo"), 1)
+
+	require.NoError(t, b.Lock(ctx, ref))
+	assert.Len(t, listKeys(t, b.bucket, ".pulumi/locks/organization/compliance/proj/env-foo"), 1)
+	locks, err := b.ListLocks(ctx)
+	require.NoError(t, err)
+	require.Len(t, locks, 1)
+	assert.Equal(t, tokens.QName("organization/proj/foo"), locks[0].Stack)
+	b.Unlock(ctx, ref)
+
+	// The template is recorded in the store.
+	b, err = open(nil)
+	require.NoError(t, err)
+	stacks, _, err := b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+	require.NoError(t, err)
+	require.Len(t, stacks, 1)
+	assert.Equal(t, "organization/proj/foo", stacks[0].Name().FullyQualifiedName().String())
+	projects, err := b.ListProjects(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []tokens.Name{"proj"}, projects)
+	chk, err := b.getCheckpoint(ctx, ref)
+	require.NoError(t, err)
+	assert.Len(t, chk.Latest.Resources, 1)
+
+	report, err := b.Verify(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Stacks)
+	assert.Empty(t, report.Problems)
+	gc, err := b.GC(ctx, GCOptions{DryRun: true, MinAge: -1})
+	require.NoError(t, err)
+	assert.Empty(t, gc.Files)
+
+	// It can't be changed.
+	_, err = open(map[string]string{PulumiFilestateKeyTemplateEnvVar: "{project}/{stack}"})
+	assert.ErrorContains(t, err, "the key template can only be set for new state stores")
+}
+
+// Legacy stacks are upgraded to the files named by the key template of the store.
+func TestKeyTemplate_upgrade(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	stateDir := t.TempDir()
+	bucket, err := fileblob.OpenBucket(stateDir, nil)
+	require.NoError(t, err)
+	writeFiles(t, bucket, map[string]string{
+		".pulumi/meta.yaml":       "version: 0\nkeytemplate: compliance/{project}/env-{stack}\n",
+		".pulumi/stacks/foo.json": legacyCheckpoint,
+	})
+	open := func() *localBackend {
+		b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+			&workspace.Project{Name: "proj"}, nil)
+		require.NoError(t, err)
+		return b
+	}
+
+	b := open()
+	require.NoError(t, b.Upgrade(ctx))
+	assert.Equal(t, []string{
+		".pulumi/stacks/compliance/proj/env-foo.json",
+		".pulumi/stacks/foo.json.bak",
+	}, listKeys(t, b.bucket, ".pulumi/stacks"))
+
+	b = open()
+	assert.Equal(t, "compliance/{project}/env-{stack}", b.meta.KeyTemplate)
+	stacks, _, err := b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+	require.NoError(t, err)
+	require.Len(t, stacks, 1)
+	assert.Equal(t, "organization/proj/foo", stacks[0].Name().FullyQualifiedName().String())
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	chk, err := b.getCheckpoint(ctx, ref)
+	require.NoError(t, err)
+	assert.Len(t, chk.Latest.Resources, 1)
+}
+
+// Migrations move legacy stacks to the files named by the key template of the store,
+// and keep the template in the new metadata file.
+func TestKeyTemplate_migrate(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	stateDir := t.TempDir()
+	bucket, err := fileblob.OpenBucket(stateDir, nil)
+	require.NoError(t, err)
+	writeFiles(t, bucket, map[string]string{
+		".pulumi/meta.yaml":       "version: 0\nkeytemplate: compliance/{project}/env-{stack}\n",
+		".pulumi/stacks/foo.json": legacyCheckpoint,
+	})
+
+	_, err = Migrate(ctx, bucket, nil)
+	require.NoError(t, err)
+	assertExists(t, bucket, ".pulumi/stacks/compliance/proj/env-foo.json")
+	assertNotExists(t, bucket, ".pulumi/stacks/foo.json")
+
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+		&workspace.Project{Name: "proj"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1, b.meta.Version)
+	assert.Equal(t, "compliance/{project}/env-{stack}", b.meta.KeyTemplate)
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	chk, err := b.getCheckpoint(ctx, ref)
+	require.NoError(t, err)
+	assert.Len(t, chk.Latest.Resources, 1)
+}
+
+func TestKeyTemplate_defaultNotRecorded(t *testing.T) {
+	t.Parallel()
+
+	b, ref := newSnapshotBackend(t, map[string]string{PulumiFilestateKeyTemplateEnvVar: "{project}/{stack}"})
+	assert.Empty(t, b.meta.KeyTemplate)
+	assert.Equal(t, ".pulumi/stacks/proj/foo.json", b.stackPath(context.Background(), ref))
+
+	_, err := newLocalBackend(context.Background(), diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"}, &localBackendOptions{Getenv: mapGetenv(map[string]string{
+			PulumiFilestateKeyTemplateEnvVar:  "{project}/{stack}",
+			PulumiFilestateLegacyLayoutEnvVar: "true",
+		})})
+	assert.ErrorIs(t, err, errKeyTemplateLegacy)
+}
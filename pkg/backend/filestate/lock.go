@@ -19,48 +19,146 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/user"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/fsutil"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
 )
 
-type lockContent struct {
+// LockInfo describes the owner of a stack lock.
+type LockInfo struct {
 	Pid       int       `json:"pid"`
 	Username  string    `json:"username"`
 	Hostname  string    `json:"hostname"`
 	Timestamp time.Time `json:"timestamp"`
+
+	// OperationID is the correlation ID of the operation that holds the lock, if any.
+	OperationID string `json:"operationID,omitempty"`
+
+	// Location describes where the lock is kept for messages,
+	// e.g. the URL of the lock file.
+	// It's not part of the contents of the lock.
+	Location string `json:"-"`
+
+	// Stack is the fully qualified name of the locked stack.
+	// It's only set by [Backend.ListLocks].
+	Stack tokens.QName `json:"-"`
+
+	// Stale reports whether the lock is older than the stale lock TTL
+	// (PULUMI_SELF_MANAGED_STATE_LOCK_TTL),
+	// so that it will be reclaimed by the next process that locks the stack.
+	// It's only set by [Backend.ListLocks], for locks kept in the state store.
+	Stale bool `json:"-"`
 }
 
-func newLockContent() (*lockContent, error) {
+// Age returns how long before now the lock was acquired.
+func (l LockInfo) Age(now time.Time) time.Duration {
+	return now.Sub(l.Timestamp)
+}
+
+// newLockInfo returns the owner of a lock acquired by this process at the given time.
+func newLockInfo(now time.Time) (LockInfo, error) {
 	u, err := user.Current()
 	if err != nil {
-		return nil, err
+		return LockInfo{}, err
 	}
 	hostname, err := os.Hostname()
 	if err != nil {
-		return nil, err
+		return LockInfo{}, err
 	}
-	return &lockContent{
+	return LockInfo{
 		Pid:       os.Getpid(),
 		Username:  u.Username,
 		Hostname:  hostname,
-		Timestamp: time.Now(),
+		Timestamp: now,
 	}, nil
 }
 
+// Locker keeps the locks that prevent concurrent operations on the same stack.
+//
+// By default, locks are files in the state store.
+// Storage providers that are only eventually consistent
+// may not reliably detect concurrent locks that way,
+// so a Locker backed by a strongly consistent service like DynamoDB or Redis
+// can be used instead with Options.Locker.
+//
+// Stacks are identified by their fully qualified names.
+// Implementations must be safe for concurrent use.
+type Locker interface {
+	// Lock acquires a lock on the given stack on behalf of owner.
+	// It fails if the stack is already locked by anyone else.
+	Lock(ctx context.Context, stack tokens.QName, owner LockInfo) error
+
+	// Unlock releases the lock acquired on the given stack with Lock.
+	Unlock(ctx context.Context, stack tokens.QName) error
+
+	// Locks returns all locks held on the given stack.
+	Locks(ctx context.Context, stack tokens.QName) ([]LockInfo, error)
+
+	// BreakLocks releases all locks held on the given stack, regardless of their owner.
+	// It succeeds if the stack isn't locked.
+	BreakLocks(ctx context.Context, stack tokens.QName) error
+}
+
+// blobLocker is the default Locker.
+// It keeps locks as files in the locks directory of the state store,
+// one per stack and backend instance.
+type blobLocker struct {
+	bucket Bucket
+	url    string // URL of the state store, for messages
+
+	// id identifies the locks held by this backend instance.
+	id string
+
+	// held tracks the stacks locked by this backend instance.
+	// Lock files don't exclude each other if they have the same id,
+	// so held excludes concurrent operations that share the backend.
+	// Only the operation holding a stack releases it, even if its lock file is broken,
+	// because that operation is still running.
+	held heldLocks
+
+	// ttl is the age after which locks held by other processes
+	// are considered stale and are reclaimed.
+	// Locks never go stale if this is zero.
+	ttl time.Duration
+
+	// clock tells the age of locks.
+	clock clock
+
+	// keys names the lock directories of project-scoped stacks.
+	// It's replaced when the layout of the store changes, and nil for the default layout.
+	keys atomic.Pointer[keyTemplate]
+
+	d diag.Sink
+}
+
+var _ Locker = (*blobLocker)(nil)
+
+// stackLockDir returns the directory that holds the locks of the given stack.
+func (l *blobLocker) stackLockDir(stack tokens.QName) string {
+	return l.keys.Load().stackLockDir(stack)
+}
+
 // checkForLock looks for any existing locks for this stack, and returns a helpful diagnostic if there is one.
-func (b *localBackend) checkForLock(ctx context.Context, stackRef backend.StackReference) error {
-	stackName := stackRef.FullyQualifiedName()
-	allFiles, err := listBucket(ctx, b.bucket, stackLockDir(stackName))
+func (l *blobLocker) checkForLock(ctx context.Context, stack tokens.QName) error {
+	allFiles, err := listBucket(ctx, l.bucket, l.stackLockDir(stack))
 	if err != nil {
 		return err
 	}
@@ -68,82 +166,499 @@ func (b *localBackend) checkForLock(ctx context.Context, stackRef backend.StackR
 	// lockPath may return a path with backslashes (\) on Windows.
 	// We need to convert it to a slash path (/) to compare it to
 	// the keys in the bucket which are always slash paths.
-	wantLock := filepath.ToSlash(b.lockPath(stackRef))
-	var lockKeys []string
+	wantLock := filepath.ToSlash(l.lockPath(stack))
+	var locks []LockInfo
 	for _, file := range allFiles {
 		if file.IsDir {
 			continue
 		}
-		if file.Key != wantLock {
-			lockKeys = append(lockKeys, file.Key)
+		if file.Key == wantLock {
+			continue
 		}
-	}
 
-	if len(lockKeys) > 0 {
-		errorString := fmt.Sprintf("the stack is currently locked by %v lock(s). Either wait for the other "+
-			"process(es) to end or delete the lock file with `pulumi cancel`.", len(lockKeys))
+		content, err := l.bucket.ReadAll(ctx, file.Key)
+		if err != nil {
+			return err
+		}
+		info := LockInfo{}
+		err = json.Unmarshal(content, &info)
+		if err != nil {
+			return err
+		}
 
-		for _, lock := range lockKeys {
-			content, err := b.bucket.ReadAll(ctx, lock)
-			if err != nil {
-				return err
-			}
-			l := &lockContent{}
-			err = json.Unmarshal(content, &l)
-			if err != nil {
-				return err
+		if l.ttl > 0 && info.Age(l.clock.Now()) > l.ttl {
+			// The lock is older than the configured TTL.
+			// Assume its owner is gone and reclaim it.
+			if err := l.bucket.Delete(ctx, file.Key); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+				return fmt.Errorf("reclaiming stale lock %v: %w", file.Key, err)
 			}
+			newOperationSink(ctx, l.d).Warningf(diag.Message("", "Reclaimed stale lock %v created by %v@%v (pid %v) at %v"),
+				l.url+"/"+file.Key,
+				info.Username,
+				info.Hostname,
+				info.Pid,
+				info.Timestamp.Format(time.RFC3339))
+			continue
+		}
 
-			errorString += fmt.Sprintf("\n  %v: created by %v@%v (pid %v) at %v",
-				b.url+"/"+lock,
-				l.Username,
-				l.Hostname,
-				l.Pid,
-				l.Timestamp.Format(time.RFC3339),
-			)
+		info.Location = l.url + "/" + file.Key
+		locks = append(locks, info)
+	}
+
+	if len(locks) > 0 {
+		return &LockConflictError{Locks: locks}
+	}
+	return nil
+}
+
+// LockConflictError is returned when a stack can't be locked
+// because others hold locks on it.
+//
+// Lockers may return it too, to have the conflict resolved by Options.OnLockConflict.
+type LockConflictError struct {
+	// Locks are the locks held on the stack.
+	Locks []LockInfo
+}
+
+func (e *LockConflictError) Error() string {
+	errorString := fmt.Sprintf("the stack is currently locked by %v lock(s). Either wait for the other "+
+		"process(es) to end or delete the lock file with `pulumi cancel`.", len(e.Locks))
+
+	for _, info := range e.Locks {
+		errorString += fmt.Sprintf("\n  %v: created by %v@%v (pid %v) at %v",
+			info.Location,
+			info.Username,
+			info.Hostname,
+			info.Pid,
+			info.Timestamp.Format(time.RFC3339),
+		)
+		if info.OperationID != "" {
+			errorString += fmt.Sprintf(" (operation %v)", info.OperationID)
 		}
+	}
+	return errorString
+}
 
-		return errors.New(errorString)
+// LockConflictAction is what to do about a lock held by someone else
+// on a stack that an operation needs to lock.
+// It's decided by Options.OnLockConflict.
+type LockConflictAction string
+
+const (
+	// LockConflictAbort fails the operation with a LockConflictError,
+	// as if Options.OnLockConflict weren't set.
+	// Unknown actions abort too.
+	LockConflictAbort LockConflictAction = "abort"
+
+	// LockConflictWait waits a little for the lock to be released,
+	// then tries to lock the stack again.
+	LockConflictWait LockConflictAction = "wait"
+
+	// LockConflictBreak breaks the locks on the stack like [Backend.BreakLock],
+	// then tries to lock the stack again.
+	LockConflictBreak LockConflictAction = "break"
+)
+
+func (l *blobLocker) Lock(ctx context.Context, stack tokens.QName, owner LockInfo) error {
+	if err := l.held.acquire(stack); err != nil {
+		return err
+	}
+	if err := l.lock(ctx, stack, owner); err != nil {
+		l.held.release(stack)
+		return err
 	}
 	return nil
 }
 
-func (b *localBackend) Lock(ctx context.Context, stackRef backend.StackReference) error {
-	//
-	err := b.checkForLock(ctx, stackRef)
+func (l *blobLocker) lock(ctx context.Context, stack tokens.QName, owner LockInfo) error {
+	err := l.checkForLock(ctx, stack)
 	if err != nil {
 		return err
 	}
-	lockContent, err := newLockContent()
+	content, err := json.Marshal(owner)
 	if err != nil {
 		return err
 	}
-	content, err := json.Marshal(lockContent)
+	err = l.bucket.WriteAll(ctx, l.lockPath(stack), content, nil)
 	if err != nil {
 		return err
 	}
-	err = b.bucket.WriteAll(ctx, b.lockPath(stackRef), content, nil)
+	// Another process may have written its lock concurrently.
+	err = l.checkForLock(ctx, stack)
 	if err != nil {
+		if uerr := l.Unlock(ctx, stack); uerr != nil {
+			return errors.Join(err, uerr)
+		}
 		return err
 	}
-	err = b.checkForLock(ctx, stackRef)
+	return nil
+}
+
+func (l *blobLocker) Unlock(ctx context.Context, stack tokens.QName) error {
+	defer l.held.release(stack)
+	if err := l.bucket.Delete(ctx, l.lockPath(stack)); err != nil {
+		return fmt.Errorf("delete lock %v: %w", path.Join(l.url, l.lockPath(stack)), err)
+	}
+	return nil
+}
+
+func (l *blobLocker) Locks(ctx context.Context, stack tokens.QName) ([]LockInfo, error) {
+	allFiles, err := listBucket(ctx, l.bucket, l.stackLockDir(stack))
 	if err != nil {
-		b.Unlock(ctx, stackRef)
+		return nil, err
+	}
+
+	var locks []LockInfo
+	for _, file := range allFiles {
+		if file.IsDir {
+			continue
+		}
+
+		content, err := l.bucket.ReadAll(ctx, file.Key)
+		if err != nil {
+			return nil, fmt.Errorf("read lock %v: %w", file.Key, err)
+		}
+		var info LockInfo
+		if err := json.Unmarshal(content, &info); err != nil {
+			return nil, fmt.Errorf("malformed lock file %v: %w", l.url+"/"+file.Key, err)
+		}
+		info.Location = l.url + "/" + file.Key
+		locks = append(locks, info)
+	}
+	return locks, nil
+}
+
+// listLocks returns the locks held on all stacks.
+// Lock files that can't be read are skipped with a warning.
+func (l *blobLocker) listLocks(ctx context.Context) ([]LockInfo, error) {
+	dir := lockDir() + "/"
+	iter := l.bucket.List(&blob.ListOptions{Prefix: dir})
+	var locks []LockInfo
+	for {
+		file, err := nextObject(ctx, l.bucket, iter)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("list locks: %w", err)
+		}
+
+		// Lock files are named after the backend instance
+		// in a directory named after the stack.
+		stackDir := path.Dir(strings.TrimPrefix(file.Key, dir))
+		if stackDir == "." || path.Ext(file.Key) != ".json" {
+			continue
+		}
+
+		content, err := l.bucket.ReadAll(ctx, file.Key)
+		if err != nil {
+			if gcerrors.Code(err) == gcerrors.NotFound {
+				// The lock was released since it was listed.
+				continue
+			}
+			return nil, fmt.Errorf("read lock %v: %w", file.Key, err)
+		}
+		var info LockInfo
+		if err := json.Unmarshal(content, &info); err != nil {
+			l.d.Warningf(diag.Message("", "Skipping malformed lock file %v: %v"), l.url+"/"+file.Key, err)
+			continue
+		}
+		info.Location = l.url + "/" + file.Key
+		info.Stack = l.keys.Load().lockedStack(stackDir)
+		info.Stale = l.ttl > 0 && info.Age(l.clock.Now()) > l.ttl
+		locks = append(locks, info)
+	}
+	return locks, nil
+}
+
+func (l *blobLocker) BreakLocks(ctx context.Context, stack tokens.QName) error {
+	// Try to delete ALL the lock files
+	allFiles, err := listBucket(ctx, l.bucket, l.stackLockDir(stack))
+	if err != nil {
+		// Don't error if it just wasn't found
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil
+		}
 		return err
 	}
+
+	for _, file := range allFiles {
+		if file.IsDir {
+			continue
+		}
+
+		err := l.bucket.Delete(ctx, file.Key)
+		if err != nil {
+			// Race condition, don't error if the file was delete between us calling list and now
+			if gcerrors.Code(err) == gcerrors.NotFound {
+				continue
+			}
+			return err
+		}
+	}
 	return nil
 }
 
-func (b *localBackend) Unlock(ctx context.Context, stackRef backend.StackReference) {
-	err := b.bucket.Delete(ctx, b.lockPath(stackRef))
+// heldLocks tracks the stacks locked by a backend instance.
+type heldLocks struct {
+	mu     sync.Mutex
+	stacks map[tokens.QName]struct{}
+}
+
+// acquire marks the given stack as locked.
+// It fails if the stack is already locked.
+func (h *heldLocks) acquire(stack tokens.QName) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.stacks[stack]; ok {
+		return errors.New("the stack is currently locked by another operation of this process")
+	}
+	if h.stacks == nil {
+		h.stacks = make(map[tokens.QName]struct{})
+	}
+	h.stacks[stack] = struct{}{}
+	return nil
+}
+
+// release marks the given stack as unlocked.
+func (h *heldLocks) release(stack tokens.QName) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.stacks, stack)
+}
+
+func (l *blobLocker) lockPath(stack tokens.QName) string {
+	return path.Join(l.stackLockDir(stack), l.id+".json")
+}
+
+func (b *localBackend) Lock(ctx context.Context, stackRef backend.StackReference) error {
+	return b.lock(ctx, stackRef, b.onLockConflict)
+}
+
+// lock locks the given stack like Lock,
+// asking onConflict what to do if it's locked by others.
+// Without onConflict, it fails with a [LockConflictError] instead.
+func (b *localBackend) lock(
+	ctx context.Context, stackRef backend.StackReference, onConflict func(LockInfo) LockConflictAction,
+) error {
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+
+	// Fail fast if an operation on the whole store is in progress,
+	// unless it's ours.
+	var storeLockID string
+	if id := b.storeLockID.Load(); id != nil {
+		storeLockID = *id
+	}
+	if err := checkStoreLock(ctx, b.bucket, storeLockID); err != nil {
+		return err
+	}
+
+	owner, err := newLockInfo(b.clock.Now())
 	if err != nil {
-		b.d.Errorf(
-			diag.Message("", "there was a problem deleting the lock at %v, manual clean up may be required: %v"),
-			path.Join(b.url, b.lockPath(stackRef)),
+		return err
+	}
+	owner.OperationID = operationID(ctx)
+	stack := stackRef.FullyQualifiedName()
+	if err := b.acquireLock(ctx, stackRef, owner, onConflict); err != nil {
+		return err
+	}
+	// An operation on the whole store may have started at the same time.
+	if err := checkStoreLock(ctx, b.bucket, storeLockID); err != nil {
+		if uerr := b.locker.Unlock(ctx, stack); uerr != nil {
+			return errors.Join(err, uerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Bounds of the delay between attempts to lock a stack
+// while waiting for the locks of others to be released.
+const (
+	minLockWaitDelay = 100 * time.Millisecond
+	maxLockWaitDelay = 5 * time.Second
+)
+
+// acquireLock locks the given stack on behalf of owner.
+// If the stack is locked by others, onConflict decides what to do about it if set.
+func (b *localBackend) acquireLock(
+	ctx context.Context, stackRef backend.StackReference, owner LockInfo, onConflict func(LockInfo) LockConflictAction,
+) error {
+	stack := stackRef.FullyQualifiedName()
+	delay := minLockWaitDelay
+	for {
+		err := b.locker.Lock(ctx, stack, owner)
+		var conflict *LockConflictError
+		if err == nil || onConflict == nil || !errors.As(err, &conflict) {
+			return err
+		}
+
+		switch action := resolveLockConflict(onConflict, conflict.Locks); action {
+		case LockConflictWait:
+			logging.V(5).Infof("waiting %v for the locks on stack %v to be released", delay, stackRef)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+			delay *= 2
+			if delay > maxLockWaitDelay {
+				delay = maxLockWaitDelay
+			}
+		case LockConflictBreak:
+			if err := b.BreakLock(ctx, stackRef); err != nil {
+				return err
+			}
+		default:
+			logging.V(5).Infof("not locking stack %v: %v", stackRef, action)
+			return err
+		}
+	}
+}
+
+// resolveLockConflict asks decide what to do about each of the given locks,
+// and returns the most cautious of its answers:
+// the stack is only waited for if no lock is to be aborted on,
+// and its locks are only broken if they're all to be broken.
+func resolveLockConflict(decide func(LockInfo) LockConflictAction, locks []LockInfo) LockConflictAction {
+	if len(locks) == 0 {
+		return LockConflictAbort
+	}
+	result := LockConflictBreak
+	for _, l := range locks {
+		switch decide(l) {
+		case LockConflictBreak:
+		case LockConflictWait:
+			result = LockConflictWait
+		default:
+			return LockConflictAbort
+		}
+	}
+	return result
+}
+
+func (b *localBackend) Unlock(ctx context.Context, stackRef backend.StackReference) {
+	if b.checkWritable() != nil {
+		// The lock could never have been acquired.
+		return
+	}
+
+	if err := b.locker.Unlock(ctx, stackRef.FullyQualifiedName()); err != nil {
+		b.sink(ctx).Errorf(
+			diag.Message("", "there was a problem releasing the lock on %v, manual clean up may be required: %v"),
+			stackRef,
 			err)
 	}
 }
 
+func (b *localBackend) ListLocks(ctx context.Context) ([]LockInfo, error) {
+	var locks []LockInfo
+	if l, ok := b.locker.(*blobLocker); ok {
+		// Lock files may be left behind for stacks that were removed,
+		// so list them all instead of those of known stacks.
+		var err error
+		locks, err = l.listLocks(ctx)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		refs, err := b.store.ListReferences(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range refs {
+			stack := ref.FullyQualifiedName()
+			held, err := b.locker.Locks(ctx, stack)
+			if err != nil {
+				return nil, fmt.Errorf("list locks of stack %v: %w", ref, err)
+			}
+			for _, info := range held {
+				info.Stack = stack
+				locks = append(locks, info)
+			}
+		}
+	}
+
+	sort.SliceStable(locks, func(i, j int) bool {
+		if locks[i].Stack != locks[j].Stack {
+			return locks[i].Stack < locks[j].Stack
+		}
+		return locks[i].Timestamp.Before(locks[j].Timestamp)
+	})
+	return locks, nil
+}
+
+// breakLockUpdate is the kind of the history entry recorded when a lock is broken.
+const breakLockUpdate apitype.UpdateKind = "break-lock"
+
+// BreakLock forcibly removes all locks held on the given stack,
+// regardless of their owner,
+// and records that the locks were broken in the stack's history.
+//
+// This is intended for recovery when a process holding a lock
+// died without releasing it.
+func (b *localBackend) BreakLock(ctx context.Context, stackRef backend.StackReference) (err error) {
+	ctx = withOperationID(ctx)
+	defer func() { err = operationError(ctx, err) }()
+
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+
+	localStackRef, err := b.getReference(stackRef)
+	if err != nil {
+		return err
+	}
+	stack := localStackRef.FullyQualifiedName()
+
+	// Read all locks before breaking any of them
+	// so that we don't break some of them and then fail on a malformed one.
+	held, err := b.locker.Locks(ctx, stack)
+	if err != nil {
+		return err
+	}
+	if len(held) == 0 {
+		return fmt.Errorf("stack %v is not locked", stackRef)
+	}
+
+	var msg strings.Builder
+	for _, l := range held {
+		b.sink(ctx).Infoerrf(diag.Message("", "Breaking lock %v created by %v@%v (pid %v) at %v (%v ago)"),
+			l.Location,
+			l.Username,
+			l.Hostname,
+			l.Pid,
+			l.Timestamp.Format(time.RFC3339),
+			l.Age(b.clock.Now()).Round(time.Second))
+
+		if msg.Len() > 0 {
+			msg.WriteString("; ")
+		}
+		fmt.Fprintf(&msg, "broke lock created by %v@%v (pid %v) at %v",
+			l.Username, l.Hostname, l.Pid, l.Timestamp.Format(time.RFC3339))
+	}
+	if err := b.locker.BreakLocks(ctx, stack); err != nil {
+		return fmt.Errorf("break locks: %w", err)
+	}
+
+	now := b.clock.Now().Unix()
+	err = b.addToHistory(ctx, localStackRef, backend.UpdateInfo{
+		Kind:      breakLockUpdate,
+		StartTime: now,
+		EndTime:   now,
+		Message:   msg.String(),
+		Result:    backend.SucceededResult,
+	})
+	if err != nil {
+		return fmt.Errorf("record broken lock in history: %w", err)
+	}
+	return nil
+}
+
 func lockDir() string {
 	return path.Join(workspace.BookkeepingDir, workspace.LockDir)
 }
@@ -152,8 +667,3 @@ func stackLockDir(stack tokens.QName) string {
 	contract.Requiref(stack != "", "stack", "must not be empty")
 	return path.Join(lockDir(), fsutil.QnamePath(stack))
 }
-
-func (b *localBackend) lockPath(stackRef backend.StackReference) string {
-	contract.Requiref(stackRef != nil, "stack", "must not be nil")
-	return path.Join(stackLockDir(stackRef.FullyQualifiedName()), b.lockID+".json")
-}
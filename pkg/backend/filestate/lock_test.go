@@ -0,0 +1,542 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag/colors"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// writeLock writes a lock file for the given stack
+// as if it were held by another process.
+func writeLock(t *testing.T, b *localBackend, stack, id string, content LockInfo) {
+	t.Helper()
+
+	ref, err := b.parseStackReference(stack)
+	require.NoError(t, err)
+
+	byts, err := json.Marshal(content)
+	require.NoError(t, err)
+
+	lockPath := filepath.Join(stackLockDir(ref.FullyQualifiedName()), id+".json")
+	require.NoError(t, b.bucket.WriteAll(context.Background(), lockPath, byts, nil))
+}
+
+func TestLock_staleTTL(t *testing.T) {
+	t.Parallel()
+
+	var buff bytes.Buffer
+	sink := diag.DefaultSink(io.Discard, &buff, diag.FormatOptions{Color: colors.Never})
+
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, sink, "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"},
+		&localBackendOptions{
+			Getenv: mapGetenv(map[string]string{
+				"PULUMI_SELF_MANAGED_STATE_LOCK_TTL": "1h",
+			}),
+		})
+	require.NoError(t, err)
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+
+	// A lock older than the TTL is reclaimed.
+	writeLock(t, b, "foo", "stale", LockInfo{
+		Pid:       42,
+		Username:  "alice",
+		Hostname:  "example.com",
+		Timestamp: time.Now().Add(-2 * time.Hour),
+	})
+	require.NoError(t, b.Lock(ctx, ref))
+	assert.Contains(t, buff.String(), "Reclaimed stale lock")
+	assert.Contains(t, buff.String(), "created by alice@example.com (pid 42)")
+	b.Unlock(ctx, ref)
+
+	// A lock younger than the TTL is respected.
+	writeLock(t, b, "foo", "fresh", LockInfo{
+		Pid:       43,
+		Username:  "bob",
+		Hostname:  "example.com",
+		Timestamp: time.Now(),
+	})
+	err = b.Lock(ctx, ref)
+	assert.ErrorContains(t, err, "the stack is currently locked by 1 lock(s)")
+	assert.ErrorContains(t, err, "created by bob@example.com (pid 43)")
+}
+
+func TestLock_noTTL(t *testing.T) {
+	t.Parallel()
+
+	// Without a TTL, locks never go stale.
+
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"}, nil)
+	require.NoError(t, err)
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+
+	writeLock(t, b, "foo", "old", LockInfo{
+		Pid:       42,
+		Username:  "alice",
+		Hostname:  "example.com",
+		Timestamp: time.Now().Add(-24 * 365 * time.Hour),
+	})
+	assert.ErrorContains(t, b.Lock(ctx, ref), "created by alice@example.com (pid 42)")
+}
+
+func TestNew_invalidLockTTL(t *testing.T) {
+	t.Parallel()
+
+	_, err := newLocalBackend(context.Background(), diagtest.LogSink(t),
+		"file://"+filepath.ToSlash(t.TempDir()), nil,
+		&localBackendOptions{
+			Getenv: mapGetenv(map[string]string{
+				"PULUMI_SELF_MANAGED_STATE_LOCK_TTL": "forever",
+			}),
+		})
+	assert.ErrorContains(t, err, "invalid PULUMI_SELF_MANAGED_STATE_LOCK_TTL")
+}
+
+func TestBreakLock(t *testing.T) {
+	t.Parallel()
+
+	var buff bytes.Buffer
+	sink := diag.DefaultSink(io.Discard, &buff, diag.FormatOptions{Color: colors.Never})
+
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, sink, "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"}, nil)
+	require.NoError(t, err)
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	writeLock(t, b, "foo", "other", LockInfo{
+		Pid:       42,
+		Username:  "alice",
+		Hostname:  "example.com",
+		Timestamp: time.Now().Add(-2 * time.Hour),
+	})
+	require.Error(t, b.Lock(ctx, ref))
+
+	require.NoError(t, b.BreakLock(ctx, ref))
+	assert.Contains(t, buff.String(), "Breaking lock")
+	assert.Contains(t, buff.String(), "created by alice@example.com (pid 42)")
+	assert.Regexp(t, `\(2h0m[0-9]+s ago\)`, buff.String())
+
+	// The stack can be locked again.
+	require.NoError(t, b.Lock(ctx, ref))
+	b.Unlock(ctx, ref)
+
+	history, err := b.GetHistory(ctx, ref, 0 /* pageSize */, 0 /* page */)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, breakLockUpdate, history[0].Kind)
+	assert.Contains(t, history[0].Message, "broke lock created by alice@example.com (pid 42)")
+}
+
+func TestBreakLock_malformed(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"}, nil)
+	require.NoError(t, err)
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+
+	lockPath := filepath.Join(stackLockDir(ref.FullyQualifiedName()), "bad.json")
+	require.NoError(t, b.bucket.WriteAll(ctx, lockPath, []byte("not json"), nil))
+
+	assert.ErrorContains(t, b.BreakLock(ctx, ref), "malformed lock file")
+
+	// The lock must not have been deleted.
+	exists, err := b.bucket.Exists(ctx, lockPath)
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestBreakLock_notLocked(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"}, nil)
+	require.NoError(t, err)
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+
+	assert.ErrorContains(t, b.BreakLock(ctx, ref), "stack foo is not locked")
+}
+
+func TestLock_onLockConflict(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	var decide func(LockInfo) LockConflictAction
+	var seen []LockInfo
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"},
+		&localBackendOptions{
+			OnLockConflict: func(l LockInfo) LockConflictAction {
+				seen = append(seen, l)
+				return decide(l)
+			},
+		})
+	require.NoError(t, err)
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	// Aborting fails with the message of a conflict that isn't resolved.
+	writeLock(t, b, "foo", "other", LockInfo{
+		Pid:       42,
+		Username:  "alice",
+		Hostname:  "example.com",
+		Timestamp: time.Now().Add(-2 * time.Hour),
+	})
+	decide = func(LockInfo) LockConflictAction { return LockConflictAbort }
+	err = b.Lock(ctx, ref)
+	var conflict *LockConflictError
+	require.ErrorAs(t, err, &conflict)
+	assert.ErrorContains(t, err, "the stack is currently locked by 1 lock(s)")
+	require.Len(t, seen, 1)
+	assert.Equal(t, 42, seen[0].Pid)
+	assert.True(t, strings.HasSuffix(seen[0].Location, "/proj/foo/other.json"), seen[0].Location)
+
+	// Waiting tries again until the lock is released.
+	seen = nil
+	decide = func(LockInfo) LockConflictAction {
+		if len(seen) == 2 {
+			require.NoError(t, b.locker.(*blobLocker).BreakLocks(ctx, ref.FullyQualifiedName()))
+		}
+		return LockConflictWait
+	}
+	require.NoError(t, b.Lock(ctx, ref))
+	assert.Len(t, seen, 2)
+	b.Unlock(ctx, ref)
+
+	// Locks are broken if they're all to be broken,
+	// and aborted on if any of them is to be aborted on.
+	maxAge := time.Hour
+	decide = func(l LockInfo) LockConflictAction {
+		if l.Age(time.Now()) > maxAge {
+			return LockConflictBreak
+		}
+		return LockConflictAbort
+	}
+	writeLock(t, b, "foo", "old", LockInfo{Pid: 43, Timestamp: time.Now().Add(-2 * time.Hour)})
+	writeLock(t, b, "foo", "new", LockInfo{Pid: 44, Timestamp: time.Now()})
+	require.ErrorAs(t, b.Lock(ctx, ref), &conflict)
+	assert.Len(t, conflict.Locks, 2)
+
+	writeLock(t, b, "foo", "new", LockInfo{Pid: 44, Timestamp: time.Now().Add(-3 * time.Hour)})
+	require.NoError(t, b.Lock(ctx, ref))
+	b.Unlock(ctx, ref)
+
+	history, err := b.GetHistory(ctx, ref, 0 /* pageSize */, 0 /* page */)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, breakLockUpdate, history[0].Kind)
+	assert.Contains(t, history[0].Message, "(pid 43)")
+	assert.Contains(t, history[0].Message, "(pid 44)")
+
+	// Waiting stops when the operation is canceled.
+	writeLock(t, b, "foo", "other", LockInfo{Pid: 45, Timestamp: time.Now()})
+	cancelCtx, cancel := context.WithCancel(ctx)
+	decide = func(LockInfo) LockConflictAction {
+		cancel()
+		return LockConflictWait
+	}
+	assert.ErrorIs(t, b.Lock(cancelCtx, ref), context.Canceled)
+
+	// Conflicts within the process aren't resolved.
+	require.NoError(t, b.locker.(*blobLocker).BreakLocks(ctx, ref.FullyQualifiedName()))
+	require.NoError(t, b.Lock(ctx, ref))
+	seen = nil
+	decide = func(LockInfo) LockConflictAction { return LockConflictBreak }
+	assert.ErrorContains(t, b.Lock(ctx, ref), "locked by another operation of this process")
+	assert.Empty(t, seen)
+	b.Unlock(ctx, ref)
+}
+
+// memLocker is a Locker that keeps locks in memory.
+type memLocker struct {
+	mu    sync.Mutex
+	locks map[tokens.QName]LockInfo
+}
+
+var _ Locker = (*memLocker)(nil)
+
+func (l *memLocker) Lock(_ context.Context, stack tokens.QName, owner LockInfo) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if held, ok := l.locks[stack]; ok {
+		return fmt.Errorf("stack is locked by pid %v", held.Pid)
+	}
+	if l.locks == nil {
+		l.locks = make(map[tokens.QName]LockInfo)
+	}
+	owner.Location = "mem://" + string(stack)
+	l.locks[stack] = owner
+	return nil
+}
+
+func (l *memLocker) Unlock(_ context.Context, stack tokens.QName) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.locks, stack)
+	return nil
+}
+
+func (l *memLocker) Locks(_ context.Context, stack tokens.QName) ([]LockInfo, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if held, ok := l.locks[stack]; ok {
+		return []LockInfo{held}, nil
+	}
+	return nil, nil
+}
+
+func (l *memLocker) BreakLocks(ctx context.Context, stack tokens.QName) error {
+	return l.Unlock(ctx, stack)
+}
+
+func TestLocker(t *testing.T) {
+	t.Parallel()
+
+	var buff bytes.Buffer
+	sink := diag.DefaultSink(io.Discard, &buff, diag.FormatOptions{Color: colors.Never})
+
+	ctx := context.Background()
+	locker := &memLocker{}
+	b, err := newLocalBackend(ctx, sink, "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"}, &localBackendOptions{Locker: locker})
+	require.NoError(t, err)
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	require.NoError(t, b.Lock(ctx, ref))
+	assert.ErrorContains(t, b.Lock(ctx, ref), "stack is locked")
+
+	// No lock files are written to the state store.
+	assert.Empty(t, listKeys(t, b.bucket, lockDir()))
+
+	b.Unlock(ctx, ref)
+	require.NoError(t, b.Lock(ctx, ref))
+
+	require.NoError(t, b.BreakLock(ctx, ref))
+	assert.Contains(t, buff.String(), "Breaking lock mem://organization/proj/foo")
+	assert.Empty(t, locker.locks)
+
+	require.NoError(t, b.Lock(ctx, ref))
+	require.NoError(t, b.CancelCurrentUpdate(ctx, ref))
+	assert.Empty(t, locker.locks)
+}
+
+func TestLock_sharedBackend(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, fooRef := newSnapshotBackend(t, nil)
+
+	// A stack locked through a backend can't be locked again through it.
+	require.NoError(t, b.Lock(ctx, fooRef))
+	err := b.Lock(ctx, fooRef)
+	assert.ErrorContains(t, err, "locked by another operation of this process")
+	b.Unlock(ctx, fooRef)
+	require.NoError(t, b.Lock(ctx, fooRef))
+	b.Unlock(ctx, fooRef)
+
+	// Different stacks are updated concurrently through the same backend.
+	const stacks = 30
+	var wg sync.WaitGroup
+	errs := make([]error, stacks)
+	for i := 0; i < stacks; i++ {
+		ref, err := b.parseStackReference(fmt.Sprintf("stack-%d", i))
+		require.NoError(t, err)
+		_, err = b.CreateStack(ctx, ref, "", nil)
+		require.NoError(t, err)
+
+		wg.Add(1)
+		go func(i int, ref *localBackendReference) {
+			defer wg.Done()
+
+			if errs[i] = b.Lock(ctx, ref); errs[i] != nil {
+				return
+			}
+			defer b.Unlock(ctx, ref)
+			_, _, errs[i] = b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, i))
+		}(i, ref)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		assert.NoError(t, err, "stack-%d", i)
+	}
+
+	for i := 0; i < stacks; i++ {
+		ref, err := b.parseStackReference(fmt.Sprintf("stack-%d", i))
+		require.NoError(t, err)
+		chk, err := b.getCheckpoint(ctx, ref)
+		require.NoError(t, err)
+		assert.Len(t, chk.Latest.Resources, i)
+	}
+}
+
+// Breaking the lock of a stack held by an operation of a backend
+// doesn't let other operations of the backend lock the stack while it runs.
+func TestLock_sharedBackendBreak(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, nil)
+
+	locked, broken := make(chan struct{}), make(chan struct{})
+	done := make(chan error)
+	go func() {
+		if err := b.Lock(ctx, ref); err != nil {
+			close(locked)
+			done <- err
+			return
+		}
+		close(locked)
+		<-broken
+		b.Unlock(ctx, ref)
+		done <- nil
+	}()
+
+	<-locked
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.NoError(t, b.BreakLock(ctx, ref))
+		assert.NoError(t, b.CancelCurrentUpdate(ctx, ref))
+	}()
+	wg.Wait()
+
+	assert.ErrorContains(t, b.Lock(ctx, ref), "locked by another operation of this process")
+	close(broken)
+	require.NoError(t, <-done)
+
+	// Once the holder unlocks the stack, it can be locked again.
+	require.NoError(t, b.Lock(ctx, ref))
+	b.Unlock(ctx, ref)
+}
+
+func TestListLocks(t *testing.T) {
+	t.Parallel()
+
+	var buff bytes.Buffer
+	sink := diag.DefaultSink(io.Discard, &buff, diag.FormatOptions{Color: colors.Never})
+
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, sink, "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"},
+		&localBackendOptions{
+			Getenv: mapGetenv(map[string]string{
+				"PULUMI_SELF_MANAGED_STATE_LOCK_TTL": "1h",
+			}),
+		})
+	require.NoError(t, err)
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	require.NoError(t, b.Lock(ctx, ref))
+	defer b.Unlock(ctx, ref)
+
+	// Locks of stacks that no longer exist are listed too.
+	writeLock(t, b, "bar", "stale", LockInfo{
+		Pid:       42,
+		Username:  "alice",
+		Hostname:  "example.com",
+		Timestamp: time.Now().Add(-2 * time.Hour),
+	})
+	require.NoError(t, b.bucket.WriteAll(ctx,
+		path.Join(stackLockDir("organization/proj/baz"), "broken.json"), []byte("{"), nil))
+	require.NoError(t, b.bucket.WriteAll(ctx, migrationLockPath, []byte("{}"), nil))
+	require.NoError(t, b.bucket.WriteAll(ctx, storeLockPath, []byte("{}"), nil))
+
+	locks, err := b.ListLocks(ctx)
+	require.NoError(t, err)
+	require.Len(t, locks, 2)
+
+	assert.Equal(t, tokens.QName("organization/proj/bar"), locks[0].Stack)
+	assert.Equal(t, "alice", locks[0].Username)
+	assert.True(t, locks[0].Stale)
+	assert.Greater(t, locks[0].Age(time.Now()), time.Hour)
+
+	assert.Equal(t, tokens.QName("organization/proj/foo"), locks[1].Stack)
+	assert.False(t, locks[1].Stale)
+	assert.Contains(t, locks[1].Location, "/.pulumi/locks/organization/proj/foo/")
+
+	assert.Contains(t, buff.String(), "Skipping malformed lock file")
+	assert.Contains(t, buff.String(), "organization/proj/baz/broken.json")
+}
+
+func TestListLocks_locker(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"}, &localBackendOptions{Locker: &memLocker{}})
+	require.NoError(t, err)
+
+	for _, name := range []string{"foo", "bar"} {
+		ref, err := b.parseStackReference(name)
+		require.NoError(t, err)
+		_, err = b.CreateStack(ctx, ref, "", nil)
+		require.NoError(t, err)
+		if name == "foo" {
+			require.NoError(t, b.Lock(ctx, ref))
+		}
+	}
+
+	locks, err := b.ListLocks(ctx)
+	require.NoError(t, err)
+	require.Len(t, locks, 1)
+	assert.Equal(t, tokens.QName("organization/proj/foo"), locks[0].Stack)
+	assert.Equal(t, "mem://organization/proj/foo", locks[0].Location)
+}
@@ -0,0 +1,69 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+)
+
+func (b *localBackend) ListStacksMatching(
+	ctx context.Context, pattern string, filter backend.ListStacksFilter,
+) ([]backend.StackSummary, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid stack pattern %q: %w", pattern, err)
+	}
+
+	refs, err := b.store.ListReferences(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the keys were listed so far;
+	// nothing is read for the stacks that don't match.
+	matched := refs[:0]
+	for _, ref := range refs {
+		project, hasProject := ref.Project()
+		if filter.Project != nil && hasProject && string(project) != *filter.Project {
+			continue
+		}
+		if matchesStackPattern(pattern, ref) {
+			matched = append(matched, ref)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].FullyQualifiedName() < matched[j].FullyQualifiedName()
+	})
+
+	return b.readStackSummaries(ctx, filter, matched)
+}
+
+// matchesStackPattern reports whether the given stack matches a pattern validated by ListStacksMatching.
+// Patterns with a "/" are matched against "project/stack", and others against the stack name alone.
+// Stacks in stores with the legacy layout have an empty project.
+func matchesStackPattern(pattern string, ref *localBackendReference) bool {
+	name := string(ref.Name())
+	if strings.Contains(pattern, "/") {
+		project, _ := ref.Project()
+		name = string(project) + "/" + name
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
@@ -0,0 +1,134 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// readRecordingBucket is a Bucket that records the keys of the files read from it.
+type readRecordingBucket struct {
+	Bucket
+
+	mu   sync.Mutex
+	keys []string
+}
+
+func (b *readRecordingBucket) record(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.keys = append(b.keys, key)
+}
+
+func (b *readRecordingBucket) ReadAll(ctx context.Context, key string) ([]byte, error) {
+	b.record(key)
+	return b.Bucket.ReadAll(ctx, key)
+}
+
+func (b *readRecordingBucket) Exists(ctx context.Context, key string) (bool, error) {
+	b.record(key)
+	return b.Bucket.Exists(ctx, key)
+}
+
+func (b *readRecordingBucket) Attributes(ctx context.Context, key string) (*blob.Attributes, error) {
+	b.record(key)
+	return b.Bucket.Attributes(ctx, key)
+}
+
+func TestListStacksMatching(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, nil)
+	writeStackFiles(t, b, ref,
+		".pulumi/stacks/proj/dev-a.json",
+		".pulumi/stacks/proj/dev-b.json.gz",
+		".pulumi/stacks/proj/prod.json",
+		".pulumi/stacks/other/dev-c.json")
+	recording := &readRecordingBucket{Bucket: b.bucket}
+	b.bucket = recording
+
+	names := func(pattern string, filter backend.ListStacksFilter) []string {
+		t.Helper()
+
+		summaries, err := b.ListStacksMatching(ctx, pattern, filter)
+		require.NoError(t, err)
+		var names []string
+		for _, s := range summaries {
+			names = append(names, s.Name().FullyQualifiedName().String())
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{"organization/other/dev-c", "organization/proj/dev-a", "organization/proj/dev-b"},
+		names("dev-*", backend.ListStacksFilter{}))
+
+	// Stacks that don't match are never read.
+	assert.NotEmpty(t, recording.keys)
+	for _, key := range recording.keys {
+		assert.NotContains(t, key, "prod", "read %v", key)
+		assert.False(t, strings.HasPrefix(key, ".pulumi/stacks/proj/foo"), "read %v", key)
+	}
+
+	proj := "proj"
+	assert.Equal(t, []string{"organization/proj/dev-a", "organization/proj/dev-b"},
+		names("dev-*", backend.ListStacksFilter{Project: &proj}))
+	assert.Equal(t, []string{"organization/other/dev-c"}, names("o*/d?v-*", backend.ListStacksFilter{}))
+	assert.Equal(t, []string{"organization/proj/foo", "organization/proj/prod"},
+		names("proj/[fp]*", backend.ListStacksFilter{}))
+	assert.Empty(t, names("staging-*", backend.ListStacksFilter{}))
+
+	_, err := b.ListStacksMatching(ctx, "dev-[", backend.ListStacksFilter{})
+	assert.ErrorContains(t, err, `invalid stack pattern "dev-["`)
+}
+
+func TestListStacksMatching_legacy(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"},
+		&localBackendOptions{Getenv: mapGetenv(map[string]string{PulumiFilestateLegacyLayoutEnvVar: "1"})})
+	require.NoError(t, err)
+	ref, err := b.parseStackReference("dev-a")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+	writeStackFiles(t, b, ref, ".pulumi/stacks/dev-b.json", ".pulumi/stacks/prod.json")
+
+	summaries, err := b.ListStacksMatching(ctx, "dev-*", backend.ListStacksFilter{})
+	require.NoError(t, err)
+	require.Len(t, summaries, 2)
+	assert.Equal(t, "dev-a", summaries[0].Name().String())
+	assert.Equal(t, "dev-b", summaries[1].Name().String())
+
+	// Legacy stacks have no project.
+	summaries, err = b.ListStacksMatching(ctx, "/prod", backend.ListStacksFilter{})
+	require.NoError(t, err)
+	require.Len(t, summaries, 1)
+	assert.Equal(t, "prod", summaries[0].Name().String())
+}
@@ -0,0 +1,41 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+
+	"gocloud.dev/blob/memblob" // driver for mem://
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// InMemoryURL is the URL of the state store used by [NewInMemory].
+//
+// Every backend opened with this URL gets its own empty state store,
+// which is discarded when the backend is no longer referenced.
+const InMemoryURL = memblob.Scheme + "://"
+
+// NewInMemory constructs a new filestate backend
+// that keeps its state in memory, configured with the given options.
+//
+// The state store starts out empty and is initialized
+// the same way as a new bucket on disk would be.
+// This is intended for tests of tools built on top of this package
+// that don't want to touch the file system.
+func NewInMemory(ctx context.Context, d diag.Sink, project *workspace.Project, opts *Options) (Backend, error) {
+	return NewWithOptions(ctx, d, InMemoryURL, project, opts)
+}
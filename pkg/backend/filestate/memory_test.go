@@ -0,0 +1,63 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+func TestNewInMemory(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	project := &workspace.Project{Name: "proj"}
+	b, err := NewInMemory(ctx, diagtest.LogSink(t), project, nil)
+	require.NoError(t, err)
+	assert.Equal(t, StoreInfo{Version: 1, MetaExists: true}, b.StoreInfo())
+
+	ref, err := b.ParseStackReference("foo")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	stacks, _, err := b.ListStacks(ctx, backend.ListStacksFilter{}, nil)
+	require.NoError(t, err)
+	require.Len(t, stacks, 1)
+	assert.Equal(t, "organization/proj/foo", string(stacks[0].Name().FullyQualifiedName()))
+
+	// Every backend has its own state store.
+	other, err := NewInMemory(ctx, diagtest.LogSink(t), project, nil)
+	require.NoError(t, err)
+	stacks, _, err = other.ListStacks(ctx, backend.ListStacksFilter{}, nil)
+	require.NoError(t, err)
+	assert.Empty(t, stacks)
+}
+
+func TestNewInMemory_options(t *testing.T) {
+	t.Parallel()
+
+	b, err := NewInMemory(context.Background(), diagtest.LogSink(t),
+		&workspace.Project{Name: "proj"}, &Options{InitialVersion: intPtr(0)})
+	require.NoError(t, err)
+	assert.Equal(t, StoreInfo{Version: 0, Legacy: true}, b.StoreInfo())
+}
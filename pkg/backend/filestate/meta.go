@@ -15,21 +15,113 @@
 package filestate
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"path/filepath"
 	"strconv"
+	"strings"
 
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/cmdutil"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+	"gocloud.dev/blob"
 	"gocloud.dev/gcerrors"
 	"gopkg.in/yaml.v3"
 )
 
-// Path inside the bucket where we store the metadata file.
-var pulumiMetaPath = filepath.Join(workspace.BookkeepingDir, "meta.yaml")
+// Paths inside the bucket where we store the metadata file
+// in each of the supported formats.
+var (
+	pulumiMetaPath     = filepath.Join(workspace.BookkeepingDir, "meta.yaml")
+	pulumiMetaJSONPath = filepath.Join(workspace.BookkeepingDir, "meta.json")
+)
+
+// metaFormat is the serialization format of the metadata file.
+type metaFormat int
+
+const (
+	// metaFormatYAML stores the metadata in .pulumi/meta.yaml.
+	// This is the default and is understood by all versions of the CLI.
+	metaFormatYAML metaFormat = iota
+
+	// metaFormatJSON stores the metadata in .pulumi/meta.json.
+	// It takes precedence over .pulumi/meta.yaml if both exist.
+	//
+	// Older versions of the CLI don't read this file,
+	// and will treat the store as a legacy store.
+	metaFormatJSON
+)
+
+// metaFormats lists the supported formats
+// in the order in which they're looked for.
+var metaFormats = []metaFormat{metaFormatJSON, metaFormatYAML}
+
+// parseMetaFormat parses the name of a metadata format,
+// which defaults to YAML if empty.
+func parseMetaFormat(s string) (metaFormat, error) {
+	switch strings.ToLower(s) {
+	case "", "yaml":
+		return metaFormatYAML, nil
+	case "json":
+		return metaFormatJSON, nil
+	default:
+		return 0, fmt.Errorf("invalid %v: %q must be one of yaml, json", PulumiFilestateMetaFormatEnvVar, s)
+	}
+}
+
+// defaultMetaIndent is the number of spaces
+// that the metadata file is indented with by default.
+const defaultMetaIndent = 4
+
+// parseMetaIndent parses the number of spaces to indent the metadata file with.
+// It returns 0 for an empty string, which stands for defaultMetaIndent.
+func parseMetaIndent(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	// The YAML encoder doesn't support other indentations.
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 2 || n > 9 {
+		return 0, fmt.Errorf("invalid %v: %q must be a number of spaces from 2 to 9", PulumiFilestateMetaIndentEnvVar, s)
+	}
+	return n, nil
+}
 
-// pulumiMeta holds the contents of the .pulumi/meta.yaml file
+// path returns the path of the metadata file in this format.
+func (f metaFormat) path() string {
+	if f == metaFormatJSON {
+		return pulumiMetaJSONPath
+	}
+	return pulumiMetaPath
+}
+
+// maxSupportedVersion is the newest version of the state store
+// that this version of the CLI understands.
+//
+// Stores with a newer version must never be written to by this CLI.
+const maxSupportedVersion = 2
+
+// shardedHistoryVersion is the first version of the state store
+// that shards the history of each stack.
+// See shard.go for details.
+const shardedHistoryVersion = 2
+
+// ErrStoreTooNew is returned when attempting to use a state store
+// whose version is newer than this version of the CLI supports.
+var ErrStoreTooNew = errors.New("state store unsupported")
+
+// newStoreTooNewError builds an error wrapping ErrStoreTooNew
+// that reports the version of the store with the given metadata
+// and the file that it was read from.
+func newStoreTooNewError(meta *pulumiMeta) error {
+	return fmt.Errorf("%w: '%v' version (%d) is not supported "+
+		"by this version of the Pulumi CLI", ErrStoreTooNew, filepath.Base(meta.path()), meta.Version)
+}
+
+// pulumiMeta holds the contents of the .pulumi/meta.yaml or .pulumi/meta.json file
 // in a filestate backend.
 //
 // This file specifies metadata for the backend,
@@ -45,10 +137,48 @@ type pulumiMeta struct {
 	// Version 0 is the starting version.
 	// It does not support project-scoped stacks.
 	// Version 1 adds support for project-scoped stacks.
+	// Version 2 shards the history of each stack into subdirectories.
 	//
 	// Does not use "omitempty" to differentiate
 	// between a missing field and a zero value.
 	Version int `json:"version" yaml:"version"`
+
+	// Checksum is the name of the algorithm used to compute
+	// checksums of checkpoint files in the store, if any.
+	//
+	// Only "sha256" is currently supported.
+	// If empty, checksums are written only if the user opts in.
+	Checksum string `json:"checksum,omitempty" yaml:"checksum,omitempty"`
+
+	// Encryption describes how checkpoint files in the store are encrypted.
+	// If nil, checkpoint files are not encrypted.
+	Encryption *encryptionMeta `json:"encryption,omitempty" yaml:"encryption,omitempty"`
+
+	// SecretsProvider is the secrets provider that the store was initialized with.
+	// If nil, stacks may use any secrets provider.
+	SecretsProvider *secretsProviderMeta `json:"secretsprovider,omitempty" yaml:"secretsprovider,omitempty"`
+
+	// KeyTemplate is the template that the keys of the files of stacks follow.
+	// If empty, they follow defaultKeyTemplate.
+	// See [keyTemplate] for details.
+	KeyTemplate string `json:"keytemplate,omitempty" yaml:"keytemplate,omitempty"`
+
+	// Description is a free-text description of the store,
+	// and Environment a label such as "production",
+	// that tell stores apart when logging in to them.
+	// Neither affects how the store is used.
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	Environment string `json:"environment,omitempty" yaml:"environment,omitempty"`
+
+	// format is the format of the file that the metadata was read from,
+	// and will be written in.
+	// It's not part of the file.
+	format metaFormat
+
+	// indent is the number of spaces that nested values are indented with
+	// when the metadata is written, or 0 for defaultMetaIndent.
+	// Like format, it's not part of the file.
+	indent int
 }
 
 // ensurePulumiMeta loads the Pulumi state metadata file from the bucket.
@@ -57,22 +187,63 @@ type pulumiMeta struct {
 // the result of this function will always be non-nil if the error is nil.
 //
 // If the bucket is empty, this will create a new metadata file
-// with the latest version number.
+// with version 1, which every CLI with project-scoped stacks can read.
 // This can be overridden by setting the environment variable
-// "PULUMI_SELF_MANAGED_STATE_LEGACY_LAYOUT" to "1".
+// "PULUMI_SELF_MANAGED_STATE_LEGACY_LAYOUT" to "1",
+// or by passing a non-nil initVersion, e.g. 2 for sharded history,
+// which takes precedence over the environment variable.
+// initVersion has no effect on buckets that aren't empty.
+// New stores record that they use checksums
+// if "PULUMI_SELF_MANAGED_STATE_CHECKSUMS" is set,
+// are encrypted if an encryption passphrase or key is set,
+// and record the secrets provider in "PULUMI_SELF_MANAGED_STATE_SECRETS_PROVIDER".
+// They also record the description and environment label
+// in "PULUMI_SELF_MANAGED_STATE_DESCRIPTION" and "PULUMI_SELF_MANAGED_STATE_ENVIRONMENT".
+// The metadata is written with the indentation in "PULUMI_SELF_MANAGED_STATE_META_INDENT".
 // ensurePulumiMeta uses the provided 'getenv' function
 // to read the environment variable.
-func ensurePulumiMeta(ctx context.Context, b Bucket, getenv func(string) string) (*pulumiMeta, error) {
+func ensurePulumiMeta(
+	ctx context.Context, b Bucket, getenv func(string) string, initVersion *int,
+) (*pulumiMeta, error) {
+	indent, err := parseMetaIndent(getenv(PulumiFilestateMetaIndentEnvVar))
+	if err != nil {
+		return nil, err
+	}
+
 	meta, err := readPulumiMeta(ctx, b)
 	if err != nil {
 		return nil, err
 	}
 
 	if meta != nil {
+		meta.indent = indent
 		return meta, nil
 	}
 
 	// If there's no metadata file, we need to create one.
+	meta, err = newPulumiMeta(ctx, b, getenv, initVersion)
+	if err != nil {
+		return nil, err
+	}
+	meta.indent = indent
+
+	// Implementation detail:
+	// For version 0, WriteTo won't write the metadata file.
+	// See [pulumiMeta.WriteTo] for details on why.
+	if err := meta.WriteTo(ctx, b); err != nil {
+		return nil, err
+	}
+
+	return meta, nil
+}
+
+// newPulumiMeta returns the metadata for a store in the given bucket
+// that does not have a metadata file yet.
+// It does not write the metadata to the bucket.
+// See ensurePulumiMeta for how initVersion is used.
+func newPulumiMeta(
+	ctx context.Context, b Bucket, getenv func(string) string, initVersion *int,
+) (*pulumiMeta, error) {
 	// The version we pick for the new file decides how we lay out the state.
 	//
 	// - Version 0 is legacy mode, which is the old layout.
@@ -82,13 +253,20 @@ func ensurePulumiMeta(ctx context.Context, b Bucket, getenv func(string) string)
 	// - Version 1 added support for project-scoped stacks.
 	//   For entirely new buckets, we'll use version 1
 	//   to give new users access to the latest features.
+	//
+	// - Version 2 shards history, which older CLIs can't read,
+	//   so it's only used if it's requested explicitly.
 	empty, err := isPulumiDirEmpty(ctx, b)
 	if err != nil {
 		return nil, err
 	}
 
 	useLegacy := !empty
-	if empty {
+	switch {
+	case empty && initVersion != nil:
+		// The version was requested explicitly.
+		useLegacy = *initVersion == 0
+	case empty:
 		// Allow opting into legacy mode for new states
 		// by setting the environment variable.
 		v, err := strconv.ParseBool(getenv(PulumiFilestateLegacyLayoutEnvVar))
@@ -98,31 +276,161 @@ func ensurePulumiMeta(ctx context.Context, b Bucket, getenv func(string) string)
 	}
 
 	if useLegacy {
-		meta = &pulumiMeta{Version: 0}
-	} else {
-		meta = &pulumiMeta{Version: 1}
+		return &pulumiMeta{Version: 0}, nil
 	}
 
-	// Implementation detail:
-	// For version 0, WriteTo won't write the metadata file.
-	// See [pulumiMeta.WriteTo] for details on why.
-	if err := meta.WriteTo(ctx, b); err != nil {
+	format, err := parseMetaFormat(getenv(PulumiFilestateMetaFormatEnvVar))
+	if err != nil {
 		return nil, err
 	}
-
+	meta := &pulumiMeta{Version: 1, format: format}
+	if initVersion != nil {
+		meta.Version = *initVersion
+	}
+	// New stores created with checksums enabled
+	// will keep using them regardless of the environment.
+	if cmdutil.IsTruthy(getenv(PulumiFilestateChecksumsEnvVar)) {
+		meta.Checksum = sha256Checksum
+	}
+	// Likewise for encryption, which can't be changed later.
+	meta.Encryption, err = newEncryptionMeta(ctx, getenv)
+	if err != nil {
+		return nil, err
+	}
+	meta.SecretsProvider, err = parseSecretsProvider(getenv(PulumiFilestateSecretsProviderEnvVar))
+	if err != nil {
+		return nil, err
+	}
+	// The default template isn't recorded
+	// so that the metadata file stays readable by older versions of the CLI.
+	if v := getenv(PulumiFilestateKeyTemplateEnvVar); v != "" {
+		keys, err := parseKeyTemplate(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v: %w", PulumiFilestateKeyTemplateEnvVar, err)
+		}
+		if !keys.isDefault() {
+			meta.KeyTemplate = keys.String()
+		}
+	}
+	meta.Description = strings.TrimSpace(getenv(PulumiFilestateDescriptionEnvVar))
+	meta.Environment = strings.TrimSpace(getenv(PulumiFilestateEnvironmentEnvVar))
 	return meta, nil
 }
 
+// Meta is the metadata of a filestate state store
+// as reported by [ReadMeta].
+type Meta struct {
+	// Version is the version of the state store.
+	//
+	// This is 0 for legacy stores without a metadata file.
+	Version int
+
+	// Exists reports whether the store has a metadata file.
+	//
+	// This differentiates legacy stores without a metadata file
+	// from those with an explicit "version: 0" in it.
+	Exists bool
+
+	// Checksum is the checksum algorithm recorded for the store,
+	// or empty if the store does not require checksums.
+	Checksum string
+
+	// Encrypted reports whether checkpoints in the store are encrypted.
+	Encrypted bool
+
+	// SecretsProvider is the secrets provider recorded for the store,
+	// e.g. "passphrase" or "awskms://alias/my-key",
+	// or empty if the store doesn't record one.
+	SecretsProvider string
+
+	// KeyTemplate is the template recorded for the store
+	// that the keys of the files of stacks follow, e.g. "compliance/{project}/env-{stack}",
+	// or empty if the store doesn't record one and uses "{project}/{stack}".
+	KeyTemplate string
+
+	// Description and Environment are the description and environment label
+	// recorded for the store, or empty if it doesn't record them.
+	Description string
+	Environment string
+}
+
+// ReadMeta reads the metadata of the state store in the given bucket.
+//
+// Unlike opening a backend with [New],
+// this never writes to the bucket:
+// if the metadata file does not exist, a zero version is reported
+// with Exists set to false.
+func ReadMeta(ctx context.Context, bucket *blob.Bucket) (*Meta, error) {
+	meta, err := readPulumiMeta(ctx, &wrappedBucket{bucket: bucket})
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		return &Meta{Version: 0, Exists: false}, nil
+	}
+	return &Meta{
+		Version:   meta.Version,
+		Exists:    true,
+		Checksum:  meta.Checksum,
+		Encrypted: meta.Encryption != nil,
+
+		SecretsProvider: meta.SecretsProvider.String(),
+		KeyTemplate:     meta.KeyTemplate,
+		Description:     meta.Description,
+		Environment:     meta.Environment,
+	}, nil
+}
+
 // readPulumiMeta loads the Pulumi state metadata from the bucket.
 // If the file does not exist, it returns nil and no error.
 func readPulumiMeta(ctx context.Context, b Bucket) (*pulumiMeta, error) {
-	metaBody, err := b.ReadAll(ctx, pulumiMetaPath)
+	metaBody, format, err := readPulumiMetaFile(ctx, b)
 	if err != nil {
 		if gcerrors.Code(err) == gcerrors.NotFound {
 			return nil, nil
 		}
-		return nil, fmt.Errorf("read %q: %w", pulumiMetaPath, err)
+		return nil, err
+	}
+	return parsePulumiMeta(format, metaBody)
+}
+
+// readPulumiMetaFile reads the contents of the metadata file in the bucket
+// in whichever format it exists.
+// It returns a NotFound error if there's no metadata file.
+func readPulumiMetaFile(ctx context.Context, b Bucket) ([]byte, metaFormat, error) {
+	var err error
+	for _, format := range metaFormats {
+		var metaBody []byte
+		metaBody, err = b.ReadAll(ctx, format.path())
+		if err == nil {
+			return metaBody, format, nil
+		}
+		if gcerrors.Code(err) != gcerrors.NotFound {
+			return nil, 0, fmt.Errorf("read %q: %w", format.path(), err)
+		}
 	}
+	return nil, 0, err
+}
+
+// Byte order marks that editors may prepend to the metadata file.
+var (
+	utf8BOM    = []byte{0xEF, 0xBB, 0xBF}
+	utf16LEBOM = []byte{0xFF, 0xFE}
+	utf16BEBOM = []byte{0xFE, 0xFF}
+)
+
+// parsePulumiMeta parses the contents of the Pulumi state metadata file
+// in the given format.
+//
+// A leading UTF-8 byte order mark is ignored,
+// as are Windows line endings.
+// Files encoded as UTF-16 are rejected with an error saying so
+// rather than failing to find a version in them.
+func parsePulumiMeta(format metaFormat, metaBody []byte) (*pulumiMeta, error) {
+	if bytes.HasPrefix(metaBody, utf16LEBOM) || bytes.HasPrefix(metaBody, utf16BEBOM) {
+		return nil, fmt.Errorf("corrupt store: %q is encoded as UTF-16; re-save it as UTF-8", format.path())
+	}
+	metaBody = bytes.TrimPrefix(metaBody, utf8BOM)
 
 	// State is a copy of the pulumiMeta shape,
 	// but with pointers to fields where we need to differentiate
@@ -133,23 +441,67 @@ func readPulumiMeta(ctx context.Context, b Bucket) (*pulumiMeta, error) {
 	// will read a zero value for a missing field or an empty file.
 	var state struct {
 		// Version 0 is valid, so we need to use a pointer.
-		Version *int `yaml:"version"`
+		Version *int `json:"version" yaml:"version"`
+
+		Checksum string `json:"checksum" yaml:"checksum"`
+
+		Encryption *encryptionMeta `json:"encryption" yaml:"encryption"`
+
+		SecretsProvider *secretsProviderMeta `json:"secretsprovider" yaml:"secretsprovider"`
+
+		KeyTemplate string `json:"keytemplate" yaml:"keytemplate"`
 	}
 
-	if err := yaml.Unmarshal(metaBody, &state); err != nil {
-		return nil, fmt.Errorf("corrupt store: unmarshal %q: %w", pulumiMetaPath, err)
+	unmarshal := yaml.Unmarshal
+	if format == metaFormatJSON {
+		unmarshal = json.Unmarshal
+	}
+	if err := unmarshal(metaBody, &state); err != nil {
+		return nil, fmt.Errorf("corrupt store: unmarshal %q: %w", format.path(), err)
 	}
 
 	if state.Version == nil {
-		return nil, fmt.Errorf("corrupt store: missing version in %q", pulumiMetaPath)
+		return nil, fmt.Errorf("corrupt store: missing version in %q", format.path())
 	}
 
+	// The description and environment are only informational,
+	// so values that aren't text, e.g. a nested map added by hand, are ignored
+	// rather than making the store unusable.
+	var labels struct {
+		Description interface{} `json:"description" yaml:"description"`
+		Environment interface{} `json:"environment" yaml:"environment"`
+	}
+	// This can't fail if the file could be unmarshaled above.
+	_ = unmarshal(metaBody, &labels)
+
 	return &pulumiMeta{
-		Version: *state.Version,
+		Version:         *state.Version,
+		Checksum:        state.Checksum,
+		Encryption:      state.Encryption,
+		SecretsProvider: state.SecretsProvider,
+		KeyTemplate:     state.KeyTemplate,
+		Description:     metaLabel(labels.Description),
+		Environment:     metaLabel(labels.Environment),
+		format:          format,
 	}, nil
 }
 
+// metaLabel returns the text of a label read from the metadata file,
+// or "" if it isn't a scalar.
+func metaLabel(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case bool, int, float64:
+		return fmt.Sprint(v)
+	default:
+		return ""
+	}
+}
+
 // WriteTo writes the metadata to the bucket, overwriting any existing metadata.
+// The file is indented with the same number of spaces at every level
+// and ends with a newline, so that it's stable under YAML and JSON formatters.
 func (m *pulumiMeta) WriteTo(ctx context.Context, b Bucket) error {
 	if m.Version == 0 {
 		// We don't want to write a metadata file
@@ -161,11 +513,41 @@ func (m *pulumiMeta) WriteTo(ctx context.Context, b Bucket) error {
 		return nil
 	}
 
-	bs, err := yaml.Marshal(m)
-	contract.AssertNoErrorf(err, "Could not marshal filestate.pulumiMeta to YAML")
+	indent := m.indent
+	if indent == 0 {
+		indent = defaultMetaIndent
+	}
 
-	if err := b.WriteAll(ctx, pulumiMetaPath, bs, nil); err != nil {
-		return fmt.Errorf("write %q: %w", pulumiMetaPath, err)
+	var bs []byte
+	var err error
+	if m.format == metaFormatJSON {
+		bs, err = json.MarshalIndent(m, "", strings.Repeat(" ", indent))
+		bs = append(bs, '\n')
+	} else {
+		var buf bytes.Buffer
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(indent)
+		err = enc.Encode(m)
+		if err == nil {
+			err = enc.Close()
+		}
+		bs = buf.Bytes()
+	}
+	contract.AssertNoErrorf(err, "Could not marshal filestate.pulumiMeta")
+
+	path := m.path()
+	if err := b.WriteAll(ctx, path, bs, nil); err != nil {
+		return fmt.Errorf("write %q: %w", path, err)
 	}
 	return nil
 }
+
+// shardsHistory reports whether the history of stacks in the store is sharded.
+func (m *pulumiMeta) shardsHistory() bool {
+	return m.Version >= shardedHistoryVersion
+}
+
+// path returns the path of the metadata file.
+func (m *pulumiMeta) path() string {
+	return m.format.path()
+}
@@ -33,7 +33,9 @@ func TestEnsurePulumiMeta(t *testing.T) {
 		desc string
 		give map[string]string // files in the bucket
 		env  map[string]string // environment variables
-		want pulumiMeta
+		// version requested for new stores, if any
+		initVersion *int
+		want        pulumiMeta
 	}{
 		{
 			// Empty bucket should be initialized to
@@ -41,6 +43,28 @@ func TestEnsurePulumiMeta(t *testing.T) {
 			desc: "empty",
 			want: pulumiMeta{Version: 1},
 		},
+		{
+			// New buckets record that they use checksums
+			// if the environment variable is set.
+			desc: "empty/checksums",
+			env:  map[string]string{PulumiFilestateChecksumsEnvVar: "true"},
+			want: pulumiMeta{Version: 1, Checksum: "sha256"},
+		},
+		{
+			// New buckets record the secrets provider they're initialized with.
+			desc: "empty/secrets provider",
+			env:  map[string]string{PulumiFilestateSecretsProviderEnvVar: "awskms://alias/my-key"},
+			want: pulumiMeta{Version: 1, SecretsProvider: &secretsProviderMeta{Type: "cloud", URL: "awskms://alias/my-key"}},
+		},
+		{
+			// New buckets record their description and environment.
+			desc: "empty/labels",
+			env: map[string]string{
+				PulumiFilestateDescriptionEnvVar: " Platform team ",
+				PulumiFilestateEnvironmentEnvVar: "production",
+			},
+			want: pulumiMeta{Version: 1, Description: "Platform team", Environment: "production"},
+		},
 		{
 			// Use legacy mode even for the new bucket
 			// because the environment variable is "1".
@@ -63,6 +87,37 @@ func TestEnsurePulumiMeta(t *testing.T) {
 			env:  map[string]string{PulumiFilestateLegacyLayoutEnvVar: "false"},
 			want: pulumiMeta{Version: 1},
 		},
+		{
+			// The requested version takes precedence
+			// over the environment variable.
+			desc:        "empty/pinned legacy",
+			env:         map[string]string{PulumiFilestateLegacyLayoutEnvVar: "false"},
+			initVersion: intPtr(0),
+			want:        pulumiMeta{Version: 0},
+		},
+		{
+			desc:        "empty/pinned",
+			env:         map[string]string{PulumiFilestateLegacyLayoutEnvVar: "true"},
+			initVersion: intPtr(1),
+			want:        pulumiMeta{Version: 1},
+		},
+		{
+			// The requested version only applies to empty buckets.
+			desc: "legacy/pinned",
+			give: map[string]string{
+				".pulumi/stacks/a.json": `{}`,
+			},
+			initVersion: intPtr(1),
+			want:        pulumiMeta{Version: 0},
+		},
+		{
+			desc: "version 1/pinned",
+			give: map[string]string{
+				".pulumi/meta.yaml": `version: 1`,
+			},
+			initVersion: intPtr(0),
+			want:        pulumiMeta{Version: 1},
+		},
 		{
 			// Non-empty bucket without a version file
 			// should get version 0 for legacy mode.
@@ -88,6 +143,13 @@ func TestEnsurePulumiMeta(t *testing.T) {
 			},
 			want: pulumiMeta{Version: 1},
 		},
+		{
+			desc: "version 1/checksum",
+			give: map[string]string{
+				".pulumi/meta.yaml": "version: 1\nchecksum: sha256",
+			},
+			want: pulumiMeta{Version: 1, Checksum: "sha256"},
+		},
 		{
 			desc: "future version",
 			give: map[string]string{
@@ -95,6 +157,52 @@ func TestEnsurePulumiMeta(t *testing.T) {
 			},
 			want: pulumiMeta{Version: 42},
 		},
+		{
+			desc: "empty/json",
+			env:  map[string]string{PulumiFilestateMetaFormatEnvVar: "json"},
+			want: pulumiMeta{Version: 1, format: metaFormatJSON},
+		},
+		{
+			desc: "json",
+			give: map[string]string{
+				".pulumi/meta.json": `{"version": 1, "checksum": "sha256"}`,
+			},
+			want: pulumiMeta{Version: 1, Checksum: "sha256", format: metaFormatJSON},
+		},
+		{
+			// The JSON file takes precedence.
+			desc: "json and yaml",
+			give: map[string]string{
+				".pulumi/meta.json": `{"version": 1}`,
+				".pulumi/meta.yaml": `version: 0`,
+			},
+			want: pulumiMeta{Version: 1, format: metaFormatJSON},
+		},
+		{
+			// Files edited on Windows may have
+			// a byte order mark and CRLF line endings.
+			desc: "bom/crlf",
+			give: map[string]string{
+				".pulumi/meta.yaml": "\xef\xbb\xbfversion: 1\r\nchecksum: sha256\r\n",
+			},
+			want: pulumiMeta{Version: 1, Checksum: "sha256"},
+		},
+		{
+			desc: "json/bom",
+			give: map[string]string{
+				".pulumi/meta.json": "\xef\xbb\xbf{\r\n  \"version\": 1\r\n}\r\n",
+			},
+			want: pulumiMeta{Version: 1, format: metaFormatJSON},
+		},
+		{
+			// The format of existing files is kept.
+			desc: "yaml/json env",
+			env:  map[string]string{PulumiFilestateMetaFormatEnvVar: "json"},
+			give: map[string]string{
+				".pulumi/meta.yaml": `version: 1`,
+			},
+			want: pulumiMeta{Version: 1},
+		},
 	}
 
 	for _, tt := range tests {
@@ -108,7 +216,7 @@ func TestEnsurePulumiMeta(t *testing.T) {
 				require.NoError(t, b.WriteAll(ctx, name, []byte(body), nil))
 			}
 
-			state, err := ensurePulumiMeta(ctx, b, mapGetenv(tt.env))
+			state, err := ensurePulumiMeta(ctx, b, mapGetenv(tt.env), tt.initVersion)
 			require.NoError(t, err)
 			assert.Equal(t, &tt.want, state)
 		})
@@ -120,7 +228,8 @@ func TestEnsurePulumiMeta_corruption(t *testing.T) {
 
 	tests := []struct {
 		desc    string
-		give    string // contents of meta.yaml
+		file    string // defaults to meta.yaml
+		give    string // contents of the file
 		wantErr string
 	}{
 		{
@@ -138,6 +247,23 @@ func TestEnsurePulumiMeta_corruption(t *testing.T) {
 			give:    `version: foo`,
 			wantErr: `corrupt store: unmarshal ".pulumi/meta.yaml"`,
 		},
+		{
+			desc:    "utf-16",
+			give:    "\xff\xfev\x00e\x00r\x00",
+			wantErr: `corrupt store: ".pulumi/meta.yaml" is encoded as UTF-16; re-save it as UTF-8`,
+		},
+		{
+			desc:    "json/other fields",
+			file:    "meta.json",
+			give:    `{"foo": "bar"}`,
+			wantErr: `corrupt store: missing version in ".pulumi/meta.json"`,
+		},
+		{
+			desc:    "json/corrupt",
+			file:    "meta.json",
+			give:    `version: 1`,
+			wantErr: `corrupt store: unmarshal ".pulumi/meta.json"`,
+		},
 	}
 
 	for _, tt := range tests {
@@ -147,9 +273,13 @@ func TestEnsurePulumiMeta_corruption(t *testing.T) {
 
 			b := memblob.OpenBucket(nil)
 			ctx := context.Background()
-			require.NoError(t, b.WriteAll(ctx, ".pulumi/meta.yaml", []byte(tt.give), nil))
+			file := tt.file
+			if file == "" {
+				file = "meta.yaml"
+			}
+			require.NoError(t, b.WriteAll(ctx, ".pulumi/"+file, []byte(tt.give), nil))
 
-			_, err := ensurePulumiMeta(context.Background(), b, mapGetenv(nil))
+			_, err := ensurePulumiMeta(context.Background(), b, mapGetenv(nil), nil)
 			assert.ErrorContains(t, err, tt.wantErr)
 		})
 	}
@@ -166,6 +296,31 @@ func TestMeta_roundTrip(t *testing.T) {
 		{desc: "zero", give: pulumiMeta{Version: 0}},
 		{desc: "one", give: pulumiMeta{Version: 1}},
 		{desc: "future", give: pulumiMeta{Version: 42}},
+		{desc: "checksum", give: pulumiMeta{Version: 1, Checksum: "sha256"}},
+		{desc: "json", give: pulumiMeta{Version: 1, Checksum: "sha256", format: metaFormatJSON}},
+		{
+			desc: "secrets provider",
+			give: pulumiMeta{Version: 1, SecretsProvider: &secretsProviderMeta{Type: "passphrase"}},
+		},
+		{
+			desc: "labels",
+			give: pulumiMeta{Version: 1, Description: "Platform team: shared state", Environment: "production"},
+		},
+		{
+			desc: "labels/json",
+			give: pulumiMeta{Version: 1, Description: "Platform team", Environment: "staging", format: metaFormatJSON},
+		},
+		{
+			desc: "secrets provider/json",
+			give: pulumiMeta{
+				Version: 1,
+				SecretsProvider: &secretsProviderMeta{
+					Type: "cloud",
+					URL:  "gcpkms://projects/p/locations/l/keyRings/r/cryptoKeys/k",
+				},
+				format: metaFormatJSON,
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -182,13 +337,98 @@ func TestMeta_roundTrip(t *testing.T) {
 			ctx := context.Background()
 			require.NoError(t, tt.give.WriteTo(ctx, b))
 
-			got, err := ensurePulumiMeta(ctx, b, mapGetenv(nil))
+			got, err := ensurePulumiMeta(ctx, b, mapGetenv(nil), nil)
 			require.NoError(t, err)
 			assert.Equal(t, &tt.give, got)
 		})
 	}
 }
 
+func TestMeta_WriteTo_indent(t *testing.T) {
+	t.Parallel()
+
+	provider := &secretsProviderMeta{Type: "cloud", URL: "awskms://alias/my-key"}
+	tests := []struct {
+		desc   string
+		give   pulumiMeta
+		indent string
+		want   string
+	}{
+		{
+			desc: "yaml/default",
+			give: pulumiMeta{Version: 1, SecretsProvider: provider},
+			want: "version: 1\nsecretsprovider:\n    type: cloud\n    url: awskms://alias/my-key\n",
+		},
+		{
+			desc:   "yaml",
+			give:   pulumiMeta{Version: 1, Checksum: "sha256", SecretsProvider: provider},
+			indent: "2",
+			want:   "version: 1\nchecksum: sha256\nsecretsprovider:\n  type: cloud\n  url: awskms://alias/my-key\n",
+		},
+		{
+			desc:   "json",
+			give:   pulumiMeta{Version: 1, SecretsProvider: provider, format: metaFormatJSON},
+			indent: "2",
+			want: "{\n" +
+				"  \"version\": 1,\n" +
+				"  \"secretsprovider\": {\n" +
+				"    \"type\": \"cloud\",\n" +
+				"    \"url\": \"awskms://alias/my-key\"\n" +
+				"  }\n" +
+				"}\n",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			b := memblob.OpenBucket(nil)
+			require.NoError(t, b.WriteAll(ctx, ".pulumi/foo", []byte("bar"), nil))
+
+			env := mapGetenv(map[string]string{PulumiFilestateMetaIndentEnvVar: tt.indent})
+			indent, err := parseMetaIndent(tt.indent)
+			require.NoError(t, err)
+			tt.give.indent = indent
+			require.NoError(t, tt.give.WriteTo(ctx, b))
+			got, err := b.ReadAll(ctx, tt.give.path())
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(got))
+
+			// The formatted file reads back as the same metadata.
+			meta, err := ensurePulumiMeta(ctx, b, env, nil)
+			require.NoError(t, err)
+			assert.Equal(t, &tt.give, meta)
+		})
+	}
+}
+
+func TestEnsurePulumiMeta_invalidIndent(t *testing.T) {
+	t.Parallel()
+
+	for _, give := range []string{"0", "10", "two"} {
+		_, err := ensurePulumiMeta(context.Background(), memblob.OpenBucket(nil), mapGetenv(map[string]string{
+			PulumiFilestateMetaIndentEnvVar: give,
+		}), nil)
+		assert.ErrorContains(t, err, "must be a number of spaces from 2 to 9", "indent %q", give)
+	}
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestEnsurePulumiMeta_invalidFormat(t *testing.T) {
+	t.Parallel()
+
+	_, err := ensurePulumiMeta(context.Background(), memblob.OpenBucket(nil), mapGetenv(map[string]string{
+		PulumiFilestateMetaFormatEnvVar: "toml",
+	}), nil)
+	assert.ErrorContains(t, err, `invalid PULUMI_SELF_MANAGED_STATE_META_FORMAT: "toml" must be one of yaml, json`)
+}
+
 // Verifies that we don't write a metadata file with version 0.
 func TestMeta_WriteTo_zero(t *testing.T) {
 	t.Parallel()
@@ -222,3 +462,138 @@ func TestNew_noMetaOnInit(t *testing.T) {
 
 	assert.NoFileExists(t, filepath.Join(tmpDir, ".pulumi", "meta.yaml"))
 }
+
+func TestReadMeta(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc string
+		give map[string]string // files in the bucket
+		want Meta
+	}{
+		{
+			desc: "empty",
+			want: Meta{Version: 0, Exists: false},
+		},
+		{
+			desc: "legacy",
+			give: map[string]string{
+				".pulumi/stacks/a.json": `{}`,
+			},
+			want: Meta{Version: 0, Exists: false},
+		},
+		{
+			desc: "version 0",
+			give: map[string]string{
+				".pulumi/meta.yaml": `version: 0`,
+			},
+			want: Meta{Version: 0, Exists: true},
+		},
+		{
+			desc: "version 1",
+			give: map[string]string{
+				".pulumi/meta.yaml": `version: 1`,
+			},
+			want: Meta{Version: 1, Exists: true},
+		},
+		{
+			desc: "labels",
+			give: map[string]string{
+				".pulumi/meta.yaml": "version: 1\ndescription: Platform team\nenvironment: production",
+			},
+			want: Meta{Version: 1, Exists: true, Description: "Platform team", Environment: "production"},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			b := memblob.OpenBucket(nil)
+			ctx := context.Background()
+			for name, body := range tt.give {
+				require.NoError(t, b.WriteAll(ctx, name, []byte(body), nil))
+			}
+
+			got, err := ReadMeta(ctx, b)
+			require.NoError(t, err)
+			assert.Equal(t, &tt.want, got)
+
+			// ReadMeta must never initialize the store.
+			exists, err := b.Exists(ctx, ".pulumi/meta.yaml")
+			require.NoError(t, err)
+			assert.Equal(t, tt.want.Exists, exists)
+		})
+	}
+}
+
+// The description and environment can't make a store unusable.
+func TestEnsurePulumiMeta_labels(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc string
+		file string // defaults to meta.yaml
+		give string // contents of the file
+		want pulumiMeta
+	}{
+		{
+			desc: "text",
+			give: "version: 1\ndescription: |\n  Platform team\n  state\nenvironment: prod\n",
+			want: pulumiMeta{Version: 1, Description: "Platform team\nstate\n", Environment: "prod"},
+		},
+		{
+			desc: "scalars",
+			give: "version: 1\ndescription: 2023\nenvironment: true\n",
+			want: pulumiMeta{Version: 1, Description: "2023", Environment: "true"},
+		},
+		{
+			desc: "not text",
+			give: "version: 2\ndescription: {team: platform}\nenvironment: [prod, eu]\n",
+			want: pulumiMeta{Version: 2},
+		},
+		{
+			desc: "json/not text",
+			file: "meta.json",
+			give: `{"version": 1, "description": {"team": "platform"}, "environment": "prod"}`,
+			want: pulumiMeta{Version: 1, Environment: "prod", format: metaFormatJSON},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			b := memblob.OpenBucket(nil)
+			ctx := context.Background()
+			file := tt.file
+			if file == "" {
+				file = "meta.yaml"
+			}
+			require.NoError(t, b.WriteAll(ctx, ".pulumi/"+file, []byte(tt.give), nil))
+
+			got, err := ensurePulumiMeta(ctx, b, mapGetenv(nil), nil)
+			require.NoError(t, err)
+			assert.Equal(t, &tt.want, got)
+		})
+	}
+
+	// They don't stand in for the version.
+	b := memblob.OpenBucket(nil)
+	require.NoError(t, b.WriteAll(context.Background(), ".pulumi/meta.yaml", []byte(`description: Platform team`), nil))
+	_, err := ensurePulumiMeta(context.Background(), b, mapGetenv(nil), nil)
+	assert.ErrorContains(t, err, `corrupt store: missing version in ".pulumi/meta.yaml"`)
+}
+
+func TestReadMeta_corruption(t *testing.T) {
+	t.Parallel()
+
+	b := memblob.OpenBucket(nil)
+	ctx := context.Background()
+	require.NoError(t, b.WriteAll(ctx, ".pulumi/meta.yaml", []byte(`version: foo`), nil))
+
+	_, err := ReadMeta(ctx, b)
+	assert.ErrorContains(t, err, `corrupt store: unmarshal ".pulumi/meta.yaml"`)
+}
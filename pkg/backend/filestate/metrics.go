@@ -0,0 +1,311 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"gocloud.dev/blob"
+)
+
+// BucketOperation is a kind of request made to the state store.
+type BucketOperation string
+
+const (
+	// BucketRead reads the contents of an object.
+	BucketRead BucketOperation = "read"
+
+	// BucketWrite writes the contents of an object.
+	BucketWrite BucketOperation = "write"
+
+	// BucketCopy copies an object within the state store.
+	BucketCopy BucketOperation = "copy"
+
+	// BucketDelete deletes one or more objects.
+	BucketDelete BucketOperation = "delete"
+
+	// BucketList lists a page of objects.
+	BucketList BucketOperation = "list"
+
+	// BucketAttributes reads the attributes of an object,
+	// e.g. to check whether it exists.
+	BucketAttributes BucketOperation = "attributes"
+)
+
+// Metrics receives measurements of the requests
+// that the filestate backend makes to its state store.
+//
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	// ObserveBucketOperation is called after every request to the state store
+	// with the kind of request, how long it took,
+	// and the error it failed with, if any.
+	//
+	// Every attempt of a retried request is reported separately.
+	// Deleting objects in bulk is reported as a single request.
+	// List requests are only reported for drivers
+	// that support ListOptions.BeforeList, such as s3blob.
+	// The time they take isn't available,
+	// so they're reported with a duration of zero.
+	ObserveBucketOperation(op BucketOperation, duration time.Duration, err error)
+}
+
+// metricsBucket wraps a Bucket, reporting every request made through it to a Metrics.
+type metricsBucket struct {
+	Bucket
+
+	metrics Metrics
+
+	// now returns the current time.
+	// Defaults to time.Now. Overridden in tests.
+	now func() time.Time
+}
+
+var _ Bucket = (*metricsBucket)(nil)
+
+// newMetricsBucket returns a Bucket that reports requests to b to the given Metrics.
+// If metrics is nil, b is returned as is so that there's no overhead.
+func newMetricsBucket(b Bucket, metrics Metrics) Bucket {
+	if metrics == nil {
+		return b
+	}
+	return &metricsBucket{Bucket: b, metrics: metrics, now: time.Now}
+}
+
+// observe reports a request of the given kind that started at the given time.
+func (b *metricsBucket) observe(op BucketOperation, start time.Time, err error) {
+	b.metrics.ObserveBucketOperation(op, b.now().Sub(start), err)
+}
+
+func (b *metricsBucket) Copy(ctx context.Context, dstKey, srcKey string, opts *blob.CopyOptions) error {
+	start := b.now()
+	err := b.Bucket.Copy(ctx, dstKey, srcKey, opts)
+	b.observe(BucketCopy, start, err)
+	return err
+}
+
+func (b *metricsBucket) Delete(ctx context.Context, key string) error {
+	start := b.now()
+	err := b.Bucket.Delete(ctx, key)
+	b.observe(BucketDelete, start, err)
+	return err
+}
+
+func (b *metricsBucket) DeleteBatch(ctx context.Context, keys []string) error {
+	start := b.now()
+	err := deleteBatch(ctx, b.Bucket, keys)
+	if errors.Is(err, errBatchDeleteUnsupported) {
+		// Nothing was requested.
+		return err
+	}
+	b.observe(BucketDelete, start, err)
+	return err
+}
+
+func (b *metricsBucket) ObjectVersion(ctx context.Context, key string) (string, error) {
+	start := b.now()
+	version, err := objectVersion(ctx, b.Bucket, key)
+	if errors.Is(err, errConditionalUnsupported) {
+		return "", err
+	}
+	b.observe(BucketAttributes, start, err)
+	return version, err
+}
+
+func (b *metricsBucket) CopyIfVersion(ctx context.Context, dstKey, srcKey, version string) error {
+	start := b.now()
+	err := copyIfVersion(ctx, b.Bucket, dstKey, srcKey, version)
+	if errors.Is(err, errConditionalUnsupported) {
+		return err
+	}
+	b.observe(BucketCopy, start, err)
+	return err
+}
+
+func (b *metricsBucket) RevisionsEnabled(ctx context.Context) (bool, error) {
+	start := b.now()
+	enabled, err := revisionsEnabled(ctx, b.Bucket)
+	if errors.Is(err, errRevisionsUnsupported) {
+		return false, err
+	}
+	b.observe(BucketAttributes, start, err)
+	return enabled, err
+}
+
+func (b *metricsBucket) ListRevisions(ctx context.Context, key string) ([]objectRevision, error) {
+	start := b.now()
+	revisions, err := listRevisions(ctx, b.Bucket, key)
+	if errors.Is(err, errRevisionsUnsupported) {
+		return nil, err
+	}
+	b.observe(BucketList, start, err)
+	return revisions, err
+}
+
+func (b *metricsBucket) ReadRevision(ctx context.Context, key, id string) ([]byte, error) {
+	start := b.now()
+	byts, err := readRevision(ctx, b.Bucket, key, id)
+	if errors.Is(err, errRevisionsUnsupported) {
+		return nil, err
+	}
+	b.observe(BucketRead, start, err)
+	return byts, err
+}
+
+func (b *metricsBucket) ListPage(
+	ctx context.Context, pageToken []byte, pageSize int, opts *blob.ListOptions,
+) ([]*blob.ListObject, []byte, error) {
+	start := b.now()
+	objs, next, err := listPage(ctx, b.Bucket, pageToken, pageSize, opts)
+	b.observe(BucketList, start, err)
+	return objs, next, err
+}
+
+// NewWriter reports the write when the writer is closed.
+func (b *metricsBucket) NewWriter(ctx context.Context, key string, opts *blob.WriterOptions) (io.WriteCloser, error) {
+	start := b.now()
+	w, err := newBucketWriter(ctx, b.Bucket, key, opts)
+	if err != nil {
+		if !errors.Is(err, errStreamingUnsupported) {
+			b.observe(BucketWrite, start, err)
+		}
+		return nil, err
+	}
+	return &metricsWriteCloser{WriteCloser: w, done: func(err error) {
+		b.observe(BucketWrite, start, err)
+	}}, nil
+}
+
+// NewReader reports the read when the reader is closed.
+func (b *metricsBucket) NewReader(ctx context.Context, key string) (io.ReadCloser, error) {
+	start := b.now()
+	r, err := newBucketReader(ctx, b.Bucket, key)
+	if err != nil {
+		if !errors.Is(err, errStreamingUnsupported) {
+			b.observe(BucketRead, start, err)
+		}
+		return nil, err
+	}
+	return &metricsReadCloser{ReadCloser: r, done: func(err error) {
+		b.observe(BucketRead, start, err)
+	}}, nil
+}
+
+func (b *metricsBucket) List(opts *blob.ListOptions) *blob.ListIterator {
+	// blob.ListIterator can't be wrapped,
+	// but it calls BeforeList before requesting every page.
+	optsCopy := *opts
+	beforeList := opts.BeforeList
+	optsCopy.BeforeList = func(as func(interface{}) bool) error {
+		b.metrics.ObserveBucketOperation(BucketList, 0, nil)
+		if beforeList != nil {
+			return beforeList(as)
+		}
+		return nil
+	}
+	return b.Bucket.List(&optsCopy)
+}
+
+func (b *metricsBucket) ReadAll(ctx context.Context, key string) ([]byte, error) {
+	start := b.now()
+	byts, err := b.Bucket.ReadAll(ctx, key)
+	b.observe(BucketRead, start, err)
+	return byts, err
+}
+
+func (b *metricsBucket) WriteAll(ctx context.Context, key string, p []byte, opts *blob.WriterOptions) error {
+	start := b.now()
+	err := b.Bucket.WriteAll(ctx, key, p, opts)
+	b.observe(BucketWrite, start, err)
+	return err
+}
+
+func (b *metricsBucket) Exists(ctx context.Context, key string) (bool, error) {
+	start := b.now()
+	exists, err := b.Bucket.Exists(ctx, key)
+	b.observe(BucketAttributes, start, err)
+	return exists, err
+}
+
+func (b *metricsBucket) Attributes(ctx context.Context, key string) (*blob.Attributes, error) {
+	start := b.now()
+	attrs, err := b.Bucket.Attributes(ctx, key)
+	b.observe(BucketAttributes, start, err)
+	return attrs, err
+}
+
+// metricsWriteCloser calls done with the first error returned by Write or Close
+// when it's closed.
+type metricsWriteCloser struct {
+	io.WriteCloser
+
+	done func(error)
+
+	err  error
+	once sync.Once
+}
+
+func (w *metricsWriteCloser) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func (w *metricsWriteCloser) Close() error {
+	err := w.WriteCloser.Close()
+	w.once.Do(func() {
+		if w.err == nil {
+			w.err = err
+		}
+		w.done(w.err)
+	})
+	return err
+}
+
+// metricsReadCloser calls done with the first error other than io.EOF
+// returned by Read or Close when it's closed.
+type metricsReadCloser struct {
+	io.ReadCloser
+
+	done func(error)
+
+	err  error
+	once sync.Once
+}
+
+func (r *metricsReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+func (r *metricsReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(func() {
+		if r.err == nil {
+			r.err = err
+		}
+		r.done(r.err)
+	})
+	return err
+}
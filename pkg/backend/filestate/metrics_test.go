@@ -0,0 +1,208 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/memblob"
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+type observedOperation struct {
+	op       BucketOperation
+	duration time.Duration
+	err      error
+}
+
+// recordingMetrics is a Metrics that records all operations.
+type recordingMetrics struct {
+	mu  sync.Mutex
+	ops []observedOperation
+}
+
+func (m *recordingMetrics) ObserveBucketOperation(op BucketOperation, duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ops = append(m.ops, observedOperation{op: op, duration: duration, err: err})
+}
+
+// counts returns the number of operations recorded of each kind.
+func (m *recordingMetrics) counts() map[BucketOperation]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := make(map[BucketOperation]int)
+	for _, o := range m.ops {
+		counts[o.op]++
+	}
+	return counts
+}
+
+func TestNewMetricsBucket_nil(t *testing.T) {
+	t.Parallel()
+
+	b := &wrappedBucket{bucket: memblob.OpenBucket(nil)}
+	assert.Same(t, b, newMetricsBucket(b, nil))
+}
+
+func TestMetricsBucket(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	metrics := &recordingMetrics{}
+	b := newMetricsBucket(
+		&wrappedBucket{bucket: memblob.OpenBucket(nil), streaming: true},
+		metrics,
+	).(*metricsBucket)
+
+	// Every request takes a second.
+	now := time.Unix(0, 0)
+	b.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	require.NoError(t, b.WriteAll(ctx, "a", []byte("foo"), nil))
+	require.NoError(t, b.Copy(ctx, "b", "a", nil))
+	_, err := b.ReadAll(ctx, "b")
+	require.NoError(t, err)
+	_, err = b.Exists(ctx, "b")
+	require.NoError(t, err)
+	require.NoError(t, b.Delete(ctx, "b"))
+
+	_, err = b.ReadAll(ctx, "b")
+	assert.Equal(t, gcerrors.NotFound, gcerrors.Code(err))
+
+	assert.Equal(t, []observedOperation{
+		{op: BucketWrite, duration: time.Second},
+		{op: BucketCopy, duration: time.Second},
+		{op: BucketRead, duration: time.Second},
+		{op: BucketAttributes, duration: time.Second},
+		{op: BucketDelete, duration: time.Second},
+		{op: BucketRead, duration: time.Second, err: err},
+	}, metrics.ops)
+}
+
+// beforeListBucket is a Bucket that calls ListOptions.BeforeList
+// once for every List call, like drivers do for every page.
+type beforeListBucket struct {
+	Bucket
+}
+
+func (b *beforeListBucket) List(opts *blob.ListOptions) *blob.ListIterator {
+	if opts.BeforeList != nil {
+		_ = opts.BeforeList(func(interface{}) bool { return false })
+	}
+	return b.Bucket.List(opts)
+}
+
+func TestMetricsBucket_list(t *testing.T) {
+	t.Parallel()
+
+	metrics := &recordingMetrics{}
+	b := newMetricsBucket(&beforeListBucket{Bucket: &wrappedBucket{bucket: memblob.OpenBucket(nil)}}, metrics)
+
+	var called bool
+	_, err := b.List(&blob.ListOptions{
+		BeforeList: func(func(interface{}) bool) error {
+			called = true
+			return nil
+		},
+	}).Next(context.Background())
+	assert.ErrorIs(t, err, io.EOF)
+
+	assert.True(t, called, "BeforeList of the caller must be called")
+	assert.Equal(t, []observedOperation{{op: BucketList}}, metrics.ops)
+}
+
+func TestMetricsBucket_streaming(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	metrics := &recordingMetrics{}
+	b := newMetricsBucket(&wrappedBucket{bucket: memblob.OpenBucket(nil), streaming: true}, metrics)
+
+	w, err := newBucketWriter(ctx, b, "foo", nil)
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "bar")
+	require.NoError(t, err)
+	assert.Empty(t, metrics.counts(), "writes are reported when closed")
+	require.NoError(t, w.Close())
+
+	r, err := newBucketReader(ctx, b, "foo")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "bar", string(got))
+	require.NoError(t, r.Close())
+	require.NoError(t, r.Close(), "closing twice must not report twice")
+
+	assert.Equal(t, map[BucketOperation]int{BucketWrite: 1, BucketRead: 1}, metrics.counts())
+	for _, o := range metrics.ops {
+		assert.NoError(t, o.err)
+	}
+}
+
+func TestMetricsBucket_unsupported(t *testing.T) {
+	t.Parallel()
+
+	// Operations that the underlying bucket doesn't support
+	// make no requests, so they aren't reported.
+	ctx := context.Background()
+	metrics := &recordingMetrics{}
+	b := newMetricsBucket(&wrappedBucket{bucket: memblob.OpenBucket(nil)}, metrics)
+
+	_, err := newBucketWriter(ctx, b, "foo", nil)
+	assert.True(t, errors.Is(err, errStreamingUnsupported))
+	_, err = newBucketReader(ctx, b, "foo")
+	assert.True(t, errors.Is(err, errStreamingUnsupported))
+	assert.ErrorIs(t, deleteBatch(ctx, b, []string{"foo"}), errBatchDeleteUnsupported)
+	assert.Empty(t, metrics.counts())
+}
+
+func TestMetrics_backend(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	metrics := &recordingMetrics{}
+	b, err := NewWithOptions(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"}, &Options{Metrics: metrics})
+	require.NoError(t, err)
+
+	ref, err := b.ParseStackReference("foo")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+	_, _, err = b.ListStacks(ctx, backend.ListStacksFilter{}, nil)
+	require.NoError(t, err)
+
+	counts := metrics.counts()
+	for _, op := range []BucketOperation{BucketRead, BucketWrite, BucketAttributes} {
+		assert.Positive(t, counts[op], "expected %v requests", op)
+	}
+}
@@ -0,0 +1,1135 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/hashicorp/go-multierror"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag/colors"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// ErrMigrationInProgress is returned by [Migrate]
+// if another migration is already running against the same state store.
+var ErrMigrationInProgress = errors.New("another state store migration is in progress")
+
+// migrationLockPath is the key of the lock held by a running migration.
+//
+// Like storeLockPath, it's directly in lockDir()
+// so that it can't be mistaken for the lock of a stack.
+var migrationLockPath = path.Join(lockDir(), "_migrate.json")
+
+// Migrate upgrades a state store that uses the legacy layout
+// to the project-scoped layout (version 1).
+//
+// Every legacy stack is copied, along with its history and backups,
+// into the project-scoped directory structure.
+// The project of each stack is inferred from the resources in its checkpoint.
+// Only after all copies have been made and the new checkpoints read back successfully
+// is .pulumi/meta.yaml written and are the original files removed.
+// The original checkpoints are kept as .bak files.
+//
+// Migrate is idempotent:
+// it may be run against a store that was already migrated, or partially migrated,
+// and it will pick up where the previous run left off.
+// Its progress is recorded in a journal in the bucket,
+// which [ResumeMigration] can also use to roll back an interrupted migration.
+// If any stack cannot be migrated, no changes are committed and an error is returned.
+//
+// Migrate returns [ErrMigrationInProgress] if another migration
+// is concurrently running against the same bucket,
+// and [ErrStoreLocked] if another operation on the whole store is.
+// It fails if any stack is locked,
+// and stacks can't be locked until the migration finishes.
+//
+// The returned plan describes the moves that were performed,
+// or in dry-run mode, the moves that would be performed.
+func Migrate(ctx context.Context, bucket *blob.Bucket, opts *MigrateOptions) (_ *MigrationPlan, err error) {
+	ctx = withOperationID(ctx)
+	defer func() { err = operationError(ctx, err) }()
+
+	b, err := applyIgnoreList(ctx, &wrappedBucket{bucket: bucket})
+	if err != nil {
+		return nil, err
+	}
+	return migrate(ctx, b, systemClock{}, nil /* stackLocks */, opts)
+}
+
+// MigrateOptions customizes the behavior of [Migrate].
+type MigrateOptions struct {
+	// DryRun reports the moves that the migration would perform
+	// without modifying the bucket.
+	DryRun bool
+
+	// Stdout is where a dry run prints the planned moves.
+	//
+	// Defaults to io.Discard.
+	Stdout io.Writer
+
+	// Events, if non-nil, receives a [ProgressMigrate] event
+	// for every file copied into the new layout.
+	// It is closed when the migration finishes, even if it fails.
+	Events chan<- ProgressEvent
+
+	// OnSkip, if non-nil, lets the migration go ahead without the stacks that can't be migrated,
+	// e.g. because their project can't be determined.
+	// Those stacks are left in the legacy layout and reported to OnSkip
+	// instead of failing the migration.
+	OnSkip func(stack string, err error)
+
+	// WriteReport writes the report of a successful migration
+	// to .pulumi/migration-report.json in the bucket,
+	// replacing the report of any earlier migration.
+	// Dry runs write nothing.
+	WriteReport bool
+}
+
+// MigrationPlan describes the moves that a migration performs.
+// It is safe to serialize to JSON.
+type MigrationPlan struct {
+	// Moves lists each file that is moved, in the order they are moved.
+	Moves []MigrationMove `json:"moves"`
+
+	// TotalBytes is the sum of the sizes of all moved files.
+	TotalBytes int64 `json:"totalBytes"`
+
+	// Unrecognized lists files in the stacks directory
+	// that are not stack checkpoints.
+	// The migration leaves these files in place.
+	Unrecognized []string `json:"unrecognized,omitempty"`
+
+	// Report summarizes the migration.
+	Report *MigrationReport `json:"report,omitempty"`
+}
+
+// MigrationMove is a single file moved by a migration.
+type MigrationMove struct {
+	// Stack is the name of the stack that the file belongs to.
+	Stack string `json:"stack"`
+
+	// Source and Destination are the keys of the file
+	// in the old and new layouts, respectively.
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+
+	// Size is the size of the file in bytes.
+	Size int64 `json:"size"`
+}
+
+// MigrationReportVersion is the version of the format of [MigrationReport].
+// It's incremented whenever fields are removed or change their meaning,
+// but not when fields are added.
+const MigrationReportVersion = 1
+
+// migrationReportPath is the key of the report written with MigrateOptions.WriteReport.
+var migrationReportPath = path.Join(workspace.BookkeepingDir, "migration-report.json")
+
+// MigrationKind is the kind of migration summarized by a [MigrationReport].
+type MigrationKind string
+
+const (
+	// MigrationLayout upgrades a store from the legacy layout with [Migrate].
+	MigrationLayout MigrationKind = "layout"
+
+	// MigrationShardHistory shards the history of a store with [ShardHistory].
+	MigrationShardHistory MigrationKind = "shard-history"
+)
+
+// MigrationReport is a machine-readable summary of a migration,
+// meant to be collected across many state stores.
+type MigrationReport struct {
+	// Version is the version of the format of the report, MigrationReportVersion.
+	Version int `json:"version"`
+
+	// Kind is the kind of migration.
+	Kind MigrationKind `json:"kind"`
+
+	// DryRun is set if the migration was only planned.
+	DryRun bool `json:"dryRun"`
+
+	// FromVersion and ToVersion are the versions of the store
+	// before and after the migration.
+	FromVersion int `json:"fromVersion"`
+	ToVersion   int `json:"toVersion"`
+
+	// Started is when the migration started.
+	Started time.Time `json:"started"`
+
+	// DurationMillis is how long the migration took, in milliseconds.
+	DurationMillis int64 `json:"durationMillis"`
+
+	// Stacks lists the names of the stacks whose files were moved, sorted.
+	Stacks []string `json:"stacks"`
+
+	// FilesMoved and BytesMoved are the number and total size of the files moved.
+	FilesMoved int   `json:"filesMoved"`
+	BytesMoved int64 `json:"bytesMoved"`
+
+	// Skipped lists the files that were left in place because they weren't recognized.
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// finishReport sets the report of the given plan of a migration of the given kind
+// that started at the given time by clk, and writes it to the bucket if asked to.
+// plan may be returned along with an error if the report couldn't be written.
+func finishReport(
+	ctx context.Context, b Bucket, clk clock, opts *MigrateOptions, plan *MigrationPlan,
+	kind MigrationKind, from, to int, started time.Time,
+) (*MigrationPlan, error) {
+	stacks := []string{}
+	seen := make(map[string]struct{})
+	for _, mv := range plan.Moves {
+		if _, ok := seen[mv.Stack]; !ok {
+			seen[mv.Stack] = struct{}{}
+			stacks = append(stacks, mv.Stack)
+		}
+	}
+	sort.Strings(stacks)
+
+	plan.Report = &MigrationReport{
+		Version:        MigrationReportVersion,
+		Kind:           kind,
+		DryRun:         opts.DryRun,
+		FromVersion:    from,
+		ToVersion:      to,
+		Started:        started.UTC(),
+		DurationMillis: clk.Now().Sub(started).Milliseconds(),
+		Stacks:         stacks,
+		FilesMoved:     len(plan.Moves),
+		BytesMoved:     plan.TotalBytes,
+		Skipped:        plan.Unrecognized,
+	}
+	if opts.DryRun || !opts.WriteReport {
+		return plan, nil
+	}
+
+	byts, err := json.Marshal(plan.Report)
+	if err != nil {
+		return plan, err
+	}
+	if err := b.WriteAll(ctx, migrationReportPath, byts, nil); err != nil {
+		return plan, fmt.Errorf("the migration finished, but its report could not be written: %w", err)
+	}
+	return plan, nil
+}
+
+// migrate is Migrate with the given clock,
+// which tells the time of the locks, journal, and report of the migration.
+// The migration doesn't start while stackLocks reports locked stacks;
+// if it's nil, the stack locks kept in the bucket are checked.
+func migrate(
+	ctx context.Context, b Bucket, clk clock, stackLocks func(context.Context) ([]LockInfo, error), opts *MigrateOptions,
+) (*MigrationPlan, error) {
+	if opts == nil {
+		opts = &MigrateOptions{}
+	}
+	started := clk.Now()
+	progress := newProgressReporter(ctx, ProgressMigrate, opts.Events)
+	defer progress.close()
+
+	stdout := opts.Stdout
+	if stdout == nil {
+		stdout = io.Discard
+	}
+
+	meta, err := readPulumiMeta(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+	if meta != nil && meta.Version > maxSupportedVersion {
+		return nil, newStoreTooNewError(meta)
+	}
+	var fromVersion int
+	if meta != nil {
+		fromVersion = meta.Version
+	}
+	// Stores that were already migrated keep their version.
+	toVersion := fromVersion
+	if toVersion < 1 {
+		toVersion = 1
+	}
+
+	// Taking the lock requires a write,
+	// so we don't do that for dry runs.
+	if !opts.DryRun {
+		unlock, err := lockForMigration(ctx, b, clk, stackLocks)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+
+	// Finish an interrupted migration first.
+	// Stacks created since are picked up by the new plan below.
+	journal, err := readMigrationJournal(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+	var resumed []MigrationMove
+	if journal != nil && !opts.DryRun {
+		if err := runMigration(ctx, b, journal, progress); err != nil {
+			return nil, fmt.Errorf("resume interrupted migration: %w", err)
+		}
+		resumed = journal.plan().Moves
+		if meta, err = readPulumiMeta(ctx, b); err != nil {
+			return nil, err
+		}
+	}
+
+	// Stacks are moved to the files named by the template of the store,
+	// which is kept by the new metadata file.
+	keys := defaultKeys
+	if meta != nil {
+		if keys, err = parseKeyTemplate(meta.KeyTemplate); err != nil {
+			return nil, fmt.Errorf("invalid key template in %q: %w", meta.path(), err)
+		}
+	}
+	projectStore := newProjectReferenceStore(b, func() *workspace.Project { return nil }, keys)
+	projectStore.shardHistory = meta != nil && meta.shardsHistory()
+	migrations, unrecognized, err := planMigration(ctx, b, projectStore, opts.OnSkip)
+	if err != nil {
+		return nil, err
+	}
+	plan := newMigrationPlan(migrations, unrecognized)
+	if opts.DryRun {
+		plan.print(stdout)
+		return finishReport(ctx, b, clk, opts, plan, MigrationLayout, fromVersion, toVersion, started)
+	}
+
+	journal = newMigrationJournal(meta, migrations, clk.Now())
+	if err := journal.write(ctx, b); err != nil {
+		return nil, err
+	}
+	if err := runMigration(ctx, b, journal, progress); err != nil {
+		return nil, err
+	}
+	if len(resumed) > 0 {
+		for _, mv := range resumed {
+			plan.TotalBytes += mv.Size
+		}
+		plan.Moves = append(resumed, plan.Moves...)
+	}
+	return finishReport(ctx, b, clk, opts, plan, MigrationLayout, fromVersion, toVersion, started)
+}
+
+// migratedMetaError is returned by migrations
+// whose stacks were copied to the new layout, but that couldn't write the new metadata file.
+// The store is left in the legacy layout.
+type migratedMetaError struct {
+	err error
+}
+
+func (e *migratedMetaError) Error() string {
+	return fmt.Sprintf("write new state metadata file: %v", e.err)
+}
+
+func (e *migratedMetaError) Unwrap() error {
+	return e.err
+}
+
+// runMigration performs the migration recorded in the given journal,
+// skipping the steps that the journal records as done,
+// and deletes the journal once the migration is complete.
+//
+// The journal is updated after each stack is copied and verified,
+// and when the new layout is committed by writing the metadata file.
+func runMigration(ctx context.Context, b Bucket, j *migrationJournal, progress *progressReporter) error {
+	// Copy everything into the new layout first.
+	// The original files remain untouched,
+	// so a failure here leaves the store usable in legacy mode.
+	for i := range j.Stacks {
+		s := &j.Stacks[i]
+		if s.Migrated {
+			continue
+		}
+		for _, mv := range s.Moves {
+			if err := copyIfMissing(ctx, b, mv.Source, mv.Destination); err != nil {
+				return fmt.Errorf("migrate stack %q: %w", s.Name, err)
+			}
+			progress.report(s.Name.String(), mv.Destination, mv.Size)
+		}
+		// Make sure that the new checkpoint is readable
+		// before we record the stack as migrated.
+		if _, err := readCheckpoint(ctx, b, s.checkpoint().Destination); err != nil {
+			return fmt.Errorf("verify migrated stack %q: %w", s.Name, err)
+		}
+		s.Migrated = true
+		if err := j.write(ctx, b); err != nil {
+			return err
+		}
+	}
+
+	if !j.Committed {
+		meta, err := readPulumiMeta(ctx, b)
+		if err != nil {
+			return err
+		}
+		if meta == nil {
+			meta = &pulumiMeta{}
+		}
+		if meta.Version < 1 {
+			// Keep the rest of the metadata, such as the key template
+			// that the migrated stacks were moved to.
+			upgraded := *meta
+			upgraded.Version = 1
+			if err := upgraded.WriteTo(ctx, b); err != nil {
+				return &migratedMetaError{err: err}
+			}
+		}
+		j.Committed = true
+		if err := j.write(ctx, b); err != nil {
+			return err
+		}
+	}
+
+	// The new layout is now live.
+	// Clean up the old files, keeping a backup of each checkpoint.
+	// Files that were already cleaned up by an interrupted migration are skipped.
+	for _, s := range j.Stacks {
+		if exists, err := b.Exists(ctx, s.checkpoint().Source); err != nil || exists {
+			backupTarget(ctx, b, s.checkpoint().Source, false)
+		}
+		for _, mv := range s.Moves[1:] {
+			if err := b.Delete(ctx, mv.Source); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+				logging.V(5).Infof("error deleting migrated object: %v (%v) skipping", mv.Source, err)
+			}
+		}
+	}
+
+	if err := b.Delete(ctx, migrationJournalPath); err != nil {
+		return fmt.Errorf("delete migration journal: %w", err)
+	}
+	return nil
+}
+
+func newMigrationPlan(migrations []*stackMigration, unrecognized []string) *MigrationPlan {
+	plan := MigrationPlan{
+		Moves:        []MigrationMove{},
+		Unrecognized: unrecognized,
+	}
+	for _, m := range migrations {
+		for _, mv := range m.moves() {
+			plan.Moves = append(plan.Moves, MigrationMove{
+				Stack:       m.name.String(),
+				Source:      mv.src,
+				Destination: mv.dst,
+				Size:        mv.size,
+			})
+			plan.TotalBytes += mv.size
+		}
+	}
+	return &plan
+}
+
+// print writes a human-readable description of the plan to w.
+func (p *MigrationPlan) print(w io.Writer) {
+	for _, mv := range p.Moves {
+		fmt.Fprintf(w, "%v -> %v (%d bytes)\n", mv.Source, mv.Destination, mv.Size)
+	}
+	for _, key := range p.Unrecognized {
+		fmt.Fprintf(w, "Unrecognized file will not be migrated: %v\n", key)
+	}
+	fmt.Fprintf(w, "Would move %d file(s) totaling %d bytes\n", len(p.Moves), p.TotalBytes)
+}
+
+// fileMove is a single object that a migration moves from src to dst.
+type fileMove struct {
+	src, dst string
+	size     int64
+}
+
+// stackMigration holds the moves necessary to migrate a single legacy stack.
+type stackMigration struct {
+	name tokens.Name
+
+	// checkpoint is the move for the stack's checkpoint file.
+	checkpoint fileMove
+
+	// auxiliary holds moves for the stack's history and backup files.
+	auxiliary []fileMove
+}
+
+func (m *stackMigration) moves() []fileMove {
+	return append([]fileMove{m.checkpoint}, m.auxiliary...)
+}
+
+// planMigration inspects the legacy stack files in the bucket
+// and decides where in projectStore each of them should be moved.
+// It also reports files in the stacks directory that it does not recognize.
+// It does not modify the bucket.
+//
+// Stacks that can't be migrated fail the plan,
+// unless skip is non-nil, in which case they're reported to skip and left out of the plan.
+func planMigration(
+	ctx context.Context, b Bucket, projectStore *projectReferenceStore, skip func(stack string, err error),
+) (_ []*stackMigration, unrecognized []string, _ error) {
+	files, err := listBucket(ctx, b, StacksDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("list stacks: %w", err)
+	}
+
+	legacyStore := newLegacyReferenceStore(b)
+
+	// sizes maps the keys of all files in the stacks directory to their sizes.
+	sizes := make(map[string]int64, len(files))
+	for _, file := range files {
+		sizes[file.Key] = file.Size
+	}
+	hasKey := func(key string) bool {
+		_, ok := sizes[key]
+		return ok
+	}
+
+	var (
+		migrations []*stackMigration
+		errs       *multierror.Error
+	)
+	fail := func(name tokens.Name, err error) {
+		if skip != nil {
+			skip(string(name), err)
+			return
+		}
+		errs = multierror.Append(errs, fmt.Errorf("stack %q: %w", name, err))
+	}
+	for _, file := range files {
+		if file.IsDir {
+			continue
+		}
+
+		name, ok := legacyStackName(objectName(file))
+		if !ok {
+			switch {
+			case strings.HasSuffix(file.Key, ".bak"):
+				// Backups of checkpoints are expected to be left behind.
+			case strings.HasSuffix(file.Key, checksumExt) && hasKey(strings.TrimSuffix(file.Key, checksumExt)):
+				// Checksums are moved alongside their checkpoints.
+			case strings.HasSuffix(file.Key, stackMetaSuffix) &&
+				(hasKey(strings.TrimSuffix(file.Key, stackMetaSuffix)+".json") ||
+					hasKey(strings.TrimSuffix(file.Key, stackMetaSuffix)+".json"+encoding.GZIPExt)):
+				// So is the metadata of stacks.
+			case strings.HasSuffix(file.Key, stackTagsSuffix) &&
+				(hasKey(strings.TrimSuffix(file.Key, stackTagsSuffix)+".json") ||
+					hasKey(strings.TrimSuffix(file.Key, stackTagsSuffix)+".json"+encoding.GZIPExt)):
+				// And their tags.
+			default:
+				unrecognized = append(unrecognized, file.Key)
+			}
+			continue
+		}
+
+		bytes, err := b.ReadAll(ctx, file.Key)
+		if err != nil {
+			fail(name, fmt.Errorf("read: %w", err))
+			continue
+		}
+		// Don't carry a corrupted checkpoint over to the new layout.
+		if err := verifyChecksum(ctx, b, file.Key, bytes); err != nil {
+			fail(name, err)
+			continue
+		}
+		chk, err := decodeCheckpoint(bytes)
+		if err != nil {
+			fail(name, fmt.Errorf("read: %w", err))
+			continue
+		}
+		project := guessProject(chk)
+		if project == "" {
+			fail(name, errors.New("no project found"))
+			continue
+		}
+		if err := validateNamePath("project", project); err != nil {
+			fail(name, err)
+			continue
+		}
+
+		oldRef := legacyStore.newReference(name)
+		newRef := projectStore.newReference(project, name)
+
+		m := &stackMigration{
+			name: name,
+			checkpoint: fileMove{
+				src:  file.Key,
+				size: file.Size,
+				// Keep the extension of the original (e.g. ".json" or ".json.gz").
+				dst: filepath.ToSlash(newRef.StackBasePath()) + strings.TrimPrefix(objectName(file), string(name)),
+			},
+		}
+		if sumKey := checksumPath(file.Key); hasKey(sumKey) {
+			m.auxiliary = append(m.auxiliary, fileMove{
+				src:  sumKey,
+				dst:  checksumPath(m.checkpoint.dst),
+				size: sizes[sumKey],
+			})
+		}
+		for _, keys := range [][2]string{
+			{stackMetaPath(oldRef), stackMetaPath(newRef)},
+			{stackTagsPath(oldRef), stackTagsPath(newRef)},
+		} {
+			if hasKey(keys[0]) {
+				m.auxiliary = append(m.auxiliary, fileMove{src: keys[0], dst: keys[1], size: sizes[keys[0]]})
+			}
+		}
+		history, err := planDirMoves(ctx, b, oldRef.HistoryDir(), newRef.HistoryFile)
+		if err != nil {
+			fail(name, err)
+			continue
+		}
+		backups, err := planDirMoves(ctx, b, oldRef.BackupDir(), func(name string) string {
+			return filepath.Join(newRef.BackupDir(), name)
+		})
+		if err != nil {
+			fail(name, err)
+			continue
+		}
+		m.auxiliary = append(m.auxiliary, history...)
+		m.auxiliary = append(m.auxiliary, backups...)
+		migrations = append(migrations, m)
+	}
+
+	if err := errs.ErrorOrNil(); err != nil {
+		return nil, nil, fmt.Errorf("cannot migrate state store: %w", err)
+	}
+	return migrations, unrecognized, nil
+}
+
+// legacyStackName reports the name of the stack stored in a legacy checkpoint file
+// with the given base name, e.g. "foo" for "foo.json" or "foo.json.gz".
+// It returns false if the file is not a checkpoint file,
+// e.g. because it holds the tags of a stack.
+func legacyStackName(objName string) (tokens.Name, bool) {
+	objName = strings.TrimSuffix(objName, encoding.GZIPExt)
+	ext := filepath.Ext(objName)
+	if ext != ".json" {
+		return "", false
+	}
+	name := strings.TrimSuffix(objName, ext)
+	if !tokens.IsName(name) || validateNamePath("stack", tokens.Name(name)) != nil ||
+		strings.HasSuffix(name, reservedStackSuffix) {
+		return "", false
+	}
+	return tokens.Name(name), true
+}
+
+// planDirMoves plans moves for all files in srcDir
+// to the keys that dst returns for their names.
+func planDirMoves(ctx context.Context, b Bucket, srcDir string, dst func(name string) string) ([]fileMove, error) {
+	files, err := listBucket(ctx, b, srcDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var moves []fileMove
+	for _, file := range files {
+		if file.IsDir {
+			continue
+		}
+		moves = append(moves, fileMove{
+			src:  file.Key,
+			dst:  filepath.ToSlash(dst(objectName(file))),
+			size: file.Size,
+		})
+	}
+	return moves, nil
+}
+
+// copyIfMissing copies src to dst unless dst already exists with the same contents.
+// It fails if dst exists with different contents.
+//
+// This makes it safe to re-run a migration that was interrupted partway through.
+func copyIfMissing(ctx context.Context, b Bucket, src, dst string) error {
+	dstBytes, err := b.ReadAll(ctx, dst)
+	if err != nil {
+		if gcerrors.Code(err) != gcerrors.NotFound {
+			return fmt.Errorf("read %q: %w", dst, err)
+		}
+		if err := b.Copy(ctx, dst, src, nil); err != nil {
+			return fmt.Errorf("copy %q to %q: %w", src, dst, err)
+		}
+		return nil
+	}
+
+	srcBytes, err := b.ReadAll(ctx, src)
+	if err != nil {
+		return fmt.Errorf("read %q: %w", src, err)
+	}
+	if !bytes.Equal(srcBytes, dstBytes) {
+		return fmt.Errorf("%q already exists with different contents than %q", dst, src)
+	}
+	return nil
+}
+
+// lockForMigration takes the locks that a migration holds while it modifies the bucket,
+// timestamped by clk.
+// It fails if stackLocks reports locked stacks,
+// or if it's nil, if there are stack locks in the bucket.
+// The returned function releases them.
+func lockForMigration(
+	ctx context.Context, b Bucket, clk clock, stackLocks func(context.Context) ([]LockInfo, error),
+) (unlock func(), _ error) {
+	// Stacks that are being updated would be left behind.
+	if stackLocks == nil {
+		locker := &blobLocker{bucket: b, clock: clk, d: diag.DefaultSink(io.Discard, io.Discard, diag.FormatOptions{
+			Color: colors.Never,
+		})}
+		stackLocks = locker.listLocks
+	}
+	_, unlockStore, err := lockStore(ctx, b, clk, "migration", stackLocks)
+	if err != nil {
+		return nil, err
+	}
+
+	// Older versions of the CLI only know about migration locks.
+	unlockMigration, err := lockMigration(ctx, b, clk)
+	if err != nil {
+		unlockStore()
+		return nil, err
+	}
+	return func() {
+		unlockMigration()
+		unlockStore()
+	}, nil
+}
+
+// lockMigration records that a migration is running against the bucket.
+// It returns ErrMigrationInProgress if another migration holds the lock.
+//
+// The returned function releases the lock.
+func lockMigration(ctx context.Context, b Bucket, clk clock) (unlock func(), _ error) {
+	if err := checkMigrationLock(ctx, b, ""); err != nil {
+		return nil, err
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	owner, err := newLockInfo(clk.Now())
+	if err != nil {
+		return nil, err
+	}
+	byts, err := json.Marshal(storeLock{LockInfo: owner, ID: id.String(), Operation: "migration"})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.WriteAll(ctx, migrationLockPath, byts, nil); err != nil {
+		return nil, fmt.Errorf("write migration lock: %w", err)
+	}
+	unlock = func() {
+		if err := b.Delete(ctx, migrationLockPath); err != nil {
+			logging.V(5).Infof("error deleting migration lock: %v (%v)", migrationLockPath, err)
+		}
+	}
+
+	// Check again in case another migration started at the same time.
+	if err := checkMigrationLock(ctx, b, id.String()); err != nil {
+		// If another migration replaced our lock, it's theirs to release.
+		return nil, err
+	}
+	return unlock, nil
+}
+
+// checkMigrationLock returns ErrMigrationInProgress
+// if the migration lock is held, unless it's held with the given ID.
+func checkMigrationLock(ctx context.Context, b Bucket, ours string) error {
+	content, err := b.ReadAll(ctx, migrationLockPath)
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil
+		}
+		return fmt.Errorf("read migration lock: %w", err)
+	}
+
+	var l storeLock
+	if err := json.Unmarshal(content, &l); err != nil {
+		return fmt.Errorf("%w:\n  %v", ErrMigrationInProgress, migrationLockPath)
+	}
+	if ours != "" && l.ID == ours {
+		return nil
+	}
+	return fmt.Errorf("%w:\n  %v: created by %v@%v (pid %v) at %v", ErrMigrationInProgress,
+		migrationLockPath, l.Username, l.Hostname, l.Pid, l.Timestamp.Format(time.RFC3339))
+}
+
+// migrationJournalPath is the key of the journal of a migration that hasn't finished.
+var migrationJournalPath = path.Join(workspace.BookkeepingDir, "migration.json")
+
+// ErrMigrationCommitted is returned by [ResumeMigration]
+// when asked to roll back a migration that already switched the store to the new layout.
+var ErrMigrationCommitted = errors.New("the migration was already committed")
+
+// migrationJournal records the progress of a migration
+// so that it can be resumed or rolled back if it's interrupted.
+type migrationJournal struct {
+	Started time.Time `json:"started"`
+
+	// StartVersion is the version of the store when the migration started.
+	StartVersion int `json:"startVersion"`
+
+	// Committed is set once the metadata file was written,
+	// after which the store uses the new layout.
+	Committed bool `json:"committed"`
+
+	Stacks []migrationJournalStack `json:"stacks"`
+}
+
+type migrationJournalStack struct {
+	Name tokens.Name `json:"name"`
+
+	// Moves are the files of the stack to move.
+	// The first one is the checkpoint of the stack.
+	Moves []MigrationMove `json:"moves"`
+
+	// Migrated is set once all files of the stack were copied
+	// and its new checkpoint was read back successfully.
+	Migrated bool `json:"migrated"`
+}
+
+func (s *migrationJournalStack) checkpoint() MigrationMove {
+	return s.Moves[0]
+}
+
+// newMigrationJournal returns the journal of a migration of the store with the given metadata
+// that started at the given time.
+func newMigrationJournal(meta *pulumiMeta, migrations []*stackMigration, started time.Time) *migrationJournal {
+	j := migrationJournal{
+		Started: started,
+		Stacks:  make([]migrationJournalStack, 0, len(migrations)),
+	}
+	if meta != nil {
+		j.StartVersion = meta.Version
+	}
+	plan := newMigrationPlan(migrations, nil)
+	for _, m := range migrations {
+		s := migrationJournalStack{Name: m.name}
+		for _, mv := range plan.Moves {
+			if mv.Stack == m.name.String() {
+				s.Moves = append(s.Moves, mv)
+			}
+		}
+		j.Stacks = append(j.Stacks, s)
+	}
+	return &j
+}
+
+// readMigrationJournal returns the journal of an unfinished migration,
+// or nil if there isn't one.
+func readMigrationJournal(ctx context.Context, b Bucket) (*migrationJournal, error) {
+	byts, err := b.ReadAll(ctx, migrationJournalPath)
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read migration journal: %w", err)
+	}
+	var j migrationJournal
+	if err := json.Unmarshal(byts, &j); err != nil {
+		return nil, fmt.Errorf("malformed migration journal %v: %w", migrationJournalPath, err)
+	}
+	for _, s := range j.Stacks {
+		if len(s.Moves) == 0 {
+			return nil, fmt.Errorf("malformed migration journal %v: no checkpoint for stack %q",
+				migrationJournalPath, s.Name)
+		}
+	}
+	return &j, nil
+}
+
+func (j *migrationJournal) write(ctx context.Context, b Bucket) error {
+	byts, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	if err := b.WriteAll(ctx, migrationJournalPath, byts, nil); err != nil {
+		return fmt.Errorf("write migration journal: %w", err)
+	}
+	return nil
+}
+
+// plan returns the moves recorded in the journal.
+func (j *migrationJournal) plan() *MigrationPlan {
+	plan := MigrationPlan{Moves: []MigrationMove{}}
+	for _, s := range j.Stacks {
+		for _, mv := range s.Moves {
+			plan.Moves = append(plan.Moves, mv)
+			plan.TotalBytes += mv.Size
+		}
+	}
+	return &plan
+}
+
+// ResumeMigration finishes a migration started by [Migrate]
+// that didn't run to completion, e.g. because the process was killed,
+// or with the Rollback option, undoes it.
+//
+// Migrations record their progress in a journal in the bucket.
+// Resuming skips the stacks that the journal records as migrated,
+// and verifies each remaining stack before recording it.
+// Rolling back deletes the copies made in the new layout
+// and leaves the store as it was before the migration,
+// which is only possible until the migration switched the store to the new layout.
+// Otherwise it returns [ErrMigrationCommitted], and the migration can only be resumed.
+//
+// ResumeMigration is idempotent.
+// It returns a nil plan if there's no unfinished migration,
+// or else the moves of the migration.
+func ResumeMigration(
+	ctx context.Context, bucket *blob.Bucket, opts *ResumeMigrationOptions,
+) (_ *MigrationPlan, err error) {
+	ctx = withOperationID(ctx)
+	defer func() { err = operationError(ctx, err) }()
+
+	b, err := applyIgnoreList(ctx, &wrappedBucket{bucket: bucket})
+	if err != nil {
+		return nil, err
+	}
+	return resumeMigration(ctx, b, systemClock{}, opts)
+}
+
+// ResumeMigrationOptions customizes the behavior of [ResumeMigration].
+type ResumeMigrationOptions struct {
+	// Rollback undoes the migration instead of finishing it.
+	Rollback bool
+}
+
+func resumeMigration(
+	ctx context.Context, b Bucket, clk clock, opts *ResumeMigrationOptions,
+) (*MigrationPlan, error) {
+	if opts == nil {
+		opts = &ResumeMigrationOptions{}
+	}
+
+	unlock, err := lockForMigration(ctx, b, clk, nil /* stackLocks */)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	journal, err := readMigrationJournal(ctx, b)
+	if err != nil || journal == nil {
+		return nil, err
+	}
+	if opts.Rollback {
+		err = rollbackMigration(ctx, b, journal)
+	} else {
+		err = runMigration(ctx, b, journal, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return journal.plan(), nil
+}
+
+// rollbackMigration deletes the files copied by the migration in the given journal,
+// and then the journal.
+func rollbackMigration(ctx context.Context, b Bucket, j *migrationJournal) error {
+	// The metadata file is written before the journal records the commit,
+	// so check it as well.
+	meta, err := readPulumiMeta(ctx, b)
+	if err != nil {
+		return err
+	}
+	if j.Committed || j.StartVersion >= 1 || (meta != nil && meta.Version >= 1) {
+		return ErrMigrationCommitted
+	}
+
+	var errs *multierror.Error
+	for _, s := range j.Stacks {
+		for _, mv := range s.Moves {
+			// Never delete the only copy of a file.
+			exists, err := b.Exists(ctx, mv.Source)
+			if err != nil {
+				errs = multierror.Append(errs, fmt.Errorf("check %q: %w", mv.Source, err))
+				continue
+			}
+			if !exists {
+				continue
+			}
+			if err := b.Delete(ctx, mv.Destination); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+				errs = multierror.Append(errs, fmt.Errorf("delete %q: %w", mv.Destination, err))
+			}
+		}
+	}
+	if err := errs.ErrorOrNil(); err != nil {
+		return err
+	}
+
+	if err := b.Delete(ctx, migrationJournalPath); err != nil {
+		return fmt.Errorf("delete migration journal: %w", err)
+	}
+	return nil
+}
+
+// ErrAmbiguousLayout is returned by [RepairMeta]
+// if the layout of a state store can't be inferred from its files.
+var ErrAmbiguousLayout = errors.New("the layout of the state store is ambiguous")
+
+// RepairMeta rewrites the metadata file of a state store
+// that lost it, e.g. because it was deleted by accident.
+// Without the file, stores with project-scoped stacks are read as legacy stores,
+// so their stacks can't be found.
+//
+// The version of the store is inferred from the layout of the checkpoint files of its stacks,
+// and checksums are kept if checkpoint files have them.
+// If the store has checkpoint files in both layouts, or none at all,
+// RepairMeta returns [ErrAmbiguousLayout] and changes nothing.
+// Encrypted stores can't be repaired:
+// the encryption settings were only kept in the metadata file.
+//
+// The metadata file is only written if opts.Confirm approves the inferred repair.
+// Legacy stores don't have a metadata file,
+// so if the store is inferred to be one, nothing is written or confirmed.
+func RepairMeta(ctx context.Context, bucket *blob.Bucket, opts *RepairMetaOptions) (_ *MetaRepair, err error) {
+	ctx = withOperationID(ctx)
+	defer func() { err = operationError(ctx, err) }()
+
+	b, err := applyIgnoreList(ctx, &wrappedBucket{bucket: bucket})
+	if err != nil {
+		return nil, err
+	}
+	return repairMeta(ctx, b, opts)
+}
+
+// RepairMetaOptions customizes the behavior of [RepairMeta].
+type RepairMetaOptions struct {
+	// Confirm is called with the inferred repair before the metadata file is written.
+	// The file is written only if it returns true.
+	//
+	// If Confirm is nil, the repair is inferred but not written.
+	Confirm func(*MetaRepair) bool
+}
+
+// MetaRepair describes the metadata file inferred by [RepairMeta].
+type MetaRepair struct {
+	// Version is the inferred version of the state store.
+	Version int `json:"version"`
+
+	// Checksum is the algorithm of the checksums of checkpoint files, if any.
+	Checksum string `json:"checksum,omitempty"`
+
+	// Stacks lists the checkpoint files that the version was inferred from.
+	Stacks []string `json:"stacks"`
+
+	// Written reports whether the metadata file was written.
+	Written bool `json:"written"`
+}
+
+func repairMeta(ctx context.Context, b Bucket, opts *RepairMetaOptions) (*MetaRepair, error) {
+	if opts == nil {
+		opts = &RepairMetaOptions{}
+	}
+
+	meta, err := readPulumiMeta(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+	if meta != nil {
+		return nil, fmt.Errorf("state store already has a metadata file at %v", meta.path())
+	}
+
+	// Legacy checkpoint files are directly in the stacks directory,
+	// and project-scoped ones are in a directory for their project.
+	var legacyFiles, projectFiles []string
+	var checksums bool
+	iter := b.List(&blob.ListOptions{Prefix: StacksDir + "/"})
+	for {
+		obj, err := nextObject(ctx, b, iter)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("list stacks: %w", err)
+		}
+
+		rel := strings.Split(strings.TrimPrefix(obj.Key, StacksDir+"/"), "/")
+		name := rel[len(rel)-1]
+		if strings.HasSuffix(name, checksumExt) {
+			checksums = true
+			continue
+		}
+		if _, ok := legacyStackName(name); !ok {
+			continue
+		}
+		switch len(rel) {
+		case 1:
+			legacyFiles = append(legacyFiles, obj.Key)
+		case 2:
+			if validateNamePath("project", tokens.Name(rel[0])) == nil {
+				projectFiles = append(projectFiles, obj.Key)
+			}
+		}
+	}
+
+	repair := &MetaRepair{}
+	switch {
+	case len(legacyFiles) > 0 && len(projectFiles) > 0:
+		// This is also what a migration that was interrupted leaves behind.
+		return nil, fmt.Errorf("%w: found checkpoint files of both layouts "+
+			"(legacy: %v; project-scoped: %v); "+
+			"if 'pulumi state upgrade' was interrupted, run it again instead",
+			ErrAmbiguousLayout, strings.Join(legacyFiles, ", "), strings.Join(projectFiles, ", "))
+	case len(projectFiles) > 0:
+		repair.Version = 1
+		repair.Stacks = projectFiles
+	case len(legacyFiles) > 0:
+		repair.Version = 0
+		repair.Stacks = legacyFiles
+	default:
+		return nil, fmt.Errorf("%w: found no checkpoint files", ErrAmbiguousLayout)
+	}
+	if checksums {
+		repair.Checksum = sha256Checksum
+	}
+
+	for _, key := range repair.Stacks {
+		byts, err := b.ReadAll(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("read %v: %w", key, err)
+		}
+		if isEncryptedCheckpoint(byts) {
+			return nil, fmt.Errorf("%v is encrypted: "+
+				"the encryption settings of the state store were lost with its metadata file", key)
+		}
+	}
+
+	if repair.Version == 0 || opts.Confirm == nil || !opts.Confirm(repair) {
+		return repair, nil
+	}
+	meta = &pulumiMeta{Version: repair.Version, Checksum: repair.Checksum}
+	if err := meta.WriteTo(ctx, b); err != nil {
+		return nil, fmt.Errorf("write metadata file: %w", err)
+	}
+	repair.Written = true
+	return repair, nil
+}
@@ -0,0 +1,695 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/fileblob"
+	"gocloud.dev/blob/memblob"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+)
+
+// legacyCheckpoint is a checkpoint for a stack in the project "proj".
+const legacyCheckpoint = `{
+	"latest": {
+		"resources": [
+			{
+				"type": "package:module:resource",
+				"urn": "urn:pulumi:stack::proj::package:module:resource::name"
+			}
+		]
+	}
+}`
+
+func writeFiles(t *testing.T, b *blob.Bucket, files map[string]string) {
+	t.Helper()
+
+	ctx := context.Background()
+	for name, body := range files {
+		require.NoError(t, b.WriteAll(ctx, name, []byte(body), nil), "write %q", name)
+	}
+}
+
+func assertExists(t *testing.T, b *blob.Bucket, key string) {
+	t.Helper()
+
+	exists, err := b.Exists(context.Background(), key)
+	require.NoError(t, err)
+	assert.True(t, exists, "%q does not exist", key)
+}
+
+func assertNotExists(t *testing.T, b *blob.Bucket, key string) {
+	t.Helper()
+
+	exists, err := b.Exists(context.Background(), key)
+	require.NoError(t, err)
+	assert.False(t, exists, "%q exists", key)
+}
+
+func TestMigrate(t *testing.T) {
+	t.Parallel()
+
+	tmpDir := t.TempDir()
+	b, err := fileblob.OpenBucket(tmpDir, nil)
+	require.NoError(t, err)
+	writeFiles(t, b, map[string]string{
+		".pulumi/stacks/a.json":                       legacyCheckpoint,
+		".pulumi/stacks/b.json.gz":                    legacyCheckpoint,
+		".pulumi/history/a/a-1.history.json":          "{}",
+		".pulumi/history/a/a-1.checkpoint.json":       legacyCheckpoint,
+		".pulumi/backups/a/a.1.json":                  legacyCheckpoint,
+		".pulumi/stacks/unrelated.txt":                "foo",
+		".pulumi/stacks/proj/already-migrated.json":   legacyCheckpoint,
+		".pulumi/history/proj/already-migrated/x.txt": "bar",
+	})
+
+	ctx := context.Background()
+	_, err = Migrate(ctx, b, nil)
+	require.NoError(t, err)
+
+	meta, err := readPulumiMeta(ctx, &wrappedBucket{bucket: b})
+	require.NoError(t, err)
+	assert.Equal(t, &pulumiMeta{Version: 1}, meta)
+	assertNotExists(t, b, migrationJournalPath)
+
+	for _, key := range []string{
+		".pulumi/stacks/proj/a.json",
+		".pulumi/stacks/proj/b.json.gz",
+		".pulumi/history/proj/a/a-1.history.json",
+		".pulumi/history/proj/a/a-1.checkpoint.json",
+		".pulumi/backups/proj/a/a.1.json",
+		// Originals are kept as backups.
+		".pulumi/stacks/a.json.bak",
+		".pulumi/stacks/b.json.gz.bak",
+		// Unrelated files are left alone.
+		".pulumi/stacks/unrelated.txt",
+	} {
+		assertExists(t, b, key)
+	}
+	for _, key := range []string{
+		".pulumi/stacks/a.json",
+		".pulumi/stacks/b.json.gz",
+		".pulumi/history/a/a-1.history.json",
+		".pulumi/backups/a/a.1.json",
+	} {
+		assertNotExists(t, b, key)
+	}
+
+	// The migrated stacks should be visible to a new backend.
+	be, err := New(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(tmpDir), nil)
+	require.NoError(t, err)
+	ref, err := be.ParseStackReference("organization/proj/a")
+	require.NoError(t, err)
+	stack, err := be.GetStack(ctx, ref)
+	require.NoError(t, err)
+	require.NotNil(t, stack)
+
+	// Running the migration again should be a no-op.
+	_, err = Migrate(ctx, b, nil)
+	require.NoError(t, err)
+}
+
+func TestMigrate_report(t *testing.T) {
+	t.Parallel()
+
+	b := memblob.OpenBucket(nil)
+	writeFiles(t, b, map[string]string{
+		".pulumi/stacks/b.json":              legacyCheckpoint,
+		".pulumi/stacks/a.json":              legacyCheckpoint,
+		".pulumi/stacks/notes.txt":           "hello",
+		".pulumi/history/a/a-1.history.json": "{}",
+	})
+
+	ctx := context.Background()
+	before := time.Now().UTC()
+	plan, err := Migrate(ctx, b, &MigrateOptions{WriteReport: true})
+	require.NoError(t, err)
+
+	byts, err := b.ReadAll(ctx, migrationReportPath)
+	require.NoError(t, err)
+	var report MigrationReport
+	require.NoError(t, json.Unmarshal(byts, &report))
+	assert.Equal(t, plan.Report, &report)
+
+	size := int64(len(legacyCheckpoint))
+	assert.Equal(t, MigrationReportVersion, report.Version)
+	assert.Equal(t, MigrationLayout, report.Kind)
+	assert.False(t, report.DryRun)
+	assert.Equal(t, 0, report.FromVersion)
+	assert.Equal(t, 1, report.ToVersion)
+	assert.False(t, report.Started.Before(before.Truncate(time.Second)))
+	assert.GreaterOrEqual(t, report.DurationMillis, int64(0))
+	assert.Equal(t, []string{"a", "b"}, report.Stacks)
+	assert.Equal(t, 3, report.FilesMoved)
+	assert.Equal(t, 2*size+2, report.BytesMoved)
+	assert.Equal(t, []string{".pulumi/stacks/notes.txt"}, report.Skipped)
+
+	// Migrating again has nothing to move, and replaces the report.
+	plan, err = Migrate(ctx, b, &MigrateOptions{WriteReport: true})
+	require.NoError(t, err)
+	assert.Equal(t, 1, plan.Report.FromVersion)
+	assert.Empty(t, plan.Report.Stacks)
+	byts, err = b.ReadAll(ctx, migrationReportPath)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(byts, &report))
+	assert.Equal(t, 0, report.FilesMoved)
+}
+
+func TestMigrate_events(t *testing.T) {
+	t.Parallel()
+
+	b := memblob.OpenBucket(nil)
+	writeFiles(t, b, map[string]string{
+		".pulumi/stacks/a.json":              legacyCheckpoint,
+		".pulumi/history/a/a-1.history.json": "{}",
+	})
+
+	events := make(chan ProgressEvent, 10)
+	plan, err := Migrate(context.Background(), b, &MigrateOptions{Events: events})
+	require.NoError(t, err)
+
+	var got []ProgressEvent
+	for ev := range events {
+		got = append(got, ev)
+	}
+	assert.Equal(t, []ProgressEvent{
+		{
+			Operation: ProgressMigrate,
+			Stack:     "a",
+			Key:       ".pulumi/stacks/proj/a.json",
+			Files:     1,
+			Bytes:     int64(len(legacyCheckpoint)),
+		},
+		{
+			Operation: ProgressMigrate,
+			Stack:     "a",
+			Key:       ".pulumi/history/proj/a/a-1.history.json",
+			Files:     2,
+			Bytes:     plan.TotalBytes,
+		},
+	}, got)
+}
+
+// The events channel is closed even if the migration fails.
+func TestMigrate_eventsClosedOnError(t *testing.T) {
+	t.Parallel()
+
+	b := memblob.OpenBucket(nil)
+	writeFiles(t, b, map[string]string{
+		".pulumi/meta.yaml": "version: 100",
+	})
+
+	events := make(chan ProgressEvent, 10)
+	_, err := Migrate(context.Background(), b, &MigrateOptions{Events: events})
+	require.Error(t, err)
+
+	_, ok := <-events
+	assert.False(t, ok, "events channel was not closed")
+}
+
+func TestMigrate_partial(t *testing.T) {
+	t.Parallel()
+
+	// A previous migration was interrupted after copying a.json
+	// but before writing meta.yaml.
+	b := memblob.OpenBucket(nil)
+	writeFiles(t, b, map[string]string{
+		".pulumi/stacks/a.json":      legacyCheckpoint,
+		".pulumi/stacks/proj/a.json": legacyCheckpoint,
+		".pulumi/stacks/b.json":      legacyCheckpoint,
+	})
+
+	ctx := context.Background()
+	_, err := Migrate(ctx, b, nil)
+	require.NoError(t, err)
+
+	assertExists(t, b, ".pulumi/meta.yaml")
+	assertExists(t, b, ".pulumi/stacks/proj/a.json")
+	assertExists(t, b, ".pulumi/stacks/proj/b.json")
+	assertNotExists(t, b, ".pulumi/stacks/a.json")
+	assertNotExists(t, b, ".pulumi/stacks/b.json")
+}
+
+// interruptedMigration sets up a bucket with a migration of the legacy stacks a and b
+// that was interrupted after a was migrated.
+func interruptedMigration(t *testing.T) *blob.Bucket {
+	b := memblob.OpenBucket(nil)
+	writeFiles(t, b, map[string]string{
+		".pulumi/stacks/a.json":              legacyCheckpoint,
+		".pulumi/stacks/b.json":              legacyCheckpoint,
+		".pulumi/history/b/b-1.history.json": "{}",
+	})
+
+	ctx := context.Background()
+	wb := &wrappedBucket{bucket: b}
+	migrations, _, err := planMigration(ctx, wb, newProjectReferenceStore(wb, nil, nil), nil /* skip */)
+	require.NoError(t, err)
+	journal := newMigrationJournal(nil, migrations, time.Now())
+	require.Len(t, journal.Stacks, 2)
+	require.Equal(t, tokens.Name("a"), journal.Stacks[0].Name)
+	require.NoError(t, copyIfMissing(ctx, wb, ".pulumi/stacks/a.json", ".pulumi/stacks/proj/a.json"))
+	journal.Stacks[0].Migrated = true
+	require.NoError(t, journal.write(ctx, wb))
+	return b
+}
+
+func TestResumeMigration(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b := interruptedMigration(t)
+	plan, err := ResumeMigration(ctx, b, nil)
+	require.NoError(t, err)
+	require.NotNil(t, plan)
+	assert.Len(t, plan.Moves, 3)
+
+	meta, err := readPulumiMeta(ctx, &wrappedBucket{bucket: b})
+	require.NoError(t, err)
+	assert.Equal(t, &pulumiMeta{Version: 1}, meta)
+	assertNotExists(t, b, migrationJournalPath)
+	assertExists(t, b, ".pulumi/stacks/proj/a.json")
+	assertExists(t, b, ".pulumi/stacks/proj/b.json")
+	assertExists(t, b, ".pulumi/history/proj/b/b-1.history.json")
+	assertNotExists(t, b, ".pulumi/stacks/a.json")
+	assertNotExists(t, b, ".pulumi/stacks/b.json")
+
+	// There's nothing left to resume.
+	plan, err = ResumeMigration(ctx, b, nil)
+	require.NoError(t, err)
+	assert.Nil(t, plan)
+	plan, err = ResumeMigration(ctx, b, &ResumeMigrationOptions{Rollback: true})
+	require.NoError(t, err)
+	assert.Nil(t, plan)
+}
+
+func TestResumeMigration_rollback(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b := interruptedMigration(t)
+	_, err := ResumeMigration(ctx, b, &ResumeMigrationOptions{Rollback: true})
+	require.NoError(t, err)
+
+	assertNotExists(t, b, migrationJournalPath)
+	assertNotExists(t, b, ".pulumi/meta.yaml")
+	assertNotExists(t, b, ".pulumi/stacks/proj/a.json")
+	assertExists(t, b, ".pulumi/stacks/a.json")
+	assertExists(t, b, ".pulumi/stacks/b.json")
+	assertExists(t, b, ".pulumi/history/b/b-1.history.json")
+}
+
+func TestResumeMigration_rollbackCommitted(t *testing.T) {
+	t.Parallel()
+
+	// The metadata file was written, but the journal doesn't record it yet.
+	ctx := context.Background()
+	b := interruptedMigration(t)
+	require.NoError(t, (&pulumiMeta{Version: 1}).WriteTo(ctx, &wrappedBucket{bucket: b}))
+
+	_, err := ResumeMigration(ctx, b, &ResumeMigrationOptions{Rollback: true})
+	assert.ErrorIs(t, err, ErrMigrationCommitted)
+	assertExists(t, b, migrationJournalPath)
+	assertExists(t, b, ".pulumi/stacks/proj/a.json")
+
+	// It can still be resumed.
+	_, err = ResumeMigration(ctx, b, nil)
+	require.NoError(t, err)
+	assertExists(t, b, ".pulumi/stacks/proj/b.json")
+	assertNotExists(t, b, migrationJournalPath)
+}
+
+func TestMigrate_resume(t *testing.T) {
+	t.Parallel()
+
+	// Migrate finishes the interrupted migration along with stacks created since.
+	ctx := context.Background()
+	b := interruptedMigration(t)
+	writeFiles(t, b, map[string]string{".pulumi/stacks/c.json": legacyCheckpoint})
+	plan, err := Migrate(ctx, b, nil)
+	require.NoError(t, err)
+	assert.Len(t, plan.Moves, 4)
+
+	assertNotExists(t, b, migrationJournalPath)
+	for _, stack := range []string{"a", "b", "c"} {
+		assertExists(t, b, ".pulumi/stacks/proj/"+stack+".json")
+		assertNotExists(t, b, ".pulumi/stacks/"+stack+".json")
+	}
+}
+
+func TestMigrate_conflict(t *testing.T) {
+	t.Parallel()
+
+	b := memblob.OpenBucket(nil)
+	writeFiles(t, b, map[string]string{
+		".pulumi/stacks/a.json":      legacyCheckpoint,
+		".pulumi/stacks/proj/a.json": `{"latest": {}}`,
+	})
+
+	ctx := context.Background()
+	_, err := Migrate(ctx, b, nil)
+	assert.ErrorContains(t, err, "already exists with different contents")
+
+	// Nothing should have been committed.
+	assertNotExists(t, b, ".pulumi/meta.yaml")
+	assertExists(t, b, ".pulumi/stacks/a.json")
+}
+
+func TestMigrate_noProject(t *testing.T) {
+	t.Parallel()
+
+	b := memblob.OpenBucket(nil)
+	writeFiles(t, b, map[string]string{
+		".pulumi/stacks/a.json": legacyCheckpoint,
+		".pulumi/stacks/b.json": `{"latest": {"resources": []}}`,
+	})
+
+	ctx := context.Background()
+	_, err := Migrate(ctx, b, nil)
+	assert.ErrorContains(t, err, `stack "b": no project found`)
+
+	// Nothing should have been copied or committed.
+	assertNotExists(t, b, ".pulumi/meta.yaml")
+	assertNotExists(t, b, ".pulumi/stacks/proj/a.json")
+	assertExists(t, b, ".pulumi/stacks/a.json")
+}
+
+func TestMigrate_unsafeProject(t *testing.T) {
+	t.Parallel()
+
+	// The project is taken from the URN
+	// which is not limited to valid names.
+	b := memblob.OpenBucket(nil)
+	writeFiles(t, b, map[string]string{
+		".pulumi/stacks/meta.json": strings.Replace(legacyCheckpoint, "::proj::", "::..::", 1),
+	})
+
+	ctx := context.Background()
+	_, err := Migrate(ctx, b, nil)
+	assert.ErrorContains(t, err, `stack "meta": project name ".." is not allowed`)
+
+	assertNotExists(t, b, ".pulumi/meta.json")
+	assertNotExists(t, b, ".pulumi/meta.yaml")
+	assertExists(t, b, ".pulumi/stacks/meta.json")
+}
+
+func TestMigrate_futureVersion(t *testing.T) {
+	t.Parallel()
+
+	b := memblob.OpenBucket(nil)
+	writeFiles(t, b, map[string]string{
+		".pulumi/meta.yaml":     "version: 42",
+		".pulumi/stacks/a.json": legacyCheckpoint,
+	})
+
+	_, err := Migrate(context.Background(), b, nil)
+	assert.ErrorContains(t, err, "'meta.yaml' version (42) is not supported")
+	assert.ErrorIs(t, err, ErrStoreTooNew)
+}
+
+func TestMigrate_concurrent(t *testing.T) {
+	t.Parallel()
+
+	b := memblob.OpenBucket(nil)
+	writeFiles(t, b, map[string]string{
+		".pulumi/stacks/a.json": legacyCheckpoint,
+		// Another migration is running.
+		".pulumi/locks/_migrate.json": `{"id": "other", "username": "alice", "hostname": "example.com", "pid": 42}`,
+	})
+
+	_, err := Migrate(context.Background(), b, nil)
+	assert.ErrorIs(t, err, ErrMigrationInProgress)
+	assert.ErrorContains(t, err, "created by alice@example.com (pid 42)")
+	assertExists(t, b, ".pulumi/stacks/a.json")
+	assertNotExists(t, b, ".pulumi/stacks/proj/a.json")
+}
+
+func TestMigrate_dryRun(t *testing.T) {
+	t.Parallel()
+
+	b := memblob.OpenBucket(nil)
+	writeFiles(t, b, map[string]string{
+		".pulumi/stacks/a.json":              legacyCheckpoint,
+		".pulumi/stacks/a.json.bak":          legacyCheckpoint,
+		".pulumi/stacks/notes.txt":           "hello",
+		".pulumi/history/a/a-1.history.json": "{}",
+	})
+
+	var out bytes.Buffer
+	ctx := context.Background()
+	plan, err := Migrate(ctx, b, &MigrateOptions{DryRun: true, Stdout: &out, WriteReport: true})
+	require.NoError(t, err)
+
+	size := int64(len(legacyCheckpoint))
+	report := plan.Report
+	require.NotNil(t, report)
+	assert.True(t, report.DryRun)
+	assert.Equal(t, []string{"a"}, report.Stacks)
+	assert.Equal(t, 2, report.FilesMoved)
+	assert.Equal(t, size+2, report.BytesMoved)
+	assert.Equal(t, []string{".pulumi/stacks/notes.txt"}, report.Skipped)
+	plan.Report = nil
+	assert.Equal(t, &MigrationPlan{
+		Moves: []MigrationMove{
+			{
+				Stack:       "a",
+				Source:      ".pulumi/stacks/a.json",
+				Destination: ".pulumi/stacks/proj/a.json",
+				Size:        size,
+			},
+			{
+				Stack:       "a",
+				Source:      ".pulumi/history/a/a-1.history.json",
+				Destination: ".pulumi/history/proj/a/a-1.history.json",
+				Size:        2,
+			},
+		},
+		TotalBytes:   size + 2,
+		Unrecognized: []string{".pulumi/stacks/notes.txt"},
+	}, plan)
+
+	assert.Equal(t,
+		fmt.Sprintf(".pulumi/stacks/a.json -> .pulumi/stacks/proj/a.json (%d bytes)\n", size)+
+			".pulumi/history/a/a-1.history.json -> .pulumi/history/proj/a/a-1.history.json (2 bytes)\n"+
+			"Unrecognized file will not be migrated: .pulumi/stacks/notes.txt\n"+
+			fmt.Sprintf("Would move 2 file(s) totaling %d bytes\n", size+2),
+		out.String())
+
+	// Nothing should have changed.
+	assertNotExists(t, b, migrationReportPath)
+	assertNotExists(t, b, ".pulumi/meta.yaml")
+	assertNotExists(t, b, ".pulumi/stacks/proj/a.json")
+	assertExists(t, b, ".pulumi/stacks/a.json")
+	assertExists(t, b, ".pulumi/history/a/a-1.history.json")
+}
+
+func TestMigrate_checksums(t *testing.T) {
+	t.Parallel()
+
+	b := memblob.OpenBucket(nil)
+	writeFiles(t, b, map[string]string{
+		".pulumi/stacks/a.json":        legacyCheckpoint,
+		".pulumi/stacks/a.json.sha256": computeChecksum([]byte(legacyCheckpoint)) + "\n",
+	})
+
+	ctx := context.Background()
+	plan, err := Migrate(ctx, b, nil)
+	require.NoError(t, err)
+	assert.Empty(t, plan.Unrecognized)
+
+	assertExists(t, b, ".pulumi/stacks/proj/a.json")
+	assertExists(t, b, ".pulumi/stacks/proj/a.json.sha256")
+	assertNotExists(t, b, ".pulumi/stacks/a.json.sha256")
+}
+
+func TestMigrate_checksumMismatch(t *testing.T) {
+	t.Parallel()
+
+	b := memblob.OpenBucket(nil)
+	writeFiles(t, b, map[string]string{
+		".pulumi/stacks/a.json":        legacyCheckpoint,
+		".pulumi/stacks/a.json.sha256": computeChecksum([]byte("something else")) + "\n",
+	})
+
+	_, err := Migrate(context.Background(), b, nil)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+
+	// Nothing should have been copied or committed.
+	assertNotExists(t, b, ".pulumi/meta.yaml")
+	assertNotExists(t, b, ".pulumi/stacks/proj/a.json")
+}
+
+func TestRepairMeta(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+	b, err := fileblob.OpenBucket(tmpDir, nil)
+	require.NoError(t, err)
+	writeFiles(t, b, map[string]string{
+		".pulumi/stacks/proj/a.json":        legacyCheckpoint,
+		".pulumi/stacks/proj/a.json.sha256": "0000",
+		".pulumi/stacks/proj/a.json.bak":    legacyCheckpoint,
+	})
+	want := &MetaRepair{
+		Version:  1,
+		Checksum: "sha256",
+		Stacks:   []string{".pulumi/stacks/proj/a.json"},
+	}
+
+	// Nothing is written without confirmation.
+	repair, err := RepairMeta(ctx, b, nil)
+	require.NoError(t, err)
+	assert.Equal(t, want, repair)
+	repair, err = RepairMeta(ctx, b, &RepairMetaOptions{
+		Confirm: func(*MetaRepair) bool { return false },
+	})
+	require.NoError(t, err)
+	assert.False(t, repair.Written)
+	assertNotExists(t, b, ".pulumi/meta.yaml")
+
+	repair, err = RepairMeta(ctx, b, &RepairMetaOptions{
+		Confirm: func(r *MetaRepair) bool {
+			assert.Equal(t, want, r)
+			return true
+		},
+	})
+	require.NoError(t, err)
+	assert.True(t, repair.Written)
+
+	meta, err := readPulumiMeta(ctx, &wrappedBucket{bucket: b})
+	require.NoError(t, err)
+	assert.Equal(t, &pulumiMeta{Version: 1, Checksum: "sha256"}, meta)
+
+	// The metadata file is never overwritten.
+	_, err = RepairMeta(ctx, b, nil)
+	assert.ErrorContains(t, err, "already has a metadata file")
+}
+
+func TestRepairMeta_notRepaired(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc    string
+		files   map[string]string
+		wantErr error
+		wantMsg string
+	}{
+		{
+			desc: "both layouts",
+			files: map[string]string{
+				".pulumi/stacks/a.json":      legacyCheckpoint,
+				".pulumi/stacks/proj/b.json": legacyCheckpoint,
+			},
+			wantErr: ErrAmbiguousLayout,
+			wantMsg: "legacy: .pulumi/stacks/a.json; project-scoped: .pulumi/stacks/proj/b.json",
+		},
+		{
+			desc: "no stacks",
+			files: map[string]string{
+				".pulumi/stacks/unrelated.txt": "foo",
+			},
+			wantErr: ErrAmbiguousLayout,
+			wantMsg: "found no checkpoint files",
+		},
+		{
+			desc: "encrypted",
+			files: map[string]string{
+				".pulumi/stacks/proj/a.json": string(encryptedCheckpointPrefix) + "ciphertext",
+			},
+			wantMsg: "the encryption settings of the state store were lost",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			b, err := fileblob.OpenBucket(t.TempDir(), nil)
+			require.NoError(t, err)
+			writeFiles(t, b, tt.files)
+
+			_, err = RepairMeta(context.Background(), b, &RepairMetaOptions{
+				Confirm: func(*MetaRepair) bool {
+					t.Error("unexpected confirmation")
+					return true
+				},
+			})
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			}
+			assert.ErrorContains(t, err, tt.wantMsg)
+			assertNotExists(t, b, ".pulumi/meta.yaml")
+		})
+	}
+}
+
+func TestRepairMeta_legacy(t *testing.T) {
+	t.Parallel()
+
+	b, err := fileblob.OpenBucket(t.TempDir(), nil)
+	require.NoError(t, err)
+	writeFiles(t, b, map[string]string{".pulumi/stacks/a.json": legacyCheckpoint})
+
+	// Legacy stores have no metadata file, so there's nothing to confirm.
+	repair, err := RepairMeta(context.Background(), b, &RepairMetaOptions{
+		Confirm: func(*MetaRepair) bool {
+			t.Error("unexpected confirmation")
+			return true
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &MetaRepair{Version: 0, Stacks: []string{".pulumi/stacks/a.json"}}, repair)
+	assertNotExists(t, b, ".pulumi/meta.yaml")
+}
+
+// Migration locks aren't mistaken for the locks of a legacy stack named like them.
+func TestMigrationLock_legacyStack(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	stateDir := t.TempDir()
+	bucket, err := fileblob.OpenBucket(stateDir, nil)
+	require.NoError(t, err)
+	writeFiles(t, bucket, map[string]string{".pulumi/stacks/_migrate.json": legacyCheckpoint})
+
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), nil, nil)
+	require.NoError(t, err)
+	ref, err := b.parseStackReference("_migrate")
+	require.NoError(t, err)
+
+	unlock, err := lockMigration(ctx, b.bucket, systemClock{})
+	require.NoError(t, err)
+	defer unlock()
+
+	require.NoError(t, b.Lock(ctx, ref))
+	defer b.Unlock(ctx, ref)
+	locks, err := b.ListLocks(ctx)
+	require.NoError(t, err)
+	require.Len(t, locks, 1)
+	assert.Equal(t, tokens.QName("_migrate"), locks[0].Stack)
+}
@@ -0,0 +1,245 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
+)
+
+// mirrorBucket wraps a primary Bucket
+// and replicates all modifications to a mirror bucket.
+//
+// Modifications are applied to the primary bucket first.
+// Failures to modify the mirror are reported as warnings
+// but don't fail the operation,
+// so the mirror may fall behind the primary bucket.
+// Copies and streamed writes replicate the object as it is in the primary bucket,
+// so the mirror catches up with objects that it missed earlier.
+//
+// Reads are served by the primary bucket.
+// If fallback is set, reads of single objects that fail for reasons
+// other than the object not existing are retried against the mirror.
+// Listings are never served by the mirror.
+// Neither are attributes because they're used to verify writes to the primary bucket.
+type mirrorBucket struct {
+	Bucket // primary
+
+	mirror   Bucket
+	d        diag.Sink
+	fallback bool
+}
+
+var _ Bucket = (*mirrorBucket)(nil)
+
+func (b *mirrorBucket) warnMirror(op, key string, err error) {
+	b.d.Warningf(diag.Message("", "Could not %v %v in the mirror state store: %v"), op, key, err)
+}
+
+func (b *mirrorBucket) operationTimeout() time.Duration {
+	return operationTimeout(b.Bucket)
+}
+
+func (b *mirrorBucket) WriteAll(ctx context.Context, key string, p []byte, opts *blob.WriterOptions) error {
+	if err := b.Bucket.WriteAll(ctx, key, p, opts); err != nil {
+		return err
+	}
+	if err := b.mirror.WriteAll(ctx, key, p, opts); err != nil {
+		b.warnMirror("write", key, err)
+	}
+	return nil
+}
+
+func (b *mirrorBucket) Copy(ctx context.Context, dstKey, srcKey string, opts *blob.CopyOptions) error {
+	if err := b.Bucket.Copy(ctx, dstKey, srcKey, opts); err != nil {
+		return err
+	}
+	b.replicate(ctx, dstKey)
+	return nil
+}
+
+// CopyIfVersion replaces the object in the primary bucket conditionally.
+// Versions are specific to the primary bucket,
+// so the mirror is replaced unconditionally.
+func (b *mirrorBucket) CopyIfVersion(ctx context.Context, dstKey, srcKey, version string) error {
+	if err := copyIfVersion(ctx, b.Bucket, dstKey, srcKey, version); err != nil {
+		return err
+	}
+	b.replicate(ctx, dstKey)
+	return nil
+}
+
+// NewWriter streams the object to the primary bucket,
+// and replicates it to the mirror once it's committed.
+func (b *mirrorBucket) NewWriter(ctx context.Context, key string, opts *blob.WriterOptions) (io.WriteCloser, error) {
+	w, err := newBucketWriter(ctx, b.Bucket, key, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &mirrorWriter{WriteCloser: w, commit: func() { b.replicate(ctx, key) }}, nil
+}
+
+// mirrorWriter is a writer to the primary bucket
+// that calls commit once the object was written.
+type mirrorWriter struct {
+	io.WriteCloser
+
+	commit func()
+}
+
+func (w *mirrorWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	w.commit()
+	return nil
+}
+
+// replicate writes the object with the given key to the mirror
+// as it is in the primary bucket,
+// rather than replaying the modification of the primary bucket in the mirror,
+// which would fail if the mirror missed the objects it depends on.
+func (b *mirrorBucket) replicate(ctx context.Context, key string) {
+	if err := b.replicateObject(ctx, key); err != nil {
+		b.warnMirror("write", key, err)
+	}
+}
+
+func (b *mirrorBucket) replicateObject(ctx context.Context, key string) error {
+	attrs, err := b.Bucket.Attributes(ctx, key)
+	if err != nil {
+		return err
+	}
+	opts := &blob.WriterOptions{ContentType: attrs.ContentType, Metadata: attrs.Metadata}
+
+	r, err := newBucketReader(ctx, b.Bucket, key)
+	if err == nil {
+		defer contract.IgnoreClose(r)
+		_, err = streamTemp(ctx, b.mirror, key, func(w io.Writer) error {
+			_, err := io.Copy(w, r)
+			return err
+		}, opts)
+		if !errors.Is(err, errStreamingUnsupported) {
+			return err
+		}
+		// Read the object again below, since the mirror can't stream it.
+	} else if !errors.Is(err, errStreamingUnsupported) {
+		return err
+	}
+
+	byts, err := b.Bucket.ReadAll(ctx, key)
+	if err != nil {
+		return err
+	}
+	return b.mirror.WriteAll(ctx, key, byts, opts)
+}
+
+func (b *mirrorBucket) ObjectVersion(ctx context.Context, key string) (string, error) {
+	return objectVersion(ctx, b.Bucket, key)
+}
+
+// Prior versions of objects are only read from the primary bucket.
+func (b *mirrorBucket) RevisionsEnabled(ctx context.Context) (bool, error) {
+	return revisionsEnabled(ctx, b.Bucket)
+}
+
+func (b *mirrorBucket) ListRevisions(ctx context.Context, key string) ([]objectRevision, error) {
+	return listRevisions(ctx, b.Bucket, key)
+}
+
+func (b *mirrorBucket) ReadRevision(ctx context.Context, key, id string) ([]byte, error) {
+	return readRevision(ctx, b.Bucket, key, id)
+}
+
+func (b *mirrorBucket) ListPage(
+	ctx context.Context, pageToken []byte, pageSize int, opts *blob.ListOptions,
+) ([]*blob.ListObject, []byte, error) {
+	return listPage(ctx, b.Bucket, pageToken, pageSize, opts)
+}
+
+func (b *mirrorBucket) Delete(ctx context.Context, key string) error {
+	if err := b.Bucket.Delete(ctx, key); err != nil {
+		return err
+	}
+	if err := b.mirror.Delete(ctx, key); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+		b.warnMirror("delete", key, err)
+	}
+	return nil
+}
+
+func (b *mirrorBucket) DeleteBatch(ctx context.Context, keys []string) error {
+	if err := deleteBatch(ctx, b.Bucket, keys); err != nil {
+		// If the primary can't delete in bulk,
+		// the caller falls back to Delete which also handles the mirror.
+		return err
+	}
+	if err := deleteAll(ctx, b.mirror, keys, defaultDeleteConcurrency); err != nil {
+		b.warnMirror("delete", fmt.Sprintf("%d objects", len(keys)), err)
+	}
+	return nil
+}
+
+// useFallback reports whether a read from the primary bucket
+// that failed with the given error should be retried against the mirror.
+func (b *mirrorBucket) useFallback(err error) bool {
+	return b.fallback && err != nil && gcerrors.Code(err) != gcerrors.NotFound
+}
+
+func (b *mirrorBucket) ReadAll(ctx context.Context, key string) ([]byte, error) {
+	byts, err := b.Bucket.ReadAll(ctx, key)
+	if !b.useFallback(err) {
+		return byts, err
+	}
+	mbyts, merr := b.mirror.ReadAll(ctx, key)
+	if merr != nil {
+		return nil, err
+	}
+	b.d.Warningf(diag.Message("", "Read %v from the mirror state store because the primary failed: %v"), key, err)
+	return mbyts, nil
+}
+
+func (b *mirrorBucket) NewReader(ctx context.Context, key string) (io.ReadCloser, error) {
+	r, err := newBucketReader(ctx, b.Bucket, key)
+	if errors.Is(err, errStreamingUnsupported) || !b.useFallback(err) {
+		return r, err
+	}
+	mr, merr := newBucketReader(ctx, b.mirror, key)
+	if merr != nil {
+		return nil, err
+	}
+	b.d.Warningf(diag.Message("", "Read %v from the mirror state store because the primary failed: %v"), key, err)
+	return mr, nil
+}
+
+func (b *mirrorBucket) Exists(ctx context.Context, key string) (bool, error) {
+	exists, err := b.Bucket.Exists(ctx, key)
+	if !b.useFallback(err) {
+		return exists, err
+	}
+	mexists, merr := b.mirror.Exists(ctx, key)
+	if merr != nil {
+		return false, err
+	}
+	return mexists, nil
+}
@@ -0,0 +1,228 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/memblob"
+	"google.golang.org/api/googleapi"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag/colors"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+func TestMirror(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	stateDir, mirrorDir := t.TempDir(), t.TempDir()
+	b, err := NewWithOptions(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+		&workspace.Project{Name: "proj"},
+		&Options{MirrorURL: "file://" + filepath.ToSlash(mirrorDir)})
+	require.NoError(t, err)
+
+	ref, err := b.ParseStackReference("foo")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+	require.NoError(t, b.(*localBackend).addToHistory(ctx, ref.(*localBackendReference),
+		backend.UpdateInfo{Kind: apitype.UpdateUpdate}))
+
+	assert.FileExists(t, filepath.Join(mirrorDir, ".pulumi", "meta.yaml"))
+	assert.FileExists(t, filepath.Join(mirrorDir, ".pulumi", "stacks", "proj", "foo.json"))
+	history, err := filepath.Glob(filepath.Join(mirrorDir, ".pulumi", "history", "proj", "foo", "*.json"))
+	require.NoError(t, err)
+	assert.Len(t, history, 2, "expected history and checkpoint files")
+
+	// Removals are mirrored too.
+	foo, err := b.GetStack(ctx, ref)
+	require.NoError(t, err)
+	_, err = b.RemoveStack(ctx, foo, true /* force */)
+	require.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(mirrorDir, ".pulumi", "stacks", "proj", "foo.json"))
+}
+
+func TestMirror_env(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	stateDir, mirrorDir := t.TempDir(), t.TempDir()
+	_, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+		&workspace.Project{Name: "proj"},
+		&localBackendOptions{Getenv: mapGetenv(map[string]string{
+			"PULUMI_SELF_MANAGED_STATE_MIRROR_URL": "file://" + filepath.ToSlash(mirrorDir),
+		})})
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(mirrorDir, ".pulumi", "meta.yaml"))
+}
+
+func TestMirror_sameURL(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	_, err := NewWithOptions(context.Background(), diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+		nil, &Options{MirrorURL: "file://" + filepath.ToSlash(stateDir)})
+	assert.ErrorContains(t, err, "is the same as the state store URL")
+}
+
+func TestMirrorBucket_mirrorFailure(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	var buff bytes.Buffer
+	primary := &wrappedBucket{bucket: memblob.OpenBucket(nil)}
+	b := &mirrorBucket{
+		Bucket: primary,
+		mirror: &flakyBucket{
+			Bucket:   &wrappedBucket{bucket: memblob.OpenBucket(nil)},
+			err:      &googleapi.Error{Code: http.StatusServiceUnavailable},
+			failures: 10,
+		},
+		d: diag.DefaultSink(io.Discard, &buff, diag.FormatOptions{Color: colors.Never}),
+	}
+
+	require.NoError(t, b.WriteAll(ctx, "foo", []byte("bar"), nil))
+	assert.Contains(t, buff.String(), "Could not write foo in the mirror state store")
+
+	got, err := primary.ReadAll(ctx, "foo")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("bar"), got)
+}
+
+// Copies repair objects that the mirror missed.
+func TestMirrorBucket_copyRepairs(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mirror := &wrappedBucket{bucket: memblob.OpenBucket(nil)}
+	b := &mirrorBucket{
+		Bucket: &md5ConditionalBucket{Bucket: &wrappedBucket{bucket: memblob.OpenBucket(nil)}},
+		mirror: &flakyBucket{
+			Bucket:   mirror,
+			err:      &googleapi.Error{Code: http.StatusServiceUnavailable},
+			failures: 1,
+		},
+		d: diagtest.LogSink(t),
+	}
+
+	require.NoError(t, b.WriteAll(ctx, "foo", []byte("bar"), &blob.WriterOptions{ContentType: "application/json"}))
+	exists, err := mirror.Exists(ctx, "foo")
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	require.NoError(t, b.Copy(ctx, "foo.bak", "foo", nil))
+	require.NoError(t, b.WriteAll(ctx, "baz", []byte("qux"), nil))
+	version, err := b.ObjectVersion(ctx, "baz")
+	require.NoError(t, err)
+	require.NoError(t, b.CopyIfVersion(ctx, "baz", "foo", version))
+	for _, key := range []string{"foo.bak", "baz"} {
+		got, err := mirror.ReadAll(ctx, key)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("bar"), got)
+		attrs, err := mirror.Attributes(ctx, key)
+		require.NoError(t, err)
+		assert.Equal(t, "application/json", attrs.ContentType)
+	}
+}
+
+// Streamed writes are replicated to the mirror.
+func TestMirrorBucket_stream(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	for _, mirrorStreams := range []bool{true, false} {
+		mirror := &wrappedBucket{bucket: memblob.OpenBucket(nil), streaming: mirrorStreams}
+		b := &mirrorBucket{
+			Bucket: &wrappedBucket{bucket: memblob.OpenBucket(nil), streaming: true},
+			mirror: mirror,
+			d:      diagtest.LogSink(t),
+		}
+
+		w, err := b.NewWriter(ctx, "foo", nil)
+		require.NoError(t, err)
+		_, err = io.WriteString(w, "bar")
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+		got, err := mirror.ReadAll(ctx, "foo")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("bar"), got, "mirror streams: %v", mirrorStreams)
+
+		r, err := b.NewReader(ctx, "foo")
+		require.NoError(t, err)
+		got, err = io.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		assert.Equal(t, []byte("bar"), got)
+	}
+}
+
+func TestMirrorBucket_fallback(t *testing.T) {
+	t.Parallel()
+
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable}
+	newBucket := func(t *testing.T, fallback bool) *mirrorBucket {
+		mirror := &wrappedBucket{bucket: memblob.OpenBucket(nil)}
+		require.NoError(t, mirror.WriteAll(context.Background(), "foo", []byte("bar"), nil))
+		return &mirrorBucket{
+			Bucket: &flakyBucket{
+				Bucket:   &wrappedBucket{bucket: memblob.OpenBucket(nil)},
+				err:      unavailable,
+				failures: 10,
+			},
+			mirror:   mirror,
+			d:        diagtest.LogSink(t),
+			fallback: fallback,
+		}
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := newBucket(t, false).ReadAll(context.Background(), "foo")
+		assert.ErrorIs(t, err, unavailable)
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		t.Parallel()
+
+		got, err := newBucket(t, true).ReadAll(context.Background(), "foo")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("bar"), got)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		t.Parallel()
+
+		// Missing files are never read from the mirror.
+		b := newBucket(t, true)
+		b.Bucket = &wrappedBucket{bucket: memblob.OpenBucket(nil)}
+		_, err := b.ReadAll(context.Background(), "foo")
+		assert.Error(t, err)
+	})
+}
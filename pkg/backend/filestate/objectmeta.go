@@ -0,0 +1,103 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gocloud.dev/blob"
+)
+
+// Metadata attached to checkpoint files.
+const (
+	stackMetadataKey        = "pulumi-stack"
+	projectMetadataKey      = "pulumi-project"
+	storeVersionMetadataKey = "pulumi-store-version"
+)
+
+// Content types of checkpoint files.
+const (
+	checkpointContentType          = "application/json"
+	encryptedCheckpointContentType = "application/octet-stream"
+)
+
+// parseCheckpointMetadata parses the value of PULUMI_SELF_MANAGED_STATE_CHECKPOINT_METADATA:
+// a comma-separated list of key=value pairs.
+func parseCheckpointMetadata(s string) (map[string]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	md := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid %v: %q is not a key=value pair",
+				PulumiFilestateCheckpointMetadataEnvVar, pair)
+		}
+		md[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return md, nil
+}
+
+// validateCheckpointMetadata reports whether the given metadata
+// can be attached to checkpoint files.
+func validateCheckpointMetadata(md map[string]string) error {
+	seen := make(map[string]string, len(md))
+	for k := range md {
+		lower := strings.ToLower(k)
+		switch {
+		case k == "":
+			return fmt.Errorf("invalid checkpoint metadata: keys must not be empty")
+		case strings.HasPrefix(lower, "pulumi-"):
+			return fmt.Errorf("invalid checkpoint metadata key %q: the pulumi- prefix is reserved", k)
+		}
+		if other, ok := seen[lower]; ok {
+			return fmt.Errorf("invalid checkpoint metadata: keys %q and %q differ only in case", other, k)
+		}
+		seen[lower] = k
+	}
+	return nil
+}
+
+// checkpointWriterOptions returns the options used to write the checkpoint file of the given stack.
+// Files are labeled with the stack they belong to and the metadata configured for the backend
+// so that lifecycle rules of the storage provider can target them.
+func (b *localBackend) checkpointWriterOptions(
+	ref *localBackendReference, compressed, encrypted bool,
+) *blob.WriterOptions {
+	md := make(map[string]string, len(b.checkpointMetadata)+3)
+	for k, v := range b.checkpointMetadata {
+		md[k] = v
+	}
+	md[stackMetadataKey] = ref.name.String()
+	if ref.project != "" {
+		md[projectMetadataKey] = ref.project.String()
+	}
+	md[storeVersionMetadataKey] = strconv.Itoa(b.meta.Version)
+
+	opts := &blob.WriterOptions{ContentType: checkpointContentType, Metadata: md}
+	switch {
+	case encrypted:
+		// The file is still compressed, but only underneath the encryption.
+		// Don't let the storage provider try to decompress it.
+		opts.ContentType = encryptedCheckpointContentType
+	case compressed:
+		opts.ContentEncoding = "gzip"
+	}
+	return opts
+}
@@ -0,0 +1,129 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+func TestSaveCheckpoint_metadata(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc         string
+		env          map[string]string
+		wantEncoding string
+		wantMetadata map[string]string
+	}{
+		{desc: "default"},
+		{
+			desc: "custom",
+			env: map[string]string{
+				PulumiFilestateCheckpointMetadataEnvVar: "team=infra, cost-center = 42",
+			},
+			wantMetadata: map[string]string{"team": "infra", "cost-center": "42"},
+		},
+		{
+			desc:         "gzip",
+			env:          map[string]string{PulumiFilestateGzipEnvVar: "true"},
+			wantEncoding: "gzip",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			b, ref := newSnapshotBackend(t, tt.env)
+			_, file, err := b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 1))
+			require.NoError(t, err)
+
+			attrs, err := b.bucket.Attributes(ctx, file)
+			require.NoError(t, err)
+			assert.Equal(t, "application/json", attrs.ContentType)
+			assert.Equal(t, tt.wantEncoding, attrs.ContentEncoding)
+
+			want := map[string]string{
+				"pulumi-stack":         "foo",
+				"pulumi-project":       "proj",
+				"pulumi-store-version": "1",
+			}
+			for k, v := range tt.wantMetadata {
+				want[k] = v
+			}
+			assert.Equal(t, want, attrs.Metadata)
+
+			// Reads are unaffected.
+			chk, err := b.getCheckpoint(ctx, ref)
+			require.NoError(t, err)
+			assert.Len(t, chk.Latest.Resources, 1)
+		})
+	}
+}
+
+func TestNew_invalidCheckpointMetadata(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc    string
+		env     string
+		opts    map[string]string
+		wantErr string
+	}{
+		{
+			desc:    "not a pair",
+			env:     "team=infra,oops",
+			wantErr: `"oops" is not a key=value pair`,
+		},
+		{
+			desc:    "reserved",
+			env:     "Pulumi-Stack=bar",
+			wantErr: `"Pulumi-Stack": the pulumi- prefix is reserved`,
+		},
+		{
+			desc:    "empty key",
+			env:     "=bar",
+			wantErr: "keys must not be empty",
+		},
+		{
+			desc:    "case",
+			opts:    map[string]string{"team": "a", "Team": "b"},
+			wantErr: "differ only in case",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := newLocalBackend(context.Background(), diagtest.LogSink(t),
+				"file://"+filepath.ToSlash(t.TempDir()), &workspace.Project{Name: "proj"},
+				&localBackendOptions{
+					Getenv:             mapGetenv(map[string]string{PulumiFilestateCheckpointMetadataEnvVar: tt.env}),
+					CheckpointMetadata: tt.opts,
+				})
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
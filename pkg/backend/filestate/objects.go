@@ -0,0 +1,101 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// objectRefExt is the extension of snapshots that refer to a checkpoint in the objects directory
+// rather than holding a copy of it.
+const objectRefExt = ".ref"
+
+// objectsDir is the directory that holds content-addressed checkpoints
+// shared by the snapshots of all stacks.
+//
+// Each object is named after the SHA-256 checksum of its contents,
+// which are those of the checkpoint file as it was stored,
+// so that identical checkpoints are only stored once.
+// Objects are only deleted by [Backend.GC], once no snapshot refers to them.
+func objectsDir() string {
+	return path.Join(workspace.BookkeepingDir, "objects")
+}
+
+// objectPath returns the key of the object with the given checksum.
+func objectPath(sum string) string {
+	return path.Join(objectsDir(), sum)
+}
+
+// isObjectID reports whether s is a valid object name, i.e. a hex-encoded SHA-256 checksum.
+func isObjectID(s string) bool {
+	if len(s) != 64 || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// writeObject stores the given checkpoint file contents in the objects directory
+// unless an identical object is already stored, and returns its checksum.
+func writeObject(ctx context.Context, b Bucket, byts []byte) (string, error) {
+	sum := computeChecksum(byts)
+	key := objectPath(sum)
+	exists, err := b.Exists(ctx, key)
+	if err != nil {
+		return "", fmt.Errorf("check object %v: %w", sum, err)
+	}
+	if exists {
+		return sum, nil
+	}
+
+	// Objects are written without a content encoding, even if they're compressed,
+	// so that they're always read back as they were written and match their checksum.
+	if err := b.WriteAll(ctx, key, byts, nil); err != nil {
+		return "", fmt.Errorf("write object %v: %w", sum, err)
+	}
+	return sum, nil
+}
+
+// readObjectRef returns the checksum of the object that the reference at the given key refers to.
+func readObjectRef(ctx context.Context, b Bucket, key string) (string, error) {
+	byts, err := b.ReadAll(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	sum := strings.TrimSpace(string(byts))
+	if !isObjectID(sum) {
+		return "", fmt.Errorf("%v does not refer to an object", key)
+	}
+	return sum, nil
+}
+
+// readObject reads the object with the given checksum,
+// and checks that its contents still match it.
+func readObject(ctx context.Context, b Bucket, sum string) ([]byte, error) {
+	byts, err := b.ReadAll(ctx, objectPath(sum))
+	if err != nil {
+		return nil, fmt.Errorf("read object %v: %w", sum, err)
+	}
+	if got := computeChecksum(byts); got != sum {
+		return nil, fmt.Errorf("%w: object %v has checksum %v", ErrChecksumMismatch, sum, got)
+	}
+	return byts, nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot_dedup(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, map[string]string{PulumiFilestateDedupSnapshotsEnvVar: "true"})
+	_, _, err := b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 1))
+	require.NoError(t, err)
+
+	first, err := b.Snapshot(ctx, ref, nil /* events */)
+	require.NoError(t, err)
+	second, err := b.Snapshot(ctx, ref, nil /* events */)
+	require.NoError(t, err)
+	assert.Equal(t, []SnapshotID{first, second}, snapshotIDs(t, b, ref))
+
+	// Both snapshots share the same object.
+	objects := listKeys(t, b.bucket, objectsDir())
+	require.Len(t, objects, 1)
+	assert.True(t, isObjectID(path.Base(objects[0])))
+	assert.Equal(t, []string{
+		path.Join(ref.BackupDir(), string(first)+objectRefExt),
+		path.Join(ref.BackupDir(), string(second)+objectRefExt),
+	}, listKeys(t, b.bucket, ref.BackupDir()))
+
+	_, _, err = b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 3))
+	require.NoError(t, err)
+	require.NoError(t, b.Restore(ctx, ref, first))
+	chk, err := b.getCheckpoint(ctx, ref)
+	require.NoError(t, err)
+	assert.Len(t, chk.Latest.Resources, 1)
+	// The safety snapshot taken by Restore holds the other checkpoint.
+	assert.Len(t, listKeys(t, b.bucket, objectsDir()), 2)
+
+	// Objects are checked against their checksum when read.
+	require.NoError(t, b.bucket.WriteAll(ctx, objects[0], []byte("{}"), nil))
+	err = b.Restore(ctx, ref, first)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+}
+
+func TestSnapshot_dedupStoreLocked(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, map[string]string{PulumiFilestateDedupSnapshotsEnvVar: "true"})
+	_, unlock, err := lockStore(ctx, b.bucket, b.clock, "garbage collection", nil)
+	require.NoError(t, err)
+	defer unlock()
+
+	_, err = b.Snapshot(ctx, ref, nil /* events */)
+	assert.ErrorIs(t, err, ErrStoreLocked)
+	assert.Empty(t, snapshotIDs(t, b, ref))
+}
+
+func TestGC_objects(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, foo := newSnapshotBackend(t, map[string]string{PulumiFilestateDedupSnapshotsEnvVar: "true"})
+	bar, err := b.parseStackReference("bar")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, bar, "", nil)
+	require.NoError(t, err)
+
+	// Checkpoints name their stack, so refer to the object of foo from bar by hand.
+	_, err = b.Snapshot(ctx, foo, nil /* events */)
+	require.NoError(t, err)
+	objects := listKeys(t, b.bucket, objectsDir())
+	require.Len(t, objects, 1)
+	require.NoError(t, b.bucket.WriteAll(ctx, path.Join(bar.BackupDir(), "20230101T000000.000000000Z"+objectRefExt),
+		[]byte(path.Base(objects[0])), nil))
+
+	gc := func() []string {
+		report, err := b.collectGarbage(ctx, false /* dryRun */, time.Hour, b.clock.Now().Add(2*time.Hour))
+		require.NoError(t, err)
+		var objects []string
+		for _, f := range report.Files {
+			if f.Kind == GCObject {
+				objects = append(objects, f.Key)
+			}
+		}
+		return objects
+	}
+
+	// Objects are kept as long as any snapshot refers to them.
+	stack, err := b.GetStack(ctx, foo)
+	require.NoError(t, err)
+	_, err = b.RemoveStack(ctx, stack, true /* force */)
+	require.NoError(t, err)
+	assert.Empty(t, gc())
+
+	stack, err = b.GetStack(ctx, bar)
+	require.NoError(t, err)
+	_, err = b.RemoveStack(ctx, stack, true /* force */)
+	require.NoError(t, err)
+	assert.Len(t, gc(), 1)
+	assert.Empty(t, listKeys(t, b.bucket, objectsDir()))
+}
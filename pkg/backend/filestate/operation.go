@@ -0,0 +1,127 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gofrs/uuid"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/result"
+)
+
+// operationIDKey is the context key of the correlation ID of the operation in progress.
+type operationIDKey struct{}
+
+// withOperationID returns a context that carries a new correlation ID for an operation,
+// unless ctx already carries one because it belongs to an enclosing operation.
+//
+// The ID tags the messages that the operation reports to the diagnostics sink,
+// the errors it returns, and the locks it takes,
+// so that concurrent operations against the same state store can be told apart.
+// The context also counts the retries of the operation against its retry budget.
+func withOperationID(ctx context.Context) context.Context {
+	if operationID(ctx) != "" {
+		return ctx
+	}
+	ctx = withRetryCount(ctx)
+	id, err := uuid.NewV4()
+	if err != nil {
+		// Correlation IDs are only for debugging; don't fail the operation.
+		return ctx
+	}
+	return context.WithValue(ctx, operationIDKey{}, id.String())
+}
+
+// operationID returns the correlation ID of the operation that ctx belongs to,
+// or "" if it doesn't belong to one.
+func operationID(ctx context.Context) string {
+	id, _ := ctx.Value(operationIDKey{}).(string)
+	return id
+}
+
+// operationError annotates err with the correlation ID of the operation that ctx belongs to.
+func operationError(ctx context.Context, err error) error {
+	id := operationID(ctx)
+	if err == nil || id == "" {
+		return err
+	}
+	return fmt.Errorf("%w (operation %v)", err, id)
+}
+
+// operationResult is operationError for results.
+// Bails are returned as is, since their errors were already reported.
+func operationResult(ctx context.Context, res result.Result) result.Result {
+	if res == nil || res.IsBail() {
+		return res
+	}
+	return result.FromError(operationError(ctx, res.Error()))
+}
+
+// sink returns the diagnostics sink of the backend for messages about the operation that ctx belongs to.
+func (b *localBackend) sink(ctx context.Context) diag.Sink {
+	return newOperationSink(ctx, b.d)
+}
+
+// newOperationSink returns a sink that tags the messages reported to d
+// with the correlation ID of the operation that ctx belongs to.
+func newOperationSink(ctx context.Context, d diag.Sink) diag.Sink {
+	if id := operationID(ctx); id != "" {
+		return &operationSink{Sink: d, id: id}
+	}
+	return d
+}
+
+// operationSink is a diag.Sink that prefixes messages with the correlation ID of an operation.
+type operationSink struct {
+	diag.Sink
+
+	id string
+}
+
+var _ diag.Sink = (*operationSink)(nil)
+
+// tag returns a copy of d whose message is prefixed with the correlation ID.
+func (s *operationSink) tag(d *diag.Diag) *diag.Diag {
+	tagged := *d
+	tagged.Message = "[operation " + s.id + "] " + d.Message
+	return &tagged
+}
+
+func (s *operationSink) Logf(sev diag.Severity, d *diag.Diag, args ...interface{}) {
+	s.Sink.Logf(sev, s.tag(d), args...)
+}
+
+func (s *operationSink) Debugf(d *diag.Diag, args ...interface{}) {
+	s.Sink.Debugf(s.tag(d), args...)
+}
+
+func (s *operationSink) Infof(d *diag.Diag, args ...interface{}) {
+	s.Sink.Infof(s.tag(d), args...)
+}
+
+func (s *operationSink) Infoerrf(d *diag.Diag, args ...interface{}) {
+	s.Sink.Infoerrf(s.tag(d), args...)
+}
+
+func (s *operationSink) Errorf(d *diag.Diag, args ...interface{}) {
+	s.Sink.Errorf(s.tag(d), args...)
+}
+
+func (s *operationSink) Warningf(d *diag.Diag, args ...interface{}) {
+	s.Sink.Warningf(s.tag(d), args...)
+}
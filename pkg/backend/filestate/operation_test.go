@@ -0,0 +1,124 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag/colors"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+func TestOperationID(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	assert.Empty(t, operationID(ctx))
+
+	opCtx := withOperationID(ctx)
+	id := operationID(opCtx)
+	assert.NotEmpty(t, id)
+	// Nested operations are part of the enclosing one.
+	assert.Equal(t, id, operationID(withOperationID(opCtx)))
+	assert.NotEqual(t, id, operationID(withOperationID(ctx)))
+
+	errBoom := errors.New("boom")
+	err := operationError(opCtx, errBoom)
+	assert.ErrorIs(t, err, errBoom)
+	assert.EqualError(t, err, "boom (operation "+id+")")
+	assert.NoError(t, operationError(opCtx, nil))
+	assert.Equal(t, errBoom, operationError(ctx, errBoom))
+}
+
+func TestOperationID_tagged(t *testing.T) {
+	t.Parallel()
+
+	var stdout, stderr bytes.Buffer
+	sink := diag.DefaultSink(&stdout, &stderr, diag.FormatOptions{Color: colors.Never})
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, sink, "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"}, nil)
+	require.NoError(t, err)
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	opCtx := context.WithValue(ctx, operationIDKey{}, "op-1")
+	stack, err := b.CreateStack(opCtx, ref, "", nil)
+	require.NoError(t, err)
+	assert.Contains(t, stdout.String(), "[operation op-1] Created stack 'foo'")
+
+	// Locks record the operation that holds them,
+	// and errors name both operations.
+	require.NoError(t, b.Lock(opCtx, ref))
+	locks, err := b.ListLocks(ctx)
+	require.NoError(t, err)
+	require.Len(t, locks, 1)
+	assert.Equal(t, "op-1", locks[0].OperationID)
+	b.Unlock(opCtx, ref)
+
+	writeLock(t, b, "foo", "other", LockInfo{
+		Pid:         42,
+		Username:    "alice",
+		Hostname:    "example.com",
+		Timestamp:   time.Now(),
+		OperationID: "op-2",
+	})
+	locks, err = b.ListLocks(ctx)
+	require.NoError(t, err)
+	require.Len(t, locks, 1)
+	assert.Equal(t, "op-2", locks[0].OperationID)
+
+	_, err = b.RemoveStack(opCtx, stack, false)
+	assert.ErrorContains(t, err, "at "+locks[0].Timestamp.Format(time.RFC3339)+" (operation op-2)")
+	assert.ErrorContains(t, err, "(operation op-1)")
+}
+
+func TestOperationID_storeOperations(t *testing.T) {
+	t.Parallel()
+
+	var stdout, stderr bytes.Buffer
+	sink := diag.DefaultSink(&stdout, &stderr, diag.FormatOptions{Color: colors.Never})
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, sink, "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"}, nil)
+	require.NoError(t, err)
+
+	// Operations on the whole store tag their messages too.
+	opCtx := context.WithValue(ctx, operationIDKey{}, "op-1")
+	require.NoError(t, b.Upgrade(opCtx))
+	assert.Contains(t, stderr.String(), "[operation op-1] Upgraded 0 stack(s) to project mode")
+
+	// And the store locks they take.
+	_, unlock, err := lockStore(opCtx, b.bucket, b.clock, "test", nil)
+	require.NoError(t, err)
+	l, err := readStoreLock(ctx, b.bucket)
+	require.NoError(t, err)
+	assert.Equal(t, "op-1", l.OperationID)
+
+	// Operations that find the store locked name themselves in their errors.
+	_, err = b.GC(ctx, GCOptions{})
+	assert.ErrorIs(t, err, ErrStoreLocked)
+	assert.ErrorContains(t, err, "(operation ")
+	unlock()
+}
@@ -0,0 +1,160 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
+)
+
+// defaultOrphanMinAge is the default age after which temporary files and locks
+// are assumed to have been abandoned by a crashed process.
+//
+// This is much longer than a single write should take
+// so that we don't sweep files that are still being written.
+const defaultOrphanMinAge = time.Hour
+
+// sweepOrphans looks for temporary checkpoint files and locks
+// older than minAge relative to now
+// that were left behind by processes that crashed,
+// and reports each one through the diagnostic sink.
+//
+// If remove is set, orphans of stacks that don't exist are deleted.
+// Orphans next to a committed checkpoint may belong to an update in progress,
+// so those are only reported.
+//
+// Errors are reported as warnings rather than returned
+// because a failed sweep does not prevent using the backend.
+func (b *localBackend) sweepOrphans(ctx context.Context, remove bool, minAge time.Duration, now time.Time) {
+	refs, err := b.store.ListReferences(ctx)
+	if err != nil {
+		b.d.Warningf(diag.Message("", "Could not sweep orphaned files: %v"), err)
+		return
+	}
+	var keys *keyTemplate
+	if p, ok := b.store.(*projectReferenceStore); ok {
+		keys = p.keys
+	}
+	lockDirs := make(map[string]struct{}, len(refs))
+	for _, ref := range refs {
+		lockDirs[keys.stackLockDir(ref.FullyQualifiedName())] = struct{}{}
+	}
+
+	stacksDir := filepath.ToSlash(StacksDir)
+	files, err := listAll(ctx, b.bucket, stacksDir+"/")
+	if err != nil {
+		b.d.Warningf(diag.Message("", "Could not sweep orphaned files in %v: %v"), stacksDir, err)
+		return
+	}
+	for _, file := range files {
+		idx := strings.Index(file.Key, tempFileInfix)
+		if idx == -1 || now.Sub(file.ModTime) < minAge {
+			continue
+		}
+
+		committed, err := b.checkpointExists(ctx, file.Key[:idx])
+		if err != nil {
+			b.d.Warningf(diag.Message("", "Could not sweep orphaned file %v: %v"), file.Key, err)
+			continue
+		}
+		if committed {
+			b.d.Warningf(diag.Message("",
+				"Found temporary file %v (last modified %v) next to an existing checkpoint; "+
+					"delete it if no update is in progress"),
+				file.Key, file.ModTime.Format(time.RFC3339))
+			continue
+		}
+		b.removeOrphan(ctx, remove, "temporary file", file.Key, file.ModTime)
+	}
+
+	locks, err := listAll(ctx, b.bucket, lockDir()+"/")
+	if err != nil {
+		b.d.Warningf(diag.Message("", "Could not sweep orphaned locks: %v"), err)
+		return
+	}
+	for _, file := range locks {
+		if file.IsDir {
+			continue
+		}
+
+		taken := b.lockTakenAt(ctx, file)
+		if now.Sub(taken) < minAge {
+			continue
+		}
+
+		if _, ok := lockDirs[path.Dir(file.Key)]; ok {
+			b.d.Warningf(diag.Message("",
+				"Found lock %v taken at %v on an existing stack; "+
+					"run 'pulumi cancel' if no update is in progress"),
+				file.Key, taken.Format(time.RFC3339))
+			continue
+		}
+		b.removeOrphan(ctx, remove, "lock", file.Key, taken)
+	}
+}
+
+// lockTakenAt returns when the given lock was taken,
+// falling back to when the file was written if it can't be read.
+func (b *localBackend) lockTakenAt(ctx context.Context, file *blob.ListObject) time.Time {
+	if byts, err := b.bucket.ReadAll(ctx, file.Key); err == nil {
+		var l LockInfo
+		if json.Unmarshal(byts, &l) == nil && !l.Timestamp.IsZero() {
+			return l.Timestamp
+		}
+	}
+	return file.ModTime
+}
+
+// removeOrphan deletes the given orphaned file if remove is set,
+// and reports what was done.
+func (b *localBackend) removeOrphan(ctx context.Context, remove bool, kind, key string, modTime time.Time) {
+	if !remove {
+		b.d.Warningf(diag.Message("", "Found orphaned %v %v (last modified %v)"),
+			kind, key, modTime.Format(time.RFC3339))
+		return
+	}
+	if err := b.bucket.Delete(ctx, key); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+		b.d.Warningf(diag.Message("", "Could not remove orphaned %v %v: %v"), kind, key, err)
+		return
+	}
+	b.d.Infoerrf(diag.Message("", "Removed orphaned %v %v (last modified %v)"),
+		kind, key, modTime.Format(time.RFC3339))
+}
+
+// checkpointExists reports whether a checkpoint is committed at the given key,
+// with or without gzip compression.
+func (b *localBackend) checkpointExists(ctx context.Context, key string) (bool, error) {
+	plain := strings.TrimSuffix(key, encoding.GZIPExt)
+	for _, k := range []string{plain, plain + encoding.GZIPExt} {
+		exists, err := b.bucket.Exists(ctx, k)
+		if err != nil {
+			return false, err
+		}
+		if exists {
+			return true, nil
+		}
+	}
+	return false, nil
+}
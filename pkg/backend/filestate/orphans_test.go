@@ -0,0 +1,151 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag/colors"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// newOrphanedStore creates a state store with the stack "proj/foo"
+// and old temporary files and locks for it and for the missing stack "proj/gone".
+// It returns the paths of these files relative to the store.
+func newOrphanedStore(t *testing.T) (stateDir string, files []string) {
+	t.Helper()
+
+	ctx := context.Background()
+	stateDir = t.TempDir()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+		&workspace.Project{Name: "proj"}, nil)
+	require.NoError(t, err)
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	old := time.Now().Add(-2 * time.Hour)
+	lock, err := json.Marshal(&LockInfo{Pid: 1, Username: "user", Hostname: "host", Timestamp: old})
+	require.NoError(t, err)
+
+	files = []string{
+		".pulumi/stacks/proj/foo.json.tmp-1234",
+		".pulumi/stacks/proj/gone.json.tmp-5678",
+		".pulumi/locks/organization/proj/foo/1234.json",
+		".pulumi/locks/organization/proj/gone/5678.json",
+	}
+	for i, name := range files {
+		body := []byte("{}")
+		if i >= 2 {
+			body = lock
+		}
+		p := filepath.Join(stateDir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o700))
+		require.NoError(t, os.WriteFile(p, body, 0o600))
+		require.NoError(t, os.Chtimes(p, old, old))
+	}
+	return stateDir, files
+}
+
+func TestSweepOrphans(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc string
+		opts Options
+
+		// Indexes of the files from newOrphanedStore
+		// expected to be removed.
+		wantRemoved []int
+		wantOut     []string
+	}{
+		{
+			desc: "disabled",
+		},
+		{
+			desc: "report only",
+			opts: Options{SweepOrphans: true},
+			wantOut: []string{
+				"Found temporary file .pulumi/stacks/proj/foo.json.tmp-1234",
+				"Found orphaned temporary file .pulumi/stacks/proj/gone.json.tmp-5678",
+				"Found lock .pulumi/locks/organization/proj/foo/1234.json",
+				"Found orphaned lock .pulumi/locks/organization/proj/gone/5678.json",
+			},
+		},
+		{
+			desc:        "remove",
+			opts:        Options{SweepOrphans: true, RemoveOrphans: true},
+			wantRemoved: []int{1, 3},
+			wantOut: []string{
+				"Found temporary file .pulumi/stacks/proj/foo.json.tmp-1234",
+				"Removed orphaned temporary file .pulumi/stacks/proj/gone.json.tmp-5678",
+				"Found lock .pulumi/locks/organization/proj/foo/1234.json",
+				"Removed orphaned lock .pulumi/locks/organization/proj/gone/5678.json",
+			},
+		},
+		{
+			desc: "too recent",
+			opts: Options{SweepOrphans: true, RemoveOrphans: true, OrphanMinAge: 3 * time.Hour},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			stateDir, files := newOrphanedStore(t)
+
+			var buff bytes.Buffer
+			sink := diag.DefaultSink(io.Discard, &buff, diag.FormatOptions{Color: colors.Never})
+			_, err := NewWithOptions(context.Background(), sink, "file://"+filepath.ToSlash(stateDir),
+				&workspace.Project{Name: "proj"}, &tt.opts)
+			require.NoError(t, err)
+
+			for _, want := range tt.wantOut {
+				assert.Contains(t, buff.String(), want)
+			}
+			if len(tt.wantOut) == 0 {
+				assert.Empty(t, buff.String())
+			}
+
+			removed := make(map[int]bool)
+			for _, i := range tt.wantRemoved {
+				removed[i] = true
+			}
+			for i, name := range files {
+				p := filepath.Join(stateDir, filepath.FromSlash(name))
+				if removed[i] {
+					assert.NoFileExists(t, p)
+				} else {
+					assert.FileExists(t, p)
+				}
+			}
+		})
+	}
+}
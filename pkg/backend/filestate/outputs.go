@@ -0,0 +1,131 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/backend/display"
+	"github.com/pulumi/pulumi/pkg/v3/resource/stack"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/config"
+)
+
+// hiddenSecret is the value that secret outputs are replaced with unless they're shown,
+// as in the output of 'pulumi stack output'.
+const hiddenSecret = "[secret]"
+
+func (b *localBackend) GetStackOutputs(
+	ctx context.Context, stackRef backend.StackReference, showSecrets bool,
+) (map[string]interface{}, error) {
+	ref, err := b.getReference(stackRef)
+	if err != nil {
+		return nil, err
+	}
+	chk, err := b.getCheckpoint(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load checkpoint: %w", err)
+	}
+
+	root := rootStackResource(chk.Latest)
+	if root == nil {
+		return map[string]interface{}{}, nil
+	}
+
+	outputs := make(map[string]interface{}, len(root.Outputs))
+	secret := false
+	for k, v := range root.Outputs {
+		var found bool
+		outputs[k], found = hideSecrets(v)
+		secret = secret || found
+	}
+	if !showSecrets || !secret {
+		return outputs, nil
+	}
+
+	dec, err := deploymentDecrypter(chk.Latest)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt outputs of stack %v: %w", ref, err)
+	}
+	props, err := stack.DeserializeProperties(root.Outputs, dec, config.NopEncrypter)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt outputs of stack %v: %w", ref, err)
+	}
+	// The secrets were replaced with their values, so nothing is encrypted.
+	return stack.SerializeProperties(display.MassageSecrets(props, true), config.NewPanicCrypter(), true)
+}
+
+// rootStackResource returns the root stack resource of the given deployment,
+// or nil if it has none, e.g. because the stack was never updated.
+func rootStackResource(deployment *apitype.DeploymentV3) *apitype.ResourceV3 {
+	if deployment == nil {
+		return nil
+	}
+	for i, res := range deployment.Resources {
+		if res.Type == resource.RootStackType {
+			return &deployment.Resources[i]
+		}
+	}
+	return nil
+}
+
+// hideSecrets returns a copy of the serialized property value v
+// with every secret replaced with hiddenSecret,
+// and whether it held any secrets.
+func hideSecrets(v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if v[resource.SigKey] == resource.SecretSig {
+			return hiddenSecret, true
+		}
+		m := make(map[string]interface{}, len(v))
+		found := false
+		for k, e := range v {
+			var ok bool
+			m[k], ok = hideSecrets(e)
+			found = found || ok
+		}
+		return m, found
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		found := false
+		for i, e := range v {
+			var ok bool
+			s[i], ok = hideSecrets(e)
+			found = found || ok
+		}
+		return s, found
+	default:
+		return v, false
+	}
+}
+
+// deploymentDecrypter returns a decrypter for the secrets of the given deployment
+// from the secrets provider it was written with.
+func deploymentDecrypter(deployment *apitype.DeploymentV3) (config.Decrypter, error) {
+	providers := deployment.SecretsProviders
+	if providers == nil || providers.Type == "" {
+		return nil, errors.New("the deployment has secrets but no secrets provider")
+	}
+	sm, err := stack.DefaultSecretsProvider.OfType(providers.Type, providers.State)
+	if err != nil {
+		return nil, err
+	}
+	return sm.Decrypter()
+}
@@ -0,0 +1,155 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/pkg/v3/secrets/b64"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+)
+
+// saveOutputsCheckpoint replaces the checkpoint of the given stack
+// with one whose root stack resource has the given outputs.
+func saveOutputsCheckpoint(
+	t *testing.T, b *localBackend, ref *localBackendReference,
+	providers *apitype.SecretsProvidersV1, outputs map[string]interface{},
+) {
+	t.Helper()
+
+	raw, err := encoding.JSON.Marshal(apitype.CheckpointV3{
+		Stack: ref.FullyQualifiedName(),
+		Latest: &apitype.DeploymentV3{
+			SecretsProviders: providers,
+			Resources: []apitype.ResourceV3{
+				{
+					URN:     "urn:pulumi:foo::proj::pulumi:pulumi:Stack::proj-foo",
+					Type:    resource.RootStackType,
+					Outputs: outputs,
+				},
+				{
+					URN:     "urn:pulumi:foo::proj::pkg:index:Res::a",
+					Custom:  true,
+					ID:      "a",
+					Type:    "pkg:index:Res",
+					Outputs: map[string]interface{}{"internal": "detail"},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	_, _, err = b.saveCheckpoint(context.Background(), ref, &apitype.VersionedCheckpoint{
+		Version:    apitype.DeploymentSchemaVersionCurrent,
+		Checkpoint: raw,
+	})
+	require.NoError(t, err)
+}
+
+func TestGetStackOutputs(t *testing.T) {
+	t.Parallel()
+
+	secret := func(plaintext string) map[string]interface{} {
+		return map[string]interface{}{
+			resource.SigKey: resource.SecretSig,
+			"ciphertext":    base64.StdEncoding.EncodeToString([]byte(plaintext)),
+		}
+	}
+	outputs := map[string]interface{}{
+		"url":      "https://example.com",
+		"replicas": 3,
+		"password": secret(`"hunter2"`),
+		"nested":   map[string]interface{}{"tokens": []interface{}{"public", secret(`"token"`)}},
+	}
+	b64Provider := &apitype.SecretsProvidersV1{Type: b64.Type}
+
+	for _, env := range []map[string]string{
+		nil,
+		{"PULUMI_SELF_MANAGED_STATE_LEGACY_LAYOUT": "1"},
+	} {
+		env := env
+		name := "project"
+		if env != nil {
+			name = "legacy"
+		}
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			b, ref := newSnapshotBackend(t, env)
+			saveOutputsCheckpoint(t, b, ref, b64Provider, outputs)
+
+			got, err := b.GetStackOutputs(ctx, ref, false /* showSecrets */)
+			require.NoError(t, err)
+			assert.Equal(t, map[string]interface{}{
+				"url":      "https://example.com",
+				"replicas": 3.0,
+				"password": "[secret]",
+				"nested":   map[string]interface{}{"tokens": []interface{}{"public", "[secret]"}},
+			}, got)
+
+			got, err = b.GetStackOutputs(ctx, ref, true /* showSecrets */)
+			require.NoError(t, err)
+			assert.Equal(t, map[string]interface{}{
+				"url":      "https://example.com",
+				"replicas": 3.0,
+				"password": "hunter2",
+				"nested":   map[string]interface{}{"tokens": []interface{}{"public", "token"}},
+			}, got)
+		})
+	}
+
+	t.Run("secrets provider unused", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+		b, ref := newSnapshotBackend(t, nil)
+		// The secrets provider can't be created,
+		// so the outputs can only be read if it isn't used.
+		saveOutputsCheckpoint(t, b, ref, &apitype.SecretsProvidersV1{Type: "unknown"}, outputs)
+
+		got, err := b.GetStackOutputs(ctx, ref, false /* showSecrets */)
+		require.NoError(t, err)
+		assert.Equal(t, "[secret]", got["password"])
+
+		_, err = b.GetStackOutputs(ctx, ref, true /* showSecrets */)
+		assert.Error(t, err)
+	})
+
+	t.Run("no secrets provider", func(t *testing.T) {
+		t.Parallel()
+
+		b, ref := newSnapshotBackend(t, nil)
+		saveOutputsCheckpoint(t, b, ref, nil /* providers */, outputs)
+
+		_, err := b.GetStackOutputs(context.Background(), ref, true /* showSecrets */)
+		assert.ErrorContains(t, err, "no secrets provider")
+	})
+
+	t.Run("never updated", func(t *testing.T) {
+		t.Parallel()
+
+		b, ref := newSnapshotBackend(t, nil)
+		got, err := b.GetStackOutputs(context.Background(), ref, true /* showSecrets */)
+		require.NoError(t, err)
+		assert.Empty(t, got)
+	})
+}
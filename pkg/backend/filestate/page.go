@@ -0,0 +1,190 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"gocloud.dev/blob"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
+)
+
+// pageBucket is implemented by Buckets that list objects a page at a time
+// with the native pagination of the storage provider.
+type pageBucket interface {
+	// ListPage is like blob.Bucket.ListPage.
+	ListPage(ctx context.Context, pageToken []byte, pageSize int,
+		opts *blob.ListOptions) ([]*blob.ListObject, []byte, error)
+}
+
+// listPage returns a page of at most pageSize objects, in order of their keys,
+// and the token of the next page, which is empty after the last page.
+// Pass blob.FirstPageToken for the first page.
+//
+// Buckets that can't list pages natively are listed from the start every time,
+// with the last key of a page as the token of the next one.
+func listPage(
+	ctx context.Context, bucket Bucket, pageToken []byte, pageSize int, opts *blob.ListOptions,
+) ([]*blob.ListObject, []byte, error) {
+	if pb, ok := bucket.(pageBucket); ok {
+		return pb.ListPage(ctx, pageToken, pageSize, opts)
+	}
+
+	if len(pageToken) == 0 {
+		return nil, nil, io.EOF
+	}
+	var after string
+	if !bytes.Equal(pageToken, blob.FirstPageToken) {
+		after = string(pageToken)
+	}
+	iter := bucket.List(opts)
+	var objs []*blob.ListObject
+	for {
+		obj, err := nextObject(ctx, bucket, iter)
+		if err == io.EOF {
+			return objs, nil, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if obj.Key <= after {
+			continue
+		}
+		if len(objs) == pageSize {
+			return objs, []byte(objs[len(objs)-1].Key), nil
+		}
+		objs = append(objs, obj)
+	}
+}
+
+// stackCursor is the position of a paginated listing of stacks.
+// It's encoded in the continuation tokens returned by ListStacksPage.
+type stackCursor struct {
+	// Page is the token of the page of the bucket listing to resume from.
+	Page []byte `json:"page"`
+
+	// After is the key of the last object of that page that was already listed.
+	After string `json:"after,omitempty"`
+
+	// Stack is the name of the last stack that was returned.
+	// The files of a stack may be split across pages,
+	// e.g. if it has both a .json and a .json.gz checkpoint.
+	Stack string `json:"stack,omitempty"`
+}
+
+// parseStackCursor decodes a continuation token returned by ListStacksPage.
+// A nil token starts from the beginning.
+func parseStackCursor(token backend.ContinuationToken) (*stackCursor, error) {
+	if token == nil {
+		return &stackCursor{Page: blob.FirstPageToken}, nil
+	}
+	byts, err := base64.RawURLEncoding.DecodeString(*token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid continuation token: %w", err)
+	}
+	var c stackCursor
+	if err := json.Unmarshal(byts, &c); err != nil || len(c.Page) == 0 {
+		return nil, errors.New("invalid continuation token")
+	}
+	return &c, nil
+}
+
+func (c *stackCursor) token() backend.ContinuationToken {
+	byts, err := json.Marshal(c)
+	contract.AssertNoErrorf(err, "marshal stack cursor")
+	token := base64.RawURLEncoding.EncodeToString(byts)
+	return &token
+}
+
+func (b *localBackend) ListStacksPage(
+	ctx context.Context, filter backend.ListStacksFilter, pageSize int, token backend.ContinuationToken,
+) ([]backend.StackSummary, backend.ContinuationToken, error) {
+	if pageSize <= 0 {
+		return nil, nil, fmt.Errorf("invalid page size %d: must be positive", pageSize)
+	}
+	cursor, err := parseStackCursor(token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var project tokens.Name
+	if filter.Project != nil {
+		project = tokens.Name(*filter.Project)
+	}
+	refs, next, err := b.listReferencePage(ctx, b.store.stackListOptions(project), cursor, pageSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	summaries, err := b.readStackSummaries(ctx, filter, refs)
+	if err != nil {
+		return nil, nil, err
+	}
+	if next == nil {
+		return summaries, nil, nil
+	}
+	return summaries, next.token(), nil
+}
+
+// listReferencePage returns the references of up to pageSize stacks
+// listed with the given options after the cursor,
+// and the cursor to continue from, which is nil after the last stack.
+func (b *localBackend) listReferencePage(
+	ctx context.Context, opts *blob.ListOptions, cursor *stackCursor, pageSize int,
+) ([]*localBackendReference, *stackCursor, error) {
+	var refs []*localBackendReference
+	pageToken, after, last := cursor.Page, cursor.After, cursor.Stack
+	for {
+		// Objects that aren't checkpoints are skipped,
+		// so each page of the bucket may hold fewer stacks than requested.
+		objs, nextToken, err := listPage(ctx, b.bucket, pageToken, pageSize, opts)
+		if err == io.EOF {
+			return refs, nil, nil
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("list bucket: %w", err)
+		}
+		for _, obj := range objs {
+			if obj.Key <= after {
+				continue
+			}
+			ref, ok := b.store.referenceFromKey(obj.Key)
+			if ok && string(ref.FullyQualifiedName()) != last {
+				if len(refs) == pageSize {
+					// Resume from the middle of this page.
+					return refs, &stackCursor{Page: pageToken, After: after, Stack: last}, nil
+				}
+				refs = append(refs, ref)
+				last = string(ref.FullyQualifiedName())
+			}
+			after = obj.Key
+		}
+		if len(nextToken) == 0 {
+			return refs, nil, nil
+		}
+		pageToken = nextToken
+		if len(refs) == pageSize {
+			return refs, &stackCursor{Page: pageToken, After: after, Stack: last}, nil
+		}
+	}
+}
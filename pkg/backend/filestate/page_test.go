@@ -0,0 +1,176 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// listAllPages lists all stacks with ListStacksPage
+// and returns their names and the number of pages.
+func listAllPages(
+	t *testing.T, b *localBackend, filter backend.ListStacksFilter, pageSize int,
+) ([]string, int) {
+	t.Helper()
+
+	var names []string
+	var token backend.ContinuationToken
+	for pages := 1; ; pages++ {
+		summaries, next, err := b.ListStacksPage(context.Background(), filter, pageSize, token)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(summaries), pageSize)
+		for _, s := range summaries {
+			names = append(names, s.Name().FullyQualifiedName().String())
+		}
+		if next == nil {
+			return names, pages
+		}
+		token = next
+	}
+}
+
+// writeStackFiles writes a copy of the checkpoint of the given stack
+// to each of the given keys.
+func writeStackFiles(t *testing.T, b *localBackend, ref *localBackendReference, keys ...string) {
+	t.Helper()
+
+	ctx := context.Background()
+	byts, err := b.bucket.ReadAll(ctx, b.stackPath(ctx, ref))
+	require.NoError(t, err)
+	for _, key := range keys {
+		require.NoError(t, b.bucket.WriteAll(ctx, key, byts, nil))
+	}
+}
+
+func TestListStacksPage(t *testing.T) {
+	t.Parallel()
+
+	b, ref := newSnapshotBackend(t, nil)
+	var keys []string
+	for i := 0; i < 6; i++ {
+		keys = append(keys, fmt.Sprintf(".pulumi/stacks/proj/s%d.json", i))
+	}
+	keys = append(keys,
+		// A stack with both kinds of checkpoints is listed once.
+		".pulumi/stacks/proj/s3.json.gz",
+		// Files that aren't checkpoints are skipped.
+		".pulumi/stacks/proj/s1.json.bak",
+		".pulumi/stacks/proj/s4.json.sha256",
+		".pulumi/stacks/other/a.json",
+		".pulumi/stacks/other/b.json")
+	writeStackFiles(t, b, ref, keys...)
+
+	want := []string{
+		"organization/other/a", "organization/other/b",
+		"organization/proj/foo",
+		"organization/proj/s0", "organization/proj/s1", "organization/proj/s2",
+		"organization/proj/s3", "organization/proj/s4", "organization/proj/s5",
+	}
+	for _, pageSize := range []int{1, 2, 4, 100} {
+		names, _ := listAllPages(t, b, backend.ListStacksFilter{}, pageSize)
+		assert.Equal(t, want, names, "page size %d", pageSize)
+	}
+	names, pages := listAllPages(t, b, backend.ListStacksFilter{}, 3)
+	assert.Equal(t, want, names)
+	assert.Equal(t, 3, pages)
+
+	// Only the project's stacks are listed.
+	other := "other"
+	names, _ = listAllPages(t, b, backend.ListStacksFilter{Project: &other}, 1)
+	assert.Equal(t, []string{"organization/other/a", "organization/other/b"}, names)
+
+	// Buckets without native pagination are listed the same way.
+	b.bucket = &struct{ Bucket }{b.bucket}
+	for _, pageSize := range []int{1, 2, 100} {
+		names, _ := listAllPages(t, b, backend.ListStacksFilter{}, pageSize)
+		assert.Equal(t, want, names, "page size %d", pageSize)
+	}
+}
+
+func TestListStacksPage_legacy(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"},
+		&localBackendOptions{Getenv: mapGetenv(map[string]string{PulumiFilestateLegacyLayoutEnvVar: "1"})})
+	require.NoError(t, err)
+	ref, err := b.parseStackReference("a")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+	writeStackFiles(t, b, ref, ".pulumi/stacks/b.json.gz", ".pulumi/stacks/c.json", ".pulumi/stacks/c.json.bak",
+		".pulumi/stacks/nested/d.json")
+
+	names, pages := listAllPages(t, b, backend.ListStacksFilter{}, 2)
+	assert.Equal(t, []string{"a", "b", "c"}, names)
+	assert.Equal(t, 2, pages)
+}
+
+func TestListStacksPage_errors(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, _ := newSnapshotBackend(t, nil)
+
+	_, _, err := b.ListStacksPage(ctx, backend.ListStacksFilter{}, 0, nil)
+	assert.ErrorContains(t, err, "invalid page size 0")
+
+	for _, give := range []string{"not base64!", "bm90IGpzb24", "e30"} {
+		give := give
+		_, _, err = b.ListStacksPage(ctx, backend.ListStacksFilter{}, 1, &give)
+		assert.ErrorContains(t, err, "invalid continuation token", "token %q", give)
+	}
+}
+
+func TestListPage_emulated(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, _ := newSnapshotBackend(t, nil)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, b.bucket.WriteAll(ctx, fmt.Sprintf("dir/%d", i), nil, nil))
+	}
+
+	// Without native pagination, the last key of a page is the token of the next one.
+	bucket := &struct{ Bucket }{b.bucket}
+	opts := &blob.ListOptions{Prefix: "dir/"}
+	var keys []string
+	token := blob.FirstPageToken
+	for len(token) > 0 {
+		objs, next, err := listPage(ctx, bucket, token, 2, opts)
+		require.NoError(t, err)
+		for _, obj := range objs {
+			keys = append(keys, obj.Key)
+		}
+		token = next
+	}
+	assert.Equal(t, []string{"dir/0", "dir/1", "dir/2", "dir/3", "dir/4"}, keys)
+
+	_, _, err := listPage(ctx, bucket, nil, 2, opts)
+	assert.ErrorIs(t, err, io.EOF)
+}
@@ -0,0 +1,103 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"path"
+
+	"github.com/gofrs/uuid"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+var (
+	// ErrAccessDenied is returned by [Backend.Ping]
+	// if the storage provider rejected the credentials in use.
+	ErrAccessDenied = errors.New("access to the state store was denied")
+
+	// ErrUnreachable is returned by [Backend.Ping]
+	// if the storage provider could not be reached.
+	ErrUnreachable = errors.New("the state store could not be reached")
+)
+
+// healthCheckDir is the directory that holds the probe objects written by Ping.
+func healthCheckDir() string {
+	return path.Join(workspace.BookkeepingDir, ".healthcheck")
+}
+
+func (b *localBackend) Ping(ctx context.Context) error {
+	if b.checkWritable() != nil {
+		// Files can only be read, so check that the store can be listed.
+		iter := b.bucket.List(&blob.ListOptions{Prefix: workspace.BookkeepingDir + "/", Delimiter: "/"})
+		if _, err := nextObject(ctx, b.bucket, iter); err != nil && !errors.Is(err, io.EOF) {
+			return b.pingError("list", workspace.BookkeepingDir, err)
+		}
+		return nil
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return err
+	}
+	key := path.Join(healthCheckDir(), id.String())
+	probe := []byte(id.String())
+	if err := b.bucket.WriteAll(ctx, key, probe, nil); err != nil {
+		return b.pingError("write", key, err)
+	}
+	defer func() {
+		// The probe is removed even if reading it failed.
+		if err := b.bucket.Delete(ctx, key); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+			logging.V(5).Infof("error deleting health check probe %v: %v", key, err)
+		}
+	}()
+
+	got, err := b.bucket.ReadAll(ctx, key)
+	if err != nil {
+		return b.pingError("read", key, err)
+	}
+	if !bytes.Equal(got, probe) {
+		return fmt.Errorf("ping state store %v: read back %d bytes of %v that differ from the %d bytes written",
+			b.url, len(got), key, len(probe))
+	}
+	if err := b.bucket.Delete(ctx, key); err != nil {
+		return b.pingError("delete", key, err)
+	}
+	return nil
+}
+
+// pingError describes a failed request of Ping,
+// wrapping ErrAccessDenied or ErrUnreachable if err is either.
+func (b *localBackend) pingError(op, key string, err error) error {
+	var netErr net.Error
+	var terr *timeoutError
+	switch {
+	case gcerrors.Code(err) == gcerrors.PermissionDenied, errors.Is(err, fs.ErrPermission):
+		return fmt.Errorf("ping state store %v: %v %v: %w: %w", b.url, op, key, ErrAccessDenied, err)
+	case errors.As(err, &netErr), errors.As(err, &terr), errors.Is(err, context.DeadlineExceeded):
+		return fmt.Errorf("ping state store %v: %v %v: %w: %w", b.url, op, key, ErrUnreachable, err)
+	default:
+		return fmt.Errorf("ping state store %v: %v %v: %w", b.url, op, key, err)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+func TestPing(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, _ := newSnapshotBackend(t, nil)
+	require.NoError(t, b.Ping(ctx))
+
+	// The probe is deleted.
+	assert.Empty(t, listKeys(t, b.bucket, healthCheckDir()))
+}
+
+func TestPing_readOnly(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(dir),
+		&workspace.Project{Name: "proj"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, b.WriteIndex(ctx))
+
+	var deny atomic.Bool
+	files := http.FileServer(http.Dir(dir))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if deny.Load() {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	ro, err := newLocalBackend(ctx, diagtest.LogSink(t), "filestate+"+srv.URL,
+		&workspace.Project{Name: "proj"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, ro.Ping(ctx))
+
+	deny.Store(true)
+	err = ro.Ping(ctx)
+	assert.ErrorIs(t, err, ErrAccessDenied)
+	assert.NotErrorIs(t, err, ErrUnreachable)
+}
+
+func TestPingError(t *testing.T) {
+	t.Parallel()
+
+	b, _ := newSnapshotBackend(t, nil)
+	tests := []struct {
+		desc string
+		give error
+		want error
+	}{
+		{
+			desc: "permission",
+			give: fmt.Errorf("open: %w", fs.ErrPermission),
+			want: ErrAccessDenied,
+		},
+		{
+			desc: "network",
+			give: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")},
+			want: ErrUnreachable,
+		},
+		{
+			desc: "timeout",
+			give: &timeoutError{op: "write", key: "k", timeout: 1, err: context.DeadlineExceeded},
+			want: ErrUnreachable,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			err := b.pingError("write", "k", tt.give)
+			assert.ErrorIs(t, err, tt.want)
+			assert.ErrorIs(t, err, tt.give)
+		})
+	}
+
+	// Other errors are returned as they are.
+	err := b.pingError("write", "k", errors.New("great sadness"))
+	assert.NotErrorIs(t, err, ErrAccessDenied)
+	assert.NotErrorIs(t, err, ErrUnreachable)
+	assert.ErrorContains(t, err, "write k: great sadness")
+}
@@ -0,0 +1,125 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"sync"
+)
+
+// ProgressOperation identifies the operation that a [ProgressEvent] belongs to.
+type ProgressOperation string
+
+const (
+	// ProgressMigrate is reported by [Migrate]
+	// for every file copied into the new layout.
+	ProgressMigrate ProgressOperation = "migrate"
+
+	// ProgressVerify is reported by [Backend.Verify]
+	// for every checkpoint checked.
+	ProgressVerify ProgressOperation = "verify"
+
+	// ProgressPrune is reported by [Backend.Snapshot]
+	// for every old snapshot deleted.
+	ProgressPrune ProgressOperation = "prune"
+
+	// ProgressRemove is reported to Options.Progress
+	// for every file deleted when a stack is removed.
+	// Deleted files are reported with a size of zero.
+	ProgressRemove ProgressOperation = "remove"
+)
+
+// ProgressEvent reports the progress of a long-running operation
+// on a state store.
+type ProgressEvent struct {
+	// Operation is the operation in progress.
+	Operation ProgressOperation
+
+	// Stack is the name of the stack being processed.
+	Stack string
+
+	// Key is the key of the file that was just processed.
+	Key string
+
+	// Files is the number of files processed so far,
+	// including this one.
+	Files int
+
+	// Bytes is the total size of the files processed so far,
+	// including this one.
+	Bytes int64
+}
+
+// progressReporter sends ProgressEvents for a single operation
+// to an optional channel or callback.
+//
+// All methods are no-ops on a nil reporter or if it has neither.
+// It's safe for concurrent use.
+type progressReporter struct {
+	ctx    context.Context
+	op     ProgressOperation
+	events chan<- ProgressEvent
+	fn     func(ProgressEvent)
+
+	mu    sync.Mutex
+	files int
+	bytes int64
+}
+
+func newProgressReporter(ctx context.Context, op ProgressOperation, events chan<- ProgressEvent) *progressReporter {
+	return &progressReporter{ctx: ctx, op: op, events: events}
+}
+
+// newProgressCallback returns a reporter that calls fn with every event.
+func newProgressCallback(ctx context.Context, op ProgressOperation, fn func(ProgressEvent)) *progressReporter {
+	return &progressReporter{ctx: ctx, op: op, fn: fn}
+}
+
+// report records that the given file was processed
+// and sends an event for it.
+//
+// This blocks until the event is received or the context is canceled.
+func (p *progressReporter) report(stack, key string, size int64) {
+	if p == nil || (p.events == nil && p.fn == nil) {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.files++
+	p.bytes += size
+	event := ProgressEvent{
+		Operation: p.op,
+		Stack:     stack,
+		Key:       key,
+		Files:     p.files,
+		Bytes:     p.bytes,
+	}
+	if p.fn != nil {
+		p.fn(event)
+		return
+	}
+	select {
+	case p.events <- event:
+	case <-p.ctx.Done():
+	}
+}
+
+// close closes the channel to signal that the operation has finished.
+func (p *progressReporter) close() {
+	if p != nil && p.events != nil {
+		close(p.events)
+	}
+}
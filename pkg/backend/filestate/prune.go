@@ -0,0 +1,134 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+)
+
+// PruneReport is the result of [Backend.PruneEmptyStacks].
+type PruneReport struct {
+	// DryRun is set if the stacks were only reported, not removed.
+	DryRun bool `json:"dryRun"`
+
+	// Stacks lists the fully qualified names of the empty stacks that were moved to the trash,
+	// or would have been for a dry run, in order.
+	Stacks []string `json:"stacks,omitempty"`
+
+	// Skipped lists the empty stacks that were kept because they're currently locked.
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+func (b *localBackend) PruneEmptyStacks(ctx context.Context, dryRun bool) (_ *PruneReport, err error) {
+	ctx = withOperationID(ctx)
+	defer func() { err = operationError(ctx, err) }()
+
+	if !dryRun {
+		if err := b.checkWritable(); err != nil {
+			return nil, err
+		}
+	}
+
+	refs, err := b.store.ListReferences(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list stacks: %w", err)
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].FullyQualifiedName() < refs[j].FullyQualifiedName()
+	})
+
+	report := PruneReport{DryRun: dryRun}
+	for _, ref := range refs {
+		name := ref.FullyQualifiedName().String()
+		empty, err := b.isEmptyStack(ctx, ref)
+		if err != nil {
+			return nil, fmt.Errorf("read stack %v: %w", name, err)
+		}
+		if !empty {
+			continue
+		}
+
+		locks, err := b.locker.Locks(ctx, ref.FullyQualifiedName())
+		if err != nil {
+			return nil, fmt.Errorf("list locks of stack %v: %w", name, err)
+		}
+		if len(locks) > 0 {
+			report.Skipped = append(report.Skipped, name)
+			continue
+		}
+		if dryRun {
+			report.Stacks = append(report.Stacks, name)
+			continue
+		}
+
+		pruned, err := b.pruneStack(ctx, ref)
+		var conflict *LockConflictError
+		switch {
+		case errors.As(err, &conflict):
+			// Locked since we looked.
+			report.Skipped = append(report.Skipped, name)
+		case err != nil:
+			return &report, fmt.Errorf("prune stack %v: %w", name, err)
+		case pruned:
+			report.Stacks = append(report.Stacks, name)
+		}
+	}
+	return &report, nil
+}
+
+// pruneStack moves the given stack to the trash if it's still empty once it's locked,
+// and reports whether it did.
+//
+// The stack is never waited for, and its locks are never broken,
+// regardless of Options.OnLockConflict.
+func (b *localBackend) pruneStack(ctx context.Context, ref *localBackendReference) (bool, error) {
+	if err := b.lock(ctx, ref, nil /* onConflict */); err != nil {
+		return false, err
+	}
+	defer b.Unlock(ctx, ref)
+
+	// An update may have finished between the scan and the lock.
+	empty, err := b.isEmptyStack(ctx, ref)
+	if err != nil || !empty {
+		return false, err
+	}
+	return true, b.trashStack(ctx, ref)
+}
+
+// isEmptyStack reports whether the checkpoint of the given stack
+// has no resources and no pending operations.
+// Stacks that have never been updated are empty,
+// and those removed since they were listed are not.
+func (b *localBackend) isEmptyStack(ctx context.Context, ref *localBackendReference) (bool, error) {
+	chk, err := b.getCheckpoint(ctx, ref)
+	switch {
+	case gcerrors.Code(err) == gcerrors.NotFound:
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return isEmptyDeployment(chk.Latest), nil
+}
+
+func isEmptyDeployment(d *apitype.DeploymentV3) bool {
+	return d == nil || (len(d.Resources) == 0 && len(d.PendingOperations) == 0)
+}
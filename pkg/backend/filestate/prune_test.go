@@ -0,0 +1,136 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+func TestPruneEmptyStacks(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	clk := newFakeClock()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"}, &localBackendOptions{
+			Getenv: mapGetenv(nil),
+			Clock:  clk,
+			// Pruning never breaks locks.
+			OnLockConflict: func(LockInfo) LockConflictAction { return LockConflictBreak },
+		})
+	require.NoError(t, err)
+
+	save := func(name string, deployment apitype.DeploymentV3) *localBackendReference {
+		ref, err := b.parseStackReference(name)
+		require.NoError(t, err)
+		_, err = b.CreateStack(ctx, ref, "", nil)
+		require.NoError(t, err)
+		raw, err := encoding.JSON.Marshal(apitype.CheckpointV3{Stack: ref.FullyQualifiedName(), Latest: &deployment})
+		require.NoError(t, err)
+		_, _, err = b.saveCheckpoint(ctx, ref, &apitype.VersionedCheckpoint{
+			Version:    apitype.DeploymentSchemaVersionCurrent,
+			Checkpoint: raw,
+		})
+		require.NoError(t, err)
+		return ref
+	}
+
+	destroyed := save("destroyed", apitype.DeploymentV3{})
+	neverUpdated, err := b.parseStackReference("new")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, neverUpdated, "", nil)
+	require.NoError(t, err)
+	_, _, err = b.saveCheckpoint(ctx, save("full", apitype.DeploymentV3{}), newTestCheckpoint(t, 2))
+	require.NoError(t, err)
+	save("pending", apitype.DeploymentV3{
+		PendingOperations: []apitype.OperationV2{{
+			Resource: apitype.ResourceV3{URN: "urn:pulumi:pending::proj::pkg:index:Res::a", Type: "pkg:index:Res"},
+			Type:     apitype.OperationTypeCreating,
+		}},
+	})
+	save("busy", apitype.DeploymentV3{})
+	writeLock(t, b, "busy", "other", LockInfo{Pid: 42, Timestamp: time.Now()})
+
+	want := &PruneReport{
+		DryRun:  true,
+		Stacks:  []string{"organization/proj/destroyed", "organization/proj/new"},
+		Skipped: []string{"organization/proj/busy"},
+	}
+
+	// Dry runs don't remove anything.
+	report, err := b.PruneEmptyStacks(ctx, true /* dryRun */)
+	require.NoError(t, err)
+	assert.Equal(t, want, report)
+	stk, err := b.GetStack(ctx, destroyed)
+	require.NoError(t, err)
+	assert.NotNil(t, stk)
+
+	want.DryRun = false
+	report, err = b.PruneEmptyStacks(ctx, false /* dryRun */)
+	require.NoError(t, err)
+	assert.Equal(t, want, report)
+
+	stacks, _, err := b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+	require.NoError(t, err)
+	var names []string
+	for _, s := range stacks {
+		names = append(names, s.Name().String())
+	}
+	assert.ElementsMatch(t, []string{"busy", "full", "pending"}, names)
+	locks, err := b.locker.Locks(ctx, "organization/proj/busy")
+	require.NoError(t, err)
+	assert.Len(t, locks, 1)
+
+	// Pruned stacks are in the trash, even without soft deletion.
+	trash, err := b.ListTrash(ctx)
+	require.NoError(t, err)
+	require.Len(t, trash, 2)
+	require.NoError(t, b.RestoreStack(ctx, destroyed, ""))
+	stk, err = b.GetStack(ctx, destroyed)
+	require.NoError(t, err)
+	assert.NotNil(t, stk)
+
+	// The lock of the pruning backend isn't left behind.
+	locks, err = b.locker.Locks(ctx, destroyed.FullyQualifiedName())
+	require.NoError(t, err)
+	assert.Empty(t, locks)
+}
+
+func TestPruneEmptyStacks_readOnly(t *testing.T) {
+	t.Parallel()
+
+	b, err := newLocalBackend(context.Background(), diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"}, &localBackendOptions{Getenv: mapGetenv(nil), ReadOnly: true})
+	require.NoError(t, err)
+
+	report, err := b.PruneEmptyStacks(context.Background(), true /* dryRun */)
+	require.NoError(t, err)
+	assert.Empty(t, report.Stacks)
+
+	_, err = b.PruneEmptyStacks(context.Background(), false /* dryRun */)
+	assert.ErrorIs(t, err, ErrReadOnly)
+}
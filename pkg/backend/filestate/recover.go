@@ -0,0 +1,86 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
+)
+
+// isRecoverableCheckpointError reports whether a checkpoint that failed to load with err
+// may be recovered from the history of its stack.
+//
+// That's the case if the checkpoint is missing or corrupt.
+// Failed requests to the state store, such as timeouts, are reported with a code
+// and aren't recovered from: the checkpoint may be fine.
+func isRecoverableCheckpointError(err error) bool {
+	switch gcerrors.Code(err) {
+	case gcerrors.NotFound, gcerrors.Unknown:
+		return true
+	default:
+		return false
+	}
+}
+
+// recoverCheckpoint is called when the checkpoint of the given stack
+// failed to load with loadErr.
+//
+// If recovery from history is enabled and the checkpoint is missing or corrupt,
+// it returns the checkpoint saved with the most recent update
+// whose checkpoint can be read and decoded, warning that it did so.
+// The checkpoint in the state store is left as is
+// so that every load warns until it's replaced by the next update.
+//
+// Otherwise, or if no update has a usable checkpoint, it returns loadErr.
+// Missing checkpoints of stacks without history stay NotFound errors
+// because those stacks don't exist.
+func (b *localBackend) recoverCheckpoint(
+	ctx context.Context, ref *localBackendReference, loadErr error,
+) (*apitype.CheckpointV3, error) {
+	if !b.recoverFromHistory || !isRecoverableCheckpointError(loadErr) {
+		return nil, loadErr
+	}
+
+	updates, err := b.ListUpdates(ctx, ref, &ListUpdatesOptions{IncludeArchived: true})
+	if err != nil {
+		return nil, fmt.Errorf("%w (recovering from history failed: %v)", loadErr, err)
+	}
+	if len(updates) == 0 {
+		return nil, loadErr
+	}
+
+	for _, u := range updates {
+		chk, err := b.GetCheckpointAt(ctx, ref, u.ID)
+		if err != nil {
+			logging.V(5).Infof("cannot recover stack %v from update %v: %v", ref, u.ID, err)
+			continue
+		}
+
+		b.d.Warningf(diag.Message("", "The checkpoint of stack %v could not be loaded: %v\n"+
+			"Using the checkpoint saved with update %v at %v instead. "+
+			"Changes made after that update are not reflected in it. "+
+			"The next update of the stack will replace the checkpoint."),
+			ref, loadErr, u.ID, time.Unix(u.EndTime, 0).UTC().Format(time.RFC3339))
+		return chk, nil
+	}
+	return nil, fmt.Errorf("%w (no update in the history of the stack has a usable checkpoint)", loadErr)
+}
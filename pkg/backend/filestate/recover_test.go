@@ -0,0 +1,155 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag/colors"
+)
+
+// newRecoveryBackend returns a backend with recovery from history enabled
+// and a stack with n updates, the ith of which saved a checkpoint with i resources.
+// Warnings are written to the returned buffer.
+func newRecoveryBackend(t *testing.T, n int) (*localBackend, *localBackendReference, *bytes.Buffer) {
+	t.Helper()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, map[string]string{PulumiFilestateRecoverFromHistoryEnvVar: "true"})
+	var buff bytes.Buffer
+	b.d = diag.DefaultSink(io.Discard, &buff, diag.FormatOptions{Color: colors.Never})
+
+	for i := 1; i <= n; i++ {
+		_, _, err := b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, i))
+		require.NoError(t, err)
+		require.NoError(t, b.addToHistory(ctx, ref, backend.UpdateInfo{
+			Kind:    "update",
+			Message: strconv.Itoa(i),
+		}))
+	}
+	return b, ref, &buff
+}
+
+func TestRecoverCheckpoint_corrupt(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref, buff := newRecoveryBackend(t, 2)
+	require.NoError(t, b.bucket.WriteAll(ctx, b.stackPath(ctx, ref), []byte("{not json"), nil))
+
+	chk, err := b.getCheckpoint(ctx, ref)
+	require.NoError(t, err)
+	assert.Len(t, chk.Latest.Resources, 2)
+	assert.Contains(t, buff.String(), "The checkpoint of stack foo could not be loaded")
+
+	// The corrupt checkpoint is left in place, so every load warns.
+	_, err = b.getCheckpoint(ctx, ref)
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(buff.String(), "could not be loaded"))
+
+	// The next update replaces it.
+	_, _, err = b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 3))
+	require.NoError(t, err)
+	chk, err = b.getCheckpoint(ctx, ref)
+	require.NoError(t, err)
+	assert.Len(t, chk.Latest.Resources, 3)
+	assert.Equal(t, 2, strings.Count(buff.String(), "could not be loaded"))
+}
+
+func TestRecoverCheckpoint_skipsCorruptHistory(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref, _ := newRecoveryBackend(t, 2)
+	require.NoError(t, b.bucket.WriteAll(ctx, b.stackPath(ctx, ref), []byte("{not json"), nil))
+
+	// Corrupt the checkpoint saved with the most recent update.
+	updates, err := b.ListUpdates(ctx, ref, nil)
+	require.NoError(t, err)
+	require.Len(t, updates, 2)
+	chkpath, _, err := b.readHistoryCheckpoint(ctx, ref, updates[0].ID)
+	require.NoError(t, err)
+	require.NoError(t, b.bucket.WriteAll(ctx, chkpath, []byte("{not json"), nil))
+
+	chk, err := b.getCheckpoint(ctx, ref)
+	require.NoError(t, err)
+	assert.Len(t, chk.Latest.Resources, 1)
+}
+
+func TestRecoverCheckpoint_nothingUsable(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref, _ := newRecoveryBackend(t, 1)
+	updates, err := b.ListUpdates(ctx, ref, nil)
+	require.NoError(t, err)
+	chkpath, _, err := b.readHistoryCheckpoint(ctx, ref, updates[0].ID)
+	require.NoError(t, err)
+	require.NoError(t, b.bucket.WriteAll(ctx, chkpath, []byte("{not json"), nil))
+	require.NoError(t, b.bucket.WriteAll(ctx, b.stackPath(ctx, ref), []byte("{not json"), nil))
+
+	_, err = b.getCheckpoint(ctx, ref)
+	assert.ErrorContains(t, err, "no update in the history of the stack has a usable checkpoint")
+}
+
+func TestRecoverCheckpoint_missing(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref, buff := newRecoveryBackend(t, 1)
+	require.NoError(t, b.bucket.Delete(ctx, b.stackPath(ctx, ref)))
+
+	stk, err := b.GetStack(ctx, ref)
+	require.NoError(t, err)
+	require.NotNil(t, stk)
+	assert.Contains(t, buff.String(), "could not be loaded")
+
+	// Stacks without history still don't exist.
+	other, err := b.parseStackReference("other")
+	require.NoError(t, err)
+	stk, err = b.GetStack(ctx, other)
+	require.NoError(t, err)
+	assert.Nil(t, stk)
+}
+
+func TestRecoverCheckpoint_disabled(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref, _ := newRecoveryBackend(t, 1)
+	b.recoverFromHistory = false
+	require.NoError(t, b.bucket.WriteAll(ctx, b.stackPath(ctx, ref), []byte("{not json"), nil))
+
+	_, err := b.getCheckpoint(ctx, ref)
+	assert.Error(t, err)
+}
+
+func TestIsRecoverableCheckpointError(t *testing.T) {
+	t.Parallel()
+
+	_, err := decodeCheckpoint([]byte("{not json"))
+	assert.True(t, isRecoverableCheckpointError(err))
+	assert.False(t, isRecoverableCheckpointError(context.DeadlineExceeded))
+}
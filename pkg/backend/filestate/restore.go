@@ -0,0 +1,362 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
+)
+
+// SnapshotID identifies a snapshot of a stack taken with [Backend.Snapshot].
+//
+// IDs are UTC timestamps of when the snapshot was taken,
+// so they sort in the order the snapshots were taken.
+type SnapshotID string
+
+// snapshotTimeFormat is the layout of the timestamps used as snapshot IDs.
+//
+// Snapshots are stored next to the automatic backups of a stack.
+// Those are named "$stack.$nanos.json", which never matches this layout.
+const snapshotTimeFormat = "20060102T150405.000000000Z"
+
+// restoreUpdate is the kind of the history entry
+// recorded when a stack is restored from a snapshot.
+const restoreUpdate apitype.UpdateKind = "restore"
+
+// errNoSnapshot is returned when the checkpoint of a stack is read
+// from a backend opened at a snapshot that predates all snapshots of the stack.
+var errNoSnapshot = errors.New("no snapshot")
+
+// snapshotRetention specifies which snapshots of a stack are kept
+// when a new snapshot is taken.
+// Zero values mean no limit.
+type snapshotRetention struct {
+	// MaxAge is the age after which snapshots are pruned.
+	MaxAge time.Duration
+
+	// MaxCount is the maximum number of snapshots kept.
+	MaxCount int
+}
+
+// stackSnapshot is a snapshot of a stack stored in the bucket.
+type stackSnapshot struct {
+	id   SnapshotID
+	key  string
+	size int64
+	time time.Time
+}
+
+// listSnapshots returns all snapshots of the given stack,
+// oldest first.
+func (b *localBackend) listSnapshots(ctx context.Context, ref *localBackendReference) ([]stackSnapshot, error) {
+	files, err := listBucket(ctx, b.bucket, ref.BackupDir())
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []stackSnapshot
+	for _, file := range files {
+		if file.IsDir {
+			continue
+		}
+
+		name := strings.TrimSuffix(objectName(file), encoding.GZIPExt)
+		ext := filepath.Ext(name)
+		if ext != ".json" && (ext != objectRefExt || name != objectName(file)) {
+			continue
+		}
+		id := strings.TrimSuffix(name, ext)
+		t, err := time.Parse(snapshotTimeFormat, id)
+		if err != nil {
+			// Not a snapshot, e.g. an automatic backup.
+			continue
+		}
+		snapshots = append(snapshots, stackSnapshot{id: SnapshotID(id), key: file.Key, size: file.Size, time: t})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].time.Before(snapshots[j].time)
+	})
+	return snapshots, nil
+}
+
+func (b *localBackend) Snapshot(
+	ctx context.Context, stackRef backend.StackReference, events chan<- ProgressEvent,
+) (_ SnapshotID, err error) {
+	ctx = withOperationID(ctx)
+	defer func() { err = operationError(ctx, err) }()
+
+	progress := newProgressReporter(ctx, ProgressPrune, events)
+	defer progress.close()
+
+	ref, err := b.getReference(stackRef)
+	if err != nil {
+		return "", err
+	}
+	return b.snapshot(ctx, ref, progress)
+}
+
+// snapshot takes a snapshot of the given stack
+// and reports pruned snapshots to progress.
+func (b *localBackend) snapshot(
+	ctx context.Context, ref *localBackendReference, progress *progressReporter,
+) (SnapshotID, error) {
+	if err := b.checkWritable(); err != nil {
+		return "", err
+	}
+
+	chkpath := b.stackPath(ctx, ref)
+	byts, err := b.bucket.ReadAll(ctx, chkpath)
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return "", fmt.Errorf("stack %v does not exist", ref)
+		}
+		return "", fmt.Errorf("read checkpoint: %w", err)
+	}
+
+	now := b.clock.Now().UTC()
+	id := SnapshotID(now.Format(snapshotTimeFormat))
+	if b.dedupSnapshots {
+		if err := b.writeSnapshotRef(ctx, ref, id, byts); err != nil {
+			return "", err
+		}
+	} else {
+		// Keep the snapshot in the same format as the checkpoint
+		// so that it can be copied back verbatim.
+		file := string(id) + ".json"
+		var writeOpts *blob.WriterOptions
+		if filepath.Ext(chkpath) == encoding.GZIPExt {
+			file += encoding.GZIPExt
+			if !isEncryptedCheckpoint(byts) {
+				writeOpts = gzipWriterOptions()
+			}
+		}
+		if err := b.bucket.WriteAll(ctx, filepath.Join(ref.BackupDir(), file), byts, writeOpts); err != nil {
+			return "", fmt.Errorf("write snapshot: %w", err)
+		}
+	}
+
+	// The snapshot was taken successfully,
+	// so don't fail if we can't clean up older ones.
+	if err := b.pruneSnapshots(ctx, ref, now, progress); err != nil {
+		b.sink(ctx).Warningf(diag.Message("", "Could not prune old snapshots of stack %v: %v"), ref, err)
+	}
+	return id, nil
+}
+
+// writeSnapshotRef saves the given checkpoint file contents as snapshot id of the given stack
+// by storing them as an object, if they aren't already, and writing a reference to it.
+func (b *localBackend) writeSnapshotRef(
+	ctx context.Context, ref *localBackendReference, id SnapshotID, byts []byte,
+) error {
+	sum, err := writeObject(ctx, b.bucket, byts)
+	if err != nil {
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	key := path.Join(filepath.ToSlash(ref.BackupDir()), string(id)+objectRefExt)
+	if err := b.bucket.WriteAll(ctx, key, []byte(sum+"\n"), nil); err != nil {
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+
+	// GC deletes objects that no snapshot refers to while it holds the store lock,
+	// so it may have missed this reference if it started before it was written.
+	// Back out rather than leave a reference to an object that may be deleted.
+	var storeLockID string
+	if lockID := b.storeLockID.Load(); lockID != nil {
+		storeLockID = *lockID
+	}
+	if err := checkStoreLock(ctx, b.bucket, storeLockID); err != nil {
+		if delErr := b.bucket.Delete(ctx, key); delErr != nil {
+			logging.V(5).Infof("error deleting snapshot reference %v: %v", key, delErr)
+		}
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	return nil
+}
+
+// pruneSnapshots deletes snapshots of the given stack
+// that are not retained by the backend's retention policy.
+func (b *localBackend) pruneSnapshots(
+	ctx context.Context, ref *localBackendReference, now time.Time, progress *progressReporter,
+) error {
+	r := b.snapshotRetention
+	if r.MaxAge == 0 && r.MaxCount == 0 {
+		return nil
+	}
+
+	snapshots, err := b.listSnapshots(ctx, ref)
+	if err != nil {
+		return err
+	}
+
+	for i, s := range snapshots {
+		// snapshots is sorted oldest first.
+		tooMany := r.MaxCount > 0 && len(snapshots)-i > r.MaxCount
+		tooOld := r.MaxAge > 0 && now.Sub(s.time) > r.MaxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		if err := b.bucket.Delete(ctx, s.key); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+			return fmt.Errorf("delete snapshot %v: %w", s.id, err)
+		}
+		progress.report(ref.String(), s.key, s.size)
+	}
+	return nil
+}
+
+func (b *localBackend) Restore(ctx context.Context, stackRef backend.StackReference, id SnapshotID) (err error) {
+	ctx = withOperationID(ctx)
+	defer func() { err = operationError(ctx, err) }()
+
+	ref, err := b.getReference(stackRef)
+	if err != nil {
+		return err
+	}
+	if _, err := time.Parse(snapshotTimeFormat, string(id)); err != nil {
+		return fmt.Errorf("invalid snapshot ID %q", id)
+	}
+
+	if err := b.Lock(ctx, stackRef); err != nil {
+		return err
+	}
+	defer b.Unlock(ctx, stackRef)
+
+	snapshots, err := b.listSnapshots(ctx, ref)
+	if err != nil {
+		return err
+	}
+	var key string
+	for _, s := range snapshots {
+		if s.id == id {
+			key = s.key
+			break
+		}
+	}
+	if key == "" {
+		return fmt.Errorf("snapshot %v of stack %v not found", id, ref)
+	}
+
+	// Read the snapshot before taking the safety snapshot
+	// because the retention policy may prune it.
+	chk, err := b.readSnapshot(ctx, ref, stackSnapshot{id: id, key: key})
+	if err != nil {
+		return err
+	}
+
+	safety, err := b.snapshot(ctx, ref, nil /* progress */)
+	if err != nil {
+		return fmt.Errorf("snapshot current state: %w", err)
+	}
+	b.sink(ctx).Infoerrf(diag.Message("", "Saved the current state of stack %v as snapshot %v"), ref, safety)
+
+	chkJSON, err := encoding.JSON.Marshal(chk)
+	if err != nil {
+		return fmt.Errorf("marshalling checkpoint: %w", err)
+	}
+	_, _, err = b.saveCheckpoint(ctx, ref, &apitype.VersionedCheckpoint{
+		Version:    apitype.DeploymentSchemaVersionCurrent,
+		Checkpoint: json.RawMessage(chkJSON),
+	})
+	if err != nil {
+		return err
+	}
+
+	now := b.clock.Now().Unix()
+	err = b.addToHistory(ctx, ref, backend.UpdateInfo{
+		Kind:      restoreUpdate,
+		StartTime: now,
+		EndTime:   now,
+		Message:   fmt.Sprintf("restored snapshot %v (previous state saved as snapshot %v)", id, safety),
+		Result:    backend.SucceededResult,
+	})
+	if err != nil {
+		return fmt.Errorf("record restore in history: %w", err)
+	}
+	return nil
+}
+
+// readSnapshot reads and decodes the checkpoint stored in the given snapshot of a stack.
+func (b *localBackend) readSnapshot(
+	ctx context.Context, ref *localBackendReference, s stackSnapshot,
+) (*apitype.CheckpointV3, error) {
+	byts, err := b.readSnapshotFile(ctx, s)
+	if err != nil {
+		return nil, fmt.Errorf("read snapshot %v: %w", s.id, err)
+	}
+	byts, err = unsealCheckpoint(ctx, b.crypter, s.key, byts)
+	if err != nil {
+		return nil, fmt.Errorf("read snapshot %v: %w", s.id, err)
+	}
+	chk, err := decodeCheckpoint(byts)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot %v is corrupt: %w", s.id, err)
+	}
+	// The stack may have been renamed since the snapshot was taken.
+	chk.Stack = ref.FullyQualifiedName()
+	return chk, nil
+}
+
+// readSnapshotFile returns the contents of the checkpoint file saved by the given snapshot,
+// resolving references to objects.
+func (b *localBackend) readSnapshotFile(ctx context.Context, s stackSnapshot) ([]byte, error) {
+	if path.Ext(s.key) != objectRefExt {
+		return b.bucket.ReadAll(ctx, s.key)
+	}
+	sum, err := readObjectRef(ctx, b.bucket, s.key)
+	if err != nil {
+		return nil, err
+	}
+	return readObject(ctx, b.bucket, sum)
+}
+
+// getCheckpointAtSnapshot reads the checkpoint of the given stack
+// from its latest snapshot taken at or before the snapshot the backend was opened at.
+func (b *localBackend) getCheckpointAtSnapshot(
+	ctx context.Context, ref *localBackendReference,
+) (*apitype.CheckpointV3, error) {
+	// The ID was validated when the backend was created.
+	at, err := time.Parse(snapshotTimeFormat, string(b.atSnapshot))
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, err := b.listSnapshots(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	// snapshots is sorted oldest first.
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if !snapshots[i].time.After(at) {
+			return b.readSnapshot(ctx, ref, snapshots[i])
+		}
+	}
+	return nil, fmt.Errorf("%w: stack %v has no snapshot taken at or before %v", errNoSnapshot, ref, b.atSnapshot)
+}
@@ -0,0 +1,272 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// newSnapshotBackend creates a backend with the given environment
+// and a stack named "foo".
+func newSnapshotBackend(t *testing.T, env map[string]string) (*localBackend, *localBackendReference) {
+	t.Helper()
+
+	b := newTestBackend(t, t.TempDir(), &localBackendOptions{Getenv: mapGetenv(env)})
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	_, err = b.CreateStack(context.Background(), ref, "", nil)
+	require.NoError(t, err)
+	return b, ref
+}
+
+func snapshotIDs(t *testing.T, b *localBackend, ref *localBackendReference) []SnapshotID {
+	t.Helper()
+
+	snapshots, err := b.listSnapshots(context.Background(), ref)
+	require.NoError(t, err)
+	ids := make([]SnapshotID, len(snapshots))
+	for i, s := range snapshots {
+		ids[i] = s.id
+	}
+	return ids
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, nil)
+
+	id, err := b.Snapshot(ctx, ref, nil /* events */)
+	require.NoError(t, err)
+
+	// Change the stack after the snapshot.
+	_, _, err = b.saveCheckpoint(ctx, ref, &apitype.VersionedCheckpoint{
+		Version:    apitype.DeploymentSchemaVersionCurrent,
+		Checkpoint: []byte(legacyCheckpoint),
+	})
+	require.NoError(t, err)
+	chk, err := b.getCheckpoint(ctx, ref)
+	require.NoError(t, err)
+	require.NotNil(t, chk.Latest)
+
+	require.NoError(t, b.Restore(ctx, ref, id))
+
+	chk, err = b.getCheckpoint(ctx, ref)
+	require.NoError(t, err)
+	assert.Nil(t, chk.Latest)
+	assert.Equal(t, ref.FullyQualifiedName(), chk.Stack)
+
+	// The state before the restore was saved as a new snapshot.
+	ids := snapshotIDs(t, b, ref)
+	require.Len(t, ids, 2)
+	assert.Equal(t, id, ids[0])
+
+	history, err := b.GetHistory(ctx, ref, 0 /* pageSize */, 0 /* page */)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, restoreUpdate, history[0].Kind)
+	assert.Contains(t, history[0].Message, "restored snapshot "+string(id))
+	assert.Contains(t, history[0].Message, "previous state saved as snapshot "+string(ids[1]))
+}
+
+func TestRestore_errors(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, nil)
+
+	assert.ErrorContains(t, b.Restore(ctx, ref, "../../stacks/foo"), "invalid snapshot ID")
+	assert.ErrorContains(t, b.Restore(ctx, ref, "20200101T000000.000000000Z"),
+		"snapshot 20200101T000000.000000000Z of stack foo not found")
+}
+
+func TestSnapshot_retentionCount(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, map[string]string{
+		"PULUMI_SELF_MANAGED_STATE_SNAPSHOT_RETENTION_COUNT": "2",
+	})
+
+	var ids []SnapshotID
+	for i := 0; i < 3; i++ {
+		id, err := b.Snapshot(ctx, ref, nil /* events */)
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	assert.Equal(t, ids[1:], snapshotIDs(t, b, ref))
+}
+
+func TestSnapshot_pruneEvents(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, map[string]string{
+		"PULUMI_SELF_MANAGED_STATE_SNAPSHOT_RETENTION_COUNT": "1",
+	})
+
+	first, err := b.Snapshot(ctx, ref, nil /* events */)
+	require.NoError(t, err)
+	snapshots, err := b.listSnapshots(ctx, ref)
+	require.NoError(t, err)
+	require.Len(t, snapshots, 1)
+
+	events := make(chan ProgressEvent, 10)
+	_, err = b.Snapshot(ctx, ref, events)
+	require.NoError(t, err)
+
+	var got []ProgressEvent
+	for ev := range events {
+		got = append(got, ev)
+	}
+	require.Len(t, got, 1)
+	assert.Equal(t, ProgressEvent{
+		Operation: ProgressPrune,
+		Stack:     "foo",
+		Key:       snapshots[0].key,
+		Files:     1,
+		Bytes:     snapshots[0].size,
+	}, got[0])
+	assert.NotContains(t, snapshotIDs(t, b, ref), first)
+}
+
+func TestSnapshot_retentionDays(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, map[string]string{
+		"PULUMI_SELF_MANAGED_STATE_SNAPSHOT_RETENTION_DAYS": "7",
+	})
+
+	backupDir := filepath.ToSlash(ref.BackupDir())
+	old := time.Now().Add(-8 * 24 * time.Hour).UTC().Format(snapshotTimeFormat)
+	recent := time.Now().Add(-6 * 24 * time.Hour).UTC().Format(snapshotTimeFormat)
+	for _, name := range []string{old + ".json", recent + ".json", "foo.1234.json"} {
+		require.NoError(t, b.bucket.WriteAll(ctx, path.Join(backupDir, name), []byte("{}"), nil))
+	}
+
+	id, err := b.Snapshot(ctx, ref, nil /* events */)
+	require.NoError(t, err)
+	assert.Equal(t, []SnapshotID{SnapshotID(recent), id}, snapshotIDs(t, b, ref))
+
+	// Automatic backups are not snapshots and are never pruned.
+	exists, err := b.bucket.Exists(ctx, path.Join(backupDir, "foo.1234.json"))
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestNew_invalidSnapshotRetention(t *testing.T) {
+	t.Parallel()
+
+	for _, name := range []string{
+		"PULUMI_SELF_MANAGED_STATE_SNAPSHOT_RETENTION_DAYS",
+		"PULUMI_SELF_MANAGED_STATE_SNAPSHOT_RETENTION_COUNT",
+	} {
+		_, err := newLocalBackend(context.Background(), diagtest.LogSink(t),
+			"file://"+filepath.ToSlash(t.TempDir()), nil,
+			&localBackendOptions{Getenv: mapGetenv(map[string]string{name: "0"})})
+		assert.ErrorContains(t, err, "invalid "+name)
+	}
+}
+
+func TestNewWithOptions_atSnapshot(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, foo := newSnapshotBackend(t, nil)
+	before, err := b.Snapshot(ctx, foo, nil /* events */)
+	require.NoError(t, err)
+
+	_, _, err = b.saveCheckpoint(ctx, foo, &apitype.VersionedCheckpoint{
+		Version:    apitype.DeploymentSchemaVersionCurrent,
+		Checkpoint: []byte(legacyCheckpoint),
+	})
+	require.NoError(t, err)
+	after, err := b.Snapshot(ctx, foo, nil /* events */)
+	require.NoError(t, err)
+
+	// bar is only snapshotted after both snapshots of foo.
+	bar, err := b.parseStackReference("bar")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, bar, "", nil)
+	require.NoError(t, err)
+	_, err = b.Snapshot(ctx, bar, nil /* events */)
+	require.NoError(t, err)
+
+	open := func(t *testing.T, id SnapshotID) *localBackend {
+		sb, err := NewWithOptions(ctx, diagtest.LogSink(t), b.originalURL,
+			&workspace.Project{Name: "proj"}, &Options{AtSnapshot: id})
+		require.NoError(t, err)
+		return sb.(*localBackend)
+	}
+
+	t.Run("before", func(t *testing.T) {
+		t.Parallel()
+
+		sb := open(t, before)
+		chk, err := sb.getCheckpoint(ctx, foo)
+		require.NoError(t, err)
+		assert.Nil(t, chk.Latest)
+
+		_, err = sb.getCheckpoint(ctx, bar)
+		assert.ErrorContains(t, err, "stack bar has no snapshot taken at or before "+string(before))
+
+		stacks, _, err := sb.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+		require.NoError(t, err)
+		require.Len(t, stacks, 1)
+		assert.Equal(t, "foo", stacks[0].Name().String())
+	})
+
+	t.Run("after", func(t *testing.T) {
+		t.Parallel()
+
+		sb := open(t, after)
+		chk, err := sb.getCheckpoint(ctx, foo)
+		require.NoError(t, err)
+		assert.NotNil(t, chk.Latest)
+	})
+
+	t.Run("read-only", func(t *testing.T) {
+		t.Parallel()
+
+		sb := open(t, after)
+		_, err := sb.CreateStack(ctx, bar, "", nil)
+		assert.ErrorIs(t, err, ErrReadOnly)
+		assert.ErrorContains(t, err, "opened at snapshot "+string(after))
+		_, err = sb.Snapshot(ctx, foo, nil /* events */)
+		assert.ErrorIs(t, err, ErrReadOnly)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := NewWithOptions(ctx, diagtest.LogSink(t), b.originalURL,
+			&workspace.Project{Name: "proj"}, &Options{AtSnapshot: "latest"})
+		assert.ErrorContains(t, err, `invalid snapshot ID "latest"`)
+	})
+}
@@ -0,0 +1,354 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+	"google.golang.org/api/googleapi"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
+)
+
+const (
+	// defaultRetryMaxAttempts is the default number of times
+	// a bucket operation is attempted before giving up.
+	defaultRetryMaxAttempts = 5
+
+	// defaultRetryBaseDelay is the default delay before retrying
+	// a failed bucket operation for the first time.
+	defaultRetryBaseDelay = 100 * time.Millisecond
+
+	// retryMaxDelay caps the delay between two attempts.
+	retryMaxDelay = 10 * time.Second
+)
+
+// retryPolicy controls how bucket operations are retried.
+type retryPolicy struct {
+	// MaxAttempts is the total number of attempts of an operation,
+	// including the first one.
+	// Operations are not retried if this is 1 or less.
+	MaxAttempts int
+
+	// BaseDelay is the delay before the second attempt.
+	// It doubles with every following attempt up to retryMaxDelay.
+	BaseDelay time.Duration
+
+	// Budget is the total number of retries allowed across all bucket operations
+	// made on behalf of one operation of the backend; see withOperationID.
+	// There's no limit if this is zero.
+	Budget int
+}
+
+// ErrRetryBudgetExhausted is wrapped by the errors of requests to the state store
+// that weren't retried because the operation they were made for
+// already spent its retry budget (see Options.RetryBudget).
+var ErrRetryBudgetExhausted = errors.New("retry budget exhausted")
+
+// retryCountKey is the context key of the number of retries made by the operation in progress.
+type retryCountKey struct{}
+
+// withRetryCount returns a context that counts the retries of the bucket operations made with it.
+func withRetryCount(ctx context.Context) context.Context {
+	return context.WithValue(ctx, retryCountKey{}, new(atomic.Int64))
+}
+
+// spend counts a retry against the budget of the operation that ctx belongs to,
+// and reports whether the budget allows it.
+// Retries outside of an operation are only limited by MaxAttempts.
+func (p retryPolicy) spend(ctx context.Context) bool {
+	if p.Budget <= 0 {
+		return true
+	}
+	n, ok := ctx.Value(retryCountKey{}).(*atomic.Int64)
+	if !ok {
+		return true
+	}
+	return n.Add(1) <= int64(p.Budget)
+}
+
+// delay returns how long to wait after the given failed attempt,
+// counting from 1.
+//
+// To keep concurrent clients from retrying in lockstep,
+// the delay is picked at random from the upper half of the backoff window.
+func (p retryPolicy) delay(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && d < retryMaxDelay; i++ {
+		d *= 2
+	}
+	if d > retryMaxDelay {
+		d = retryMaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1)) //nolint:gosec // jitter needn't be secure
+}
+
+// isTransientError reports whether a failed bucket operation
+// may succeed if it is attempted again.
+func isTransientError(err error) bool {
+	var terr *timeoutError
+	if errors.As(err, &terr) {
+		// The request may have hung on a broken connection.
+		return true
+	}
+
+	switch gcerrors.Code(err) {
+	case gcerrors.Internal, gcerrors.ResourceExhausted, gcerrors.DeadlineExceeded:
+		return true
+	case gcerrors.Unknown:
+		// Drivers classify server errors such as "503 Service Unavailable" as Unknown,
+		// so check the underlying response.
+		return httpStatusCode(err) >= http.StatusInternalServerError
+	default:
+		return false
+	}
+}
+
+// httpStatusCode returns the status code of the HTTP response that caused err,
+// or zero if it's unknown.
+func httpStatusCode(err error) int {
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return gerr.Code
+	}
+	var aerr awserr.RequestFailure
+	if errors.As(err, &aerr) {
+		return aerr.StatusCode()
+	}
+	var serr *azblob.StorageError
+	if errors.As(err, &serr) && serr.Response() != nil {
+		return serr.StatusCode()
+	}
+	var rerr *azcore.ResponseError
+	if errors.As(err, &rerr) {
+		return rerr.StatusCode
+	}
+	return 0
+}
+
+// retryBucket wraps a Bucket, retrying operations that fail with transient errors
+// with exponential backoff.
+//
+// Listings are not retried because blob.ListIterator can't be wrapped.
+type retryBucket struct {
+	Bucket
+
+	policy retryPolicy
+
+	// sleep waits for the given duration or until the context is done.
+	// Defaults to sleepContext. Overridden in tests.
+	sleep func(context.Context, time.Duration) error
+}
+
+var _ Bucket = (*retryBucket)(nil)
+
+func newRetryBucket(b Bucket, policy retryPolicy) *retryBucket {
+	return &retryBucket{Bucket: b, policy: policy, sleep: sleepContext}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// do runs f until it succeeds, fails with an error that isn't transient,
+// or runs out of attempts or retry budget.
+// f is given the number of the attempt, counting from 1.
+func (b *retryBucket) do(ctx context.Context, op, key string, f func(attempt int) error) error {
+	return b.policy.run(ctx, op, key, b.sleep, f)
+}
+
+// run is retryBucket.do for operations that the bucket can't retry by itself,
+// such as streamed writes, which must be replayed in full.
+// sleep waits for the given duration or until the context is done.
+func (p retryPolicy) run(
+	ctx context.Context, op, key string, sleep func(context.Context, time.Duration) error, f func(attempt int) error,
+) error {
+	for attempt := 1; ; attempt++ {
+		err := f(attempt)
+		if err == nil || attempt >= p.MaxAttempts || ctx.Err() != nil || !isTransientError(err) {
+			return err
+		}
+		if !p.spend(ctx) {
+			logging.V(5).Infof("%v %q failed (attempt %d of %d), not retrying: the operation spent its %d retries: %v",
+				op, key, attempt, p.MaxAttempts, p.Budget, err)
+			return fmt.Errorf("%w after %d retries: %w", ErrRetryBudgetExhausted, p.Budget, err)
+		}
+
+		d := p.delay(attempt)
+		logging.V(5).Infof("%v %q failed (attempt %d of %d), retrying in %v: %v",
+			op, key, attempt, p.MaxAttempts, d, err)
+		if serr := sleep(ctx, d); serr != nil {
+			// Report the failure rather than the cancellation.
+			return err
+		}
+	}
+}
+
+func (b *retryBucket) operationTimeout() time.Duration {
+	return operationTimeout(b.Bucket)
+}
+
+func (b *retryBucket) Copy(ctx context.Context, dstKey, srcKey string, opts *blob.CopyOptions) error {
+	return b.do(ctx, "copy", dstKey, func(int) error {
+		return b.Bucket.Copy(ctx, dstKey, srcKey, opts)
+	})
+}
+
+func (b *retryBucket) Delete(ctx context.Context, key string) error {
+	return b.do(ctx, "delete", key, func(attempt int) error {
+		err := b.Bucket.Delete(ctx, key)
+		if attempt > 1 && gcerrors.Code(err) == gcerrors.NotFound {
+			// An earlier attempt deleted the file
+			// but failed before it could report success.
+			return nil
+		}
+		return err
+	})
+}
+
+func (b *retryBucket) DeleteBatch(ctx context.Context, keys []string) error {
+	// Deleting objects that no longer exist succeeds,
+	// so the whole batch can be attempted again.
+	return b.do(ctx, "delete batch", fmt.Sprintf("%d objects", len(keys)), func(int) error {
+		return deleteBatch(ctx, b.Bucket, keys)
+	})
+}
+
+// NewWriter is not retried because the contents can't be replayed.
+// Callers must retry the entire write instead; see writeAtomicStream.
+func (b *retryBucket) NewWriter(ctx context.Context, key string, opts *blob.WriterOptions) (io.WriteCloser, error) {
+	return newBucketWriter(ctx, b.Bucket, key, opts)
+}
+
+// NewReader retries opening the object, but not reading from it.
+func (b *retryBucket) NewReader(ctx context.Context, key string) (r io.ReadCloser, err error) {
+	err = b.do(ctx, "open", key, func(int) error {
+		r, err = newBucketReader(ctx, b.Bucket, key)
+		return err
+	})
+	return r, err
+}
+
+func (b *retryBucket) ObjectVersion(ctx context.Context, key string) (version string, err error) {
+	err = b.do(ctx, "stat", key, func(int) error {
+		version, err = objectVersion(ctx, b.Bucket, key)
+		return err
+	})
+	return version, err
+}
+
+func (b *retryBucket) RevisionsEnabled(ctx context.Context) (enabled bool, err error) {
+	err = b.do(ctx, "stat", "", func(int) error {
+		enabled, err = revisionsEnabled(ctx, b.Bucket)
+		return err
+	})
+	return enabled, err
+}
+
+func (b *retryBucket) ListRevisions(ctx context.Context, key string) (revisions []objectRevision, err error) {
+	err = b.do(ctx, "list", key, func(int) error {
+		revisions, err = listRevisions(ctx, b.Bucket, key)
+		return err
+	})
+	return revisions, err
+}
+
+func (b *retryBucket) ReadRevision(ctx context.Context, key, id string) (byts []byte, err error) {
+	err = b.do(ctx, "read", key, func(int) error {
+		byts, err = readRevision(ctx, b.Bucket, key, id)
+		return err
+	})
+	return byts, err
+}
+
+func (b *retryBucket) ListPage(
+	ctx context.Context, pageToken []byte, pageSize int, opts *blob.ListOptions,
+) (objs []*blob.ListObject, next []byte, err error) {
+	err = b.do(ctx, "list", opts.Prefix, func(int) error {
+		objs, next, err = listPage(ctx, b.Bucket, pageToken, pageSize, opts)
+		return err
+	})
+	return objs, next, err
+}
+
+// CopyIfVersion is retried like Copy.
+// If an attempt that failed had replaced the destination anyway,
+// the following attempts fail with ErrConcurrentModification.
+func (b *retryBucket) CopyIfVersion(ctx context.Context, dstKey, srcKey, version string) error {
+	return b.do(ctx, "copy", dstKey, func(int) error {
+		return copyIfVersion(ctx, b.Bucket, dstKey, srcKey, version)
+	})
+}
+
+func (b *retryBucket) SignedURL(ctx context.Context, key string, opts *blob.SignedURLOptions) (url string, err error) {
+	err = b.do(ctx, "sign", key, func(int) error {
+		url, err = b.Bucket.SignedURL(ctx, key, opts)
+		return err
+	})
+	return url, err
+}
+
+func (b *retryBucket) ReadAll(ctx context.Context, key string) (byts []byte, err error) {
+	err = b.do(ctx, "read", key, func(int) error {
+		byts, err = b.Bucket.ReadAll(ctx, key)
+		return err
+	})
+	return byts, err
+}
+
+func (b *retryBucket) WriteAll(ctx context.Context, key string, p []byte, opts *blob.WriterOptions) error {
+	return b.do(ctx, "write", key, func(int) error {
+		return b.Bucket.WriteAll(ctx, key, p, opts)
+	})
+}
+
+func (b *retryBucket) Exists(ctx context.Context, key string) (exists bool, err error) {
+	err = b.do(ctx, "stat", key, func(int) error {
+		exists, err = b.Bucket.Exists(ctx, key)
+		return err
+	})
+	return exists, err
+}
+
+func (b *retryBucket) Attributes(ctx context.Context, key string) (attrs *blob.Attributes, err error) {
+	err = b.do(ctx, "stat", key, func(int) error {
+		attrs, err = b.Bucket.Attributes(ctx, key)
+		return err
+	})
+	return attrs, err
+}
@@ -0,0 +1,395 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/fileblob"
+	"gocloud.dev/blob/memblob"
+	"google.golang.org/api/googleapi"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+func TestIsTransientError(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	_, notFound := memblob.OpenBucket(nil).ReadAll(ctx, "foo")
+	require.Error(t, notFound)
+
+	tests := []struct {
+		desc string
+		give error
+		want bool
+	}{
+		{desc: "unavailable", give: &googleapi.Error{Code: http.StatusServiceUnavailable}, want: true},
+		{desc: "internal", give: &googleapi.Error{Code: http.StatusInternalServerError}, want: true},
+		{
+			desc: "wrapped",
+			give: fmt.Errorf("read: %w", &googleapi.Error{Code: http.StatusBadGateway}),
+			want: true,
+		},
+		{desc: "deadline", give: context.DeadlineExceeded, want: true},
+		{
+			desc: "timeout",
+			give: &timeoutError{op: "read", key: "foo", timeout: time.Second, err: notFound},
+			want: true,
+		},
+		{desc: "permission denied", give: &googleapi.Error{Code: http.StatusForbidden}},
+		{desc: "not found", give: notFound},
+		{desc: "canceled", give: context.Canceled},
+		{desc: "other", give: errors.New("great sadness")},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, tt.want, isTransientError(tt.give))
+		})
+	}
+}
+
+func TestRetryPolicy_delay(t *testing.T) {
+	t.Parallel()
+
+	p := retryPolicy{MaxAttempts: 10, BaseDelay: 100 * time.Millisecond}
+	for attempt, want := range map[int]time.Duration{
+		1: 100 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		3: 400 * time.Millisecond,
+		9: retryMaxDelay,
+	} {
+		for i := 0; i < 10; i++ {
+			got := p.delay(attempt)
+			assert.GreaterOrEqual(t, got, want/2, "attempt %d", attempt)
+			assert.LessOrEqual(t, got, want, "attempt %d", attempt)
+		}
+	}
+
+	assert.Zero(t, retryPolicy{}.delay(1))
+}
+
+// flakyBucket is a Bucket that fails the first few reads and writes
+// with the given error.
+type flakyBucket struct {
+	Bucket
+
+	err      error
+	failures int // number of remaining failures
+	calls    int
+}
+
+func (b *flakyBucket) fail() error {
+	b.calls++
+	if b.failures > 0 {
+		b.failures--
+		return b.err
+	}
+	return nil
+}
+
+func (b *flakyBucket) ReadAll(ctx context.Context, key string) ([]byte, error) {
+	if err := b.fail(); err != nil {
+		return nil, err
+	}
+	return b.Bucket.ReadAll(ctx, key)
+}
+
+func (b *flakyBucket) WriteAll(ctx context.Context, key string, p []byte, opts *blob.WriterOptions) error {
+	if err := b.fail(); err != nil {
+		return err
+	}
+	return b.Bucket.WriteAll(ctx, key, p, opts)
+}
+
+func (b *flakyBucket) Delete(ctx context.Context, key string) error {
+	// Delete the file, but fail to report it.
+	err := b.Bucket.Delete(ctx, key)
+	if ferr := b.fail(); ferr != nil {
+		return ferr
+	}
+	return err
+}
+
+func newTestRetryBucket(b Bucket, maxAttempts int) (*retryBucket, *[]time.Duration) {
+	var sleeps []time.Duration
+	rb := newRetryBucket(b, retryPolicy{MaxAttempts: maxAttempts, BaseDelay: time.Second})
+	rb.sleep = func(_ context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		return nil
+	}
+	return rb, &sleeps
+}
+
+func TestRetryBucket(t *testing.T) {
+	t.Parallel()
+
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable}
+	forbidden := &googleapi.Error{Code: http.StatusForbidden}
+
+	t.Run("recovers", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+		flaky := &flakyBucket{
+			Bucket:   &wrappedBucket{bucket: memblob.OpenBucket(nil)},
+			err:      unavailable,
+			failures: 2,
+		}
+		b, sleeps := newTestRetryBucket(flaky, 3)
+
+		require.NoError(t, b.WriteAll(ctx, "foo", []byte("bar"), nil))
+		assert.Equal(t, 3, flaky.calls)
+		assert.Len(t, *sleeps, 2)
+
+		got, err := b.ReadAll(ctx, "foo")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("bar"), got)
+	})
+
+	t.Run("gives up", func(t *testing.T) {
+		t.Parallel()
+
+		flaky := &flakyBucket{
+			Bucket:   &wrappedBucket{bucket: memblob.OpenBucket(nil)},
+			err:      unavailable,
+			failures: 10,
+		}
+		b, sleeps := newTestRetryBucket(flaky, 3)
+
+		_, err := b.ReadAll(context.Background(), "foo")
+		assert.ErrorIs(t, err, unavailable)
+		assert.Equal(t, 3, flaky.calls)
+		assert.Len(t, *sleeps, 2)
+	})
+
+	t.Run("permanent error", func(t *testing.T) {
+		t.Parallel()
+
+		flaky := &flakyBucket{
+			Bucket:   &wrappedBucket{bucket: memblob.OpenBucket(nil)},
+			err:      forbidden,
+			failures: 10,
+		}
+		b, sleeps := newTestRetryBucket(flaky, 3)
+
+		err := b.WriteAll(context.Background(), "foo", []byte("bar"), nil)
+		assert.ErrorIs(t, err, forbidden)
+		assert.Equal(t, 1, flaky.calls)
+		assert.Empty(t, *sleeps)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		t.Parallel()
+
+		flaky := &flakyBucket{
+			Bucket:   &wrappedBucket{bucket: memblob.OpenBucket(nil)},
+			err:      unavailable,
+			failures: 10,
+		}
+		b := newRetryBucket(flaky, retryPolicy{MaxAttempts: 3, BaseDelay: time.Hour})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go cancel()
+		_, err := b.ReadAll(ctx, "foo")
+		assert.ErrorIs(t, err, unavailable)
+		assert.LessOrEqual(t, flaky.calls, 2)
+	})
+
+	t.Run("budget", func(t *testing.T) {
+		t.Parallel()
+
+		flaky := &flakyBucket{
+			Bucket:   &wrappedBucket{bucket: memblob.OpenBucket(nil)},
+			err:      unavailable,
+			failures: 100,
+		}
+		b, sleeps := newTestRetryBucket(flaky, 3)
+		b.policy.Budget = 3
+
+		// The budget is shared by all requests of an operation.
+		ctx := withOperationID(context.Background())
+		_, err := b.ReadAll(ctx, "foo")
+		assert.ErrorIs(t, err, unavailable)
+		assert.NotErrorIs(t, err, ErrRetryBudgetExhausted)
+		assert.Equal(t, 3, flaky.calls)
+
+		_, err = b.ReadAll(ctx, "foo")
+		assert.ErrorIs(t, err, unavailable)
+		assert.ErrorIs(t, err, ErrRetryBudgetExhausted)
+		assert.Equal(t, 5, flaky.calls)
+
+		// Once it's spent, requests fail after their first attempt.
+		err = b.WriteAll(ctx, "foo", []byte("bar"), nil)
+		assert.ErrorIs(t, err, ErrRetryBudgetExhausted)
+		assert.Equal(t, 6, flaky.calls)
+		assert.Len(t, *sleeps, 3)
+
+		// Other operations have budgets of their own.
+		_, err = b.ReadAll(withOperationID(context.Background()), "foo")
+		assert.NotErrorIs(t, err, ErrRetryBudgetExhausted)
+		assert.Equal(t, 9, flaky.calls)
+
+		// Nested operations share the budget of the enclosing one.
+		_, err = b.ReadAll(withOperationID(ctx), "foo")
+		assert.ErrorIs(t, err, ErrRetryBudgetExhausted)
+		assert.Equal(t, 10, flaky.calls)
+	})
+
+	t.Run("delete already deleted", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+		mem := &wrappedBucket{bucket: memblob.OpenBucket(nil)}
+		require.NoError(t, mem.WriteAll(ctx, "foo", []byte("bar"), nil))
+
+		flaky := &flakyBucket{Bucket: mem, err: unavailable, failures: 1}
+		b, _ := newTestRetryBucket(flaky, 3)
+		require.NoError(t, b.Delete(ctx, "foo"))
+		assert.Equal(t, 2, flaky.calls)
+
+		// Without a retry, deleting a missing file still fails.
+		assert.Error(t, b.Delete(ctx, "foo"))
+	})
+}
+
+func TestNew_retryOptions(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	newBackend := func(t *testing.T, env map[string]string, opts *localBackendOptions) (*localBackend, error) {
+		if opts == nil {
+			opts = &localBackendOptions{}
+		}
+		opts.Getenv = mapGetenv(env)
+		return newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+			&workspace.Project{Name: "testproj"}, opts)
+	}
+	policy := func(t *testing.T, b *localBackend) retryPolicy {
+		var found *retryBucket
+		for bucket := b.bucket; bucket != nil; {
+			switch bb := bucket.(type) {
+			case *retryBucket:
+				found = bb
+				bucket = nil
+			case *readOnlyBucket:
+				bucket = bb.Bucket
+			default:
+				bucket = nil
+			}
+		}
+		require.NotNil(t, found, "retryBucket not found")
+		return found.policy
+	}
+
+	t.Run("default", func(t *testing.T) {
+		t.Parallel()
+
+		b, err := newBackend(t, nil, nil)
+		require.NoError(t, err)
+		assert.Equal(t, retryPolicy{
+			MaxAttempts: defaultRetryMaxAttempts,
+			BaseDelay:   defaultRetryBaseDelay,
+		}, policy(t, b))
+	})
+
+	t.Run("env", func(t *testing.T) {
+		t.Parallel()
+
+		b, err := newBackend(t, map[string]string{
+			"PULUMI_SELF_MANAGED_STATE_RETRY_ATTEMPTS": "2",
+			"PULUMI_SELF_MANAGED_STATE_RETRY_DELAY":    "1s",
+		}, nil)
+		require.NoError(t, err)
+		assert.Equal(t, retryPolicy{MaxAttempts: 2, BaseDelay: time.Second}, policy(t, b))
+	})
+
+	t.Run("options override env", func(t *testing.T) {
+		t.Parallel()
+
+		b, err := newBackend(t, map[string]string{
+			"PULUMI_SELF_MANAGED_STATE_RETRY_ATTEMPTS": "2",
+			"PULUMI_SELF_MANAGED_STATE_RETRY_DELAY":    "1s",
+		}, &localBackendOptions{
+			RetryMaxAttempts: 7,
+			RetryBaseDelay:   time.Minute,
+			RetryBudget:      20,
+			ReadOnly:         true,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, retryPolicy{MaxAttempts: 7, BaseDelay: time.Minute, Budget: 20}, policy(t, b))
+	})
+
+	t.Run("invalid attempts", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := newBackend(t, map[string]string{
+			"PULUMI_SELF_MANAGED_STATE_RETRY_ATTEMPTS": "0",
+		}, nil)
+		assert.ErrorContains(t, err, `invalid PULUMI_SELF_MANAGED_STATE_RETRY_ATTEMPTS: "0"`)
+	})
+
+	t.Run("invalid delay", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := newBackend(t, map[string]string{
+			"PULUMI_SELF_MANAGED_STATE_RETRY_DELAY": "soon",
+		}, nil)
+		assert.ErrorContains(t, err, "invalid PULUMI_SELF_MANAGED_STATE_RETRY_DELAY")
+	})
+}
+
+// Upgrading the store spends a single retry budget across all of its requests.
+func TestRetryBudget_upgrade(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	stateDir := t.TempDir()
+	bucket, err := fileblob.OpenBucket(stateDir, nil)
+	require.NoError(t, err)
+	writeFiles(t, bucket, map[string]string{".pulumi/stacks/foo.json": legacyCheckpoint})
+
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+		&workspace.Project{Name: "proj"}, nil)
+	require.NoError(t, err)
+	flaky := &flakyBucket{
+		Bucket:   b.bucket,
+		err:      &googleapi.Error{Code: http.StatusServiceUnavailable},
+		failures: 100,
+	}
+	rb, sleeps := newTestRetryBucket(flaky, 10)
+	rb.policy.Budget = 2
+	b.bucket = rb
+
+	err = b.Upgrade(ctx)
+	assert.ErrorIs(t, err, ErrRetryBudgetExhausted)
+	assert.Equal(t, 3, flaky.calls)
+	assert.Len(t, *sleeps, 2)
+	assert.FileExists(t, filepath.Join(stateDir, ".pulumi", "stacks", "foo.json"))
+}
@@ -0,0 +1,330 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"gocloud.dev/blob"
+	"google.golang.org/api/iterator"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
+)
+
+// errRevisionsUnsupported is returned by revisionsEnabled, listRevisions, and readRevision
+// if the bucket can't access prior versions of objects.
+var errRevisionsUnsupported = errors.New("object versioning is not supported")
+
+// objectRevision is a version of an object
+// kept by a storage provider with object versioning enabled.
+//
+// These are called revisions to tell them apart
+// from the versions used for conditional writes.
+type objectRevision struct {
+	// ID identifies the revision, e.g. the S3 version ID or the GCS generation.
+	ID string
+
+	// ModTime is when the revision was written.
+	ModTime time.Time
+}
+
+// revisionBucket is implemented by Buckets that can read
+// prior versions of objects kept by the storage provider.
+type revisionBucket interface {
+	// RevisionsEnabled reports whether object versioning is enabled on the bucket.
+	RevisionsEnabled(ctx context.Context) (bool, error)
+
+	// ListRevisions returns all revisions of the object at key, most recent first.
+	ListRevisions(ctx context.Context, key string) ([]objectRevision, error)
+
+	// ReadRevision reads the contents of the given revision of the object at key.
+	ReadRevision(ctx context.Context, key, id string) ([]byte, error)
+}
+
+// revisionsEnabled reports whether the bucket keeps prior versions of objects,
+// or returns errRevisionsUnsupported if it can't access them.
+func revisionsEnabled(ctx context.Context, bucket Bucket) (bool, error) {
+	if rb, ok := bucket.(revisionBucket); ok {
+		return rb.RevisionsEnabled(ctx)
+	}
+	return false, errRevisionsUnsupported
+}
+
+// listRevisions returns all revisions of the object at key, most recent first,
+// if the bucket can access them, or errRevisionsUnsupported otherwise.
+func listRevisions(ctx context.Context, bucket Bucket, key string) ([]objectRevision, error) {
+	if rb, ok := bucket.(revisionBucket); ok {
+		return rb.ListRevisions(ctx, key)
+	}
+	return nil, errRevisionsUnsupported
+}
+
+// readRevision reads the given revision of the object at key
+// if the bucket can access it, or returns errRevisionsUnsupported otherwise.
+func readRevision(ctx context.Context, bucket Bucket, key, id string) ([]byte, error) {
+	if rb, ok := bucket.(revisionBucket); ok {
+		return rb.ReadRevision(ctx, key, id)
+	}
+	return nil, errRevisionsUnsupported
+}
+
+// revisioner accesses prior versions of objects for a specific storage provider.
+//
+// gocloud doesn't expose object versioning,
+// so these use the provider-specific clients that its drivers expose through As.
+// Keys are relative to the same prefix as those of the blob.Bucket they were made for.
+type revisioner interface {
+	enabled(ctx context.Context) (bool, error)
+	list(ctx context.Context, key string) ([]objectRevision, error)
+	read(ctx context.Context, key, id string) ([]byte, error)
+}
+
+// s3Revisioner uses S3 version IDs as revisions.
+type s3Revisioner struct {
+	client *s3.S3
+	bucket string
+	prefix string // prepended to all keys
+}
+
+// newS3Revisioner returns a revisioner for the given bucket opened from an s3:// URL,
+// with keys relative to the given prefix.
+//
+// It returns nil if the bucket doesn't use the AWS SDK v1,
+// which is the case if it was opened with "awssdk=v2".
+func newS3Revisioner(bucket *blob.Bucket, name, prefix string) revisioner {
+	var client *s3.S3
+	if !bucket.As(&client) {
+		return nil
+	}
+	return &s3Revisioner{client: client, bucket: name, prefix: prefix}
+}
+
+func (r *s3Revisioner) enabled(ctx context.Context) (bool, error) {
+	out, err := r.client.GetBucketVersioningWithContext(ctx, &s3.GetBucketVersioningInput{
+		Bucket: aws.String(r.bucket),
+	})
+	if err != nil {
+		return false, fmt.Errorf("get bucket versioning: %w", err)
+	}
+	return aws.StringValue(out.Status) == s3.BucketVersioningStatusEnabled, nil
+}
+
+func (r *s3Revisioner) list(ctx context.Context, key string) ([]objectRevision, error) {
+	key = r.prefix + key
+	var revisions []objectRevision
+	err := r.client.ListObjectVersionsPagesWithContext(ctx, &s3.ListObjectVersionsInput{
+		Bucket: aws.String(r.bucket),
+		Prefix: aws.String(key),
+	}, func(page *s3.ListObjectVersionsOutput, _ bool) bool {
+		// Versions of each key are listed most recent first.
+		// Delete markers are listed separately, so they're skipped.
+		for _, v := range page.Versions {
+			if aws.StringValue(v.Key) != key {
+				continue
+			}
+			revisions = append(revisions, objectRevision{
+				ID:      aws.StringValue(v.VersionId),
+				ModTime: aws.TimeValue(v.LastModified),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list object versions: %w", err)
+	}
+	return revisions, nil
+}
+
+func (r *s3Revisioner) read(ctx context.Context, key, id string) ([]byte, error) {
+	out, err := r.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket:    aws.String(r.bucket),
+		Key:       aws.String(r.prefix + key),
+		VersionId: aws.String(id),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get object version %v: %w", id, err)
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
+// gcsRevisioner uses object generations as revisions.
+type gcsRevisioner struct {
+	client *storage.Client
+	bucket string
+	prefix string // prepended to all keys
+}
+
+// newGCSRevisioner returns a revisioner for the given bucket opened from a gs:// URL,
+// with keys relative to the given prefix.
+func newGCSRevisioner(bucket *blob.Bucket, name, prefix string) revisioner {
+	var client *storage.Client
+	if !bucket.As(&client) {
+		return nil
+	}
+	return &gcsRevisioner{client: client, bucket: name, prefix: prefix}
+}
+
+func (r *gcsRevisioner) enabled(ctx context.Context) (bool, error) {
+	attrs, err := r.client.Bucket(r.bucket).Attrs(ctx)
+	if err != nil {
+		return false, fmt.Errorf("get bucket attributes: %w", err)
+	}
+	return attrs.VersioningEnabled, nil
+}
+
+func (r *gcsRevisioner) list(ctx context.Context, key string) ([]objectRevision, error) {
+	key = r.prefix + key
+	it := r.client.Bucket(r.bucket).Objects(ctx, &storage.Query{Prefix: key, Versions: true})
+
+	var generations []int64
+	created := make(map[int64]time.Time)
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("list object generations: %w", err)
+		}
+		if attrs.Name != key {
+			continue
+		}
+		generations = append(generations, attrs.Generation)
+		created[attrs.Generation] = attrs.Created
+	}
+
+	// Later generations are more recent.
+	sort.Slice(generations, func(i, j int) bool { return generations[i] > generations[j] })
+	revisions := make([]objectRevision, len(generations))
+	for i, g := range generations {
+		revisions[i] = objectRevision{ID: strconv.FormatInt(g, 10), ModTime: created[g]}
+	}
+	return revisions, nil
+}
+
+func (r *gcsRevisioner) read(ctx context.Context, key, id string) ([]byte, error) {
+	generation, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid object generation %q: %w", id, err)
+	}
+	rd, err := r.client.Bucket(r.bucket).Object(r.prefix + key).Generation(generation).NewReader(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("read object generation %v: %w", id, err)
+	}
+	defer rd.Close()
+	return io.ReadAll(rd)
+}
+
+// checkNativeVersioning reports whether prior checkpoints can be left
+// to the object versioning of the storage provider,
+// warning about why not otherwise.
+func (b *localBackend) checkNativeVersioning(ctx context.Context) bool {
+	const fallback = "checkpoints will be copied to the history directory instead"
+	enabled, err := revisionsEnabled(ctx, b.bucket)
+	switch {
+	case errors.Is(err, errRevisionsUnsupported):
+		b.d.Warningf(diag.Message("", "The state store does not support object versioning; "+fallback))
+		return false
+	case err != nil:
+		b.d.Warningf(diag.Message("", "Could not check whether object versioning is enabled: %v; "+fallback), err)
+		return false
+	case !enabled:
+		b.d.Warningf(diag.Message("", "Object versioning is not enabled on the state store; "+fallback))
+		return false
+	}
+	return true
+}
+
+// checkpointRevision records the revision of a checkpoint
+// that was current after an update.
+type checkpointRevision struct {
+	// Key is the key of the checkpoint,
+	// which changes if the stack is renamed or compressed.
+	Key string `json:"key"`
+
+	// ID identifies the revision of the checkpoint.
+	ID string `json:"id"`
+}
+
+// historyRevisionKey returns the key of the file recording
+// the revision of the checkpoint saved with the given history file.
+//
+// These are written instead of a copy of the checkpoint with native versioning.
+// They're named "$stack-$nanos.revision.json" so that they're moved
+// along with the history files when a stack is renamed.
+func historyRevisionKey(historyFile string) string {
+	idx := strings.LastIndex(historyFile, ".history.")
+	if idx == -1 {
+		return historyFile + ".revision.json"
+	}
+	return historyFile[:idx] + ".revision.json"
+}
+
+// writeHistoryRevision records the current revision of the checkpoint
+// at chkpath in the file at key.
+func (b *localBackend) writeHistoryRevision(ctx context.Context, key, chkpath string) error {
+	revs, err := listRevisions(ctx, b.bucket, chkpath)
+	if err != nil {
+		return err
+	}
+	if len(revs) == 0 {
+		return fmt.Errorf("no revisions of %v found", chkpath)
+	}
+	byts, err := json.Marshal(checkpointRevision{Key: chkpath, ID: revs[0].ID})
+	if err != nil {
+		return err
+	}
+	return b.bucket.WriteAll(ctx, key, byts, nil)
+}
+
+// readHistoryRevision returns the revision of the checkpoint
+// recorded with the given history file.
+// It returns a NotFound error if none was recorded.
+func (b *localBackend) readHistoryRevision(ctx context.Context, historyFile string) (checkpointRevision, error) {
+	var rev checkpointRevision
+	key := historyRevisionKey(historyFile)
+	byts, err := b.bucket.ReadAll(ctx, key)
+	if err != nil {
+		return rev, err
+	}
+	if err := json.Unmarshal(byts, &rev); err != nil {
+		return rev, fmt.Errorf("unmarshal %v: %w", key, err)
+	}
+	return rev, nil
+}
+
+// readCheckpointRevision reads the given revision of a checkpoint,
+// returning a description of where it was read from for error messages.
+func (b *localBackend) readCheckpointRevision(
+	ctx context.Context, rev checkpointRevision,
+) (string, []byte, error) {
+	byts, err := readRevision(ctx, b.bucket, rev.Key, rev.ID)
+	if err != nil {
+		return "", nil, fmt.Errorf("read revision %v of %v: %w", rev.ID, rev.Key, err)
+	}
+	return fmt.Sprintf("%v@%v", rev.Key, rev.ID), byts, nil
+}
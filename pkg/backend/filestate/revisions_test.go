@@ -0,0 +1,229 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag/colors"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// memRevisionBucket is a revisionBucket
+// that keeps a copy of every object written through it.
+type memRevisionBucket struct {
+	Bucket
+
+	mu        sync.Mutex
+	revisions map[string][]memRevision // newest last
+}
+
+type memRevision struct {
+	id   string
+	body []byte
+}
+
+var _ revisionBucket = (*memRevisionBucket)(nil)
+
+// record saves the current contents of the object at key as a new revision.
+func (b *memRevisionBucket) record(ctx context.Context, key string) error {
+	body, err := b.Bucket.ReadAll(ctx, key)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.revisions == nil {
+		b.revisions = make(map[string][]memRevision)
+	}
+	id := strconv.Itoa(len(b.revisions[key]) + 1)
+	b.revisions[key] = append(b.revisions[key], memRevision{id: id, body: body})
+	return nil
+}
+
+func (b *memRevisionBucket) WriteAll(ctx context.Context, key string, p []byte, opts *blob.WriterOptions) error {
+	if err := b.Bucket.WriteAll(ctx, key, p, opts); err != nil {
+		return err
+	}
+	return b.record(ctx, key)
+}
+
+func (b *memRevisionBucket) Copy(ctx context.Context, dstKey, srcKey string, opts *blob.CopyOptions) error {
+	if err := b.Bucket.Copy(ctx, dstKey, srcKey, opts); err != nil {
+		return err
+	}
+	return b.record(ctx, dstKey)
+}
+
+func (b *memRevisionBucket) RevisionsEnabled(context.Context) (bool, error) {
+	return true, nil
+}
+
+func (b *memRevisionBucket) ListRevisions(_ context.Context, key string) ([]objectRevision, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	revs := b.revisions[key]
+	out := make([]objectRevision, len(revs))
+	for i, rev := range revs {
+		out[len(revs)-1-i] = objectRevision{ID: rev.id, ModTime: time.Unix(int64(i), 0)}
+	}
+	return out, nil
+}
+
+func (b *memRevisionBucket) ReadRevision(_ context.Context, key, id string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, rev := range b.revisions[key] {
+		if rev.id == id {
+			return rev.body, nil
+		}
+	}
+	return nil, io.ErrUnexpectedEOF
+}
+
+func TestNativeVersioning(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, nil)
+	revs := &memRevisionBucket{Bucket: b.bucket}
+	b.bucket = revs
+	b.nativeVersioning = true
+
+	for i := 1; i <= 3; i++ {
+		_, _, err := b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, i))
+		require.NoError(t, err)
+		require.NoError(t, b.addToHistory(ctx, ref, backend.UpdateInfo{
+			Kind:    "update",
+			Message: strconv.Itoa(i),
+		}))
+	}
+
+	// No checkpoints were copied to the history directory.
+	keys := listKeys(t, b.bucket, ref.HistoryDir())
+	for _, key := range keys {
+		assert.NotContains(t, key, ".checkpoint.")
+	}
+	assert.NotEmpty(t, keys)
+
+	// But the checkpoint of every update can still be read.
+	updates, err := b.ListUpdates(ctx, ref, nil)
+	require.NoError(t, err)
+	require.Len(t, updates, 3)
+	for _, u := range updates {
+		n, err := strconv.Atoi(u.Message)
+		require.NoError(t, err)
+		chk, err := b.GetCheckpointAt(ctx, ref, u.ID)
+		require.NoError(t, err, "update %v", u.ID)
+		assert.Len(t, chk.Latest.Resources, n, "update %v", u.Message)
+	}
+
+	// The versions of the checkpoint are listed from the storage provider.
+	versions, err := b.ListCheckpointVersions(ctx, ref)
+	require.NoError(t, err)
+	require.NotEmpty(t, versions)
+	assert.True(t, versions[0].Native)
+	chk, err := b.GetCheckpointVersion(ctx, ref, versions[0].ID)
+	require.NoError(t, err)
+	assert.Len(t, chk.Latest.Resources, 3)
+}
+
+func TestNativeVersioning_compactArchive(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, nil)
+	b.bucket = &memRevisionBucket{Bucket: b.bucket}
+	b.nativeVersioning = true
+
+	for i := 1; i <= 2; i++ {
+		_, _, err := b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, i))
+		require.NoError(t, err)
+		require.NoError(t, b.addToHistory(ctx, ref, backend.UpdateInfo{Kind: "update"}))
+	}
+	updates, err := b.ListUpdates(ctx, ref, nil)
+	require.NoError(t, err)
+	require.Len(t, updates, 2)
+	oldest := updates[1].ID
+
+	require.NoError(t, b.CompactHistory(ctx, ref, 1, &CompactHistoryOptions{Archive: true}))
+	for _, key := range listKeys(t, b.bucket, ref.HistoryDir()) {
+		assert.False(t, strings.Contains(key, oldest) && strings.HasSuffix(key, ".revision.json"),
+			"revision file %v should have been archived", key)
+	}
+
+	// The revision is kept in the archive.
+	chk, err := b.GetCheckpointAt(ctx, ref, oldest)
+	require.NoError(t, err)
+	assert.Len(t, chk.Latest.Resources, 1)
+}
+
+func TestListCheckpointVersions_history(t *testing.T) {
+	t.Parallel()
+
+	// Without native versioning, the checkpoints saved with updates are listed.
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, nil)
+	_, _, err := b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 2))
+	require.NoError(t, err)
+	require.NoError(t, b.addToHistory(ctx, ref, backend.UpdateInfo{Kind: "update", EndTime: 42}))
+
+	versions, err := b.ListCheckpointVersions(ctx, ref)
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+	assert.False(t, versions[0].Native)
+	assert.Equal(t, time.Unix(42, 0), versions[0].Time)
+
+	chk, err := b.GetCheckpointVersion(ctx, ref, versions[0].ID)
+	require.NoError(t, err)
+	assert.Len(t, chk.Latest.Resources, 2)
+}
+
+func TestNativeVersioning_unsupported(t *testing.T) {
+	t.Parallel()
+
+	// Buckets without object versioning fall back to copying checkpoints.
+	var buff bytes.Buffer
+	b, err := newLocalBackend(context.Background(),
+		diag.DefaultSink(io.Discard, &buff, diag.FormatOptions{Color: colors.Never}),
+		"file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"},
+		&localBackendOptions{NativeVersioning: true})
+	require.NoError(t, err)
+
+	assert.False(t, b.nativeVersioning)
+	assert.Contains(t, buff.String(), "does not support object versioning")
+}
+
+func TestHistoryRevisionKey(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, ".pulumi/history/proj/dev/dev-123.revision.json",
+		historyRevisionKey(".pulumi/history/proj/dev/dev-123.history.json.gz"))
+}
@@ -0,0 +1,86 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/hashicorp/go-multierror"
+	"gocloud.dev/blob"
+)
+
+// s3MaxBatchDelete is the maximum number of objects
+// that S3 deletes in a single DeleteObjects request.
+const s3MaxBatchDelete = 1000
+
+// s3BatchDeleter deletes objects from an S3 bucket
+// with DeleteObjects requests.
+type s3BatchDeleter struct {
+	client *s3.S3
+	bucket string
+
+	// prefix is prepended to all keys.
+	// It must match the prefix of the blob.Bucket that the keys are relative to.
+	prefix string
+}
+
+var _ batchDeleter = (*s3BatchDeleter)(nil)
+
+// newS3BatchDeleter returns a batchDeleter for the given bucket
+// opened from an s3:// URL, with keys relative to the given prefix.
+//
+// It returns nil if the bucket doesn't use the AWS SDK v1,
+// which is the case if it was opened with "awssdk=v2".
+func newS3BatchDeleter(bucket *blob.Bucket, name, prefix string) batchDeleter {
+	var client *s3.S3
+	if !bucket.As(&client) {
+		return nil
+	}
+	return &s3BatchDeleter{client: client, bucket: name, prefix: prefix}
+}
+
+func (d *s3BatchDeleter) DeleteBatch(ctx context.Context, keys []string) error {
+	var merr *multierror.Error
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > s3MaxBatchDelete {
+			n = s3MaxBatchDelete
+		}
+		objects := make([]*s3.ObjectIdentifier, n)
+		for i, key := range keys[:n] {
+			objects[i] = &s3.ObjectIdentifier{Key: aws.String(d.prefix + key)}
+		}
+		keys = keys[n:]
+
+		out, err := d.client.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(d.bucket),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return fmt.Errorf("delete objects: %w", err)
+		}
+		// Quiet mode only reports the objects that could not be deleted.
+		for _, e := range out.Errors {
+			key := strings.TrimPrefix(aws.StringValue(e.Key), d.prefix)
+			merr = multierror.Append(merr, fmt.Errorf("delete %v: %v: %v",
+				key, aws.StringValue(e.Code), aws.StringValue(e.Message)))
+		}
+	}
+	return merr.ErrorOrNil()
+}
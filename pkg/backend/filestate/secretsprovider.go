@@ -0,0 +1,110 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pulumi/pulumi/pkg/v3/secrets"
+	"github.com/pulumi/pulumi/pkg/v3/secrets/cloud"
+	"github.com/pulumi/pulumi/pkg/v3/secrets/passphrase"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
+)
+
+// secretsProviderMeta describes the secrets provider recorded in the metadata file of a store.
+//
+// Only the kind of provider and the key of cloud providers are recorded:
+// stacks using the passphrase provider each have their own salt.
+type secretsProviderMeta struct {
+	// Type is the type of the secrets manager, "passphrase" or "cloud".
+	Type string `json:"type" yaml:"type"`
+
+	// URL is the URL of the key of a cloud secrets manager,
+	// e.g. "awskms://alias/my-key".
+	URL string `json:"url,omitempty" yaml:"url,omitempty"`
+}
+
+// parseSecretsProvider parses a secrets provider
+// in the syntax of the --secrets-provider flag of 'pulumi stack init'.
+// It returns nil for an empty string.
+func parseSecretsProvider(s string) (*secretsProviderMeta, error) {
+	switch {
+	case s == "":
+		return nil, nil
+	case s == "default" || s == passphrase.Type:
+		return &secretsProviderMeta{Type: passphrase.Type}, nil
+	case strings.Contains(s, "://"):
+		return &secretsProviderMeta{Type: cloud.Type, URL: s}, nil
+	default:
+		return nil, fmt.Errorf("invalid %v: %q must be %q or the URL of a key, e.g. \"awskms://alias/my-key\"",
+			PulumiFilestateSecretsProviderEnvVar, s, passphrase.Type)
+	}
+}
+
+// secretsProviderOf returns the secrets provider of the given secrets manager.
+func secretsProviderOf(sm secrets.Manager) (*secretsProviderMeta, error) {
+	m := &secretsProviderMeta{Type: sm.Type()}
+	if m.Type == cloud.Type {
+		var state struct {
+			URL string `json:"url"`
+		}
+		if err := json.Unmarshal(sm.State(), &state); err != nil {
+			return nil, fmt.Errorf("read state of secrets manager: %w", err)
+		}
+		m.URL = state.URL
+	}
+	return m, nil
+}
+
+// String returns the secrets provider in the syntax accepted by parseSecretsProvider,
+// or an empty string if m is nil.
+func (m *secretsProviderMeta) String() string {
+	switch {
+	case m == nil:
+		return ""
+	case m.URL != "":
+		return m.URL
+	default:
+		return m.Type
+	}
+}
+
+// checkSecretsProvider reports a secrets provider that differs from the one recorded for the store.
+// It's an error in strict mode, and a warning otherwise.
+// Mismatches of a stack are only warned about once.
+//
+// stack is empty for the secrets provider configured with PULUMI_SELF_MANAGED_STATE_SECRETS_PROVIDER.
+func (b *localBackend) checkSecretsProvider(meta *pulumiMeta, stack string, got *secretsProviderMeta) error {
+	want := meta.SecretsProvider
+	if want == nil || got == nil || *want == *got {
+		return nil
+	}
+
+	subject := "the configured secrets provider is"
+	if stack != "" {
+		subject = fmt.Sprintf("stack %v uses the secrets provider", stack)
+	}
+	msg := fmt.Sprintf("%v %q, but the state store was initialized with %q", subject, got, want)
+	if b.strictSecretsProvider {
+		return errors.New(msg)
+	}
+	if _, warned := b.secretsProviderWarned.LoadOrStore(stack, true); !warned {
+		b.d.Warningf(diag.Message("", "Mismatched secrets provider: %s; secrets may fail to decrypt"), msg)
+	}
+	return nil
+}
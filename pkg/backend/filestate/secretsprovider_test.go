@@ -0,0 +1,132 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob"
+
+	"github.com/pulumi/pulumi/pkg/v3/resource/deploy"
+	"github.com/pulumi/pulumi/pkg/v3/secrets/b64"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag/colors"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+func TestParseSecretsProvider(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc    string
+		give    string
+		want    *secretsProviderMeta
+		wantErr string
+	}{
+		{desc: "empty"},
+		{desc: "default", give: "default", want: &secretsProviderMeta{Type: "passphrase"}},
+		{desc: "passphrase", give: "passphrase", want: &secretsProviderMeta{Type: "passphrase"}},
+		{
+			desc: "cloud",
+			give: "awskms://alias/my-key?region=us-east-1",
+			want: &secretsProviderMeta{Type: "cloud", URL: "awskms://alias/my-key?region=us-east-1"},
+		},
+		{desc: "invalid", give: "awskms", wantErr: `"awskms" must be "passphrase" or the URL of a key`},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := parseSecretsProvider(tt.give)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.give == "default", got.String() != tt.give)
+		})
+	}
+}
+
+func TestSecretsProvider_mismatch(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	stateDir := t.TempDir()
+	url := "file://" + filepath.ToSlash(stateDir)
+	open := func(env map[string]string, strict bool) (*localBackend, *bytes.Buffer, error) {
+		var output bytes.Buffer
+		sink := diag.DefaultSink(&output, &output, diag.FormatOptions{Color: colors.Never})
+		b, err := newLocalBackend(ctx, sink, url, &workspace.Project{Name: "proj"},
+			&localBackendOptions{Getenv: mapGetenv(env), StrictSecretsProvider: strict})
+		return b, &output, err
+	}
+
+	b, output, err := open(map[string]string{PulumiFilestateSecretsProviderEnvVar: "passphrase"}, false)
+	require.NoError(t, err)
+	assert.Empty(t, output.String())
+
+	bucket, err := blob.OpenBucket(ctx, url)
+	require.NoError(t, err)
+	defer bucket.Close()
+	meta, err := ReadMeta(ctx, bucket)
+	require.NoError(t, err)
+	assert.Equal(t, "passphrase", meta.SecretsProvider)
+
+	// The secrets provider of an existing store isn't replaced.
+	b, output, err = open(map[string]string{PulumiFilestateSecretsProviderEnvVar: "awskms://alias/my-key"}, false)
+	require.NoError(t, err)
+	assert.Contains(t, output.String(),
+		`the configured secrets provider is "awskms://alias/my-key", `+
+			`but the state store was initialized with "passphrase"`)
+	meta, err = ReadMeta(ctx, bucket)
+	require.NoError(t, err)
+	assert.Equal(t, "passphrase", meta.SecretsProvider)
+
+	_, _, err = open(map[string]string{PulumiFilestateSecretsProviderEnvVar: "awskms://alias/my-key"}, true)
+	assert.ErrorContains(t, err, `the configured secrets provider is "awskms://alias/my-key"`)
+
+	// Stacks are checked when they're saved, and are warned about once.
+	ref, err := b.ParseStackReference("dev")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+	snap := deploy.NewSnapshot(deploy.Manifest{}, b64.NewBase64SecretsManager(), nil, nil)
+	lref, err := b.getReference(ref)
+	require.NoError(t, err)
+	output.Reset()
+	for i := 0; i < 2; i++ {
+		_, err = b.saveStack(ctx, lref, snap, snap.SecretsManager)
+		require.NoError(t, err)
+	}
+	const want = `stack organization/proj/dev uses the secrets provider "b64"`
+	assert.Equal(t, 1, strings.Count(output.String(), want), output.String())
+
+	b, _, err = open(nil, true)
+	require.NoError(t, err)
+	lref, err = b.parseStackReference("dev")
+	require.NoError(t, err)
+	_, err = b.saveStack(ctx, lref, snap, snap.SecretsManager)
+	assert.ErrorContains(t, err, want)
+}
@@ -0,0 +1,753 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/driver"
+	"gocloud.dev/gcerrors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
+)
+
+// State stores may be kept on a server that's only reachable over SFTP.
+// They're opened with sftp:// URLs whose path is the directory of the store on the server,
+// e.g. "sftp://deploy@files.example.com/srv/pulumi",
+// or "sftp://deploy@files.example.com/~/pulumi" for a directory relative to the home directory of the user.
+// The user defaults to the current user, and the port to 22.
+//
+// Connections authenticate with the keys of the SSH agent at SSH_AUTH_SOCK, if any,
+// and with the private key in the file named by the "identity_file" query parameter,
+// or by default ~/.ssh/id_ed25519, ~/.ssh/id_ecdsa, and ~/.ssh/id_rsa if they exist.
+// Keys with a passphrase must be added to the agent.
+// The key of the server is verified against the known_hosts file
+// named by the "known_hosts" query parameter, or by default ~/.ssh/known_hosts.
+//
+// SFTP has no conditional writes, so stack locks are kept as lock files like in file:// stores.
+// Files are written to a temporary file that's renamed into place once complete.
+// Servers that support the posix-rename@openssh.com extension, like OpenSSH, replace files atomically.
+// Other servers can't rename over an existing file,
+// so it's deleted first, and readers may briefly find it missing.
+// Metadata and content types of files aren't kept.
+const sftpBucketScheme = "sftp"
+
+func init() {
+	blob.DefaultURLMux().RegisterBucket(sftpBucketScheme, &sftpBucketURLOpener{})
+}
+
+// Query parameters of sftp:// URLs.
+const (
+	sftpIdentityFileParam = "identity_file"
+	sftpKnownHostsParam   = "known_hosts"
+)
+
+// sftpTempExt is the extension of the temporary files that writes are staged in.
+// They're left out of listings.
+const sftpTempExt = ".sftp-tmp"
+
+// posixRenameExtension is the SFTP extension that renames files over existing ones.
+const posixRenameExtension = "posix-rename@openssh.com"
+
+// errSFTPSignedURL is returned by stores served over SFTP for signed URLs.
+var errSFTPSignedURL = errors.New("signed URLs are not supported for sftp:// state stores")
+
+// sftpBucketURLOpener opens stores served over SFTP.
+type sftpBucketURLOpener struct{}
+
+func (*sftpBucketURLOpener) OpenBucketURL(ctx context.Context, u *url.URL) (*blob.Bucket, error) {
+	if _, ok := u.User.Password(); ok {
+		return nil, errors.New("passwords are not supported in sftp:// URLs; " +
+			"authenticate with an SSH agent or an identity file instead")
+	}
+	for param := range u.Query() {
+		if param != sftpIdentityFileParam && param != sftpKnownHostsParam {
+			return nil, fmt.Errorf("unknown query parameter %q in sftp:// URL", param)
+		}
+	}
+
+	config, err := newSSHClientConfig(u)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	dial := func(ctx context.Context) (*sftpConn, error) {
+		return dialSFTP(ctx, addr, config)
+	}
+
+	b, err := newSFTPBucket(ctx, dial, sftpRoot(u.Path))
+	if err != nil {
+		return nil, err
+	}
+	return blob.NewBucket(b), nil
+}
+
+// sftpRoot returns the directory on the server of the store with the given URL path.
+// Paths starting with "/~" are relative to the home directory of the user,
+// which is the working directory of SFTP sessions.
+func sftpRoot(p string) string {
+	if p == "/~" || p == "" {
+		return "."
+	}
+	if rest, ok := strings.CutPrefix(p, "/~/"); ok {
+		return path.Clean(rest)
+	}
+	return path.Clean(p)
+}
+
+// newSSHClientConfig returns the configuration of SSH connections to the server of the given URL.
+func newSSHClientConfig(u *url.URL) (*ssh.ClientConfig, error) {
+	username := u.User.Username()
+	if username == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("determine user to connect as: %w", err)
+		}
+		username = current.Username
+	}
+
+	var home string
+	q := u.Query()
+	knownHostsFile := q.Get(sftpKnownHostsParam)
+	identityFile := q.Get(sftpIdentityFileParam)
+	if knownHostsFile == "" || identityFile == "" {
+		var err error
+		home, err = os.UserHomeDir()
+		if err != nil && knownHostsFile == "" {
+			return nil, fmt.Errorf("find known_hosts file: %w", err)
+		}
+	}
+	if knownHostsFile == "" {
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeys, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("read known hosts: %w", err)
+	}
+
+	var signers []ssh.Signer
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		// The connection to the agent is kept open
+		// so that its keys can sign in again when a new session is started.
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			logging.V(5).Infof("error connecting to SSH agent at %v: %v (skipping)", sock, err)
+		} else {
+			agentSigners, err := agent.NewClient(conn).Signers()
+			if err != nil {
+				logging.V(5).Infof("error listing keys of SSH agent at %v: %v (skipping)", sock, err)
+			}
+			signers = append(signers, agentSigners...)
+		}
+	}
+	if identityFile != "" {
+		signer, err := readIdentityFile(identityFile)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	} else if home != "" {
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			signer, err := readIdentityFile(filepath.Join(home, ".ssh", name))
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				logging.V(5).Infof("%v (skipping)", err)
+				continue
+			}
+			signers = append(signers, signer)
+		}
+	}
+	if len(signers) == 0 {
+		return nil, errors.New("no SSH keys to authenticate with; " +
+			"start an SSH agent or set the identity_file query parameter of the sftp:// URL")
+	}
+
+	return &ssh.ClientConfig{
+		User:            username,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback: hostKeys,
+	}, nil
+}
+
+// readIdentityFile reads the unencrypted private key in the given file.
+func readIdentityFile(name string) (ssh.Signer, error) {
+	pem, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("read identity file: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		var perr *ssh.PassphraseMissingError
+		if errors.As(err, &perr) {
+			return nil, fmt.Errorf("identity file %v is encrypted; add it to an SSH agent instead", name)
+		}
+		return nil, fmt.Errorf("parse identity file %v: %w", name, err)
+	}
+	return signer, nil
+}
+
+// sftpConn is an SFTP session and the connection it runs over.
+type sftpConn struct {
+	*sftp.Client
+
+	// conn is closed along with the session if set.
+	conn io.Closer
+
+	// posixRename reports whether the server supports the posix-rename extension.
+	posixRename bool
+}
+
+func (c *sftpConn) close() error {
+	err := c.Client.Close()
+	if c.conn != nil {
+		err = errors.Join(err, c.conn.Close())
+	}
+	return err
+}
+
+// dialSFTP starts an SFTP session with the server at the given address.
+func dialSFTP(ctx context.Context, addr string, config *ssh.ClientConfig) (*sftpConn, error) {
+	var d net.Dialer
+	nconn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(nconn, addr, config)
+	if err != nil {
+		contract.IgnoreClose(nconn)
+		return nil, fmt.Errorf("connect to %v: %w", addr, err)
+	}
+	client := ssh.NewClient(c, chans, reqs)
+	session, err := sftp.NewClient(client)
+	if err != nil {
+		contract.IgnoreClose(client)
+		return nil, fmt.Errorf("start SFTP session with %v: %w", addr, err)
+	}
+	_, posixRename := session.HasExtension(posixRenameExtension)
+	return &sftpConn{Client: session, conn: client, posixRename: posixRename}, nil
+}
+
+// sftpBucket is a driver.Bucket for stores served over SFTP.
+type sftpBucket struct {
+	// dial starts a new session with the server.
+	dial func(context.Context) (*sftpConn, error)
+
+	// root is the directory of the store on the server.
+	root string
+
+	// mu guards conn.
+	mu sync.Mutex
+
+	// conn is the current session with the server.
+	// It's replaced by a new session if the connection is lost.
+	conn *sftpConn
+}
+
+var _ driver.Bucket = (*sftpBucket)(nil)
+
+// newSFTPBucket returns a bucket for the store in the given directory of a server,
+// connected with the given function.
+// The first session is started right away so that the store fails to open
+// if the server can't be reached or the user can't authenticate.
+func newSFTPBucket(
+	ctx context.Context, dial func(context.Context) (*sftpConn, error), root string,
+) (*sftpBucket, error) {
+	b := &sftpBucket{dial: dial, root: root}
+	if _, err := b.session(ctx); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// session returns the current session with the server,
+// starting a new one if there's none.
+func (b *sftpBucket) session(ctx context.Context) (*sftpConn, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.conn == nil {
+		conn, err := b.dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+		b.conn = conn
+	}
+	return b.conn, nil
+}
+
+// done drops the given session if err reports that its connection was lost,
+// so that the next operation starts a new one.
+// It returns err, wrapped in sftp.ErrSSHFxConnectionLost if the connection was lost.
+func (b *sftpBucket) done(conn *sftpConn, err error) error {
+	if !conn.lost(err) {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == conn {
+		if cerr := conn.close(); cerr != nil {
+			logging.V(5).Infof("error closing lost SFTP session: %v (skipping)", cerr)
+		}
+		b.conn = nil
+	}
+	if errors.Is(err, sftp.ErrSSHFxConnectionLost) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", sftp.ErrSSHFxConnectionLost, err)
+}
+
+// lost reports whether the connection of the session was lost,
+// given the error an operation failed with.
+func (c *sftpConn) lost(err error) bool {
+	var serr *sftp.StatusError
+	switch {
+	case err == nil, err == io.EOF, errors.Is(err, fs.ErrNotExist), errors.Is(err, fs.ErrPermission),
+		errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded), errors.As(err, &serr):
+		// The server answered.
+		// Readers return io.EOF itself at the end of a file,
+		// whereas a connection closed by the server fails with a wrapped io.EOF.
+		return false
+	case errors.Is(err, sftp.ErrSSHFxConnectionLost):
+		return true
+	default:
+		// The error may have come from the connection,
+		// so check whether the server still answers.
+		_, err := c.Getwd()
+		return err != nil
+	}
+}
+
+// do runs f with the current session with the server.
+func (b *sftpBucket) do(ctx context.Context, f func(*sftpConn) error) error {
+	conn, err := b.session(ctx)
+	if err != nil {
+		return err
+	}
+	return b.done(conn, f(conn))
+}
+
+// path returns the path on the server of the file with the given key.
+func (b *sftpBucket) path(key string) string {
+	return path.Join(b.root, key)
+}
+
+func (b *sftpBucket) ErrorCode(err error) gcerrors.ErrorCode {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return gcerrors.NotFound
+	case errors.Is(err, fs.ErrPermission):
+		return gcerrors.PermissionDenied
+	case errors.Is(err, errSFTPSignedURL), errors.Is(err, sftp.ErrSSHFxOpUnsupported):
+		return gcerrors.Unimplemented
+	case errors.Is(err, sftp.ErrSSHFxConnectionLost):
+		// The operation is retried with a new session.
+		return gcerrors.Internal
+	case errors.Is(err, context.Canceled):
+		return gcerrors.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return gcerrors.DeadlineExceeded
+	default:
+		return gcerrors.Unknown
+	}
+}
+
+func (b *sftpBucket) As(i interface{}) bool {
+	p, ok := i.(**sftp.Client)
+	if !ok {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		return false
+	}
+	*p = b.conn.Client
+	return true
+}
+
+func (b *sftpBucket) ErrorAs(err error, i interface{}) bool { return errors.As(err, i) }
+
+// stat returns information about the file with the given key.
+// Directories are reported as missing, like they are by fileblob.
+func (b *sftpBucket) stat(ctx context.Context, key string) (fs.FileInfo, error) {
+	var info fs.FileInfo
+	err := b.do(ctx, func(conn *sftpConn) error {
+		var err error
+		info, err = conn.Stat(b.path(key))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, &fs.PathError{Op: "stat", Path: b.path(key), Err: fs.ErrNotExist}
+	}
+	return info, nil
+}
+
+func (b *sftpBucket) Attributes(ctx context.Context, key string) (*driver.Attributes, error) {
+	info, err := b.stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &driver.Attributes{
+		ModTime: info.ModTime(),
+		Size:    info.Size(),
+		AsFunc:  func(interface{}) bool { return false },
+	}, nil
+}
+
+// ListPaged lists the files below the directory of the prefix.
+// SFTP can only list one directory at a time,
+// so listings without a delimiter walk every directory below it.
+func (b *sftpBucket) ListPaged(ctx context.Context, opts *driver.ListOptions) (*driver.ListPage, error) {
+	if opts.BeforeList != nil {
+		if err := opts.BeforeList(func(interface{}) bool { return false }); err != nil {
+			return nil, err
+		}
+	}
+
+	// Start at the deepest directory that holds every key with the prefix.
+	dir := ""
+	if i := strings.LastIndex(opts.Prefix, "/"); i >= 0 {
+		dir = opts.Prefix[:i]
+	}
+	if opts.Delimiter != "" && opts.Delimiter != "/" {
+		return nil, fmt.Errorf("unsupported delimiter %q for sftp:// state stores", opts.Delimiter)
+	}
+	recursive := opts.Delimiter == ""
+	var objects []*driver.ListObject
+	err := b.do(ctx, func(conn *sftpConn) error {
+		var err error
+		objects, err = b.list(ctx, conn, dir, opts.Prefix, opts.Delimiter, recursive)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+
+	// The page token is the last key of the previous page.
+	after := string(opts.PageToken)
+	var page driver.ListPage
+	for _, obj := range objects {
+		if obj.Key <= after {
+			continue
+		}
+		if opts.PageSize > 0 && len(page.Objects) == opts.PageSize {
+			page.NextPageToken = []byte(page.Objects[len(page.Objects)-1].Key)
+			break
+		}
+		page.Objects = append(page.Objects, obj)
+	}
+	return &page, nil
+}
+
+// list returns the files in the directory with the given key whose keys have the given prefix,
+// and those in its subdirectories if recursive is set.
+// Otherwise subdirectories are listed as directories, with the delimiter appended to their keys.
+// Directories that don't exist are empty.
+func (b *sftpBucket) list(
+	ctx context.Context, conn *sftpConn, dir, prefix, delimiter string, recursive bool,
+) ([]*driver.ListObject, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	entries, err := conn.ReadDir(b.path(dir))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var objects []*driver.ListObject
+	for _, entry := range entries {
+		name := entry.Name()
+		key := name
+		if dir != "" {
+			key = dir + "/" + name
+		}
+		switch {
+		case entry.IsDir():
+			// Only descend into directories that may hold keys with the prefix.
+			if !strings.HasPrefix(key+"/", prefix) && !strings.HasPrefix(prefix, key+"/") {
+				continue
+			}
+			if !recursive {
+				objects = append(objects, &driver.ListObject{Key: key + delimiter, IsDir: true})
+				continue
+			}
+			children, err := b.list(ctx, conn, key, prefix, delimiter, recursive)
+			if err != nil {
+				return nil, err
+			}
+			objects = append(objects, children...)
+		case entry.Mode().IsRegular():
+			if !strings.HasPrefix(key, prefix) || strings.HasSuffix(name, sftpTempExt) {
+				continue
+			}
+			objects = append(objects, &driver.ListObject{
+				Key:     key,
+				ModTime: entry.ModTime(),
+				Size:    entry.Size(),
+				AsFunc:  func(interface{}) bool { return false },
+			})
+		}
+	}
+	return objects, nil
+}
+
+func (b *sftpBucket) NewRangeReader(
+	ctx context.Context, key string, offset, length int64, opts *driver.ReaderOptions,
+) (driver.Reader, error) {
+	conn, err := b.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	f, err := conn.Open(b.path(key))
+	if err != nil {
+		return nil, b.done(conn, err)
+	}
+	info, err := f.Stat()
+	if err == nil && info.IsDir() {
+		err = &fs.PathError{Op: "open", Path: b.path(key), Err: fs.ErrNotExist}
+	}
+	if err == nil && offset > 0 {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err == nil && opts.BeforeRead != nil {
+		err = opts.BeforeRead(func(interface{}) bool { return false })
+	}
+	if err != nil {
+		contract.IgnoreClose(f)
+		return nil, b.done(conn, err)
+	}
+
+	r := &sftpReader{
+		bucket: b,
+		conn:   conn,
+		file:   f,
+		r:      f,
+		attrs: driver.ReaderAttributes{
+			ModTime: info.ModTime(),
+			Size:    info.Size(),
+		},
+	}
+	if length >= 0 {
+		r.r = io.LimitReader(f, length)
+	}
+	return r, nil
+}
+
+// sftpReader reads a file from a store served over SFTP.
+type sftpReader struct {
+	bucket *sftpBucket
+	conn   *sftpConn
+	file   *sftp.File
+	r      io.Reader
+	attrs  driver.ReaderAttributes
+}
+
+func (r *sftpReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	return n, r.bucket.done(r.conn, err)
+}
+
+func (r *sftpReader) Close() error { return r.bucket.done(r.conn, r.file.Close()) }
+
+func (r *sftpReader) Attributes() *driver.ReaderAttributes { return &r.attrs }
+
+func (r *sftpReader) As(interface{}) bool { return false }
+
+// create creates a temporary file next to the file with the given key to stage a write in,
+// along with the directories it's in.
+func (b *sftpBucket) create(conn *sftpConn, key string) (*sftp.File, string, error) {
+	var suffix [8]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		return nil, "", err
+	}
+	dst := b.path(key)
+	tmp := dst + "." + hex.EncodeToString(suffix[:]) + sftpTempExt
+
+	if err := conn.MkdirAll(path.Dir(dst)); err != nil {
+		return nil, "", fmt.Errorf("create directory of %q: %w", key, err)
+	}
+	f, err := conn.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return nil, "", err
+	}
+	return f, tmp, nil
+}
+
+// commit moves the temporary file of a write into place.
+// Servers without the posix-rename extension can't rename over an existing file,
+// so it's deleted first.
+func (b *sftpBucket) commit(conn *sftpConn, tmp, key string) error {
+	dst := b.path(key)
+	if conn.posixRename {
+		return conn.PosixRename(tmp, dst)
+	}
+
+	if err := conn.Remove(dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("replace %q: %w", key, err)
+	}
+	return conn.Rename(tmp, dst)
+}
+
+// abort deletes the temporary file of a failed write.
+func (b *sftpBucket) abort(conn *sftpConn, tmp string) {
+	if err := conn.Remove(tmp); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logging.V(5).Infof("error deleting temporary file %v: %v (skipping)", tmp, err)
+	}
+}
+
+func (b *sftpBucket) NewTypedWriter(
+	ctx context.Context, key, contentType string, opts *driver.WriterOptions,
+) (driver.Writer, error) {
+	conn, err := b.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	f, tmp, err := b.create(conn, key)
+	if err != nil {
+		return nil, b.done(conn, err)
+	}
+	if opts.BeforeWrite != nil {
+		if err := opts.BeforeWrite(func(interface{}) bool { return false }); err != nil {
+			contract.IgnoreClose(f)
+			b.abort(conn, tmp)
+			return nil, err
+		}
+	}
+	return &sftpWriter{ctx: ctx, bucket: b, conn: conn, file: f, tmp: tmp, key: key}, nil
+}
+
+// sftpWriter writes a file to a store served over SFTP.
+// The file is staged in a temporary file that's moved into place when it's closed.
+type sftpWriter struct {
+	ctx    context.Context
+	bucket *sftpBucket
+	conn   *sftpConn
+	file   *sftp.File
+	tmp    string
+	key    string
+}
+
+func (w *sftpWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	return n, w.bucket.done(w.conn, err)
+}
+
+func (w *sftpWriter) Close() error {
+	err := w.file.Close()
+	if err == nil {
+		// Writes whose context is canceled are abandoned.
+		err = w.ctx.Err()
+	}
+	if err == nil {
+		err = w.bucket.commit(w.conn, w.tmp, w.key)
+	}
+	if err != nil {
+		w.bucket.abort(w.conn, w.tmp)
+	}
+	return w.bucket.done(w.conn, err)
+}
+
+// Copy copies the file through the client,
+// since SFTP has no way to copy files on the server.
+func (b *sftpBucket) Copy(ctx context.Context, dstKey, srcKey string, opts *driver.CopyOptions) error {
+	if opts.BeforeCopy != nil {
+		if err := opts.BeforeCopy(func(interface{}) bool { return false }); err != nil {
+			return err
+		}
+	}
+	return b.do(ctx, func(conn *sftpConn) error {
+		src, err := conn.Open(b.path(srcKey))
+		if err != nil {
+			return err
+		}
+		defer contract.IgnoreClose(src)
+
+		dst, tmp, err := b.create(conn, dstKey)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(dst, src)
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = b.commit(conn, tmp, dstKey)
+		}
+		if err != nil {
+			b.abort(conn, tmp)
+		}
+		return err
+	})
+}
+
+func (b *sftpBucket) Delete(ctx context.Context, key string) error {
+	if _, err := b.stat(ctx, key); err != nil {
+		return err
+	}
+	return b.do(ctx, func(conn *sftpConn) error {
+		return conn.Remove(b.path(key))
+	})
+}
+
+func (b *sftpBucket) SignedURL(ctx context.Context, key string, opts *driver.SignedURLOptions) (string, error) {
+	return "", errSFTPSignedURL
+}
+
+func (b *sftpBucket) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		return nil
+	}
+	err := b.conn.close()
+	b.conn = nil
+	return err
+}
@@ -0,0 +1,364 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// newTestSFTPKey returns a new SSH key.
+func newTestSFTPKey(t *testing.T) (ssh.Signer, []byte) {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	return signer, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// startSFTPServer starts an SSH server that serves the local file system over SFTP
+// to clients that authenticate with the returned identity file.
+// It returns the base of the URLs of stores on the server,
+// whose query points at the identity file and a known_hosts file.
+func startSFTPServer(t *testing.T) *url.URL {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the SFTP server serves Windows paths differently")
+	}
+
+	dir := t.TempDir()
+	hostKey, _ := newTestSFTPKey(t)
+	clientKey, clientPEM := newTestSFTPKey(t)
+	identityFile := filepath.Join(dir, "id_ed25519")
+	require.NoError(t, os.WriteFile(identityFile, clientPEM, 0o600))
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), clientKey.PublicKey().Marshal()) {
+				return nil, assert.AnError
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			nconn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(nconn, config)
+		}
+	}()
+
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(l.Addr().String())}, hostKey.PublicKey())
+	require.NoError(t, os.WriteFile(knownHostsFile, []byte(line+"\n"), 0o600))
+
+	q := url.Values{}
+	q.Set("identity_file", identityFile)
+	q.Set("known_hosts", knownHostsFile)
+	return &url.URL{Scheme: "sftp", User: url.User("test"), Host: l.Addr().String(), RawQuery: q.Encode()}
+}
+
+// serveSFTP serves the sftp subsystem on the given SSH connection.
+func serveSFTP(nconn net.Conn, config *ssh.ServerConfig) {
+	defer nconn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(nconn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			_ = nc.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer ch.Close()
+			for req := range reqs {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				_ = req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				server, err := sftp.NewServer(ch)
+				if err != nil {
+					return
+				}
+				_ = server.Serve()
+				return
+			}
+		}()
+	}
+}
+
+// sftpStoreURL returns the URL of a store in the given directory of the server.
+func sftpStoreURL(base *url.URL, dir string) string {
+	u := *base
+	u.Path = filepath.ToSlash(dir)
+	return u.String()
+}
+
+func TestSFTPBucket(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	bucket, err := blob.OpenBucket(ctx, sftpStoreURL(startSFTPServer(t), dir))
+	require.NoError(t, err)
+	defer bucket.Close()
+
+	// Files are written below the directory of the URL.
+	require.NoError(t, bucket.WriteAll(ctx, ".pulumi/stacks/proj/foo.json", []byte("{}"), nil))
+	byts, err := os.ReadFile(filepath.Join(dir, ".pulumi", "stacks", "proj", "foo.json"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("{}"), byts)
+
+	// Files are replaced.
+	require.NoError(t, bucket.WriteAll(ctx, ".pulumi/stacks/proj/foo.json", []byte(`{"a":1}`), nil))
+	byts, err = bucket.ReadAll(ctx, ".pulumi/stacks/proj/foo.json")
+	require.NoError(t, err)
+	assert.Equal(t, []byte(`{"a":1}`), byts)
+
+	r, err := bucket.NewRangeReader(ctx, ".pulumi/stacks/proj/foo.json", 2, 3, nil)
+	require.NoError(t, err)
+	byts, err = io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, []byte(`a":`), byts)
+
+	attrs, err := bucket.Attributes(ctx, ".pulumi/stacks/proj/foo.json")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), attrs.Size)
+
+	require.NoError(t, bucket.Copy(ctx, ".pulumi/stacks/proj/foo.json.bak", ".pulumi/stacks/proj/foo.json", nil))
+	require.NoError(t, bucket.WriteAll(ctx, ".pulumi/history/proj/foo/foo-1.history.json", []byte("{}"), nil))
+	// Staged writes aren't listed.
+	require.NoError(t, os.WriteFile(
+		filepath.Join(dir, ".pulumi", "stacks", "proj", "bar.json.0123"+sftpTempExt), nil, 0o600))
+
+	var keys []string
+	iter := bucket.List(&blob.ListOptions{Prefix: ".pulumi/"})
+	for {
+		obj, err := iter.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		keys = append(keys, obj.Key)
+	}
+	assert.Equal(t, []string{
+		".pulumi/history/proj/foo/foo-1.history.json",
+		".pulumi/stacks/proj/foo.json",
+		".pulumi/stacks/proj/foo.json.bak",
+	}, keys)
+
+	keys = nil
+	iter = bucket.List(&blob.ListOptions{Prefix: ".pulumi/", Delimiter: "/"})
+	for {
+		obj, err := iter.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		assert.True(t, obj.IsDir, obj.Key)
+		keys = append(keys, obj.Key)
+	}
+	assert.Equal(t, []string{".pulumi/history/", ".pulumi/stacks/"}, keys)
+
+	// Directories are not files, and listing missing ones finds nothing.
+	_, err = bucket.Attributes(ctx, ".pulumi/stacks")
+	assert.Equal(t, gcerrors.NotFound, gcerrors.Code(err))
+	assert.Equal(t, gcerrors.NotFound, gcerrors.Code(bucket.Delete(ctx, ".pulumi/stacks")))
+	_, err = bucket.List(&blob.ListOptions{Prefix: "missing/"}).Next(ctx)
+	assert.Equal(t, io.EOF, err)
+
+	require.NoError(t, bucket.Delete(ctx, ".pulumi/stacks/proj/foo.json.bak"))
+	_, err = bucket.ReadAll(ctx, ".pulumi/stacks/proj/foo.json.bak")
+	assert.Equal(t, gcerrors.NotFound, gcerrors.Code(err))
+	assert.Equal(t, gcerrors.NotFound, gcerrors.Code(bucket.Delete(ctx, ".pulumi/stacks/proj/foo.json.bak")))
+}
+
+// newTestSFTPBucket returns a bucket for a new store on the given server.
+// Sessions are passed through wrap after they're started.
+func newTestSFTPBucket(t *testing.T, base *url.URL, wrap func(*sftpConn)) *sftpBucket {
+	t.Helper()
+
+	ctx := context.Background()
+	u, err := url.Parse(sftpStoreURL(base, t.TempDir()))
+	require.NoError(t, err)
+	config, err := newSSHClientConfig(u)
+	require.NoError(t, err)
+	b, err := newSFTPBucket(ctx, func(ctx context.Context) (*sftpConn, error) {
+		conn, err := dialSFTP(ctx, u.Host, config)
+		if err == nil {
+			wrap(conn)
+		}
+		return conn, err
+	}, sftpRoot(u.Path))
+	require.NoError(t, err)
+	return b
+}
+
+func TestSFTPBucket_noPosixRename(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b := newTestSFTPBucket(t, startSFTPServer(t), func(conn *sftpConn) {
+		assert.True(t, conn.posixRename)
+		conn.posixRename = false
+	})
+	bucket := blob.NewBucket(b)
+	defer bucket.Close()
+
+	// Files are still replaced, though not atomically.
+	require.NoError(t, bucket.WriteAll(ctx, "file", []byte("one"), nil))
+	require.NoError(t, bucket.WriteAll(ctx, "file", []byte("two"), nil))
+	byts, err := bucket.ReadAll(ctx, "file")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("two"), byts)
+}
+
+func TestSFTPBucket_reconnect(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	var sessions []*sftpConn
+	b := newTestSFTPBucket(t, startSFTPServer(t), func(conn *sftpConn) {
+		sessions = append(sessions, conn)
+	})
+	bucket := blob.NewBucket(b)
+	defer bucket.Close()
+	require.NoError(t, bucket.WriteAll(ctx, "file", []byte("one"), nil))
+
+	// Operations on a lost connection fail with a transient error,
+	// and the next one starts a new session.
+	require.Len(t, sessions, 1)
+	require.NoError(t, sessions[0].conn.Close())
+	_, err := bucket.ReadAll(ctx, "file")
+	assert.True(t, isTransientError(err), "%v", err)
+
+	byts, err := bucket.ReadAll(ctx, "file")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("one"), byts)
+	assert.Len(t, sessions, 2)
+}
+
+func TestSFTPBucket_open(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	base := startSFTPServer(t)
+
+	// The host key must be known.
+	u := *base
+	q := u.Query()
+	q.Set("known_hosts", filepath.Join(t.TempDir(), "known_hosts"))
+	require.NoError(t, os.WriteFile(q.Get("known_hosts"), nil, 0o600))
+	u.RawQuery = q.Encode()
+	_, err := blob.OpenBucket(ctx, sftpStoreURL(&u, t.TempDir()))
+	assert.ErrorContains(t, err, "knownhosts: key is unknown")
+
+	u = *base
+	u.User = url.UserPassword("test", "hunter2")
+	_, err = blob.OpenBucket(ctx, sftpStoreURL(&u, t.TempDir()))
+	assert.ErrorContains(t, err, "passwords are not supported")
+
+	u = *base
+	u.RawQuery += "&region=eu"
+	_, err = blob.OpenBucket(ctx, sftpStoreURL(&u, t.TempDir()))
+	assert.ErrorContains(t, err, `unknown query parameter "region"`)
+
+	assert.Equal(t, ".", sftpRoot(""))
+	assert.Equal(t, ".", sftpRoot("/~"))
+	assert.Equal(t, "state", sftpRoot("/~/state/"))
+	assert.Equal(t, "/srv/state", sftpRoot("/srv/state/"))
+}
+
+func TestNew_sftp(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	storeURL := sftpStoreURL(startSFTPServer(t), dir)
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), storeURL,
+		&workspace.Project{Name: "proj"}, &localBackendOptions{Getenv: mapGetenv(nil)})
+	require.NoError(t, err)
+	assert.Equal(t, "sftp", b.BucketInfo().Scheme)
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+	saveOutputsCheckpoint(t, b, ref, nil /* providers */, map[string]interface{}{"url": "https://example.com"})
+
+	// The store is laid out like any other.
+	_, err = os.Stat(filepath.Join(dir, ".pulumi", "stacks", "proj", "foo.json"))
+	require.NoError(t, err)
+
+	outputs, err := b.GetStackOutputs(ctx, ref, false /* showSecrets */)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"url": "https://example.com"}, outputs)
+
+	require.NoError(t, b.Lock(ctx, ref))
+	other, err := newLocalBackend(ctx, diagtest.LogSink(t), storeURL,
+		&workspace.Project{Name: "proj"}, &localBackendOptions{Getenv: mapGetenv(nil)})
+	require.NoError(t, err)
+	var conflict *LockConflictError
+	assert.ErrorAs(t, other.Lock(ctx, ref), &conflict)
+	b.Unlock(ctx, ref)
+	require.NoError(t, other.Lock(ctx, ref))
+	other.Unlock(ctx, ref)
+
+	stacks, _, err := b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+	require.NoError(t, err)
+	assert.Len(t, stacks, 1)
+}
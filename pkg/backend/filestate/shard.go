@@ -0,0 +1,294 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// Version 2 of the state store shards the history of each stack
+// into subdirectories of its history directory,
+// so that no single prefix holds every update of a long-lived stack:
+//
+//	.pulumi/history/$project/$stack/~3f/$stack-$nanos.history.json
+//
+// The shard of a file is derived from the ID of the update it belongs to,
+// so the files of an update share a shard, and it's kept when a stack is renamed.
+// Files that were written before the store was upgraded to version 2
+// are read from the history directory itself until they're moved by [ShardHistory].
+
+// historyShardPrefix starts the names of shard directories.
+// It's the one character allowed unescaped in URLs but not in project and stack names,
+// so shards are never mistaken for the directories of stacks.
+const historyShardPrefix = "~"
+
+// historyShard returns the name of the shard directory
+// that holds the files of the update with the given ID.
+func historyShard(updateID string) string {
+	sum := sha256.Sum256([]byte(updateID))
+	return historyShardPrefix + hex.EncodeToString(sum[:1])
+}
+
+// isHistoryShard reports whether the directory with the given name is a shard.
+func isHistoryShard(name string) bool {
+	rest, ok := strings.CutPrefix(name, historyShardPrefix)
+	if !ok || len(rest) != 2 {
+		return false
+	}
+	_, err := hex.DecodeString(rest)
+	return err == nil && strings.ToLower(rest) == rest
+}
+
+// historyFileUpdateID returns the ID of the update that the history file with the given name belongs to,
+// e.g. "1690000000000000000" for "dev-1690000000000000000.checkpoint.json",
+// or false if it isn't named after an update.
+//
+// Unlike historyUpdateID, this accepts every kind of file in the history of a stack,
+// and names without an extension.
+func historyFileUpdateID(name string) (string, bool) {
+	dash := strings.LastIndex(name, "-")
+	if dash == -1 {
+		return "", false
+	}
+	id, _, _ := strings.Cut(name[dash+1:], ".")
+	return id, id != ""
+}
+
+// shardedHistoryFile returns the key of the file with the given name
+// in the sharded history directory dir.
+// Files that aren't named after an update are kept in dir itself.
+func shardedHistoryFile(dir, name string) string {
+	id, ok := historyFileUpdateID(name)
+	if !ok {
+		return path.Join(dir, name)
+	}
+	return path.Join(dir, historyShard(id), name)
+}
+
+// historyFileDir returns the history directory of the stack
+// that the history file with the given key belongs to,
+// whether or not it's in a shard.
+func historyFileDir(key string) string {
+	dir := path.Dir(key)
+	if isHistoryShard(path.Base(dir)) {
+		return path.Dir(dir)
+	}
+	return dir
+}
+
+// listShardedHistory lists the files in the given history directory and its shards.
+// They're sorted by name, which orders the updates they belong to chronologically,
+// like listBucket does for history directories that aren't sharded.
+//
+// A file is listed twice if a move into its shard was interrupted,
+// once in the history directory and once in the shard.
+// The copy in the shard is listed first.
+func listShardedHistory(ctx context.Context, b Bucket, dir string) ([]*blob.ListObject, error) {
+	// Listing the directory without a delimiter lists its shards along with it,
+	// which is cheaper than listing each shard separately.
+	prefix := dir + "/"
+	all, err := listAll(ctx, b, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*blob.ListObject, 0, len(all))
+	for _, file := range all {
+		if file.IsDir {
+			continue
+		}
+		// Skip files in other directories,
+		// e.g. those of project-scoped stacks below the history of a legacy stack of the same name.
+		if rel := strings.TrimPrefix(file.Key, prefix); strings.Contains(rel, "/") &&
+			!isHistoryShard(path.Dir(rel)) {
+			continue
+		}
+		files = append(files, file)
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		ni, nj := objectName(files[i]), objectName(files[j])
+		if ni != nj {
+			return ni < nj
+		}
+		return isHistoryShard(path.Base(path.Dir(files[i].Key))) &&
+			!isHistoryShard(path.Base(path.Dir(files[j].Key)))
+	})
+	return files, nil
+}
+
+// uniqueHistoryFiles removes the second of any two files with the same name
+// from files sorted by listShardedHistory,
+// leaving the copy in the shard of a file whose move was interrupted.
+func uniqueHistoryFiles(files []*blob.ListObject) []*blob.ListObject {
+	unique := make([]*blob.ListObject, 0, len(files))
+	for i, file := range files {
+		if i > 0 && objectName(files[i-1]) == objectName(file) {
+			continue
+		}
+		unique = append(unique, file)
+	}
+	return unique
+}
+
+// ShardHistory upgrades the state store in the given bucket from version 1 to version 2,
+// moving the history of every stack into shards.
+//
+// The metadata file is written first, so that the history is never written unsharded again.
+// Version 2 stores read history from both layouts,
+// so stacks stay usable while their files are moved, and if the upgrade is interrupted.
+// Each file is copied into its shard before the original is deleted.
+// Stores at version 2 are accepted too,
+// in which case the files left behind by an interrupted upgrade are moved.
+// Older versions of the CLI can't open the store once it's upgraded.
+//
+// Like [Migrate], ShardHistory returns [ErrMigrationInProgress]
+// if another migration is running against the same bucket,
+// and [ErrStoreLocked] if another operation on the whole store is.
+// It fails if any stack is locked.
+// The returned plan describes the moves that were performed,
+// or in dry-run mode, the moves that would be performed.
+func ShardHistory(ctx context.Context, bucket *blob.Bucket, opts *MigrateOptions) (_ *MigrationPlan, err error) {
+	ctx = withOperationID(ctx)
+	defer func() { err = operationError(ctx, err) }()
+
+	b, err := applyIgnoreList(ctx, &wrappedBucket{bucket: bucket})
+	if err != nil {
+		return nil, err
+	}
+	return shardHistory(ctx, b, systemClock{}, opts)
+}
+
+func shardHistory(ctx context.Context, b Bucket, clk clock, opts *MigrateOptions) (*MigrationPlan, error) {
+	if opts == nil {
+		opts = &MigrateOptions{}
+	}
+	started := clk.Now()
+	progress := newProgressReporter(ctx, ProgressMigrate, opts.Events)
+	defer progress.close()
+
+	stdout := opts.Stdout
+	if stdout == nil {
+		stdout = io.Discard
+	}
+
+	meta, err := readPulumiMeta(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case meta == nil || meta.Version == 0:
+		return nil, errors.New("the state store uses the legacy layout; " +
+			"upgrade it to project-scoped stacks with 'pulumi state upgrade' first")
+	case meta.Version > maxSupportedVersion:
+		return nil, newStoreTooNewError(meta)
+	}
+
+	if !opts.DryRun {
+		unlock, err := lockForMigration(ctx, b, clk, nil /* stackLocks */)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+
+	plan, err := planHistorySharding(ctx, b, meta)
+	if err != nil {
+		return nil, err
+	}
+	fromVersion, toVersion := meta.Version, meta.Version
+	if !meta.shardsHistory() {
+		toVersion = shardedHistoryVersion
+	}
+	if opts.DryRun {
+		plan.print(stdout)
+		return finishReport(ctx, b, clk, opts, plan, MigrationShardHistory, fromVersion, toVersion, started)
+	}
+
+	if !meta.shardsHistory() {
+		meta.Version = shardedHistoryVersion
+		if err := meta.WriteTo(ctx, b); err != nil {
+			return nil, err
+		}
+	}
+	for _, mv := range plan.Moves {
+		if err := copyIfMissing(ctx, b, mv.Source, mv.Destination); err != nil {
+			return nil, fmt.Errorf("shard history of stack %v: %w", mv.Stack, err)
+		}
+		progress.report(mv.Stack, mv.Destination, mv.Size)
+		// The copy is read in place of the original, so a file left behind does no harm.
+		if err := b.Delete(ctx, mv.Source); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+			logging.V(5).Infof("error deleting sharded history file: %v (%v) skipping", mv.Source, err)
+		}
+	}
+	return finishReport(ctx, b, clk, opts, plan, MigrationShardHistory, fromVersion, toVersion, started)
+}
+
+// planHistorySharding lists the history files of every stack in the store with the given metadata
+// that aren't in their shard yet, and decides where they're moved.
+// Files in the history directories of stacks that no longer exist are left in place.
+// It does not modify the bucket.
+func planHistorySharding(ctx context.Context, b Bucket, meta *pulumiMeta) (*MigrationPlan, error) {
+	keys, err := parseKeyTemplate(meta.KeyTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key template in %q: %w", meta.path(), err)
+	}
+	store := newProjectReferenceStore(b, func() *workspace.Project { return nil }, keys)
+	refs, err := store.ListReferences(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list stacks: %w", err)
+	}
+
+	plan := &MigrationPlan{Moves: []MigrationMove{}}
+	for _, ref := range refs {
+		dir := filepath.ToSlash(ref.HistoryDir())
+		files, err := listBucket(ctx, b, dir)
+		if err != nil {
+			return nil, fmt.Errorf("list history of stack %v: %w", ref, err)
+		}
+		for _, file := range files {
+			if file.IsDir {
+				continue
+			}
+			dst := shardedHistoryFile(dir, objectName(file))
+			if dst == file.Key {
+				continue
+			}
+			plan.Moves = append(plan.Moves, MigrationMove{
+				Stack:       ref.FullyQualifiedName().String(),
+				Source:      file.Key,
+				Destination: dst,
+				Size:        file.Size,
+			})
+			plan.TotalBytes += file.Size
+		}
+	}
+	return plan, nil
+}
@@ -0,0 +1,214 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"context"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob/fileblob"
+)
+
+func TestShardedHistoryFile(t *testing.T) {
+	t.Parallel()
+
+	shard := historyShard("1690000000000000000")
+	assert.True(t, isHistoryShard(shard))
+	assert.Len(t, shard, 3)
+
+	dir := ".pulumi/history/proj/my-stack.v2"
+	for _, name := range []string{
+		"my-stack.v2-1690000000000000000.history.json",
+		"my-stack.v2-1690000000000000000.checkpoint.json.gz",
+		"my-stack.v2-1690000000000000000.revision.json",
+		"my-stack.v2-1690000000000000000",
+	} {
+		key := shardedHistoryFile(dir, name)
+		assert.Equal(t, path.Join(dir, shard, name), key, name)
+		assert.Equal(t, dir, historyFileDir(key), name)
+	}
+
+	// Files that aren't named after an update stay in the history directory.
+	assert.Equal(t, dir+"/notes.txt", shardedHistoryFile(dir, "notes.txt"))
+	assert.Equal(t, dir, historyFileDir(dir+"/notes.txt"))
+
+	for _, name := range []string{"ab", "~", "~abc", "~AB", "~zz", "-ab"} {
+		assert.False(t, isHistoryShard(name), name)
+	}
+}
+
+// historyKeys returns the keys of the files in the history of the given stack.
+func historyKeys(t *testing.T, b *localBackend, ref *localBackendReference) []string {
+	t.Helper()
+
+	files, err := ref.listHistory(context.Background())
+	require.NoError(t, err)
+	keys := make([]string, 0, len(files))
+	for _, f := range files {
+		if !f.IsDir {
+			keys = append(keys, f.Key)
+		}
+	}
+	return keys
+}
+
+func TestShardedHistory(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b := newTestBackend(t, t.TempDir(), &localBackendOptions{InitialVersion: intPtr(2)})
+	assert.Equal(t, 2, b.StoreInfo().Version)
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	stk, err := b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+	addTestHistory(t, b, ref, 3)
+
+	keys := historyKeys(t, b, ref)
+	require.Len(t, keys, 6) // a history file and a checkpoint for each update
+	for _, key := range keys {
+		assert.True(t, isHistoryShard(path.Base(path.Dir(key))), key)
+	}
+
+	history, err := b.GetHistory(ctx, ref, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{3, 2, 1}, startTimes(history))
+
+	// Shards belong to the stack whose history holds them.
+	report, err := b.GC(ctx, GCOptions{DryRun: true, MinAge: -1})
+	require.NoError(t, err)
+	assert.Empty(t, report.Files)
+
+	// The history of renamed stacks is moved into the shards of the new name,
+	// after which the rename is recorded.
+	renamed, err := b.RenameStack(ctx, stk, "bar")
+	require.NoError(t, err)
+	renamedRef, err := b.getReference(renamed)
+	require.NoError(t, err)
+	history, err = b.GetHistory(ctx, renamedRef, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, history, 4)
+	assert.Equal(t, []int64{3, 2, 1}, startTimes(history[1:]))
+	assert.Empty(t, historyKeys(t, b, ref))
+	for _, key := range historyKeys(t, b, renamedRef) {
+		assert.True(t, isHistoryShard(path.Base(path.Dir(key))), key)
+	}
+
+	renamedStk, err := b.GetStack(ctx, renamed)
+	require.NoError(t, err)
+	_, err = b.RemoveStack(ctx, renamedStk, true /* force */)
+	require.NoError(t, err)
+	assert.Empty(t, historyKeys(t, b, renamedRef))
+}
+
+func TestShardHistory(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	b := newTestBackend(t, dir, &localBackendOptions{InitialVersion: intPtr(1)})
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+	addTestHistory(t, b, ref, 3)
+
+	unsharded := historyKeys(t, b, ref)
+	require.Len(t, unsharded, 6)
+	for _, key := range unsharded {
+		assert.Equal(t, filepath.ToSlash(ref.HistoryDir()), path.Dir(key))
+	}
+
+	bucket, err := fileblob.OpenBucket(dir, nil)
+	require.NoError(t, err)
+	defer bucket.Close()
+
+	// Dry runs don't modify the store.
+	var out bytes.Buffer
+	plan, err := ShardHistory(ctx, bucket, &MigrateOptions{DryRun: true, Stdout: &out})
+	require.NoError(t, err)
+	assert.Len(t, plan.Moves, 6)
+	assert.Contains(t, out.String(), "Would move 6 file(s)")
+	meta, err := ReadMeta(ctx, bucket)
+	require.NoError(t, err)
+	assert.Equal(t, 1, meta.Version)
+
+	plan, err = ShardHistory(ctx, bucket, &MigrateOptions{WriteReport: true})
+	require.NoError(t, err)
+	assert.Len(t, plan.Moves, 6)
+	assert.Equal(t, MigrationShardHistory, plan.Report.Kind)
+	assert.Equal(t, 1, plan.Report.FromVersion)
+	assert.Equal(t, 2, plan.Report.ToVersion)
+	assert.Equal(t, []string{"organization/proj/foo"}, plan.Report.Stacks)
+	exists, err := bucket.Exists(ctx, migrationReportPath)
+	require.NoError(t, err)
+	assert.True(t, exists)
+	meta, err = ReadMeta(ctx, bucket)
+	require.NoError(t, err)
+	assert.Equal(t, 2, meta.Version)
+	for _, mv := range plan.Moves {
+		exists, err := bucket.Exists(ctx, mv.Source)
+		require.NoError(t, err)
+		assert.False(t, exists, mv.Source)
+	}
+
+	// A file whose move was interrupted is read once.
+	mv := plan.Moves[0]
+	require.NoError(t, bucket.Copy(ctx, mv.Source, mv.Destination, nil))
+
+	b = newTestBackend(t, dir, &localBackendOptions{InitialVersion: intPtr(2)})
+	ref, err = b.parseStackReference("foo")
+	require.NoError(t, err)
+	history, err := b.GetHistory(ctx, ref, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{3, 2, 1}, startTimes(history))
+
+	// Updates of upgraded stores are sharded,
+	// and those recorded before are still read.
+	addTestHistory(t, b, ref, 1)
+	history, err = b.GetHistory(ctx, ref, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{1, 3, 2, 1}, startTimes(history))
+
+	// Running it again finishes the interrupted move.
+	plan, err = ShardHistory(ctx, bucket, nil)
+	require.NoError(t, err)
+	require.Len(t, plan.Moves, 1)
+	assert.Equal(t, mv.Source, plan.Moves[0].Source)
+	for _, key := range historyKeys(t, b, ref) {
+		assert.True(t, strings.Contains(key, "/"+historyShardPrefix), key)
+	}
+}
+
+func TestShardHistory_legacy(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	newTestBackend(t, dir, &localBackendOptions{InitialVersion: intPtr(0)})
+
+	bucket, err := fileblob.OpenBucket(dir, nil)
+	require.NoError(t, err)
+	defer bucket.Close()
+
+	_, err = ShardHistory(context.Background(), bucket, nil)
+	assert.ErrorContains(t, err, "legacy layout")
+}
@@ -0,0 +1,357 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/driver"
+)
+
+// State stores may be accessed through URLs signed for one file at a time,
+// e.g. presigned S3 URLs issued by a service that decides which stacks a pipeline may touch,
+// so that the pipeline never holds credentials for the whole bucket.
+// The URLs are issued by the SignedURLResolver in Options,
+// and the store is opened with a URL that only names it, e.g. "filestate+signed://team/prod".
+//
+// Files are read with GET and HEAD requests, written with PUT, and deleted with DELETE,
+// each sent to a URL issued for that method and file.
+// URLs are reused until shortly before they expire,
+// and requests that are denied are sent once more with a freshly issued URL.
+//
+// Listings are answered by the resolver if it implements SignedURLLister,
+// or from the index of the store written by [Backend.WriteIndex] otherwise,
+// in which case files written since the index was aren't listed.
+// Locks are listed like any other file,
+// so stacks can only be locked reliably if the resolver lists them.
+const signedURLBucketScheme = "filestate+signed"
+
+func init() {
+	blob.DefaultURLMux().RegisterBucket(signedURLBucketScheme, signedURLBucketURLOpener{})
+}
+
+// SignedURLResolver issues the URLs of the files of a state store opened with a "filestate+signed" URL.
+// Implementations must be safe for concurrent use.
+type SignedURLResolver interface {
+	// SignURL returns a URL to which a request with the given method
+	// may be sent for the file with the given key, relative to the root of the store.
+	// The method is one of GET, HEAD, PUT, and DELETE.
+	SignURL(ctx context.Context, method, key string) (*SignedURL, error)
+}
+
+// SignedURLLister may be implemented by a [SignedURLResolver]
+// to list the files of the store.
+type SignedURLLister interface {
+	// ListFiles returns all files whose keys start with the given prefix, in any order.
+	ListFiles(ctx context.Context, prefix string) ([]SignedURLFile, error)
+}
+
+// SignedURL is a URL issued by a [SignedURLResolver].
+type SignedURL struct {
+	// URL is the URL the request is sent to.
+	URL string
+
+	// Header holds headers the request must be sent with,
+	// e.g. those covered by the signature.
+	Header http.Header
+
+	// Expires is the time after which the URL can no longer be used.
+	// URLs that don't say when they expire are used once.
+	Expires time.Time
+}
+
+// SignedURLFile is a file listed by a [SignedURLLister].
+type SignedURLFile struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// errSignedURLResolverRequired is returned when a "filestate+signed" store is opened without a resolver.
+var errSignedURLResolverRequired = fmt.Errorf(
+	"%v:// state stores can only be opened by programs that set Options.SignedURLResolver", signedURLBucketScheme)
+
+// signedURLBucketURLOpener refuses to open stores without a resolver.
+// It's registered so that their URLs are recognized as those of state stores.
+type signedURLBucketURLOpener struct{}
+
+func (signedURLBucketURLOpener) OpenBucketURL(ctx context.Context, u *url.URL) (*blob.Bucket, error) {
+	return nil, errSignedURLResolverRequired
+}
+
+// openSignedURLBucket opens the "filestate+signed" store with the given URL,
+// whose files are accessed through the URLs issued by resolver.
+// It returns the bucket and the canonical URL of the store.
+func openSignedURLBucket(
+	originalURL string, resolver SignedURLResolver, clk clock,
+) (*wrappedBucket, string, error) {
+	p, err := url.Parse(originalURL)
+	if err != nil {
+		return nil, "", err
+	}
+	if p.Scheme != signedURLBucketScheme {
+		return nil, "", fmt.Errorf("a signed URL resolver can't be used with %v; expected a %v:// URL",
+			originalURL, signedURLBucketScheme)
+	}
+	if p.RawQuery != "" {
+		return nil, "", fmt.Errorf("%v:// URLs have no parameters: %v", signedURLBucketScheme, originalURL)
+	}
+	p.Path = strings.TrimSuffix(p.Path, "/")
+
+	bucket := blob.NewBucket(newSignedURLBucket(resolver, clk))
+	return &wrappedBucket{bucket: bucket, info: newBucketInfo(bucket, p)}, p.String(), nil
+}
+
+// URLs are refreshed this long before they expire,
+// so that they don't expire while a request is in flight.
+const signedURLRefreshMargin = 30 * time.Second
+
+// maxCachedSignedURLs is the number of URLs kept before expired ones are evicted.
+const maxCachedSignedURLs = 1024
+
+// signedURLCacheKey identifies a URL issued by a SignedURLResolver.
+type signedURLCacheKey struct {
+	method string
+	key    string
+}
+
+// signedURLCache keeps the URLs issued by a SignedURLResolver until shortly before they expire.
+type signedURLCache struct {
+	resolver SignedURLResolver
+	clock    clock
+
+	mu   sync.Mutex
+	urls map[signedURLCacheKey]*SignedURL
+}
+
+// get returns a URL for a request with the given method for the file with the given key,
+// issuing a new one if there's none cached, it's about to expire, or fresh is set.
+func (c *signedURLCache) get(ctx context.Context, method, key string, fresh bool) (*SignedURL, error) {
+	k := signedURLCacheKey{method: method, key: key}
+	if !fresh {
+		c.mu.Lock()
+		u, ok := c.urls[k]
+		c.mu.Unlock()
+		if ok && c.usable(u, c.clock.Now()) {
+			return u, nil
+		}
+	}
+
+	u, err := c.resolver.SignURL(ctx, method, key)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil || u.URL == "" {
+		return nil, errors.New("the signed URL resolver returned no URL")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.clock.Now()
+	if !c.usable(u, now) {
+		delete(c.urls, k)
+		return u, nil
+	}
+	if len(c.urls) >= maxCachedSignedURLs {
+		c.evict(now)
+	}
+	c.urls[k] = u
+	return u, nil
+}
+
+// usable reports whether the given URL may be reused at the given time.
+func (c *signedURLCache) usable(u *SignedURL, now time.Time) bool {
+	return u.Expires.Sub(now) > signedURLRefreshMargin
+}
+
+// evict removes the URLs that can no longer be reused,
+// or all of them if they all can.
+// The caller must hold mu.
+func (c *signedURLCache) evict(now time.Time) {
+	for k, u := range c.urls {
+		if !c.usable(u, now) {
+			delete(c.urls, k)
+		}
+	}
+	if len(c.urls) >= maxCachedSignedURLs {
+		c.urls = make(map[signedURLCacheKey]*SignedURL)
+	}
+}
+
+// signedURLBucket is a driver.Bucket for stores whose files are accessed through signed URLs.
+// Reads are those of stores served over HTTP.
+type signedURLBucket struct {
+	*httpBucket
+
+	// lister lists the files of the store if the resolver can.
+	lister SignedURLLister
+}
+
+var _ driver.Bucket = (*signedURLBucket)(nil)
+
+func newSignedURLBucket(resolver SignedURLResolver, clk clock) *signedURLBucket {
+	lister, _ := resolver.(SignedURLLister)
+	return &signedURLBucket{
+		httpBucket: &httpBucket{
+			client: http.DefaultClient,
+			urls: &signedURLCache{
+				resolver: resolver,
+				clock:    clk,
+				urls:     make(map[signedURLCacheKey]*SignedURL),
+			},
+		},
+		lister: lister,
+	}
+}
+
+func (b *signedURLBucket) ListPaged(ctx context.Context, opts *driver.ListOptions) (*driver.ListPage, error) {
+	if b.lister == nil {
+		return b.httpBucket.ListPaged(ctx, opts)
+	}
+	if opts.BeforeList != nil {
+		if err := opts.BeforeList(func(interface{}) bool { return false }); err != nil {
+			return nil, err
+		}
+	}
+
+	files, err := b.lister.ListFiles(ctx, opts.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	index := storeIndex{Objects: make([]storeIndexObject, len(files))}
+	for i, f := range files {
+		index.Objects[i] = storeIndexObject{Key: f.Key, Size: f.Size, ModTime: f.ModTime}
+	}
+	sort.Slice(index.Objects, func(i, j int) bool {
+		return index.Objects[i].Key < index.Objects[j].Key
+	})
+	return index.page(opts), nil
+}
+
+func (b *signedURLBucket) NewTypedWriter(
+	ctx context.Context, key, contentType string, opts *driver.WriterOptions,
+) (driver.Writer, error) {
+	if opts.BeforeWrite != nil {
+		if err := opts.BeforeWrite(func(interface{}) bool { return false }); err != nil {
+			return nil, err
+		}
+	}
+
+	header := make(http.Header)
+	for k, v := range map[string]string{
+		"Content-Type":        contentType,
+		"Cache-Control":       opts.CacheControl,
+		"Content-Disposition": opts.ContentDisposition,
+		"Content-Encoding":    opts.ContentEncoding,
+		"Content-Language":    opts.ContentLanguage,
+	} {
+		if v != "" {
+			header.Set(k, v)
+		}
+	}
+	if len(opts.ContentMD5) > 0 {
+		header.Set("Content-MD5", base64.StdEncoding.EncodeToString(opts.ContentMD5))
+	}
+	return &signedURLWriter{ctx: ctx, bucket: b, key: key, header: header}, nil
+}
+
+// signedURLWriter buffers a file and uploads it with a single PUT request when it's closed.
+type signedURLWriter struct {
+	ctx    context.Context
+	bucket *signedURLBucket
+	key    string
+	header http.Header
+	buf    bytes.Buffer
+}
+
+func (w *signedURLWriter) Write(p []byte) (int, error) { return w.buf.Write(p) }
+
+func (w *signedURLWriter) Close() error {
+	// Writes are aborted by canceling their context.
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	resp, err := w.bucket.do(w.ctx, http.MethodPut, w.key, w.header, w.buf.Bytes(),
+		http.StatusOK, http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Copy downloads the source file and uploads it again,
+// since a URL can only be signed for one file.
+func (b *signedURLBucket) Copy(ctx context.Context, dstKey, srcKey string, opts *driver.CopyOptions) error {
+	if opts.BeforeCopy != nil {
+		if err := opts.BeforeCopy(func(interface{}) bool { return false }); err != nil {
+			return err
+		}
+	}
+
+	resp, err := b.do(ctx, http.MethodGet, srcKey, nil, nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	byts, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	header := make(http.Header)
+	for _, k := range []string{"Content-Type", "Cache-Control", "Content-Disposition", "Content-Encoding"} {
+		if v := resp.Header.Get(k); v != "" {
+			header.Set(k, v)
+		}
+	}
+	put, err := b.do(ctx, http.MethodPut, dstKey, header, byts,
+		http.StatusOK, http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	return put.Body.Close()
+}
+
+func (b *signedURLBucket) Delete(ctx context.Context, key string) error {
+	resp, err := b.do(ctx, http.MethodDelete, key, nil, nil,
+		http.StatusOK, http.StatusAccepted, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// SignedURL returns a URL newly issued by the resolver.
+// Headers that must be sent with it are dropped,
+// so it only works with resolvers that don't require any.
+func (b *signedURLBucket) SignedURL(ctx context.Context, key string, opts *driver.SignedURLOptions) (string, error) {
+	u, err := b.urls.get(ctx, opts.Method, key, true /* fresh */)
+	if err != nil {
+		return "", err
+	}
+	return u.URL, nil
+}
@@ -0,0 +1,336 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// signingServer is an object store that only accepts requests to the URLs it signed,
+// until they expire by the time of its clock.
+// It's also the resolver that signs them.
+type signingServer struct {
+	t     *testing.T
+	clock *fakeClock
+	ttl   time.Duration
+	srv   *httptest.Server
+
+	mu      sync.Mutex
+	files   map[string][]byte
+	types   map[string]string
+	expires map[string]time.Time // by signature
+	signed  map[signedURLCacheKey]int
+	n       int
+}
+
+var _ SignedURLResolver = (*signingServer)(nil)
+
+func newSigningServer(t *testing.T, clk *fakeClock, ttl time.Duration) *signingServer {
+	s := &signingServer{
+		t:       t,
+		clock:   clk,
+		ttl:     ttl,
+		files:   make(map[string][]byte),
+		types:   make(map[string]string),
+		expires: make(map[string]time.Time),
+		signed:  make(map[signedURLCacheKey]int),
+	}
+	s.srv = httptest.NewServer(s)
+	t.Cleanup(s.srv.Close)
+	return s
+}
+
+func (s *signingServer) SignURL(ctx context.Context, method, key string) (*SignedURL, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.n++
+	sig := fmt.Sprintf("%v-%d", method, s.n)
+	expires := s.clock.Now().Add(s.ttl)
+	s.expires[sig] = expires
+	s.signed[signedURLCacheKey{method: method, key: key}]++
+	return &SignedURL{
+		URL:     s.srv.URL + "/" + key + "?sig=" + sig,
+		Header:  http.Header{"X-Signed-Key": {key}},
+		Expires: expires,
+	}, nil
+}
+
+// signCount returns the number of URLs signed for the given method and key.
+func (s *signingServer) signCount(method, key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.signed[signedURLCacheKey{method: method, key: key}]
+}
+
+// revoke makes all URLs signed so far unusable.
+func (s *signingServer) revoke() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expires = make(map[string]time.Time)
+}
+
+func (s *signingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	sig := r.URL.Query().Get("sig")
+	expires, ok := s.expires[sig]
+	if !ok || !strings.HasPrefix(sig, r.Method+"-") || r.Header.Get("X-Signed-Key") != key ||
+		!s.clock.Now().Before(expires) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		byts, ok := s.files[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", s.types[key])
+		w.Header().Set("Content-Length", fmt.Sprint(len(byts)))
+		if r.Method == http.MethodGet {
+			_, err := w.Write(byts)
+			assert.NoError(s.t, err)
+		}
+	case http.MethodPut:
+		byts, err := io.ReadAll(r.Body)
+		assert.NoError(s.t, err)
+		s.files[key] = byts
+		s.types[key] = r.Header.Get("Content-Type")
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		if _, ok := s.files[key]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(s.files, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// listingSigningServer is a signingServer that lists its files.
+type listingSigningServer struct {
+	*signingServer
+}
+
+var _ SignedURLLister = listingSigningServer{}
+
+func (s listingSigningServer) ListFiles(ctx context.Context, prefix string) ([]SignedURLFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var files []SignedURLFile
+	for key, byts := range s.files {
+		if strings.HasPrefix(key, prefix) {
+			files = append(files, SignedURLFile{Key: key, Size: int64(len(byts))})
+		}
+	}
+	return files, nil
+}
+
+func TestSignedURLBucket(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	clk := newFakeClock()
+	srv := newSigningServer(t, clk, time.Hour)
+	bucket := blob.NewBucket(newSignedURLBucket(listingSigningServer{srv}, clk))
+	defer bucket.Close()
+
+	require.NoError(t, bucket.WriteAll(ctx, "a/b.json", []byte("hello"), &blob.WriterOptions{
+		ContentType: "application/json",
+	}))
+	byts, err := bucket.ReadAll(ctx, "a/b.json")
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(byts))
+	attrs, err := bucket.Attributes(ctx, "a/b.json")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), attrs.Size)
+	assert.Equal(t, "application/json", attrs.ContentType)
+
+	require.NoError(t, bucket.Copy(ctx, "a/c.json", "a/b.json", nil))
+	page, _, err := bucket.ListPage(ctx, blob.FirstPageToken, 10, &blob.ListOptions{Prefix: "a/"})
+	require.NoError(t, err)
+	require.Len(t, page, 2)
+	assert.Equal(t, "a/b.json", page[0].Key)
+	assert.Equal(t, "a/c.json", page[1].Key)
+
+	require.NoError(t, bucket.Delete(ctx, "a/b.json"))
+	_, err = bucket.ReadAll(ctx, "a/b.json")
+	assert.Equal(t, gcerrors.NotFound, gcerrors.Code(err))
+	err = bucket.Delete(ctx, "a/b.json")
+	assert.Equal(t, gcerrors.NotFound, gcerrors.Code(err))
+
+	// Canceled writes aren't uploaded.
+	wctx, cancel := context.WithCancel(ctx)
+	w, err := bucket.NewWriter(wctx, "a/canceled", nil)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("partial"))
+	require.NoError(t, err)
+	cancel()
+	assert.Error(t, w.Close())
+	exists, err := bucket.Exists(ctx, "a/canceled")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestSignedURLBucket_cache(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	clk := newFakeClock()
+	srv := newSigningServer(t, clk, 10*time.Minute)
+	bucket := blob.NewBucket(newSignedURLBucket(srv, clk))
+	defer bucket.Close()
+	require.NoError(t, bucket.WriteAll(ctx, "k", []byte("v"), nil))
+
+	// URLs are reused until shortly before they expire.
+	for i := 0; i < 3; i++ {
+		_, err := bucket.ReadAll(ctx, "k")
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 1, srv.signCount(http.MethodGet, "k"))
+	clk.Advance(10*time.Minute - signedURLRefreshMargin)
+	_, err := bucket.ReadAll(ctx, "k")
+	require.NoError(t, err)
+	assert.Equal(t, 2, srv.signCount(http.MethodGet, "k"))
+
+	// URLs that stop working early are replaced.
+	srv.revoke()
+	_, err = bucket.ReadAll(ctx, "k")
+	require.NoError(t, err)
+	assert.Equal(t, 3, srv.signCount(http.MethodGet, "k"))
+}
+
+func TestSignedURLBucket_noSignatureInErrors(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	clk := newFakeClock()
+	// URLs that expire immediately are never accepted.
+	srv := newSigningServer(t, clk, 0)
+	bucket := blob.NewBucket(newSignedURLBucket(srv, clk))
+	defer bucket.Close()
+
+	_, err := bucket.ReadAll(ctx, "secret")
+	require.Error(t, err)
+	assert.Equal(t, gcerrors.PermissionDenied, gcerrors.Code(err))
+	assert.Contains(t, err.Error(), srv.srv.URL+"/secret")
+	assert.NotContains(t, err.Error(), "sig=")
+	assert.Equal(t, 2, srv.signCount(http.MethodGet, "secret"))
+}
+
+func TestNew_signedURL(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	clk := newFakeClock()
+	srv := listingSigningServer{newSigningServer(t, clk, time.Hour)}
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "filestate+signed://team/prod/",
+		&workspace.Project{Name: "proj"},
+		&localBackendOptions{Getenv: mapGetenv(nil), Clock: clk, SignedURLResolver: srv})
+	require.NoError(t, err)
+	assert.Equal(t, "filestate+signed://team/prod", b.url)
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+	_, _, err = b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 2))
+	require.NoError(t, err)
+
+	stacks, _, err := b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+	require.NoError(t, err)
+	require.Len(t, stacks, 1)
+	chk, err := b.getCheckpoint(ctx, ref)
+	require.NoError(t, err)
+	assert.Len(t, chk.Latest.Resources, 2)
+	assert.Contains(t, srv.files, ".pulumi/stacks/proj/foo.json")
+
+	// Locks are visible to other backends.
+	require.NoError(t, b.Lock(ctx, ref))
+	other, err := newLocalBackend(ctx, diagtest.LogSink(t), "filestate+signed://team/prod",
+		&workspace.Project{Name: "proj"},
+		&localBackendOptions{Getenv: mapGetenv(nil), Clock: clk, SignedURLResolver: srv})
+	require.NoError(t, err)
+	assert.ErrorContains(t, other.Lock(ctx, ref), "the stack is currently locked")
+	b.Unlock(ctx, ref)
+}
+
+func TestNew_signedURLInvalid(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	clk := newFakeClock()
+	srv := newSigningServer(t, clk, time.Hour)
+
+	tests := []struct {
+		desc     string
+		url      string
+		resolver SignedURLResolver
+		wantErr  string
+	}{
+		{
+			desc:    "no resolver",
+			url:     "filestate+signed://team/prod",
+			wantErr: "Options.SignedURLResolver",
+		},
+		{
+			desc:     "other scheme",
+			url:      "file://" + t.TempDir(),
+			resolver: srv,
+			wantErr:  "expected a filestate+signed:// URL",
+		},
+		{
+			desc:     "parameters",
+			url:      "filestate+signed://team/prod?prefix=a",
+			resolver: srv,
+			wantErr:  "have no parameters",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := newLocalBackend(ctx, diagtest.LogSink(t), tt.url, &workspace.Project{Name: "proj"},
+				&localBackendOptions{Getenv: mapGetenv(nil), SignedURLResolver: tt.resolver})
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
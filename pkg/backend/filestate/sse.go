@@ -0,0 +1,193 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"errors"
+	"fmt"
+
+	"cloud.google.com/go/storage"
+	s3v2 "github.com/aws/aws-sdk-go-v2/service/s3"
+	s3v2types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/gcsblob"
+	"gocloud.dev/blob/s3blob"
+)
+
+// ServerSideEncryption configures the encryption that the storage provider applies
+// to every object the backend writes, instead of the default encryption of the bucket.
+// Objects are decrypted by the storage provider, so reads are unaffected.
+//
+// It's supported by state stores in S3 and Google Cloud Storage.
+type ServerSideEncryption struct {
+	// Algorithm is the S3 server-side encryption algorithm:
+	// "AES256", "aws:kms", or "aws:kms:dsse".
+	// It defaults to "aws:kms" if KMSKeyID is set,
+	// and must be empty for Google Cloud Storage.
+	Algorithm string
+
+	// KMSKeyID is the key that objects are encrypted with:
+	// the ID, ARN, or alias of an AWS KMS key for S3,
+	// or the resource name of a Cloud KMS key for Google Cloud Storage,
+	// e.g. "projects/p/locations/l/keyRings/r/cryptoKeys/k".
+	KMSKeyID string
+}
+
+const (
+	sseAES256  = string(s3v2types.ServerSideEncryptionAes256)
+	sseKMS     = string(s3v2types.ServerSideEncryptionAwsKms)
+	sseKMSDSSE = "aws:kms:dsse"
+)
+
+// resolveServerSideEncryption checks that the given encryption settings
+// can be applied to the bucket with the given scheme,
+// and returns them with their defaults filled in,
+// or nil if sse is nil or empty.
+func resolveServerSideEncryption(scheme string, sse *ServerSideEncryption) (*ServerSideEncryption, error) {
+	if sse == nil || *sse == (ServerSideEncryption{}) {
+		return nil, nil
+	}
+
+	resolved := *sse
+	switch scheme {
+	case s3blob.Scheme:
+		if resolved.Algorithm == "" {
+			if resolved.KMSKeyID == "" {
+				return nil, errors.New("server-side encryption requires an algorithm or a KMS key")
+			}
+			resolved.Algorithm = sseKMS
+		}
+		switch resolved.Algorithm {
+		case sseKMS, sseKMSDSSE:
+		case sseAES256:
+			if resolved.KMSKeyID != "" {
+				return nil, fmt.Errorf("server-side encryption with %v does not use a KMS key", sseAES256)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported server-side encryption algorithm %q; expected one of %v, %v, %v",
+				resolved.Algorithm, sseAES256, sseKMS, sseKMSDSSE)
+		}
+	case gcsblob.Scheme:
+		if resolved.Algorithm != "" {
+			return nil, errors.New("server-side encryption in Google Cloud Storage takes a KMS key, not an algorithm")
+		}
+	default:
+		return nil, fmt.Errorf("server-side encryption is not supported for %v:// state stores", scheme)
+	}
+	return &resolved, nil
+}
+
+// errSSEUnsupported is returned when server-side encryption is configured,
+// but a write to the bucket can't be customized with it.
+var errSSEUnsupported = errors.New("server-side encryption can't be applied to writes to this bucket")
+
+// beforeWrite applies the encryption settings to a write.
+func (sse *ServerSideEncryption) beforeWrite(as func(interface{}) bool) error {
+	var input *s3manager.UploadInput
+	if as(&input) {
+		input.ServerSideEncryption = aws.String(sse.Algorithm)
+		if sse.KMSKeyID != "" {
+			input.SSEKMSKeyId = aws.String(sse.KMSKeyID)
+		}
+		return nil
+	}
+	var inputV2 *s3v2.PutObjectInput
+	if as(&inputV2) {
+		inputV2.ServerSideEncryption = s3v2types.ServerSideEncryption(sse.Algorithm)
+		if sse.KMSKeyID != "" {
+			inputV2.SSEKMSKeyId = aws.String(sse.KMSKeyID)
+		}
+		return nil
+	}
+	var w *storage.Writer
+	if as(&w) {
+		w.KMSKeyName = sse.KMSKeyID
+		return nil
+	}
+	return errSSEUnsupported
+}
+
+// beforeCopy applies the encryption settings to the destination of a copy.
+func (sse *ServerSideEncryption) beforeCopy(as func(interface{}) bool) error {
+	var input *s3.CopyObjectInput
+	if as(&input) {
+		input.ServerSideEncryption = aws.String(sse.Algorithm)
+		if sse.KMSKeyID != "" {
+			input.SSEKMSKeyId = aws.String(sse.KMSKeyID)
+		}
+		return nil
+	}
+	var inputV2 *s3v2.CopyObjectInput
+	if as(&inputV2) {
+		inputV2.ServerSideEncryption = s3v2types.ServerSideEncryption(sse.Algorithm)
+		if sse.KMSKeyID != "" {
+			inputV2.SSEKMSKeyId = aws.String(sse.KMSKeyID)
+		}
+		return nil
+	}
+	// The handles of a GCS copy must be accessed before its copier,
+	// which is why the settings are applied after any other option.
+	var copier *storage.Copier
+	if as(&copier) {
+		copier.DestinationKMSKeyName = sse.KMSKeyID
+		return nil
+	}
+	return errSSEUnsupported
+}
+
+// writerOptions returns opts with the server-side encryption of the bucket applied, if any.
+func (b *wrappedBucket) writerOptions(opts *blob.WriterOptions) *blob.WriterOptions {
+	if b.sse == nil {
+		return opts
+	}
+	var withSSE blob.WriterOptions
+	if opts != nil {
+		withSSE = *opts
+	}
+	before := withSSE.BeforeWrite
+	withSSE.BeforeWrite = func(as func(interface{}) bool) error {
+		if before != nil {
+			if err := before(as); err != nil {
+				return err
+			}
+		}
+		return b.sse.beforeWrite(as)
+	}
+	return &withSSE
+}
+
+// copyOptions returns opts with the server-side encryption of the bucket applied, if any.
+func (b *wrappedBucket) copyOptions(opts *blob.CopyOptions) *blob.CopyOptions {
+	if b.sse == nil {
+		return opts
+	}
+	var withSSE blob.CopyOptions
+	if opts != nil {
+		withSSE = *opts
+	}
+	before := withSSE.BeforeCopy
+	withSSE.BeforeCopy = func(as func(interface{}) bool) error {
+		if before != nil {
+			if err := before(as); err != nil {
+				return err
+			}
+		}
+		return b.sse.beforeCopy(as)
+	}
+	return &withSSE
+}
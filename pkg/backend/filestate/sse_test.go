@@ -0,0 +1,220 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	s3v2 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/memblob"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+)
+
+func TestResolveServerSideEncryption(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc    string
+		scheme  string
+		give    *ServerSideEncryption
+		want    *ServerSideEncryption
+		wantErr string
+	}{
+		{desc: "unset", scheme: "file"},
+		{desc: "empty", scheme: "file", give: &ServerSideEncryption{}},
+		{
+			desc:   "s3 key",
+			scheme: "s3",
+			give:   &ServerSideEncryption{KMSKeyID: "alias/state"},
+			want:   &ServerSideEncryption{Algorithm: "aws:kms", KMSKeyID: "alias/state"},
+		},
+		{
+			desc:   "s3 dsse",
+			scheme: "s3",
+			give:   &ServerSideEncryption{Algorithm: "aws:kms:dsse", KMSKeyID: "alias/state"},
+			want:   &ServerSideEncryption{Algorithm: "aws:kms:dsse", KMSKeyID: "alias/state"},
+		},
+		{
+			desc:   "s3 managed keys",
+			scheme: "s3",
+			give:   &ServerSideEncryption{Algorithm: "AES256"},
+			want:   &ServerSideEncryption{Algorithm: "AES256"},
+		},
+		{
+			desc:    "s3 managed keys with key",
+			scheme:  "s3",
+			give:    &ServerSideEncryption{Algorithm: "AES256", KMSKeyID: "alias/state"},
+			wantErr: "does not use a KMS key",
+		},
+		{
+			desc:    "s3 unknown algorithm",
+			scheme:  "s3",
+			give:    &ServerSideEncryption{Algorithm: "rot13"},
+			wantErr: `unsupported server-side encryption algorithm "rot13"`,
+		},
+		{
+			desc:   "gcs key",
+			scheme: "gs",
+			give:   &ServerSideEncryption{KMSKeyID: "projects/p/locations/l/keyRings/r/cryptoKeys/k"},
+			want:   &ServerSideEncryption{KMSKeyID: "projects/p/locations/l/keyRings/r/cryptoKeys/k"},
+		},
+		{
+			desc:    "gcs algorithm",
+			scheme:  "gs",
+			give:    &ServerSideEncryption{Algorithm: "aws:kms", KMSKeyID: "k"},
+			wantErr: "takes a KMS key, not an algorithm",
+		},
+		{
+			desc:    "unsupported store",
+			scheme:  "file",
+			give:    &ServerSideEncryption{KMSKeyID: "alias/state"},
+			wantErr: "not supported for file:// state stores",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := resolveServerSideEncryption(tt.scheme, tt.give)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// asTarget returns an As function that exposes target,
+// which must be a pointer to the request of a driver.
+func asTarget[T any](target *T) func(interface{}) bool {
+	return func(i interface{}) bool {
+		p, ok := i.(**T)
+		if ok {
+			*p = target
+		}
+		return ok
+	}
+}
+
+func TestServerSideEncryption_requests(t *testing.T) {
+	t.Parallel()
+
+	kms := &ServerSideEncryption{Algorithm: "aws:kms", KMSKeyID: "alias/state"}
+
+	upload := &s3manager.UploadInput{}
+	require.NoError(t, kms.beforeWrite(asTarget(upload)))
+	assert.Equal(t, "aws:kms", aws.StringValue(upload.ServerSideEncryption))
+	assert.Equal(t, "alias/state", aws.StringValue(upload.SSEKMSKeyId))
+
+	put := &s3v2.PutObjectInput{}
+	require.NoError(t, kms.beforeWrite(asTarget(put)))
+	assert.Equal(t, "aws:kms", string(put.ServerSideEncryption))
+	assert.Equal(t, "alias/state", aws.StringValue(put.SSEKMSKeyId))
+
+	cp := &s3.CopyObjectInput{}
+	require.NoError(t, kms.beforeCopy(asTarget(cp)))
+	assert.Equal(t, "aws:kms", aws.StringValue(cp.ServerSideEncryption))
+	assert.Equal(t, "alias/state", aws.StringValue(cp.SSEKMSKeyId))
+
+	cpV2 := &s3v2.CopyObjectInput{}
+	require.NoError(t, kms.beforeCopy(asTarget(cpV2)))
+	assert.Equal(t, "aws:kms", string(cpV2.ServerSideEncryption))
+
+	managed := &ServerSideEncryption{Algorithm: "AES256"}
+	upload = &s3manager.UploadInput{}
+	require.NoError(t, managed.beforeWrite(asTarget(upload)))
+	assert.Equal(t, "AES256", aws.StringValue(upload.ServerSideEncryption))
+	assert.Nil(t, upload.SSEKMSKeyId)
+
+	cmek := &ServerSideEncryption{KMSKeyID: "projects/p/locations/l/keyRings/r/cryptoKeys/k"}
+	w := &storage.Writer{}
+	require.NoError(t, cmek.beforeWrite(asTarget(w)))
+	assert.Equal(t, cmek.KMSKeyID, w.KMSKeyName)
+	copier := &storage.Copier{}
+	require.NoError(t, cmek.beforeCopy(asTarget(copier)))
+	assert.Equal(t, cmek.KMSKeyID, copier.DestinationKMSKeyName)
+
+	// Writes that can't be encrypted fail rather than fall back to the default encryption.
+	unsupported := func(interface{}) bool { return false }
+	assert.ErrorIs(t, kms.beforeWrite(unsupported), errSSEUnsupported)
+	assert.ErrorIs(t, kms.beforeCopy(unsupported), errSSEUnsupported)
+}
+
+func TestWrappedBucket_serverSideEncryption(t *testing.T) {
+	t.Parallel()
+
+	kms := &ServerSideEncryption{Algorithm: "aws:kms", KMSKeyID: "alias/state"}
+	b := &wrappedBucket{bucket: memblob.OpenBucket(nil), sse: kms}
+
+	// Options of the caller are kept, and their hooks run first.
+	var called bool
+	opts := b.writerOptions(&blob.WriterOptions{
+		ContentEncoding: "gzip",
+		BeforeWrite: func(func(interface{}) bool) error {
+			called = true
+			return nil
+		},
+	})
+	assert.Equal(t, "gzip", opts.ContentEncoding)
+	upload := &s3manager.UploadInput{}
+	require.NoError(t, opts.BeforeWrite(asTarget(upload)))
+	assert.True(t, called)
+	assert.Equal(t, "alias/state", aws.StringValue(upload.SSEKMSKeyId))
+
+	cp := &s3.CopyObjectInput{}
+	require.NoError(t, b.copyOptions(nil).BeforeCopy(asTarget(cp)))
+	assert.Equal(t, "alias/state", aws.StringValue(cp.SSEKMSKeyId))
+
+	// memblob can't encrypt objects, so writes to it fail.
+	err := b.WriteAll(context.Background(), "foo", []byte("bar"), nil)
+	assert.ErrorIs(t, err, errSSEUnsupported)
+
+	// Without encryption, options are passed through as they are.
+	plain := &wrappedBucket{bucket: memblob.OpenBucket(nil)}
+	assert.Nil(t, plain.writerOptions(nil))
+	assert.Nil(t, plain.copyOptions(nil))
+}
+
+func TestNew_serverSideEncryption(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	_, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()), nil,
+		&localBackendOptions{Getenv: mapGetenv(map[string]string{
+			"PULUMI_SELF_MANAGED_STATE_SSE_KMS_KEY_ID": "alias/state",
+		})})
+	assert.ErrorContains(t, err, "invalid server-side encryption")
+
+	_, err = newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()), nil,
+		&localBackendOptions{
+			Getenv:               mapGetenv(nil),
+			ServerSideEncryption: &ServerSideEncryption{Algorithm: "AES256"},
+		})
+	assert.ErrorContains(t, err, "not supported for file:// state stores")
+}
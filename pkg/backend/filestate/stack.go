@@ -40,19 +40,24 @@ type Stack interface {
 
 // localStack is a local stack descriptor.
 type localStack struct {
-	ref      *localBackendReference // the stack's reference (qualified name).
-	path     string                 // a path to the stack's checkpoint file on disk.
-	snapshot *deploy.Snapshot       // a snapshot representing the latest deployment state.
-	b        *localBackend          // a pointer to the backend this stack belongs to.
+	ref      *localBackendReference          // the stack's reference (qualified name).
+	path     string                          // a path to the stack's checkpoint file on disk.
+	snapshot *deploy.Snapshot                // a snapshot representing the latest deployment state.
+	tags     map[apitype.StackTagName]string // the stack's tags, if any.
+	b        *localBackend                   // a pointer to the backend this stack belongs to.
 }
 
-func newStack(ref *localBackendReference, path string, snapshot *deploy.Snapshot, b *localBackend) Stack {
+func newStack(
+	ref *localBackendReference, path string, snapshot *deploy.Snapshot,
+	tags map[apitype.StackTagName]string, b *localBackend,
+) Stack {
 	contract.Requiref(ref != nil, "ref", "ref was nil")
 
 	return &localStack{
 		ref:      ref,
 		path:     path,
 		snapshot: snapshot,
+		tags:     tags,
 		b:        b,
 	}
 }
@@ -65,7 +70,7 @@ func (s *localStack) Snapshot(ctx context.Context, secretsProvider secrets.Provi
 }
 func (s *localStack) Backend() backend.Backend              { return s.b }
 func (s *localStack) Path() string                          { return s.path }
-func (s *localStack) Tags() map[apitype.StackTagName]string { return nil }
+func (s *localStack) Tags() map[apitype.StackTagName]string { return s.tags }
 
 func (s *localStack) Remove(ctx context.Context, force bool) (bool, error) {
 	return backend.RemoveStack(ctx, s, force)
@@ -122,13 +127,36 @@ func (s *localStack) DefaultSecretManager(info *workspace.ProjectStack) (secrets
 	return passphrase.NewPromptingPassphraseSecretsManager(info, false /* rotatePassphraseSecretsProvider */)
 }
 
+// StackSummary is a summary of a local stack, as returned by ListStacks.
+// This adds the stack's tags and creation time atop the standard backend stack summary interface.
+type StackSummary interface {
+	backend.StackSummary
+	Tags() map[apitype.StackTagName]string // the stack's tags, if any.
+
+	// CreatedAt returns when the stack was created,
+	// or nil if it was created by a version of the CLI that didn't record it.
+	CreatedAt() *time.Time
+}
+
 type localStackSummary struct {
 	name backend.StackReference
 	chk  *apitype.CheckpointV3
+	tags map[apitype.StackTagName]string
+
+	// created is when the stack was created, if known.
+	created *time.Time
+
+	// lastUpdate is when the stack was last updated
+	// if the checkpoint doesn't say, e.g. as recorded in its history.
+	lastUpdate *time.Time
 }
 
-func newLocalStackSummary(name backend.StackReference, chk *apitype.CheckpointV3) localStackSummary {
-	return localStackSummary{name: name, chk: chk}
+var _ StackSummary = localStackSummary{}
+
+func newLocalStackSummary(
+	name backend.StackReference, chk *apitype.CheckpointV3, tags map[apitype.StackTagName]string,
+) localStackSummary {
+	return localStackSummary{name: name, chk: chk, tags: tags}
 }
 
 func (lss localStackSummary) Name() backend.StackReference {
@@ -141,7 +169,15 @@ func (lss localStackSummary) LastUpdate() *time.Time {
 			return &t
 		}
 	}
-	return nil
+	return lss.lastUpdate
+}
+
+func (lss localStackSummary) CreatedAt() *time.Time {
+	return lss.created
+}
+
+func (lss localStackSummary) Tags() map[apitype.StackTagName]string {
+	return lss.tags
 }
 
 func (lss localStackSummary) ResourceCount() *int {
@@ -0,0 +1,110 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"gocloud.dev/gcerrors"
+)
+
+// stackMetaSuffix is appended to StackBasePath
+// to get the path of the file holding the metadata of a stack,
+// e.g. ".pulumi/stacks/proj/dev.meta".
+// It doesn't have the extension of a checkpoint,
+// so it's never mistaken for the checkpoint of another stack.
+const stackMetaSuffix = ".meta"
+
+// stackMeta is the contents of the file holding the metadata of a stack.
+type stackMeta struct {
+	// Created is when the stack was created.
+	Created time.Time `json:"created"`
+}
+
+// stackMetaPath returns the path of the file holding the metadata of the given stack.
+func stackMetaPath(ref *localBackendReference) string {
+	return filepath.ToSlash(ref.StackBasePath()) + stackMetaSuffix
+}
+
+// readStackMeta returns the metadata of the given stack,
+// or nil if it has none, e.g. because it was created before metadata was recorded.
+func (b *localBackend) readStackMeta(ctx context.Context, ref *localBackendReference) (*stackMeta, error) {
+	key := stackMetaPath(ref)
+	byts, err := b.bucket.ReadAll(ctx, key)
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read %v: %w", key, err)
+	}
+
+	var meta stackMeta
+	if err := json.Unmarshal(byts, &meta); err != nil {
+		return nil, fmt.Errorf("unmarshal %v: %w", key, err)
+	}
+	return &meta, nil
+}
+
+// writeStackMeta replaces the metadata of the given stack.
+func (b *localBackend) writeStackMeta(ctx context.Context, ref *localBackendReference, meta *stackMeta) error {
+	key := stackMetaPath(ref)
+	byts, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("marshal stack metadata: %w", err)
+	}
+	if err := b.bucket.WriteAll(ctx, key, byts, nil); err != nil {
+		return fmt.Errorf("write %v: %w", key, err)
+	}
+	return nil
+}
+
+// renameStackMeta moves the metadata of a stack to the file for its new name.
+func (b *localBackend) renameStackMeta(ctx context.Context, oldRef, newRef *localBackendReference) error {
+	oldKey, newKey := stackMetaPath(oldRef), stackMetaPath(newRef)
+	if err := b.bucket.Copy(ctx, newKey, oldKey, nil); err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			// The stack has no metadata.
+			return nil
+		}
+		return fmt.Errorf("copying stack metadata: %w", err)
+	}
+	if err := b.bucket.Delete(ctx, oldKey); err != nil {
+		return fmt.Errorf("deleting existing stack metadata: %w", err)
+	}
+	return nil
+}
+
+// lastUpdateFromHistory returns the time the most recent update of the given stack ended,
+// or nil if it has no history.
+func (b *localBackend) lastUpdateFromHistory(ctx context.Context, ref *localBackendReference) (*time.Time, error) {
+	updates, err := b.getHistory(ctx, ref, 1 /* pageSize */, 1 /* page */)
+	if err != nil || len(updates) == 0 {
+		return nil, err
+	}
+	u := updates[0]
+	end := u.EndTime
+	if end == 0 {
+		end = u.StartTime
+	}
+	if end == 0 {
+		return nil, nil
+	}
+	t := time.Unix(end, 0)
+	return &t, nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// listSummaries returns the summaries of all stacks by name.
+func listSummaries(t *testing.T, b *localBackend) map[string]StackSummary {
+	t.Helper()
+
+	stacks, _, err := b.ListStacks(context.Background(), backend.ListStacksFilter{}, nil /* inContToken */)
+	require.NoError(t, err)
+	summaries := make(map[string]StackSummary, len(stacks))
+	for _, s := range stacks {
+		summaries[s.Name().String()] = s.(StackSummary)
+	}
+	return summaries
+}
+
+func TestStackMeta(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	clk := newFakeClock()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"}, &localBackendOptions{Getenv: mapGetenv(nil), Clock: clk})
+	require.NoError(t, err)
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	stack, err := b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+	created := clk.Now()
+
+	summary := listSummaries(t, b)["foo"]
+	require.NotNil(t, summary)
+	require.NotNil(t, summary.CreatedAt())
+	assert.Equal(t, created, *summary.CreatedAt())
+	assert.Nil(t, summary.LastUpdate())
+
+	// Stacks without a deployment are last updated as of their history.
+	clk.Advance(time.Hour)
+	require.NoError(t, b.addToHistory(ctx, ref, backend.UpdateInfo{
+		Kind:      apitype.UpdateUpdate,
+		StartTime: clk.Now().Add(-time.Minute).Unix(),
+		EndTime:   clk.Now().Unix(),
+	}))
+	summary = listSummaries(t, b)["foo"]
+	require.NotNil(t, summary.LastUpdate())
+	assert.Equal(t, clk.Now().Unix(), summary.LastUpdate().Unix())
+
+	// Renames keep when the stack was created.
+	clk.Advance(time.Hour)
+	renamed, err := b.RenameStack(ctx, stack, "bar")
+	require.NoError(t, err)
+	summary = listSummaries(t, b)["bar"]
+	require.NotNil(t, summary.CreatedAt())
+	assert.Equal(t, created, *summary.CreatedAt())
+	assertTagsFile(t, b, ".pulumi/stacks/proj/foo.meta", false)
+
+	stack, err = b.GetStack(ctx, renamed)
+	require.NoError(t, err)
+	_, err = b.RemoveStack(ctx, stack, true /* force */)
+	require.NoError(t, err)
+	assertTagsFile(t, b, ".pulumi/stacks/proj/bar.meta", false)
+}
+
+func TestStackMeta_missing(t *testing.T) {
+	t.Parallel()
+
+	// Metadata is never mistaken for a stack.
+	b, ref := newSnapshotBackend(t, nil)
+	assertTagsFile(t, b, stackMetaPath(ref), true)
+	projects, err := b.ListProjects(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []tokens.Name{"proj"}, projects)
+	assert.Len(t, listSummaries(t, b), 1)
+
+	// Stacks created by older versions of the CLI have no metadata.
+	require.NoError(t, b.bucket.Delete(context.Background(), stackMetaPath(ref)))
+	summary := listSummaries(t, b)["foo"]
+	require.NotNil(t, summary)
+	assert.Nil(t, summary.CreatedAt())
+}
@@ -15,6 +15,8 @@
 package filestate
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
@@ -24,8 +26,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/pulumi/pulumi/sdk/v3/go/common/util/retry"
-
 	"github.com/pulumi/pulumi/pkg/v3/engine"
 
 	"gocloud.dev/blob"
@@ -36,6 +36,7 @@ import (
 	"github.com/pulumi/pulumi/pkg/v3/resource/stack"
 	"github.com/pulumi/pulumi/pkg/v3/secrets"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/config"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/cmdutil"
@@ -165,11 +166,93 @@ func (b *localBackend) getStack(
 
 // GetCheckpoint loads a checkpoint file for the given stack in this project, from the current project workspace.
 func (b *localBackend) getCheckpoint(ctx context.Context, ref *localBackendReference) (*apitype.CheckpointV3, error) {
+	if b.atSnapshot != "" {
+		return b.getCheckpointAtSnapshot(ctx, ref)
+	}
+
 	chkpath := b.stackPath(ctx, ref)
+
+	// The version is taken before the checkpoint is read
+	// so that a modification which races with the read
+	// makes the next write fail rather than go unnoticed.
+	version := b.checkpointVersion(ctx, chkpath)
+	chk, err := b.readCheckpointFile(ctx, chkpath)
+	if err != nil {
+		return b.recoverCheckpoint(ctx, ref, err)
+	}
+	if version != "" {
+		b.versions.set(chkpath, version)
+	}
+	return chk, nil
+}
+
+// readCheckpointFile reads and decodes the checkpoint file at the given path,
+// verifying its checksum and decrypting it as needed.
+func (b *localBackend) readCheckpointFile(ctx context.Context, chkpath string) (*apitype.CheckpointV3, error) {
+	if b.crypter == nil {
+		// Decode the checkpoint as it's read
+		// so that large checkpoints aren't held in memory twice.
+		chk, err := b.readCheckpointStream(ctx, chkpath)
+		if !errors.Is(err, errStreamingUnsupported) {
+			return chk, err
+		}
+	}
+
 	bytes, err := b.bucket.ReadAll(ctx, chkpath)
 	if err != nil {
 		return nil, err
 	}
+	if b.checksums {
+		if err := verifyChecksum(ctx, b.bucket, chkpath, bytes); err != nil {
+			return nil, err
+		}
+	}
+	bytes, err = unsealCheckpoint(ctx, b.crypter, chkpath, bytes)
+	if err != nil {
+		return nil, err
+	}
+	return decodeCheckpoint(bytes)
+}
+
+// gzipWriterOptions returns the options used to write gzip-compressed files to the bucket.
+//
+// These hint to the storage provider that the object is compressed.
+// Some providers may use this to transparently decompress the object when it's read,
+// so readers must not assume that a .gz object is still compressed.
+func gzipWriterOptions() *blob.WriterOptions {
+	return &blob.WriterOptions{ContentEncoding: "gzip"}
+}
+
+// gzipBytes compresses the given contents of a file at the given gzip level.
+func gzipBytes(byts []byte, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(byts); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readCheckpoint reads and decodes the checkpoint file at the given path in the bucket.
+// The file may optionally be gzip-compressed;
+// this is detected from its contents rather than its name.
+func readCheckpoint(ctx context.Context, bucket Bucket, chkpath string) (*apitype.CheckpointV3, error) {
+	bytes, err := bucket.ReadAll(ctx, chkpath)
+	if err != nil {
+		return nil, err
+	}
+	return decodeCheckpoint(bytes)
+}
+
+// decodeCheckpoint decodes the contents of a checkpoint file,
+// decompressing them first if they're gzip-compressed.
+func decodeCheckpoint(bytes []byte) (*apitype.CheckpointV3, error) {
 	m := encoding.JSON
 	if encoding.IsCompressed(bytes) {
 		m = encoding.Gzip(m)
@@ -183,6 +266,16 @@ func (b *localBackend) saveCheckpoint(
 	ref *localBackendReference,
 	checkpoint *apitype.VersionedCheckpoint,
 ) (backupFile string, file string, _ error) {
+	if err := b.checkWritable(); err != nil {
+		return "", "", err
+	}
+	if err := b.checkLayout(ref); err != nil {
+		return "", "", err
+	}
+	if err := b.validateCheckpoint(ctx, ref, checkpoint); err != nil {
+		return "", "", err
+	}
+
 	// Make a serializable stack and then use the encoder to encode it.
 	file = b.stackPath(ctx, ref)
 	m, ext := encoding.Detect(strings.TrimSuffix(file, ".gz"))
@@ -196,17 +289,36 @@ func (b *localBackend) saveCheckpoint(
 		if filepath.Ext(file) != encoding.GZIPExt {
 			file = file + ".gz"
 		}
-		m = encoding.Gzip(m)
 	} else {
 		file = strings.TrimSuffix(file, ".gz")
 	}
+	writeOpts := b.checkpointWriterOptions(ref, b.gzip, b.crypter != nil)
 
-	byts, err := m.Marshal(checkpoint)
-	if err != nil {
-		return "", "", fmt.Errorf("An IO error occurred while marshalling the checkpoint: %w", err)
+	// encode writes the contents of the checkpoint file.
+	// Unencrypted checkpoints are streamed to the bucket as they're encoded
+	// so that large checkpoints are never held in memory in full.
+	// Encryption needs the entire file, however.
+	var encode func(io.Writer) error
+	if b.crypter == nil {
+		encode = func(w io.Writer) error {
+			return encodeCheckpoint(w, checkpoint, b.checkpointFormat, b.gzip, b.gzipLevel)
+		}
+	} else {
+		var buf bytes.Buffer
+		if err := encodeCheckpoint(&buf, checkpoint, b.checkpointFormat, b.gzip, b.gzipLevel); err != nil {
+			return "", "", fmt.Errorf("An IO error occurred while marshalling the checkpoint: %w", err)
+		}
+		byts, err := sealCheckpoint(ctx, b.crypter, buf.Bytes())
+		if err != nil {
+			return "", "", fmt.Errorf("encrypt checkpoint: %w", err)
+		}
+		encode = func(w io.Writer) error {
+			_, err := w.Write(byts)
+			return err
+		}
 	}
 
-	// Back up the existing file if it already exists. Don't delete the original, the following WriteAll will
+	// Back up the existing file if it already exists. Don't delete the original, the following write will
 	// atomically replace it anyway and various other bits of the system depend on being able to find the
 	// .json file to know the stack currently exists (see https://github.com/pulumi/pulumi/issues/9033 for
 	// context).
@@ -222,36 +334,39 @@ func (b *localBackend) saveCheckpoint(
 		backupFile = bckPlain
 	}
 
-	// And now write out the new snapshot file, overwriting that location.
-	if err = b.bucket.WriteAll(ctx, file, byts, nil); err != nil {
-
-		b.mutex.Lock()
-		defer b.mutex.Unlock()
-
-		// FIXME: Would be nice to make these configurable
-		delay, _ := time.ParseDuration("1s")
-		maxDelay, _ := time.ParseDuration("30s")
-		backoff := 1.2
-
-		// Retry the write 10 times in case of upstream bucket errors
-		_, _, err = retry.Until(ctx, retry.Acceptor{
-			Delay:    &delay,
-			MaxDelay: &maxDelay,
-			Backoff:  &backoff,
-			Accept: func(try int, nextRetryTime time.Duration) (bool, interface{}, error) {
-				// And now write out the new snapshot file, overwriting that location.
-				err := b.bucket.WriteAll(ctx, file, byts, nil)
-				if err != nil {
-					logging.V(7).Infof("Error while writing snapshot to: %s (attempt=%d, error=%s)", file, try, err)
-					if try > 10 {
-						return false, nil, fmt.Errorf("An IO error occurred while writing the new snapshot file: %w", err)
-					}
-					return false, nil, nil
-				}
-				return true, nil, nil
-			},
-		})
-		if err != nil {
+	// Write out the new snapshot file, overwriting that location,
+	// and record the checksum of what was written.
+	// If conditional writes are enabled,
+	// the file is only overwritten if it hasn't changed since this backend last saw it.
+	ifVersion, _ := b.versions.get(file)
+	hash := newChecksumHash()
+	err := writeAtomicStream(ctx, b.bucket, file, ifVersion, b.retry, func(w io.Writer) error {
+		// Writes that are replayed start over.
+		hash.Reset()
+		return encode(io.MultiWriter(w, hash))
+	}, writeOpts)
+	if err != nil {
+		// Another attempt would overwrite the concurrent modification.
+		if !errors.Is(err, ErrConcurrentModification) {
+			err = fmt.Errorf("An IO error occurred while writing the new snapshot file: %w", err)
+		}
+		return backupFile, "", err
+	}
+	checksum := formatChecksum(hash)
+	if version := b.checkpointVersion(ctx, file); version != "" {
+		b.versions.set(file, version)
+	}
+
+	if b.verifyWrites || b.consistencyTimeout > 0 {
+		if err := b.verifyWrite(ctx, file, checksum); err != nil {
+			return backupFile, "", err
+		}
+	}
+
+	// Record the checksum only after the checkpoint has been written
+	// so that a truncated write is caught when the checkpoint is next read.
+	if b.checksums {
+		if err := writeChecksum(ctx, b.bucket, file, checksum); err != nil {
 			return backupFile, "", err
 		}
 	}
@@ -260,7 +375,7 @@ func (b *localBackend) saveCheckpoint(
 
 	// And if we are retaining historical checkpoint information, write it out again
 	if cmdutil.IsTruthy(b.Getenv("PULUMI_RETAIN_CHECKPOINTS")) {
-		if err = b.bucket.WriteAll(ctx, fmt.Sprintf("%v.%v", file, time.Now().UnixNano()), byts, nil); err != nil {
+		if err := b.bucket.Copy(ctx, fmt.Sprintf("%v.%v", file, time.Now().UnixNano()), file, nil); err != nil {
 			return backupFile, "", fmt.Errorf("An IO error occurred while writing the new snapshot file: %w", err)
 		}
 	}
@@ -268,12 +383,70 @@ func (b *localBackend) saveCheckpoint(
 	return backupFile, file, nil
 }
 
+// verifyWrite reads back the given file that was just written
+// and checks that its contents have the given checksum.
+// This catches storage providers that acknowledge writes
+// before they serve the new contents.
+//
+// With a consistency timeout, the file is read again with an increasing delay
+// until it has the new contents or the timeout expires.
+// Strongly consistent storage providers pass on the first read.
+func (b *localBackend) verifyWrite(ctx context.Context, file, checksum string) error {
+	deadline := b.clock.Now().Add(b.consistencyTimeout)
+	delay := consistencyPollDelay
+	for attempt := 1; ; attempt++ {
+		byts, err := b.bucket.ReadAll(ctx, file)
+		if err == nil {
+			err = matchChecksum(file, checksum, computeChecksum(byts))
+			if err == nil {
+				return nil
+			}
+		} else if gcerrors.Code(err) != gcerrors.NotFound {
+			// New files may not be listed yet, but other errors aren't about consistency.
+			return fmt.Errorf("verify write of %v: %w", file, err)
+		}
+
+		if b.consistencyTimeout <= 0 {
+			return fmt.Errorf("verify write of %v: %w", file, err)
+		}
+		if b.clock.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("verify write of %v: not visible after %v: %w", file, b.consistencyTimeout, err)
+		}
+		logging.V(7).Infof("waiting %v for write of %v to be visible (attempt %d): %v", delay, file, attempt, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > maxConsistencyPollDelay {
+			delay = maxConsistencyPollDelay
+		}
+	}
+}
+
+// consistencyPollDelay and maxConsistencyPollDelay bound the delay
+// between reads of a file waiting for a write to be visible.
+const (
+	consistencyPollDelay    = 50 * time.Millisecond
+	maxConsistencyPollDelay = time.Second
+)
+
 func (b *localBackend) saveStack(
 	ctx context.Context,
 	ref *localBackendReference, snap *deploy.Snapshot,
 	sm secrets.Manager,
 ) (string, error) {
 	contract.Requiref(ref != nil, "ref", "ref was nil")
+	if sm != nil {
+		provider, err := secretsProviderOf(sm)
+		if err != nil {
+			return "", err
+		}
+		if err := b.checkSecretsProvider(b.meta, string(ref.FullyQualifiedName()), provider); err != nil {
+			return "", err
+		}
+	}
 	chk, err := stack.SerializeCheckpoint(ref.FullyQualifiedName(), snap, sm, false /* showSecrets */)
 	if err != nil {
 		return "", fmt.Errorf("serializaing checkpoint: %w", err)
@@ -298,16 +471,81 @@ func (b *localBackend) saveStack(
 	return file, nil
 }
 
-// removeStack removes information about a stack from the current workspace.
+// removeStack deletes the checkpoint, history, and backups of the given stack,
+// leaving only a copy of the checkpoint in a ".bak" file next to it.
+//
+// The caller must hold the lock on the stack, and release it afterwards.
 func (b *localBackend) removeStack(ctx context.Context, ref *localBackendReference) error {
 	contract.Requiref(ref != nil, "ref", "must not be nil")
 
+	if b.softDelete {
+		return b.trashStack(ctx, ref)
+	}
+
 	// Just make a backup of the file and don't write out anything new.
 	file := b.stackPath(ctx, ref)
-	backupTarget(ctx, b.bucket, file, false)
+	backupTarget(ctx, b.bucket, file, true /* keepOriginal */)
 
-	historyDir := ref.HistoryDir()
-	return removeAllByPrefix(ctx, b.bucket, historyDir)
+	// Stacks with a long history have many files,
+	// so delete them all at once rather than one by one.
+	keys, err := b.stackFileKeys(ctx, ref, file)
+	if err != nil {
+		return err
+	}
+	b.versions.forget(file)
+
+	var deleted func(string)
+	if b.progress != nil {
+		progress := newProgressCallback(ctx, ProgressRemove, b.progress)
+		stack := ref.FullyQualifiedName().String()
+		deleted = func(key string) { progress.report(stack, key, 0) }
+	}
+	return deleteAllProgress(ctx, b.bucket, keys, b.deleteConcurrency, deleted)
+}
+
+// stackFileKeys returns the keys of the files that make up the given stack
+// with its checkpoint at file: the checkpoint, its checksum, tags, and metadata,
+// and every file in its history and backups.
+func (b *localBackend) stackFileKeys(ctx context.Context, ref *localBackendReference, file string) ([]string, error) {
+	history, err := ref.listHistory(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list bucket objects for removal: %w", err)
+	}
+	backups, err := listBucket(ctx, b.bucket, ref.BackupDir())
+	if err != nil {
+		return nil, fmt.Errorf("unable to list bucket objects for removal: %w", err)
+	}
+
+	keys := []string{file, checksumPath(file), stackTagsPath(ref), stackMetaPath(ref)}
+	for _, f := range append(history, backups...) {
+		if !f.IsDir {
+			keys = append(keys, f.Key)
+		}
+	}
+	return keys, nil
+}
+
+// checkpointVersion returns the current version of the checkpoint file at the given path
+// if conditional writes are enabled and the state store supports them.
+// It returns an empty string otherwise,
+// in which case the checkpoint is written unconditionally.
+func (b *localBackend) checkpointVersion(ctx context.Context, file string) string {
+	if !b.conditionalWrites {
+		return ""
+	}
+	version, err := objectVersion(ctx, b.bucket, file)
+	if errors.Is(err, errConditionalUnsupported) {
+		b.warnConditionalOnce.Do(func() {
+			b.d.Warningf(diag.Message("", "The state store does not support conditional writes; "+
+				"checkpoints will be written without checking whether they were modified concurrently"))
+		})
+		return ""
+	}
+	if err != nil {
+		logging.V(5).Infof("error getting version of %v: %v (skipping)", file, err)
+		return ""
+	}
+	return version
 }
 
 // backupTarget makes a backup of an existing file, in preparation for writing a new one.
@@ -325,6 +563,12 @@ func backupTarget(ctx context.Context, bucket Bucket, file string, keepOriginal
 		if err != nil {
 			logging.V(5).Infof("error deleting source object after rename: %v (%v) skipping", file, err)
 		}
+
+		// The checksum of the original, if any, is meaningless without it.
+		err = bucket.Delete(ctx, checksumPath(file))
+		if err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+			logging.V(5).Infof("error deleting checksum of source object: %v (%v) skipping", file, err)
+		}
 	}
 
 	// IDEA: consider multiple backups (.bak.bak.bak...etc).
@@ -361,7 +605,7 @@ func (b *localBackend) backupStack(ctx context.Context, ref *localBackendReferen
 		ext = ext2 + ext
 		base = strings.TrimSuffix(base, ext2)
 	}
-	backupFile := fmt.Sprintf("%s.%v%s", base, time.Now().UnixNano(), ext)
+	backupFile := fmt.Sprintf("%s.%v%s", base, b.clock.Now().UnixNano(), ext)
 	return b.bucket.WriteAll(ctx, filepath.Join(backupDir, backupFile), byts, nil)
 }
 
@@ -383,7 +627,7 @@ func (b *localBackend) stackPath(ctx context.Context, ref *localBackendReference
 
 	var plainObj *blob.ListObject
 	for {
-		file, err := bucketIter.Next(ctx)
+		file, err := nextObject(ctx, b.bucket, bucketIter)
 		if err == io.EOF {
 			break
 		}
@@ -417,10 +661,47 @@ func (b *localBackend) getHistory(
 ) ([]backend.UpdateInfo, error) {
 	contract.Requiref(stack != nil, "stack", "must not be nil")
 
-	dir := stack.HistoryDir()
+	historyEntries, err := b.listHistoryFiles(ctx, stack)
+	if err != nil {
+		return nil, err
+	}
+
+	start := 0
+	end := len(historyEntries) - 1
+	if pageSize > 0 {
+		if page < 1 {
+			page = 1
+		}
+		start = (page - 1) * pageSize
+		end = start + pageSize - 1
+		if end > len(historyEntries)-1 {
+			end = len(historyEntries) - 1
+		}
+	}
+
+	var updates []backend.UpdateInfo
+
+	for i := start; i <= end; i++ {
+		update, err := b.readHistoryFile(ctx, historyEntries[i].Key)
+		if err != nil {
+			return nil, err
+		}
+		updates = append(updates, update)
+	}
+
+	return updates, nil
+}
+
+// listHistoryFiles lists the history entries of the given stack,
+// most recent first.
+// Copies of checkpoints stored alongside the entries are not included.
+func (b *localBackend) listHistoryFiles(
+	ctx context.Context,
+	stack *localBackendReference,
+) ([]*blob.ListObject, error) {
 	// TODO: we could consider optimizing the list operation using `page` and `pageSize`.
 	// Unfortunately, this is mildly invasive given the gocloud List API.
-	allFiles, err := listBucket(ctx, b.bucket, dir)
+	allFiles, err := stack.listHistory(ctx)
 	if err != nil {
 		// History doesn't exist until a stack has been updated.
 		if gcerrors.Code(err) == gcerrors.NotFound {
@@ -432,8 +713,9 @@ func (b *localBackend) getHistory(
 	var historyEntries []*blob.ListObject
 
 	// filter down to just history entries, reversing list to be in most recent order.
-	// listBucket returns the array sorted by file name, but because of how we name files, older updates come before
+	// listHistory returns the array sorted by file name, but because of how we name files, older updates come before
 	// newer ones.
+	allFiles = uniqueHistoryFiles(allFiles)
 	for i := len(allFiles) - 1; i >= 0; i-- {
 		file := allFiles[i]
 		filepath := file.Key
@@ -446,54 +728,31 @@ func (b *localBackend) getHistory(
 
 		historyEntries = append(historyEntries, file)
 	}
+	return historyEntries, nil
+}
 
-	start := 0
-	end := len(historyEntries) - 1
-	if pageSize > 0 {
-		if page < 1 {
-			page = 1
-		}
-		start = (page - 1) * pageSize
-		end = start + pageSize - 1
-		if end > len(historyEntries)-1 {
-			end = len(historyEntries) - 1
-		}
+// readHistoryFile reads and decodes the history entry at the given path in the bucket.
+func (b *localBackend) readHistoryFile(ctx context.Context, filepath string) (backend.UpdateInfo, error) {
+	var update backend.UpdateInfo
+	byts, err := b.bucket.ReadAll(ctx, filepath)
+	if err != nil {
+		return update, fmt.Errorf("reading history file %s: %w", filepath, err)
 	}
-
-	var updates []backend.UpdateInfo
-
-	for i := start; i <= end; i++ {
-		file := historyEntries[i]
-		filepath := file.Key
-
-		var update backend.UpdateInfo
-		b, err := b.bucket.ReadAll(ctx, filepath)
-		if err != nil {
-			return nil, fmt.Errorf("reading history file %s: %w", filepath, err)
-		}
-		m := encoding.JSON
-		if encoding.IsCompressed(b) {
-			m = encoding.Gzip(m)
-		}
-		err = m.Unmarshal(b, &update)
-		if err != nil {
-			return nil, fmt.Errorf("reading history file %s: %w", filepath, err)
-		}
-
-		updates = append(updates, update)
+	m := encoding.JSON
+	if encoding.IsCompressed(byts) {
+		m = encoding.Gzip(m)
 	}
-
-	return updates, nil
+	if err := m.Unmarshal(byts, &update); err != nil {
+		return update, fmt.Errorf("reading history file %s: %w", filepath, err)
+	}
+	return update, nil
 }
 
 func (b *localBackend) renameHistory(ctx context.Context, oldName, newName *localBackendReference) error {
 	contract.Requiref(oldName != nil, "oldName", "must not be nil")
 	contract.Requiref(newName != nil, "newName", "must not be nil")
 
-	oldHistory := oldName.HistoryDir()
-	newHistory := newName.HistoryDir()
-
-	allFiles, err := listBucket(ctx, b.bucket, oldHistory)
+	allFiles, err := oldName.listHistory(ctx)
 	if err != nil {
 		// if there's nothing there, we don't really need to do a rename.
 		if gcerrors.Code(err) == gcerrors.NotFound {
@@ -503,8 +762,11 @@ func (b *localBackend) renameHistory(ctx context.Context, oldName, newName *loca
 	}
 
 	for _, file := range allFiles {
+		if file.IsDir {
+			continue
+		}
 		fileName := objectName(file)
-		oldBlob := path.Join(oldHistory, fileName)
+		oldBlob := file.Key
 
 		// The filename format is <stack-name>-<timestamp>.[checkpoint|history].json[.gz], we need to change
 		// the stack name part but retain the other parts. If we find files that don't match this format
@@ -516,7 +778,7 @@ func (b *localBackend) renameHistory(ctx context.Context, oldName, newName *loca
 		}
 
 		newFileName := newName.name.String() + fileName[dashIndex:]
-		newBlob := path.Join(newHistory, newFileName)
+		newBlob := newName.HistoryFile(newFileName)
 
 		if err := b.bucket.Copy(ctx, newBlob, oldBlob, nil); err != nil {
 			return fmt.Errorf("copying history file: %w", err)
@@ -529,19 +791,66 @@ func (b *localBackend) renameHistory(ctx context.Context, oldName, newName *loca
 	return nil
 }
 
+// renameBackups moves the backups and snapshots of a stack
+// to the backup directory for its new name.
+func (b *localBackend) renameBackups(ctx context.Context, oldName, newName *localBackendReference) error {
+	contract.Requiref(oldName != nil, "oldName", "must not be nil")
+	contract.Requiref(newName != nil, "newName", "must not be nil")
+
+	oldBackups := oldName.BackupDir()
+	newBackups := newName.BackupDir()
+
+	allFiles, err := listBucket(ctx, b.bucket, oldBackups)
+	if err != nil {
+		// No backups were taken, so there's nothing to move.
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil
+		}
+		return err
+	}
+
+	for _, file := range allFiles {
+		if file.IsDir {
+			continue
+		}
+		fileName := objectName(file)
+		oldBlob := path.Join(oldBackups, fileName)
+
+		// Backups are named <stack-name>.<timestamp>.json[.gz] so they need the new stack name.
+		// Snapshots are named after their ID only and keep their name.
+		newFileName := fileName
+		if prefix := oldName.name.String() + "."; strings.HasPrefix(fileName, prefix) {
+			newFileName = newName.name.String() + "." + strings.TrimPrefix(fileName, prefix)
+		}
+		newBlob := path.Join(newBackups, newFileName)
+
+		if err := b.bucket.Copy(ctx, newBlob, oldBlob, nil); err != nil {
+			return fmt.Errorf("copying backup file: %w", err)
+		}
+		if err := b.bucket.Delete(ctx, oldBlob); err != nil {
+			return fmt.Errorf("deleting existing backup file: %w", err)
+		}
+	}
+
+	return nil
+}
+
 // addToHistory saves the UpdateInfo and makes a copy of the current Checkpoint file.
 func (b *localBackend) addToHistory(ctx context.Context, ref *localBackendReference, update backend.UpdateInfo) error {
 	contract.Requiref(ref != nil, "ref", "must not be nil")
-
-	dir := ref.HistoryDir()
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
 
 	// Prefix for the update and checkpoint files.
-	pathPrefix := path.Join(dir, fmt.Sprintf("%s-%d", ref.name, time.Now().UnixNano()))
+	pathPrefix := ref.HistoryFile(fmt.Sprintf("%s-%d", ref.name, b.clock.Now().UnixNano()))
 
 	m, ext := encoding.JSON, "json"
-	if b.gzip {
-		m = encoding.Gzip(m)
+	var writeOpts *blob.WriterOptions
+	if b.gzip || b.gzipHistory {
+		m = encoding.GzipLevel(m, b.gzipLevel)
 		ext += ".gz"
+		writeOpts = gzipWriterOptions()
 	}
 
 	// Save the history file.
@@ -551,13 +860,57 @@ func (b *localBackend) addToHistory(ctx context.Context, ref *localBackendRefere
 	}
 
 	historyFile := fmt.Sprintf("%s.history.%s", pathPrefix, ext)
-	if err = b.bucket.WriteAll(ctx, historyFile, byts, nil); err != nil {
+	if err = b.bucket.WriteAll(ctx, historyFile, byts, writeOpts); err != nil {
 		return err
 	}
 
 	// Make a copy of the checkpoint file. (Assuming it already exists.)
+	// If the storage provider keeps prior versions of it,
+	// record which version is current instead.
+	// With thin history, save a delta from the prior checkpoint.
+	// If only unchanged checkpoints are deduplicated, save a delta only if it's a marker.
+	chkpath := b.stackPath(ctx, ref)
+	if b.nativeVersioning {
+		err := b.writeHistoryRevision(ctx, historyRevisionKey(historyFile), chkpath)
+		if err == nil {
+			return nil
+		}
+		logging.V(5).Infof("error recording revision of %v: %v (copying it instead)", chkpath, err)
+	} else if b.thinHistory || b.dedupHistory {
+		// Save only what changed since the prior update.
+		err := b.writeHistoryDelta(ctx, ref, historyFile, chkpath, m, writeOpts, !b.thinHistory /* unchangedOnly */)
+		if err == nil {
+			return nil
+		}
+		logging.V(5).Infof("error saving delta of %v: %v (copying it instead)", chkpath, err)
+	}
 	checkpointFile := fmt.Sprintf("%s.checkpoint.%s", pathPrefix, ext)
-	return b.bucket.Copy(ctx, checkpointFile, b.stackPath(ctx, ref), nil)
+	if b.gzipHistory && !b.gzip {
+		return b.copyCheckpointCompressed(ctx, checkpointFile, chkpath)
+	}
+	return b.bucket.Copy(ctx, checkpointFile, chkpath, nil)
+}
+
+// copyCheckpointCompressed copies the checkpoint file at src to dst,
+// compressing it unless it's already compressed or encrypted.
+// Unlike Copy, this reads the checkpoint into memory.
+func (b *localBackend) copyCheckpointCompressed(ctx context.Context, dst, src string) error {
+	byts, err := b.bucket.ReadAll(ctx, src)
+	if err != nil {
+		return err
+	}
+
+	var writeOpts *blob.WriterOptions
+	switch {
+	case encoding.IsCompressed(byts):
+		writeOpts = gzipWriterOptions()
+	case b.crypter == nil && !isEncryptedCheckpoint(byts):
+		if byts, err = gzipBytes(byts, b.gzipLevel); err != nil {
+			return err
+		}
+		writeOpts = gzipWriterOptions()
+	}
+	return b.bucket.WriteAll(ctx, dst, byts, writeOpts)
 }
 
 // isPulumiDirEmpty reports whether the .pulumi directory inside the bucket
@@ -569,7 +922,7 @@ func isPulumiDirEmpty(ctx context.Context, b Bucket) (bool, error) {
 		Prefix:    workspace.BookkeepingDir,
 	})
 
-	if _, err := iter.Next(ctx); err != nil {
+	if _, err := nextObject(ctx, b, iter); err != nil {
 		if errors.Is(err, io.EOF) {
 			return true, nil
 		}
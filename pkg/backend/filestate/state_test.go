@@ -2,11 +2,18 @@ package filestate
 
 import (
 	"context"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"gocloud.dev/blob/memblob"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
 )
 
 func TestIsPulumiDirEmpty(t *testing.T) {
@@ -66,3 +73,65 @@ func TestIsPulumiDirEmpty(t *testing.T) {
 		})
 	}
 }
+
+// staleReadBucket is a Bucket that serves old contents of checkpoint files
+// like an eventually consistent storage provider may do right after they were written.
+type staleReadBucket struct {
+	Bucket
+
+	// staleReads is the number of reads of checkpoint files that are stale.
+	// All of them are if it's zero.
+	staleReads int32
+	reads      atomic.Int32
+}
+
+func (b *staleReadBucket) ReadAll(ctx context.Context, key string) ([]byte, error) {
+	if strings.HasPrefix(key, StacksDir+"/") && (b.staleReads == 0 || b.reads.Add(1) <= b.staleReads) {
+		return []byte("{}"), nil
+	}
+	return b.Bucket.ReadAll(ctx, key)
+}
+
+func TestSaveCheckpoint_verifyWrites(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, map[string]string{PulumiFilestateVerifyWritesEnvVar: "true"})
+	require.True(t, b.verifyWrites)
+	_, _, err := b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 1))
+	require.NoError(t, err)
+
+	b.bucket = &staleReadBucket{Bucket: b.bucket}
+	_, _, err = b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 2))
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+	assert.ErrorContains(t, err, "verify write of .pulumi/stacks/proj/foo.json")
+}
+
+func TestSaveCheckpoint_consistencyTimeout(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, map[string]string{PulumiFilestateConsistencyTimeoutEnvVar: "10s"})
+	require.Equal(t, 10*time.Second, b.consistencyTimeout)
+	require.False(t, b.verifyWrites)
+	bucket := b.bucket
+
+	// Reads are retried until the new contents are served.
+	stale := &staleReadBucket{Bucket: bucket, staleReads: 3}
+	b.bucket = stale
+	_, _, err := b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 1))
+	require.NoError(t, err)
+	assert.Equal(t, int32(4), stale.reads.Load())
+
+	// Writes fail if they aren't visible once the timeout expires.
+	b.consistencyTimeout = 200 * time.Millisecond
+	b.bucket = &staleReadBucket{Bucket: bucket}
+	_, _, err = b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 2))
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+	assert.ErrorContains(t, err, "not visible after 200ms")
+
+	_, err = newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"},
+		&localBackendOptions{Getenv: mapGetenv(map[string]string{PulumiFilestateConsistencyTimeoutEnvVar: "-1s"})})
+	assert.ErrorContains(t, err, "is not a non-negative duration")
+}
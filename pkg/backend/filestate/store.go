@@ -47,6 +47,37 @@ var (
 	BackupsDir = filepath.Join(workspace.BookkeepingDir, workspace.BackupDir)
 )
 
+// validateNamePath returns an error if the given project or stack name
+// can't be used as a single component of an object key.
+//
+// tokens.IsName accepts "." and "..",
+// which would place files outside of the directory for the project or stack,
+// possibly on top of other files in the bookkeeping directory such as meta.yaml.
+// kind is "project" or "stack", and is used in the error message.
+func validateNamePath(kind string, name tokens.Name) error {
+	switch s := string(name); {
+	case s == "":
+		return fmt.Errorf("%v name must not be empty", kind)
+	case s == "." || s == "..":
+		return fmt.Errorf("%v name %q is not allowed because it refers to a parent or current directory", kind, s)
+	case strings.ContainsAny(s, `/\`):
+		return fmt.Errorf("%v name %q must not contain path separators", kind, s)
+	case kind == "stack" && strings.HasSuffix(s, reservedStackSuffix):
+		return fmt.Errorf("stack name %q must not end in %q", s, reservedStackSuffix)
+	}
+	return nil
+}
+
+// namePath returns the path component for the given project or stack name.
+//
+// Names are validated with validateNamePath when references are parsed or listed,
+// so an invalid name here is a bug.
+func namePath(kind string, name tokens.Name) string {
+	err := validateNamePath(kind, name)
+	contract.Requiref(err == nil, kind, "%v", err)
+	return fsutil.NamePath(name)
+}
+
 // referenceStore stores and provides access to stack information.
 //
 // Each implementation of referenceStore is a different version of the stack
@@ -68,6 +99,17 @@ type referenceStore interface {
 	// This must be under HistoriesDir.
 	HistoryDir(*localBackendReference) string
 
+	// HistoryFile returns the key of the file with the given name
+	// in the history of this stack,
+	// e.g. for "dev-1690000000000000000.history.json".
+	//
+	// This must be under HistoryDir.
+	HistoryFile(ref *localBackendReference, name string) string
+
+	// listHistory lists the files in the history of this stack,
+	// sorted by name so that the updates they belong to are in chronological order.
+	listHistory(ctx context.Context, ref *localBackendReference) ([]*blob.ListObject, error)
+
 	// BackupDir returns the path to the directory
 	// where backups for this stack are stored.
 	//
@@ -77,6 +119,15 @@ type referenceStore interface {
 	// ListReferences lists all stack references in the store.
 	ListReferences(context.Context) ([]*localBackendReference, error)
 
+	// stackListOptions returns the options to list the checkpoints of the store's stacks with,
+	// limited to those of the given project if it's not empty and the store has projects.
+	stackListOptions(project tokens.Name) *blob.ListOptions
+
+	// referenceFromKey returns the reference of the stack
+	// whose checkpoint is the object with the given key,
+	// or false if the object isn't a checkpoint.
+	referenceFromKey(key string) (*localBackendReference, bool)
+
 	// ParseReference parses a localBackendReference from a string.
 	ParseReference(ref string) (*localBackendReference, error)
 
@@ -88,20 +139,36 @@ type referenceStore interface {
 // projectReferenceStore is a referenceStore that stores stack
 // information with the new project-based layout.
 //
-// This is version 1 of the stack storage format.
+// This is version 1 of the stack storage format,
+// and version 2 if the history of stacks is sharded.
 type projectReferenceStore struct {
 	bucket Bucket
 
 	// currentProject is a thread-safe way to get the current project.
 	currentProject func() *workspace.Project
+
+	// keys names the files of stacks.
+	keys *keyTemplate
+
+	// shardHistory writes history files into shards of the history directory of each stack
+	// and reads them from both, as in version 2 of the state store.
+	shardHistory bool
 }
 
 var _ referenceStore = (*projectReferenceStore)(nil)
 
-func newProjectReferenceStore(bucket Bucket, currentProject func() *workspace.Project) *projectReferenceStore {
+// newProjectReferenceStore builds a projectReferenceStore
+// whose files are named after the given key template, or the default one if it's nil.
+func newProjectReferenceStore(
+	bucket Bucket, currentProject func() *workspace.Project, keys *keyTemplate,
+) *projectReferenceStore {
+	if keys == nil {
+		keys = defaultKeys
+	}
 	return &projectReferenceStore{
 		bucket:         bucket,
 		currentProject: currentProject,
+		keys:           keys,
 	}
 }
 
@@ -118,17 +185,33 @@ func (p *projectReferenceStore) newReference(project, name tokens.Name) *localBa
 
 func (p *projectReferenceStore) StackBasePath(ref *localBackendReference) string {
 	contract.Requiref(ref.project != "", "ref.project", "must not be empty")
-	return filepath.Join(StacksDir, fsutil.NamePath(ref.project), fsutil.NamePath(ref.name))
+	return filepath.Join(StacksDir, filepath.FromSlash(p.keys.path(ref.project, ref.name)))
 }
 
 func (p *projectReferenceStore) HistoryDir(stack *localBackendReference) string {
 	contract.Requiref(stack.project != "", "ref.project", "must not be empty")
-	return filepath.Join(HistoriesDir, fsutil.NamePath(stack.project), fsutil.NamePath(stack.name))
+	return filepath.Join(HistoriesDir, filepath.FromSlash(p.keys.path(stack.project, stack.name)))
+}
+
+func (p *projectReferenceStore) HistoryFile(stack *localBackendReference, name string) string {
+	if p.shardHistory {
+		return shardedHistoryFile(filepath.ToSlash(p.HistoryDir(stack)), name)
+	}
+	return filepath.Join(p.HistoryDir(stack), name)
+}
+
+func (p *projectReferenceStore) listHistory(
+	ctx context.Context, stack *localBackendReference,
+) ([]*blob.ListObject, error) {
+	if p.shardHistory {
+		return listShardedHistory(ctx, p.bucket, filepath.ToSlash(p.HistoryDir(stack)))
+	}
+	return listBucket(ctx, p.bucket, p.HistoryDir(stack))
 }
 
 func (p *projectReferenceStore) BackupDir(stack *localBackendReference) string {
 	contract.Requiref(stack.project != "", "ref.project", "must not be empty")
-	return filepath.Join(BackupsDir, fsutil.NamePath(stack.project), fsutil.NamePath(stack.name))
+	return filepath.Join(BackupsDir, filepath.FromSlash(p.keys.path(stack.project, stack.name)))
 }
 
 func (p *projectReferenceStore) ParseReference(stackRef string) (*localBackendReference, error) {
@@ -195,6 +278,13 @@ func (p *projectReferenceStore) ParseReference(stackRef string) (*localBackendRe
 			name)
 	}
 
+	if err := validateNamePath("project", tokens.Name(project)); err != nil {
+		return nil, err
+	}
+	if err := validateNamePath("stack", tokens.Name(name)); err != nil {
+		return nil, err
+	}
+
 	return p.newReference(tokens.Name(project), tokens.Name(name)), nil
 }
 
@@ -206,7 +296,7 @@ func (p *projectReferenceStore) ValidateReference(ref *localBackendReference) er
 }
 
 func (p *projectReferenceStore) ListProjects(ctx context.Context) ([]tokens.Name, error) {
-	path := StacksDir
+	path := path.Join(filepath.ToSlash(StacksDir), p.keys.projectsDir())
 
 	files, err := listBucket(ctx, p.bucket, path)
 	if err != nil {
@@ -219,15 +309,12 @@ func (p *projectReferenceStore) ListProjects(ctx context.Context) ([]tokens.Name
 			continue // ignore files
 		}
 
-		projName := objectName(file)
-		if !tokens.IsName(projName) {
-			// If this isn't a valid Name
-			// it won't be a project directory,
-			// so skip it.
-			continue
+		// If this isn't a valid Name
+		// it won't be a project directory,
+		// so skip it.
+		if projName, ok := p.keys.projectName(objectName(file)); ok {
+			projects = append(projects, projName)
 		}
-
-		projects = append(projects, tokens.Name(projName))
 	}
 
 	return projects, nil
@@ -236,7 +323,7 @@ func (p *projectReferenceStore) ListProjects(ctx context.Context) ([]tokens.Name
 func (p *projectReferenceStore) ProjectExists(ctx context.Context, projectName string) (bool, error) {
 	contract.Requiref(projectName != "", "projectName", "must not be empty")
 
-	path := path.Join(StacksDir, projectName)
+	path := path.Join(filepath.ToSlash(StacksDir), p.keys.projectDir(tokens.Name(projectName)))
 
 	files, err := listBucket(ctx, p.bucket, path)
 	if err != nil {
@@ -260,7 +347,7 @@ func (p *projectReferenceStore) ListReferences(ctx context.Context) ([]*localBac
 
 	var stacks []*localBackendReference
 	for {
-		file, err := iter.Next(ctx)
+		file, err := nextObject(ctx, p.bucket, iter)
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				break
@@ -271,42 +358,77 @@ func (p *projectReferenceStore) ListReferences(ctx context.Context) ([]*localBac
 		if file.IsDir {
 			continue
 		}
+		if ref, ok := p.referenceFromKey(file.Key); ok {
+			stacks = append(stacks, ref)
+		}
+	}
+	return stacks, nil
+}
 
-		// Key is in the form,
-		//   $StacksDir/$projName/$stackName.json[.gz]
-		// We want to extract projName and stackName from it.
+func (p *projectReferenceStore) stackListOptions(project tokens.Name) *blob.ListOptions {
+	prefix := filepath.ToSlash(StacksDir) + "/"
+	if project != "" {
+		prefix += p.keys.projectDir(project) + "/"
+	} else if dir := p.keys.projectsDir(); dir != "" {
+		prefix += dir + "/"
+	}
+	return &blob.ListOptions{Prefix: prefix}
+}
 
-		parts := strings.Split(strings.TrimPrefix(file.Key, prefix), "/")
-		if len(parts) != 2 {
-			continue // skip paths too shallow or too deep
-		}
-		projName := parts[0]
-		objName := parts[1]
+func (p *projectReferenceStore) referenceFromKey(key string) (*localBackendReference, bool) {
+	// Key is in the form,
+	//   $StacksDir/$projName/$stackName.json[.gz]
+	// with the default key template.
+	// We want to extract projName and stackName from it.
+	prefix := filepath.ToSlash(StacksDir) + "/"
+	if !strings.HasPrefix(key, prefix) {
+		return nil, false
+	}
+	dir, file := path.Split(strings.TrimPrefix(key, prefix))
+	base, ok := trimCheckpointExt(file)
+	if !ok {
+		return nil, false
+	}
+	// Skips paths too shallow or too deep,
+	// and those with names that would not round-trip through StackBasePath.
+	projName, name, ok := p.keys.parse(dir + base)
+	if !ok {
+		return nil, false
+	}
+	return p.newReference(projName, name), true
+}
 
-		if !tokens.IsName(projName) {
-			// If this isn't a valid Name
-			// it won't be a project directory,
-			// so skip it.
-			continue
-		}
+// stackFileName returns the name of the stack whose checkpoint is in the file with the given name,
+// e.g. "dev" for "dev.json.gz", or false if the file isn't a checkpoint.
+func stackFileName(objName string) (tokens.Name, bool) {
+	name, ok := trimCheckpointExt(objName)
+	if !ok {
+		return "", false
+	}
 
-		// Skip files without valid extensions (e.g., *.bak files).
-		ext := filepath.Ext(objName)
-		// But accept gzip compression
-		if ext == encoding.GZIPExt {
-			objName = strings.TrimSuffix(objName, encoding.GZIPExt)
-			ext = filepath.Ext(objName)
-		}
+	// Skip files that would not round-trip through StackBasePath,
+	// e.g. ".pulumi/stacks/proj/..json".
+	if validateNamePath("stack", tokens.Name(name)) != nil {
+		return "", false
+	}
+	return tokens.Name(name), true
+}
 
-		if _, has := encoding.Marshalers[ext]; !has {
-			continue
-		}
+// trimCheckpointExt returns the name of a checkpoint file without its extension,
+// e.g. "dev" for "dev.json.gz", or false if the file isn't a checkpoint.
+func trimCheckpointExt(objName string) (string, bool) {
+	// Skip files without valid extensions (e.g., *.bak files).
+	ext := filepath.Ext(objName)
+	// But accept gzip compression
+	if ext == encoding.GZIPExt {
+		objName = strings.TrimSuffix(objName, encoding.GZIPExt)
+		ext = filepath.Ext(objName)
+	}
 
-		// Read in this stack's information.
-		name := objName[:len(objName)-len(ext)]
-		stacks = append(stacks, p.newReference(tokens.Name(projName), tokens.Name(name)))
+	if _, has := encoding.Marshalers[ext]; !has {
+		return "", false
 	}
-	return stacks, nil
+	return objName[:len(objName)-len(ext)], true
 }
 
 // legacyReferenceStore is a referenceStore that stores stack
@@ -338,17 +460,27 @@ func (p *legacyReferenceStore) newReference(name tokens.Name) *localBackendRefer
 
 func (p *legacyReferenceStore) StackBasePath(ref *localBackendReference) string {
 	contract.Requiref(ref.project == "", "ref.project", "must be empty")
-	return filepath.Join(StacksDir, fsutil.NamePath(ref.name))
+	return filepath.Join(StacksDir, namePath("stack", ref.name))
 }
 
 func (p *legacyReferenceStore) HistoryDir(stack *localBackendReference) string {
 	contract.Requiref(stack.project == "", "ref.project", "must be empty")
-	return filepath.Join(HistoriesDir, fsutil.NamePath(stack.name))
+	return filepath.Join(HistoriesDir, namePath("stack", stack.name))
+}
+
+func (p *legacyReferenceStore) HistoryFile(stack *localBackendReference, name string) string {
+	return filepath.Join(p.HistoryDir(stack), name)
+}
+
+func (p *legacyReferenceStore) listHistory(
+	ctx context.Context, stack *localBackendReference,
+) ([]*blob.ListObject, error) {
+	return listBucket(ctx, p.bucket, p.HistoryDir(stack))
 }
 
 func (p *legacyReferenceStore) BackupDir(stack *localBackendReference) string {
 	contract.Requiref(stack.project == "", "ref.project", "must be empty")
-	return filepath.Join(BackupsDir, fsutil.NamePath(stack.name))
+	return filepath.Join(BackupsDir, namePath("stack", stack.name))
 }
 
 func (p *legacyReferenceStore) ParseReference(stackRef string) (*localBackendReference, error) {
@@ -357,6 +489,9 @@ func (p *legacyReferenceStore) ParseReference(stackRef string) (*localBackendRef
 			"stack names are limited to 100 characters and may only contain alphanumeric, hyphens, underscores, or periods: %q",
 			stackRef)
 	}
+	if err := validateNamePath("stack", tokens.Name(stackRef)); err != nil {
+		return nil, err
+	}
 	return p.newReference(tokens.Name(stackRef)), nil
 }
 
@@ -368,33 +503,58 @@ func (p *legacyReferenceStore) ValidateReference(ref *localBackendReference) err
 }
 
 func (p *legacyReferenceStore) ListReferences(ctx context.Context) ([]*localBackendReference, error) {
+	files, err := p.listStackFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stacks := make([]*localBackendReference, len(files))
+	for i, file := range files {
+		stacks[i] = p.newReference(file.Name)
+	}
+	return stacks, nil
+}
+
+func (p *legacyReferenceStore) stackListOptions(tokens.Name) *blob.ListOptions {
+	return &blob.ListOptions{Prefix: filepath.ToSlash(StacksDir) + "/", Delimiter: "/"}
+}
+
+func (p *legacyReferenceStore) referenceFromKey(key string) (*localBackendReference, bool) {
+	prefix := filepath.ToSlash(StacksDir) + "/"
+	if !strings.HasPrefix(key, prefix) || strings.Contains(strings.TrimPrefix(key, prefix), "/") {
+		return nil, false
+	}
+	name, ok := stackFileName(strings.TrimPrefix(key, prefix))
+	if !ok {
+		return nil, false
+	}
+	return p.newReference(name), true
+}
+
+// legacyStackFile is a stack file in the legacy layout.
+type legacyStackFile struct {
+	Name tokens.Name // name of the stack
+	Key  string      // key of the file
+}
+
+// listStackFiles lists the stack files in the legacy layout.
+func (p *legacyReferenceStore) listStackFiles(ctx context.Context) ([]legacyStackFile, error) {
 	files, err := listBucket(ctx, p.bucket, StacksDir)
 	if err != nil {
 		return nil, fmt.Errorf("error listing stacks: %w", err)
 	}
-	stacks := make([]*localBackendReference, 0, len(files))
+	stacks := make([]legacyStackFile, 0, len(files))
 
 	for _, file := range files {
 		if file.IsDir {
 			continue
 		}
 
-		objName := objectName(file)
-		// Skip files without valid extensions (e.g., *.bak files).
-		ext := filepath.Ext(objName)
-		// But accept gzip compression
-		if ext == encoding.GZIPExt {
-			objName = strings.TrimSuffix(objName, encoding.GZIPExt)
-			ext = filepath.Ext(objName)
-		}
-
-		if _, has := encoding.Marshalers[ext]; !has {
+		name, ok := stackFileName(objectName(file))
+		if !ok {
 			continue
 		}
 
-		// Read in this stack's information.
-		name := objName[:len(objName)-len(ext)]
-		stacks = append(stacks, p.newReference(tokens.Name(name)))
+		stacks = append(stacks, legacyStackFile{Name: name, Key: file.Key})
 	}
 
 	return stacks, nil
@@ -48,7 +48,7 @@ func TestProjectReferenceStore_referencePaths(t *testing.T) {
 	bucket := memblob.OpenBucket(nil)
 	store := newProjectReferenceStore(bucket, func() *workspace.Project {
 		return &workspace.Project{Name: "test"}
-	})
+	}, nil)
 
 	ref, err := store.ParseReference("organization/myproject/mystack")
 	require.NoError(t, err)
@@ -64,7 +64,7 @@ func TestProjectReferenceStore_ParseReference(t *testing.T) {
 	bucket := memblob.OpenBucket(nil)
 	store := newProjectReferenceStore(bucket, func() *workspace.Project {
 		return &workspace.Project{Name: "currentProject"}
-	})
+	}, nil)
 
 	tests := []struct {
 		desc string
@@ -137,6 +137,8 @@ func TestLegacyReferenceStore_ParseReference_errors(t *testing.T) {
 			desc: "over 100 characters",
 			give: strings.Repeat("a", 101),
 		},
+		{desc: "current directory", give: "."},
+		{desc: "parent directory", give: ".."},
 	}
 
 	for _, tt := range tests {
@@ -158,7 +160,7 @@ func TestProjectReferenceStore_ParseReference_errors(t *testing.T) {
 	bucket := memblob.OpenBucket(nil)
 	store := newProjectReferenceStore(bucket, func() *workspace.Project {
 		return nil // current project is not set
-	})
+	}, nil)
 
 	tests := []struct {
 		desc    string
@@ -199,6 +201,22 @@ func TestProjectReferenceStore_ParseReference_errors(t *testing.T) {
 			give:    "organization/foo/baz:qux",
 			wantErr: "may only contain alphanumeric",
 		},
+		{
+			// Would be stored in .pulumi/meta.json.
+			desc:    "parent directory project",
+			give:    "organization/../meta",
+			wantErr: `project name ".." is not allowed`,
+		},
+		{
+			desc:    "parent directory stack",
+			give:    "organization/foo/..",
+			wantErr: `stack name ".." is not allowed`,
+		},
+		{
+			desc:    "current directory stack",
+			give:    "organization/foo/.",
+			wantErr: `stack name "." is not allowed`,
+		},
 	}
 
 	for _, tt := range tests {
@@ -264,6 +282,15 @@ func TestLegacyReferenceStore_ListReferences(t *testing.T) {
 			},
 			want: []tokens.QName{"foo"},
 		},
+		{
+			desc: "directory names",
+			files: []string{
+				".pulumi/stacks/foo.json",
+				".pulumi/stacks/..json",
+				".pulumi/stacks/...json.gz",
+			},
+			want: []tokens.QName{"foo"},
+		},
 	}
 
 	for _, tt := range tests {
@@ -355,6 +382,17 @@ func TestProjectReferenceStore_List(t *testing.T) {
 			stacks:   []tokens.QName{"organization/a/foo"},
 			projects: []tokens.Name{"a", "bar"},
 		},
+		{
+			desc: "directory names",
+			files: []string{
+				".pulumi/stacks/a/foo.json",
+				".pulumi/stacks/a/..json",
+				".pulumi/stacks/a/...json",
+				".pulumi/stacks/./b.json",
+			},
+			stacks:   []tokens.QName{"organization/a/foo"},
+			projects: []tokens.Name{"a"},
+		},
 	}
 
 	for _, tt := range tests {
@@ -365,7 +403,7 @@ func TestProjectReferenceStore_List(t *testing.T) {
 			bucket := memblob.OpenBucket(nil)
 			store := newProjectReferenceStore(bucket, func() *workspace.Project {
 				return &workspace.Project{Name: "test"}
-			})
+			}, nil)
 
 			ctx := context.Background()
 			for _, f := range tt.files {
@@ -456,7 +494,7 @@ func TestProjectReferenceStore_ProjectExists(t *testing.T) {
 			bucket := memblob.OpenBucket(nil)
 			store := newProjectReferenceStore(bucket, func() *workspace.Project {
 				return &workspace.Project{Name: "test"}
-			})
+			}, nil)
 
 			ctx := context.Background()
 			for _, f := range tt.files {
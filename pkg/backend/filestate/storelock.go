@@ -0,0 +1,165 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
+)
+
+// ErrStoreLocked is returned by operations that can't run
+// while an operation on the whole state store, like a migration, is in progress.
+var ErrStoreLocked = errors.New("the state store is locked")
+
+// storeLockPath is the key of the lock held by operations on the whole state store.
+//
+// Stack locks live in per-stack directories under lockDir(),
+// so a file directly in it can't be mistaken for one.
+var storeLockPath = path.Join(lockDir(), "_store.json")
+
+// storeLock is the contents of the store lock file.
+type storeLock struct {
+	LockInfo
+
+	// ID identifies the holder of the lock.
+	ID string `json:"id"`
+
+	// Operation names the operation that holds the lock, e.g. "migration".
+	Operation string `json:"operation"`
+}
+
+// readStoreLock returns the store lock, or nil if the store isn't locked.
+func readStoreLock(ctx context.Context, b Bucket) (*storeLock, error) {
+	byts, err := b.ReadAll(ctx, storeLockPath)
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read store lock: %w", err)
+	}
+	var l storeLock
+	if err := json.Unmarshal(byts, &l); err != nil {
+		return nil, fmt.Errorf("malformed store lock %v: %w", storeLockPath, err)
+	}
+	return &l, nil
+}
+
+// checkStoreLock returns ErrStoreLocked if the store lock is held,
+// unless it's held with the given ID.
+func checkStoreLock(ctx context.Context, b Bucket, ours string) error {
+	l, err := readStoreLock(ctx, b)
+	if err != nil || l == nil || (ours != "" && l.ID == ours) {
+		return err
+	}
+	return fmt.Errorf("%w: %v started by %v@%v (pid %v) at %v is in progress; "+
+		"wait for it to finish, or delete %v if it's no longer running",
+		ErrStoreLocked, l.Operation, l.Username, l.Hostname, l.Pid, l.Timestamp.Format(time.RFC3339), storeLockPath)
+}
+
+// lockStore acquires the store lock on behalf of the named operation,
+// e.g. "migration".
+// It fails with ErrStoreLocked if another operation holds it.
+// If stackLocks is non-nil, it also fails if stackLocks reports stacks that are locked,
+// except for stale locks that the next process to lock the stack will reclaim.
+//
+// As for stack locks, the store is checked again after the lock is written
+// so that operations started at the same time see each other's locks.
+// Once the store lock is held, stacks can't be locked until it's released.
+//
+// It returns the ID of the lock and a function that releases it.
+func lockStore(
+	ctx context.Context, b Bucket, clk clock, operation string, stackLocks func(context.Context) ([]LockInfo, error),
+) (_ string, unlock func(), _ error) {
+	if err := checkStoreLock(ctx, b, ""); err != nil {
+		return "", nil, err
+	}
+	if err := checkStacksUnlocked(ctx, operation, stackLocks); err != nil {
+		return "", nil, err
+	}
+
+	uid, err := uuid.NewV4()
+	if err != nil {
+		return "", nil, err
+	}
+	lockID := uid.String()
+	owner, err := newLockInfo(clk.Now())
+	if err != nil {
+		return "", nil, err
+	}
+	owner.OperationID = operationID(ctx)
+	byts, err := json.Marshal(storeLock{LockInfo: owner, ID: lockID, Operation: operation})
+	if err != nil {
+		return "", nil, err
+	}
+	if err := b.WriteAll(ctx, storeLockPath, byts, nil); err != nil {
+		return "", nil, fmt.Errorf("write store lock: %w", err)
+	}
+	unlock = func() {
+		if err := b.Delete(ctx, storeLockPath); err != nil {
+			logging.V(5).Infof("error deleting store lock: %v (%v)", storeLockPath, err)
+		}
+	}
+
+	if err := checkStoreLock(ctx, b, lockID); err != nil {
+		if !errors.Is(err, ErrStoreLocked) {
+			unlock()
+		}
+		// Otherwise another operation replaced our lock, and it's theirs to release.
+		return "", nil, err
+	}
+	if err := checkStacksUnlocked(ctx, operation, stackLocks); err != nil {
+		unlock()
+		return "", nil, err
+	}
+	return lockID, unlock, nil
+}
+
+// checkStacksUnlocked returns an error listing the stacks reported by stackLocks
+// that are locked and whose locks aren't stale.
+func checkStacksUnlocked(
+	ctx context.Context, operation string, stackLocks func(context.Context) ([]LockInfo, error),
+) error {
+	if stackLocks == nil {
+		return nil
+	}
+	locks, err := stackLocks(ctx)
+	if err != nil {
+		return fmt.Errorf("list stack locks: %w", err)
+	}
+
+	var msg strings.Builder
+	for _, l := range locks {
+		if l.Stale {
+			continue
+		}
+		fmt.Fprintf(&msg, "\n  %v: locked by %v@%v (pid %v) at %v",
+			l.Stack, l.Username, l.Hostname, l.Pid, l.Timestamp.Format(time.RFC3339))
+	}
+	if msg.Len() > 0 {
+		return fmt.Errorf("cannot start %v while stacks are locked; "+
+			"wait for their operations to finish or remove their locks with `pulumi cancel`:%s", operation, msg.String())
+	}
+	return nil
+}
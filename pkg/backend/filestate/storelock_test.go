@@ -0,0 +1,103 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob/memblob"
+)
+
+// otherStoreLock is a store lock held by another process.
+const otherStoreLock = `{"id": "other", "operation": "migration", ` +
+	`"username": "alice", "hostname": "example.com", "pid": 42}`
+
+func assertStoreUnlocked(t *testing.T, b *localBackend) {
+	t.Helper()
+
+	exists, err := b.bucket.Exists(context.Background(), storeLockPath)
+	require.NoError(t, err)
+	assert.False(t, exists, "store lock was not released")
+}
+
+func TestStoreLock_blocksStacks(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, nil)
+	require.NoError(t, b.bucket.WriteAll(ctx, storeLockPath, []byte(otherStoreLock), nil))
+
+	err := b.Lock(ctx, ref)
+	assert.ErrorIs(t, err, ErrStoreLocked)
+	assert.ErrorContains(t, err, "migration started by alice@example.com (pid 42)")
+	assert.ErrorContains(t, err, "delete .pulumi/locks/_store.json if it's no longer running")
+	locks, err := b.ListLocks(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, locks)
+
+	// Other operations on the whole store are blocked too.
+	_, err = b.GC(ctx, GCOptions{})
+	assert.ErrorIs(t, err, ErrStoreLocked)
+	assert.ErrorIs(t, b.Upgrade(ctx), ErrStoreLocked)
+
+	require.NoError(t, b.bucket.Delete(ctx, storeLockPath))
+	require.NoError(t, b.Lock(ctx, ref))
+	b.Unlock(ctx, ref)
+}
+
+func TestStoreLock_upgrade(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, nil)
+
+	// Operations on the whole store don't start while stacks are locked.
+	require.NoError(t, b.Lock(ctx, ref))
+	err := b.Upgrade(ctx)
+	assert.ErrorContains(t, err, "cannot start migration while stacks are locked")
+	assert.ErrorContains(t, err, "organization/proj/foo: locked by")
+	assertStoreUnlocked(t, b)
+	b.Unlock(ctx, ref)
+
+	require.NoError(t, b.Upgrade(ctx))
+	assertStoreUnlocked(t, b)
+	require.NoError(t, b.Lock(ctx, ref))
+	b.Unlock(ctx, ref)
+}
+
+func TestStoreLock_migrate(t *testing.T) {
+	t.Parallel()
+
+	b := memblob.OpenBucket(nil)
+	writeFiles(t, b, map[string]string{
+		".pulumi/stacks/a.json":         legacyCheckpoint,
+		".pulumi/locks/_store.json":     otherStoreLock,
+		".pulumi/locks/b/instance.json": `{"username": "bob", "hostname": "example.com", "pid": 7}`,
+	})
+
+	_, err := Migrate(context.Background(), b, nil)
+	assert.ErrorIs(t, err, ErrStoreLocked)
+	assertNotExists(t, b, ".pulumi/stacks/proj/a.json")
+
+	require.NoError(t, b.Delete(context.Background(), ".pulumi/locks/_store.json"))
+	_, err = Migrate(context.Background(), b, nil)
+	assert.ErrorContains(t, err, "cannot start migration while stacks are locked")
+	assert.ErrorContains(t, err, "b: locked by bob@example.com (pid 7)")
+	assertNotExists(t, b, ".pulumi/stacks/proj/a.json")
+	assertNotExists(t, b, storeLockPath)
+}
@@ -0,0 +1,311 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
+)
+
+// CheckpointFormat is the JSON format that checkpoint files are written in.
+type CheckpointFormat string
+
+const (
+	// CheckpointFormatPretty indents checkpoint files by four spaces
+	// so that changes to them produce reviewable diffs.
+	//
+	// Keys are written in a fixed order:
+	// the fields of the checkpoint in the order of its schema
+	// and the keys of resource properties sorted,
+	// so the same state is always written the same way.
+	CheckpointFormatPretty CheckpointFormat = "pretty"
+
+	// CheckpointFormatCompact writes checkpoint files on a single line,
+	// which makes them smaller.
+	CheckpointFormatCompact CheckpointFormat = "compact"
+)
+
+// indent returns the indentation of nested values in the format,
+// which is empty for compact JSON.
+func (f CheckpointFormat) indent() string {
+	if f == CheckpointFormatCompact {
+		return ""
+	}
+	return "    "
+}
+
+// encodeCheckpoint writes the given checkpoint to w in the given format,
+// compressing it with the given gzip level if compress is set.
+// The pretty format is the same as that of encoding.JSON.
+//
+// Unlike encoding.JSON, it doesn't build the entire file in memory first.
+func encodeCheckpoint(
+	w io.Writer, chk *apitype.VersionedCheckpoint, format CheckpointFormat, compress bool, level int,
+) error {
+	raw := []byte(chk.Checkpoint)
+	if len(raw) == 0 {
+		raw = []byte("null")
+	}
+	// The checkpoint is written as is,
+	// so make sure that it won't corrupt the file.
+	if !json.Valid(raw) {
+		return errors.New("checkpoint is not valid JSON")
+	}
+
+	var zw *gzip.Writer
+	if compress {
+		var err error
+		zw, err = gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return err
+		}
+		w = zw
+	}
+
+	ji := &jsonIndenter{w: w, indent: format.indent()}
+	for _, part := range [][]byte{
+		[]byte(`{"version":` + strconv.Itoa(chk.Version) + `,"checkpoint":`),
+		raw,
+		[]byte("}"),
+	} {
+		if _, err := ji.Write(part); err != nil {
+			return err
+		}
+	}
+	if err := ji.Flush(); err != nil {
+		return err
+	}
+	// Like json.Encoder, end the file with a newline.
+	if _, err := w.Write([]byte("\n")); err != nil {
+		return err
+	}
+
+	if zw != nil {
+		return zw.Close()
+	}
+	return nil
+}
+
+// jsonIndentFlushSize is the number of bytes that jsonIndenter buffers
+// before writing them to the underlying writer.
+const jsonIndentFlushSize = 32 * 1024
+
+// jsonIndenter indents the JSON written to it like json.Indent with no prefix,
+// but writes the result to w as it goes
+// rather than holding the entire document in memory.
+//
+// Whitespace outside of strings is discarded
+// so the input may be indented already.
+// With an empty indent, the output is compact instead.
+// The input must be valid JSON; it's not validated.
+type jsonIndenter struct {
+	w      io.Writer
+	indent string
+
+	buf        []byte
+	depth      int
+	needIndent bool // an object or array was opened, but its first element hasn't been written yet
+	inString   bool
+	escaped    bool // the previous byte in a string was a backslash
+}
+
+func (ji *jsonIndenter) Write(p []byte) (int, error) {
+	for _, c := range p {
+		if ji.inString {
+			ji.buf = append(ji.buf, c)
+			switch {
+			case ji.escaped:
+				ji.escaped = false
+			case c == '\\':
+				ji.escaped = true
+			case c == '"':
+				ji.inString = false
+			}
+			continue
+		}
+
+		switch c {
+		case ' ', '\t', '\n', '\r':
+			continue
+		}
+
+		// Empty objects and arrays are written on a single line.
+		if ji.needIndent && c != '}' && c != ']' {
+			ji.needIndent = false
+			ji.depth++
+			ji.newline()
+		}
+
+		switch c {
+		case '"':
+			ji.inString = true
+			ji.buf = append(ji.buf, c)
+		case '{', '[':
+			ji.needIndent = true
+			ji.buf = append(ji.buf, c)
+		case ',':
+			ji.buf = append(ji.buf, c)
+			ji.newline()
+		case ':':
+			ji.buf = append(ji.buf, c)
+			if ji.indent != "" {
+				ji.buf = append(ji.buf, ' ')
+			}
+		case '}', ']':
+			if ji.needIndent {
+				ji.needIndent = false
+			} else {
+				ji.depth--
+				ji.newline()
+			}
+			ji.buf = append(ji.buf, c)
+		default:
+			ji.buf = append(ji.buf, c)
+		}
+
+		if len(ji.buf) >= jsonIndentFlushSize {
+			if err := ji.Flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(p), nil
+}
+
+func (ji *jsonIndenter) newline() {
+	if ji.indent == "" {
+		return
+	}
+	ji.buf = append(ji.buf, '\n')
+	for i := 0; i < ji.depth; i++ {
+		ji.buf = append(ji.buf, ji.indent...)
+	}
+}
+
+// Flush writes all buffered output to the underlying writer.
+func (ji *jsonIndenter) Flush() error {
+	_, err := ji.w.Write(ji.buf)
+	ji.buf = ji.buf[:0]
+	return err
+}
+
+// decodeCheckpointStream decodes a checkpoint file from r
+// without reading the entire file into memory first.
+//
+// Only files with the current checkpoint version that list the version before the checkpoint,
+// as written by encodeCheckpoint, can be decoded this way.
+// It returns errStreamingUnsupported for all other files
+// and files that fail to decode.
+// These should be decoded with decodeCheckpoint instead
+// which reports errors for them.
+func decodeCheckpointStream(r io.Reader) (*apitype.CheckpointV3, error) {
+	dec := json.NewDecoder(r)
+	expect := func(want json.Token) bool {
+		tok, err := dec.Token()
+		return err == nil && tok == want
+	}
+
+	if !expect(json.Delim('{')) || !expect("version") {
+		return nil, errStreamingUnsupported
+	}
+	var version int
+	if err := dec.Decode(&version); err != nil || version != apitype.DeploymentSchemaVersionCurrent {
+		return nil, errStreamingUnsupported
+	}
+	if !expect("checkpoint") {
+		return nil, errStreamingUnsupported
+	}
+	var chk apitype.CheckpointV3
+	if err := dec.Decode(&chk); err != nil {
+		return nil, errStreamingUnsupported
+	}
+	if !expect(json.Delim('}')) {
+		return nil, errStreamingUnsupported
+	}
+	return &chk, nil
+}
+
+// readCheckpointStream reads and decodes the checkpoint file at the given path
+// as it's read from the bucket.
+//
+// It returns errStreamingUnsupported if the bucket can't read files incrementally,
+// or if the file can't be decoded as it's read.
+// The caller should then read the file in full instead.
+func (b *localBackend) readCheckpointStream(ctx context.Context, chkpath string) (*apitype.CheckpointV3, error) {
+	contract.Requiref(b.crypter == nil, "crypter", "encrypted checkpoints can't be streamed")
+
+	var want string
+	var verify bool
+	if b.checksums {
+		var err error
+		want, verify, err = readChecksum(ctx, b.bucket, chkpath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r, err := newBucketReader(ctx, b.bucket, chkpath)
+	if err != nil {
+		return nil, err
+	}
+	defer contract.IgnoreClose(r)
+
+	hash := newChecksumHash()
+	br := bufio.NewReader(io.TeeReader(r, hash))
+	head, _ := br.Peek(len(encryptedCheckpointPrefix))
+	if isEncryptedCheckpoint(head) {
+		// Let the caller report that the file is unexpectedly encrypted.
+		return nil, errStreamingUnsupported
+	}
+
+	var src io.Reader = br
+	if encoding.IsCompressed(head) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, errStreamingUnsupported
+		}
+		src = zr
+	}
+
+	chk, err := decodeCheckpointStream(src)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read the rest of the file so that the entire file is checksummed,
+	// and so that the gzip reader verifies the uncompressed data.
+	if _, err := io.Copy(io.Discard, src); err != nil {
+		return nil, errStreamingUnsupported
+	}
+	if _, err := io.Copy(io.Discard, br); err != nil {
+		return nil, fmt.Errorf("read %q: %w", chkpath, err)
+	}
+	if verify {
+		if err := matchChecksum(chkpath, want, formatChecksum(hash)); err != nil {
+			return nil, err
+		}
+	}
+	return chk, nil
+}
@@ -0,0 +1,193 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/pkg/v3/resource/stack"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+)
+
+// newTestCheckpoint returns a checkpoint with n resources
+// whose inputs exercise the corner cases of JSON encoding.
+func newTestCheckpoint(t *testing.T, n int) *apitype.VersionedCheckpoint {
+	t.Helper()
+
+	resources := make([]apitype.ResourceV3, n)
+	for i := range resources {
+		resources[i] = apitype.ResourceV3{
+			URN:    resource.URN(fmt.Sprintf("urn:pulumi:foo::proj::pkg:index:Res::r%d", i)),
+			Custom: true,
+			Type:   "pkg:index:Res",
+			Inputs: map[string]interface{}{
+				"escaped": "quote \" backslash \\ brace } bracket ] comma , colon :",
+				"html":    "<a href='x'>&amp;</a>  ",
+				"empty":   map[string]interface{}{},
+				"list":    []interface{}{1, "two", []interface{}{}, map[string]interface{}{"k": nil}},
+			},
+		}
+	}
+	raw, err := encoding.JSON.Marshal(apitype.CheckpointV3{
+		Stack:  "foo",
+		Latest: &apitype.DeploymentV3{Resources: resources},
+	})
+	require.NoError(t, err)
+	return &apitype.VersionedCheckpoint{
+		Version:    apitype.DeploymentSchemaVersionCurrent,
+		Checkpoint: raw,
+	}
+}
+
+func TestEncodeCheckpoint(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc string
+		n    int
+	}{
+		{desc: "empty", n: 0},
+		{desc: "small", n: 1},
+		// Larger than the buffer of jsonIndenter.
+		{desc: "large", n: 500},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			chk := newTestCheckpoint(t, tt.n)
+
+			// The output must match what the buffered path writes.
+			want, err := encoding.JSON.Marshal(chk)
+			require.NoError(t, err)
+			var got bytes.Buffer
+			require.NoError(t, encodeCheckpoint(&got, chk, CheckpointFormatPretty, false, gzip.DefaultCompression))
+			assert.Equal(t, string(want), got.String())
+
+			wantGzip, err := encoding.GzipLevel(encoding.JSON, gzip.BestSpeed).Marshal(chk)
+			require.NoError(t, err)
+			var gotGzip bytes.Buffer
+			require.NoError(t, encodeCheckpoint(&gotGzip, chk, CheckpointFormatPretty, true, gzip.BestSpeed))
+			assert.Equal(t, wantGzip, gotGzip.Bytes())
+
+			// Compact files hold the same JSON on a single line.
+			var wantCompact bytes.Buffer
+			require.NoError(t, json.Compact(&wantCompact, want))
+			wantCompact.WriteString("\n")
+			var gotCompact bytes.Buffer
+			require.NoError(t, encodeCheckpoint(&gotCompact, chk, CheckpointFormatCompact, false, gzip.DefaultCompression))
+			assert.Equal(t, wantCompact.String(), gotCompact.String())
+		})
+	}
+}
+
+func TestEncodeCheckpoint_invalid(t *testing.T) {
+	t.Parallel()
+
+	var buff bytes.Buffer
+	err := encodeCheckpoint(&buff, &apitype.VersionedCheckpoint{
+		Version:    apitype.DeploymentSchemaVersionCurrent,
+		Checkpoint: json.RawMessage(`{"stack": "foo"`),
+	}, CheckpointFormatPretty, false, gzip.DefaultCompression)
+	assert.ErrorContains(t, err, "checkpoint is not valid JSON")
+	assert.Zero(t, buff.Len(), "nothing should be written")
+}
+
+func TestDecodeCheckpointStream(t *testing.T) {
+	t.Parallel()
+
+	chk := newTestCheckpoint(t, 3)
+	byts, err := encoding.JSON.Marshal(chk)
+	require.NoError(t, err)
+
+	want, err := stack.UnmarshalVersionedCheckpointToLatestCheckpoint(encoding.JSON, byts)
+	require.NoError(t, err)
+	got, err := decodeCheckpointStream(bytes.NewReader(byts))
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	unsupported := []string{
+		`{"version": 2, "checkpoint": {"stack": "foo"}}`,
+		`{"checkpoint": {"stack": "foo"}, "version": 3}`,
+		`{"stack": "foo"}`,
+		`{"version": 3, "checkpoint": {"stack": `,
+		"not json",
+	}
+	for _, give := range unsupported {
+		_, err := decodeCheckpointStream(strings.NewReader(give))
+		assert.ErrorIs(t, err, errStreamingUnsupported, "decode %q", give)
+	}
+}
+
+func TestGetCheckpoint_streaming(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc string
+		env  map[string]string
+	}{
+		{desc: "plain"},
+		{desc: "gzip", env: map[string]string{"PULUMI_SELF_MANAGED_STATE_GZIP": "true"}},
+		{desc: "checksums", env: map[string]string{"PULUMI_SELF_MANAGED_STATE_CHECKSUMS": "true"}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			b, ref := newSnapshotBackend(t, tt.env)
+			chk := newTestCheckpoint(t, 10)
+			_, _, err := b.saveCheckpoint(ctx, ref, chk)
+			require.NoError(t, err)
+
+			got, err := b.readCheckpointStream(ctx, b.stackPath(ctx, ref))
+			require.NoError(t, err)
+			assert.Len(t, got.Latest.Resources, 10)
+		})
+	}
+}
+
+func TestGetCheckpoint_streamingChecksumMismatch(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, map[string]string{"PULUMI_SELF_MANAGED_STATE_CHECKSUMS": "true"})
+	_, _, err := b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 1))
+	require.NoError(t, err)
+
+	// Valid JSON that decodes fine, but isn't what was written.
+	file := b.stackPath(ctx, ref)
+	byts, err := b.bucket.ReadAll(ctx, file)
+	require.NoError(t, err)
+	require.NoError(t, b.bucket.WriteAll(ctx, file, append(byts, '\n'), nil))
+
+	_, err = b.getCheckpoint(ctx, ref)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+}
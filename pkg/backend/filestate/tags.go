@@ -0,0 +1,159 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/util/validation"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+)
+
+const (
+	// reservedStackSuffix may not end stack names
+	// so that files holding stack tags
+	// are never mistaken for the checkpoint of another stack.
+	reservedStackSuffix = ".tags"
+
+	// stackTagsSuffix is appended to StackBasePath
+	// to get the path of the file holding the tags of a stack,
+	// e.g. ".pulumi/stacks/proj/dev.tags.json".
+	stackTagsSuffix = reservedStackSuffix + ".json"
+)
+
+// stackTagsPath returns the path of the file holding the tags of the given stack.
+func stackTagsPath(ref *localBackendReference) string {
+	return filepath.ToSlash(ref.StackBasePath()) + stackTagsSuffix
+}
+
+// readStackTags returns the tags of the given stack,
+// or nil if it has none.
+func (b *localBackend) readStackTags(
+	ctx context.Context, ref *localBackendReference,
+) (map[apitype.StackTagName]string, error) {
+	key := stackTagsPath(ref)
+	byts, err := b.bucket.ReadAll(ctx, key)
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read %v: %w", key, err)
+	}
+
+	var tags map[apitype.StackTagName]string
+	if err := json.Unmarshal(byts, &tags); err != nil {
+		return nil, fmt.Errorf("unmarshal %v: %w", key, err)
+	}
+	return tags, nil
+}
+
+// checkStackExists returns an error if the given stack has no checkpoint.
+func (b *localBackend) checkStackExists(ctx context.Context, ref *localBackendReference) error {
+	exists, err := b.checkpointExists(ctx, b.stackPath(ctx, ref))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("stack %v does not exist", ref)
+	}
+	return nil
+}
+
+func (b *localBackend) GetStackTags(
+	ctx context.Context, stackRef backend.StackReference,
+) (map[apitype.StackTagName]string, error) {
+	ref, err := b.getReference(stackRef)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.checkStackExists(ctx, ref); err != nil {
+		return nil, err
+	}
+	return b.readStackTags(ctx, ref)
+}
+
+func (b *localBackend) SetStackTags(
+	ctx context.Context, stackRef backend.StackReference, tags map[apitype.StackTagName]string,
+) error {
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+	ref, err := b.getReference(stackRef)
+	if err != nil {
+		return err
+	}
+	if err := validation.ValidateStackTags(tags); err != nil {
+		return fmt.Errorf("validating stack tags: %w", err)
+	}
+	if err := b.checkStackExists(ctx, ref); err != nil {
+		return err
+	}
+
+	key := stackTagsPath(ref)
+	if len(tags) == 0 {
+		if err := b.bucket.Delete(ctx, key); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+			return fmt.Errorf("delete %v: %w", key, err)
+		}
+		return nil
+	}
+
+	byts, err := json.MarshalIndent(tags, "", "    ")
+	if err != nil {
+		return fmt.Errorf("marshal stack tags: %w", err)
+	}
+	if err := b.bucket.WriteAll(ctx, key, byts, nil); err != nil {
+		return fmt.Errorf("write %v: %w", key, err)
+	}
+	return nil
+}
+
+// UpdateStackTags updates the stacks's tags, replacing all existing tags.
+func (b *localBackend) UpdateStackTags(ctx context.Context,
+	stack backend.Stack, tags map[apitype.StackTagName]string,
+) error {
+	return b.SetStackTags(ctx, stack.Ref(), tags)
+}
+
+// renameStackTags moves the tags of a stack to the file for its new name.
+func (b *localBackend) renameStackTags(ctx context.Context, oldRef, newRef *localBackendReference) error {
+	oldKey, newKey := stackTagsPath(oldRef), stackTagsPath(newRef)
+	if err := b.bucket.Copy(ctx, newKey, oldKey, nil); err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			// The stack has no tags.
+			return nil
+		}
+		return fmt.Errorf("copying stack tags: %w", err)
+	}
+	if err := b.bucket.Delete(ctx, oldKey); err != nil {
+		return fmt.Errorf("deleting existing stack tags: %w", err)
+	}
+	return nil
+}
+
+// matchesTagFilter reports whether the given tags
+// satisfy the tag filter of a ListStacks call.
+func matchesTagFilter(filter backend.ListStacksFilter, tags map[apitype.StackTagName]string) bool {
+	if filter.TagName == nil {
+		return true
+	}
+	v, ok := tags[*filter.TagName]
+	return ok && (filter.TagValue == nil || *filter.TagValue == v)
+}
@@ -0,0 +1,147 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+)
+
+// assertTagsFile asserts whether the file with the given key exists.
+func assertTagsFile(t *testing.T, b *localBackend, key string, want bool) {
+	t.Helper()
+
+	exists, err := b.bucket.Exists(context.Background(), key)
+	require.NoError(t, err)
+	assert.Equal(t, want, exists, "exists(%q)", key)
+}
+
+func TestStackTags(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, nil)
+
+	tags, err := b.GetStackTags(ctx, ref)
+	require.NoError(t, err)
+	assert.Empty(t, tags)
+
+	want := map[apitype.StackTagName]string{"owner": "alice", "env": "prod"}
+	require.NoError(t, b.SetStackTags(ctx, ref, want))
+	assertTagsFile(t, b, ".pulumi/stacks/proj/foo.tags.json", true)
+
+	tags, err = b.GetStackTags(ctx, ref)
+	require.NoError(t, err)
+	assert.Equal(t, want, tags)
+
+	s, err := b.GetStack(ctx, ref)
+	require.NoError(t, err)
+	assert.Equal(t, want, s.Tags())
+
+	// The tags file isn't listed as a stack.
+	stacks, _, err := b.ListStacks(ctx, backend.ListStacksFilter{}, nil)
+	require.NoError(t, err)
+	require.Len(t, stacks, 1)
+	assert.Equal(t, want, stacks[0].(StackSummary).Tags())
+
+	// Removing all tags deletes the file.
+	require.NoError(t, b.SetStackTags(ctx, ref, nil))
+	assertTagsFile(t, b, ".pulumi/stacks/proj/foo.tags.json", false)
+}
+
+func TestStackTags_errors(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, _ := newSnapshotBackend(t, nil)
+
+	missing, err := b.parseStackReference("missing")
+	require.NoError(t, err)
+	_, err = b.GetStackTags(ctx, missing)
+	assert.ErrorContains(t, err, "does not exist")
+	err = b.SetStackTags(ctx, missing, map[apitype.StackTagName]string{"owner": "alice"})
+	assert.ErrorContains(t, err, "does not exist")
+
+	_, err = b.parseStackReference("foo.tags")
+	assert.ErrorContains(t, err, `must not end in ".tags"`)
+}
+
+func TestStackTags_invalid(t *testing.T) {
+	t.Parallel()
+
+	b, ref := newSnapshotBackend(t, nil)
+	err := b.SetStackTags(context.Background(), ref, map[apitype.StackTagName]string{"bad tag": "x"})
+	assert.ErrorContains(t, err, "validating stack tags")
+}
+
+func TestListStacks_tagFilter(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, foo := newSnapshotBackend(t, nil)
+	bar, err := b.parseStackReference("bar")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, bar, "", nil)
+	require.NoError(t, err)
+
+	require.NoError(t, b.SetStackTags(ctx, foo, map[apitype.StackTagName]string{"env": "prod"}))
+	require.NoError(t, b.SetStackTags(ctx, bar, map[apitype.StackTagName]string{"env": "dev"}))
+
+	names := func(filter backend.ListStacksFilter) []string {
+		stacks, _, err := b.ListStacks(ctx, filter, nil)
+		require.NoError(t, err)
+		var names []string
+		for _, s := range stacks {
+			names = append(names, s.Name().String())
+		}
+		return names
+	}
+
+	env, prod, owner := "env", "prod", "owner"
+	assert.ElementsMatch(t, []string{"foo", "bar"}, names(backend.ListStacksFilter{TagName: &env}))
+	assert.Equal(t, []string{"foo"}, names(backend.ListStacksFilter{TagName: &env, TagValue: &prod}))
+	assert.Empty(t, names(backend.ListStacksFilter{TagName: &owner}))
+}
+
+func TestStackTags_renameAndRemove(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, nil)
+	want := map[apitype.StackTagName]string{"owner": "alice"}
+	require.NoError(t, b.SetStackTags(ctx, ref, want))
+
+	s, err := b.GetStack(ctx, ref)
+	require.NoError(t, err)
+	renamed, err := b.RenameStack(ctx, s, "organization/proj/bar")
+	require.NoError(t, err)
+	assertTagsFile(t, b, ".pulumi/stacks/proj/foo.tags.json", false)
+
+	tags, err := b.GetStackTags(ctx, renamed)
+	require.NoError(t, err)
+	assert.Equal(t, want, tags)
+
+	s, err = b.GetStack(ctx, renamed)
+	require.NoError(t, err)
+	_, err = b.RemoveStack(ctx, s, false)
+	require.NoError(t, err)
+	assertTagsFile(t, b, ".pulumi/stacks/proj/bar.tags.json", false)
+}
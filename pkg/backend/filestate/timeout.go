@@ -0,0 +1,318 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"gocloud.dev/blob"
+)
+
+// defaultOperationTimeout is the default time after which
+// a single request to the state store is abandoned.
+//
+// Reads and writes of checkpoints transfer the entire file in one request,
+// so this is generous enough for large checkpoints on slow connections.
+const defaultOperationTimeout = 5 * time.Minute
+
+// timeoutError is returned when a request to the state store
+// doesn't complete within the operation timeout.
+//
+// errors.Is reports it as context.DeadlineExceeded.
+type timeoutError struct {
+	op      string
+	key     string
+	timeout time.Duration
+	err     error
+}
+
+func (e *timeoutError) Error() string {
+	if e.key == "" {
+		return fmt.Sprintf("%v did not complete within %v: %v", e.op, e.timeout, e.err)
+	}
+	return fmt.Sprintf("%v %q did not complete within %v: %v", e.op, e.key, e.timeout, e.err)
+}
+
+func (e *timeoutError) Unwrap() error { return e.err }
+
+func (e *timeoutError) Is(target error) bool { return target == context.DeadlineExceeded }
+
+// timeoutBucket wraps a Bucket, abandoning requests to it
+// that don't complete within a timeout.
+//
+// Objects read or written incrementally must be transferred entirely
+// within the timeout of the request that opened them.
+//
+// blob.ListIterator can't be wrapped,
+// so listings are bounded by nextObject instead.
+type timeoutBucket struct {
+	Bucket
+
+	timeout time.Duration
+}
+
+var _ Bucket = (*timeoutBucket)(nil)
+
+// newTimeoutBucket returns a Bucket that abandons requests to b
+// after the given timeout.
+// If timeout is not positive, b is returned as is.
+func newTimeoutBucket(b Bucket, timeout time.Duration) Bucket {
+	if timeout <= 0 {
+		return b
+	}
+	return &timeoutBucket{Bucket: b, timeout: timeout}
+}
+
+// do runs f with a context that expires after the timeout,
+// reporting an expired timeout as a timeoutError.
+func (b *timeoutBucket) do(ctx context.Context, op, key string, f func(context.Context) error) error {
+	tctx, cancel := context.WithTimeout(ctx, b.timeout)
+	defer cancel()
+	return b.timedOut(ctx, tctx, op, key, f(tctx))
+}
+
+// timedOut returns err as a timeoutError
+// if it occurred because tctx expired, but its parent ctx did not.
+func (b *timeoutBucket) timedOut(ctx, tctx context.Context, op, key string, err error) error {
+	if err == nil || ctx.Err() != nil || tctx.Err() == nil {
+		return err
+	}
+	return &timeoutError{op: op, key: key, timeout: b.timeout, err: err}
+}
+
+func (b *timeoutBucket) operationTimeout() time.Duration {
+	return b.timeout
+}
+
+func (b *timeoutBucket) Copy(ctx context.Context, dstKey, srcKey string, opts *blob.CopyOptions) error {
+	return b.do(ctx, "copy", dstKey, func(ctx context.Context) error {
+		return b.Bucket.Copy(ctx, dstKey, srcKey, opts)
+	})
+}
+
+func (b *timeoutBucket) Delete(ctx context.Context, key string) error {
+	return b.do(ctx, "delete", key, func(ctx context.Context) error {
+		return b.Bucket.Delete(ctx, key)
+	})
+}
+
+func (b *timeoutBucket) DeleteBatch(ctx context.Context, keys []string) error {
+	return b.do(ctx, "delete batch", fmt.Sprintf("%d objects", len(keys)), func(ctx context.Context) error {
+		return deleteBatch(ctx, b.Bucket, keys)
+	})
+}
+
+func (b *timeoutBucket) ObjectVersion(ctx context.Context, key string) (version string, err error) {
+	err = b.do(ctx, "stat", key, func(ctx context.Context) error {
+		version, err = objectVersion(ctx, b.Bucket, key)
+		return err
+	})
+	return version, err
+}
+
+func (b *timeoutBucket) RevisionsEnabled(ctx context.Context) (enabled bool, err error) {
+	err = b.do(ctx, "stat", "", func(ctx context.Context) error {
+		enabled, err = revisionsEnabled(ctx, b.Bucket)
+		return err
+	})
+	return enabled, err
+}
+
+func (b *timeoutBucket) ListRevisions(ctx context.Context, key string) (revisions []objectRevision, err error) {
+	err = b.do(ctx, "list", key, func(ctx context.Context) error {
+		revisions, err = listRevisions(ctx, b.Bucket, key)
+		return err
+	})
+	return revisions, err
+}
+
+func (b *timeoutBucket) ReadRevision(ctx context.Context, key, id string) (byts []byte, err error) {
+	err = b.do(ctx, "read", key, func(ctx context.Context) error {
+		byts, err = readRevision(ctx, b.Bucket, key, id)
+		return err
+	})
+	return byts, err
+}
+
+func (b *timeoutBucket) ListPage(
+	ctx context.Context, pageToken []byte, pageSize int, opts *blob.ListOptions,
+) (objs []*blob.ListObject, next []byte, err error) {
+	err = b.do(ctx, "list", opts.Prefix, func(ctx context.Context) error {
+		objs, next, err = listPage(ctx, b.Bucket, pageToken, pageSize, opts)
+		return err
+	})
+	return objs, next, err
+}
+
+func (b *timeoutBucket) CopyIfVersion(ctx context.Context, dstKey, srcKey, version string) error {
+	return b.do(ctx, "copy", dstKey, func(ctx context.Context) error {
+		return copyIfVersion(ctx, b.Bucket, dstKey, srcKey, version)
+	})
+}
+
+func (b *timeoutBucket) ReadAll(ctx context.Context, key string) (byts []byte, err error) {
+	err = b.do(ctx, "read", key, func(ctx context.Context) error {
+		byts, err = b.Bucket.ReadAll(ctx, key)
+		return err
+	})
+	return byts, err
+}
+
+func (b *timeoutBucket) WriteAll(ctx context.Context, key string, p []byte, opts *blob.WriterOptions) error {
+	return b.do(ctx, "write", key, func(ctx context.Context) error {
+		return b.Bucket.WriteAll(ctx, key, p, opts)
+	})
+}
+
+func (b *timeoutBucket) Exists(ctx context.Context, key string) (exists bool, err error) {
+	err = b.do(ctx, "stat", key, func(ctx context.Context) error {
+		exists, err = b.Bucket.Exists(ctx, key)
+		return err
+	})
+	return exists, err
+}
+
+func (b *timeoutBucket) Attributes(ctx context.Context, key string) (attrs *blob.Attributes, err error) {
+	err = b.do(ctx, "stat", key, func(ctx context.Context) error {
+		attrs, err = b.Bucket.Attributes(ctx, key)
+		return err
+	})
+	return attrs, err
+}
+
+// NewWriter bounds the entire write, up to closing the writer, by the timeout.
+func (b *timeoutBucket) NewWriter(ctx context.Context, key string, opts *blob.WriterOptions) (io.WriteCloser, error) {
+	tctx, cancel := context.WithTimeout(ctx, b.timeout)
+	w, err := newBucketWriter(tctx, b.Bucket, key, opts)
+	if err != nil {
+		err = b.timedOut(ctx, tctx, "write", key, err)
+		cancel()
+		return nil, err
+	}
+	return &timeoutWriteCloser{WriteCloser: w, wrap: func(err error) error {
+		return b.timedOut(ctx, tctx, "write", key, err)
+	}, cancel: cancel}, nil
+}
+
+// NewReader bounds the entire read, up to closing the reader, by the timeout.
+func (b *timeoutBucket) NewReader(ctx context.Context, key string) (io.ReadCloser, error) {
+	tctx, cancel := context.WithTimeout(ctx, b.timeout)
+	r, err := newBucketReader(tctx, b.Bucket, key)
+	if err != nil {
+		err = b.timedOut(ctx, tctx, "read", key, err)
+		cancel()
+		return nil, err
+	}
+	return &timeoutReadCloser{ReadCloser: r, wrap: func(err error) error {
+		if err == io.EOF {
+			return err
+		}
+		return b.timedOut(ctx, tctx, "read", key, err)
+	}, cancel: cancel}, nil
+}
+
+// timeoutWriteCloser reports errors of a write that timed out with wrap,
+// and releases the timeout when it's closed.
+type timeoutWriteCloser struct {
+	io.WriteCloser
+
+	wrap   func(error) error
+	cancel context.CancelFunc
+}
+
+func (w *timeoutWriteCloser) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	return n, w.wrap(err)
+}
+
+func (w *timeoutWriteCloser) Close() error {
+	defer w.cancel()
+	return w.wrap(w.WriteCloser.Close())
+}
+
+// timeoutReadCloser reports errors of a read that timed out with wrap,
+// and releases the timeout when it's closed.
+type timeoutReadCloser struct {
+	io.ReadCloser
+
+	wrap   func(error) error
+	cancel context.CancelFunc
+}
+
+func (r *timeoutReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	return n, r.wrap(err)
+}
+
+func (r *timeoutReadCloser) Close() error {
+	defer r.cancel()
+	return r.wrap(r.ReadCloser.Close())
+}
+
+// operationTimeouter is implemented by Buckets
+// that abandon requests after a timeout.
+type operationTimeouter interface {
+	operationTimeout() time.Duration
+}
+
+// operationTimeout returns the timeout of requests to the given bucket,
+// or zero if they don't time out.
+func operationTimeout(b Bucket) time.Duration {
+	if t, ok := b.(operationTimeouter); ok {
+		return t.operationTimeout()
+	}
+	return 0
+}
+
+// nextObject returns the next object of a listing of the given bucket
+// like iter.Next, but bounded by the bucket's operation timeout.
+//
+// Pages of objects are only requested by some calls,
+// so the timeout applies to each call separately.
+// Objects of a page that has already been fetched are returned without a request,
+// which iter.Next does even if ctx is done,
+// so ctx is checked first to stop listings promptly once it's canceled.
+//
+// Objects matched by the ignore file of the state store are skipped.
+func nextObject(ctx context.Context, b Bucket, iter *blob.ListIterator) (*blob.ListObject, error) {
+	for {
+		obj, err := nextListedObject(ctx, b, iter)
+		if err != nil || !ignoredKey(b, obj.Key) {
+			return obj, err
+		}
+	}
+}
+
+// nextListedObject is nextObject without skipping ignored objects.
+func nextListedObject(ctx context.Context, b Bucket, iter *blob.ListIterator) (*blob.ListObject, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	timeout := operationTimeout(b)
+	if timeout <= 0 {
+		return iter.Next(ctx)
+	}
+	tctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	obj, err := iter.Next(tctx)
+	if err != nil && err != io.EOF && ctx.Err() == nil && tctx.Err() != nil {
+		return nil, &timeoutError{op: "list", timeout: timeout, err: err}
+	}
+	return obj, err
+}
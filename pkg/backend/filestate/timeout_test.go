@@ -0,0 +1,207 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/memblob"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// hangingBucket is a Bucket whose reads hang until their context is done
+// for the given number of attempts.
+type hangingBucket struct {
+	Bucket
+
+	hangs    int32
+	attempts int32
+}
+
+func (b *hangingBucket) ReadAll(ctx context.Context, key string) ([]byte, error) {
+	if atomic.AddInt32(&b.attempts, 1) <= b.hangs {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return b.Bucket.ReadAll(ctx, key)
+}
+
+func TestTimeoutBucket(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b := newTimeoutBucket(&hangingBucket{Bucket: &wrappedBucket{bucket: memblob.OpenBucket(nil)}, hangs: 1},
+		10*time.Millisecond)
+
+	_, err := b.ReadAll(ctx, "foo")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, `read "foo" did not complete within 10ms`)
+
+	// Requests that complete in time are unaffected.
+	require.NoError(t, b.WriteAll(ctx, "foo", []byte("bar"), nil))
+	got, err := b.ReadAll(ctx, "foo")
+	require.NoError(t, err)
+	assert.Equal(t, "bar", string(got))
+}
+
+func TestTimeoutBucket_canceled(t *testing.T) {
+	t.Parallel()
+
+	// Cancellation by the caller isn't reported as a timeout.
+	ctx, cancel := context.WithCancel(context.Background())
+	b := newTimeoutBucket(&hangingBucket{Bucket: &wrappedBucket{bucket: memblob.OpenBucket(nil)}, hangs: 1},
+		time.Minute)
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	_, err := b.ReadAll(ctx, "foo")
+	assert.ErrorIs(t, err, context.Canceled)
+	var terr *timeoutError
+	assert.False(t, errors.As(err, &terr), "unexpected timeout: %v", err)
+}
+
+func TestTimeoutBucket_retry(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	hanging := &hangingBucket{Bucket: &wrappedBucket{bucket: memblob.OpenBucket(nil)}, hangs: 2}
+	require.NoError(t, hanging.WriteAll(ctx, "foo", []byte("bar"), nil))
+	b := newRetryBucket(newTimeoutBucket(hanging, 10*time.Millisecond), retryPolicy{MaxAttempts: 3})
+
+	got, err := b.ReadAll(ctx, "foo")
+	require.NoError(t, err)
+	assert.Equal(t, "bar", string(got))
+	assert.Equal(t, int32(3), hanging.attempts)
+}
+
+func TestTimeoutBucket_streaming(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b := newTimeoutBucket(&wrappedBucket{bucket: memblob.OpenBucket(nil), streaming: true}, time.Minute)
+
+	w, err := newBucketWriter(ctx, b, "foo", nil)
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "bar")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	r, err := newBucketReader(ctx, b, "foo")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, "bar", string(got))
+
+	_, err = newBucketReader(ctx, b, "missing")
+	var terr *timeoutError
+	assert.False(t, errors.As(err, &terr), "missing objects must not be reported as timeouts: %v", err)
+}
+
+func TestNextObject(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	bucket := &wrappedBucket{bucket: memblob.OpenBucket(nil)}
+	require.NoError(t, bucket.WriteAll(ctx, "foo", []byte("bar"), nil))
+
+	// The timeout is found through other wrappers.
+	b := &readOnlyBucket{
+		Bucket: newRetryBucket(newTimeoutBucket(bucket, time.Minute), retryPolicy{MaxAttempts: 1}),
+		err:    ErrReadOnly,
+	}
+	assert.Equal(t, time.Minute, operationTimeout(b))
+
+	iter := b.List(&blob.ListOptions{})
+	obj, err := nextObject(ctx, b, iter)
+	require.NoError(t, err)
+	assert.Equal(t, "foo", obj.Key)
+	_, err = nextObject(ctx, b, iter)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestNextObject_canceled(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := &wrappedBucket{bucket: memblob.OpenBucket(nil)}
+	for _, key := range []string{"a", "b", "c"} {
+		require.NoError(t, b.WriteAll(ctx, key, []byte(key), nil))
+	}
+
+	// The remaining objects were fetched with the first,
+	// but aren't returned once ctx is canceled.
+	iter := b.List(&blob.ListOptions{})
+	_, err := nextObject(ctx, b, iter)
+	require.NoError(t, err)
+	cancel()
+	_, err = nextObject(ctx, b, iter)
+	assert.Equal(t, context.Canceled, err)
+
+	files, err := listAll(ctx, b, "")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Nil(t, files)
+}
+
+func TestNew_operationTimeout(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc    string
+		env     string
+		opt     time.Duration
+		want    time.Duration
+		wantErr string
+	}{
+		{desc: "default", want: defaultOperationTimeout},
+		{desc: "env", env: "30s", want: 30 * time.Second},
+		{desc: "env disabled", env: "0"},
+		{desc: "option", env: "30s", opt: time.Minute, want: time.Minute},
+		{desc: "option disabled", opt: -1},
+		{desc: "invalid", env: "soon", wantErr: "is not a non-negative duration"},
+		{desc: "negative", env: "-1s", wantErr: "is not a non-negative duration"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			b, err := newLocalBackend(context.Background(), diagtest.LogSink(t),
+				"file://"+filepath.ToSlash(t.TempDir()), &workspace.Project{Name: "testproj"},
+				&localBackendOptions{
+					Getenv:           mapGetenv(map[string]string{PulumiFilestateOperationTimeoutEnvVar: tt.env}),
+					OperationTimeout: tt.opt,
+				})
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, operationTimeout(b.bucket))
+		})
+	}
+}
@@ -0,0 +1,421 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// transactionsDir is the directory that holds the journals of transactions being committed
+// and the checkpoints they replace.
+func transactionsDir() string {
+	return path.Join(workspace.BookkeepingDir, "transactions")
+}
+
+// transactionJournalName is the name of the journal in the directory of a transaction.
+const transactionJournalName = "journal.json"
+
+// errTransactionDone is returned when a transaction is used
+// after it was committed or rolled back.
+var errTransactionDone = errors.New("transaction already committed or rolled back")
+
+// transactionJournal records the checkpoints replaced by a transaction being committed
+// so that they can be put back if the commit doesn't finish.
+type transactionJournal struct {
+	ID      string                    `json:"id"`
+	Started time.Time                 `json:"started"`
+	Stacks  []transactionJournalStack `json:"stacks"`
+}
+
+type transactionJournalStack struct {
+	// Stack is the fully qualified name of the stack.
+	Stack string `json:"stack"`
+
+	// Checkpoint is the key of the checkpoint of the stack when the commit started.
+	Checkpoint string `json:"checkpoint"`
+
+	// Previous is the key of the copy of that checkpoint.
+	Previous string `json:"previous"`
+}
+
+// Transaction replaces the checkpoints of several stacks together.
+// It's created with [Backend.BeginTransaction],
+// and must be finished with Commit or Rollback.
+//
+// Blob stores can't replace several objects atomically,
+// so a transaction is committed by writing a journal with a copy of each checkpoint it replaces
+// before writing the new checkpoints.
+// If writing any of them fails, those already written are put back.
+// If the process dies mid-commit instead,
+// [Backend.RecoverTransactions] puts them back from the journal.
+// Until then, readers that don't hold the locks of the stacks
+// may observe some of the new checkpoints but not others.
+type Transaction struct {
+	b  *localBackend
+	id string
+
+	// refs are the stacks in the transaction, sorted by name.
+	refs []*localBackendReference
+
+	// staged holds the checkpoints to commit, by the name of their stack.
+	staged map[string]*apitype.VersionedCheckpoint
+
+	done bool
+}
+
+// ID returns the unique ID of the transaction.
+func (t *Transaction) ID() string {
+	return t.id
+}
+
+func (b *localBackend) BeginTransaction(
+	ctx context.Context, stackRefs ...backend.StackReference,
+) (*Transaction, error) {
+	if err := b.checkWritable(); err != nil {
+		return nil, err
+	}
+	if len(stackRefs) == 0 {
+		return nil, errors.New("a transaction needs at least one stack")
+	}
+
+	seen := make(map[string]bool)
+	var refs []*localBackendReference
+	for _, stackRef := range stackRefs {
+		ref, err := b.getReference(stackRef)
+		if err != nil {
+			return nil, err
+		}
+		if name := string(ref.FullyQualifiedName()); !seen[name] {
+			seen[name] = true
+			refs = append(refs, ref)
+		}
+	}
+	// Lock the stacks in a fixed order
+	// so that overlapping transactions can't deadlock each other.
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].FullyQualifiedName() < refs[j].FullyQualifiedName()
+	})
+
+	for _, ref := range refs {
+		exists, err := b.bucket.Exists(ctx, b.stackPath(ctx, ref))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load checkpoint: %w", err)
+		}
+		if !exists {
+			return nil, fmt.Errorf("stack %v does not exist", ref)
+		}
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	if err := b.lockAll(ctx, refs); err != nil {
+		return nil, err
+	}
+	return &Transaction{
+		b:      b,
+		id:     id.String(),
+		refs:   refs,
+		staged: make(map[string]*apitype.VersionedCheckpoint),
+	}, nil
+}
+
+// lockAll locks the given stacks in order.
+// If any lock can't be acquired, those already acquired are released.
+func (b *localBackend) lockAll(ctx context.Context, refs []*localBackendReference) error {
+	for i, ref := range refs {
+		if err := b.Lock(ctx, ref); err != nil {
+			b.unlockAll(ctx, refs[:i])
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *localBackend) unlockAll(ctx context.Context, refs []*localBackendReference) {
+	for _, ref := range refs {
+		b.Unlock(ctx, ref)
+	}
+}
+
+// Stage sets the checkpoint that the given stack is updated to when the transaction is committed.
+// The checkpoint is validated right away, but nothing is written until Commit.
+// Staging a stack again replaces its checkpoint.
+func (t *Transaction) Stage(
+	ctx context.Context, stackRef backend.StackReference, checkpoint *apitype.VersionedCheckpoint,
+) error {
+	if t.done {
+		return errTransactionDone
+	}
+	ref, err := t.b.getReference(stackRef)
+	if err != nil {
+		return err
+	}
+	name := string(ref.FullyQualifiedName())
+	found := false
+	for _, r := range t.refs {
+		if string(r.FullyQualifiedName()) == name {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("stack %v is not part of transaction %v", ref, t.id)
+	}
+	if err := t.b.validateCheckpoint(ctx, ref, checkpoint); err != nil {
+		return err
+	}
+	t.staged[name] = checkpoint
+	return nil
+}
+
+// Commit writes the staged checkpoints and releases the locks of the stacks.
+//
+// If any checkpoint can't be written, those already written are put back
+// and the error is returned.
+// Stacks that had nothing staged are left as they are.
+func (t *Transaction) Commit(ctx context.Context) error {
+	if t.done {
+		return errTransactionDone
+	}
+	t.done = true
+	b := t.b
+	defer b.unlockAll(ctx, t.refs)
+
+	if len(t.staged) == 0 {
+		return nil
+	}
+
+	dir := path.Join(transactionsDir(), t.id)
+	journal := transactionJournal{ID: t.id, Started: t.b.clock.Now().UTC()}
+	var refs []*localBackendReference
+	for _, ref := range t.refs {
+		if _, ok := t.staged[string(ref.FullyQualifiedName())]; !ok {
+			continue
+		}
+		chkpath := b.stackPath(ctx, ref)
+		journal.Stacks = append(journal.Stacks, transactionJournalStack{
+			Stack:      string(ref.FullyQualifiedName()),
+			Checkpoint: chkpath,
+			Previous:   path.Join(dir, fmt.Sprintf("%d-%s", len(refs), path.Base(chkpath))),
+		})
+		refs = append(refs, ref)
+	}
+
+	// The journal is written before the copies it lists
+	// so that RecoverTransactions always finds copies it can trust:
+	// a journal without a copy means the checkpoint wasn't replaced yet.
+	byts, err := json.MarshalIndent(journal, "", "    ")
+	if err != nil {
+		return fmt.Errorf("marshal transaction journal: %w", err)
+	}
+	journalKey := path.Join(dir, transactionJournalName)
+	if err := b.bucket.WriteAll(ctx, journalKey, byts, nil); err != nil {
+		return fmt.Errorf("write transaction journal: %w", err)
+	}
+	for _, s := range journal.Stacks {
+		if err := b.bucket.Copy(ctx, s.Previous, s.Checkpoint, nil); err != nil {
+			err = fmt.Errorf("copy checkpoint of stack %v: %w", s.Stack, err)
+			if derr := b.deleteTransaction(ctx, t.id); derr != nil {
+				return fmt.Errorf("%w; the transaction may have to be recovered: %v", err, derr)
+			}
+			return err
+		}
+	}
+
+	for i, ref := range refs {
+		if _, _, err := b.saveCheckpoint(ctx, ref, t.staged[journal.Stacks[i].Stack]); err != nil {
+			err = fmt.Errorf("commit stack %v: %w", ref, err)
+			if rerr := b.rollbackTransaction(ctx, &journal); rerr != nil {
+				return fmt.Errorf("%w; rolling back failed, recover the transaction to retry: %v", err, rerr)
+			}
+			return err
+		}
+	}
+
+	// Deleting the journal commits the transaction:
+	// the copies are only left behind if cleaning up fails, and are never restored then.
+	if err := b.bucket.Delete(ctx, journalKey); err != nil {
+		err = fmt.Errorf("delete transaction journal: %w", err)
+		if rerr := b.rollbackTransaction(ctx, &journal); rerr != nil {
+			return fmt.Errorf("%w; rolling back failed, recover the transaction to retry: %v", err, rerr)
+		}
+		return err
+	}
+	if err := b.deleteTransaction(ctx, t.id); err != nil {
+		logging.V(5).Infof("error deleting files of transaction %v: %v", t.id, err)
+	}
+	return nil
+}
+
+// Rollback discards the staged checkpoints and releases the locks of the stacks.
+// Nothing has been written before Commit, so there's nothing to undo.
+func (t *Transaction) Rollback(ctx context.Context) {
+	if t.done {
+		return
+	}
+	t.done = true
+	t.b.unlockAll(ctx, t.refs)
+}
+
+// rollbackTransaction puts back the checkpoints replaced by a transaction
+// and deletes its files.
+// The stacks in the journal must be locked.
+func (b *localBackend) rollbackTransaction(ctx context.Context, journal *transactionJournal) error {
+	for _, s := range journal.Stacks {
+		if err := b.restoreTransactionCheckpoint(ctx, s); err != nil {
+			return fmt.Errorf("roll back stack %v: %w", s.Stack, err)
+		}
+	}
+	return b.deleteTransaction(ctx, journal.ID)
+}
+
+// restoreTransactionCheckpoint puts back the checkpoint of a stack from its copy.
+// Stacks whose checkpoint was never copied weren't replaced and are left as they are.
+func (b *localBackend) restoreTransactionCheckpoint(ctx context.Context, s transactionJournalStack) error {
+	byts, err := b.bucket.ReadAll(ctx, s.Previous)
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil
+		}
+		return fmt.Errorf("read previous checkpoint: %w", err)
+	}
+	if err := b.bucket.WriteAll(ctx, s.Checkpoint, byts, nil); err != nil {
+		return fmt.Errorf("restore checkpoint: %w", err)
+	}
+	b.versions.forget(s.Checkpoint)
+	if b.checksums {
+		if err := writeChecksum(ctx, b.bucket, s.Checkpoint, computeChecksum(byts)); err != nil {
+			return err
+		}
+	}
+
+	// The new checkpoint may have been saved with the other extension
+	// if compression was toggled in between.
+	other := strings.TrimSuffix(s.Checkpoint, ".gz")
+	if other == s.Checkpoint {
+		other += ".gz"
+	}
+	if exists, err := b.bucket.Exists(ctx, other); err == nil && exists {
+		backupTarget(ctx, b.bucket, other, false /* keepOriginal */)
+		b.versions.forget(other)
+	}
+	return nil
+}
+
+// deleteTransaction deletes all files of a transaction.
+func (b *localBackend) deleteTransaction(ctx context.Context, id string) error {
+	files, err := listAll(ctx, b.bucket, path.Join(transactionsDir(), id))
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(files))
+	for _, file := range files {
+		keys = append(keys, file.Key)
+	}
+	return deleteAll(ctx, b.bucket, keys, b.deleteConcurrency)
+}
+
+func (b *localBackend) RecoverTransactions(ctx context.Context) (_ []string, err error) {
+	ctx = withOperationID(ctx)
+	defer func() { err = operationError(ctx, err) }()
+
+	if err := b.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	files, err := listAll(ctx, b.bucket, transactionsDir())
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("list transactions: %w", err)
+	}
+	ids := make(map[string]bool)
+	journals := make(map[string]bool)
+	for _, file := range files {
+		rel := strings.TrimPrefix(file.Key, transactionsDir()+"/")
+		id, name, ok := strings.Cut(rel, "/")
+		if !ok {
+			continue
+		}
+		ids[id] = true
+		if name == transactionJournalName {
+			journals[id] = true
+		}
+	}
+
+	var recovered []string
+	for id := range ids {
+		if !journals[id] {
+			// The transaction was committed, but its copies weren't cleaned up.
+			if err := b.deleteTransaction(ctx, id); err != nil {
+				return recovered, fmt.Errorf("delete files of transaction %v: %w", id, err)
+			}
+			continue
+		}
+		if err := b.recoverTransaction(ctx, id); err != nil {
+			return recovered, fmt.Errorf("recover transaction %v: %w", id, err)
+		}
+		recovered = append(recovered, id)
+	}
+	sort.Strings(recovered)
+	return recovered, nil
+}
+
+// recoverTransaction rolls back a transaction whose commit didn't finish.
+func (b *localBackend) recoverTransaction(ctx context.Context, id string) error {
+	byts, err := b.bucket.ReadAll(ctx, path.Join(transactionsDir(), id, transactionJournalName))
+	if err != nil {
+		return fmt.Errorf("read journal: %w", err)
+	}
+	var journal transactionJournal
+	if err := json.Unmarshal(byts, &journal); err != nil {
+		return fmt.Errorf("parse journal: %w", err)
+	}
+	if journal.ID != id {
+		return fmt.Errorf("journal has ID %q", journal.ID)
+	}
+
+	refs := make([]*localBackendReference, len(journal.Stacks))
+	for i, s := range journal.Stacks {
+		if refs[i], err = b.parseStackReference(s.Stack); err != nil {
+			return err
+		}
+	}
+	// A transaction that's still being committed holds these locks.
+	if err := b.lockAll(ctx, refs); err != nil {
+		return err
+	}
+	defer b.unlockAll(ctx, refs)
+
+	return b.rollbackTransaction(ctx, &journal)
+}
@@ -0,0 +1,197 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+)
+
+// newTransactionBackend creates a backend with the stacks "foo" and "bar".
+func newTransactionBackend(t *testing.T) (*localBackend, *localBackendReference, *localBackendReference) {
+	t.Helper()
+
+	b, foo := newSnapshotBackend(t, nil)
+	bar, err := b.parseStackReference("bar")
+	require.NoError(t, err)
+	_, err = b.CreateStack(context.Background(), bar, "", nil)
+	require.NoError(t, err)
+	return b, foo, bar
+}
+
+func checkpointResources(t *testing.T, b *localBackend, ref *localBackendReference) int {
+	t.Helper()
+
+	chk, err := b.getCheckpoint(context.Background(), ref)
+	require.NoError(t, err)
+	if chk.Latest == nil {
+		return 0
+	}
+	return len(chk.Latest.Resources)
+}
+
+func TestTransaction_commit(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, foo, bar := newTransactionBackend(t)
+
+	tx, err := b.BeginTransaction(ctx, foo, bar, foo)
+	require.NoError(t, err)
+	require.NoError(t, tx.Stage(ctx, foo, newTestCheckpoint(t, 2)))
+	require.NoError(t, tx.Stage(ctx, bar, newTestCheckpoint(t, 3)))
+
+	// Nothing is written before the commit.
+	assert.Equal(t, 0, checkpointResources(t, b, foo))
+
+	require.NoError(t, tx.Commit(ctx))
+	assert.Equal(t, 2, checkpointResources(t, b, foo))
+	assert.Equal(t, 3, checkpointResources(t, b, bar))
+	assert.Empty(t, listKeys(t, b.bucket, transactionsDir()))
+
+	// The locks were released.
+	require.NoError(t, b.Lock(ctx, foo))
+	b.Unlock(ctx, foo)
+
+	assert.ErrorIs(t, tx.Commit(ctx), errTransactionDone)
+}
+
+func TestTransaction_rollback(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, foo, bar := newTransactionBackend(t)
+
+	tx, err := b.BeginTransaction(ctx, foo, bar)
+	require.NoError(t, err)
+
+	// Other updates can't touch the stacks in the meantime.
+	assert.Error(t, b.Lock(ctx, bar))
+
+	require.NoError(t, tx.Stage(ctx, foo, newTestCheckpoint(t, 2)))
+	tx.Rollback(ctx)
+	assert.Equal(t, 0, checkpointResources(t, b, foo))
+	require.NoError(t, b.Lock(ctx, bar))
+	b.Unlock(ctx, bar)
+
+	assert.ErrorIs(t, tx.Stage(ctx, foo, newTestCheckpoint(t, 2)), errTransactionDone)
+}
+
+func TestBeginTransaction_errors(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, foo, bar := newTransactionBackend(t)
+	missing, err := b.parseStackReference("missing")
+	require.NoError(t, err)
+
+	_, err = b.BeginTransaction(ctx, foo, missing)
+	assert.ErrorContains(t, err, "stack missing does not exist")
+	// No lock was left behind.
+	require.NoError(t, b.Lock(ctx, foo))
+	b.Unlock(ctx, foo)
+
+	// A stack whose lock is taken fails the transaction,
+	// and the locks acquired before it are released.
+	require.NoError(t, b.Lock(ctx, foo))
+	_, err = b.BeginTransaction(ctx, foo, bar)
+	assert.Error(t, err)
+	b.Unlock(ctx, foo)
+	require.NoError(t, b.Lock(ctx, bar))
+	b.Unlock(ctx, bar)
+
+	tx, err := b.BeginTransaction(ctx, foo)
+	require.NoError(t, err)
+	defer tx.Rollback(ctx)
+	assert.ErrorContains(t, tx.Stage(ctx, bar, newTestCheckpoint(t, 1)), "stack bar is not part of transaction")
+}
+
+func TestTransaction_commitFailure(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, foo, bar := newTransactionBackend(t)
+
+	tx, err := b.BeginTransaction(ctx, foo, bar)
+	require.NoError(t, err)
+	require.NoError(t, tx.Stage(ctx, foo, newTestCheckpoint(t, 2)))
+	require.NoError(t, tx.Stage(ctx, bar, newTestCheckpoint(t, 3)))
+
+	// Stacks are committed in order, so bar is written before foo fails.
+	b.checkpointValidator = func(ctx context.Context, stack tokens.QName, chk *apitype.CheckpointV3) error {
+		if stack == foo.FullyQualifiedName() {
+			return errors.New("great sadness")
+		}
+		return nil
+	}
+
+	err = tx.Commit(ctx)
+	assert.ErrorContains(t, err, "commit stack foo")
+	assert.ErrorContains(t, err, "great sadness")
+
+	assert.Equal(t, 0, checkpointResources(t, b, foo))
+	assert.Equal(t, 0, checkpointResources(t, b, bar))
+	assert.Empty(t, listKeys(t, b.bucket, transactionsDir()))
+	require.NoError(t, b.Lock(ctx, foo))
+	b.Unlock(ctx, foo)
+}
+
+func TestRecoverTransactions(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, foo, bar := newTransactionBackend(t)
+
+	// Simulate a commit that died after replacing the checkpoint of bar, but not that of foo.
+	journal := transactionJournal{ID: "crashed"}
+	for i, ref := range []*localBackendReference{bar, foo} {
+		chkpath := b.stackPath(ctx, ref)
+		journal.Stacks = append(journal.Stacks, transactionJournalStack{
+			Stack:      string(ref.FullyQualifiedName()),
+			Checkpoint: chkpath,
+			Previous:   path.Join(transactionsDir(), "crashed", fmt.Sprintf("%d-%s", i, path.Base(chkpath))),
+		})
+	}
+	byts, err := json.Marshal(journal)
+	require.NoError(t, err)
+	require.NoError(t, b.bucket.WriteAll(ctx, path.Join(transactionsDir(), "crashed", transactionJournalName), byts, nil))
+	require.NoError(t, b.bucket.Copy(ctx, journal.Stacks[0].Previous, journal.Stacks[0].Checkpoint, nil))
+	_, _, err = b.saveCheckpoint(ctx, bar, newTestCheckpoint(t, 3))
+	require.NoError(t, err)
+
+	// A committed transaction whose copies weren't cleaned up.
+	require.NoError(t, b.bucket.WriteAll(ctx, path.Join(transactionsDir(), "committed", "0-foo.json"), []byte("{}"), nil))
+
+	recovered, err := b.RecoverTransactions(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"crashed"}, recovered)
+	assert.Equal(t, 0, checkpointResources(t, b, bar))
+	assert.Equal(t, 0, checkpointResources(t, b, foo))
+	assert.Empty(t, listKeys(t, b.bucket, transactionsDir()))
+
+	recovered, err = b.RecoverTransactions(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, recovered)
+}
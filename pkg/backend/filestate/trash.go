@@ -0,0 +1,297 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// TrashID identifies a removal of a stack that was moved to the trash.
+//
+// Like snapshot IDs, IDs are UTC timestamps of when the stack was removed,
+// so they sort in the order the stack was removed.
+type TrashID string
+
+// TrashedStack is a stack in the trash, as listed by [Backend.ListTrash].
+type TrashedStack struct {
+	// Stack is the fully qualified name of the stack.
+	Stack string `json:"stack"`
+
+	// ID identifies the removal of the stack.
+	ID TrashID `json:"id"`
+
+	// Removed is when the stack was removed.
+	Removed time.Time `json:"removed"`
+}
+
+// trashDir is the directory that removed stacks are moved to with soft deletes.
+//
+// Each removal is kept in a directory named "$stack-$id",
+// where $stack is the fully qualified name of the stack,
+// holding the files of the stack at their paths relative to the bookkeeping directory,
+// e.g. .pulumi/trash/organization/app/dev-$id/stacks/app/dev.json.
+// This keeps them in place for any layout or key template.
+func trashDir() string {
+	return path.Join(workspace.BookkeepingDir, "trash")
+}
+
+// trashEntry is a removal of a stack in the trash.
+type trashEntry struct {
+	TrashedStack
+
+	// keys are the keys of the files of the removal.
+	keys []string
+}
+
+// dir returns the directory that holds the files of the removal.
+func (e *trashEntry) dir() string {
+	return path.Join(trashDir(), e.Stack+"-"+string(e.ID))
+}
+
+// parseTrashKey returns the stack, removal, and path relative to the bookkeeping directory
+// of a file in the trash directory, or false if it isn't in the directory of a removal.
+func parseTrashKey(key string) (stack string, id TrashID, rel string, ok bool) {
+	segs := strings.Split(strings.TrimPrefix(key, trashDir()+"/"), "/")
+	// Removals are named after fully qualified stack names,
+	// which have at most three components.
+	for i := 0; i < len(segs)-1 && i < 3; i++ {
+		seg := segs[i]
+		cut := len(seg) - len(snapshotTimeFormat) - 1
+		if cut < 1 || seg[cut] != '-' {
+			continue
+		}
+		if _, err := time.Parse(snapshotTimeFormat, seg[cut+1:]); err != nil {
+			continue
+		}
+		stack := path.Join(append(segs[:i:i], seg[:cut])...)
+		return stack, TrashID(seg[cut+1:]), path.Join(segs[i+1:]...), true
+	}
+	return "", "", "", false
+}
+
+// listTrash returns the removals in the trash, oldest first.
+func (b *localBackend) listTrash(ctx context.Context) ([]*trashEntry, error) {
+	files, err := listAll(ctx, b.bucket, trashDir()+"/")
+	if err != nil {
+		return nil, fmt.Errorf("list trash: %w", err)
+	}
+
+	byDir := make(map[string]*trashEntry)
+	var entries []*trashEntry
+	for _, f := range files {
+		stack, id, _, ok := parseTrashKey(f.Key)
+		if !ok {
+			continue
+		}
+		removed, _ := time.Parse(snapshotTimeFormat, string(id))
+		e := &trashEntry{TrashedStack: TrashedStack{Stack: stack, ID: id, Removed: removed}}
+		if prior, ok := byDir[e.dir()]; ok {
+			e = prior
+		} else {
+			byDir[e.dir()] = e
+			entries = append(entries, e)
+		}
+		e.keys = append(e.keys, f.Key)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if !entries[i].Removed.Equal(entries[j].Removed) {
+			return entries[i].Removed.Before(entries[j].Removed)
+		}
+		return entries[i].Stack < entries[j].Stack
+	})
+	return entries, nil
+}
+
+func (b *localBackend) ListTrash(ctx context.Context) ([]TrashedStack, error) {
+	entries, err := b.listTrash(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stacks := make([]TrashedStack, len(entries))
+	for i, e := range entries {
+		stacks[i] = e.TrashedStack
+	}
+	return stacks, nil
+}
+
+// trashStack moves the files of the given stack to the trash,
+// and purges removals that the retention policy no longer keeps.
+func (b *localBackend) trashStack(ctx context.Context, ref *localBackendReference) error {
+	file := b.stackPath(ctx, ref)
+	keys, err := b.stackFileKeys(ctx, ref, file)
+	if err != nil {
+		return err
+	}
+
+	now := b.clock.Now().UTC()
+	entry := trashEntry{TrashedStack: TrashedStack{
+		Stack:   string(ref.FullyQualifiedName()),
+		ID:      TrashID(now.Format(snapshotTimeFormat)),
+		Removed: now,
+	}}
+
+	// Copy everything before deleting anything
+	// so that the stack is left as it was if the move fails.
+	moved := make([]string, 0, len(keys))
+	for _, key := range keys {
+		key = filepath.ToSlash(key)
+		rel := strings.TrimPrefix(key, workspace.BookkeepingDir+"/")
+		if err := b.bucket.Copy(ctx, path.Join(entry.dir(), rel), key, nil); err != nil {
+			if gcerrors.Code(err) == gcerrors.NotFound {
+				// e.g. stacks without tags.
+				continue
+			}
+			return fmt.Errorf("move %v to the trash: %w", key, err)
+		}
+		moved = append(moved, key)
+	}
+	b.versions.forget(file)
+	if err := deleteAll(ctx, b.bucket, moved, b.deleteConcurrency); err != nil {
+		return err
+	}
+
+	// The stack was removed successfully,
+	// so don't fail if we can't purge older removals.
+	if err := b.purgeTrash(ctx, now); err != nil {
+		b.sink(ctx).Warningf(diag.Message("", "Could not purge old stacks from the trash: %v"), err)
+	}
+	return nil
+}
+
+// purgeTrash permanently deletes the removals
+// that are older than the retention period of the trash.
+func (b *localBackend) purgeTrash(ctx context.Context, now time.Time) error {
+	if b.trashRetention == 0 {
+		return nil
+	}
+	entries, err := b.listTrash(ctx)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for _, e := range entries {
+		if now.Sub(e.Removed) > b.trashRetention {
+			keys = append(keys, e.keys...)
+		}
+	}
+	return deleteAll(ctx, b.bucket, keys, b.deleteConcurrency)
+}
+
+func (b *localBackend) RestoreStack(
+	ctx context.Context, stackRef backend.StackReference, id TrashID,
+) (err error) {
+	ctx = withOperationID(ctx)
+	defer func() { err = operationError(ctx, err) }()
+
+	ref, err := b.getReference(stackRef)
+	if err != nil {
+		return err
+	}
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+
+	if err := b.Lock(ctx, ref); err != nil {
+		return err
+	}
+	defer b.Unlock(ctx, ref)
+
+	entries, err := b.listTrash(ctx)
+	if err != nil {
+		return err
+	}
+	var entry *trashEntry
+	for _, e := range entries {
+		// entries is sorted oldest first, so the last match is the latest removal.
+		if e.Stack == string(ref.FullyQualifiedName()) && (id == "" || e.ID == id) {
+			entry = e
+		}
+	}
+	if entry == nil {
+		if id != "" {
+			return fmt.Errorf("removal %v of stack %v is not in the trash", id, ref)
+		}
+		return fmt.Errorf("stack %v is not in the trash", ref)
+	}
+
+	exists, err := b.bucket.Exists(ctx, b.stackPath(ctx, ref))
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("a stack named %s already exists", ref)
+	}
+
+	// Copy the checkpoint back last so that the stack only reappears
+	// once its other files are in place.
+	sort.SliceStable(entry.keys, func(i, j int) bool {
+		return !isTrashedCheckpoint(entry.keys[i]) && isTrashedCheckpoint(entry.keys[j])
+	})
+	for _, key := range entry.keys {
+		_, _, rel, _ := parseTrashKey(key)
+		dst := path.Join(workspace.BookkeepingDir, rel)
+		if err := b.bucket.Copy(ctx, dst, key, nil); err != nil {
+			return fmt.Errorf("restore %v from the trash: %w", dst, err)
+		}
+	}
+	if err := deleteAll(ctx, b.bucket, entry.keys, b.deleteConcurrency); err != nil {
+		return fmt.Errorf("remove stack %v from the trash: %w", ref, err)
+	}
+
+	b.sink(ctx).Infoerrf(diag.Message("", "Restored stack %v removed at %v"),
+		ref, entry.Removed.Format(time.RFC3339))
+	return nil
+}
+
+// isTrashedCheckpoint reports whether the given file in the trash is the checkpoint of a stack.
+func isTrashedCheckpoint(key string) bool {
+	_, _, rel, _ := parseTrashKey(key)
+	if !strings.HasPrefix(rel, workspace.StackDir+"/") {
+		return false
+	}
+	_, ok := trimCheckpointExt(path.Base(rel))
+	return ok
+}
+
+func (b *localBackend) EmptyTrash(ctx context.Context) (err error) {
+	ctx = withOperationID(ctx)
+	defer func() { err = operationError(ctx, err) }()
+
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+	files, err := listAll(ctx, b.bucket, trashDir()+"/")
+	if err != nil {
+		return fmt.Errorf("list trash: %w", err)
+	}
+	keys := make([]string, len(files))
+	for i, f := range files {
+		keys[i] = f.Key
+	}
+	return deleteAll(ctx, b.bucket, keys, b.deleteConcurrency)
+}
@@ -0,0 +1,196 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+func TestTrash(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	clk := newFakeClock()
+	b := newTestBackend(t, t.TempDir(), &localBackendOptions{Clock: clk, SoftDelete: true})
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	stack, err := b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+	_, _, err = b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 2))
+	require.NoError(t, err)
+	require.NoError(t, b.SetStackTags(ctx, ref, map[apitype.StackTagName]string{"team": "infra"}))
+	require.NoError(t, b.addToHistory(ctx, ref, backend.UpdateInfo{Kind: apitype.UpdateUpdate}))
+
+	_, err = b.RemoveStack(ctx, stack, true /* force */)
+	require.NoError(t, err)
+	removed, err := b.GetStack(ctx, ref)
+	require.NoError(t, err)
+	assert.Nil(t, removed)
+	assert.Empty(t, listKeys(t, b.bucket, ".pulumi/history/proj/foo"))
+
+	trash, err := b.ListTrash(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []TrashedStack{{
+		Stack:   "organization/proj/foo",
+		ID:      "20230101T000000.000000000Z",
+		Removed: clk.Now(),
+	}}, trash)
+
+	require.NoError(t, b.RestoreStack(ctx, ref, ""))
+	chk, err := b.getCheckpoint(ctx, ref)
+	require.NoError(t, err)
+	assert.Len(t, chk.Latest.Resources, 2)
+	tags, err := b.GetStackTags(ctx, ref)
+	require.NoError(t, err)
+	assert.Equal(t, "infra", tags["team"])
+	updates, err := b.ListUpdates(ctx, ref, nil /* opts */)
+	require.NoError(t, err)
+	assert.Len(t, updates, 1)
+
+	trash, err = b.ListTrash(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, trash)
+	err = b.RestoreStack(ctx, ref, "")
+	assert.ErrorContains(t, err, "stack foo is not in the trash")
+}
+
+func TestTrash_restoreExisting(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	clk := newFakeClock()
+	b := newTestBackend(t, t.TempDir(), &localBackendOptions{Clock: clk, SoftDelete: true})
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	for i := 1; i <= 2; i++ {
+		stack, err := b.CreateStack(ctx, ref, "", nil)
+		require.NoError(t, err)
+		_, _, err = b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, i))
+		require.NoError(t, err)
+		_, err = b.RemoveStack(ctx, stack, true /* force */)
+		require.NoError(t, err)
+		clk.Advance(time.Hour)
+	}
+	trash, err := b.ListTrash(ctx)
+	require.NoError(t, err)
+	require.Len(t, trash, 2)
+
+	// A stack can't be restored over an existing one.
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+	err = b.RestoreStack(ctx, ref, trash[0].ID)
+	assert.ErrorContains(t, err, "a stack named foo already exists")
+	err = b.RestoreStack(ctx, ref, "20990101T000000.000000000Z")
+	assert.ErrorContains(t, err, "is not in the trash")
+
+	stack, err := b.GetStack(ctx, ref)
+	require.NoError(t, err)
+	_, err = b.RemoveStack(ctx, stack, true /* force */)
+	require.NoError(t, err)
+
+	// Removals can be restored by ID.
+	require.NoError(t, b.RestoreStack(ctx, ref, trash[0].ID))
+	chk, err := b.getCheckpoint(ctx, ref)
+	require.NoError(t, err)
+	assert.Len(t, chk.Latest.Resources, 1)
+
+	require.NoError(t, b.EmptyTrash(ctx))
+	trash, err = b.ListTrash(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, trash)
+	assert.Empty(t, listKeys(t, b.bucket, ".pulumi/trash"))
+}
+
+func TestTrash_retention(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	clk := newFakeClock()
+	b := newTestBackend(t, t.TempDir(), &localBackendOptions{
+		Getenv:     mapGetenv(map[string]string{PulumiFilestateTrashRetentionDaysEnvVar: "7"}),
+		Clock:      clk,
+		SoftDelete: true,
+	})
+	assert.Equal(t, 7*24*time.Hour, b.trashRetention)
+
+	for _, name := range []string{"old", "new"} {
+		ref, err := b.parseStackReference(name)
+		require.NoError(t, err)
+		stack, err := b.CreateStack(ctx, ref, "", nil)
+		require.NoError(t, err)
+		_, err = b.RemoveStack(ctx, stack, false /* force */)
+		require.NoError(t, err)
+		clk.Advance(8 * 24 * time.Hour)
+	}
+
+	// Removing "new" purged "old".
+	trash, err := b.ListTrash(ctx)
+	require.NoError(t, err)
+	require.Len(t, trash, 1)
+	assert.Equal(t, "organization/proj/new", trash[0].Stack)
+
+	_, err = newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"}, &localBackendOptions{Getenv: mapGetenv(map[string]string{
+			PulumiFilestateTrashRetentionDaysEnvVar: "0",
+		})})
+	assert.ErrorContains(t, err, "is not a positive number of days")
+}
+
+func TestTrash_disabled(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, nil)
+	stack, err := b.GetStack(ctx, ref)
+	require.NoError(t, err)
+	_, err = b.RemoveStack(ctx, stack, true /* force */)
+	require.NoError(t, err)
+
+	trash, err := b.ListTrash(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, trash)
+}
+
+func TestParseTrashKey(t *testing.T) {
+	t.Parallel()
+
+	stack, id, rel, ok := parseTrashKey(
+		".pulumi/trash/organization/proj/dev-x-20230101T000000.000000000Z/stacks/proj/dev-x.json")
+	assert.True(t, ok)
+	assert.Equal(t, "organization/proj/dev-x", stack)
+	assert.Equal(t, TrashID("20230101T000000.000000000Z"), id)
+	assert.Equal(t, "stacks/proj/dev-x.json", rel)
+
+	stack, _, rel, ok = parseTrashKey(".pulumi/trash/dev-20230101T000000.000000000Z/stacks/dev.json")
+	assert.True(t, ok)
+	assert.Equal(t, "dev", stack)
+	assert.Equal(t, "stacks/dev.json", rel)
+
+	_, _, _, ok = parseTrashKey(".pulumi/trash/organization/proj/dev/stacks/proj/dev.json")
+	assert.False(t, ok)
+}
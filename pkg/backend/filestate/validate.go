@@ -0,0 +1,87 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+)
+
+// CheckpointValidator inspects the checkpoint about to be written for a stack.
+// If it returns an error, the checkpoint is not written
+// and the state of the stack is left as it was.
+//
+// chk.Latest is the deployment of the stack, with its resources.
+// It's nil for stacks that have never been updated.
+// The checkpoint must not be modified.
+//
+// Validators enforce policies at the state store as a last line of defense.
+// They don't replace policy packs, which run before resources are changed:
+// a rejected checkpoint may describe resources that already exist.
+type CheckpointValidator func(ctx context.Context, stack tokens.QName, chk *apitype.CheckpointV3) error
+
+// validateCheckpoint runs the checkpoint validator, if any,
+// on the given checkpoint of a stack.
+func (b *localBackend) validateCheckpoint(
+	ctx context.Context, ref *localBackendReference, checkpoint *apitype.VersionedCheckpoint,
+) error {
+	if b.checkpointValidator == nil {
+		return nil
+	}
+
+	// The checkpoint may have any version, so decode it like a checkpoint file.
+	byts, err := json.Marshal(checkpoint)
+	if err != nil {
+		return fmt.Errorf("validate checkpoint of stack %v: %w", ref, err)
+	}
+	chk, err := decodeCheckpoint(byts)
+	if err != nil {
+		return fmt.Errorf("validate checkpoint of stack %v: %w", ref, err)
+	}
+	return b.runCheckpointValidator(ctx, ref, chk)
+}
+
+// validateCheckpointFile runs the checkpoint validator, if any,
+// on the contents of a checkpoint file as they're stored.
+func (b *localBackend) validateCheckpointFile(
+	ctx context.Context, ref *localBackendReference, key string, byts []byte,
+) error {
+	if b.checkpointValidator == nil {
+		return nil
+	}
+
+	byts, err := b.plainCheckpoint(ctx, key, byts)
+	if err != nil {
+		return fmt.Errorf("validate checkpoint of stack %v: %w", ref, err)
+	}
+	chk, err := decodeCheckpoint(byts)
+	if err != nil {
+		return fmt.Errorf("validate checkpoint of stack %v: %w", ref, err)
+	}
+	return b.runCheckpointValidator(ctx, ref, chk)
+}
+
+func (b *localBackend) runCheckpointValidator(
+	ctx context.Context, ref *localBackendReference, chk *apitype.CheckpointV3,
+) error {
+	if err := b.checkpointValidator(ctx, ref.FullyQualifiedName(), chk); err != nil {
+		return fmt.Errorf("checkpoint of stack %v was rejected: %w", ref, err)
+	}
+	return nil
+}
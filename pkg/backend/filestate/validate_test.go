@@ -0,0 +1,90 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+)
+
+// errTooManyResources is returned by maxResourcesValidator.
+var errTooManyResources = errors.New("too many resources")
+
+// maxResourcesValidator rejects checkpoints with more than max resources.
+func maxResourcesValidator(max int) CheckpointValidator {
+	return func(_ context.Context, _ tokens.QName, chk *apitype.CheckpointV3) error {
+		if chk.Latest != nil && len(chk.Latest.Resources) > max {
+			return errTooManyResources
+		}
+		return nil
+	}
+}
+
+func TestCheckpointValidator(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, ref := newSnapshotBackend(t, nil)
+
+	var stacks []tokens.QName
+	validate := maxResourcesValidator(2)
+	b.checkpointValidator = func(ctx context.Context, stack tokens.QName, chk *apitype.CheckpointV3) error {
+		stacks = append(stacks, stack)
+		return validate(ctx, stack, chk)
+	}
+
+	_, _, err := b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 2))
+	require.NoError(t, err)
+	assert.Equal(t, []tokens.QName{"organization/proj/foo"}, stacks)
+
+	// Rejected checkpoints aren't written.
+	_, _, err = b.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 3))
+	assert.ErrorIs(t, err, errTooManyResources)
+	assert.ErrorContains(t, err, "checkpoint of stack foo was rejected")
+	chk, err := b.getCheckpoint(ctx, ref)
+	require.NoError(t, err)
+	assert.Len(t, chk.Latest.Resources, 2)
+}
+
+func TestCheckpointValidator_importProject(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	src, ref := newSnapshotBackend(t, nil)
+	_, _, err := src.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 3))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, src.ExportProject(ctx, "proj", &buf))
+
+	dst, _ := newSnapshotBackend(t, nil)
+	_, _, err = dst.saveCheckpoint(ctx, ref, newTestCheckpoint(t, 1))
+	require.NoError(t, err)
+	dst.checkpointValidator = maxResourcesValidator(2)
+
+	_, err = dst.ImportProject(ctx, bytes.NewReader(buf.Bytes()),
+		&ImportProjectOptions{OnConflict: ProjectImportOverwrite})
+	assert.ErrorIs(t, err, errTooManyResources)
+	chk, err := dst.getCheckpoint(ctx, ref)
+	require.NoError(t, err)
+	assert.Len(t, chk.Latest.Resources, 1)
+}
@@ -0,0 +1,337 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/config"
+)
+
+// VerifySeverity is the severity of a problem found by [Backend.Verify].
+type VerifySeverity string
+
+const (
+	// VerifyError indicates a problem that prevents
+	// a stack or the store from being used.
+	VerifyError VerifySeverity = "error"
+
+	// VerifyWarning indicates a problem that does not prevent
+	// using the store, but likely needs attention.
+	VerifyWarning VerifySeverity = "warning"
+)
+
+// VerifyProblem is a single problem found by [Backend.Verify].
+type VerifyProblem struct {
+	// Severity is the severity of the problem.
+	Severity VerifySeverity `json:"severity"`
+
+	// Key is the key of the file in the bucket with the problem.
+	Key string `json:"key"`
+
+	// Message describes the problem.
+	Message string `json:"message"`
+
+	// Remediation suggests how to fix the problem.
+	Remediation string `json:"remediation"`
+}
+
+// VerifyReport is the result of [Backend.Verify].
+type VerifyReport struct {
+	// Version is the version of the store as reported by its metadata file.
+	Version int `json:"version"`
+
+	// Stacks is the number of stack checkpoints that were checked.
+	Stacks int `json:"stacks"`
+
+	// Problems lists all problems found in the store,
+	// ordered by the key of the file with the problem.
+	Problems []VerifyProblem `json:"problems,omitempty"`
+}
+
+// HasErrors reports whether the report contains any problems
+// with the severity [VerifyError].
+func (r *VerifyReport) HasErrors() bool {
+	for _, p := range r.Problems {
+		if p.Severity == VerifyError {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *VerifyReport) add(sev VerifySeverity, key, remediation, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, VerifyProblem{
+		Severity:    sev,
+		Key:         key,
+		Message:     fmt.Sprintf(format, args...),
+		Remediation: remediation,
+	})
+}
+
+func (b *localBackend) Verify(ctx context.Context, events chan<- ProgressEvent) (_ *VerifyReport, err error) {
+	ctx = withOperationID(ctx)
+	defer func() { err = operationError(ctx, err) }()
+
+	return verifyStore(ctx, b.bucket, b.crypter, events)
+}
+
+// verifyStore scans the store in the given bucket for problems.
+//
+// This only reads from the bucket.
+// It does not take any locks so that it may run alongside other operations,
+// which means that it may report problems for files that are being written to.
+//
+// Checkpoints are decrypted with the given crypter, which is nil for unencrypted stores.
+// If events is non-nil, a [ProgressVerify] event is sent to it for every checkpoint,
+// and it is closed when verification finishes.
+func verifyStore(
+	ctx context.Context, b Bucket, crypter config.Crypter, events chan<- ProgressEvent,
+) (*VerifyReport, error) {
+	progress := newProgressReporter(ctx, ProgressVerify, events)
+	defer progress.close()
+
+	var report VerifyReport
+	template := defaultKeys
+
+	metaBody, format, err := readPulumiMetaFile(ctx, b)
+	if err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+		return nil, err
+	}
+	// A missing metadata file is expected for legacy stores.
+	if err == nil {
+		metaKey := filepath.ToSlash(format.path())
+		meta, err := parsePulumiMeta(format, metaBody)
+		switch {
+		case err != nil:
+			report.add(VerifyError, metaKey,
+				"Restore the file from a backup, or rewrite it with the version of the store.",
+				"%v", err)
+		case meta.Version > maxSupportedVersion:
+			report.Version = meta.Version
+			report.add(VerifyError, metaKey,
+				"Use a newer version of the Pulumi CLI.",
+				"store version %d is not supported by this version of the Pulumi CLI", meta.Version)
+		default:
+			report.Version = meta.Version
+			k, err := parseKeyTemplate(meta.KeyTemplate)
+			if err != nil {
+				report.add(VerifyError, metaKey,
+					"Restore the file from a backup.",
+					"%v", err)
+				break
+			}
+			template = k
+		}
+	}
+
+	stacksDir := filepath.ToSlash(StacksDir) + "/"
+	stackFiles, err := listAll(ctx, b, stacksDir)
+	if err != nil {
+		return nil, fmt.Errorf("list stacks: %w", err)
+	}
+
+	keys := make(map[string]struct{}, len(stackFiles))
+	for _, file := range stackFiles {
+		keys[file.Key] = struct{}{}
+	}
+
+	// stacks holds the stack names relative to the stacks directory,
+	// e.g. "dev" for legacy stacks or "myproj/dev" for project-scoped stacks,
+	// for all checkpoints in the store.
+	stacks := make(map[string]struct{})
+	for _, file := range stackFiles {
+		key := file.Key
+		switch {
+		case strings.Contains(objectName(file), tempFileInfix):
+			report.add(VerifyWarning, key,
+				"Delete the file if no update is in progress.",
+				"temporary file left behind by an interrupted write (last modified %v)", file.ModTime)
+			continue
+		case strings.HasSuffix(key, ".bak"):
+			continue
+		case strings.HasSuffix(key, stackTagsSuffix):
+			base := strings.TrimSuffix(key, stackTagsSuffix) + ".json"
+			_, plain := keys[base]
+			_, gzipped := keys[base+encoding.GZIPExt]
+			if !plain && !gzipped {
+				report.add(VerifyWarning, key,
+					"Delete the file.",
+					"stack tags file without a checkpoint")
+			}
+			continue
+		case strings.HasSuffix(key, stackMetaSuffix):
+			base := strings.TrimSuffix(key, stackMetaSuffix) + ".json"
+			_, plain := keys[base]
+			_, gzipped := keys[base+encoding.GZIPExt]
+			if !plain && !gzipped {
+				report.add(VerifyWarning, key,
+					"Delete the file.",
+					"stack metadata file without a checkpoint")
+			}
+			continue
+		case strings.HasSuffix(key, checksumExt):
+			if _, ok := keys[strings.TrimSuffix(key, checksumExt)]; !ok {
+				report.add(VerifyWarning, key,
+					"Delete the file.",
+					"checksum file without a checkpoint")
+			}
+			continue
+		}
+
+		name, ok := checkpointStackName(strings.TrimPrefix(key, stacksDir), template)
+		if !ok {
+			continue
+		}
+		stacks[name] = struct{}{}
+		report.Stacks++
+
+		projectScoped := strings.Contains(name, "/")
+		switch {
+		case report.Version == 0 && projectScoped:
+			report.add(VerifyWarning, key,
+				"Run 'pulumi state upgrade' to upgrade the store.",
+				"project-scoped stack %q is not visible in a store with the legacy layout", name)
+		case report.Version > 0 && !projectScoped:
+			report.add(VerifyWarning, key,
+				"Run 'pulumi state upgrade' to migrate the stack to the project-scoped layout.",
+				"legacy stack %q is not visible in a store with the project-scoped layout", name)
+		}
+
+		if err := verifyCheckpointFile(ctx, b, crypter, key); err != nil {
+			var problem *checkpointProblem
+			if !errors.As(err, &problem) {
+				return nil, err
+			}
+			report.add(VerifyError, key,
+				"Restore the checkpoint from its .bak file or from the backups directory.",
+				"%v", problem.err)
+		}
+		progress.report(name, key, file.Size)
+	}
+
+	historiesDir := filepath.ToSlash(HistoriesDir) + "/"
+	historyFiles, err := listAll(ctx, b, historiesDir)
+	if err != nil {
+		return nil, fmt.Errorf("list histories: %w", err)
+	}
+
+	// Report each orphaned history directory only once.
+	orphans := make(map[string]struct{})
+	for _, file := range historyFiles {
+		dir := historyFileDir(file.Key)
+		name := strings.TrimPrefix(dir, historiesDir)
+		if _, ok := stacks[name]; ok {
+			continue
+		}
+		if _, ok := orphans[dir]; ok {
+			continue
+		}
+		orphans[dir] = struct{}{}
+		report.add(VerifyWarning, dir+"/",
+			"Delete the directory if the stack was removed intentionally.",
+			"history for stack %q which does not exist", name)
+	}
+
+	sort.SliceStable(report.Problems, func(i, j int) bool {
+		return report.Problems[i].Key < report.Problems[j].Key
+	})
+	return &report, nil
+}
+
+// checkpointStackName reports the name of the stack
+// for the checkpoint file at the given path relative to the stacks directory,
+// e.g. "dev" for "dev.json" or "myproj/dev" for "myproj/dev.json.gz".
+// Deeper paths are only of checkpoint files if they follow the key template of the store.
+// It returns false if the path is not of a checkpoint file.
+func checkpointStackName(rel string, keys *keyTemplate) (string, bool) {
+	name := strings.TrimSuffix(rel, encoding.GZIPExt)
+	ext := path.Ext(name)
+	if _, has := encoding.Marshalers[ext]; !has {
+		return "", false
+	}
+	name = strings.TrimSuffix(name, ext)
+	if strings.Count(name, "/") > 1 {
+		if _, _, ok := keys.parse(name); !ok {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+// checkpointProblem is returned by verifyCheckpointFile
+// if the checkpoint is unusable.
+// All other errors are failures to read from the bucket.
+type checkpointProblem struct{ err error }
+
+func (p *checkpointProblem) Error() string { return p.err.Error() }
+
+// verifyCheckpointFile verifies that the checkpoint at the given key
+// matches its checksum, if any, and can be decrypted and decoded.
+func verifyCheckpointFile(ctx context.Context, b Bucket, crypter config.Crypter, key string) error {
+	byts, err := b.ReadAll(ctx, key)
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			// Deleted since it was listed.
+			return nil
+		}
+		return fmt.Errorf("read %q: %w", key, err)
+	}
+	if err := verifyChecksum(ctx, b, key, byts); err != nil {
+		if errors.Is(err, ErrChecksumMismatch) {
+			return &checkpointProblem{err}
+		}
+		return err
+	}
+	byts, err = unsealCheckpoint(ctx, crypter, key, byts)
+	if err != nil {
+		return &checkpointProblem{err}
+	}
+	if _, err := decodeCheckpoint(byts); err != nil {
+		return &checkpointProblem{fmt.Errorf("checkpoint could not be parsed: %w", err)}
+	}
+	return nil
+}
+
+// listAll returns all files in the bucket with the given prefix,
+// including those in nested directories.
+func listAll(ctx context.Context, b Bucket, prefix string) ([]*blob.ListObject, error) {
+	iter := b.List(&blob.ListOptions{Prefix: prefix})
+
+	var files []*blob.ListObject
+	for {
+		file, err := nextObject(ctx, b, iter)
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !file.IsDir {
+			files = append(files, file)
+		}
+	}
+}
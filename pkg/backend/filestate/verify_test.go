@@ -0,0 +1,188 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob/memblob"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+func TestVerify(t *testing.T) {
+	t.Parallel()
+
+	b := memblob.OpenBucket(nil)
+	writeFiles(t, b, map[string]string{
+		".pulumi/meta.yaml":                             "version: 1",
+		".pulumi/stacks/proj/good.json":                 legacyCheckpoint,
+		".pulumi/stacks/proj/good.json.sha256":          computeChecksum([]byte(legacyCheckpoint)),
+		".pulumi/stacks/proj/good.json.bak":             "not verified",
+		".pulumi/stacks/proj/corrupt.json":              "{",
+		".pulumi/stacks/proj/mismatch.json":             legacyCheckpoint,
+		".pulumi/stacks/proj/mismatch.json.sha256":      computeChecksum([]byte("other")),
+		".pulumi/stacks/proj/good.json.tmp-1234":        legacyCheckpoint,
+		".pulumi/stacks/proj/gone.json.sha256":          computeChecksum([]byte("gone")),
+		".pulumi/stacks/proj/good.tags.json":            `{"owner": "alice"}`,
+		".pulumi/stacks/proj/gone.tags.json":            `{"owner": "bob"}`,
+		".pulumi/stacks/legacy.json":                    legacyCheckpoint,
+		".pulumi/history/proj/good/good-1.history.json": "{}",
+		".pulumi/history/proj/gone/gone-1.history.json": "{}",
+		".pulumi/history/proj/gone/gone-2.history.json": "{}",
+	})
+
+	// Verify must not write to the bucket.
+	bucket := &readOnlyBucket{
+		Bucket: &wrappedBucket{bucket: b},
+		err:    errors.New("unexpected write"),
+	}
+	report, err := verifyStore(context.Background(), bucket, nil, nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, report.Version)
+	assert.Equal(t, 4, report.Stacks)
+	assert.True(t, report.HasErrors())
+
+	type problem struct {
+		Severity VerifySeverity
+		Key      string
+	}
+	var got []problem
+	for _, p := range report.Problems {
+		assert.NotEmpty(t, p.Message, "%v", p.Key)
+		assert.NotEmpty(t, p.Remediation, "%v", p.Key)
+		got = append(got, problem{p.Severity, p.Key})
+	}
+	assert.Equal(t, []problem{
+		{VerifyWarning, ".pulumi/history/proj/gone/"},
+		{VerifyWarning, ".pulumi/stacks/legacy.json"},
+		{VerifyError, ".pulumi/stacks/proj/corrupt.json"},
+		{VerifyWarning, ".pulumi/stacks/proj/gone.json.sha256"},
+		{VerifyWarning, ".pulumi/stacks/proj/gone.tags.json"},
+		{VerifyWarning, ".pulumi/stacks/proj/good.json.tmp-1234"},
+		{VerifyError, ".pulumi/stacks/proj/mismatch.json"},
+	}, got)
+}
+
+func TestVerify_meta(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc    string
+		give    map[string]string
+		version int
+		wantErr bool
+	}{
+		{
+			desc: "legacy",
+			give: map[string]string{
+				".pulumi/stacks/a.json": legacyCheckpoint,
+			},
+		},
+		{
+			desc: "corrupt",
+			give: map[string]string{
+				".pulumi/meta.yaml": "version: foo",
+			},
+			wantErr: true,
+		},
+		{
+			desc: "future",
+			give: map[string]string{
+				".pulumi/meta.yaml": "version: 42",
+			},
+			version: 42,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			b := memblob.OpenBucket(nil)
+			writeFiles(t, b, tt.give)
+
+			report, err := verifyStore(context.Background(), &wrappedBucket{bucket: b}, nil, nil)
+			require.NoError(t, err)
+			assert.Equal(t, tt.version, report.Version)
+			assert.Equal(t, tt.wantErr, report.HasErrors(), "%v", report.Problems)
+		})
+	}
+}
+
+func TestVerify_backend(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, err := New(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"})
+	require.NoError(t, err)
+
+	ref, err := b.ParseStackReference("foo")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	report, err := b.(Backend).Verify(ctx, nil /* events */)
+	require.NoError(t, err)
+	assert.Equal(t, &VerifyReport{Version: 1, Stacks: 1}, report)
+}
+
+func TestVerify_events(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b := memblob.OpenBucket(nil)
+	writeFiles(t, b, map[string]string{
+		".pulumi/meta.yaml":              "version: 1",
+		".pulumi/stacks/proj/a.json":     legacyCheckpoint,
+		".pulumi/stacks/proj/b.json":     "{}",
+		".pulumi/stacks/proj/b.json.bak": "{}",
+	})
+
+	events := make(chan ProgressEvent, 10)
+	_, err := verifyStore(ctx, &wrappedBucket{bucket: b}, nil, events)
+	require.NoError(t, err)
+
+	var got []ProgressEvent
+	for ev := range events {
+		got = append(got, ev)
+	}
+	assert.Equal(t, []ProgressEvent{
+		{
+			Operation: ProgressVerify,
+			Stack:     "proj/a",
+			Key:       ".pulumi/stacks/proj/a.json",
+			Files:     1,
+			Bytes:     int64(len(legacyCheckpoint)),
+		},
+		{
+			Operation: ProgressVerify,
+			Stack:     "proj/b",
+			Key:       ".pulumi/stacks/proj/b.json",
+			Files:     2,
+			Bytes:     int64(len(legacyCheckpoint)) + 2,
+		},
+	}, got)
+}
@@ -0,0 +1,108 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
+)
+
+// defaultHistoryWatchInterval is how often WatchHistory lists the history of a stack by default.
+const defaultHistoryWatchInterval = 5 * time.Second
+
+func (b *localBackend) WatchHistory(ctx context.Context, stackRef backend.StackReference) (<-chan UpdateInfo, error) {
+	ref, err := b.getReference(stackRef)
+	if err != nil {
+		return nil, err
+	}
+
+	// Entries recorded before the watch started aren't sent.
+	files, err := b.listHistoryFiles(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("list history of stack %v: %w", ref, err)
+	}
+	seen := make(map[string]struct{}, len(files))
+	for _, file := range files {
+		if id, ok := historyUpdateID(file.Key); ok {
+			seen[id] = struct{}{}
+		}
+	}
+
+	updates := make(chan UpdateInfo)
+	go b.watchHistory(ctx, ref, seen, updates)
+	return updates, nil
+}
+
+// watchHistory lists the history of the given stack every historyWatchInterval,
+// and sends the entries that aren't in seen to updates, oldest first,
+// until ctx is done, when it closes updates.
+//
+// Entries are identified by their update ID,
+// so an entry that's stored both compressed and uncompressed is sent once.
+// Entries recorded while the receiver is slow to take one are sent after the next listing.
+func (b *localBackend) watchHistory(
+	ctx context.Context, ref *localBackendReference, seen map[string]struct{}, updates chan<- UpdateInfo,
+) {
+	defer close(updates)
+
+	ticker := time.NewTicker(b.historyWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		files, err := b.listHistoryFiles(ctx, ref)
+		if err != nil {
+			// The store may only be unreachable for a moment.
+			logging.V(5).Infof("list history of stack %v: %v (retrying in %v)", ref, err, b.historyWatchInterval)
+			continue
+		}
+
+		// Only the entries of this listing are remembered,
+		// so that those removed, e.g. by compacting the history, are forgotten.
+		listed := make(map[string]struct{}, len(files))
+		for i := len(files) - 1; i >= 0; i-- {
+			id, ok := historyUpdateID(files[i].Key)
+			if !ok {
+				continue
+			}
+			if _, ok := seen[id]; ok {
+				listed[id] = struct{}{}
+				continue
+			}
+
+			update, err := b.readHistoryFile(ctx, files[i].Key)
+			if err != nil {
+				// Read it again at the next listing.
+				logging.V(5).Infof("%v (retrying in %v)", err, b.historyWatchInterval)
+				continue
+			}
+			select {
+			case updates <- UpdateInfo{ID: id, UpdateInfo: update}:
+				listed[id] = struct{}{}
+			case <-ctx.Done():
+				return
+			}
+		}
+		seen = listed
+	}
+}
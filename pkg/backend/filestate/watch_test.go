@@ -0,0 +1,109 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+func TestWatchHistory(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	clk := newFakeClock()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "proj"}, &localBackendOptions{
+			Getenv:               mapGetenv(nil),
+			Clock:                clk,
+			HistoryWatchInterval: 10 * time.Millisecond,
+		})
+	require.NoError(t, err)
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	record := func(message string) {
+		clk.Advance(time.Second)
+		require.NoError(t, b.addToHistory(ctx, ref, backend.UpdateInfo{Kind: "update", Message: message}))
+	}
+	receive := func(updates <-chan UpdateInfo) string {
+		t.Helper()
+
+		select {
+		case update, ok := <-updates:
+			require.True(t, ok, "updates closed")
+			return update.Message
+		case <-time.After(10 * time.Second):
+			require.FailNow(t, "no update received")
+			return ""
+		}
+	}
+
+	record("before")
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	updates, err := b.WatchHistory(watchCtx, ref)
+	require.NoError(t, err)
+
+	// Updates recorded before the watch started aren't sent,
+	// and those recorded together are sent in order.
+	record("first")
+	record("second")
+	assert.Equal(t, "first", receive(updates))
+	assert.Equal(t, "second", receive(updates))
+
+	// Updates are sent once, however often they're listed.
+	time.Sleep(50 * time.Millisecond)
+	record("third")
+	assert.Equal(t, "third", receive(updates))
+	select {
+	case update := <-updates:
+		assert.Failf(t, "unexpected update", "%+v", update)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The channel is closed once the watch is canceled.
+	cancel()
+	_, ok := <-updates
+	assert.False(t, ok)
+}
+
+func TestWatchHistory_noHistory(t *testing.T) {
+	t.Parallel()
+
+	b, _ := newSnapshotBackend(t, nil)
+	ref, err := b.parseStackReference("missing")
+	require.NoError(t, err)
+
+	// Stacks that were never updated have no history yet.
+	ctx, cancel := context.WithCancel(context.Background())
+	updates, err := b.WatchHistory(ctx, ref)
+	require.NoError(t, err)
+	cancel()
+	_, ok := <-updates
+	assert.False(t, ok)
+}
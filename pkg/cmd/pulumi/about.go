@@ -23,6 +23,7 @@ import (
 	"os"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/blang/semver"
@@ -30,6 +31,7 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/backend/filestate"
 	"github.com/pulumi/pulumi/pkg/v3/backend/state"
 	"github.com/pulumi/pulumi/pkg/v3/engine"
 	"github.com/pulumi/pulumi/pkg/v3/resource/deploy"
@@ -303,30 +305,67 @@ type backendAbout struct {
 	URL           string   `json:"url"`
 	User          string   `json:"user"`
 	Organizations []string `json:"organizations"`
+
+	// StoreVersion and StoreLayout describe the state store of self-managed backends.
+	StoreVersion *int   `json:"storeVersion,omitempty"`
+	StoreLayout  string `json:"storeLayout,omitempty"`
+
+	// StoreDescription and StoreEnvironment are recorded in the metadata file of the state store, if at all.
+	StoreDescription string `json:"storeDescription,omitempty"`
+	StoreEnvironment string `json:"storeEnvironment,omitempty"`
 }
 
+// Layouts of self-managed state stores reported by pulumi about.
+const (
+	storeLayoutLegacy  = "legacy"
+	storeLayoutProject = "project"
+)
+
 func getBackendAbout(b backend.Backend) backendAbout {
 	currentUser, currentOrgs, err := b.CurrentUser()
 	if err != nil {
 		currentUser = "Unknown"
 	}
-	return backendAbout{
+	about := backendAbout{
 		Name:          b.Name(),
 		URL:           b.URL(),
 		User:          currentUser,
 		Organizations: currentOrgs,
 	}
+	if lb, ok := b.(filestate.Backend); ok {
+		info := lb.StoreInfo()
+		about.StoreVersion = &info.Version
+		about.StoreLayout = storeLayoutProject
+		if info.Legacy {
+			about.StoreLayout = storeLayoutLegacy
+		}
+		about.StoreDescription = info.Description
+		about.StoreEnvironment = info.Environment
+	}
+	return about
 }
 
 func (b backendAbout) String() string {
+	rows := [][]string{
+		{"Name", b.Name},
+		{"URL", b.URL},
+		{"User", b.User},
+		{"Organizations", strings.Join(b.Organizations, ", ")},
+	}
+	if b.StoreVersion != nil {
+		rows = append(rows,
+			[]string{"Store version", strconv.Itoa(*b.StoreVersion)},
+			[]string{"Store layout", b.StoreLayout})
+	}
+	if b.StoreEnvironment != "" {
+		rows = append(rows, []string{"Store environment", b.StoreEnvironment})
+	}
+	if b.StoreDescription != "" {
+		rows = append(rows, []string{"Store description", b.StoreDescription})
+	}
 	return cmdutil.Table{
 		Headers: []string{"Backend", ""},
-		Rows: simpleTableRows([][]string{
-			{"Name", b.Name},
-			{"URL", b.URL},
-			{"User", b.User},
-			{"Organizations", strings.Join(b.Organizations, ", ")},
-		}),
+		Rows:    simpleTableRows(rows),
 	}.String()
 }
 
@@ -15,11 +15,18 @@
 package main
 
 import (
+	"context"
+	"os"
+	"path/filepath"
 	"runtime"
 	"testing"
 
 	"github.com/shirou/gopsutil/v3/host"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend/filestate"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
 )
 
 func TestCLI(t *testing.T) {
@@ -44,3 +51,51 @@ func TestBackend(t *testing.T) {
 	assert.Contains(t, display, stats.PlatformVersion)
 	assert.Contains(t, display, stats.KernelArch)
 }
+
+func TestBackendAbout_filestate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc        string
+		give        int // initial version
+		wantVersion int
+		wantLayout  string
+	}{
+		{desc: "legacy", give: 0, wantVersion: 0, wantLayout: "legacy"},
+		{desc: "project", give: 1, wantVersion: 1, wantLayout: "project"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			b, err := filestate.NewWithOptions(context.Background(), diagtest.LogSink(t),
+				"file://"+filepath.ToSlash(t.TempDir()), nil, &filestate.Options{InitialVersion: &tt.give})
+			require.NoError(t, err)
+
+			about := getBackendAbout(b)
+			require.NotNil(t, about.StoreVersion)
+			assert.Equal(t, tt.wantVersion, *about.StoreVersion)
+			assert.Equal(t, tt.wantLayout, about.StoreLayout)
+			assert.Contains(t, about.String(), "Store layout")
+		})
+	}
+}
+
+func TestBackendAbout_filestateLabels(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, ".pulumi"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".pulumi", "meta.yaml"),
+		[]byte("version: 1\ndescription: Platform team\nenvironment: production\n"), 0o600))
+
+	b, err := filestate.New(context.Background(), diagtest.LogSink(t), "file://"+filepath.ToSlash(dir), nil)
+	require.NoError(t, err)
+
+	about := getBackendAbout(b)
+	assert.Equal(t, "Platform team", about.StoreDescription)
+	assert.Equal(t, "production", about.StoreEnvironment)
+	assert.Contains(t, about.String(), "Platform team")
+	assert.Equal(t, "Environment: production\nDescription: Platform team\n", formatStoreLabels(b.StoreInfo()))
+}
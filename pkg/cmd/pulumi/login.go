@@ -85,7 +85,11 @@ func newLoginCmd() *cobra.Command {
 			"\n" +
 			"Azure Blob:\n" +
 			"\n" +
-			"    $ pulumi login azblob://my-pulumi-state-bucket\n",
+			"    $ pulumi login azblob://my-pulumi-state-bucket\n" +
+			"\n" +
+			"[PREVIEW] State may also be kept in a directory of a server that's reachable over SFTP. For instance,\n" +
+			"\n" +
+			"    $ pulumi login sftp://deploy@files.example.com/srv/pulumi\n",
 		Args: cmdutil.MaximumNArgs(1),
 		Run: cmdutil.RunFunc(func(cmd *cobra.Command, args []string) error {
 			ctx := commandContext()
@@ -168,6 +172,10 @@ func newLoginCmd() *cobra.Command {
 			} else {
 				fmt.Printf("Logged in to %s (%s)\n", be.Name(), be.URL())
 			}
+			if lb, ok := be.(filestate.Backend); ok {
+				// Self-managed stores may describe themselves so that they can be told apart.
+				fmt.Print(formatStoreLabels(lb.StoreInfo()))
+			}
 
 			return nil
 		}),
@@ -184,13 +192,26 @@ func newLoginCmd() *cobra.Command {
 
 func validateCloudBackendType(typ string) error {
 	kind := strings.SplitN(typ, ":", 2)[0]
-	supportedKinds := []string{"azblob", "gs", "s3", "file", "https", "http"}
+	supportedKinds := []string{"azblob", "gs", "s3", "file", "sftp", "https", "http"}
 	for _, supportedKind := range supportedKinds {
 		if kind == supportedKind {
 			return nil
 		}
 	}
 	return fmt.Errorf("unknown backend cloudUrl format '%s' (supported Url formats are: "+
-		"azblob://, gs://, s3://, file://, https:// and http://)",
+		"azblob://, gs://, s3://, file://, sftp://, https:// and http://)",
 		kind)
 }
+
+// formatStoreLabels returns the environment and description recorded in the metadata file
+// of a self-managed state store, one per line, or "" if it records neither.
+func formatStoreLabels(info filestate.StoreInfo) string {
+	var sb strings.Builder
+	if info.Environment != "" {
+		fmt.Fprintf(&sb, "Environment: %s\n", info.Environment)
+	}
+	if info.Description != "" {
+		fmt.Fprintf(&sb, "Description: %s\n", info.Description)
+	}
+	return sb.String()
+}
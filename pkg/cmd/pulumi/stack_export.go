@@ -108,6 +108,7 @@ func newStackExportCmd() *cobra.Command {
 				deployment = &apitype.UntypedDeployment{
 					Version:    3,
 					Deployment: data,
+					StateStore: deployment.StateStore,
 				}
 
 				log3rdPartySecretsProviderDecryptionEvent(ctx, s, "", "pulumi stack export")
@@ -135,6 +135,8 @@ func newStackImportCmd() *cobra.Command {
 			dep := apitype.UntypedDeployment{
 				Version:    apitype.DeploymentSchemaVersionCurrent,
 				Deployment: bytes,
+				// Let the backend check that the source store is compatible.
+				StateStore: deployment.StateStore,
 			}
 
 			// Now perform the deployment.
@@ -18,6 +18,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"path"
 	"sort"
 	"strconv"
 	"strings"
@@ -28,6 +29,7 @@ import (
 
 	"github.com/pulumi/pulumi/pkg/v3/backend"
 	"github.com/pulumi/pulumi/pkg/v3/backend/display"
+	"github.com/pulumi/pulumi/pkg/v3/backend/filestate"
 	"github.com/pulumi/pulumi/pkg/v3/backend/httpstate"
 	"github.com/pulumi/pulumi/pkg/v3/backend/state"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/cmdutil"
@@ -42,7 +44,7 @@ func newStackLsCmd() *cobra.Command {
 	var tagFilter string
 
 	cmd := &cobra.Command{
-		Use:   "ls",
+		Use:   "ls [pattern]",
 		Short: "List stacks",
 		Long: "List stacks\n" +
 			"\n" +
@@ -52,11 +54,19 @@ func newStackLsCmd() *cobra.Command {
 			"\n" +
 			"Results may be further filtered by passing additional flags. Tag filters may include\n" +
 			"the tag name as well as the tag value, separated by an equals sign. For example\n" +
-			"'environment=production' or just 'gcp:project'.",
-		Args: cmdutil.NoArgs,
-		Run: cmdutil.RunFunc(func(cmd *cobra.Command, _ []string) error {
+			"'environment=production' or just 'gcp:project'.\n" +
+			"\n" +
+			"Stacks may also be filtered by a glob pattern matched against their names, such as\n" +
+			"'dev-*'. Patterns that contain a slash are matched against 'project/stack' instead.",
+		Args: cmdutil.MaximumNArgs(1),
+		Run: cmdutil.RunFunc(func(cmd *cobra.Command, args []string) error {
 			ctx := commandContext()
+			var pattern string
+			if len(args) > 0 {
+				pattern = args[0]
+			}
 			cmdArgs := stackLSArgs{
+				pattern:    pattern,
 				jsonOut:    jsonOut,
 				allStacks:  allStacks,
 				orgFilter:  orgFilter,
@@ -83,6 +93,7 @@ func newStackLsCmd() *cobra.Command {
 }
 
 type stackLSArgs struct {
+	pattern    string
 	jsonOut    bool
 	allStacks  bool
 	orgFilter  string
@@ -91,6 +102,10 @@ type stackLSArgs struct {
 }
 
 func runStackLS(ctx context.Context, args stackLSArgs) error {
+	if _, err := path.Match(args.pattern, ""); err != nil {
+		return fmt.Errorf("invalid stack pattern %q: %w", args.pattern, err)
+	}
+
 	// Build up the stack filters. We do not support accepting empty strings as filters
 	// from command-line arguments, though the API technically supports it.
 	strPtrIfSet := func(s string) *string {
@@ -153,22 +168,31 @@ func runStackLS(ctx context.Context, args stackLSArgs) error {
 	// show stacks as they get returned. (And resizing/redrawing the table as appropriate.)
 	//
 	// See display/jsonmessage.go for how we do this when rendering progressive updates.
-	var (
-		allStackSummaries []backend.StackSummary
-		inContToken       backend.ContinuationToken
-	)
-	for {
-		summaries, outContToken, err := b.ListStacks(ctx, filter, inContToken)
-		if err != nil {
+	var allStackSummaries []backend.StackSummary
+	if lb, ok := b.(filestate.Backend); ok && args.pattern != "" {
+		// Self-managed backends skip the stacks that don't match without reading them.
+		if allStackSummaries, err = lb.ListStacksMatching(ctx, args.pattern, filter); err != nil {
 			return err
 		}
+	} else {
+		var inContToken backend.ContinuationToken
+		for {
+			summaries, outContToken, err := b.ListStacks(ctx, filter, inContToken)
+			if err != nil {
+				return err
+			}
 
-		allStackSummaries = append(allStackSummaries, summaries...)
+			for _, s := range summaries {
+				if matchesStackPattern(args.pattern, s.Name()) {
+					allStackSummaries = append(allStackSummaries, s)
+				}
+			}
 
-		if outContToken == nil {
-			break
+			if outContToken == nil {
+				break
+			}
+			inContToken = outContToken
 		}
-		inContToken = outContToken
 	}
 
 	// Sort by stack name.
@@ -183,6 +207,21 @@ func runStackLS(ctx context.Context, args stackLSArgs) error {
 	return formatStackSummariesConsole(b, current, allStackSummaries)
 }
 
+// matchesStackPattern reports whether the given stack matches a glob pattern passed to 'pulumi stack ls'.
+// All stacks match an empty pattern.
+func matchesStackPattern(pattern string, ref backend.StackReference) bool {
+	if pattern == "" {
+		return true
+	}
+	name := ref.Name().String()
+	if strings.Contains(pattern, "/") {
+		project, _ := ref.Project()
+		name = project.String() + "/" + name
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
 // parseTagFilter parses a tag filter into its separate name and value parts, separatedby an equal sign.
 // If no "value" is provided, the second return parameter will be `nil`. Either the tag name or value can
 // be omitted. e.g. "=x" returns ("", "x") and "=" returns ("", "").
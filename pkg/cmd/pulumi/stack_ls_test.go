@@ -184,3 +184,26 @@ func TestListStacksPagination(t *testing.T) {
 			callIdx, callIdx-1)
 	}
 }
+
+func TestMatchesStackPattern(t *testing.T) {
+	t.Parallel()
+
+	ref := &backend.MockStackReference{NameV: "dev-a", ProjectV: "web"}
+	tests := []struct {
+		pattern string
+		want    bool
+	}{
+		{pattern: "", want: true},
+		{pattern: "dev-*", want: true},
+		{pattern: "dev-?", want: true},
+		{pattern: "prod-*", want: false},
+		{pattern: "web/dev-*", want: true},
+		{pattern: "w*/*", want: true},
+		{pattern: "api/dev-*", want: false},
+		// Patterns without a slash don't match the project.
+		{pattern: "web*", want: false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, matchesStackPattern(tt.pattern, ref), "pattern %q", tt.pattern)
+	}
+}
@@ -51,6 +51,9 @@ troubleshooting a stack or when performing specific edits that otherwise would r
 	cmd.AddCommand(newStateUnprotectCommand())
 	cmd.AddCommand(newStateRenameCommand())
 	cmd.AddCommand(newStateUpgradeCommand())
+	cmd.AddCommand(newStateCheckCommand())
+	cmd.AddCommand(newStateGCCommand())
+	cmd.AddCommand(newStatePruneCommand())
 	return cmd
 }
 
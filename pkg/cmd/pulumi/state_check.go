@@ -0,0 +1,122 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/backend/display"
+	"github.com/pulumi/pulumi/pkg/v3/backend/filestate"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/cmdutil"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/result"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+
+	"github.com/spf13/cobra"
+)
+
+func newStateCheckCommand() *cobra.Command {
+	var sccmd stateCheckCmd
+	cmd := &cobra.Command{
+		Use:   "check",
+		Short: "Checks the current backend for problems",
+		Long: `Checks the current backend for problems
+
+This scans every stack in the backend, reporting checkpoints that cannot be read,
+files left behind by interrupted operations, and other inconsistencies.
+The backend is not modified, and no stacks are locked during the scan.
+
+The command fails if any errors are found.
+This only has an effect on self-managed backends.
+`,
+		Args: cmdutil.NoArgs,
+		Run: cmdutil.RunResultFunc(func(cmd *cobra.Command, args []string) result.Result {
+			if err := sccmd.Run(commandContext()); err != nil {
+				return result.FromError(err)
+			}
+			return nil
+		}),
+	}
+	cmd.PersistentFlags().BoolVarP(
+		&sccmd.JSON, "json", "j", false, "Emit output as JSON")
+	return cmd
+}
+
+// stateCheckCmd implements the 'pulumi state check' command.
+type stateCheckCmd struct {
+	Stdout io.Writer // defaults to os.Stdout
+
+	// JSON specifies that the report should be printed as JSON.
+	JSON bool
+
+	// Used to mock out the currentBackend function for testing.
+	// Defaults to currentBackend function.
+	currentBackend func(context.Context, *workspace.Project, display.Options) (backend.Backend, error)
+}
+
+func (cmd *stateCheckCmd) Run(ctx context.Context) error {
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+
+	if cmd.currentBackend == nil {
+		cmd.currentBackend = currentBackend
+	}
+	currentBackend := cmd.currentBackend // shadow top-level currentBackend
+
+	dopts := display.Options{
+		Color:  cmdutil.GetGlobalColorization(),
+		Stdout: cmd.Stdout,
+	}
+
+	b, err := currentBackend(ctx, nil, dopts)
+	if err != nil {
+		return err
+	}
+
+	lb, ok := b.(filestate.Backend)
+	if !ok {
+		// Only the file state backend supports checks.
+		// Report the no-op.
+		fmt.Fprintln(cmd.Stdout, "Nothing to do")
+		return nil
+	}
+
+	report, err := lb.Verify(ctx, nil /* events */)
+	if err != nil {
+		return err
+	}
+
+	if cmd.JSON {
+		if err := fprintJSON(cmd.Stdout, report); err != nil {
+			return err
+		}
+	} else {
+		for _, p := range report.Problems {
+			fmt.Fprintf(cmd.Stdout, "%v: %v: %v\n", p.Severity, p.Key, p.Message)
+			fmt.Fprintf(cmd.Stdout, "    %v\n", p.Remediation)
+		}
+		fmt.Fprintf(cmd.Stdout, "Checked %d stack(s), found %d problem(s)\n", report.Stacks, len(report.Problems))
+	}
+
+	if report.HasErrors() {
+		return errors.New("state check found errors")
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/backend/display"
+	"github.com/pulumi/pulumi/pkg/v3/backend/filestate"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateCheckCommand_parseArgs(t *testing.T) {
+	t.Parallel()
+
+	cmd := newStateCheckCommand()
+	args := []string{"--json"}
+
+	require.NoError(t, cmd.ParseFlags(args))
+	args = cmd.Flags().Args() // non flag args
+	require.NoError(t, cmd.ValidateArgs(args))
+}
+
+// checkBackend returns a currentBackend function
+// for a backend that reports the given problems.
+func checkBackend(problems ...filestate.VerifyProblem) func(
+	context.Context, *workspace.Project, display.Options,
+) (backend.Backend, error) {
+	return func(context.Context, *workspace.Project, display.Options) (backend.Backend, error) {
+		return &stubFileBackend{
+			VerifyF: func(context.Context) (*filestate.VerifyReport, error) {
+				return &filestate.VerifyReport{Version: 1, Stacks: 2, Problems: problems}, nil
+			},
+		}, nil
+	}
+}
+
+func TestStateCheckCommand_Run(t *testing.T) {
+	t.Parallel()
+
+	var stdout bytes.Buffer
+	cmd := stateCheckCmd{
+		Stdout: &stdout,
+		currentBackend: checkBackend(filestate.VerifyProblem{
+			Severity:    filestate.VerifyWarning,
+			Key:         ".pulumi/stacks/proj/a.json.tmp-1234",
+			Message:     "temporary file",
+			Remediation: "Delete the file.",
+		}),
+	}
+
+	// Warnings alone don't fail the check.
+	require.NoError(t, cmd.Run(context.Background()))
+	assert.Equal(t,
+		"warning: .pulumi/stacks/proj/a.json.tmp-1234: temporary file\n"+
+			"    Delete the file.\n"+
+			"Checked 2 stack(s), found 1 problem(s)\n",
+		stdout.String())
+}
+
+func TestStateCheckCommand_Run_errors(t *testing.T) {
+	t.Parallel()
+
+	var stdout bytes.Buffer
+	cmd := stateCheckCmd{
+		Stdout: &stdout,
+		JSON:   true,
+		currentBackend: checkBackend(filestate.VerifyProblem{
+			Severity:    filestate.VerifyError,
+			Key:         ".pulumi/stacks/proj/a.json",
+			Message:     "checkpoint could not be parsed",
+			Remediation: "Restore the checkpoint.",
+		}),
+	}
+
+	assert.ErrorContains(t, cmd.Run(context.Background()), "state check found errors")
+
+	var got filestate.VerifyReport
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &got))
+	require.Len(t, got.Problems, 1)
+	assert.Equal(t, filestate.VerifyError, got.Problems[0].Severity)
+}
+
+func TestStateCheckCommand_Run_unsupportedBackend(t *testing.T) {
+	t.Parallel()
+
+	var stdout bytes.Buffer
+	cmd := stateCheckCmd{
+		Stdout: &stdout,
+		currentBackend: func(context.Context, *workspace.Project, display.Options) (backend.Backend, error) {
+			return &backend.MockBackend{}, nil
+		},
+	}
+
+	require.NoError(t, cmd.Run(context.Background()))
+	assert.Contains(t, stdout.String(), "Nothing to do")
+}
@@ -0,0 +1,126 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/backend/display"
+	"github.com/pulumi/pulumi/pkg/v3/backend/filestate"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/cmdutil"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/result"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+
+	"github.com/spf13/cobra"
+)
+
+func newStateGCCommand() *cobra.Command {
+	var sgcmd stateGCCmd
+	cmd := &cobra.Command{
+		Use:   "gc",
+		Short: "Removes files left behind by deleted stacks",
+		Long: `Removes files left behind by deleted stacks
+
+This deletes the history, backups, and locks of stacks that no longer exist
+in the current backend, e.g. because their checkpoints were deleted by hand.
+Stacks that are currently locked, and files written in the last hour, are left alone.
+
+Use --dry-run to see what would be deleted.
+This only has an effect on self-managed backends.
+`,
+		Args: cmdutil.NoArgs,
+		Run: cmdutil.RunResultFunc(func(cmd *cobra.Command, args []string) result.Result {
+			if err := sgcmd.Run(commandContext()); err != nil {
+				return result.FromError(err)
+			}
+			return nil
+		}),
+	}
+	cmd.PersistentFlags().BoolVar(
+		&sgcmd.DryRun, "dry-run", false, "Report the files that would be deleted without deleting them")
+	cmd.PersistentFlags().BoolVarP(
+		&sgcmd.JSON, "json", "j", false, "Emit output as JSON")
+	return cmd
+}
+
+// stateGCCmd implements the 'pulumi state gc' command.
+type stateGCCmd struct {
+	Stdout io.Writer // defaults to os.Stdout
+
+	// DryRun specifies that files should only be reported.
+	DryRun bool
+
+	// JSON specifies that the report should be printed as JSON.
+	JSON bool
+
+	// Used to mock out the currentBackend function for testing.
+	// Defaults to currentBackend function.
+	currentBackend func(context.Context, *workspace.Project, display.Options) (backend.Backend, error)
+}
+
+func (cmd *stateGCCmd) Run(ctx context.Context) error {
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+
+	if cmd.currentBackend == nil {
+		cmd.currentBackend = currentBackend
+	}
+	currentBackend := cmd.currentBackend // shadow top-level currentBackend
+
+	dopts := display.Options{
+		Color:  cmdutil.GetGlobalColorization(),
+		Stdout: cmd.Stdout,
+	}
+
+	b, err := currentBackend(ctx, nil, dopts)
+	if err != nil {
+		return err
+	}
+
+	lb, ok := b.(filestate.Backend)
+	if !ok {
+		// Only the file state backend stores these files itself.
+		// Report the no-op.
+		fmt.Fprintln(cmd.Stdout, "Nothing to do")
+		return nil
+	}
+
+	report, err := lb.GC(ctx, filestate.GCOptions{DryRun: cmd.DryRun})
+	if err != nil {
+		return err
+	}
+
+	if cmd.JSON {
+		return fprintJSON(cmd.Stdout, report)
+	}
+
+	verb := "Removed"
+	if report.DryRun {
+		verb = "Would remove"
+	}
+	for _, f := range report.Files {
+		fmt.Fprintf(cmd.Stdout, "%v %v %v\n", verb, f.Kind, f.Key)
+	}
+	for _, stack := range report.Skipped {
+		fmt.Fprintf(cmd.Stdout, "Skipped %v because it is locked\n", stack)
+	}
+	fmt.Fprintf(cmd.Stdout, "%v %d file(s), %d byte(s)\n", verb, len(report.Files), report.ReclaimedBytes)
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/backend/display"
+	"github.com/pulumi/pulumi/pkg/v3/backend/filestate"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateGCCommand_parseArgs(t *testing.T) {
+	t.Parallel()
+
+	cmd := newStateGCCommand()
+	args := []string{"--dry-run", "--json"}
+
+	require.NoError(t, cmd.ParseFlags(args))
+	args = cmd.Flags().Args() // non flag args
+	require.NoError(t, cmd.ValidateArgs(args))
+}
+
+func TestStateGCCommand_Run(t *testing.T) {
+	t.Parallel()
+
+	var (
+		stdout  bytes.Buffer
+		gotOpts filestate.GCOptions
+	)
+	cmd := stateGCCmd{
+		Stdout: &stdout,
+		DryRun: true,
+		currentBackend: func(context.Context, *workspace.Project, display.Options) (backend.Backend, error) {
+			return &stubFileBackend{
+				GCF: func(_ context.Context, opts filestate.GCOptions) (*filestate.GCReport, error) {
+					gotOpts = opts
+					return &filestate.GCReport{
+						DryRun: true,
+						Files: []filestate.GCFile{
+							{Key: ".pulumi/history/proj/gone/gone-1.history.json", Kind: filestate.GCHistory, Size: 10},
+						},
+						Skipped:        []string{"proj/busy"},
+						ReclaimedBytes: 10,
+					}, nil
+				},
+			}, nil
+		},
+	}
+
+	require.NoError(t, cmd.Run(context.Background()))
+	assert.True(t, gotOpts.DryRun)
+	assert.Equal(t,
+		"Would remove history .pulumi/history/proj/gone/gone-1.history.json\n"+
+			"Skipped proj/busy because it is locked\n"+
+			"Would remove 1 file(s), 10 byte(s)\n",
+		stdout.String())
+}
+
+func TestStateGCCommand_Run_unsupportedBackend(t *testing.T) {
+	t.Parallel()
+
+	var stdout bytes.Buffer
+	cmd := stateGCCmd{
+		Stdout: &stdout,
+		currentBackend: func(context.Context, *workspace.Project, display.Options) (backend.Backend, error) {
+			return &backend.MockBackend{}, nil
+		},
+	}
+
+	require.NoError(t, cmd.Run(context.Background()))
+	assert.Contains(t, stdout.String(), "Nothing to do")
+}
@@ -0,0 +1,128 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/backend/display"
+	"github.com/pulumi/pulumi/pkg/v3/backend/filestate"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/cmdutil"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/result"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+
+	"github.com/spf13/cobra"
+)
+
+func newStatePruneCommand() *cobra.Command {
+	var spcmd statePruneCmd
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Removes stacks that have no resources",
+		Long: `Removes stacks that have no resources
+
+This moves every stack in the current backend whose state has no resources
+and no pending operations to the trash, e.g. stacks that were destroyed but never removed,
+and stacks that were created but never updated.
+Removed stacks can be restored from the trash until it is purged.
+Stacks that are currently locked are left alone.
+
+Use --dry-run to see what would be removed.
+This only has an effect on self-managed backends.
+`,
+		Args: cmdutil.NoArgs,
+		Run: cmdutil.RunResultFunc(func(cmd *cobra.Command, args []string) result.Result {
+			if err := spcmd.Run(commandContext()); err != nil {
+				return result.FromError(err)
+			}
+			return nil
+		}),
+	}
+	cmd.PersistentFlags().BoolVar(
+		&spcmd.DryRun, "dry-run", false, "Report the stacks that would be removed without removing them")
+	cmd.PersistentFlags().BoolVarP(
+		&spcmd.JSON, "json", "j", false, "Emit output as JSON")
+	return cmd
+}
+
+// statePruneCmd implements the 'pulumi state prune' command.
+type statePruneCmd struct {
+	Stdout io.Writer // defaults to os.Stdout
+
+	// DryRun specifies that stacks should only be reported.
+	DryRun bool
+
+	// JSON specifies that the report should be printed as JSON.
+	JSON bool
+
+	// Used to mock out the currentBackend function for testing.
+	// Defaults to currentBackend function.
+	currentBackend func(context.Context, *workspace.Project, display.Options) (backend.Backend, error)
+}
+
+func (cmd *statePruneCmd) Run(ctx context.Context) error {
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+
+	if cmd.currentBackend == nil {
+		cmd.currentBackend = currentBackend
+	}
+	currentBackend := cmd.currentBackend // shadow top-level currentBackend
+
+	dopts := display.Options{
+		Color:  cmdutil.GetGlobalColorization(),
+		Stdout: cmd.Stdout,
+	}
+
+	b, err := currentBackend(ctx, nil, dopts)
+	if err != nil {
+		return err
+	}
+
+	lb, ok := b.(filestate.Backend)
+	if !ok {
+		// Only the file state backend has a trash to move stacks to.
+		// Report the no-op.
+		fmt.Fprintln(cmd.Stdout, "Nothing to do")
+		return nil
+	}
+
+	report, err := lb.PruneEmptyStacks(ctx, cmd.DryRun)
+	if err != nil {
+		return err
+	}
+
+	if cmd.JSON {
+		return fprintJSON(cmd.Stdout, report)
+	}
+
+	verb := "Removed"
+	if report.DryRun {
+		verb = "Would remove"
+	}
+	for _, stack := range report.Stacks {
+		fmt.Fprintf(cmd.Stdout, "%v %v\n", verb, stack)
+	}
+	for _, stack := range report.Skipped {
+		fmt.Fprintf(cmd.Stdout, "Skipped %v because it is locked\n", stack)
+	}
+	fmt.Fprintf(cmd.Stdout, "%v %d stack(s)\n", verb, len(report.Stacks))
+	return nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/backend/display"
+	"github.com/pulumi/pulumi/pkg/v3/backend/filestate"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatePruneCommand_parseArgs(t *testing.T) {
+	t.Parallel()
+
+	cmd := newStatePruneCommand()
+	args := []string{"--dry-run", "--json"}
+
+	require.NoError(t, cmd.ParseFlags(args))
+	args = cmd.Flags().Args() // non flag args
+	require.NoError(t, cmd.ValidateArgs(args))
+}
+
+func TestStatePruneCommand_Run(t *testing.T) {
+	t.Parallel()
+
+	var (
+		stdout    bytes.Buffer
+		gotDryRun bool
+	)
+	cmd := statePruneCmd{
+		Stdout: &stdout,
+		DryRun: true,
+		currentBackend: func(context.Context, *workspace.Project, display.Options) (backend.Backend, error) {
+			return &stubFileBackend{
+				PruneF: func(_ context.Context, dryRun bool) (*filestate.PruneReport, error) {
+					gotDryRun = dryRun
+					return &filestate.PruneReport{
+						DryRun:  true,
+						Stacks:  []string{"organization/proj/empty"},
+						Skipped: []string{"organization/proj/busy"},
+					}, nil
+				},
+			}, nil
+		},
+	}
+
+	require.NoError(t, cmd.Run(context.Background()))
+	assert.True(t, gotDryRun)
+	assert.Equal(t,
+		"Would remove organization/proj/empty\n"+
+			"Skipped organization/proj/busy because it is locked\n"+
+			"Would remove 1 stack(s)\n",
+		stdout.String())
+}
+
+func TestStatePruneCommand_Run_unsupportedBackend(t *testing.T) {
+	t.Parallel()
+
+	var stdout bytes.Buffer
+	cmd := statePruneCmd{
+		Stdout: &stdout,
+		currentBackend: func(context.Context, *workspace.Project, display.Options) (backend.Backend, error) {
+			return &backend.MockBackend{}, nil
+		},
+	}
+
+	require.NoError(t, cmd.Run(context.Background()))
+	assert.Contains(t, stdout.String(), "Nothing to do")
+}
@@ -159,8 +159,25 @@ type stubFileBackend struct {
 	filestate.Backend
 
 	UpgradeF func(context.Context) error
+	VerifyF  func(context.Context) (*filestate.VerifyReport, error)
+	GCF      func(context.Context, filestate.GCOptions) (*filestate.GCReport, error)
+	PruneF   func(context.Context, bool) (*filestate.PruneReport, error)
 }
 
 func (f *stubFileBackend) Upgrade(ctx context.Context) error {
 	return f.UpgradeF(ctx)
 }
+
+func (f *stubFileBackend) Verify(
+	ctx context.Context, _ chan<- filestate.ProgressEvent,
+) (*filestate.VerifyReport, error) {
+	return f.VerifyF(ctx)
+}
+
+func (f *stubFileBackend) GC(ctx context.Context, opts filestate.GCOptions) (*filestate.GCReport, error) {
+	return f.GCF(ctx, opts)
+}
+
+func (f *stubFileBackend) PruneEmptyStacks(ctx context.Context, dryRun bool) (*filestate.PruneReport, error) {
+	return f.PruneF(ctx, dryRun)
+}
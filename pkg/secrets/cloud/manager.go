@@ -113,6 +113,22 @@ func newCloudSecretsManager(url string, encryptedDataKey []byte) (*Manager, erro
 	}, nil
 }
 
+// NewDataKey generates a new data key like the one used by the cloud secrets manager,
+// encrypted using the key management service at the given URL.
+func NewDataKey(url string) ([]byte, error) {
+	return generateNewDataKey(url)
+}
+
+// NewDataKeyCrypter returns a crypter for envelope encryption with the given data key,
+// which is first decrypted using the key management service at the given URL.
+func NewDataKeyCrypter(url string, encryptedDataKey []byte) (config.Crypter, error) {
+	m, err := newCloudSecretsManager(url, encryptedDataKey)
+	if err != nil {
+		return nil, err
+	}
+	return m.crypter, nil
+}
+
 // Manager is the secrets.Manager implementation for cloud key management services
 type Manager struct {
 	state   json.RawMessage
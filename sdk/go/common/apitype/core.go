@@ -199,6 +199,29 @@ type UntypedDeployment struct {
 	// permit round-tripping of stack contents when an older client is talking to a newer server.  If we unmarshaled
 	// the contents, and then remarshaled them, we could end up losing important information.
 	Deployment json.RawMessage `json:"deployment,omitempty"`
+	// StateStore describes the self-managed state store that the deployment was exported from, if any.
+	StateStore *StateStoreV1 `json:"stateStore,omitempty"`
+	// Redacted is true if the secrets of the deployment were replaced with placeholders when it was exported,
+	// so that it can be shared but must not be imported.
+	Redacted bool `json:"redacted,omitempty"`
+}
+
+const (
+	// StateStoreLayoutLegacy is the layout of self-managed state stores
+	// where stacks are not scoped to projects.
+	StateStoreLayoutLegacy = "legacy"
+	// StateStoreLayoutProject is the layout of self-managed state stores
+	// where each stack belongs to a project.
+	StateStoreLayoutProject = "project"
+)
+
+// StateStoreV1 describes the layout of a self-managed state store.
+type StateStoreV1 struct {
+	// Version is the version of the state store recorded in its metadata.
+	Version int `json:"version"`
+	// Layout is how stacks are laid out in the state store,
+	// either StateStoreLayoutLegacy or StateStoreLayoutProject.
+	Layout string `json:"layout"`
 }
 
 // ResourceV1 describes a Cloud resource constructed by Pulumi.
@@ -124,6 +124,7 @@ func (m *yamlMarshaler) Unmarshal(data []byte, v interface{}) error {
 
 type gzipMarshaller struct {
 	inner Marshaler
+	level int
 }
 
 func (m *gzipMarshaller) Marshal(v interface{}) ([]byte, error) {
@@ -133,7 +134,10 @@ func (m *gzipMarshaller) Marshal(v interface{}) ([]byte, error) {
 	}
 
 	var buf bytes.Buffer
-	writer := gzip.NewWriter(&buf)
+	writer, err := gzip.NewWriterLevel(&buf, m.level)
+	if err != nil {
+		return nil, err
+	}
 	defer writer.Close()
 	_, err = writer.Write(b)
 	if err != nil {
@@ -169,9 +173,14 @@ func IsCompressed(buf []byte) bool {
 }
 
 func Gzip(m Marshaler) Marshaler {
-	_, alreadyGZIP := m.(*gzipMarshaller)
-	if alreadyGZIP {
-		return m
+	return GzipLevel(m, gzip.DefaultCompression)
+}
+
+// GzipLevel is like Gzip, but compresses with the given compression level.
+// The level must be one of the levels accepted by gzip.NewWriterLevel.
+func GzipLevel(m Marshaler, level int) Marshaler {
+	if gm, alreadyGZIP := m.(*gzipMarshaller); alreadyGZIP {
+		m = gm.inner
 	}
-	return &gzipMarshaller{m}
+	return &gzipMarshaller{inner: m, level: level}
 }
@@ -76,4 +76,160 @@ var (
 
 	SelfManagedStateLegacyLayout = env.Bool("SELF_MANAGED_STATE_LEGACY_LAYOUT",
 		"Uses the legacy layout for new buckets, which currently default to project-scoped stacks.")
+
+	SelfManagedStateAllowNewer = env.Bool("SELF_MANAGED_STATE_ALLOW_NEWER",
+		"Allows read-only access to state stores written by newer versions of the CLI.")
+
+	SelfManagedStateGzipLevel = env.Int("SELF_MANAGED_STATE_GZIP_LEVEL",
+		"The compression level used for gzip-compressed state files, "+
+			"from 1 (best speed) to 9 (best compression). Uses the gzip default if unset.")
+
+	SelfManagedStateLockTTL = env.String("SELF_MANAGED_STATE_LOCK_TTL",
+		"How long a stack lock may be held before it's considered stale and reclaimed, e.g. \"1h\". "+
+			"Locks never go stale if unset.")
+
+	SelfManagedStateChecksums = env.Bool("SELF_MANAGED_STATE_CHECKSUMS",
+		"Records a SHA-256 checksum alongside each state file and verifies it when the file is read.")
+
+	SelfManagedStateSnapshotRetentionDays = env.Int("SELF_MANAGED_STATE_SNAPSHOT_RETENTION_DAYS",
+		"Deletes stack snapshots older than this many days when a new snapshot is taken. "+
+			"Snapshots are kept regardless of age if unset.")
+
+	SelfManagedStateSnapshotRetentionCount = env.Int("SELF_MANAGED_STATE_SNAPSHOT_RETENTION_COUNT",
+		"The maximum number of snapshots kept for each stack. "+
+			"Older snapshots are deleted when a new snapshot is taken. There is no limit if unset.")
+
+	SelfManagedStateListConcurrency = env.Int("SELF_MANAGED_STATE_LIST_CONCURRENCY",
+		"The maximum number of stacks whose state is read concurrently when listing stacks, "+
+			"and of history entries read concurrently when fetching a range of the history of a stack. Defaults to 8.")
+
+	SelfManagedStateRetryAttempts = env.Int("SELF_MANAGED_STATE_RETRY_ATTEMPTS",
+		"How many times a request to the state store is attempted if it fails with a transient error. "+
+			"Defaults to 5. Set to 1 to disable retries.")
+
+	SelfManagedStateRetryDelay = env.String("SELF_MANAGED_STATE_RETRY_DELAY",
+		"How long to wait before retrying a failed request to the state store, e.g. \"100ms\". "+
+			"The delay doubles with each retry.")
+
+	SelfManagedStateEncryptionPassphrase = env.String("SELF_MANAGED_STATE_ENCRYPTION_PASSPHRASE",
+		"The passphrase used to encrypt state files of new self-managed state stores, "+
+			"and to decrypt them for stores encrypted with a passphrase.")
+
+	SelfManagedStateEncryptionKey = env.String("SELF_MANAGED_STATE_ENCRYPTION_KEY",
+		"The URL of a key management service key, e.g. \"awskms://alias/my-key\", "+
+			"used to encrypt state files of new self-managed state stores.")
+
+	SelfManagedStateMirrorURL = env.String("SELF_MANAGED_STATE_MIRROR_URL",
+		"The URL of a second state store, e.g. \"gs://my-mirror\", "+
+			"that all writes to the self-managed state store are replicated to.")
+
+	SelfManagedStateMirrorFallback = env.Bool("SELF_MANAGED_STATE_MIRROR_FALLBACK",
+		"Read from the mirror state store if reading from the primary state store fails.")
+
+	SelfManagedStateMetaFormat = env.String("SELF_MANAGED_STATE_META_FORMAT",
+		`The format of the metadata file of new state stores: "yaml" (default) or "json".`)
+
+	SelfManagedStateConditionalWrites = env.Bool("SELF_MANAGED_STATE_CONDITIONAL_WRITES",
+		"Fail writes of state files that were modified by another process since they were read, "+
+			"if the storage provider supports it.")
+
+	SelfManagedStateOperationTimeout = env.String("SELF_MANAGED_STATE_OPERATION_TIMEOUT",
+		"How long to wait for a single request to the state store before abandoning it, e.g. \"30s\". "+
+			"Defaults to 5m. Set to 0 to wait indefinitely.")
+
+	SelfManagedStateNativeVersioning = env.Bool("SELF_MANAGED_STATE_NATIVE_VERSIONING",
+		"Rely on object versioning of the storage provider for prior checkpoints "+
+			"instead of copying them to the history directory. Supported for S3 and GCS buckets.")
+
+	SelfManagedStateRecoverFromHistory = env.Bool("SELF_MANAGED_STATE_RECOVER_FROM_HISTORY",
+		"Load the checkpoint of the most recent update of a stack if its current checkpoint is missing or corrupt.")
+
+	SelfManagedStateThinHistory = env.Bool("SELF_MANAGED_STATE_THIN_HISTORY",
+		"Save the changes to resources since the prior update in the history of a stack "+
+			"instead of a full copy of its checkpoint.")
+
+	SelfManagedStateCheckpointFormat = env.String("SELF_MANAGED_STATE_CHECKPOINT_FORMAT",
+		`The JSON format of checkpoint files: "pretty" (the default) to indent them, or "compact".`)
+
+	SelfManagedStateNoInit = env.Bool("SELF_MANAGED_STATE_NO_INIT",
+		"Don't write a metadata file to empty state stores when they're opened. "+
+			"They're treated as legacy stores until they're initialized explicitly.")
+
+	SelfManagedStateStrictLayout = env.Bool("SELF_MANAGED_STATE_STRICT_LAYOUT",
+		"Fail to open state stores with project-scoped stacks that also have legacy stack files, "+
+			"instead of warning about them.")
+
+	SelfManagedStateCheckpointMetadata = env.String("SELF_MANAGED_STATE_CHECKPOINT_METADATA",
+		"A comma-separated list of key=value pairs of custom metadata to attach to checkpoint files.")
+
+	SelfManagedStateHistoryRetentionCount = env.Int("SELF_MANAGED_STATE_HISTORY_RETENTION_COUNT",
+		"The number of updates kept in the history of a stack. "+
+			"Older updates are removed after every successful update. 0 keeps only the latest update.")
+
+	SelfManagedStateVerifyWrites = env.Bool("SELF_MANAGED_STATE_VERIFY_WRITES",
+		"Read checkpoint files back after writing them, and fail if they differ from what was written.")
+
+	SelfManagedStateDedupHistory = env.Bool("SELF_MANAGED_STATE_DEDUP_HISTORY",
+		"Don't copy the checkpoint of an update into the history of a stack "+
+			"if its resources are unchanged since the prior update.")
+
+	SelfManagedStateGzipHistory = env.Bool("SELF_MANAGED_STATE_GZIP_HISTORY",
+		"Compress new entries in the history of a stack with gzip, even if checkpoints aren't compressed. "+
+			"Entries saved before are read either way.")
+
+	SelfManagedStateSecretsProvider = env.String("SELF_MANAGED_STATE_SECRETS_PROVIDER",
+		`The secrets provider that new self-managed state stores record in their metadata file, `+
+			`e.g. "passphrase" or "awskms://alias/my-key". `+
+			`Opening the store or saving a stack with a different secrets provider is warned about.`)
+
+	SelfManagedStateStrictSecretsProvider = env.Bool("SELF_MANAGED_STATE_STRICT_SECRETS_PROVIDER",
+		"Fail to open state stores or save stacks with a secrets provider "+
+			"other than the one recorded in the metadata file of the store, instead of warning about it.")
+
+	SelfManagedStateConsistencyTimeout = env.String("SELF_MANAGED_STATE_CONSISTENCY_TIMEOUT",
+		"How long to wait for a checkpoint file to be served with its new contents after it's written, e.g. \"10s\", "+
+			"on storage providers that are eventually consistent. Writes fail if it isn't by then. Disabled by default.")
+
+	SelfManagedStateMetaIndent = env.String("SELF_MANAGED_STATE_META_INDENT",
+		"The number of spaces, from 2 to 9, that the metadata file of the state store is indented with. Defaults to 4.")
+
+	SelfManagedStateKeyTemplate = env.String("SELF_MANAGED_STATE_KEY_TEMPLATE",
+		`The path that the files of each stack are kept at in new state stores, e.g. "compliance/{project}/env-{stack}". `+
+			`Defaults to "{project}/{stack}". It's recorded in the metadata file, and can't be changed later.`)
+
+	SelfManagedStateDescription = env.String("SELF_MANAGED_STATE_DESCRIPTION",
+		"A free-text description that new self-managed state stores record in their metadata file, "+
+			"shown when logging in to them.")
+
+	SelfManagedStateEnvironment = env.String("SELF_MANAGED_STATE_ENVIRONMENT",
+		`A label such as "production" that new self-managed state stores record in their metadata file, `+
+			`shown when logging in to them.`)
+
+	SelfManagedStateSoftDelete = env.Bool("SELF_MANAGED_STATE_SOFT_DELETE",
+		"Moves the files of removed stacks to .pulumi/trash instead of deleting them, "+
+			"so that they can be restored later.")
+
+	SelfManagedStateTrashRetentionDays = env.Int("SELF_MANAGED_STATE_TRASH_RETENTION_DAYS",
+		"Permanently deletes stacks that were moved to the trash more than this many days ago "+
+			"when another stack is removed. Removed stacks are kept regardless of age if unset.")
+
+	SelfManagedStateDedupSnapshots = env.Bool("SELF_MANAGED_STATE_DEDUP_SNAPSHOTS",
+		"Stores the checkpoints of stack snapshots in .pulumi/objects by their SHA-256 checksum, "+
+			"so that identical checkpoints are only stored once.")
+
+	SelfManagedStateDeleteConcurrency = env.Int("SELF_MANAGED_STATE_DELETE_CONCURRENCY",
+		"The maximum number of files deleted concurrently when removing a stack "+
+			"from a state store that can't delete files in bulk. Defaults to 16.")
+
+	SelfManagedStateSSEAlgorithm = env.String("SELF_MANAGED_STATE_SSE_ALGORITHM",
+		"The S3 server-side encryption algorithm applied to every object written to the state store: "+
+			"AES256, aws:kms, or aws:kms:dsse.")
+
+	SelfManagedStateSSEKMSKeyID = env.String("SELF_MANAGED_STATE_SSE_KMS_KEY_ID",
+		"The KMS key that the storage provider encrypts every object written to the state store with. "+
+			"An AWS KMS key ID, ARN, or alias for S3, or a Cloud KMS key name for Google Cloud Storage.")
+
+	SelfManagedStateFsync = env.Bool("SELF_MANAGED_STATE_FSYNC",
+		"Flush every file written to a file:// state store, and its directory, "+
+			"to stable storage before reporting the write as successful.")
 )